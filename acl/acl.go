@@ -49,6 +49,10 @@ type ACL interface {
 	// for a given node.
 	AgentWrite(string) bool
 
+	// CrossDCWrite determines if mutating requests can be sent on to
+	// another datacenter when the local one refuses remote writes.
+	CrossDCWrite() bool
+
 	// EventRead determines if a specific event can be queried.
 	EventRead(string) bool
 
@@ -88,6 +92,21 @@ type ACL interface {
 	// functions can be used.
 	OperatorWrite() bool
 
+	// OperatorRaftRead determines if the Raft configuration can be read.
+	OperatorRaftRead() bool
+
+	// OperatorRaftWrite determines if the Raft configuration can be
+	// changed, such as by removing peers.
+	OperatorRaftWrite() bool
+
+	// OperatorAutopilotRead determines if the Autopilot configuration and
+	// server health can be read.
+	OperatorAutopilotRead() bool
+
+	// OperatorAutopilotWrite determines if the Autopilot configuration can
+	// be changed.
+	OperatorAutopilotWrite() bool
+
 	// PrepardQueryRead determines if a specific prepared query can be read
 	// to show its contents (this is not used for execution).
 	PreparedQueryRead(string) bool
@@ -138,6 +157,10 @@ func (s *StaticACL) AgentWrite(string) bool {
 	return s.defaultAllow
 }
 
+func (s *StaticACL) CrossDCWrite() bool {
+	return s.allowManage
+}
+
 func (s *StaticACL) EventRead(string) bool {
 	return s.defaultAllow
 }
@@ -182,6 +205,22 @@ func (s *StaticACL) OperatorWrite() bool {
 	return s.defaultAllow
 }
 
+func (s *StaticACL) OperatorRaftRead() bool {
+	return s.defaultAllow
+}
+
+func (s *StaticACL) OperatorRaftWrite() bool {
+	return s.defaultAllow
+}
+
+func (s *StaticACL) OperatorAutopilotRead() bool {
+	return s.defaultAllow
+}
+
+func (s *StaticACL) OperatorAutopilotWrite() bool {
+	return s.defaultAllow
+}
+
 func (s *StaticACL) PreparedQueryRead(string) bool {
 	return s.defaultAllow
 }
@@ -274,6 +313,15 @@ type PolicyACL struct {
 
 	// operatorRule contains the operator policies.
 	operatorRule string
+
+	// operatorRaftRule and operatorAutopilotRule narrow the operator
+	// policy for the Raft and Autopilot endpoints. If they're not set, the
+	// operator policy applies.
+	operatorRaftRule      string
+	operatorAutopilotRule string
+
+	// crossDCRule contains the cross-datacenter policy.
+	crossDCRule string
 }
 
 // New is used to construct a policy based ACL from a set of policies
@@ -328,8 +376,13 @@ func New(parent ACL, policy *Policy) (*PolicyACL, error) {
 	// Load the keyring policy
 	p.keyringRule = policy.Keyring
 
-	// Load the operator policy
+	// Load the operator policies
 	p.operatorRule = policy.Operator
+	p.operatorRaftRule = policy.OperatorRaft
+	p.operatorAutopilotRule = policy.OperatorAutopilot
+
+	// Load the cross-datacenter policy
+	p.crossDCRule = policy.CrossDC
 
 	return p, nil
 }
@@ -387,6 +440,15 @@ func (p *PolicyACL) Snapshot() bool {
 	return p.parent.Snapshot()
 }
 
+// CrossDCWrite determines if mutating requests can be sent on to another
+// datacenter when the local one refuses remote writes.
+func (p *PolicyACL) CrossDCWrite() bool {
+	if p.crossDCRule == PolicyWrite {
+		return true
+	}
+	return p.parent.CrossDCWrite()
+}
+
 // EventRead is used to determine if the policy allows for a
 // specific user event to be read.
 func (p *PolicyACL) EventRead(name string) bool {
@@ -561,6 +623,57 @@ func (p *PolicyACL) OperatorWrite() bool {
 	return p.parent.OperatorWrite()
 }
 
+// OperatorRaftRead determines if the Raft configuration can be read.
+func (p *PolicyACL) OperatorRaftRead() bool {
+	switch p.operatorArea(p.operatorRaftRule) {
+	case PolicyRead, PolicyWrite:
+		return true
+	case PolicyDeny:
+		return false
+	default:
+		return p.parent.OperatorRaftRead()
+	}
+}
+
+// OperatorRaftWrite determines if the Raft configuration can be changed.
+func (p *PolicyACL) OperatorRaftWrite() bool {
+	if p.operatorArea(p.operatorRaftRule) == PolicyWrite {
+		return true
+	}
+	return p.parent.OperatorRaftWrite()
+}
+
+// OperatorAutopilotRead determines if the Autopilot configuration and server
+// health can be read.
+func (p *PolicyACL) OperatorAutopilotRead() bool {
+	switch p.operatorArea(p.operatorAutopilotRule) {
+	case PolicyRead, PolicyWrite:
+		return true
+	case PolicyDeny:
+		return false
+	default:
+		return p.parent.OperatorAutopilotRead()
+	}
+}
+
+// OperatorAutopilotWrite determines if the Autopilot configuration can be
+// changed.
+func (p *PolicyACL) OperatorAutopilotWrite() bool {
+	if p.operatorArea(p.operatorAutopilotRule) == PolicyWrite {
+		return true
+	}
+	return p.parent.OperatorAutopilotWrite()
+}
+
+// operatorArea returns the rule for one area of the operator endpoints,
+// which is the operator rule unless the area has its own.
+func (p *PolicyACL) operatorArea(rule string) string {
+	if rule != "" {
+		return rule
+	}
+	return p.operatorRule
+}
+
 // PreparedQueryRead checks if reading (listing) of a prepared query is
 // allowed - this isn't execution, just listing its contents.
 func (p *PolicyACL) PreparedQueryRead(prefix string) bool {
@@ -47,6 +47,9 @@ func TestStaticACL(t *testing.T) {
 	if !all.AgentWrite("foobar") {
 		t.Fatalf("should allow")
 	}
+	if all.CrossDCWrite() {
+		t.Fatalf("should not allow")
+	}
 	if !all.EventRead("foobar") {
 		t.Fatalf("should allow")
 	}
@@ -77,6 +80,18 @@ func TestStaticACL(t *testing.T) {
 	if !all.OperatorWrite() {
 		t.Fatalf("should allow")
 	}
+	if !all.OperatorRaftRead() {
+		t.Fatalf("should allow")
+	}
+	if !all.OperatorRaftWrite() {
+		t.Fatalf("should allow")
+	}
+	if !all.OperatorAutopilotRead() {
+		t.Fatalf("should allow")
+	}
+	if !all.OperatorAutopilotWrite() {
+		t.Fatalf("should allow")
+	}
 	if !all.PreparedQueryRead("foobar") {
 		t.Fatalf("should allow")
 	}
@@ -111,6 +126,9 @@ func TestStaticACL(t *testing.T) {
 	if none.AgentWrite("foobar") {
 		t.Fatalf("should not allow")
 	}
+	if none.CrossDCWrite() {
+		t.Fatalf("should not allow")
+	}
 	if none.EventRead("foobar") {
 		t.Fatalf("should not allow")
 	}
@@ -147,6 +165,18 @@ func TestStaticACL(t *testing.T) {
 	if none.OperatorWrite() {
 		t.Fatalf("should not allow")
 	}
+	if none.OperatorRaftRead() {
+		t.Fatalf("should not allow")
+	}
+	if none.OperatorRaftWrite() {
+		t.Fatalf("should not allow")
+	}
+	if none.OperatorAutopilotRead() {
+		t.Fatalf("should not allow")
+	}
+	if none.OperatorAutopilotWrite() {
+		t.Fatalf("should not allow")
+	}
 	if none.PreparedQueryRead("foobar") {
 		t.Fatalf("should not allow")
 	}
@@ -181,6 +211,9 @@ func TestStaticACL(t *testing.T) {
 	if !manage.AgentWrite("foobar") {
 		t.Fatalf("should allow")
 	}
+	if !manage.CrossDCWrite() {
+		t.Fatalf("should allow")
+	}
 	if !manage.EventRead("foobar") {
 		t.Fatalf("should allow")
 	}
@@ -211,6 +244,18 @@ func TestStaticACL(t *testing.T) {
 	if !manage.OperatorWrite() {
 		t.Fatalf("should allow")
 	}
+	if !manage.OperatorRaftRead() {
+		t.Fatalf("should allow")
+	}
+	if !manage.OperatorRaftWrite() {
+		t.Fatalf("should allow")
+	}
+	if !manage.OperatorAutopilotRead() {
+		t.Fatalf("should allow")
+	}
+	if !manage.OperatorAutopilotWrite() {
+		t.Fatalf("should allow")
+	}
 	if !manage.PreparedQueryRead("foobar") {
 		t.Fatalf("should allow")
 	}
@@ -698,6 +743,97 @@ func TestPolicyACL_Operator(t *testing.T) {
 	}
 }
 
+func TestPolicyACL_OperatorAreas(t *testing.T) {
+	type areacase struct {
+		operator, raft, autopilot                          string
+		raftRead, raftWrite, autopilotRead, autopilotWrite bool
+	}
+	cases := []areacase{
+		// Nothing set falls through to the parent.
+		{"", "", "", false, false, false, false},
+
+		// The operator policy covers everything that isn't set.
+		{PolicyRead, "", "", true, false, true, false},
+		{PolicyWrite, "", "", true, true, true, true},
+		{PolicyDeny, "", "", false, false, false, false},
+
+		// Each area can be given on its own.
+		{"", PolicyRead, "", true, false, false, false},
+		{"", "", PolicyWrite, false, false, true, true},
+
+		// Or narrow the operator policy.
+		{PolicyWrite, PolicyRead, "", true, false, true, true},
+		{PolicyWrite, "", PolicyDeny, true, true, false, false},
+		{PolicyRead, PolicyWrite, "", true, true, true, false},
+	}
+	for _, c := range cases {
+		acl, err := New(DenyAll(), &Policy{
+			Operator:          c.operator,
+			OperatorRaft:      c.raft,
+			OperatorAutopilot: c.autopilot,
+		})
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		if acl.OperatorRaftRead() != c.raftRead ||
+			acl.OperatorRaftWrite() != c.raftWrite ||
+			acl.OperatorAutopilotRead() != c.autopilotRead ||
+			acl.OperatorAutopilotWrite() != c.autopilotWrite {
+			t.Fatalf("bad: %#v", c)
+		}
+	}
+
+	// Unset areas should come from the parent.
+	parent, err := New(DenyAll(), &Policy{OperatorRaft: PolicyWrite})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	acl, err := New(parent, &Policy{OperatorAutopilot: PolicyRead})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if !acl.OperatorRaftWrite() || !acl.OperatorAutopilotRead() || acl.OperatorAutopilotWrite() {
+		t.Fatalf("bad")
+	}
+
+	// The keyring has its own policy, which operator doesn't grant.
+	acl, err = New(DenyAll(), &Policy{Operator: PolicyWrite})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if acl.KeyringRead() || acl.KeyringWrite() {
+		t.Fatalf("bad")
+	}
+	acl, err = New(DenyAll(), &Policy{Keyring: PolicyRead})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if !acl.KeyringRead() || acl.KeyringWrite() || acl.OperatorRaftRead() {
+		t.Fatalf("bad")
+	}
+}
+
+func TestPolicyACL_CrossDC(t *testing.T) {
+	cases := []struct {
+		inp   string
+		write bool
+	}{
+		{"", false},
+		{PolicyRead, false},
+		{PolicyWrite, true},
+		{PolicyDeny, false},
+	}
+	for _, c := range cases {
+		acl, err := New(DenyAll(), &Policy{CrossDC: c.inp})
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		if acl.CrossDCWrite() != c.write {
+			t.Fatalf("bad: %#v", c)
+		}
+	}
+}
+
 func TestPolicyACL_Node(t *testing.T) {
 	deny := DenyAll()
 	policyRoot := &Policy{
@@ -21,6 +21,7 @@ type aclEntry struct {
 // Cache is used to implement policy and ACL caching
 type Cache struct {
 	faultfn     FaultFunc
+	defaults    map[string]string
 	aclCache    *lru.TwoQueueCache // Cache id -> acl
 	policyCache *lru.TwoQueueCache // Cache policy -> acl
 	ruleCache   *lru.TwoQueueCache // Cache rules -> policy
@@ -28,6 +29,12 @@ type Cache struct {
 
 // NewCache constructs a new policy and ACL cache of a given size
 func NewCache(size int, faultfn FaultFunc) (*Cache, error) {
+	return NewCacheWithDefaults(size, faultfn, nil)
+}
+
+// NewCacheWithDefaults is like NewCache, but the allow and deny root
+// policies use the given per-type defaults, see RootACLWithDefaults.
+func NewCacheWithDefaults(size int, faultfn FaultFunc, defaults map[string]string) (*Cache, error) {
 	if size <= 0 {
 		return nil, fmt.Errorf("Must provide positive cache size")
 	}
@@ -49,6 +56,7 @@ func NewCache(size int, faultfn FaultFunc) (*Cache, error) {
 
 	c := &Cache{
 		faultfn:     faultfn,
+		defaults:    defaults,
 		aclCache:    ac,
 		policyCache: pc,
 		ruleCache:   rc,
@@ -140,7 +148,7 @@ func (c *Cache) GetACL(id string) (ACL, error) {
 		}
 
 		// Get the parent ACL
-		parent := RootACL(parentID)
+		parent := RootACLWithDefaults(parentID, c.defaults)
 		if parent == nil {
 			parent, err = c.GetACL(parentID)
 			if err != nil {
@@ -0,0 +1,166 @@
+package acl
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DefaultKV is the resource type for the key/value store in per-type default
+// policies, which is named after the store rather than the key rule. The
+// other types use the Resource constants.
+const DefaultKV = "kv"
+
+// defaultTypes are all the resource types that can have a default.
+var defaultTypes = []string{
+	DefaultKV,
+	ResourceService,
+	ResourceNode,
+	ResourceSession,
+	ResourcePreparedQuery,
+	ResourceEvent,
+	ResourceKeyring,
+}
+
+// ValidateDefaults returns an error if the given per-type default policies
+// name an unknown resource type, or a policy other than allow or deny.
+func ValidateDefaults(defaults map[string]string) error {
+	for kind, policy := range defaults {
+		known := false
+		for _, t := range defaultTypes {
+			if kind == t {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("Unknown resource type %q for default ACL policy, must be one of %s",
+				kind, strings.Join(defaultTypes, ", "))
+		}
+		if policy != "allow" && policy != "deny" {
+			return fmt.Errorf("Unsupported default ACL policy %q for %s", policy, kind)
+		}
+	}
+	return nil
+}
+
+// EffectiveDefaults returns the default policy for each resource type that can
+// have its own, using the global default for the ones that don't.
+func EffectiveDefaults(global string, defaults map[string]string) map[string]string {
+	effective := make(map[string]string, len(defaultTypes))
+	for _, kind := range defaultTypes {
+		if policy, ok := defaults[kind]; ok {
+			effective[kind] = policy
+		} else {
+			effective[kind] = global
+		}
+	}
+	return effective
+}
+
+// DefaultsID returns a string that identifies the given per-type defaults,
+// which is the same for equal maps. This is empty if there aren't any.
+func DefaultsID(defaults map[string]string) string {
+	var parts []string
+	for kind, policy := range defaults {
+		parts = append(parts, kind+"="+policy)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// DefaultsACL is a root ACL with its own default policy for some resource
+// types. Everything else falls back to the global default.
+type DefaultsACL struct {
+	// ACL is the global default.
+	ACL
+
+	key, service, node, session, query, event, keyring ACL
+}
+
+// RootACLWithDefaults is like RootACL, but the allow and deny policies are
+// overridden for the resource types in the given defaults. Management isn't
+// affected, since it allows everything anyway.
+func RootACLWithDefaults(id string, defaults map[string]string) ACL {
+	root := RootACL(id)
+	if root == nil || id == "manage" || len(defaults) == 0 {
+		return root
+	}
+
+	pick := func(kind string) ACL {
+		if policy := RootACL(defaults[kind]); policy != nil && policy != manageAll {
+			return policy
+		}
+		return root
+	}
+	return &DefaultsACL{
+		ACL:     root,
+		key:     pick(DefaultKV),
+		service: pick(ResourceService),
+		node:    pick(ResourceNode),
+		session: pick(ResourceSession),
+		query:   pick(ResourcePreparedQuery),
+		event:   pick(ResourceEvent),
+		keyring: pick(ResourceKeyring),
+	}
+}
+
+func (d *DefaultsACL) EventRead(name string) bool {
+	return d.event.EventRead(name)
+}
+
+func (d *DefaultsACL) EventWrite(name string) bool {
+	return d.event.EventWrite(name)
+}
+
+func (d *DefaultsACL) KeyRead(key string) bool {
+	return d.key.KeyRead(key)
+}
+
+func (d *DefaultsACL) KeyWrite(key string) bool {
+	return d.key.KeyWrite(key)
+}
+
+func (d *DefaultsACL) KeyWritePrefix(prefix string) bool {
+	return d.key.KeyWritePrefix(prefix)
+}
+
+func (d *DefaultsACL) KeyringRead() bool {
+	return d.keyring.KeyringRead()
+}
+
+func (d *DefaultsACL) KeyringWrite() bool {
+	return d.keyring.KeyringWrite()
+}
+
+func (d *DefaultsACL) NodeRead(name string) bool {
+	return d.node.NodeRead(name)
+}
+
+func (d *DefaultsACL) NodeWrite(name string) bool {
+	return d.node.NodeWrite(name)
+}
+
+func (d *DefaultsACL) PreparedQueryRead(prefix string) bool {
+	return d.query.PreparedQueryRead(prefix)
+}
+
+func (d *DefaultsACL) PreparedQueryWrite(prefix string) bool {
+	return d.query.PreparedQueryWrite(prefix)
+}
+
+func (d *DefaultsACL) ServiceRead(name string) bool {
+	return d.service.ServiceRead(name)
+}
+
+func (d *DefaultsACL) ServiceWrite(name string) bool {
+	return d.service.ServiceWrite(name)
+}
+
+func (d *DefaultsACL) SessionRead(node string) bool {
+	return d.session.SessionRead(node)
+}
+
+func (d *DefaultsACL) SessionWrite(node string) bool {
+	return d.session.SessionWrite(node)
+}
@@ -0,0 +1,119 @@
+package acl
+
+import (
+	"testing"
+)
+
+func TestRootACLWithDefaults(t *testing.T) {
+	defaults := map[string]string{
+		DefaultKV:       "deny",
+		ResourceService: "allow",
+		ResourceKeyring: "deny",
+	}
+
+	// Without defaults, or for management, it's just the root ACL.
+	if RootACLWithDefaults("allow", nil) != AllowAll() {
+		t.Fatalf("should be allow all")
+	}
+	if RootACLWithDefaults("manage", defaults) != ManageAll() {
+		t.Fatalf("should be manage all")
+	}
+	if RootACLWithDefaults("nope", defaults) != nil {
+		t.Fatalf("should be nil")
+	}
+
+	// The types with defaults should use them, and the rest should fall
+	// back to the global default.
+	a := RootACLWithDefaults("deny", defaults)
+	if a.KeyRead("foo") || a.KeyWrite("foo") || a.KeyWritePrefix("foo") {
+		t.Fatalf("kv should be denied")
+	}
+	if !a.ServiceRead("foo") || !a.ServiceWrite("foo") {
+		t.Fatalf("service should be allowed")
+	}
+	if a.NodeRead("foo") || a.EventRead("foo") || a.SessionRead("foo") || a.PreparedQueryRead("foo") {
+		t.Fatalf("should fall back to deny")
+	}
+	if a.ACLList() || a.Snapshot() || a.OperatorRead() {
+		t.Fatalf("should not allow management or operator")
+	}
+
+	a = RootACLWithDefaults("allow", defaults)
+	if a.KeyRead("foo") || a.KeyringRead() {
+		t.Fatalf("should be denied")
+	}
+	if !a.NodeRead("foo") || !a.EventWrite("foo") || !a.OperatorRead() {
+		t.Fatalf("should fall back to allow")
+	}
+
+	// Token policies should use it as their parent.
+	policy, err := Parse(`key "foo/" { policy = "read" }`)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	token, err := New(a, policy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !token.KeyRead("foo/bar") || token.KeyRead("bar") {
+		t.Fatalf("bad")
+	}
+}
+
+func TestValidateDefaults(t *testing.T) {
+	if err := ValidateDefaults(nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ok := map[string]string{
+		DefaultKV:             "deny",
+		ResourceService:       "allow",
+		ResourceNode:          "allow",
+		ResourceSession:       "deny",
+		ResourcePreparedQuery: "deny",
+		ResourceEvent:         "allow",
+		ResourceKeyring:       "deny",
+	}
+	if err := ValidateDefaults(ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ValidateDefaults(map[string]string{"key": "deny"}); err == nil {
+		t.Fatalf("should fail")
+	}
+	if err := ValidateDefaults(map[string]string{DefaultKV: "manage"}); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestEffectiveDefaults(t *testing.T) {
+	effective := EffectiveDefaults("allow", map[string]string{DefaultKV: "deny"})
+	if len(effective) != len(defaultTypes) {
+		t.Fatalf("bad: %v", effective)
+	}
+	if effective[DefaultKV] != "deny" || effective[ResourceService] != "allow" {
+		t.Fatalf("bad: %v", effective)
+	}
+
+	if id := DefaultsID(map[string]string{"service": "allow", "kv": "deny"}); id != "kv=deny,service=allow" {
+		t.Fatalf("bad: %s", id)
+	}
+	if id := DefaultsID(nil); id != "" {
+		t.Fatalf("bad: %s", id)
+	}
+}
+
+func TestCache_Defaults(t *testing.T) {
+	faultfn := func(id string) (string, string, error) {
+		return "deny", `key "foo/" { policy = "read" }`, nil
+	}
+	c, err := NewCacheWithDefaults(16, faultfn, map[string]string{ResourceService: "allow"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	a, err := c.GetACL("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !a.ServiceRead("web") || a.NodeRead("node1") || !a.KeyRead("foo/bar") {
+		t.Fatalf("bad")
+	}
+}
@@ -0,0 +1,196 @@
+package acl
+
+import (
+	"fmt"
+)
+
+// These are the resources that can be probed with Allowed and Explain. They
+// are named after the rules that cover them, except for ResourceACL, which
+// is only allowed for management tokens.
+const (
+	ResourceACL               = "acl"
+	ResourceAgent             = "agent"
+	ResourceCrossDC           = "cross_dc"
+	ResourceEvent             = "event"
+	ResourceKey               = "key"
+	ResourceKeyring           = "keyring"
+	ResourceNode              = "node"
+	ResourceOperator          = "operator"
+	ResourceOperatorAutopilot = "operator_autopilot"
+	ResourceOperatorRaft      = "operator_raft"
+	ResourcePreparedQuery     = "query"
+	ResourceService           = "service"
+	ResourceSession           = "session"
+)
+
+// Allowed returns true if the ACL allows the given access, which is either
+// PolicyRead or PolicyWrite, to the given resource. The segment is the name of
+// the resource, like a key or a service name, and is ignored for resources
+// that don't have names. This makes the same check the endpoints make.
+func Allowed(a ACL, resource, segment, access string) (bool, error) {
+	var write bool
+	switch access {
+	case PolicyRead:
+	case PolicyWrite:
+		write = true
+	default:
+		return false, fmt.Errorf("Invalid access %q, must be %q or %q", access, PolicyRead, PolicyWrite)
+	}
+
+	switch resource {
+	case ResourceACL:
+		if write {
+			return a.ACLModify(), nil
+		}
+		return a.ACLList(), nil
+	case ResourceAgent:
+		if write {
+			return a.AgentWrite(segment), nil
+		}
+		return a.AgentRead(segment), nil
+	case ResourceCrossDC:
+		if write {
+			return a.CrossDCWrite(), nil
+		}
+		return false, fmt.Errorf("Resource %q only has %q access", resource, PolicyWrite)
+	case ResourceEvent:
+		if write {
+			return a.EventWrite(segment), nil
+		}
+		return a.EventRead(segment), nil
+	case ResourceKey:
+		if write {
+			return a.KeyWrite(segment), nil
+		}
+		return a.KeyRead(segment), nil
+	case ResourceKeyring:
+		if write {
+			return a.KeyringWrite(), nil
+		}
+		return a.KeyringRead(), nil
+	case ResourceNode:
+		if write {
+			return a.NodeWrite(segment), nil
+		}
+		return a.NodeRead(segment), nil
+	case ResourceOperator:
+		if write {
+			return a.OperatorWrite(), nil
+		}
+		return a.OperatorRead(), nil
+	case ResourceOperatorAutopilot:
+		if write {
+			return a.OperatorAutopilotWrite(), nil
+		}
+		return a.OperatorAutopilotRead(), nil
+	case ResourceOperatorRaft:
+		if write {
+			return a.OperatorRaftWrite(), nil
+		}
+		return a.OperatorRaftRead(), nil
+	case ResourcePreparedQuery:
+		if write {
+			return a.PreparedQueryWrite(segment), nil
+		}
+		return a.PreparedQueryRead(segment), nil
+	case ResourceService:
+		if write {
+			return a.ServiceWrite(segment), nil
+		}
+		return a.ServiceRead(segment), nil
+	case ResourceSession:
+		if write {
+			return a.SessionWrite(segment), nil
+		}
+		return a.SessionRead(segment), nil
+	default:
+		return false, fmt.Errorf("Invalid resource %q", resource)
+	}
+}
+
+// Explain describes what decides the given access to the given resource,
+// which is either the rule that matched, like `key "foo/" = "read"`, or the
+// root policy the check fell through to, like `root "deny"`. The arguments
+// are the same as for Allowed, and should be checked with it first.
+func Explain(a ACL, resource, segment, access string) string {
+	write := access == PolicyWrite
+	for {
+		switch v := a.(type) {
+		case *PolicyACL:
+			if rule := v.match(resource, segment, write); rule != "" {
+				return rule
+			}
+			a = v.parent
+		case *StaticACL:
+			switch {
+			case v.allowManage:
+				return `root "manage"`
+			case v.defaultAllow:
+				return `root "allow"`
+			default:
+				return `root "deny"`
+			}
+		default:
+			return fmt.Sprintf("%T", a)
+		}
+	}
+}
+
+// match returns the rule in this policy that decides the given access, or an
+// empty string if the check is passed on to the parent. This has to follow
+// the checks above it in this file.
+func (p *PolicyACL) match(resource, segment string, write bool) string {
+	prefixed := func(rules interface {
+		LongestPrefix(string) (string, interface{}, bool)
+	}) string {
+		if prefix, rule, ok := rules.LongestPrefix(segment); ok {
+			return fmt.Sprintf("%s %q = %q", resource, prefix, rule)
+		}
+		return ""
+	}
+
+	// Most of the rules without names only decide writes when they allow
+	// them, and leave the rest to the parent.
+	single := func(name, rule string) string {
+		if rule == "" || (write && rule != PolicyWrite) {
+			return ""
+		}
+		return fmt.Sprintf("%s = %q", name, rule)
+	}
+
+	switch resource {
+	case ResourceAgent:
+		return prefixed(p.agentRules)
+	case ResourceCrossDC:
+		if p.crossDCRule == PolicyWrite {
+			return fmt.Sprintf("%s = %q", resource, p.crossDCRule)
+		}
+	case ResourceEvent:
+		return prefixed(p.eventRules)
+	case ResourceKey:
+		return prefixed(p.keyRules)
+	case ResourceKeyring:
+		return single(resource, p.keyringRule)
+	case ResourceNode:
+		return prefixed(p.nodeRules)
+	case ResourceOperator:
+		return single(resource, p.operatorRule)
+	case ResourceOperatorAutopilot:
+		if p.operatorAutopilotRule != "" {
+			return single(resource, p.operatorAutopilotRule)
+		}
+		return single(ResourceOperator, p.operatorRule)
+	case ResourceOperatorRaft:
+		if p.operatorRaftRule != "" {
+			return single(resource, p.operatorRaftRule)
+		}
+		return single(ResourceOperator, p.operatorRule)
+	case ResourcePreparedQuery:
+		return prefixed(p.preparedQueryRules)
+	case ResourceService:
+		return prefixed(p.serviceRules)
+	case ResourceSession:
+		return prefixed(p.sessionRules)
+	}
+	return ""
+}
@@ -0,0 +1,84 @@
+package acl
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIntrospect(t *testing.T) {
+	policy, err := Parse(`
+key "" {
+	policy = "read"
+}
+key "foo/" {
+	policy = "write"
+}
+key "foo/private/" {
+	policy = "deny"
+}
+service "web" {
+	policy = "write"
+}
+operator = "read"
+operator_raft = "write"
+`)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	a, err := New(DenyAll(), policy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	type tcase struct {
+		resource, segment, access string
+		allowed                   bool
+		rule                      string
+	}
+	cases := []tcase{
+		{ResourceKey, "bar", PolicyRead, true, `key "" = "read"`},
+		{ResourceKey, "bar", PolicyWrite, false, `key "" = "read"`},
+		{ResourceKey, "foo/bar", PolicyWrite, true, `key "foo/" = "write"`},
+		{ResourceKey, "foo/private/bar", PolicyRead, false, `key "foo/private/" = "deny"`},
+		{ResourceService, "web-api", PolicyWrite, true, `service "web" = "write"`},
+		{ResourceService, "db", PolicyRead, false, `root "deny"`},
+		{ResourceOperator, "", PolicyRead, true, `operator = "read"`},
+
+		// A read rule doesn't decide writes, so they fall through.
+		{ResourceOperator, "", PolicyWrite, false, `root "deny"`},
+
+		// The Raft area has its own rule, and Autopilot falls back to the
+		// operator rule.
+		{ResourceOperatorRaft, "", PolicyWrite, true, `operator_raft = "write"`},
+		{ResourceOperatorAutopilot, "", PolicyRead, true, `operator = "read"`},
+
+		{ResourceACL, "", PolicyRead, false, `root "deny"`},
+	}
+	for _, c := range cases {
+		allowed, err := Allowed(a, c.resource, c.segment, c.access)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if allowed != c.allowed {
+			t.Fatalf("bad: %#v %v", c, allowed)
+		}
+		if rule := Explain(a, c.resource, c.segment, c.access); rule != c.rule {
+			t.Fatalf("bad: %#v %s", c, rule)
+		}
+	}
+
+	// Management tokens are explained by their root policy.
+	if rule := Explain(ManageAll(), ResourceACL, "", PolicyWrite); rule != `root "manage"` {
+		t.Fatalf("bad: %s", rule)
+	}
+
+	// Bad probes should be rejected.
+	_, err = Allowed(a, "nope", "", PolicyRead)
+	if err == nil || !strings.Contains(err.Error(), "Invalid resource") {
+		t.Fatalf("err: %v", err)
+	}
+	_, err = Allowed(a, ResourceKey, "foo", "list")
+	if err == nil || !strings.Contains(err.Error(), "Invalid access") {
+		t.Fatalf("err: %v", err)
+	}
+}
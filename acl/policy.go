@@ -15,16 +15,19 @@ const (
 // Policy is used to represent the policy specified by
 // an ACL configuration.
 type Policy struct {
-	ID              string                 `hcl:"-"`
-	Agents          []*AgentPolicy         `hcl:"agent,expand"`
-	Keys            []*KeyPolicy           `hcl:"key,expand"`
-	Nodes           []*NodePolicy          `hcl:"node,expand"`
-	Services        []*ServicePolicy       `hcl:"service,expand"`
-	Sessions        []*SessionPolicy       `hcl:"session,expand"`
-	Events          []*EventPolicy         `hcl:"event,expand"`
-	PreparedQueries []*PreparedQueryPolicy `hcl:"query,expand"`
-	Keyring         string                 `hcl:"keyring"`
-	Operator        string                 `hcl:"operator"`
+	ID                string                 `hcl:"-"`
+	Agents            []*AgentPolicy         `hcl:"agent,expand"`
+	Keys              []*KeyPolicy           `hcl:"key,expand"`
+	Nodes             []*NodePolicy          `hcl:"node,expand"`
+	Services          []*ServicePolicy       `hcl:"service,expand"`
+	Sessions          []*SessionPolicy       `hcl:"session,expand"`
+	Events            []*EventPolicy         `hcl:"event,expand"`
+	PreparedQueries   []*PreparedQueryPolicy `hcl:"query,expand"`
+	Keyring           string                 `hcl:"keyring"`
+	Operator          string                 `hcl:"operator"`
+	OperatorRaft      string                 `hcl:"operator_raft"`
+	OperatorAutopilot string                 `hcl:"operator_autopilot"`
+	CrossDC           string                 `hcl:"cross_dc"`
 }
 
 // AgentPolicy represents a policy for working with agent endpoints on nodes
@@ -187,5 +190,19 @@ func Parse(rules string) (*Policy, error) {
 		return nil, fmt.Errorf("Invalid operator policy: %#v", p.Operator)
 	}
 
+	// Validate the Raft and Autopilot operator policies - these are
+	// allowed to be empty, in which case the operator policy applies
+	if p.OperatorRaft != "" && !isPolicyValid(p.OperatorRaft) {
+		return nil, fmt.Errorf("Invalid operator_raft policy: %#v", p.OperatorRaft)
+	}
+	if p.OperatorAutopilot != "" && !isPolicyValid(p.OperatorAutopilot) {
+		return nil, fmt.Errorf("Invalid operator_autopilot policy: %#v", p.OperatorAutopilot)
+	}
+
+	// Validate the cross-datacenter policy - this one is allowed to be empty
+	if p.CrossDC != "" && !isPolicyValid(p.CrossDC) {
+		return nil, fmt.Errorf("Invalid cross_dc policy: %#v", p.CrossDC)
+	}
+
 	return p, nil
 }
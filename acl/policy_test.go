@@ -390,12 +390,37 @@ operator = ""
 	}
 }
 
+func TestACLPolicy_OperatorAreas(t *testing.T) {
+	inp := `
+operator = "read"
+operator_raft = "deny"
+operator_autopilot = "write"
+	`
+	exp := &Policy{
+		Operator:          PolicyRead,
+		OperatorRaft:      PolicyDeny,
+		OperatorAutopilot: PolicyWrite,
+	}
+
+	out, err := Parse(inp)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if !reflect.DeepEqual(out, exp) {
+		t.Fatalf("bad: %#v %#v", out, exp)
+	}
+}
+
 func TestACLPolicy_Bad_Policy(t *testing.T) {
 	cases := []string{
 		`agent "" { policy = "nope" }`,
+		`cross_dc = "nope"`,
 		`event "" { policy = "nope" }`,
 		`key "" { policy = "nope" }`,
 		`keyring = "nope"`,
+		`operator_autopilot = "nope"`,
+		`operator_raft = "nope"`,
 		`node "" { policy = "nope" }`,
 		`operator = "nope"`,
 		`query "" { policy = "nope" }`,
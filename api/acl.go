@@ -1,5 +1,9 @@
 package api
 
+import (
+	"time"
+)
+
 const (
 	// ACLCLientType is the client type token
 	ACLClientType = "client"
@@ -10,12 +14,19 @@ const (
 
 // ACLEntry is used to represent an ACL entry
 type ACLEntry struct {
-	CreateIndex uint64
-	ModifyIndex uint64
-	ID          string
-	Name        string
-	Type        string
-	Rules       string
+	CreateIndex  uint64
+	ModifyIndex  uint64
+	ID           string
+	Name         string
+	Type         string
+	Rules        string
+	Datacenters  []string
+	NodeIdentity string
+	RateLimit    float64
+	SessionLimit int
+	ShadowRules  string
+	LastUsed     time.Time
+	Uses         uint64
 }
 
 // ACL can be used to query the ACL endpoints
@@ -20,10 +20,22 @@ type CatalogService struct {
 	ServiceTags              []string
 	ServicePort              int
 	ServiceEnableTagOverride bool
+	ServiceMeta              map[string]string
+	ServiceKind              string
 	CreateIndex              uint64
 	ModifyIndex              uint64
 }
 
+// CatalogServiceSummary sums up the instances of a service, by health.
+type CatalogServiceSummary struct {
+	Name      string
+	Tags      []string
+	Instances int
+	Passing   int
+	Warning   int
+	Critical  int
+}
+
 type CatalogNode struct {
 	Node     *Node
 	Services map[string]*AgentService
@@ -38,6 +50,10 @@ type CatalogRegistration struct {
 	Datacenter      string
 	Service         *AgentService
 	Check           *AgentCheck
+
+	// Replace supersedes any existing instance of the service with the
+	// same ID on the node, along with its checks, in a single update.
+	Replace bool
 }
 
 type CatalogDeregistration struct {
@@ -148,6 +164,29 @@ func (c *Catalog) Services(q *QueryOptions) (map[string][]string, *QueryMeta, er
 	return out, qm, nil
 }
 
+// ServiceSummaries is used to query for all known services, along with the
+// number of instances of each in every health state
+func (c *Catalog) ServiceSummaries(q *QueryOptions) ([]*CatalogServiceSummary, *QueryMeta, error) {
+	r := c.c.newRequest("GET", "/v1/catalog/services")
+	r.setQueryOptions(q)
+	r.params.Set("summary", "")
+	rtt, resp, err := requireOK(c.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	var out []*CatalogServiceSummary
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, nil, err
+	}
+	return out, qm, nil
+}
+
 // Service is used to query catalog entries for a given service
 func (c *Catalog) Service(service, tag string, q *QueryOptions) ([]*CatalogService, *QueryMeta, error) {
 	r := c.c.newRequest("GET", "/v1/catalog/service/"+service)
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // KVPair is used to represent a single K/V entry
@@ -40,6 +41,17 @@ type KVPair struct {
 	// interactions with this key over the same session must specify the same
 	// session ID.
 	Session string
+
+	// CreatedBy and ModifiedBy identify the ACL tokens that created and last
+	// modified the key, and CreateTime and ModifyTime say when. The tokens
+	// are given as a hash, or "anonymous" for the anonymous token. These are
+	// only set if the servers have KV metadata turned on, and the tokens are
+	// only shown to management tokens. The times come from the leader's
+	// clock, so they're only advisory. These are read-only fields.
+	CreatedBy  string     `json:",omitempty"`
+	ModifiedBy string     `json:",omitempty"`
+	CreateTime *time.Time `json:",omitempty"`
+	ModifyTime *time.Time `json:",omitempty"`
 }
 
 // KVPairs is a list of KVPair objects
@@ -60,6 +72,8 @@ const (
 	KVGetTree      KVOp = "get-tree"
 	KVCheckSession KVOp = "check-session"
 	KVCheckIndex   KVOp = "check-index"
+	KVTxnLock      KVOp = "kv-lock"
+	KVTxnUnlock    KVOp = "kv-unlock"
 )
 
 // KVTxnOp defines a single operation inside a transaction.
@@ -276,6 +290,18 @@ func (k *KV) DeleteTree(prefix string, w *WriteOptions) (*WriteMeta, error) {
 	return qm, err
 }
 
+// DeleteTreeSkipTombstones is like DeleteTree, but leaves a single tombstone
+// for the whole prefix instead of one for each key. This is meant for
+// deleting very large trees, and needs an operator token.
+func (k *KV) DeleteTreeSkipTombstones(prefix string, w *WriteOptions) (*WriteMeta, error) {
+	params := map[string]string{
+		"recurse":         "",
+		"skip-tombstones": "",
+	}
+	_, qm, err := k.deleteInternal(prefix, params, w)
+	return qm, err
+}
+
 func (k *KV) deleteInternal(key string, params map[string]string, q *WriteOptions) (bool, *WriteMeta, error) {
 	r := k.c.newRequest("DELETE", "/v1/kv/"+strings.TrimPrefix(key, "/"))
 	r.setWriteOptions(q)
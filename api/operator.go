@@ -151,6 +151,10 @@ type ServerHealth struct {
 
 	// StableSince is the last time this server's Healthy value changed.
 	StableSince time.Time
+
+	// GossipDegraded is whether any of this server's gossip pools has more
+	// queued messages than its configured threshold.
+	GossipDegraded bool
 }
 
 // OperatorHealthReply is a representation of the overall health of the cluster
@@ -164,6 +168,10 @@ type OperatorHealthReply struct {
 
 	// Servers holds the health of each server.
 	Servers []ServerHealth
+
+	// Warnings holds any problems with the cluster as a whole that don't
+	// make it unhealthy, such as a flapping leader.
+	Warnings []string
 }
 
 // ReadableDuration is a duration type that is serialized to JSON in human readable format.
@@ -29,6 +29,16 @@ type SessionEntry struct {
 	LockDelay   time.Duration
 	Behavior    string
 	TTL         string
+
+	// ServiceChecks ties the session to checks belonging to specific
+	// service instances on the session's node.
+	ServiceChecks []ServiceCheck
+}
+
+// ServiceCheck refers to a health check registered for a service instance.
+type ServiceCheck struct {
+	ID        string
+	ServiceID string
 }
 
 // Session can be used to query the Session endpoints
@@ -62,6 +72,9 @@ func (s *Session) CreateNoChecks(se *SessionEntry, q *WriteOptions) (string, *Wr
 		if se.TTL != "" {
 			body["TTL"] = se.TTL
 		}
+		if len(se.ServiceChecks) > 0 {
+			body["ServiceChecks"] = se.ServiceChecks
+		}
 	}
 	return s.create(body, q)
 
@@ -92,6 +105,9 @@ func (s *Session) Create(se *SessionEntry, q *WriteOptions) (string, *WriteMeta,
 		if se.TTL != "" {
 			body["TTL"] = se.TTL
 		}
+		if len(se.ServiceChecks) > 0 {
+			body["ServiceChecks"] = se.ServiceChecks
+		}
 	}
 	return s.create(obj, q)
 }
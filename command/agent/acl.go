@@ -205,7 +205,7 @@ func (m *aclManager) lookupACL(agent *Agent, id string) (acl.ACL, error) {
 	if cached != nil && cached.ETag == reply.ETag {
 		compiled = cached.ACL
 	} else {
-		parent := acl.RootACL(reply.Parent)
+		parent := acl.RootACLWithDefaults(reply.Parent, reply.ParentDefaults)
 		if parent == nil {
 			parent, err = m.lookupACL(agent, reply.Parent)
 			if err != nil {
@@ -305,6 +305,18 @@ func (a *Agent) consulConfig() *consul.Config {
 	if a.config.Performance.RaftMultiplier > 0 {
 		base.ScaleRaft(a.config.Performance.RaftMultiplier)
 	}
+	if a.config.Performance.RPCMaxResultSize > 0 {
+		base.RPCMaxResultSize = a.config.Performance.RPCMaxResultSize
+	}
+	if a.config.Performance.RaftMaxEntrySize > 0 {
+		base.RaftMaxEntrySize = a.config.Performance.RaftMaxEntrySize
+	}
+	if a.config.Performance.ApplyBackoffQueueDepth > 0 {
+		base.ApplyBackoffQueueDepth = a.config.Performance.ApplyBackoffQueueDepth
+	}
+	if a.config.Performance.ApplyBackoffLatencyRaw != "" {
+		base.ApplyBackoffLatency = a.config.Performance.ApplyBackoffLatency
+	}
 
 	// Override with our config
 	if a.config.Datacenter != "" {
@@ -404,6 +416,9 @@ func (a *Agent) consulConfig() *consul.Config {
 	if a.config.ACLDefaultPolicy != "" {
 		base.ACLDefaultPolicy = a.config.ACLDefaultPolicy
 	}
+	if len(a.config.ACLDefaultPolicies) != 0 {
+		base.ACLDefaultPolicies = a.config.ACLDefaultPolicies
+	}
 	if a.config.ACLDownPolicy != "" {
 		base.ACLDownPolicy = a.config.ACLDownPolicy
 	}
@@ -416,6 +431,90 @@ func (a *Agent) consulConfig() *consul.Config {
 	if a.config.SessionTTLMinRaw != "" {
 		base.SessionTTLMin = a.config.SessionTTLMin
 	}
+	if a.config.SessionTTLJitterPercent != 0 {
+		base.SessionTTLJitterPercent = a.config.SessionTTLJitterPercent
+	}
+	if a.config.SessionLimitPerNode != 0 {
+		base.SessionLimitPerNode = a.config.SessionLimitPerNode
+	}
+	if a.config.RPCLogDedupWindowRaw != "" {
+		base.RPCLogDedupWindow = a.config.RPCLogDedupWindow
+	}
+	if len(a.config.RPCLogDedupExempt) != 0 {
+		base.RPCLogDedupExempt = a.config.RPCLogDedupExempt
+	}
+	if len(a.config.ServiceKinds) != 0 {
+		base.ServiceKinds = a.config.ServiceKinds
+	}
+	if a.config.StaleReadFenceRaw != "" {
+		base.StaleReadFenceDuration = a.config.StaleReadFence
+	}
+	if a.config.CatchUpThreshold != 0 {
+		base.CatchUpThreshold = a.config.CatchUpThreshold
+	}
+	if a.config.LeaderFlapThreshold != nil {
+		base.LeaderFlapThreshold = *a.config.LeaderFlapThreshold
+	}
+	if a.config.LeaderFlapWindowRaw != "" {
+		base.LeaderFlapWindow = a.config.LeaderFlapWindow
+	}
+	if a.config.MaxTombstonesPerApply != 0 {
+		base.MaxTombstonesPerApply = a.config.MaxTombstonesPerApply
+	}
+	if a.config.WANConnectionWarming {
+		base.WANConnectionWarming = true
+	}
+	if a.config.WANConnectionWarmingMaxDCs != nil {
+		base.WANConnectionWarmingMaxDCs = *a.config.WANConnectionWarmingMaxDCs
+	}
+	if a.config.WANLivenessCheck {
+		base.WANLivenessCheck = true
+	}
+	if a.config.WANLivenessThresholdRaw != "" {
+		base.WANLivenessThreshold = a.config.WANLivenessThreshold
+	}
+	if a.config.WANLivenessTimeoutRaw != "" {
+		base.WANLivenessTimeout = a.config.WANLivenessTimeout
+	}
+	if a.config.StrictRPCDecoding {
+		base.StrictRPCDecoding = true
+	}
+	if a.config.RefuseRemoteWrites {
+		base.RefuseRemoteWrites = true
+	}
+	if a.config.KVMetadata {
+		base.KVMetadata = true
+	}
+	if a.config.DisableRegisterDedup {
+		base.DisableRegisterDedup = true
+	}
+	if a.config.LeaderReconcileHoldoffRaw != "" {
+		base.LeaderReconcileHoldoff = a.config.LeaderReconcileHoldoff
+	}
+	if a.config.ReconcileCoalesceWindowRaw != "" {
+		base.ReconcileCoalesceWindow = a.config.ReconcileCoalesceWindow
+	}
+	if a.config.ReapBatchSize != 0 {
+		base.ReapBatchSize = a.config.ReapBatchSize
+	}
+	if a.config.ReapBatchRate != 0 {
+		base.ReapBatchRate = a.config.ReapBatchRate
+	}
+	if a.config.ReadinessAddr != "" {
+		base.ReadinessAddr = a.config.ReadinessAddr
+	}
+	if a.config.ReadinessMinDiskFreeMB != 0 {
+		base.ReadinessMinDiskFree = a.config.ReadinessMinDiskFreeMB * 1024 * 1024
+	}
+	if a.config.ReadinessShutdownDelayRaw != "" {
+		base.ReadinessShutdownDelay = a.config.ReadinessShutdownDelay
+	}
+	if a.config.GossipDegradedThreshold != 0 {
+		base.GossipDegradedThreshold = a.config.GossipDegradedThreshold
+	}
+	if a.config.GossipDegradedEventDelayRaw != "" {
+		base.GossipDegradedEventDelay = a.config.GossipDegradedEventDelay
+	}
 	if a.config.Autopilot.CleanupDeadServers != nil {
 		base.AutopilotConfig.CleanupDeadServers = *a.config.Autopilot.CleanupDeadServers
 	}
@@ -428,9 +527,27 @@ func (a *Agent) consulConfig() *consul.Config {
 	if a.config.Autopilot.ServerStabilizationTime != nil {
 		base.AutopilotConfig.ServerStabilizationTime = *a.config.Autopilot.ServerStabilizationTime
 	}
+	if a.config.Autopilot.VoterDemotionTimeout != nil {
+		base.VoterDemotionTimeout = *a.config.Autopilot.VoterDemotionTimeout
+	}
+	if a.config.Autopilot.DeadServerCleanupTimeout != nil {
+		base.DeadServerCleanupTimeout = *a.config.Autopilot.DeadServerCleanupTimeout
+	}
 	if a.config.NonVotingServer {
 		base.NonVoter = a.config.NonVotingServer
 	}
+	if a.config.AllowStaleRaftID {
+		base.AllowStaleRaftID = a.config.AllowStaleRaftID
+	}
+	if a.config.ForceBootstrap {
+		base.ForceBootstrap = a.config.ForceBootstrap
+	}
+	if a.config.WANProxyURL != "" {
+		base.WANProxyURL = a.config.WANProxyURL
+	}
+	if a.config.EnableFaultInjection {
+		base.EnableFaultInjection = a.config.EnableFaultInjection
+	}
 	if a.config.Autopilot.RedundancyZoneTag != "" {
 		base.AutopilotConfig.RedundancyZoneTag = a.config.Autopilot.RedundancyZoneTag
 	}
@@ -1115,6 +1232,9 @@ func (a *Agent) AddService(service *structs.NodeService, chkTypes CheckTypes, pe
 			return fmt.Errorf("Check type is not valid")
 		}
 	}
+	if err := structs.ValidateMetadata(service.Meta); err != nil {
+		return fmt.Errorf("Invalid service meta: %v", err)
+	}
 
 	// Warn if the service name is incompatible with DNS
 	if !dnsNameRe.MatchString(service.Service) {
@@ -1230,6 +1350,9 @@ func (a *Agent) AddCheck(check *structs.HealthCheck, chkType *CheckType, persist
 	if check.CheckID == "" {
 		return fmt.Errorf("CheckID missing")
 	}
+	if consul.IsCriticalProbeCheck(check.CheckID) {
+		return fmt.Errorf("CheckID %q is reserved for critical service probes", check.CheckID)
+	}
 	if chkType != nil && !chkType.Valid() {
 		return fmt.Errorf("Check type is not valid")
 	}
@@ -473,6 +473,22 @@ func TestAgent_AddService(t *testing.T) {
 			t.Fatalf("missing redis check notes")
 		}
 	}
+
+	// Service registration with bad meta
+	{
+		srv := &structs.NodeService{
+			ID:      "mysql",
+			Service: "mysql",
+			Meta:    map[string]string{"consul-version": "1"},
+		}
+		err := agent.AddService(srv, nil, false, "")
+		if err == nil || !strings.Contains(err.Error(), "Invalid service meta") {
+			t.Fatalf("err: %v", err)
+		}
+		if _, ok := agent.state.Services()["mysql"]; ok {
+			t.Fatalf("should not have registered mysql")
+		}
+	}
 }
 
 func TestAgent_RemoveService(t *testing.T) {
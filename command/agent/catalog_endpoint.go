@@ -91,6 +91,23 @@ func (s *HTTPServer) CatalogServices(resp http.ResponseWriter, req *http.Request
 		return nil, nil
 	}
 
+	// The summary has per-service instance counts, but doesn't support
+	// filtering by node metadata.
+	if _, ok := req.URL.Query()["summary"]; ok {
+		if len(args.NodeMetaFilters) > 0 {
+			resp.WriteHeader(400)
+			resp.Write([]byte("Node metadata filters are not supported with summary"))
+			return nil, nil
+		}
+
+		var out structs.IndexedServiceSummaries
+		defer setMeta(resp, &out.QueryMeta)
+		if err := s.agent.RPC("Catalog.ServiceSummaries", &args, &out); err != nil {
+			return nil, err
+		}
+		return out.Services, nil
+	}
+
 	var out structs.IndexedServices
 	defer setMeta(resp, &out.QueryMeta)
 	if err := s.agent.RPC("Catalog.ListServices", &args, &out); err != nil {
@@ -169,6 +169,23 @@ type Performance struct {
 	// RaftMultiplier is an integer multiplier used to scale Raft timing
 	// parameters: HeartbeatTimeout, ElectionTimeout, and LeaderLeaseTimeout.
 	RaftMultiplier uint `mapstructure:"raft_multiplier"`
+
+	// RPCMaxResultSize is a rough limit, in bytes, on the size of the
+	// results returned by the servers' list endpoints. Larger results are
+	// truncated. This is disabled if set to 0.
+	RPCMaxResultSize int `mapstructure:"rpc_max_result_size"`
+
+	// RaftMaxEntrySize is the largest write, in bytes, that the servers
+	// will send into Raft.
+	RaftMaxEntrySize int `mapstructure:"raft_max_entry_size"`
+
+	// ApplyBackoffQueueDepth and ApplyBackoffLatency are the number of Raft
+	// applies in flight and the average apply latency on the leader above
+	// which Status.ApplyBackoff tells agents to back off. Either is disabled
+	// if set to 0.
+	ApplyBackoffQueueDepth int           `mapstructure:"apply_backoff_queue_depth"`
+	ApplyBackoffLatency    time.Duration `mapstructure:"-"`
+	ApplyBackoffLatencyRaw string        `mapstructure:"apply_backoff_latency"`
 }
 
 // Telemetry is the telemetry configuration for the server
@@ -289,6 +306,17 @@ type Autopilot struct {
 	ServerStabilizationTime    *time.Duration `mapstructure:"-" json:"-"`
 	ServerStabilizationTimeRaw string         `mapstructure:"server_stabilization_time"`
 
+	// VoterDemotionTimeout is how long a voter can be failed before it's
+	// demoted to a non-voter, so it no longer counts towards the quorum. Only
+	// applicable with Raft protocol version 3 or higher.
+	VoterDemotionTimeout    *time.Duration `mapstructure:"-" json:"-"`
+	VoterDemotionTimeoutRaw string         `mapstructure:"voter_demotion_timeout"`
+
+	// DeadServerCleanupTimeout is how long a server must be failed before
+	// dead server cleanup removes it.
+	DeadServerCleanupTimeout    *time.Duration `mapstructure:"-" json:"-"`
+	DeadServerCleanupTimeoutRaw string         `mapstructure:"dead_server_cleanup_timeout"`
+
 	// (Enterprise-only) RedundancyZoneTag is the Meta tag to use for separating servers
 	// into zones for redundancy. If left blank, this feature will be disabled.
 	RedundancyZoneTag string `mapstructure:"redundancy_zone_tag"`
@@ -323,10 +351,28 @@ type Config struct {
 	// in leader election, etc.
 	Server bool `mapstructure:"server"`
 
-	// (Enterprise-only) NonVotingServer is whether this server will act as a non-voting member
+	// NonVotingServer is whether this server will act as a non-voting member
 	// of the cluster to help provide read scalability.
 	NonVotingServer bool `mapstructure:"non_voting_server"`
 
+	// AllowStaleRaftID lets a server start even if its data directory has
+	// this server's address registered under a different node ID or node
+	// name, which usually means the data directory came from another server.
+	// The Raft state is rewritten to use this server's node ID.
+	AllowStaleRaftID bool `mapstructure:"allow_stale_raft_id"`
+
+	// ForceBootstrap lets a server in bootstrap mode start even if its data
+	// directory shows it used to be in a cluster with other servers.
+	ForceBootstrap bool `mapstructure:"force_bootstrap"`
+
+	// WANProxyURL is a socks5:// or http:// proxy that servers use for RPC
+	// connections to servers in other datacenters.
+	WANProxyURL string `mapstructure:"wan_proxy_url"`
+
+	// EnableFaultInjection lets operators inject latency and failures into
+	// a server's connections to other servers, for chaos testing.
+	EnableFaultInjection bool `mapstructure:"enable_fault_injection"`
+
 	// Datacenter is the datacenter this node is in. Defaults to dc1
 	Datacenter string `mapstructure:"datacenter"`
 
@@ -607,6 +653,10 @@ type Config struct {
 	// white-lists.
 	ACLDefaultPolicy string `mapstructure:"acl_default_policy"`
 
+	// ACLDefaultPolicies overrides the ACLDefaultPolicy for some resource
+	// types, like "kv" or "service".
+	ACLDefaultPolicies map[string]string `mapstructure:"acl_default_policies"`
+
 	// ACLDisabledTTL is used by clients to determine how long they will
 	// wait to check again with the servers if they discover ACLs are not
 	// enabled.
@@ -721,6 +771,125 @@ type Config struct {
 	// Minimum Session TTL
 	SessionTTLMin    time.Duration `mapstructure:"-"`
 	SessionTTLMinRaw string        `mapstructure:"session_ttl_min"`
+
+	// SessionTTLJitterPercent spreads out session expirations by adding up
+	// to this percentage of each session's TTL to its timer.
+	SessionTTLJitterPercent int `mapstructure:"session_ttl_jitter_percent"`
+
+	// SessionLimitPerNode is the most sessions a node can have at once.
+	SessionLimitPerNode int `mapstructure:"session_limit_per_node"`
+
+	// RPCLogDedupWindow is how long servers hold back repeats of the same
+	// RPC error in their logs before summarizing them in a single line.
+	RPCLogDedupWindow    time.Duration `mapstructure:"-"`
+	RPCLogDedupWindowRaw string        `mapstructure:"rpc_log_dedup_window"`
+
+	// RPCLogDedupExempt is a list of regular expressions for RPC error log
+	// lines that should never be deduplicated.
+	RPCLogDedupExempt []string `mapstructure:"rpc_log_dedup_exempt"`
+
+	// ServiceKinds are the kinds of service the servers allow to be
+	// registered, on top of the built-in ones.
+	ServiceKinds []string `mapstructure:"service_kinds"`
+
+	// StaleReadFence is how long a follower server can go without hearing
+	// from the leader before it stops serving stale reads.
+	StaleReadFence    time.Duration `mapstructure:"-"`
+	StaleReadFenceRaw string        `mapstructure:"stale_read_fence"`
+
+	// CatchUpThreshold is how many entries behind the leader a server can
+	// be after starting up before it serves stale reads.
+	CatchUpThreshold uint64 `mapstructure:"catch_up_threshold"`
+
+	// LeaderFlapThreshold is how many leadership changes within the
+	// LeaderFlapWindow servers will allow before warning that the leader is
+	// flapping. Setting this to 0 turns off flap detection.
+	LeaderFlapThreshold *int `mapstructure:"leader_flap_threshold"`
+
+	// LeaderFlapWindow is the window over which leadership changes are
+	// counted.
+	LeaderFlapWindow    time.Duration `mapstructure:"-"`
+	LeaderFlapWindowRaw string        `mapstructure:"leader_flap_window"`
+
+	// MaxTombstonesPerApply limits how many tombstones a single KV
+	// delete-tree will create before servers fall back to a single
+	// tombstone for the whole prefix.
+	MaxTombstonesPerApply int `mapstructure:"max_tombstones_per_apply"`
+
+	// WANConnectionWarming has servers keep a connection open to a server
+	// in each of the other datacenters, so forwarded requests don't have to
+	// wait for a new connection.
+	WANConnectionWarming bool `mapstructure:"wan_connection_warming"`
+
+	// WANConnectionWarmingMaxDCs limits warming to this many of the closest
+	// datacenters. Zero means there's no limit.
+	WANConnectionWarmingMaxDCs *int `mapstructure:"wan_connection_warming_max_dcs"`
+
+	// WANLivenessCheck has servers ping a server in another datacenter
+	// before forwarding a write or consistent read to it, unless an RPC to
+	// it has succeeded within WANLivenessThreshold. Servers that don't
+	// answer within WANLivenessTimeout are skipped.
+	WANLivenessCheck        bool          `mapstructure:"wan_liveness_check"`
+	WANLivenessThreshold    time.Duration `mapstructure:"-"`
+	WANLivenessThresholdRaw string        `mapstructure:"wan_liveness_threshold"`
+	WANLivenessTimeout      time.Duration `mapstructure:"-"`
+	WANLivenessTimeoutRaw   string        `mapstructure:"wan_liveness_timeout"`
+
+	// StrictRPCDecoding has servers reject RPC requests from clients that
+	// have fields they don't know about, instead of ignoring those fields.
+	StrictRPCDecoding bool `mapstructure:"strict_rpc_decoding"`
+
+	// RefuseRemoteWrites has servers reject writes meant for other
+	// datacenters instead of forwarding them, unless the token allows it.
+	// This only sets the initial policy for the datacenter.
+	RefuseRemoteWrites bool `mapstructure:"refuse_remote_writes"`
+
+	// KVMetadata has servers record the token that created and last
+	// modified each KV entry, along with when.
+	KVMetadata bool `mapstructure:"kv_metadata"`
+
+	// DisableRegisterDedup has servers write every catalog registration to
+	// Raft, even ones that wouldn't change anything.
+	DisableRegisterDedup bool `mapstructure:"disable_register_dedup"`
+
+	// LeaderReconcileHoldoff is how long a new leader waits before it
+	// deregisters nodes or marks them failed, since its view of the
+	// cluster can lag right after an election.
+	LeaderReconcileHoldoff    time.Duration `mapstructure:"-"`
+	LeaderReconcileHoldoffRaw string        `mapstructure:"leader_reconcile_holdoff"`
+
+	// ReconcileCoalesceWindow is how long the leader holds on to Serf
+	// events for a node so a burst of them is reconciled only once.
+	ReconcileCoalesceWindow    time.Duration `mapstructure:"-"`
+	ReconcileCoalesceWindowRaw string        `mapstructure:"reconcile_coalesce_window"`
+
+	// ReapBatchSize is the most reaped nodes the leader deregisters in one
+	// Raft entry, and ReapBatchRate is the most of those batches it writes
+	// per second. Batching is off if ReapBatchSize is zero.
+	ReapBatchSize int     `mapstructure:"reap_batch_size"`
+	ReapBatchRate float64 `mapstructure:"reap_batch_rate"`
+
+	// ReadinessAddr is the address of a listener on servers that load
+	// balancers can check to see if the server should get requests.
+	ReadinessAddr string `mapstructure:"readiness_addr"`
+
+	// ReadinessMinDiskFreeMB is the least free space, in megabytes, the
+	// data directory's disk can have for the server to report ready.
+	ReadinessMinDiskFreeMB uint64 `mapstructure:"readiness_min_disk_free_mb"`
+
+	// ReadinessShutdownDelay is how long a server reports that it isn't
+	// ready before closing its listeners when it shuts down.
+	ReadinessShutdownDelay    time.Duration `mapstructure:"-"`
+	ReadinessShutdownDelayRaw string        `mapstructure:"readiness_shutdown_delay"`
+
+	// GossipDegradedThreshold is the number of queued gossip messages above
+	// which a server considers its gossip pool degraded. Zero disables it.
+	GossipDegradedThreshold int `mapstructure:"gossip_degraded_threshold"`
+
+	// GossipDegradedEventDelay is how long a server waits before firing a
+	// user event while its LAN gossip pool is degraded.
+	GossipDegradedEventDelay    time.Duration `mapstructure:"-"`
+	GossipDegradedEventDelayRaw string        `mapstructure:"gossip_degraded_event_delay"`
 }
 
 // Bool is used to initialize bool pointers in struct literals.
@@ -1111,6 +1280,20 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 		}
 		result.Autopilot.ServerStabilizationTime = &dur
 	}
+	if raw := result.Autopilot.VoterDemotionTimeoutRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("VoterDemotionTimeout invalid: %v", err)
+		}
+		result.Autopilot.VoterDemotionTimeout = &dur
+	}
+	if raw := result.Autopilot.DeadServerCleanupTimeoutRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("DeadServerCleanupTimeout invalid: %v", err)
+		}
+		result.Autopilot.DeadServerCleanupTimeout = &dur
+	}
 
 	// Merge the single recursor
 	if result.DNSRecursor != "" {
@@ -1125,6 +1308,78 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 		result.SessionTTLMin = dur
 	}
 
+	if raw := result.RPCLogDedupWindowRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("RPC log dedup window invalid: %v", err)
+		}
+		result.RPCLogDedupWindow = dur
+	}
+
+	if raw := result.StaleReadFenceRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Stale read fence invalid: %v", err)
+		}
+		result.StaleReadFence = dur
+	}
+
+	if raw := result.ReadinessShutdownDelayRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Readiness shutdown delay invalid: %v", err)
+		}
+		result.ReadinessShutdownDelay = dur
+	}
+
+	if raw := result.WANLivenessThresholdRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("WAN liveness threshold invalid: %v", err)
+		}
+		result.WANLivenessThreshold = dur
+	}
+
+	if raw := result.WANLivenessTimeoutRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("WAN liveness timeout invalid: %v", err)
+		}
+		result.WANLivenessTimeout = dur
+	}
+
+	if raw := result.LeaderFlapWindowRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Leader flap window invalid: %v", err)
+		}
+		result.LeaderFlapWindow = dur
+	}
+
+	if raw := result.LeaderReconcileHoldoffRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Leader reconcile holdoff invalid: %v", err)
+		}
+		result.LeaderReconcileHoldoff = dur
+	}
+
+	if raw := result.ReconcileCoalesceWindowRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Reconcile coalesce window invalid: %v", err)
+		}
+		result.ReconcileCoalesceWindow = dur
+	}
+
+	if raw := result.GossipDegradedEventDelayRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Gossip degraded event delay invalid: %v", err)
+		}
+		result.GossipDegradedEventDelay = dur
+	}
+
 	if result.AdvertiseAddrs.SerfLanRaw != "" {
 		ipStr, err := parseSingleIPTemplate(result.AdvertiseAddrs.SerfLanRaw)
 		if err != nil {
@@ -1172,6 +1427,14 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 		return nil, fmt.Errorf("Performance.RaftMultiplier must be <= %d", consul.MaxRaftMultiplier)
 	}
 
+	if raw := result.Performance.ApplyBackoffLatencyRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Performance.ApplyBackoffLatency invalid: %v", err)
+		}
+		result.Performance.ApplyBackoffLatency = dur
+	}
+
 	return &result, nil
 }
 
@@ -1332,6 +1595,19 @@ func MergeConfig(a, b *Config) *Config {
 	if b.Performance.RaftMultiplier > 0 {
 		result.Performance.RaftMultiplier = b.Performance.RaftMultiplier
 	}
+	if b.Performance.RPCMaxResultSize > 0 {
+		result.Performance.RPCMaxResultSize = b.Performance.RPCMaxResultSize
+	}
+	if b.Performance.RaftMaxEntrySize > 0 {
+		result.Performance.RaftMaxEntrySize = b.Performance.RaftMaxEntrySize
+	}
+	if b.Performance.ApplyBackoffQueueDepth > 0 {
+		result.Performance.ApplyBackoffQueueDepth = b.Performance.ApplyBackoffQueueDepth
+	}
+	if b.Performance.ApplyBackoffLatencyRaw != "" {
+		result.Performance.ApplyBackoffLatency = b.Performance.ApplyBackoffLatency
+		result.Performance.ApplyBackoffLatencyRaw = b.Performance.ApplyBackoffLatencyRaw
+	}
 
 	// Copy the strings if they're set
 	if b.Bootstrap {
@@ -1412,6 +1688,18 @@ func MergeConfig(a, b *Config) *Config {
 	if b.NonVotingServer == true {
 		result.NonVotingServer = b.NonVotingServer
 	}
+	if b.AllowStaleRaftID == true {
+		result.AllowStaleRaftID = b.AllowStaleRaftID
+	}
+	if b.ForceBootstrap == true {
+		result.ForceBootstrap = b.ForceBootstrap
+	}
+	if b.WANProxyURL != "" {
+		result.WANProxyURL = b.WANProxyURL
+	}
+	if b.EnableFaultInjection == true {
+		result.EnableFaultInjection = b.EnableFaultInjection
+	}
 	if b.LeaveOnTerm != nil {
 		result.LeaveOnTerm = b.LeaveOnTerm
 	}
@@ -1430,6 +1718,12 @@ func MergeConfig(a, b *Config) *Config {
 	if b.Autopilot.ServerStabilizationTime != nil {
 		result.Autopilot.ServerStabilizationTime = b.Autopilot.ServerStabilizationTime
 	}
+	if b.Autopilot.VoterDemotionTimeout != nil {
+		result.Autopilot.VoterDemotionTimeout = b.Autopilot.VoterDemotionTimeout
+	}
+	if b.Autopilot.DeadServerCleanupTimeout != nil {
+		result.Autopilot.DeadServerCleanupTimeout = b.Autopilot.DeadServerCleanupTimeout
+	}
 	if b.Autopilot.RedundancyZoneTag != "" {
 		result.Autopilot.RedundancyZoneTag = b.Autopilot.RedundancyZoneTag
 	}
@@ -1684,6 +1978,15 @@ func MergeConfig(a, b *Config) *Config {
 	if b.ACLDefaultPolicy != "" {
 		result.ACLDefaultPolicy = b.ACLDefaultPolicy
 	}
+	if len(b.ACLDefaultPolicies) != 0 {
+		result.ACLDefaultPolicies = make(map[string]string)
+		for kind, policy := range a.ACLDefaultPolicies {
+			result.ACLDefaultPolicies[kind] = policy
+		}
+		for kind, policy := range b.ACLDefaultPolicies {
+			result.ACLDefaultPolicies[kind] = policy
+		}
+	}
 	if b.ACLReplicationToken != "" {
 		result.ACLReplicationToken = b.ACLReplicationToken
 	}
@@ -1736,6 +2039,99 @@ func MergeConfig(a, b *Config) *Config {
 		result.SessionTTLMin = b.SessionTTLMin
 		result.SessionTTLMinRaw = b.SessionTTLMinRaw
 	}
+	if b.SessionTTLJitterPercent != 0 {
+		result.SessionTTLJitterPercent = b.SessionTTLJitterPercent
+	}
+	if b.SessionLimitPerNode != 0 {
+		result.SessionLimitPerNode = b.SessionLimitPerNode
+	}
+	if b.RPCLogDedupWindowRaw != "" {
+		result.RPCLogDedupWindow = b.RPCLogDedupWindow
+		result.RPCLogDedupWindowRaw = b.RPCLogDedupWindowRaw
+	}
+	if len(b.RPCLogDedupExempt) != 0 {
+		result.RPCLogDedupExempt = append(result.RPCLogDedupExempt, b.RPCLogDedupExempt...)
+	}
+	if len(b.ServiceKinds) != 0 {
+		result.ServiceKinds = append(result.ServiceKinds, b.ServiceKinds...)
+	}
+	if b.StaleReadFenceRaw != "" {
+		result.StaleReadFence = b.StaleReadFence
+		result.StaleReadFenceRaw = b.StaleReadFenceRaw
+	}
+	if b.CatchUpThreshold != 0 {
+		result.CatchUpThreshold = b.CatchUpThreshold
+	}
+	if b.LeaderFlapThreshold != nil {
+		result.LeaderFlapThreshold = b.LeaderFlapThreshold
+	}
+	if b.LeaderFlapWindowRaw != "" {
+		result.LeaderFlapWindow = b.LeaderFlapWindow
+		result.LeaderFlapWindowRaw = b.LeaderFlapWindowRaw
+	}
+	if b.MaxTombstonesPerApply != 0 {
+		result.MaxTombstonesPerApply = b.MaxTombstonesPerApply
+	}
+	if b.WANConnectionWarming {
+		result.WANConnectionWarming = true
+	}
+	if b.WANConnectionWarmingMaxDCs != nil {
+		result.WANConnectionWarmingMaxDCs = b.WANConnectionWarmingMaxDCs
+	}
+	if b.WANLivenessCheck {
+		result.WANLivenessCheck = true
+	}
+	if b.WANLivenessThresholdRaw != "" {
+		result.WANLivenessThreshold = b.WANLivenessThreshold
+		result.WANLivenessThresholdRaw = b.WANLivenessThresholdRaw
+	}
+	if b.WANLivenessTimeoutRaw != "" {
+		result.WANLivenessTimeout = b.WANLivenessTimeout
+		result.WANLivenessTimeoutRaw = b.WANLivenessTimeoutRaw
+	}
+	if b.StrictRPCDecoding {
+		result.StrictRPCDecoding = true
+	}
+	if b.RefuseRemoteWrites {
+		result.RefuseRemoteWrites = true
+	}
+	if b.KVMetadata {
+		result.KVMetadata = true
+	}
+	if b.DisableRegisterDedup {
+		result.DisableRegisterDedup = true
+	}
+	if b.LeaderReconcileHoldoffRaw != "" {
+		result.LeaderReconcileHoldoff = b.LeaderReconcileHoldoff
+		result.LeaderReconcileHoldoffRaw = b.LeaderReconcileHoldoffRaw
+	}
+	if b.ReconcileCoalesceWindowRaw != "" {
+		result.ReconcileCoalesceWindow = b.ReconcileCoalesceWindow
+		result.ReconcileCoalesceWindowRaw = b.ReconcileCoalesceWindowRaw
+	}
+	if b.ReapBatchSize != 0 {
+		result.ReapBatchSize = b.ReapBatchSize
+	}
+	if b.ReapBatchRate != 0 {
+		result.ReapBatchRate = b.ReapBatchRate
+	}
+	if b.ReadinessAddr != "" {
+		result.ReadinessAddr = b.ReadinessAddr
+	}
+	if b.ReadinessMinDiskFreeMB != 0 {
+		result.ReadinessMinDiskFreeMB = b.ReadinessMinDiskFreeMB
+	}
+	if b.ReadinessShutdownDelayRaw != "" {
+		result.ReadinessShutdownDelay = b.ReadinessShutdownDelay
+		result.ReadinessShutdownDelayRaw = b.ReadinessShutdownDelayRaw
+	}
+	if b.GossipDegradedThreshold != 0 {
+		result.GossipDegradedThreshold = b.GossipDegradedThreshold
+	}
+	if b.GossipDegradedEventDelayRaw != "" {
+		result.GossipDegradedEventDelay = b.GossipDegradedEventDelay
+		result.GossipDegradedEventDelayRaw = b.GossipDegradedEventDelayRaw
+	}
 	if len(b.HTTPAPIResponseHeaders) != 0 {
 		if result.HTTPAPIResponseHeaders == nil {
 			result.HTTPAPIResponseHeaders = make(map[string]string)
@@ -686,7 +686,8 @@ func TestDecodeConfig(t *testing.T) {
 	"acl_agent_token": "3333", "acl_datacenter": "dc2",
 	"acl_ttl": "60s", "acl_down_policy": "deny",
 	"acl_default_policy": "deny", "acl_master_token": "2345",
-	"acl_replication_token": "8675309"}`
+	"acl_replication_token": "8675309",
+	"acl_default_policies": {"kv": "deny", "service": "allow"}}`
 	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
 	if err != nil {
 		t.Fatalf("err: %s", err)
@@ -716,6 +717,9 @@ func TestDecodeConfig(t *testing.T) {
 	if config.ACLDefaultPolicy != "deny" {
 		t.Fatalf("bad: %#v", config)
 	}
+	if config.ACLDefaultPolicies["kv"] != "deny" || config.ACLDefaultPolicies["service"] != "allow" {
+		t.Fatalf("bad: %#v", config)
+	}
 	if config.ACLReplicationToken != "8675309" {
 		t.Fatalf("bad: %#v", config)
 	}
@@ -1041,6 +1045,226 @@ func TestDecodeConfig(t *testing.T) {
 	if config.SessionTTLMin != 5*time.Second {
 		t.Fatalf("bad: %s %#v", config.SessionTTLMin.String(), config)
 	}
+
+	// SessionTTLJitterPercent
+	input = `{"session_ttl_jitter_percent": 25}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.SessionTTLJitterPercent != 25 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// SessionLimitPerNode
+	input = `{"session_limit_per_node": 100}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.SessionLimitPerNode != 100 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Leader flap detection
+	input = `{"leader_flap_threshold": 0, "leader_flap_window": "10m"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.LeaderFlapThreshold == nil || *config.LeaderFlapThreshold != 0 {
+		t.Fatalf("bad: %#v", config)
+	}
+	if config.LeaderFlapWindow != 10*time.Minute {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Tombstone limit
+	input = `{"max_tombstones_per_apply": 1000}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.MaxTombstonesPerApply != 1000 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// WAN connection warming
+	input = `{"wan_connection_warming": true, "wan_connection_warming_max_dcs": 0}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.WANConnectionWarming || config.WANConnectionWarmingMaxDCs == nil ||
+		*config.WANConnectionWarmingMaxDCs != 0 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// WAN liveness checks
+	input = `{"wan_liveness_check": true, "wan_liveness_threshold": "10s", "wan_liveness_timeout": "250ms"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.WANLivenessCheck || config.WANLivenessThreshold != 10*time.Second ||
+		config.WANLivenessTimeout != 250*time.Millisecond {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Strict RPC decoding
+	input = `{"strict_rpc_decoding": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.StrictRPCDecoding {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Refuse remote writes
+	input = `{"refuse_remote_writes": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.RefuseRemoteWrites {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// KV metadata
+	input = `{"kv_metadata": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.KVMetadata {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Register dedup
+	input = `{"disable_register_dedup": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.DisableRegisterDedup {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Catch-up threshold
+	input = `{"catch_up_threshold": 1000}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.CatchUpThreshold != 1000 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Force bootstrap
+	input = `{"force_bootstrap": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.ForceBootstrap {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// WAN proxy
+	input = `{"wan_proxy_url": "socks5://proxy.example.com:1080"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.WANProxyURL != "socks5://proxy.example.com:1080" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Fault injection
+	input = `{"enable_fault_injection": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.EnableFaultInjection {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Leader reconcile holdoff
+	input = `{"leader_reconcile_holdoff": "30s"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.LeaderReconcileHoldoff != 30*time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Reconcile coalesce window
+	input = `{"reconcile_coalesce_window": "500ms"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.ReconcileCoalesceWindow != 500*time.Millisecond {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Reap batching
+	input = `{"reap_batch_size": 64, "reap_batch_rate": 2.5}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.ReapBatchSize != 64 || config.ReapBatchRate != 2.5 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Readiness listener
+	input = `{"readiness_addr": "127.0.0.1:8310", "readiness_min_disk_free_mb": 500, "readiness_shutdown_delay": "10s"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.ReadinessAddr != "127.0.0.1:8310" || config.ReadinessMinDiskFreeMB != 500 {
+		t.Fatalf("bad: %#v", config)
+	}
+	if config.ReadinessShutdownDelay != 10*time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Gossip degraded threshold and event delay
+	input = `{"gossip_degraded_threshold": 500, "gossip_degraded_event_delay": "2s"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.GossipDegradedThreshold != 500 {
+		t.Fatalf("bad: %#v", config)
+	}
+	if config.GossipDegradedEventDelay != 2*time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
 }
 
 func TestDecodeConfig_invalidKeys(t *testing.T) {
@@ -1122,6 +1346,27 @@ func TestDecodeConfig_Performance(t *testing.T) {
 	if err == nil || !strings.Contains(err.Error(), "Performance.RaftMultiplier must be <=") {
 		t.Fatalf("bad: %v", err)
 	}
+
+	input = `{"performance": { "apply_backoff_queue_depth": 50, "apply_backoff_latency": "250ms" }}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if config.Performance.ApplyBackoffQueueDepth != 50 {
+		t.Fatalf("bad: %#v", config.Performance)
+	}
+	if config.Performance.ApplyBackoffLatency != 250*time.Millisecond {
+		t.Fatalf("bad: %#v", config.Performance)
+	}
+
+	input = `{"performance": { "raft_max_entry_size": 1048576 }}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if config.Performance.RaftMaxEntrySize != 1048576 {
+		t.Fatalf("bad: %#v", config.Performance)
+	}
 }
 
 func TestDecodeConfig_Autopilot(t *testing.T) {
@@ -1130,6 +1375,8 @@ func TestDecodeConfig_Autopilot(t *testing.T) {
 	  "last_contact_threshold": "100ms",
 	  "max_trailing_logs": 10,
 	  "server_stabilization_time": "10s",
+	  "voter_demotion_timeout": "5m",
+	  "dead_server_cleanup_timeout": "72h",
 	  "redundancy_zone_tag": "az",
 	  "disable_upgrade_migration": true
 	 }}`
@@ -1149,6 +1396,12 @@ func TestDecodeConfig_Autopilot(t *testing.T) {
 	if config.Autopilot.ServerStabilizationTime == nil || *config.Autopilot.ServerStabilizationTime != 10*time.Second {
 		t.Fatalf("bad: %#v", config)
 	}
+	if config.Autopilot.VoterDemotionTimeout == nil || *config.Autopilot.VoterDemotionTimeout != 5*time.Minute {
+		t.Fatalf("bad: %#v", config)
+	}
+	if config.Autopilot.DeadServerCleanupTimeout == nil || *config.Autopilot.DeadServerCleanupTimeout != 72*time.Hour {
+		t.Fatalf("bad: %#v", config)
+	}
 	if config.Autopilot.RedundancyZoneTag != "az" {
 		t.Fatalf("bad: %#v", config)
 	}
@@ -1673,10 +1926,12 @@ func TestMergeConfig(t *testing.T) {
 		SkipLeaveOnInt: Bool(true),
 		RaftProtocol:   3,
 		Autopilot: Autopilot{
-			CleanupDeadServers:      Bool(true),
-			LastContactThreshold:    Duration(time.Duration(10)),
-			MaxTrailingLogs:         Uint64(10),
-			ServerStabilizationTime: Duration(time.Duration(100)),
+			CleanupDeadServers:       Bool(true),
+			LastContactThreshold:     Duration(time.Duration(10)),
+			MaxTrailingLogs:          Uint64(10),
+			ServerStabilizationTime:  Duration(time.Duration(100)),
+			VoterDemotionTimeout:     Duration(time.Duration(200)),
+			DeadServerCleanupTimeout: Duration(time.Duration(300)),
 		},
 		EnableDebug:            true,
 		VerifyIncoming:         true,
@@ -1714,6 +1969,7 @@ func TestMergeConfig(t *testing.T) {
 		ACLTTLRaw:              "15s",
 		ACLDownPolicy:          "deny",
 		ACLDefaultPolicy:       "deny",
+		ACLDefaultPolicies:     map[string]string{"kv": "deny"},
 		ACLReplicationToken:    "8765309",
 		ACLEnforceVersion8:     Bool(true),
 		Watches: []map[string]interface{}{
@@ -486,11 +486,30 @@ func setLastContact(resp http.ResponseWriter, last time.Duration) {
 	resp.Header().Set("X-Consul-LastContact", strconv.FormatUint(lastMsec, 10))
 }
 
+// setTruncated is used to set the truncation headers. These are only present
+// if the results were cut short.
+func setTruncated(resp http.ResponseWriter, truncated bool, omitted int) {
+	if truncated {
+		resp.Header().Set("X-Consul-Truncated", "true")
+		resp.Header().Set("X-Consul-Omitted", strconv.Itoa(omitted))
+	}
+}
+
+// setCancelled is used to set the cancelled header. This is only present if
+// an operator cancelled the blocking query.
+func setCancelled(resp http.ResponseWriter, cancelled bool) {
+	if cancelled {
+		resp.Header().Set("X-Consul-Cancelled", "true")
+	}
+}
+
 // setMeta is used to set the query response meta data
 func setMeta(resp http.ResponseWriter, m *structs.QueryMeta) {
 	setIndex(resp, m.Index)
 	setLastContact(resp, m.LastContact)
 	setKnownLeader(resp, m.KnownLeader)
+	setTruncated(resp, m.Truncated, m.Omitted)
+	setCancelled(resp, m.Cancelled)
 }
 
 // setHeaders is used to set canonical response header fields
@@ -160,6 +160,11 @@ func (s *HTTPServer) KVSPut(resp http.ResponseWriter, req *http.Request, args *s
 		applyReq.DirEnt.Flags = flagVal
 	}
 
+	// Check for overriding the reserved flags
+	if _, ok := params["override-flags"]; ok {
+		applyReq.OverrideFlags = true
+	}
+
 	// Check for cas value
 	if _, ok := params["cas"]; ok {
 		casVal, err := strconv.ParseUint(params.Get("cas"), 10, 64)
@@ -232,6 +237,21 @@ func (s *HTTPServer) KVSDelete(resp http.ResponseWriter, req *http.Request, args
 		return nil, nil
 	}
 
+	// Check for skipping tombstones, which only makes sense for a tree
+	if _, ok := params["skip-tombstones"]; ok {
+		if applyReq.Op != structs.KVSDeleteTree {
+			resp.WriteHeader(400)
+			resp.Write([]byte("Cannot skip tombstones without recurse"))
+			return nil, nil
+		}
+		applyReq.SkipTombstones = true
+	}
+
+	// Check for overriding the reserved flags
+	if _, ok := params["override-flags"]; ok {
+		applyReq.OverrideFlags = true
+	}
+
 	// Check for cas value
 	if _, ok := params["cas"]; ok {
 		casVal, err := strconv.ParseUint(params.Get("cas"), 10, 64)
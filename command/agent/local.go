@@ -487,9 +487,10 @@ func (l *localState) setSyncState() error {
 		id := check.CheckID
 		existing, ok := l.checks[id]
 		if !ok {
-			// The Serf check is created automatically, and does not
-			// need to be registered
-			if id == consul.SerfCheckID {
+			// The Serf check and the critical probe checks are
+			// managed by the servers, and do not need to be
+			// registered
+			if id == consul.SerfCheckID || consul.IsCriticalProbeCheck(id) {
 				continue
 			}
 			l.checkStatus[id] = syncStatus{inSync: false}
@@ -297,21 +297,23 @@ func (s *HTTPServer) OperatorServerHealth(resp http.ResponseWriter, req *http.Re
 	out := &api.OperatorHealthReply{
 		Healthy:          reply.Healthy,
 		FailureTolerance: reply.FailureTolerance,
+		Warnings:         reply.Warnings,
 	}
 	for _, server := range reply.Servers {
 		out.Servers = append(out.Servers, api.ServerHealth{
-			ID:          server.ID,
-			Name:        server.Name,
-			Address:     server.Address,
-			Version:     server.Version,
-			Leader:      server.Leader,
-			SerfStatus:  server.SerfStatus.String(),
-			LastContact: api.NewReadableDuration(server.LastContact),
-			LastTerm:    server.LastTerm,
-			LastIndex:   server.LastIndex,
-			Healthy:     server.Healthy,
-			Voter:       server.Voter,
-			StableSince: server.StableSince.Round(time.Second).UTC(),
+			ID:             server.ID,
+			Name:           server.Name,
+			Address:        server.Address,
+			Version:        server.Version,
+			Leader:         server.Leader,
+			SerfStatus:     server.SerfStatus.String(),
+			LastContact:    api.NewReadableDuration(server.LastContact),
+			LastTerm:       server.LastTerm,
+			LastIndex:      server.LastIndex,
+			Healthy:        server.Healthy,
+			Voter:          server.Voter,
+			StableSince:    server.StableSince.Round(time.Second).UTC(),
+			GossipDegraded: server.GossipDegraded,
 		})
 	}
 
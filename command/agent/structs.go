@@ -16,6 +16,8 @@ type ServiceDefinition struct {
 	Checks            CheckTypes
 	Token             string
 	EnableTagOverride bool
+	Meta              map[string]string
+	Kind              string
 }
 
 func (s *ServiceDefinition) NodeService() *structs.NodeService {
@@ -26,6 +28,8 @@ func (s *ServiceDefinition) NodeService() *structs.NodeService {
 		Address:           s.Address,
 		Port:              s.Port,
 		EnableTagOverride: s.EnableTagOverride,
+		Meta:              s.Meta,
+		Kind:              s.Kind,
 	}
 	if ns.ID == "" && ns.Service != "" {
 		ns.ID = ns.Service
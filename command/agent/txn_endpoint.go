@@ -198,6 +198,9 @@ func (s *HTTPServer) Txn(resp http.ResponseWriter, req *http.Request) (interface
 		args := structs.TxnRequest{Ops: ops}
 		s.parseDC(req, &args.Datacenter)
 		s.parseToken(req, &args.Token)
+		if _, ok := req.URL.Query()["override-flags"]; ok {
+			args.OverrideFlags = true
+		}
 
 		var reply structs.TxnResponse
 		if err := s.agent.RPC("Txn.Apply", &args, &reply); err != nil {
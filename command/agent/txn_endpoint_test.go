@@ -312,9 +312,16 @@ func TestTxnEndpoint_KV_Actions(t *testing.T) {
 					},
 				},
 				QueryMeta: structs.QueryMeta{
-					KnownLeader: true,
+					KnownLeader:  true,
+					LastLeader:   fmt.Sprintf("%s:%d", srv.agent.config.AdvertiseAddr, srv.agent.config.Ports.Server),
+					RaftState:    "Leader",
+					AliveServers: 1,
 				},
 			}
+			if txnResp.Server != srv.agent.config.NodeName {
+				t.Fatalf("bad: %#v", txnResp.ReplyMeta)
+			}
+			txnResp.ReplyMeta = structs.ReplyMeta{}
 			if !reflect.DeepEqual(txnResp, expected) {
 				t.Fatalf("bad: %v", txnResp)
 			}
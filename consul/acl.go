@@ -1,11 +1,13 @@
 package consul
 
 import (
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/armon/go-metrics"
@@ -51,6 +53,12 @@ type aclCacheEntry struct {
 	ACL     acl.ACL
 	Expires time.Time
 	ETag    string
+
+	// RateLimit is the token's rate limit, see structs.ACL.
+	RateLimit float64
+
+	// SessionLimit is the token's session limit, see structs.ACL.
+	SessionLimit int
 }
 
 // aclLocalFault is used by the authoritative ACL cache to fault in the rules
@@ -58,34 +66,130 @@ type aclCacheEntry struct {
 // assumes its running in the ACL datacenter, or in a non-ACL datacenter when
 // using its replicated ACLs during an outage.
 func (s *Server) aclLocalFault(id string) (string, string, error) {
+	parent, rules, _, err := s.aclLocalLookup(id)
+	return parent, rules, err
+}
+
+// aclLocalLookup is like aclLocalFault, but also returns the token itself so
+// callers can see where it's limited to.
+func (s *Server) aclLocalLookup(id string) (string, string, *structs.ACL, error) {
 	defer metrics.MeasureSince([]string{"consul", "acl", "fault"}, time.Now())
 
 	// Query the state store.
 	state := s.fsm.State()
 	_, acl, err := state.ACLGet(nil, id)
 	if err != nil {
-		return "", "", err
+		return "", "", nil, err
 	}
 	if acl == nil {
-		return "", "", errors.New(aclNotFound)
+		return "", "", nil, errors.New(aclNotFound)
 	}
 
 	// Management tokens have no policy and inherit from the 'manage' root
 	// policy.
 	if acl.Type == structs.ACLTypeManagement {
-		return "manage", "", nil
+		return "manage", "", acl, nil
 	}
 
 	// Otherwise use the default policy.
-	return s.config.ACLDefaultPolicy, acl.Rules, nil
+	return s.config.ACLDefaultPolicy, acl.Rules, acl, nil
+}
+
+// aclLocalShadow wraps the given ACL with the given shadow rules for the
+// authoritative ACL path.
+func (s *Server) aclLocalShadow(resolved acl.ACL, parent, rules, id string) (acl.ACL, error) {
+	policy, err := s.aclAuthCache.GetPolicy(rules)
+	if err != nil {
+		return nil, err
+	}
+	defaults := s.config.ACLDefaultPolicies
+	root := acl.RootACLWithDefaults(parent, defaults)
+	if root == nil {
+		return nil, fmt.Errorf("Invalid ACL parent policy %q", parent)
+	}
+	key := parent + ":" + acl.DefaultsID(defaults)
+	return s.aclShadow.wrap(resolved, root, key, policy, id)
+}
+
+// aclAppliesInDatacenter returns true if an ACL limited to the given
+// datacenters applies in the given datacenter. Tokens are denied everything
+// where they don't apply.
+func aclAppliesInDatacenter(datacenters []string, dc string) bool {
+	if len(datacenters) == 0 {
+		return true
+	}
+	for _, allowed := range datacenters {
+		if allowed == dc {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeBoundACL is the ACL for a token that's bound to a single node. It
+// otherwise behaves just like the token's regular ACL.
+type nodeBoundACL struct {
+	acl.ACL
+	node string
+	dc   string
+}
+
+// bindACLToNode wraps the given ACL so it's bound to the node in the given
+// node identity. The ACL is returned as-is if the identity is empty.
+func bindACLToNode(a acl.ACL, identity string) acl.ACL {
+	if identity == "" {
+		return a
+	}
+
+	// Identities are checked when tokens are set, but if a bad one gets
+	// through we still need to bind it to something, so we leave the
+	// datacenter empty, which will never match.
+	node, dc, err := structs.ParseNodeIdentity(identity)
+	if err != nil {
+		node, dc = identity, ""
+	}
+	return &nodeBoundACL{ACL: a, node: node, dc: dc}
+}
+
+// vetNodeIdentity returns a permission denied error if the given ACL is bound
+// to a node other than the given node in the given datacenter.
+func vetNodeIdentity(a acl.ACL, node, dc string) error {
+	bound, ok := a.(*nodeBoundACL)
+	if !ok {
+		return nil
+	}
+	if !strings.EqualFold(bound.node, node) || bound.dc != dc {
+		return permissionDeniedErr
+	}
+	return nil
 }
 
 // resolveToken is the primary interface used by ACL-checkers (such as an
 // endpoint handling a request) to resolve a token. If ACLs aren't enabled
 // then this will return a nil token, otherwise it will attempt to use local
 // cache and ultimately the ACL datacenter to get the policy associated with the
-// token.
-func (s *Server) resolveToken(id string) (acl.ACL, error) {
+// token. The endpoint is the RPC endpoint making the checks, like "KVS.Apply",
+// which is what the checks a token's shadow rules would deny are reported
+// under.
+func (s *Server) resolveToken(endpoint, id string) (acl.ACL, error) {
+	resolved, err := s.lookupToken(id)
+	if err != nil || resolved == nil {
+		return resolved, err
+	}
+
+	// Track usage of tokens that resolved successfully.
+	if s.isACLUsageEnabled() {
+		if len(id) == 0 {
+			id = anonymousToken
+		}
+		s.aclUsage.record(id)
+	}
+	return shadowForEndpoint(resolved, endpoint), nil
+}
+
+// lookupToken resolves a token the same way as resolveToken, but without
+// counting it as a use of the token.
+func (s *Server) lookupToken(id string) (acl.ACL, error) {
 	// Check if there is no ACL datacenter (ACLs disabled)
 	authDC := s.config.ACLDatacenter
 	if len(authDC) == 0 {
@@ -102,12 +206,46 @@ func (s *Server) resolveToken(id string) (acl.ACL, error) {
 
 	// Check if we are the ACL datacenter and the leader, use the
 	// authoritative cache
+	var resolved acl.ACL
+	var err error
 	if s.config.Datacenter == authDC && s.IsLeader() {
-		return s.aclAuthCache.GetACL(id)
+		resolved, err = s.aclAuthCache.GetACL(id)
+
+		// The authoritative cache only deals with rules, so check where
+		// the token applies and its shadow rules directly.
+		if err == nil {
+			var parent string
+			var token *structs.ACL
+			if parent, _, token, err = s.aclLocalLookup(id); err == nil {
+				if !aclAppliesInDatacenter(token.Datacenters, s.config.Datacenter) {
+					resolved = acl.DenyAll()
+				} else if token.ShadowRules != "" {
+					resolved, err = s.aclLocalShadow(resolved, parent, token.ShadowRules, id)
+				}
+				if err == nil {
+					resolved = bindACLToNode(resolved, token.NodeIdentity)
+				}
+			}
+		}
+	} else {
+		// Use our non-authoritative cache
+		resolved, err = s.aclCache.lookupACL(id, authDC)
+	}
+	if err != nil {
+		return nil, err
 	}
+	return resolved, nil
+}
 
-	// Use our non-authoritative cache
-	return s.aclCache.lookupACL(id, authDC)
+// hashToken returns a short hash of the given token, so things done with the
+// same token can be grouped without giving the token away. This is an empty
+// string for the anonymous token.
+func hashToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("%x", sum[:8])
 }
 
 // rpcFn is used to make an RPC call to the client or server.
@@ -129,19 +267,41 @@ type aclCache struct {
 
 	// local is a function used to look for an ACL locally if replication is
 	// enabled. This will be nil if replication isn't enabled.
-	local acl.FaultFunc
+	local aclLocalFunc
+
+	// defaults are the per-type default policies last heard from the ACL
+	// datacenter, which are used for replicated ACLs if it can't be
+	// reached. This is nil until we've heard from it.
+	defaults     map[string]string
+	defaultsLock sync.RWMutex
+
+	// shadow is used to check tokens' shadow rules.
+	shadow *aclShadow
+
+	// downPolicy and ttl start out as the configured ACLDownPolicy and
+	// ACLTTL, and can be changed when the server's config is reloaded.
+	downPolicy     string
+	ttl            time.Duration
+	downPolicyLock sync.RWMutex
 }
 
+// aclLocalFunc looks up the parent policy, rules, and token for an ACL from
+// the local state store.
+type aclLocalFunc func(id string) (string, string, *structs.ACL, error)
+
 // newAclCache returns a new non-authoritative cache for ACLs. This is used for
 // performance, and is used inside the ACL datacenter on non-leader servers, and
 // outside the ACL datacenter everywhere.
-func newAclCache(conf *Config, logger *log.Logger, rpc rpcFn, local acl.FaultFunc) (*aclCache, error) {
+func newAclCache(conf *Config, logger *log.Logger, rpc rpcFn, local aclLocalFunc, shadow *aclShadow) (*aclCache, error) {
 	var err error
 	cache := &aclCache{
-		config: conf,
-		logger: logger,
-		rpc:    rpc,
-		local:  local,
+		config:     conf,
+		logger:     logger,
+		rpc:        rpc,
+		local:      local,
+		shadow:     shadow,
+		downPolicy: conf.ACLDownPolicy,
+		ttl:        conf.ACLTTL,
 	}
 
 	// Initialize the non-authoritative ACL cache
@@ -187,6 +347,11 @@ func (c *aclCache) lookupACL(id, authDC string) (acl.ACL, error) {
 	var reply structs.ACLPolicy
 	err := c.rpc("ACL.GetPolicy", &args, &reply)
 	if err == nil {
+		// The defaults are only sent along with a new policy, since
+		// they're part of the ETag.
+		if reply.Policy != nil {
+			c.setDefaults(reply.ParentDefaults)
+		}
 		return c.useACLPolicy(id, authDC, cached, &reply)
 	}
 
@@ -215,8 +380,9 @@ func (c *aclCache) lookupACL(id, authDC string) (acl.ACL, error) {
 	// local ACL fault function is registered to query replicated ACL data,
 	// and the user's policy allows it, we will try locally before we give
 	// up.
-	if c.local != nil && c.config.ACLDownPolicy == "extend-cache" {
-		parent, rules, err := c.local(id)
+	downPolicy, ttl := c.getDownPolicy()
+	if c.local != nil && downPolicy == "extend-cache" {
+		parent, rules, token, err := c.local(id)
 		if err != nil {
 			// We don't make an exception here for ACLs that aren't
 			// found locally. It seems more robust to use an expired
@@ -238,16 +404,31 @@ func (c *aclCache) lookupACL(id, authDC string) (acl.ACL, error) {
 		// Note we use the local TTL here, so this'll be used for that
 		// amount of time even once the ACL datacenter becomes available.
 		metrics.IncrCounter([]string{"consul", "acl", "replication_hit"}, 1)
-		reply.ETag = makeACLETag(parent, policy)
-		reply.TTL = c.config.ACLTTL
+		defaults := c.getDefaults()
+		reply.ETag = makeACLETag(parent, defaults, policy, token)
+		reply.TTL = ttl
 		reply.Parent = parent
 		reply.Policy = policy
+		reply.Datacenters = token.Datacenters
+		reply.NodeIdentity = token.NodeIdentity
+		reply.RateLimit = token.RateLimit
+		reply.SessionLimit = token.SessionLimit
+		reply.ParentDefaults = defaults
+		if token.ShadowRules != "" {
+			shadow, err := acl.Parse(token.ShadowRules)
+			if err != nil {
+				c.logger.Printf("[DEBUG] consul.acl: Failed to parse shadow policy for replicated ACL: %v", err)
+				goto ACL_DOWN
+			}
+			shadow.ID = acl.RuleID(token.ShadowRules)
+			reply.ShadowPolicy = shadow
+		}
 		return c.useACLPolicy(id, authDC, cached, &reply)
 	}
 
 ACL_DOWN:
 	// Unable to refresh, apply the down policy.
-	switch c.config.ACLDownPolicy {
+	switch downPolicy {
 	case "allow":
 		return acl.AllowAll(), nil
 	case "extend-cache":
@@ -260,6 +441,43 @@ ACL_DOWN:
 	}
 }
 
+// setDownPolicy changes the down policy, and the TTL used for ACLs found
+// locally when the ACL datacenter is down.
+func (c *aclCache) setDownPolicy(policy string, ttl time.Duration) {
+	c.downPolicyLock.Lock()
+	defer c.downPolicyLock.Unlock()
+	c.downPolicy, c.ttl = policy, ttl
+}
+
+// getDownPolicy returns the down policy and TTL.
+func (c *aclCache) getDownPolicy() (string, time.Duration) {
+	c.downPolicyLock.RLock()
+	defer c.downPolicyLock.RUnlock()
+	return c.downPolicy, c.ttl
+}
+
+// setDefaults records the per-type default policies from the ACL datacenter.
+func (c *aclCache) setDefaults(defaults map[string]string) {
+	c.defaultsLock.Lock()
+	defer c.defaultsLock.Unlock()
+	if defaults == nil {
+		defaults = make(map[string]string)
+	}
+	c.defaults = defaults
+}
+
+// getDefaults returns the per-type default policies last heard from the ACL
+// datacenter, or the ones in our own configuration if we haven't heard from
+// it yet.
+func (c *aclCache) getDefaults() map[string]string {
+	c.defaultsLock.RLock()
+	defer c.defaultsLock.RUnlock()
+	if c.defaults == nil {
+		return c.config.ACLDefaultPolicies
+	}
+	return c.defaults
+}
+
 // useACLPolicy handles an ACLPolicy response
 func (c *aclCache) useACLPolicy(id, authDC string, cached *aclCacheEntry, p *structs.ACLPolicy) (acl.ACL, error) {
 	// Check if we can used the cached policy
@@ -272,14 +490,21 @@ func (c *aclCache) useACLPolicy(id, authDC string, cached *aclCacheEntry, p *str
 		return cached.ACL, nil
 	}
 
-	// Check for a cached compiled policy
+	// Check for a cached compiled policy. Tokens that don't apply in this
+	// datacenter are denied everything, even with an allow default policy,
+	// since they aren't meant to be used here at all. Tokens with shadow rules
+	// aren't shared, since what they would deny is tracked per token.
 	var compiled acl.ACL
+	shadowed := p.ShadowPolicy != nil && c.shadow != nil
 	raw, ok := c.policies.Get(p.ETag)
-	if ok {
+	if ok && !shadowed {
 		compiled = raw.(acl.ACL)
+	} else if !aclAppliesInDatacenter(p.Datacenters, c.config.Datacenter) {
+		compiled = acl.DenyAll()
+		c.policies.Add(p.ETag, compiled)
 	} else {
 		// Resolve the parent policy
-		parent := acl.RootACL(p.Parent)
+		parent := acl.RootACLWithDefaults(p.Parent, p.ParentDefaults)
 		if parent == nil {
 			var err error
 			parent, err = c.lookupACL(p.Parent, authDC)
@@ -289,20 +514,31 @@ func (c *aclCache) useACLPolicy(id, authDC string, cached *aclCacheEntry, p *str
 		}
 
 		// Compile the ACL
+		parentKey := p.Parent + ":" + acl.DefaultsID(p.ParentDefaults)
 		acl, err := acl.New(parent, p.Policy)
 		if err != nil {
 			return nil, err
 		}
 
-		// Cache the policy
-		c.policies.Add(p.ETag, acl)
-		compiled = acl
+		// Cache the policy, unless it's for a token with shadow rules.
+		if shadowed {
+			shadow, err := c.shadow.wrap(acl, parent, parentKey, p.ShadowPolicy, id)
+			if err != nil {
+				return nil, err
+			}
+			compiled = bindACLToNode(shadow, p.NodeIdentity)
+		} else {
+			compiled = bindACLToNode(acl, p.NodeIdentity)
+			c.policies.Add(p.ETag, compiled)
+		}
 	}
 
 	// Cache the ACL
 	cached = &aclCacheEntry{
-		ACL:  compiled,
-		ETag: p.ETag,
+		ACL:          compiled,
+		ETag:         p.ETag,
+		RateLimit:    p.RateLimit,
+		SessionLimit: p.SessionLimit,
 	}
 	if p.TTL > 0 {
 		cached.Expires = time.Now().Add(p.TTL)
@@ -311,6 +547,26 @@ func (c *aclCache) useACLPolicy(id, authDC string, cached *aclCacheEntry, p *str
 	return compiled, nil
 }
 
+// tokenRateLimit returns the rate limit of the given token, and false if it
+// isn't in the cache.
+func (c *aclCache) tokenRateLimit(id string) (float64, bool) {
+	raw, ok := c.acls.Peek(id)
+	if !ok {
+		return 0, false
+	}
+	return raw.(*aclCacheEntry).RateLimit, true
+}
+
+// tokenSessionLimit returns the session limit of the given token if it's in
+// the cache, or zero if it isn't.
+func (c *aclCache) tokenSessionLimit(id string) int {
+	raw, ok := c.acls.Peek(id)
+	if !ok {
+		return 0
+	}
+	return raw.(*aclCacheEntry).SessionLimit
+}
+
 // aclFilter is used to filter results from our state store based on ACL rules
 // configured for the provided token.
 type aclFilter struct {
@@ -383,6 +639,22 @@ func (f *aclFilter) filterServices(services structs.Services) {
 	}
 }
 
+// filterServiceSummaries is used to filter service summaries based on ACL
+// rules.
+func (f *aclFilter) filterServiceSummaries(summaries *structs.ServiceSummaries) {
+	s := *summaries
+	for i := 0; i < len(s); i++ {
+		svc := s[i].Name
+		if f.allowService(svc) {
+			continue
+		}
+		f.logger.Printf("[DEBUG] consul: dropping service %q from result due to ACLs", svc)
+		s = append(s[:i], s[i+1:]...)
+		i--
+	}
+	*summaries = s
+}
+
 // filterServiceNodes is used to filter a set of nodes for a given service
 // based on the configured ACL rules.
 func (f *aclFilter) filterServiceNodes(nodes *structs.ServiceNodes) {
@@ -419,6 +691,27 @@ func (f *aclFilter) filterNodeServices(services **structs.NodeServices) {
 	}
 }
 
+// filterNodeCatalogDiff is used to filter the changes for a node based on
+// ACL rules.
+func (f *aclFilter) filterNodeCatalogDiff(node string, diff *structs.NodeCatalogDiff) {
+	if !f.allowNode(node) {
+		*diff = structs.NodeCatalogDiff{Indexes: diff.Indexes}
+		return
+	}
+
+	svcs := diff.Services
+	for i := 0; i < len(svcs); i++ {
+		if f.allowService(svcs[i].Service) {
+			continue
+		}
+		f.logger.Printf("[DEBUG] consul: dropping service %q from result due to ACLs", svcs[i].ID)
+		svcs = append(svcs[:i], svcs[i+1:]...)
+		i--
+	}
+	diff.Services = svcs
+	f.filterHealthChecks(&diff.Checks)
+}
+
 // filterCheckServiceNodes is used to filter nodes based on ACL rules.
 func (f *aclFilter) filterCheckServiceNodes(nodes *structs.CheckServiceNodes) {
 	csn := *nodes
@@ -505,6 +798,67 @@ func (f *aclFilter) filterNodeDump(dump *structs.NodeDump) {
 	*dump = nd
 }
 
+// filterReverseLookup is used to filter the results of a reverse lookup
+// based on the configured ACL rules. A match is dropped altogether if the
+// only ways it matched were through services the token can't read.
+func (f *aclFilter) filterReverseLookup(matches *[]*structs.ReverseLookupMatch) {
+	m := *matches
+	for i := 0; i < len(m); i++ {
+		match := m[i]
+
+		// Filter nodes
+		if node := match.Node.Node; !f.allowNode(node) {
+			f.logger.Printf("[DEBUG] consul: dropping node %q from result due to ACLs", node)
+			m = append(m[:i], m[i+1:]...)
+			i--
+			continue
+		}
+
+		// Filter services, along with any matches through their addresses
+		for j := 0; j < len(match.Services); j++ {
+			svc := match.Services[j]
+			if f.allowService(svc.Service) {
+				continue
+			}
+			f.logger.Printf("[DEBUG] consul: dropping service %q from result due to ACLs", svc.Service)
+			match.Services = append(match.Services[:j], match.Services[j+1:]...)
+			j--
+
+			reason := structs.ReverseLookupServiceAddress + ":" + svc.ID
+			for k := 0; k < len(match.MatchedBy); k++ {
+				if match.MatchedBy[k] == reason {
+					match.MatchedBy = append(match.MatchedBy[:k], match.MatchedBy[k+1:]...)
+					k--
+				}
+			}
+		}
+		if len(match.MatchedBy) == 0 {
+			m = append(m[:i], m[i+1:]...)
+			i--
+			continue
+		}
+
+		// Filter checks
+		for j := 0; j < len(match.Checks); j++ {
+			chk := match.Checks[j]
+			if f.allowService(chk.ServiceName) {
+				continue
+			}
+			f.logger.Printf("[DEBUG] consul: dropping check %q from result due to ACLs", chk.CheckID)
+			match.Checks = append(match.Checks[:j], match.Checks[j+1:]...)
+			j--
+		}
+
+		// Filter sessions, and the locks they hold
+		f.filterSessions(&match.Sessions)
+		if len(match.Sessions) == 0 {
+			match.Locks = nil
+		}
+		match.Locks = FilterDirEnt(f.acl, match.Locks)
+	}
+	*matches = m
+}
+
 // filterNodes is used to filter through all parts of a node list and remove
 // elements the provided ACL token cannot access.
 func (f *aclFilter) filterNodes(nodes *structs.Nodes) {
@@ -581,10 +935,11 @@ func (f *aclFilter) filterPreparedQueries(queries *structs.PreparedQueries) {
 
 // filterACL is used to filter results from our service catalog based on the
 // rules configured for the provided token. The subject is scrubbed and
-// modified in-place, leaving only resources the token can access.
-func (s *Server) filterACL(token string, subj interface{}) error {
+// modified in-place, leaving only resources the token can access. The endpoint
+// is the one doing the filtering, see resolveToken.
+func (s *Server) filterACL(endpoint, token string, subj interface{}) error {
 	// Get the ACL from the token
-	acl, err := s.resolveToken(token)
+	acl, err := s.resolveToken(endpoint, token)
 	if err != nil {
 		return err
 	}
@@ -616,15 +971,30 @@ func (s *Server) filterACL(token string, subj interface{}) error {
 	case *structs.IndexedNodes:
 		filt.filterNodes(&v.Nodes)
 
+	case *structs.IndexedReverseLookup:
+		filt.filterReverseLookup(&v.Matches)
+
 	case *structs.IndexedNodeServices:
 		filt.filterNodeServices(&v.NodeServices)
 
+	case *structs.IndexedNodeCatalogDiff:
+		filt.filterNodeCatalogDiff(v.Node, &v.Diff)
+
+	case *structs.IndexedConsistentRead:
+		filt.filterNodes(&v.Results.Nodes)
+		filt.filterServices(v.Results.Services)
+		filt.filterHealthChecks(&v.Results.Checks)
+		filt.filterCoordinates(&v.Results.Coordinates)
+
 	case *structs.IndexedServiceNodes:
 		filt.filterServiceNodes(&v.ServiceNodes)
 
 	case *structs.IndexedServices:
 		filt.filterServices(v.Services)
 
+	case *structs.IndexedServiceSummaries:
+		filt.filterServiceSummaries(&v.Services)
+
 	case *structs.IndexedSessions:
 		filt.filterSessions(&v.Sessions)
 
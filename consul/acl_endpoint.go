@@ -2,6 +2,7 @@ package consul
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/armon/go-metrics"
@@ -49,6 +50,41 @@ func aclApplyInternal(srv *Server, args *structs.ACLRequest, reply *string) erro
 			return fmt.Errorf("ACL rule compilation failed: %v", err)
 		}
 
+		// Validate the datacenters
+		for _, dc := range args.ACL.Datacenters {
+			if dc == "" {
+				return fmt.Errorf("Invalid ACL datacenter: datacenter names can't be empty")
+			}
+		}
+
+		// Validate the node binding
+		if args.ACL.NodeIdentity != "" {
+			if _, _, err := structs.ParseNodeIdentity(args.ACL.NodeIdentity); err != nil {
+				return err
+			}
+		}
+
+		// Validate the rate limit
+		if args.ACL.RateLimit < 0 {
+			return fmt.Errorf("Invalid ACL rate limit: must not be negative")
+		}
+
+		// Validate the session limit
+		if args.ACL.SessionLimit < 0 {
+			return fmt.Errorf("Invalid ACL session limit: must not be negative")
+		}
+
+		// Validate the shadow rules, which only make sense for tokens
+		// that use rules.
+		if args.ACL.ShadowRules != "" {
+			if args.ACL.Type == structs.ACLTypeManagement {
+				return fmt.Errorf("Invalid ACL shadow rules: management tokens don't use rules")
+			}
+			if _, err := acl.Parse(args.ACL.ShadowRules); err != nil {
+				return fmt.Errorf("ACL shadow rule compilation failed: %v", err)
+			}
+		}
+
 	case structs.ACLDelete:
 		if args.ACL.ID == anonymousToken {
 			return fmt.Errorf("%s: Cannot delete anonymous token", permissionDenied)
@@ -90,7 +126,7 @@ func (a *ACL) Apply(args *structs.ACLRequest, reply *string) error {
 	}
 
 	// Verify token is permitted to modify ACLs
-	if acl, err := a.srv.resolveToken(args.Token); err != nil {
+	if acl, err := a.srv.resolveToken("ACL.Apply", args.Token); err != nil {
 		return err
 	} else if acl == nil || !acl.ACLModify() {
 		return permissionDeniedErr
@@ -134,6 +170,55 @@ func (a *ACL) Apply(args *structs.ACLRequest, reply *string) error {
 	return nil
 }
 
+// EnforceShadow replaces an ACL's rules with its shadow rules, so the checks
+// they would have denied are denied from now on. Shadow rules never take
+// effect any other way.
+func (a *ACL) EnforceShadow(args *structs.ACLEnforceShadowRequest, reply *string) error {
+	if done, err := a.srv.forward("ACL.EnforceShadow", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "acl", "enforce_shadow"}, time.Now())
+
+	// Verify we are allowed to serve this request
+	if a.srv.config.ACLDatacenter != a.srv.config.Datacenter {
+		return fmt.Errorf(aclDisabled)
+	}
+
+	// Verify token is permitted to modify ACLs
+	if acl, err := a.srv.resolveToken("ACL.EnforceShadow", args.Token); err != nil {
+		return err
+	} else if acl == nil || !acl.ACLModify() {
+		return permissionDeniedErr
+	}
+
+	_, existing, err := a.srv.fsm.State().ACLGet(nil, args.ACL)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return fmt.Errorf(aclNotFound)
+	}
+	if existing.ShadowRules == "" {
+		return fmt.Errorf("ACL has no shadow rules to enforce")
+	}
+
+	// Swap in the shadow rules with the usual checks.
+	update := *existing
+	update.Rules, update.ShadowRules = existing.ShadowRules, ""
+	req := structs.ACLRequest{
+		Datacenter: args.Datacenter,
+		Op:         structs.ACLSet,
+		ACL:        update,
+	}
+	if err := aclApplyInternal(a.srv, &req, reply); err != nil {
+		return err
+	}
+	a.srv.aclAuthCache.ClearACL(args.ACL)
+	a.srv.aclShadow.clear(args.ACL)
+	a.srv.logger.Printf("[INFO] consul.acl: Enforced shadow rules for token %s", hashToken(args.ACL))
+	return nil
+}
+
 // Get is used to retrieve a single ACL
 func (a *ACL) Get(args *structs.ACLSpecificRequest,
 	reply *structs.IndexedACLs) error {
@@ -164,9 +249,30 @@ func (a *ACL) Get(args *structs.ACLSpecificRequest,
 		})
 }
 
-// makeACLETag returns an ETag for the given parent and policy.
-func makeACLETag(parent string, policy *acl.Policy) string {
-	return fmt.Sprintf("%s:%s", parent, policy.ID)
+// makeACLETag returns an ETag for the given parent and policy, along with
+// the per-type defaults and the parts of the token that limit where and how
+// often it can be used.
+func makeACLETag(parent string, defaults map[string]string, policy *acl.Policy, token *structs.ACL) string {
+	etag := fmt.Sprintf("%s:%s", parent, policy.ID)
+	if id := acl.DefaultsID(defaults); id != "" {
+		etag += ":defaults=" + id
+	}
+	if len(token.Datacenters) != 0 {
+		etag += ":" + strings.Join(token.Datacenters, ",")
+	}
+	if token.NodeIdentity != "" {
+		etag += ":node=" + token.NodeIdentity
+	}
+	if token.RateLimit != 0 {
+		etag += fmt.Sprintf(":rate=%g", token.RateLimit)
+	}
+	if token.SessionLimit != 0 {
+		etag += fmt.Sprintf(":sessions=%d", token.SessionLimit)
+	}
+	if token.ShadowRules != "" {
+		etag += ":shadow=" + acl.RuleID(token.ShadowRules)
+	}
+	return etag
 }
 
 // GetPolicy is used to retrieve a compiled policy object with a TTL. Does not
@@ -187,20 +293,69 @@ func (a *ACL) GetPolicy(args *structs.ACLPolicyRequest, reply *structs.ACLPolicy
 		return err
 	}
 
+	// The cache doesn't track where the token applies, so look that up
+	// separately. The requesting server decides what to do with it.
+	_, _, token, err := a.srv.aclLocalLookup(args.ACL)
+	if err != nil {
+		return err
+	}
+
 	// Generate an ETag
 	conf := a.srv.config
-	etag := makeACLETag(parent, policy)
+	etag := makeACLETag(parent, conf.ACLDefaultPolicies, policy, token)
 
 	// Setup the response
 	reply.ETag = etag
-	reply.TTL = conf.ACLTTL
+	reply.TTL = a.srv.aclTTL()
 	a.srv.setQueryMeta(&reply.QueryMeta)
 
 	// Only send the policy on an Etag mis-match
 	if args.ETag != etag {
 		reply.Parent = parent
 		reply.Policy = policy
+		reply.Datacenters = token.Datacenters
+		reply.NodeIdentity = token.NodeIdentity
+		reply.RateLimit = token.RateLimit
+		reply.SessionLimit = token.SessionLimit
+		reply.ParentDefaults = conf.ACLDefaultPolicies
+		if token.ShadowRules != "" {
+			reply.ShadowPolicy, err = a.srv.aclAuthCache.GetPolicy(token.ShadowRules)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Defaults returns the default ACL policies in effect. These come from the
+// ACL datacenter, so other datacenters pass the request along to it.
+func (a *ACL) Defaults(args *structs.DCSpecificRequest, reply *structs.ACLDefaults) error {
+	if done, err := a.srv.forward("ACL.Defaults", args, args, reply); done {
+		return err
+	}
+
+	// Verify ACLs are enabled.
+	authDC := a.srv.config.ACLDatacenter
+	if authDC == "" {
+		return fmt.Errorf(aclDisabled)
+	}
+
+	// This action requires operator read access.
+	if rule, err := a.srv.resolveToken("ACL.Defaults", args.Token); err != nil {
+		return err
+	} else if rule != nil && !rule.OperatorRead() {
+		return permissionDeniedErr
 	}
+
+	if authDC != a.srv.config.Datacenter {
+		args.Datacenter = authDC
+		return a.srv.forwardDC("ACL.Defaults", authDC, args, reply)
+	}
+
+	reply.Default = a.srv.config.ACLDefaultPolicy
+	reply.Types = acl.EffectiveDefaults(a.srv.config.ACLDefaultPolicy, a.srv.config.ACLDefaultPolicies)
+	a.srv.setQueryMeta(&reply.QueryMeta)
 	return nil
 }
 
@@ -217,7 +372,7 @@ func (a *ACL) List(args *structs.DCSpecificRequest,
 	}
 
 	// Verify token is permitted to list ACLs
-	if acl, err := a.srv.resolveToken(args.Token); err != nil {
+	if acl, err := a.srv.resolveToken("ACL.List", args.Token); err != nil {
 		return err
 	} else if acl == nil || !acl.ACLList() {
 		return permissionDeniedErr
@@ -236,6 +391,118 @@ func (a *ACL) List(args *structs.DCSpecificRequest,
 		})
 }
 
+// Introspect is used to check what a token can do. The token is resolved the
+// same way as when it's used, including the cache and the down policy, and
+// each probe is checked against the result. Nothing is changed, and the check
+// doesn't count as a use of the token.
+func (a *ACL) Introspect(args *structs.ACLIntrospectRequest,
+	reply *structs.ACLIntrospectResponse) error {
+	if done, err := a.srv.forward("ACL.Introspect", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "acl", "introspect"}, time.Now())
+
+	// There's nothing to check if ACLs are off.
+	if a.srv.config.ACLDatacenter == "" {
+		return fmt.Errorf(aclDisabled)
+	}
+
+	// Checking any token other than your own needs a management token.
+	subject := args.Subject
+	if subject == "" {
+		subject = args.Token
+	} else if subject != args.Token {
+		if caller, err := a.srv.resolveToken("ACL.Introspect", args.Token); err != nil {
+			return err
+		} else if caller == nil || !caller.ACLList() {
+			return permissionDeniedErr
+		}
+	}
+
+	resolved, err := a.srv.lookupToken(subject)
+	if err != nil {
+		if !strings.Contains(err.Error(), aclNotFound) {
+			return err
+		}
+		reply.TokenStatus = structs.ACLTokenNotFound
+		a.srv.setQueryMeta(&reply.QueryMeta)
+		return nil
+	}
+
+	// Binding a token to a node only limits what it can register, which
+	// isn't something that can be probed. Probes also shouldn't show up as
+	// things the token's shadow rules would deny.
+	if bound, ok := resolved.(*nodeBoundACL); ok {
+		resolved = bound.ACL
+	}
+	if shadow, ok := resolved.(*shadowACL); ok {
+		resolved = shadow.ACL
+	}
+
+	reply.TokenStatus = structs.ACLTokenResolved
+	reply.Results = make([]structs.ACLProbeResult, 0, len(args.Probes))
+	for _, probe := range args.Probes {
+		allowed, err := acl.Allowed(resolved, probe.Resource, probe.Segment, probe.Access)
+		if err != nil {
+			return err
+		}
+		reply.Results = append(reply.Results, structs.ACLProbeResult{
+			ACLProbe: probe,
+			Allowed:  allowed,
+			Rule:     acl.Explain(resolved, probe.Resource, probe.Segment, probe.Access),
+		})
+	}
+	a.srv.setQueryMeta(&reply.QueryMeta)
+	return nil
+}
+
+// ReportUsage is used by servers to send the token usage they've seen to the
+// ACL datacenter. The usage is reported by token hash, so the tokens aren't
+// sent around for this, and the leader matches the hashes back up with its
+// tokens and adds the usage to its pending usage so it's written along with
+// its own on the next flush.
+func (a *ACL) ReportUsage(args *structs.ACLUsageRequest, reply *struct{}) error {
+	if done, err := a.srv.forward("ACL.ReportUsage", args, args, reply); done {
+		return err
+	}
+
+	// Verify we are allowed to serve this request
+	if a.srv.config.ACLDatacenter != a.srv.config.Datacenter {
+		return fmt.Errorf(aclDisabled)
+	}
+
+	// Only callers with a real token can report usage, so anyone who can
+	// reach the servers can't pad it out. This doesn't count as a use of
+	// the token.
+	if args.Token == "" || args.Token == anonymousToken {
+		return permissionDeniedErr
+	}
+	if _, err := a.srv.lookupToken(args.Token); err != nil {
+		return err
+	}
+
+	// If we aren't tracking usage there's nothing to flush it, so drop it.
+	if !a.srv.isACLUsageEnabled() {
+		return nil
+	}
+	_, acls, err := a.srv.fsm.State().ACLList(nil)
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]string, len(acls))
+	for _, acl := range acls {
+		ids[hashToken(acl.ID)] = acl.ID
+	}
+	var usage structs.ACLUsages
+	for _, u := range args.Usage {
+		if id, ok := ids[u.ID]; ok {
+			usage = append(usage, &structs.ACLUsage{ID: id, LastUsed: u.LastUsed, Uses: u.Uses})
+		}
+	}
+	a.srv.aclUsage.merge(usage)
+	return nil
+}
+
 // ReplicationStatus is used to retrieve the current ACL replication status.
 func (a *ACL) ReplicationStatus(args *structs.DCSpecificRequest,
 	reply *structs.ACLReplicationStatus) error {
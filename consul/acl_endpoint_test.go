@@ -2,6 +2,7 @@ package consul
 
 import (
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -100,7 +101,7 @@ func TestACLEndpoint_Update_PurgeCache(t *testing.T) {
 	id := out
 
 	// Resolve
-	acl1, err := s1.resolveToken(id)
+	acl1, err := s1.resolveToken("", id)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -119,7 +120,7 @@ func TestACLEndpoint_Update_PurgeCache(t *testing.T) {
 	}
 
 	// Resolve again
-	acl2, err := s1.resolveToken(id)
+	acl2, err := s1.resolveToken("", id)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -141,7 +142,7 @@ func TestACLEndpoint_Update_PurgeCache(t *testing.T) {
 	}
 
 	// Resolve again
-	acl3, err := s1.resolveToken(id)
+	acl3, err := s1.resolveToken("", id)
 	if err == nil || err.Error() != aclNotFound {
 		t.Fatalf("err: %v", err)
 	}
@@ -467,6 +468,103 @@ func TestACLEndpoint_List_Denied(t *testing.T) {
 	}
 }
 
+func TestACLEndpoint_Introspect(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+		c.ACLUsageFlushInterval = time.Hour
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	token := makeTestToken(t, codec, `
+key "foo/" {
+	policy = "write"
+}
+key "foo/private/" {
+	policy = "deny"
+}
+service "bar" {
+	policy = "read"
+}
+`, 0)
+
+	arg := structs.ACLIntrospectRequest{
+		Datacenter: "dc1",
+		Probes: []structs.ACLProbe{
+			{Resource: "key", Segment: "foo/bar", Access: "read"},
+			{Resource: "key", Segment: "foo/private/bar", Access: "read"},
+			{Resource: "service", Segment: "bar", Access: "write"},
+			{Resource: "service", Segment: "bar", Access: "read"},
+			{Resource: "node", Segment: "node1", Access: "read"},
+		},
+		QueryOptions: structs.QueryOptions{Token: token},
+	}
+	expected := []structs.ACLProbeResult{
+		{ACLProbe: arg.Probes[0], Allowed: true, Rule: `key "foo/" = "write"`},
+		{ACLProbe: arg.Probes[1], Allowed: false, Rule: `key "foo/private/" = "deny"`},
+		{ACLProbe: arg.Probes[2], Allowed: false, Rule: `service "bar" = "read"`},
+		{ACLProbe: arg.Probes[3], Allowed: true, Rule: `service "bar" = "read"`},
+		{ACLProbe: arg.Probes[4], Allowed: false, Rule: `root "deny"`},
+	}
+
+	// A token can check itself.
+	var reply structs.ACLIntrospectResponse
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Introspect", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.TokenStatus != structs.ACLTokenResolved || !reflect.DeepEqual(reply.Results, expected) {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	// Another token needs management access to check it.
+	arg.Subject = token
+	arg.Token = ""
+	err := msgpackrpc.CallWithCodec(codec, "ACL.Introspect", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Token = "root"
+	var reply2 structs.ACLIntrospectResponse
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Introspect", &arg, &reply2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply2.TokenStatus != structs.ACLTokenResolved || !reflect.DeepEqual(reply2.Results, expected) {
+		t.Fatalf("bad: %#v", reply2)
+	}
+
+	// Checking a token shouldn't count as using it.
+	for _, usage := range s1.aclUsage.drain() {
+		if usage.ID == token {
+			t.Fatalf("bad: %#v", usage)
+		}
+	}
+
+	// An unknown token gets its own status rather than an error or a
+	// pile of denials.
+	arg.Subject = "nope"
+	var reply3 structs.ACLIntrospectResponse
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Introspect", &arg, &reply3); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply3.TokenStatus != structs.ACLTokenNotFound || len(reply3.Results) != 0 {
+		t.Fatalf("bad: %#v", reply3)
+	}
+
+	// Bad probes are rejected.
+	arg.Subject = token
+	arg.Probes = []structs.ACLProbe{{Resource: "nope", Access: "read"}}
+	err = msgpackrpc.CallWithCodec(codec, "ACL.Introspect", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), "Invalid resource") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestACLEndpoint_ReplicationStatus(t *testing.T) {
 	dir1, s1 := testServerWithConfig(t, func(c *Config) {
 		c.ACLDatacenter = "dc2"
@@ -0,0 +1,397 @@
+package consul
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/consul/agent"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/golang-lru"
+)
+
+const (
+	// aclShadowMaxDenials limits how many different would-be denials are
+	// tracked, so a busy token can't use up all our memory. Checks past
+	// the limit are still counted in the metrics.
+	aclShadowMaxDenials = 4096
+
+	// aclShadowCacheSize is the number of compiled shadow policies kept.
+	aclShadowCacheSize = 1024
+
+	// aclResourceSnapshot is used to report snapshot checks, which don't
+	// have a resource in the acl package since there's no rule for them.
+	aclResourceSnapshot = "snapshot"
+)
+
+// aclShadowKey identifies a would-be denial.
+type aclShadowKey struct {
+	tokenHash string
+	endpoint  string
+	resource  string
+	segment   string
+	access    string
+}
+
+// aclShadow keeps track of the checks that tokens' shadow rules would have
+// denied, and caches the compiled shadow policies for the authoritative ACL
+// path.
+type aclShadow struct {
+	logger *log.Logger
+
+	// compiled holds compiled shadow ACLs, keyed by parent and rule ID.
+	compiled *lru.TwoQueueCache
+
+	// denials holds the would-be denials seen so far.
+	denials map[aclShadowKey]*structs.ACLShadowDenial
+	lock    sync.Mutex
+}
+
+// newACLShadow returns a new tracker for shadow rules.
+func newACLShadow(logger *log.Logger) (*aclShadow, error) {
+	compiled, err := lru.New2Q(aclShadowCacheSize)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create ACL shadow cache: %v", err)
+	}
+	return &aclShadow{
+		logger:   logger,
+		compiled: compiled,
+		denials:  make(map[aclShadowKey]*structs.ACLShadowDenial),
+	}, nil
+}
+
+// wrap returns an ACL that enforces the given effective ACL, but also checks
+// the given shadow policy and records anything it would deny for the given
+// token. The parent key identifies the parent ACL for caching.
+func (s *aclShadow) wrap(effective, parent acl.ACL, parentKey string, policy *acl.Policy, id string) (acl.ACL, error) {
+	key := parentKey + ":" + policy.ID
+	var shadow acl.ACL
+	if raw, ok := s.compiled.Get(key); ok {
+		shadow = raw.(acl.ACL)
+	} else {
+		compiled, err := acl.New(parent, policy)
+		if err != nil {
+			return nil, err
+		}
+		shadow = compiled
+		s.compiled.Add(key, shadow)
+	}
+
+	return &shadowACL{
+		ACL:       effective,
+		shadow:    shadow,
+		tokenHash: hashToken(id),
+		tracker:   s,
+	}, nil
+}
+
+// record counts a check that shadow rules would have denied. The first time
+// each one is seen it's also logged.
+func (s *aclShadow) record(tokenHash, endpoint, resource, segment, access string) {
+	metrics.IncrCounter([]string{"consul", "acl", "shadow", "would_deny"}, 1)
+
+	key := aclShadowKey{tokenHash, endpoint, resource, segment, access}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	denial, ok := s.denials[key]
+	if !ok {
+		if len(s.denials) >= aclShadowMaxDenials {
+			return
+		}
+		denial = &structs.ACLShadowDenial{
+			ACLProbe: structs.ACLProbe{
+				Resource: resource,
+				Segment:  segment,
+				Access:   access,
+			},
+			TokenHash: tokenHash,
+			Endpoint:  endpoint,
+		}
+		s.denials[key] = denial
+		s.logger.Printf("[WARN] consul.acl: Shadow rules for token %s would deny %s %s %q in %s",
+			tokenHash, access, resource, segment, endpoint)
+	}
+	denial.Count++
+	denial.LastSeen = time.Now()
+}
+
+// report returns the would-be denials seen so far, most frequent first.
+func (s *aclShadow) report() []structs.ACLShadowDenial {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	denials := make([]structs.ACLShadowDenial, 0, len(s.denials))
+	for _, denial := range s.denials {
+		denials = append(denials, *denial)
+	}
+	sortShadowDenials(denials)
+	return denials
+}
+
+// sortShadowDenials sorts would-be denials with the most frequent first.
+func sortShadowDenials(denials []structs.ACLShadowDenial) {
+	sort.Slice(denials, func(i, j int) bool {
+		a, b := denials[i], denials[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.TokenHash != b.TokenHash {
+			return a.TokenHash < b.TokenHash
+		}
+		if a.Endpoint != b.Endpoint {
+			return a.Endpoint < b.Endpoint
+		}
+		return a.Resource+a.Segment+a.Access < b.Resource+b.Segment+b.Access
+	})
+}
+
+// mergeShadowDenials adds up the would-be denials from several servers,
+// keeping only the ones for the given token hashes. Each server only clears
+// its own denials when shadow rules are enforced, so this is how the ones
+// for tokens that no longer have shadow rules get left out.
+func mergeShadowDenials(reports [][]structs.ACLShadowDenial, tokenHashes map[string]bool) []structs.ACLShadowDenial {
+	merged := make(map[aclShadowKey]*structs.ACLShadowDenial)
+	for _, report := range reports {
+		for _, denial := range report {
+			if !tokenHashes[denial.TokenHash] {
+				continue
+			}
+
+			key := aclShadowKey{denial.TokenHash, denial.Endpoint, denial.Resource, denial.Segment, denial.Access}
+			existing, ok := merged[key]
+			if !ok {
+				copied := denial
+				merged[key] = &copied
+				continue
+			}
+			existing.Count += denial.Count
+			if denial.LastSeen.After(existing.LastSeen) {
+				existing.LastSeen = denial.LastSeen
+			}
+		}
+	}
+
+	denials := make([]structs.ACLShadowDenial, 0, len(merged))
+	for _, denial := range merged {
+		denials = append(denials, *denial)
+	}
+	sortShadowDenials(denials)
+	return denials
+}
+
+// gatherACLShadowReports asks the other servers in the datacenter for the
+// checks they've seen shadow rules would deny, and adds them to the given
+// report. Servers that can't be reached are logged and left out.
+func (s *Server) gatherACLShadowReports(args *structs.DCSpecificRequest, reply *structs.ACLShadowReport) error {
+	s.localLock.RLock()
+	servers := make([]*agent.Server, 0, len(s.localConsuls))
+	for _, server := range s.localConsuls {
+		if server.Name != s.config.NodeName {
+			servers = append(servers, server)
+		}
+	}
+	s.localLock.RUnlock()
+
+	reports := [][]structs.ACLShadowDenial{reply.Denials}
+	for _, server := range servers {
+		req := *args
+		req.AllowStale = true
+		var out structs.ACLShadowReport
+		if err := s.connPool.RPC(s.config.Datacenter, server.Addr, server.Version, "Operator.ACLShadowReport", &req, &out); err != nil {
+			s.logger.Printf("[WARN] consul.acl: Failed to get shadow rule report from %s: %v", server.Name, err)
+			continue
+		}
+		reports = append(reports, out.Denials)
+		reply.Servers = append(reply.Servers, server.Name)
+	}
+	sort.Strings(reply.Servers)
+
+	_, acls, err := s.fsm.State().ACLList(nil)
+	if err != nil {
+		return err
+	}
+	tokenHashes := make(map[string]bool)
+	for _, acl := range acls {
+		if acl.ShadowRules != "" {
+			tokenHashes[hashToken(acl.ID)] = true
+		}
+	}
+	reply.Denials = mergeShadowDenials(reports, tokenHashes)
+	return nil
+}
+
+// clear forgets the would-be denials for the given token.
+func (s *aclShadow) clear(id string) {
+	tokenHash := hashToken(id)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key := range s.denials {
+		if key.tokenHash == tokenHash {
+			delete(s.denials, key)
+		}
+	}
+}
+
+// shadowForEndpoint returns the given ACL with its shadow rules, if it has
+// any, reporting the checks they would deny under the given endpoint. ACLs
+// are cached and shared between requests, so this hands back a copy.
+func shadowForEndpoint(a acl.ACL, endpoint string) acl.ACL {
+	switch wrapped := a.(type) {
+	case *shadowACL:
+		return wrapped.forEndpoint(endpoint)
+	case *nodeBoundACL:
+		if shadow, ok := wrapped.ACL.(*shadowACL); ok {
+			bound := *wrapped
+			bound.ACL = shadow.forEndpoint(endpoint)
+			return &bound
+		}
+	}
+	return a
+}
+
+// shadowACL enforces a token's rules, but also checks its shadow rules and
+// records the checks they would have denied.
+type shadowACL struct {
+	acl.ACL
+	shadow    acl.ACL
+	tokenHash string
+	tracker   *aclShadow
+
+	// endpoint is the RPC endpoint making the checks, or empty if it's not
+	// known.
+	endpoint string
+}
+
+// forEndpoint returns a copy of the ACL that reports checks under the given
+// endpoint.
+func (a *shadowACL) forEndpoint(endpoint string) *shadowACL {
+	copied := *a
+	copied.endpoint = endpoint
+	return &copied
+}
+
+// check records the check if the shadow rules would deny something the
+// token's rules allow, and returns what the token's rules decided.
+func (a *shadowACL) check(resource, segment, access string, allowed, shadowAllowed bool) bool {
+	if allowed && !shadowAllowed {
+		endpoint := a.endpoint
+		if endpoint == "" {
+			endpoint = "unknown"
+		}
+		a.tracker.record(a.tokenHash, endpoint, resource, segment, access)
+	}
+	return allowed
+}
+
+func (a *shadowACL) ACLList() bool {
+	return a.check(acl.ResourceACL, "", acl.PolicyRead, a.ACL.ACLList(), a.shadow.ACLList())
+}
+
+func (a *shadowACL) ACLModify() bool {
+	return a.check(acl.ResourceACL, "", acl.PolicyWrite, a.ACL.ACLModify(), a.shadow.ACLModify())
+}
+
+func (a *shadowACL) AgentRead(node string) bool {
+	return a.check(acl.ResourceAgent, node, acl.PolicyRead, a.ACL.AgentRead(node), a.shadow.AgentRead(node))
+}
+
+func (a *shadowACL) AgentWrite(node string) bool {
+	return a.check(acl.ResourceAgent, node, acl.PolicyWrite, a.ACL.AgentWrite(node), a.shadow.AgentWrite(node))
+}
+
+func (a *shadowACL) CrossDCWrite() bool {
+	return a.check(acl.ResourceCrossDC, "", acl.PolicyWrite, a.ACL.CrossDCWrite(), a.shadow.CrossDCWrite())
+}
+
+func (a *shadowACL) EventRead(name string) bool {
+	return a.check(acl.ResourceEvent, name, acl.PolicyRead, a.ACL.EventRead(name), a.shadow.EventRead(name))
+}
+
+func (a *shadowACL) EventWrite(name string) bool {
+	return a.check(acl.ResourceEvent, name, acl.PolicyWrite, a.ACL.EventWrite(name), a.shadow.EventWrite(name))
+}
+
+func (a *shadowACL) KeyRead(key string) bool {
+	return a.check(acl.ResourceKey, key, acl.PolicyRead, a.ACL.KeyRead(key), a.shadow.KeyRead(key))
+}
+
+func (a *shadowACL) KeyWrite(key string) bool {
+	return a.check(acl.ResourceKey, key, acl.PolicyWrite, a.ACL.KeyWrite(key), a.shadow.KeyWrite(key))
+}
+
+func (a *shadowACL) KeyWritePrefix(prefix string) bool {
+	return a.check(acl.ResourceKey, prefix, acl.PolicyWrite, a.ACL.KeyWritePrefix(prefix), a.shadow.KeyWritePrefix(prefix))
+}
+
+func (a *shadowACL) KeyringRead() bool {
+	return a.check(acl.ResourceKeyring, "", acl.PolicyRead, a.ACL.KeyringRead(), a.shadow.KeyringRead())
+}
+
+func (a *shadowACL) KeyringWrite() bool {
+	return a.check(acl.ResourceKeyring, "", acl.PolicyWrite, a.ACL.KeyringWrite(), a.shadow.KeyringWrite())
+}
+
+func (a *shadowACL) NodeRead(name string) bool {
+	return a.check(acl.ResourceNode, name, acl.PolicyRead, a.ACL.NodeRead(name), a.shadow.NodeRead(name))
+}
+
+func (a *shadowACL) NodeWrite(name string) bool {
+	return a.check(acl.ResourceNode, name, acl.PolicyWrite, a.ACL.NodeWrite(name), a.shadow.NodeWrite(name))
+}
+
+func (a *shadowACL) OperatorRead() bool {
+	return a.check(acl.ResourceOperator, "", acl.PolicyRead, a.ACL.OperatorRead(), a.shadow.OperatorRead())
+}
+
+func (a *shadowACL) OperatorWrite() bool {
+	return a.check(acl.ResourceOperator, "", acl.PolicyWrite, a.ACL.OperatorWrite(), a.shadow.OperatorWrite())
+}
+
+func (a *shadowACL) OperatorRaftRead() bool {
+	return a.check(acl.ResourceOperatorRaft, "", acl.PolicyRead, a.ACL.OperatorRaftRead(), a.shadow.OperatorRaftRead())
+}
+
+func (a *shadowACL) OperatorRaftWrite() bool {
+	return a.check(acl.ResourceOperatorRaft, "", acl.PolicyWrite, a.ACL.OperatorRaftWrite(), a.shadow.OperatorRaftWrite())
+}
+
+func (a *shadowACL) OperatorAutopilotRead() bool {
+	return a.check(acl.ResourceOperatorAutopilot, "", acl.PolicyRead, a.ACL.OperatorAutopilotRead(), a.shadow.OperatorAutopilotRead())
+}
+
+func (a *shadowACL) OperatorAutopilotWrite() bool {
+	return a.check(acl.ResourceOperatorAutopilot, "", acl.PolicyWrite, a.ACL.OperatorAutopilotWrite(), a.shadow.OperatorAutopilotWrite())
+}
+
+func (a *shadowACL) PreparedQueryRead(prefix string) bool {
+	return a.check(acl.ResourcePreparedQuery, prefix, acl.PolicyRead, a.ACL.PreparedQueryRead(prefix), a.shadow.PreparedQueryRead(prefix))
+}
+
+func (a *shadowACL) PreparedQueryWrite(prefix string) bool {
+	return a.check(acl.ResourcePreparedQuery, prefix, acl.PolicyWrite, a.ACL.PreparedQueryWrite(prefix), a.shadow.PreparedQueryWrite(prefix))
+}
+
+func (a *shadowACL) ServiceRead(name string) bool {
+	return a.check(acl.ResourceService, name, acl.PolicyRead, a.ACL.ServiceRead(name), a.shadow.ServiceRead(name))
+}
+
+func (a *shadowACL) ServiceWrite(name string) bool {
+	return a.check(acl.ResourceService, name, acl.PolicyWrite, a.ACL.ServiceWrite(name), a.shadow.ServiceWrite(name))
+}
+
+func (a *shadowACL) SessionRead(node string) bool {
+	return a.check(acl.ResourceSession, node, acl.PolicyRead, a.ACL.SessionRead(node), a.shadow.SessionRead(node))
+}
+
+func (a *shadowACL) SessionWrite(node string) bool {
+	return a.check(acl.ResourceSession, node, acl.PolicyWrite, a.ACL.SessionWrite(node), a.shadow.SessionWrite(node))
+}
+
+func (a *shadowACL) Snapshot() bool {
+	return a.check(aclResourceSnapshot, "", acl.PolicyWrite, a.ACL.Snapshot(), a.shadow.Snapshot())
+}
@@ -0,0 +1,373 @@
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+const testShadowRules = `
+key "" {
+	policy = "write"
+}
+key "secret/" {
+	policy = "deny"
+}
+`
+
+func TestACLShadow_Report(t *testing.T) {
+	shadow, err := newACLShadow(log.New(os.Stderr, "", log.LstdFlags))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	shadow.record("a", "KVS.Apply", acl.ResourceKey, "foo", acl.PolicyWrite)
+	shadow.record("b", "KVS.Get", acl.ResourceKey, "bar", acl.PolicyRead)
+	shadow.record("b", "KVS.Get", acl.ResourceKey, "bar", acl.PolicyRead)
+	report := shadow.report()
+	if len(report) != 2 {
+		t.Fatalf("bad: %#v", report)
+	}
+	if report[0].TokenHash != "b" || report[0].Count != 2 || report[0].Endpoint != "KVS.Get" ||
+		report[0].Segment != "bar" || report[0].LastSeen.IsZero() {
+		t.Fatalf("bad: %#v", report[0])
+	}
+	if report[1].TokenHash != "a" || report[1].Count != 1 || report[1].Access != acl.PolicyWrite {
+		t.Fatalf("bad: %#v", report[1])
+	}
+
+	// Clearing is by token ID, which gets hashed.
+	shadow.record(hashToken("c"), "KVS.Get", acl.ResourceKey, "baz", acl.PolicyRead)
+	shadow.clear("c")
+	if report := shadow.report(); len(report) != 2 {
+		t.Fatalf("bad: %#v", report)
+	}
+
+	// The number of different denials is capped.
+	for i := 0; i < aclShadowMaxDenials; i++ {
+		shadow.record("d", "KVS.Get", acl.ResourceKey, fmt.Sprintf("key%d", i), acl.PolicyRead)
+	}
+	if report := shadow.report(); len(report) != aclShadowMaxDenials {
+		t.Fatalf("bad: %d", len(report))
+	}
+}
+
+func TestACL_ShadowRules(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Bad shadow rules are refused.
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:        "User token",
+			Type:        structs.ACLTypeClient,
+			Rules:       `key "" { policy = "write" }`,
+			ShadowRules: `key "" { policy = "nope" }`,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &id)
+	if err == nil || !strings.Contains(err.Error(), "shadow rule compilation failed") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Make a token that can write everything, but is trying out rules
+	// that deny the secret keys.
+	arg.ACL.ShadowRules = testShadowRules
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The write should still go through.
+	kv := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "secret/password",
+			Value: []byte("hunter2"),
+		},
+		WriteRequest: structs.WriteRequest{Token: id},
+	}
+	var ok bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &kv, &ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// So should one the shadow rules allow, and introspection shouldn't
+	// count either.
+	kv.DirEnt.Key = "public/motd"
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &kv, &ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	introspect := structs.ACLIntrospectRequest{
+		Datacenter: "dc1",
+		Probes: []structs.ACLProbe{
+			{Resource: acl.ResourceKey, Segment: "secret/other", Access: acl.PolicyRead},
+		},
+		QueryOptions: structs.QueryOptions{Token: id},
+	}
+	var introspectReply structs.ACLIntrospectResponse
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Introspect", &introspect, &introspectReply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !introspectReply.Results[0].Allowed {
+		t.Fatalf("bad: %#v", introspectReply)
+	}
+
+	// The would-be denial should be in the report.
+	req := structs.DCSpecificRequest{
+		Datacenter:   "dc1",
+		QueryOptions: structs.QueryOptions{Token: "root"},
+	}
+	var report structs.ACLShadowReport
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ACLShadowReport", &req, &report); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if report.Node != s1.config.NodeName || len(report.Denials) != 1 {
+		t.Fatalf("bad: %#v", report)
+	}
+	denial := report.Denials[0]
+	if denial.TokenHash != hashToken(id) || denial.Endpoint != "KVS.Apply" ||
+		denial.Resource != acl.ResourceKey || denial.Segment != "secret/password" ||
+		denial.Access != acl.PolicyWrite || denial.Count != 1 {
+		t.Fatalf("bad: %#v", denial)
+	}
+
+	// Enforcing the shadow rules needs a management token.
+	enforce := structs.ACLEnforceShadowRequest{
+		Datacenter:   "dc1",
+		ACL:          id,
+		WriteRequest: structs.WriteRequest{Token: id},
+	}
+	var out string
+	err = msgpackrpc.CallWithCodec(codec, "ACL.EnforceShadow", &enforce, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	enforce.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.EnforceShadow", &enforce, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, token, err := s1.fsm.State().ACLGet(nil, id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if token.Rules != testShadowRules || token.ShadowRules != "" {
+		t.Fatalf("bad: %#v", token)
+	}
+
+	// There's nothing more to enforce.
+	err = msgpackrpc.CallWithCodec(codec, "ACL.EnforceShadow", &enforce, &out)
+	if err == nil || !strings.Contains(err.Error(), "no shadow rules") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Now the write should be denied, and the report cleared.
+	kv.DirEnt.Key = "secret/password"
+	err = msgpackrpc.CallWithCodec(codec, "KVS.Apply", &kv, &ok)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	var cleared structs.ACLShadowReport
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ACLShadowReport", &req, &cleared); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(cleared.Denials) != 0 {
+		t.Fatalf("bad: %#v", cleared)
+	}
+}
+
+func TestACL_ShadowRules_NonAuthority(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.Bootstrap = false
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		p1, _ := s1.numPeers()
+		return p1 == 2, errors.New(fmt.Sprintf("%d", p1))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:        "User token",
+			Type:        structs.ACLTypeClient,
+			Rules:       `key "" { policy = "write" }`,
+			ShadowRules: testShadowRules,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := s1.RPC("ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	nonAuth := s2
+	if !s1.IsLeader() {
+		nonAuth = s1
+	}
+
+	// The rules should be enforced, with the shadow rules only tracked.
+	resolved, err := nonAuth.resolveToken("KVS.Apply", id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !resolved.KeyWrite("secret/password") || !resolved.KeyWrite("public/motd") {
+		t.Fatalf("should allow")
+	}
+	report := nonAuth.aclShadow.report()
+	if len(report) != 1 || report[0].TokenHash != hashToken(id) ||
+		report[0].Segment != "secret/password" || report[0].Endpoint != "KVS.Apply" {
+		t.Fatalf("bad: %#v", report)
+	}
+}
+
+func TestACL_ShadowReport_AllServers(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.Bootstrap = false
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		p1, _ := s1.numPeers()
+		return p1 == 2, errors.New(fmt.Sprintf("%d", p1))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:        "User token",
+			Type:        structs.ACLTypeClient,
+			Rules:       `key "" { policy = "write" }`,
+			ShadowRules: testShadowRules,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := s1.RPC("ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Make the same check on both servers, and one more on the follower.
+	for _, s := range []*Server{s1, s2} {
+		resolved, err := s.resolveToken("KVS.Get", id)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resolved.KeyRead("secret/password")
+	}
+	resolved, err := s2.resolveToken("KVS.Apply", id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resolved.KeyWrite("secret/password")
+
+	// The leader should add up what both servers saw.
+	req := structs.DCSpecificRequest{
+		Datacenter:   "dc1",
+		QueryOptions: structs.QueryOptions{Token: "root"},
+	}
+	var report structs.ACLShadowReport
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ACLShadowReport", &req, &report); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(report.Servers) != 2 || len(report.Denials) != 2 {
+		t.Fatalf("bad: %#v", report)
+	}
+	if report.Denials[0].Endpoint != "KVS.Get" || report.Denials[0].Count != 2 ||
+		report.Denials[1].Endpoint != "KVS.Apply" || report.Denials[1].Count != 1 {
+		t.Fatalf("bad: %#v", report.Denials)
+	}
+
+	// A stale request only gets what the server itself saw.
+	codec2 := rpcClient(t, s2)
+	defer codec2.Close()
+	req.AllowStale = true
+	var stale structs.ACLShadowReport
+	if err := msgpackrpc.CallWithCodec(codec2, "Operator.ACLShadowReport", &req, &stale); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stale.Node != s2.config.NodeName || len(stale.Servers) != 1 ||
+		len(stale.Denials) != 2 || stale.Denials[0].Count != 1 {
+		t.Fatalf("bad: %#v", stale)
+	}
+
+	// Once the shadow rules are enforced, the follower's denials shouldn't
+	// show up any more.
+	enforce := structs.ACLEnforceShadowRequest{
+		Datacenter:   "dc1",
+		ACL:          id,
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var out string
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.EnforceShadow", &enforce, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req.AllowStale = false
+	var cleared structs.ACLShadowReport
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ACLShadowReport", &req, &cleared); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(cleared.Denials) != 0 {
+		t.Fatalf("bad: %#v", cleared)
+	}
+}
@@ -3,6 +3,7 @@ package consul
 import (
 	"errors"
 	"fmt"
+	"net/rpc"
 	"os"
 	"reflect"
 	"strings"
@@ -11,6 +12,7 @@ import (
 	"github.com/hashicorp/consul/acl"
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
 )
 
 var testACLPolicy = `
@@ -31,7 +33,7 @@ func TestACL_Disabled(t *testing.T) {
 
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
-	acl, err := s1.resolveToken("does not exist")
+	acl, err := s1.resolveToken("", "does not exist")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -47,7 +49,7 @@ func TestACL_ResolveRootACL(t *testing.T) {
 	defer os.RemoveAll(dir1)
 	defer s1.Shutdown()
 
-	acl, err := s1.resolveToken("allow")
+	acl, err := s1.resolveToken("", "allow")
 	if err == nil || err.Error() != rootDenied {
 		t.Fatalf("err: %v", err)
 	}
@@ -55,7 +57,7 @@ func TestACL_ResolveRootACL(t *testing.T) {
 		t.Fatalf("bad: %v", acl)
 	}
 
-	acl, err = s1.resolveToken("deny")
+	acl, err = s1.resolveToken("", "deny")
 	if err == nil || err.Error() != rootDenied {
 		t.Fatalf("err: %v", err)
 	}
@@ -75,7 +77,7 @@ func TestACL_Authority_NotFound(t *testing.T) {
 
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
-	acl, err := s1.resolveToken("does not exist")
+	acl, err := s1.resolveToken("", "does not exist")
 	if err == nil || err.Error() != aclNotFound {
 		t.Fatalf("err: %v", err)
 	}
@@ -113,7 +115,7 @@ func TestACL_Authority_Found(t *testing.T) {
 	}
 
 	// Resolve the token
-	acl, err := s1.resolveToken(id)
+	acl, err := s1.resolveToken("", id)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -142,7 +144,7 @@ func TestACL_Authority_Anonymous_Found(t *testing.T) {
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
 	// Resolve the token
-	acl, err := s1.resolveToken("")
+	acl, err := s1.resolveToken("", "")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -169,7 +171,7 @@ func TestACL_Authority_Master_Found(t *testing.T) {
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
 	// Resolve the token
-	acl, err := s1.resolveToken("foobar")
+	acl, err := s1.resolveToken("", "foobar")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -197,7 +199,7 @@ func TestACL_Authority_Management(t *testing.T) {
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
 	// Resolve the token
-	acl, err := s1.resolveToken("foobar")
+	acl, err := s1.resolveToken("", "foobar")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -251,7 +253,7 @@ func TestACL_NonAuthority_NotFound(t *testing.T) {
 		nonAuth = s2
 	}
 
-	acl, err := nonAuth.resolveToken("does not exist")
+	acl, err := nonAuth.resolveToken("", "does not exist")
 	if err == nil || err.Error() != aclNotFound {
 		t.Fatalf("err: %v", err)
 	}
@@ -317,7 +319,7 @@ func TestACL_NonAuthority_Found(t *testing.T) {
 	}
 
 	// Token should resolve
-	acl, err := nonAuth.resolveToken(id)
+	acl, err := nonAuth.resolveToken("", id)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -377,7 +379,7 @@ func TestACL_NonAuthority_Management(t *testing.T) {
 	}
 
 	// Resolve the token
-	acl, err := nonAuth.resolveToken("foobar")
+	acl, err := nonAuth.resolveToken("", "foobar")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -456,7 +458,7 @@ func TestACL_DownPolicy_Deny(t *testing.T) {
 	auth.Shutdown()
 
 	// Token should resolve into a DenyAll
-	aclR, err := nonAuth.resolveToken(id)
+	aclR, err := nonAuth.resolveToken("", id)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -530,7 +532,7 @@ func TestACL_DownPolicy_Allow(t *testing.T) {
 	auth.Shutdown()
 
 	// Token should resolve into a AllowAll
-	aclR, err := nonAuth.resolveToken(id)
+	aclR, err := nonAuth.resolveToken("", id)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -603,7 +605,7 @@ func TestACL_DownPolicy_ExtendCache(t *testing.T) {
 	}
 
 	// Warm the caches
-	aclR, err := nonAuth.resolveToken(id)
+	aclR, err := nonAuth.resolveToken("", id)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -615,7 +617,7 @@ func TestACL_DownPolicy_ExtendCache(t *testing.T) {
 	auth.Shutdown()
 
 	// Token should resolve into cached copy
-	aclR2, err := nonAuth.resolveToken(id)
+	aclR2, err := nonAuth.resolveToken("", id)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -675,9 +677,11 @@ func TestACL_Replication(t *testing.T) {
 		Datacenter: "dc1",
 		Op:         structs.ACLSet,
 		ACL: structs.ACL{
-			Name:  "User token",
-			Type:  structs.ACLTypeClient,
-			Rules: testACLPolicy,
+			Name:         "User token",
+			Type:         structs.ACLTypeClient,
+			Rules:        testACLPolicy,
+			Datacenters:  []string{"dc2"},
+			NodeIdentity: "web-1/dc2",
 		},
 		WriteRequest: structs.WriteRequest{Token: "root"},
 	}
@@ -695,6 +699,9 @@ func TestACL_Replication(t *testing.T) {
 		if acl == nil {
 			return false, nil
 		}
+		if !reflect.DeepEqual(acl.Datacenters, []string{"dc2"}) || acl.NodeIdentity != "web-1/dc2" {
+			return false, fmt.Errorf("bad: %#v", acl)
+		}
 		_, acl, err = s3.fsm.State().ACLGet(nil, id)
 		if err != nil {
 			return false, err
@@ -711,7 +718,7 @@ func TestACL_Replication(t *testing.T) {
 	s1.Shutdown()
 
 	// Token should resolve on s2, which has replication + extend-cache.
-	acl, err := s2.resolveToken(id)
+	acl, err := s2.resolveToken("", id)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -727,9 +734,17 @@ func TestACL_Replication(t *testing.T) {
 		t.Fatalf("unexpected failed read")
 	}
 
+	// The node binding should have come along too.
+	if err := vetNodeIdentity(acl, "web-1", "dc2"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := vetNodeIdentity(acl, "web-2", "dc2"); err == nil {
+		t.Fatalf("should be denied")
+	}
+
 	// Although s3 has replication, and we verified that the ACL is there,
 	// it can not be used because of the down policy.
-	acl, err = s3.resolveToken(id)
+	acl, err = s3.resolveToken("", id)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -790,7 +805,7 @@ func TestACL_MultiDC_Found(t *testing.T) {
 	}
 
 	// Token should resolve
-	acl, err := s2.resolveToken(id)
+	acl, err := s2.resolveToken("", id)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -807,6 +822,256 @@ func TestACL_MultiDC_Found(t *testing.T) {
 	}
 }
 
+func TestACL_MultiDC_Datacenters(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec1 := rpcClient(t, s1)
+	defer codec1.Close()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Datacenter = "dc2"
+		c.ACLDatacenter = "dc1"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+	codec2 := rpcClient(t, s2)
+	defer codec2.Close()
+
+	// Try to join
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s1.RPC, "dc2")
+
+	// Create a token that only applies in dc2.
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:        "User token",
+			Type:        structs.ACLTypeClient,
+			Rules:       testACLPolicy,
+			Datacenters: []string{"dc2"},
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := msgpackrpc.CallWithCodec(codec1, "ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The datacenters should come back when reading the token.
+	getR := structs.ACLSpecificRequest{
+		Datacenter: "dc1",
+		ACL:        id,
+	}
+	var acls structs.IndexedACLs
+	if err := msgpackrpc.CallWithCodec(codec1, "ACL.Get", &getR, &acls); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(acls.ACLs) != 1 || !reflect.DeepEqual(acls.ACLs[0].Datacenters, []string{"dc2"}) {
+		t.Fatalf("bad: %#v", acls.ACLs)
+	}
+
+	// Writes using the token should be denied in dc1, but work in dc2.
+	write := func(codec rpc.ClientCodec, dc string) error {
+		req := structs.KVSRequest{
+			Datacenter: dc,
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   "foo/test",
+				Value: []byte("hello"),
+			},
+			WriteRequest: structs.WriteRequest{Token: id},
+		}
+		var out bool
+		return msgpackrpc.CallWithCodec(codec, "KVS.Apply", &req, &out)
+	}
+	err := write(codec1, "dc1")
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// It should still be denied in dc1 with an allow default policy.
+	s1.config.ACLDefaultPolicy = "allow"
+	err = write(codec1, "dc1")
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	s1.config.ACLDefaultPolicy = "deny"
+	if err := write(codec2, "dc2"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Move the token over to dc1, which should flip things around once
+	// dc2's cache expires.
+	arg.ACL.ID = id
+	arg.ACL.Datacenters = []string{"dc1"}
+	if err := msgpackrpc.CallWithCodec(codec1, "ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := write(codec1, "dc1"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s2.aclCache.acls.Purge()
+	err = write(codec2, "dc2")
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Empty datacenter names aren't allowed.
+	arg.ACL.Datacenters = []string{""}
+	err = msgpackrpc.CallWithCodec(codec1, "ACL.Apply", &arg, &id)
+	if err == nil || !strings.Contains(err.Error(), "Invalid ACL datacenter") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestACL_DefaultPolicies(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "allow"
+		c.ACLDefaultPolicies = map[string]string{
+			"kv":      "deny",
+			"service": "allow",
+		}
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec1 := rpcClient(t, s1)
+	defer codec1.Close()
+
+	// The other datacenter doesn't have any per-type defaults of its own,
+	// so it should pick up the ones from the ACL datacenter.
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Datacenter = "dc2"
+		c.ACLDatacenter = "dc1"
+		c.ACLDefaultPolicy = "allow"
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+	codec2 := rpcClient(t, s2)
+	defer codec2.Close()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s1.RPC, "dc2")
+
+	// Write a key and register a service in each datacenter.
+	for _, dc := range []string{"dc1", "dc2"} {
+		kv := structs.KVSRequest{
+			Datacenter: dc,
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   "foo",
+				Value: []byte("hello"),
+			},
+			WriteRequest: structs.WriteRequest{Token: "root"},
+		}
+		var applied bool
+		if err := msgpackrpc.CallWithCodec(codec1, "KVS.Apply", &kv, &applied); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		reg := structs.RegisterRequest{
+			Datacenter: dc,
+			Node:       "node1",
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				Service: "web",
+			},
+			WriteRequest: structs.WriteRequest{Token: "root"},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec1, "Catalog.Register", &reg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// With no token, the KV read should be denied while the service
+	// listing goes through, in both datacenters.
+	for dc, codec := range map[string]rpc.ClientCodec{"dc1": codec1, "dc2": codec2} {
+		get := structs.KeyRequest{
+			Datacenter: dc,
+			Key:        "foo",
+		}
+		var entries structs.IndexedDirEntries
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Get", &get, &entries); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(entries.Entries) != 0 {
+			t.Fatalf("%s: KV read should have been denied: %v", dc, entries.Entries)
+		}
+		get.Token = "root"
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Get", &get, &entries); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(entries.Entries) != 1 {
+			t.Fatalf("%s: bad: %v", dc, entries.Entries)
+		}
+
+		list := structs.DCSpecificRequest{
+			Datacenter: dc,
+		}
+		var services structs.IndexedServices
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListServices", &list, &services); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, ok := services.Services["web"]; !ok {
+			t.Fatalf("%s: missing service: %v", dc, services.Services)
+		}
+	}
+
+	// The effective defaults should be the same from either datacenter.
+	expected := map[string]string{
+		"kv":      "deny",
+		"service": "allow",
+		"node":    "allow",
+		"session": "allow",
+		"query":   "allow",
+		"event":   "allow",
+		"keyring": "allow",
+	}
+	for dc, codec := range map[string]rpc.ClientCodec{"dc1": codec1, "dc2": codec2} {
+		req := structs.DCSpecificRequest{
+			Datacenter: dc,
+		}
+		var defaults structs.ACLDefaults
+		if err := msgpackrpc.CallWithCodec(codec, "ACL.Defaults", &req, &defaults); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if defaults.Default != "allow" || !reflect.DeepEqual(defaults.Types, expected) {
+			t.Fatalf("%s: bad: %#v", dc, defaults)
+		}
+	}
+}
+
+func TestACL_DefaultPolicies_Invalid(t *testing.T) {
+	config := DefaultConfig()
+	config.ACLDefaultPolicies = map[string]string{"kv": "manage"}
+	if err := config.CheckACL(); err == nil || !strings.Contains(err.Error(), "Unsupported default ACL policy") {
+		t.Fatalf("err: %v", err)
+	}
+	config.ACLDefaultPolicies = map[string]string{"key": "deny"}
+	if err := config.CheckACL(); err == nil || !strings.Contains(err.Error(), "Unknown resource type") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestACL_filterHealthChecks(t *testing.T) {
 	// Create some health checks.
 	fill := func() structs.HealthChecks {
@@ -1572,7 +1837,7 @@ func TestACL_unhandledFilterType(t *testing.T) {
 	defer client.Close()
 
 	// Pass an unhandled type into the ACL filter.
-	srv.filterACL(token, &structs.HealthCheck{})
+	srv.filterACL("", token, &structs.HealthCheck{})
 }
 
 func TestACL_vetRegisterWithACL(t *testing.T) {
@@ -0,0 +1,146 @@
+package consul
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// aclUsageGranularity is the resolution that we track the last use of a
+// token at. Keeping this coarse means that a busy token doesn't look any
+// different from one that's used once a minute.
+const aclUsageGranularity = time.Minute
+
+// aclUsageTracker accumulates token usage in memory so it can be flushed to
+// the state store in batches.
+type aclUsageTracker struct {
+	pending map[string]*structs.ACLUsage
+	lock    sync.Mutex
+}
+
+// newACLUsageTracker returns a tracker with no pending usage.
+func newACLUsageTracker() *aclUsageTracker {
+	return &aclUsageTracker{
+		pending: make(map[string]*structs.ACLUsage),
+	}
+}
+
+// record notes a single use of the given token.
+func (t *aclUsageTracker) record(id string) {
+	t.merge(structs.ACLUsages{
+		&structs.ACLUsage{
+			ID:       id,
+			LastUsed: time.Now().UTC().Truncate(aclUsageGranularity),
+			Uses:     1,
+		},
+	})
+}
+
+// merge adds the given usage to the pending usage.
+func (t *aclUsageTracker) merge(usage structs.ACLUsages) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, u := range usage {
+		existing, ok := t.pending[u.ID]
+		if !ok {
+			existing = &structs.ACLUsage{ID: u.ID}
+			t.pending[u.ID] = existing
+		}
+		if u.LastUsed.After(existing.LastUsed) {
+			existing.LastUsed = u.LastUsed
+		}
+		existing.Uses += u.Uses
+	}
+}
+
+// drain returns the pending usage sorted by ID and resets the tracker.
+func (t *aclUsageTracker) drain() structs.ACLUsages {
+	t.lock.Lock()
+	pending := t.pending
+	t.pending = make(map[string]*structs.ACLUsage)
+	t.lock.Unlock()
+
+	usage := make(structs.ACLUsages, 0, len(pending))
+	for _, u := range pending {
+		usage = append(usage, u)
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].ID < usage[j].ID
+	})
+	return usage
+}
+
+// isACLUsageEnabled returns true if we should be tracking token usage.
+func (s *Server) isACLUsageEnabled() bool {
+	return len(s.config.ACLDatacenter) > 0 && s.config.ACLUsageFlushInterval > 0
+}
+
+// runACLUsageFlush periodically flushes the token usage seen by this server.
+func (s *Server) runACLUsageFlush() {
+	for {
+		select {
+		case <-time.After(s.config.ACLUsageFlushInterval):
+			if err := s.flushACLUsage(); err != nil {
+				s.logger.Printf("[WARN] consul.acl: Failed to flush token usage: %v", err)
+			}
+
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// flushACLUsage sends the pending token usage on its way to the state store.
+// The leader of the ACL datacenter applies it via Raft, and all other servers
+// send it to the ACL datacenter by token hash, using the replication token or
+// the default token, where it's added to the leader's pending usage. Usage
+// is dropped if there's no token to send it with. If this fails then the
+// usage is kept so it can be tried again on the next flush.
+func (s *Server) flushACLUsage() error {
+	usage := s.aclUsage.drain()
+	if len(usage) == 0 {
+		return nil
+	}
+	defer metrics.MeasureSince([]string{"consul", "acl", "usage", "flush"}, time.Now())
+
+	req := structs.ACLUsageRequest{
+		Datacenter: s.config.ACLDatacenter,
+		Usage:      usage,
+	}
+	var err error
+	if s.config.Datacenter == s.config.ACLDatacenter && s.IsLeader() {
+		// This is safe to ignore on older servers since it's only
+		// bookkeeping.
+		t := structs.ACLUsageRequestType | structs.IgnoreUnknownTypeFlag
+		var resp interface{}
+		resp, err = s.raftApply(t, &req)
+		if respErr, ok := resp.(error); ok && err == nil {
+			err = respErr
+		}
+	} else {
+		req.Token = s.config.ACLReplicationToken
+		if req.Token == "" {
+			req.Token = s.config.ACLToken
+		}
+		if req.Token == "" {
+			return fmt.Errorf("no acl_replication_token or acl_token to report token usage with")
+		}
+
+		req.Usage = make(structs.ACLUsages, 0, len(usage))
+		for _, u := range usage {
+			req.Usage = append(req.Usage, &structs.ACLUsage{ID: hashToken(u.ID), LastUsed: u.LastUsed, Uses: u.Uses})
+		}
+		var out struct{}
+		err = s.RPC("ACL.ReportUsage", &req, &out)
+	}
+	if err != nil {
+		s.aclUsage.merge(usage)
+		return err
+	}
+	return nil
+}
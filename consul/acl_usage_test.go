@@ -0,0 +1,288 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestACLUsageTracker(t *testing.T) {
+	tracker := newACLUsageTracker()
+	if usage := tracker.drain(); len(usage) != 0 {
+		t.Fatalf("bad: %v", usage)
+	}
+
+	// Record some usage and merge in some from elsewhere.
+	tracker.record("foo")
+	tracker.record("foo")
+	tracker.record("bar")
+	later := time.Now().UTC().Add(time.Hour).Truncate(aclUsageGranularity)
+	tracker.merge(structs.ACLUsages{
+		&structs.ACLUsage{ID: "bar", LastUsed: later, Uses: 3},
+		&structs.ACLUsage{ID: "baz", LastUsed: later, Uses: 1},
+	})
+
+	usage := tracker.drain()
+	if len(usage) != 3 {
+		t.Fatalf("bad: %v", usage)
+	}
+	if usage[0].ID != "bar" || usage[0].Uses != 4 || !usage[0].LastUsed.Equal(later) {
+		t.Fatalf("bad: %v", usage[0])
+	}
+	if usage[1].ID != "baz" || usage[1].Uses != 1 || !usage[1].LastUsed.Equal(later) {
+		t.Fatalf("bad: %v", usage[1])
+	}
+	if usage[2].ID != "foo" || usage[2].Uses != 2 {
+		t.Fatalf("bad: %v", usage[2])
+	}
+	if used := usage[2].LastUsed; used.IsZero() || !used.Equal(used.Truncate(aclUsageGranularity)) {
+		t.Fatalf("bad: %v", used)
+	}
+
+	// Draining should reset the tracker.
+	if usage := tracker.drain(); len(usage) != 0 {
+		t.Fatalf("bad: %v", usage)
+	}
+}
+
+// getACL fetches the given ACL from the server's ACL datacenter.
+func getACL(t *testing.T, s *Server, id string) *structs.ACL {
+	getR := structs.ACLSpecificRequest{
+		Datacenter: "dc1",
+		ACL:        id,
+	}
+	var acls structs.IndexedACLs
+	if err := s.RPC("ACL.Get", &getR, &acls); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(acls.ACLs) != 1 {
+		t.Fatalf("bad: %v", acls)
+	}
+	return acls.ACLs[0]
+}
+
+func TestACLUsage_Flush(t *testing.T) {
+	dir1, config1 := testServerConfig(t, fmt.Sprintf("Node %d", getPort()))
+	defer os.RemoveAll(dir1)
+	config1.ACLDatacenter = "dc1"
+	config1.ACLMasterToken = "root"
+	config1.ACLUsageFlushInterval = time.Hour
+	s1, err := NewServer(config1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Create a new token.
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testACLPolicy,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := s1.RPC("ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Flush out the usage of the management token so we start clean.
+	if err := s1.flushACLUsage(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if acl := getACL(t, s1, id); !acl.LastUsed.IsZero() || acl.Uses != 0 {
+		t.Fatalf("bad: %v", acl)
+	}
+
+	// Use the token for a couple of KV reads.
+	for i := 0; i < 2; i++ {
+		getR := structs.KeyRequest{
+			Datacenter:   "dc1",
+			Key:          "foo/test",
+			QueryOptions: structs.QueryOptions{Token: id},
+		}
+		var dirent structs.IndexedDirEntries
+		if err := s1.RPC("KVS.Get", &getR, &dirent); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Flush and make sure the usage shows up.
+	if err := s1.flushACLUsage(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	acl := getACL(t, s1, id)
+	if acl.LastUsed.IsZero() || acl.Uses != 2 {
+		t.Fatalf("bad: %v", acl)
+	}
+	if acl.CreateIndex != acl.ModifyIndex {
+		t.Fatalf("usage shouldn't modify the ACL: %v", acl)
+	}
+	lastUsed := acl.LastUsed
+
+	// Updating the ACL should leave the usage alone.
+	arg.ACL.ID = id
+	arg.ACL.Name = "Updated token"
+	arg.ACL.Uses = 100
+	if err := s1.RPC("ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if acl := getACL(t, s1, id); acl.Uses != 2 || !acl.LastUsed.Equal(lastUsed) {
+		t.Fatalf("bad: %v", acl)
+	}
+
+	// Restart the server and make sure the usage survives.
+	s1.Shutdown()
+	_, config2 := testServerConfig(t, config1.NodeName)
+	defer os.RemoveAll(config2.DataDir)
+	config2.DataDir = dir1
+	config2.NodeID = config1.NodeID
+	config2.RPCAddr = config1.RPCAddr
+	config2.ACLDatacenter = "dc1"
+	config2.ACLMasterToken = "root"
+	config2.ACLUsageFlushInterval = time.Hour
+	s2, err := NewServer(config2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	testutil.WaitForLeader(t, s2.RPC, "dc1")
+	if acl := getACL(t, s2, id); acl.Uses != 2 || !acl.LastUsed.Equal(lastUsed) {
+		t.Fatalf("bad: %v", acl)
+	}
+}
+
+func TestACLUsage_MultiDC(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLUsageFlushInterval = time.Hour
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Datacenter = "dc2"
+		c.ACLDatacenter = "dc1"
+		c.ACLReplicationToken = "root"
+		c.ACLUsageFlushInterval = time.Hour
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	// Try to join
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s1.RPC, "dc2")
+
+	// Create a new token
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testACLPolicy,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := s1.RPC("ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Use the token in both datacenters.
+	for _, s := range []*Server{s1, s2, s2} {
+		if _, err := s.resolveToken("", id); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Flushing dc2 hands its usage to dc1, which then writes it out along
+	// with its own.
+	if err := s2.flushACLUsage(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.flushACLUsage(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if acl := getACL(t, s1, id); acl.LastUsed.IsZero() || acl.Uses != 3 {
+		t.Fatalf("bad: %v", acl)
+	}
+}
+
+func TestACLUsage_ReportUsage(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLUsageFlushInterval = time.Hour
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Usage is reported by token hash, and hashes that don't match a
+	// token are dropped.
+	used := time.Now().UTC().Truncate(aclUsageGranularity)
+	arg := structs.ACLUsageRequest{
+		Datacenter: "dc1",
+		Usage: structs.ACLUsages{
+			&structs.ACLUsage{ID: hashToken("root"), LastUsed: used, Uses: 2},
+			&structs.ACLUsage{ID: hashToken("nope"), LastUsed: used, Uses: 1},
+		},
+	}
+	var out struct{}
+
+	// Reporting needs a real token.
+	for _, token := range []string{"", anonymousToken, "nope"} {
+		arg.Token = token
+		err := msgpackrpc.CallWithCodec(codec, "ACL.ReportUsage", &arg, &out)
+		if err == nil {
+			t.Fatalf("should fail with token %q", token)
+		}
+	}
+	for _, u := range s1.aclUsage.drain() {
+		if u.ID == "root" {
+			t.Fatalf("bad: %#v", u)
+		}
+	}
+
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.ReportUsage", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var found bool
+	for _, u := range s1.aclUsage.drain() {
+		switch u.ID {
+		case "root":
+			if u.Uses != 2 || !u.LastUsed.Equal(used) {
+				t.Fatalf("bad: %#v", u)
+			}
+			found = true
+		case "nope", hashToken("root"), hashToken("nope"):
+			t.Fatalf("bad: %#v", u)
+		}
+	}
+	if !found {
+		t.Fatalf("missing usage for the reported token")
+	}
+}
@@ -38,6 +38,7 @@ type Server struct {
 	Version     int
 	RaftVersion int
 	NonVoter    bool
+	ClusterID   string
 	Addr        net.Addr
 	Status      serf.MemberStatus
 }
@@ -135,6 +136,7 @@ func IsConsulServer(m serf.Member) (bool, *Server) {
 		RaftVersion: raft_vsn,
 		Status:      m.Status,
 		NonVoter:    nonVoter,
+		ClusterID:   m.Tags["cluster_id"],
 	}
 	return true, parts
 }
@@ -64,6 +64,7 @@ func TestIsConsulServer(t *testing.T) {
 			"vsn":           "1",
 			"expect":        "3",
 			"raft_vsn":      "3",
+			"cluster_id":    "a5cd2e6b-4d6f-4f0b-9bd0-6d6fb5f6a1d2",
 		},
 		Status: serf.StatusLeft,
 	}
@@ -92,6 +93,9 @@ func TestIsConsulServer(t *testing.T) {
 	if parts.RaftVersion != 3 {
 		t.Fatalf("bad: %v", parts.RaftVersion)
 	}
+	if parts.ClusterID != "a5cd2e6b-4d6f-4f0b-9bd0-6d6fb5f6a1d2" {
+		t.Fatalf("bad: %v", parts.ClusterID)
+	}
 	if parts.Status != serf.StatusLeft {
 		t.Fatalf("bad: %v", parts.Status)
 	}
@@ -0,0 +1,79 @@
+package consul
+
+import (
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// applyLoadWeight is the weight given to each new apply when updating the
+// moving average of apply latency.
+const applyLoadWeight = 0.25
+
+// applyLoad tracks the number of Raft applies in flight and a moving
+// average of how long they take.
+type applyLoad struct {
+	inflight int
+	latency  time.Duration
+	lock     sync.Mutex
+}
+
+// begin records the start of an apply, and returns a function to call once
+// it's done.
+func (l *applyLoad) begin() func() {
+	start := time.Now()
+	l.lock.Lock()
+	l.inflight++
+	depth := l.inflight
+	l.lock.Unlock()
+	metrics.SetGauge([]string{"consul", "raft", "apply", "inflight"}, float32(depth))
+
+	return func() {
+		elapsed := time.Since(start)
+		l.lock.Lock()
+		l.inflight--
+		depth := l.inflight
+		l.latency += time.Duration(applyLoadWeight * float64(elapsed-l.latency))
+		l.lock.Unlock()
+		metrics.SetGauge([]string{"consul", "raft", "apply", "inflight"}, float32(depth))
+	}
+}
+
+// stats returns the number of applies in flight and the average latency.
+func (l *applyLoad) stats() (int, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.inflight, l.latency
+}
+
+// applyBackoff fills in the backoff hint for agents' catalog writes. The
+// suggested backoff grows with how far past its thresholds the apply path is.
+func (s *Server) applyBackoff(reply *structs.ApplyBackoff) {
+	depth, latency := s.applyLoad.stats()
+	reply.ApplyQueueDepth = depth
+
+	var over float64
+	if limit := s.config.ApplyBackoffQueueDepth; limit > 0 {
+		if r := float64(depth) / float64(limit); r > over {
+			over = r
+		}
+	}
+	if limit := s.config.ApplyBackoffLatency; limit > 0 {
+		if r := float64(latency) / float64(limit); r > over {
+			over = r
+		}
+	}
+	if over <= 1 {
+		reply.Backoff = 0
+		return
+	}
+
+	backoff := time.Duration(over * float64(s.config.ApplyBackoffStep))
+	if backoff > s.config.ApplyBackoffMax {
+		backoff = s.config.ApplyBackoffMax
+	}
+	reply.Backoff = backoff
+	metrics.IncrCounter([]string{"consul", "rpc", "backoff"}, 1)
+}
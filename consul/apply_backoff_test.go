@@ -0,0 +1,144 @@
+package consul
+
+import (
+	"fmt"
+	"net/rpc"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestCatalog_Register_Backoff_Latency(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ApplyBackoffLatency = 10 * time.Millisecond
+		c.ApplyBackoffStep = time.Second
+		c.ApplyBackoffMax = time.Minute
+
+		// The same nodes get registered again, and those need to be
+		// applied.
+		c.DisableRegisterDedup = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Slow down catalog applies by however long is set.
+	var delay int64
+	s1.raftApplyHook = func(t structs.MessageType, msg interface{}) {
+		if t == structs.RegisterRequestType {
+			time.Sleep(time.Duration(atomic.LoadInt64(&delay)))
+		}
+	}
+
+	register := func(n int) structs.ApplyBackoff {
+		for i := 0; i < n; i++ {
+			arg := structs.RegisterRequest{
+				Datacenter: "dc1",
+				Node:       fmt.Sprintf("node%d", i),
+				Address:    "127.0.0.1",
+			}
+			var out struct{}
+			if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		return applyBackoff(t, codec)
+	}
+
+	// No backoff while applies are fast.
+	if out := register(3); out.Backoff != 0 || out.ApplyQueueDepth != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Slow applies should get a backoff.
+	atomic.StoreInt64(&delay, int64(30*time.Millisecond))
+	slow := register(6)
+	if slow.Backoff < time.Second {
+		t.Fatalf("bad: %#v", slow)
+	}
+
+	// Slower ones should get a bigger one.
+	atomic.StoreInt64(&delay, int64(100*time.Millisecond))
+	slower := register(6)
+	if slower.Backoff <= slow.Backoff || slower.Backoff > time.Minute {
+		t.Fatalf("bad: %#v %#v", slow, slower)
+	}
+
+}
+
+func TestCatalog_Register_Backoff_QueueDepth(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ApplyBackoffQueueDepth = 2
+		c.ApplyBackoffStep = time.Second
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Hold up applies for the blocked nodes until we let them go.
+	release := make(chan struct{})
+	s1.raftApplyHook = func(t structs.MessageType, msg interface{}) {
+		if req, ok := msg.(*structs.RegisterRequest); ok && strings.HasPrefix(req.Node, "blocked") {
+			<-release
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codec := rpcClient(t, s1)
+			defer codec.Close()
+			arg := structs.RegisterRequest{
+				Datacenter: "dc1",
+				Node:       fmt.Sprintf("blocked%d", i),
+				Address:    "127.0.0.1",
+			}
+			var out struct{}
+			if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+				t.Errorf("err: %v", err)
+			}
+		}(i)
+	}
+	defer wg.Wait()
+	defer close(release)
+
+	if err := testutil.WaitForResult(func() (bool, error) {
+		depth, _ := s1.applyLoad.stats()
+		return depth == 3, fmt.Errorf("bad: %d", depth)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// With three applies stuck against a limit of two, the backoff should
+	// be one and a half steps.
+	if out := applyBackoff(t, codec); out.ApplyQueueDepth != 3 || out.Backoff != 1500*time.Millisecond {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+// applyBackoff asks the server for its current backoff advice.
+func applyBackoff(t *testing.T, codec rpc.ClientCodec) structs.ApplyBackoff {
+	args := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var out structs.ApplyBackoff
+	if err := msgpackrpc.CallWithCodec(codec, "Status.ApplyBackoff", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return out
+}
@@ -0,0 +1,65 @@
+package consul
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// applyDeadlines counts the writes that ran out of time in raftApply. The
+// counts must be accessed atomically.
+type applyDeadlines struct {
+	// abandoned is the number of writes that were given up on before they
+	// were handed to Raft.
+	abandoned uint64
+
+	// late is the number of writes that were handed to Raft in time, but
+	// finished applying after their deadline.
+	late uint64
+}
+
+// abandon records a write that was given up on before it was handed to Raft.
+func (d *applyDeadlines) abandon() error {
+	atomic.AddUint64(&d.abandoned, 1)
+	metrics.IncrCounter([]string{"consul", "raft", "apply", "deadline_abandoned"}, 1)
+	return structs.ErrDeadlineExceeded
+}
+
+// finishLate records a write that was applied after its deadline.
+func (d *applyDeadlines) finishLate() {
+	atomic.AddUint64(&d.late, 1)
+	metrics.IncrCounter([]string{"consul", "raft", "apply", "deadline_late"}, 1)
+}
+
+// stats returns the number of abandoned and late writes.
+func (d *applyDeadlines) stats() (uint64, uint64) {
+	return atomic.LoadUint64(&d.abandoned), atomic.LoadUint64(&d.late)
+}
+
+// requestDeadline returns the deadline carried by the given message, or zero
+// if it doesn't have one.
+func requestDeadline(msg interface{}) time.Time {
+	if req, ok := msg.(structs.DeadlineRequest); ok {
+		return req.Deadline()
+	}
+	return time.Time{}
+}
+
+// passDeadline sets a write's RequestTimeout to the time it has left, just
+// before it's forwarded, so the next server gives up at about the same time
+// as this one. If there's no time left the write is abandoned here instead.
+func (s *Server) passDeadline(info structs.RPCInfo) error {
+	req, ok := info.(structs.DeadlineRequest)
+	if !ok || req.Deadline().IsZero() {
+		return nil
+	}
+
+	left := req.Deadline().Sub(time.Now())
+	if left <= 0 {
+		return s.applyDeadlines.abandon()
+	}
+	req.SetRequestTimeout(left)
+	return nil
+}
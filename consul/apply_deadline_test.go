@@ -0,0 +1,204 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestRaftApply_Deadline(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Slow down every other KV apply before it gets to Raft, well past the
+	// timeout the writes are given.
+	var applies int64
+	s1.raftApplyHook = func(t structs.MessageType, msg interface{}) {
+		if t == structs.KVSRequestType && atomic.AddInt64(&applies, 1)%2 == 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	// Keep track of what happened to each write.
+	const writes = 10
+	outcomes := make(map[string]error)
+	for i := 0; i < writes; i++ {
+		key := fmt.Sprintf("deadline/%d", i)
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Value: []byte("test"),
+			},
+			WriteRequest: structs.WriteRequest{
+				RequestTimeout: 10 * time.Millisecond,
+			},
+		}
+		var out bool
+		err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out)
+		if err != nil && err.Error() != structs.ErrDeadlineExceeded.Error() {
+			t.Fatalf("err: %v", err)
+		}
+		outcomes[key] = err
+	}
+
+	// Half the writes were held up, and they should have been abandoned.
+	abandoned, late := s1.applyDeadlines.stats()
+	if abandoned != writes/2 {
+		t.Fatalf("bad: %d %d", abandoned, late)
+	}
+
+	// Only the abandoned writes should be missing from the KV store.
+	state := s1.fsm.State()
+	var missing uint64
+	for key, err := range outcomes {
+		_, entry, err2 := state.KVSGet(nil, key)
+		if err2 != nil {
+			t.Fatalf("err: %v", err2)
+		}
+		if (err == nil) != (entry != nil) {
+			t.Fatalf("bad: %s %v %#v", key, err, entry)
+		}
+		if entry == nil {
+			missing++
+		}
+	}
+	if missing != abandoned {
+		t.Fatalf("bad: %d %d", missing, abandoned)
+	}
+
+	// Writes without a timeout should wait as long as they need to.
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "deadline/none",
+			Value: []byte("test"),
+		},
+	}
+	for i := 0; i < 2; i++ {
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if now, _ := s1.applyDeadlines.stats(); now != abandoned {
+		t.Fatalf("bad: %d", now)
+	}
+}
+
+func TestRaftApply_Deadline_Forward(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s2.RPC, "dc1")
+
+	// Send the write through the follower, and hold it up on the leader.
+	// The leader should give up when the time that's left runs out, not
+	// start the timeout over again.
+	leader, follower := s1, s2
+	if !s1.IsLeader() {
+		leader, follower = s2, s1
+	}
+	codec := rpcClient(t, follower)
+	defer codec.Close()
+
+	leader.raftApplyHook = func(t structs.MessageType, msg interface{}) {
+		if t == structs.KVSRequestType {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}
+
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "deadline",
+			Value: []byte("test"),
+		},
+		WriteRequest: structs.WriteRequest{
+			RequestTimeout: 100 * time.Millisecond,
+		},
+	}
+	var out bool
+	err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), structs.ErrDeadlineExceeded.Error()) {
+		t.Fatalf("err: %v", err)
+	}
+	if abandoned, _ := leader.applyDeadlines.stats(); abandoned != 1 {
+		t.Fatalf("bad: %d", abandoned)
+	}
+	_, entry, err := leader.fsm.State().KVSGet(nil, "deadline")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if entry != nil {
+		t.Fatalf("bad: %#v", entry)
+	}
+}
+
+func TestServer_PassDeadline(t *testing.T) {
+	s := &Server{}
+
+	// Requests without a timeout are left alone.
+	var req structs.KVSRequest
+	req.StartDeadline(time.Now())
+	if err := s.passDeadline(&req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if req.RequestTimeout != 0 {
+		t.Fatalf("bad: %v", req.RequestTimeout)
+	}
+
+	// The time that's left gets passed on.
+	start := time.Now()
+	req.RequestTimeout = time.Minute
+	req.StartDeadline(start.Add(-10 * time.Second))
+	if err := s.passDeadline(&req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if req.RequestTimeout <= 0 || req.RequestTimeout > 50*time.Second {
+		t.Fatalf("bad: %v", req.RequestTimeout)
+	}
+
+	// The deadline isn't started over once it's set.
+	req.StartDeadline(time.Now())
+	if !req.Deadline().Equal(start.Add(50 * time.Second)) {
+		t.Fatalf("bad: %v", req.Deadline())
+	}
+
+	// Once it's run out the request is abandoned.
+	req = structs.KVSRequest{}
+	req.RequestTimeout = time.Second
+	req.StartDeadline(time.Now().Add(-time.Minute))
+	if err := s.passDeadline(&req); err != structs.ErrDeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+	if abandoned, _ := s.applyDeadlines.stats(); abandoned != 1 {
+		t.Fatalf("bad: %d", abandoned)
+	}
+}
@@ -3,6 +3,7 @@ package consul
 import (
 	"context"
 	"fmt"
+	"net"
 	"strconv"
 	"sync"
 	"time"
@@ -22,6 +23,7 @@ type AutopilotPolicy interface {
 
 func (s *Server) startAutopilot() {
 	s.autopilotShutdownCh = make(chan struct{})
+	s.autopilotFailed = make(map[string]*failedServer)
 	s.autopilotWaitGroup = sync.WaitGroup{}
 	s.autopilotWaitGroup.Add(1)
 
@@ -29,23 +31,40 @@ func (s *Server) startAutopilot() {
 }
 
 func (s *Server) stopAutopilot() {
+	// Autopilot isn't running if leadership was lost before it started.
+	if s.autopilotShutdownCh == nil {
+		return
+	}
 	close(s.autopilotShutdownCh)
 	s.autopilotWaitGroup.Wait()
+	s.autopilotShutdownCh = nil
+}
+
+// failedServer records when Autopilot first saw a server as failed.
+type failedServer struct {
+	// id is the server's ID, which may be empty for older servers.
+	id string
+
+	// since is when the server was first seen as failed.
+	since time.Time
 }
 
-// autopilotLoop periodically looks for nonvoting servers to promote and dead servers to remove.
+// autopilotLoop periodically looks for nonvoting servers to promote, failed
+// voters to demote, and dead servers to remove.
 func (s *Server) autopilotLoop() {
 	defer s.autopilotWaitGroup.Done()
 
 	// Monitor server health until shutdown
-	ticker := time.NewTicker(s.config.AutopilotInterval)
+	ticker := s.newReloadTicker(s.autopilotInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-s.autopilotShutdownCh:
 			return
-		case <-ticker.C:
+		case <-ticker.Reloaded():
+			ticker.Reset()
+		case <-ticker.C():
 			state := s.fsm.State()
 			_, autopilotConf, err := state.AutopilotConfig()
 			if err != nil {
@@ -53,6 +72,11 @@ func (s *Server) autopilotLoop() {
 				break
 			}
 
+			s.trackFailedServers()
+			if err := s.demoteFailedVoters(); err != nil {
+				s.logger.Printf("[ERR] consul: error checking for failed voters to demote: %s", err)
+			}
+
 			if err := s.autopilotPolicy.PromoteNonVoters(autopilotConf); err != nil {
 				s.logger.Printf("[ERR] consul: error checking for non-voters to promote: %s", err)
 			}
@@ -61,6 +85,7 @@ func (s *Server) autopilotLoop() {
 				s.logger.Printf("[ERR] consul: error checking for dead servers to remove: %s", err)
 			}
 		case <-s.autopilotRemoveDeadCh:
+			s.trackFailedServers()
 			if err := s.pruneDeadServers(); err != nil {
 				s.logger.Printf("[ERR] consul: error checking for dead servers to remove: %s", err)
 			}
@@ -68,6 +93,100 @@ func (s *Server) autopilotLoop() {
 	}
 }
 
+// trackFailedServers updates the record of when each failed server was first
+// seen, dropping servers that are no longer failed.
+func (s *Server) trackFailedServers() {
+	now := s.clock.Now()
+	seen := make(map[string]struct{})
+	for _, member := range s.serfLAN.Members() {
+		valid, parts := agent.IsConsulServer(member)
+		if !valid || member.Status != serf.StatusFailed {
+			continue
+		}
+
+		seen[member.Name] = struct{}{}
+		if _, ok := s.autopilotFailed[member.Name]; !ok {
+			s.autopilotFailed[member.Name] = &failedServer{parts.ID, now}
+		}
+	}
+	for name := range s.autopilotFailed {
+		if _, ok := seen[name]; !ok {
+			delete(s.autopilotFailed, name)
+		}
+	}
+}
+
+// demoteFailedVoters demotes voters that have been failed for longer than
+// VoterDemotionTimeout to non-voters, as long as they're a minority of the
+// voters. They stay in the Raft configuration, so they'll get promoted again
+// like any other non-voter once they're back and stable.
+func (s *Server) demoteFailedVoters() error {
+	if s.config.VoterDemotionTimeout == 0 {
+		return nil
+	}
+
+	// Demotion relies on the non-voter features.
+	minRaftProtocol, err := ServerMinRaftProtocol(s.LANMembers())
+	if err != nil {
+		return fmt.Errorf("error getting server raft protocol versions: %s", err)
+	}
+	if minRaftProtocol < 3 {
+		return nil
+	}
+
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return fmt.Errorf("failed to get raft configuration: %v", err)
+	}
+
+	// Everything in Raft protocol 3 has an ID, so look the failed servers
+	// up by that.
+	failedByID := make(map[raft.ServerID]string)
+	for name, failed := range s.autopilotFailed {
+		failedByID[raft.ServerID(failed.id)] = name
+	}
+
+	now := s.clock.Now()
+	var demotions []raft.Server
+	voterCount := 0
+	for _, server := range future.Configuration().Servers {
+		if !isVoter(server.Suffrage) {
+			continue
+		}
+		voterCount++
+
+		name, ok := failedByID[server.ID]
+		if ok && now.Sub(s.autopilotFailed[name].since) >= s.config.VoterDemotionTimeout {
+			demotions = append(demotions, server)
+		}
+	}
+	if len(demotions) == 0 {
+		return nil
+	}
+
+	// Only demote if the failed voters are a minority, otherwise the
+	// configuration change couldn't be committed anyway.
+	if len(demotions)*2 >= voterCount {
+		s.logger.Printf("[DEBUG] consul: Not demoting failed voters: too many failed voters: %d/%d",
+			len(demotions), voterCount)
+		return nil
+	}
+
+	for _, server := range demotions {
+		name := failedByID[server.ID]
+		s.logger.Printf("[INFO] consul: Demoting server %s (ID %s) to non-voter after being failed for %v",
+			name, server.ID, now.Sub(s.autopilotFailed[name].since))
+		demoteFuture := s.raft.DemoteVoter(server.ID, 0, 0)
+		if err := demoteFuture.Error(); err != nil {
+			return fmt.Errorf("failed to demote raft peer: %v", err)
+		}
+		metrics.IncrCounter([]string{"consul", "autopilot", "voter_demoted"}, 1)
+		s.recordServerEvent(server.ID, server.Address, structs.ServerEventDemoted,
+			fmt.Sprintf("failed for %v", now.Sub(s.autopilotFailed[name].since)), structs.ServerEventByAutopilot)
+	}
+	return nil
+}
+
 // pruneDeadServers removes up to numPeers/2 failed servers
 func (s *Server) pruneDeadServers() error {
 	state := s.fsm.State()
@@ -76,13 +195,13 @@ func (s *Server) pruneDeadServers() error {
 		return err
 	}
 
-	// Find any failed servers
+	// Find any servers that have been failed for long enough
 	var failed []string
 	if autopilotConf.CleanupDeadServers {
-		for _, member := range s.serfLAN.Members() {
-			valid, _ := agent.IsConsulServer(member)
-			if valid && member.Status == serf.StatusFailed {
-				failed = append(failed, member.Name)
+		now := s.clock.Now()
+		for name, server := range s.autopilotFailed {
+			if now.Sub(server.since) >= s.config.DeadServerCleanupTimeout {
+				failed = append(failed, name)
 			}
 		}
 	}
@@ -97,19 +216,72 @@ func (s *Server) pruneDeadServers() error {
 		return err
 	}
 
-	// Only do removals if a minority of servers will be affected
-	if len(failed) < peers/2 {
-		for _, server := range failed {
-			s.logger.Printf("[INFO] consul: Attempting removal of failed server: %v", server)
-			go s.serfLAN.RemoveFailedNode(server)
+	// Non-voters don't affect the quorum, so they can always be removed,
+	// and only the failed voters count towards the limit. Servers only
+	// show up as non-voters in Raft protocol 3, where the IDs match.
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+	nonVoters := make(map[raft.ServerID]struct{})
+	for _, server := range future.Configuration().Servers {
+		if !isVoter(server.Suffrage) {
+			nonVoters[server.ID] = struct{}{}
+		}
+	}
+	var failedVoters, failedNonVoters []string
+	for _, name := range failed {
+		if _, ok := nonVoters[raft.ServerID(s.autopilotFailed[name].id)]; ok {
+			failedNonVoters = append(failedNonVoters, name)
+		} else {
+			failedVoters = append(failedVoters, name)
+		}
+	}
+
+	// Only remove voters if a minority of them will be affected
+	remove := failedNonVoters
+	if len(failedVoters) < peers/2 {
+		remove = append(remove, failedVoters...)
+	} else if len(failedVoters) > 0 {
+		s.logger.Printf("[DEBUG] consul: Failed to remove dead servers: too many dead servers: %d/%d", len(failedVoters), peers)
+	}
+	for _, server := range remove {
+		s.logger.Printf("[INFO] consul: Attempting removal of failed server: %v", server)
+		if err := s.cleanupDeadServer(server); err != nil {
+			s.logger.Printf("[ERR] consul: failed to remove failed server %v: %v", server, err)
 		}
-	} else {
-		s.logger.Printf("[DEBUG] consul: Failed to remove dead servers: too many dead servers: %d/%d", len(failed), peers)
 	}
 
 	return nil
 }
 
+// cleanupDeadServer forces the given failed server to leave, and removes it
+// from the Raft peers and the catalog. This is tracked as an operator intent,
+// so a new leader can finish the job if we fail part way.
+func (s *Server) cleanupDeadServer(name string) error {
+	intent, err := s.operatorIntentFor(name)
+	if err != nil {
+		return err
+	}
+	if intent != nil {
+		return s.runOperatorIntent(intent)
+	}
+
+	for _, member := range s.serfLAN.Members() {
+		if member.Name != name {
+			continue
+		}
+		valid, parts := agent.IsConsulServer(member)
+		if !valid {
+			return nil
+		}
+		addr := (&net.TCPAddr{IP: member.Addr, Port: parts.Port}).String()
+		return s.startOperatorIntent(structs.OperatorIntentDeadServerCleanup,
+			name, parts.ID, addr, "dead server cleanup")
+	}
+	return nil
+}
+
 // BasicAutopilot defines a policy for promoting non-voting servers in a way
 // that maintains an odd-numbered voter count.
 type BasicAutopilot struct {
@@ -133,14 +305,27 @@ func (b *BasicAutopilot) PromoteNonVoters(autopilotConf *structs.AutopilotConfig
 		return fmt.Errorf("failed to get raft configuration: %v", err)
 	}
 
+	// Servers configured as non-voting are never promoted.
+	nonVoting := make(map[raft.ServerID]struct{})
+	for _, member := range b.server.LANMembers() {
+		if valid, parts := agent.IsConsulServer(member); valid && parts.NonVoter {
+			nonVoting[raft.ServerID(parts.ID)] = struct{}{}
+		}
+	}
+
 	// Find any non-voters eligible for promotion
 	var promotions []raft.Server
 	voterCount := 0
+	appliedIndex := b.server.raft.AppliedIndex()
 	for _, server := range future.Configuration().Servers {
-		// If this server has been stable and passing for long enough, promote it to a voter
+		// If this server has been stable and passing for long enough, and
+		// has caught up on applying the log, promote it to a voter
 		if !isVoter(server.Suffrage) {
+			if _, ok := nonVoting[server.ID]; ok {
+				continue
+			}
 			health := b.server.getServerHealth(string(server.ID))
-			if health.IsStable(time.Now(), autopilotConf) {
+			if health.IsStable(time.Now(), autopilotConf) && health.IsCaughtUp(appliedIndex, b.server.config.PromoteMaxApplyLag) {
 				promotions = append(promotions, server)
 			}
 		} else {
@@ -164,9 +349,8 @@ func (s *Server) handlePromotions(voterCount int, promotions []raft.Server) (boo
 	// to get to an odd-sized quorum
 	newServers := false
 	if voterCount%2 == 0 {
-		addFuture := s.raft.AddVoter(promotions[0].ID, promotions[0].Address, 0, 0)
-		if err := addFuture.Error(); err != nil {
-			return newServers, fmt.Errorf("failed to add raft peer: %v", err)
+		if err := s.promoteNonVoter(promotions[0]); err != nil {
+			return newServers, err
 		}
 		promotions = promotions[1:]
 		newServers = true
@@ -174,13 +358,11 @@ func (s *Server) handlePromotions(voterCount int, promotions []raft.Server) (boo
 
 	// Promote remaining servers in twos to maintain an odd quorum size
 	for i := 0; i < len(promotions)-1; i += 2 {
-		addFirst := s.raft.AddVoter(promotions[i].ID, promotions[i].Address, 0, 0)
-		if err := addFirst.Error(); err != nil {
-			return newServers, fmt.Errorf("failed to add raft peer: %v", err)
+		if err := s.promoteNonVoter(promotions[i]); err != nil {
+			return newServers, err
 		}
-		addSecond := s.raft.AddVoter(promotions[i+1].ID, promotions[i+1].Address, 0, 0)
-		if err := addSecond.Error(); err != nil {
-			return newServers, fmt.Errorf("failed to add raft peer: %v", err)
+		if err := s.promoteNonVoter(promotions[i+1]); err != nil {
+			return newServers, err
 		}
 		newServers = true
 	}
@@ -196,17 +378,32 @@ func (s *Server) handlePromotions(voterCount int, promotions []raft.Server) (boo
 	return newServers, nil
 }
 
+// promoteNonVoter makes the given server a voter.
+func (s *Server) promoteNonVoter(server raft.Server) error {
+	s.logger.Printf("[INFO] consul: Promoting server (ID %s) to voter", server.ID)
+	addFuture := s.raft.AddVoter(server.ID, server.Address, 0, 0)
+	if err := addFuture.Error(); err != nil {
+		return fmt.Errorf("failed to add raft peer: %v", err)
+	}
+	metrics.IncrCounter([]string{"consul", "autopilot", "voter_promoted"}, 1)
+	s.recordServerEvent(server.ID, server.Address, structs.ServerEventPromoted,
+		"stable as a non-voter", structs.ServerEventByAutopilot)
+	return nil
+}
+
 // serverHealthLoop monitors the health of the servers in the cluster
 func (s *Server) serverHealthLoop() {
 	// Monitor server health until shutdown
-	ticker := time.NewTicker(s.config.ServerHealthInterval)
+	ticker := s.newReloadTicker(s.serverHealthInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-s.shutdownCh:
 			return
-		case <-ticker.C:
+		case <-ticker.Reloaded():
+			ticker.Reset()
+		case <-ticker.C():
 			if err := s.updateClusterHealth(); err != nil {
 				s.logger.Printf("[ERR] consul: error updating cluster health: %s", err)
 			}
@@ -265,7 +462,7 @@ func (s *Server) updateClusterHealth() error {
 			fetchList = append(fetchList, parts)
 		}
 	}
-	d := time.Now().Add(s.config.ServerHealthInterval / 2)
+	d := time.Now().Add(s.serverHealthInterval() / 2)
 	ctx, cancel := context.WithDeadline(context.Background(), d)
 	defer cancel()
 	fetchedStats := s.statsFetcher.Fetch(ctx, fetchList)
@@ -305,9 +502,17 @@ func (s *Server) updateClusterHealth() error {
 			}
 		}
 
+		if health.GossipDegraded {
+			clusterHealth.Warnings = append(clusterHealth.Warnings,
+				fmt.Sprintf("Server %q has a degraded gossip pool", health.Name))
+		}
+
 		clusterHealth.Servers = append(clusterHealth.Servers, health)
 	}
 	clusterHealth.Healthy = healthyCount == len(servers)
+	if warning := s.leaderFlapWarning(); warning != "" {
+		clusterHealth.Warnings = append(clusterHealth.Warnings, warning)
+	}
 
 	// If we have extra healthy voters, update FailureTolerance
 	requiredQuorum := len(servers)/2 + 1
@@ -340,6 +545,8 @@ func (s *Server) updateServerHealth(health *structs.ServerHealth,
 
 	health.LastTerm = stats.LastTerm
 	health.LastIndex = stats.LastIndex
+	health.LastAppliedIndex = stats.LastAppliedIndex
+	health.GossipDegraded = stats.GossipDegraded
 
 	if stats.LastContact != "never" {
 		var err error
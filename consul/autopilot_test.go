@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/testutil"
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
@@ -250,3 +251,263 @@ func TestAutopilot_PromoteNonVoter(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestAutopilot_PromoteNonVoter_CatchUp(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Datacenter = "dc1"
+		c.Bootstrap = true
+		c.RaftConfig.ProtocolVersion = 3
+		c.AutopilotConfig.ServerStabilizationTime = 200 * time.Millisecond
+		c.PromoteMaxApplyLag = 10
+		c.ServerHealthInterval = 100 * time.Millisecond
+		c.AutopilotInterval = 100 * time.Millisecond
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Put some data in the cluster so the new servers have something to
+	// catch up on.
+	for i := 0; i < 100; i++ {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   fmt.Sprintf("test/%d", i),
+				Value: []byte("hello"),
+			},
+		}
+		var out bool
+		if err := s1.RPC("KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	dataIndex := s1.raft.AppliedIndex()
+
+	// Join two servers so they can be promoted as a pair.
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	var servers []*Server
+	for i := 0; i < 2; i++ {
+		dir, s := testServerWithConfig(t, func(c *Config) {
+			c.Datacenter = "dc1"
+			c.Bootstrap = false
+			c.RaftConfig.ProtocolVersion = 3
+		})
+		defer os.RemoveAll(dir)
+		defer s.Shutdown()
+		if _, err := s.JoinLAN([]string{addr}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		servers = append(servers, s)
+
+		// The new server should show up as a non-voter first.
+		if err := testutil.WaitForResult(func() (bool, error) {
+			future := s1.raft.GetConfiguration()
+			if err := future.Error(); err != nil {
+				return false, err
+			}
+			for _, server := range future.Configuration().Servers {
+				if server.ID == raft.ServerID(s.config.NodeID) {
+					if server.Suffrage != raft.Nonvoter {
+						t.Fatalf("bad: %v", server)
+					}
+					return true, nil
+				}
+			}
+			return false, fmt.Errorf("server not added")
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Both should get promoted, but only once they've applied the data.
+	if err := testutil.WaitForResult(func() (bool, error) {
+		future := s1.raft.GetConfiguration()
+		if err := future.Error(); err != nil {
+			return false, err
+		}
+		voters := 0
+		for _, server := range future.Configuration().Servers {
+			if server.Suffrage == raft.Voter {
+				voters++
+			}
+		}
+		if voters != 3 {
+			return false, fmt.Errorf("bad: %v", future.Configuration().Servers)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		health := s1.getServerHealth(string(s.config.NodeID))
+		if health == nil || health.LastAppliedIndex < dataIndex-10 {
+			t.Fatalf("bad: %v", health)
+		}
+		if applied := s.raft.AppliedIndex(); applied < dataIndex {
+			t.Fatalf("bad: %d < %d", applied, dataIndex)
+		}
+	}
+}
+
+func TestAutopilot_JoinAsVoter(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Datacenter = "dc1"
+		c.Bootstrap = true
+		c.RaftConfig.ProtocolVersion = 3
+		c.JoinAsVoter = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Datacenter = "dc1"
+		c.Bootstrap = false
+		c.RaftConfig.ProtocolVersion = 3
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The new server should go straight in as a voter.
+	if err := testutil.WaitForResult(func() (bool, error) {
+		future := s1.raft.GetConfiguration()
+		if err := future.Error(); err != nil {
+			return false, err
+		}
+		servers := future.Configuration().Servers
+		if len(servers) != 2 {
+			return false, fmt.Errorf("bad: %v", servers)
+		}
+		if servers[1].Suffrage != raft.Voter {
+			t.Fatalf("bad: %v", servers)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAutopilot_DemoteFailedVoter(t *testing.T) {
+	conf := func(c *Config) {
+		c.Datacenter = "dc1"
+		c.Bootstrap = false
+		c.RaftConfig.ProtocolVersion = 3
+		c.AutopilotConfig.ServerStabilizationTime = 200 * time.Millisecond
+		c.ServerHealthInterval = 100 * time.Millisecond
+		c.AutopilotInterval = 100 * time.Millisecond
+		c.VoterDemotionTimeout = time.Second
+
+		// Cleanup stays on, but shouldn't get to the failed server.
+		c.DeadServerCleanupTimeout = time.Hour
+	}
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		conf(c)
+		c.Bootstrap = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	servers := []*Server{s1}
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	for i := 0; i < 4; i++ {
+		dir, s := testServerWithConfig(t, conf)
+		defer os.RemoveAll(dir)
+		defer s.Shutdown()
+		if _, err := s.JoinLAN([]string{addr}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		servers = append(servers, s)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// suffrages returns the suffrage of each server in the configuration,
+	// by ID.
+	suffrages := func() (map[raft.ServerID]raft.ServerSuffrage, error) {
+		future := s1.raft.GetConfiguration()
+		if err := future.Error(); err != nil {
+			return nil, err
+		}
+		result := make(map[raft.ServerID]raft.ServerSuffrage)
+		for _, server := range future.Configuration().Servers {
+			result[server.ID] = server.Suffrage
+		}
+		return result, nil
+	}
+	allVoters := func() (bool, error) {
+		servers, err := suffrages()
+		if err != nil {
+			return false, err
+		}
+		if len(servers) != 5 {
+			return false, fmt.Errorf("bad: %v", servers)
+		}
+		for _, suffrage := range servers {
+			if suffrage != raft.Voter {
+				return false, fmt.Errorf("bad: %v", servers)
+			}
+		}
+		return true, nil
+	}
+
+	// Wait for everyone to get promoted.
+	if err := testutil.WaitForResult(allVoters); err != nil {
+		t.Fatal(err)
+	}
+
+	// Kill a server, which should get demoted, but not removed.
+	victim := servers[4]
+	id := raft.ServerID(victim.config.NodeID)
+	victim.Shutdown()
+
+	// A shut down server in the same process doesn't hang up connections
+	// that were already open, the way a real one would, so do that for it.
+	for _, s := range servers[:4] {
+		s.connPool.Lock()
+		conn := s.connPool.pool[victim.config.RPCAddr.String()]
+		s.connPool.Unlock()
+		if conn != nil {
+			s.connPool.clearConn(conn)
+			conn.Close()
+		}
+	}
+	killed := time.Now()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		servers, err := suffrages()
+		if err != nil {
+			return false, err
+		}
+		if len(servers) != 5 {
+			return false, fmt.Errorf("bad: %v", servers)
+		}
+		return servers[id] == raft.Nonvoter, fmt.Errorf("bad: %v", servers)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Now().Sub(killed); elapsed < s1.config.VoterDemotionTimeout {
+		t.Fatalf("demoted too soon: %v", elapsed)
+	}
+
+	// Bring it back, and it should get promoted again once it's stable.
+	dir, victim := testServerWithConfig(t, func(c *Config) {
+		*c = *testRestartConfig(t, victim.config)
+		conf(c)
+	})
+	defer os.RemoveAll(dir)
+	defer victim.Shutdown()
+	if _, err := victim.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := testutil.WaitForResult(allVoters); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,200 @@
+package consul
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-uuid"
+)
+
+// blockingQuerySourceLocal is the source given for blocking queries made by
+// the server's own agent, which don't come in over the network.
+const blockingQuerySourceLocal = "local"
+
+// blockingQueryFilterFields are the request fields that say what a blocking
+// query is watching. Only these are summarized, since other fields can hold
+// secrets, like the ID of the token being read.
+var blockingQueryFilterFields = []string{
+	"Key",
+	"Prefix",
+	"ServiceName",
+	"ServiceTag",
+	"Node",
+	"State",
+	"Session",
+	"QueryIDOrName",
+}
+
+// blockingQuerySource is what the RPC layer knows about a blocking query
+// before it reaches the endpoint.
+type blockingQuerySource struct {
+	endpoint string
+	filter   string
+	source   string
+}
+
+// blockingQueryEntry is a blocking query the server is waiting to answer.
+type blockingQueryEntry struct {
+	info structs.BlockingQuery
+
+	// cancelCh is closed to make the query return right away.
+	cancelCh chan struct{}
+}
+
+// blockingQueries keeps track of the blocking queries being served, so
+// operators can see what's waiting and cancel queries that are stuck or
+// holding on to too much. Non-blocking queries are never tracked, so this
+// costs nothing when there are no blocking queries.
+type blockingQueries struct {
+	sync.Mutex
+
+	// sources holds what the RPC layer knows about each blocking request
+	// while it's being served, keyed by the request's query options. The
+	// endpoint's blocking query looks itself up here.
+	sources map[*structs.QueryOptions]blockingQuerySource
+
+	// queries are the blocking queries that are waiting, by ID.
+	queries map[string]*blockingQueryEntry
+}
+
+// newBlockingQueries returns an empty blocking query registry.
+func newBlockingQueries() *blockingQueries {
+	return &blockingQueries{
+		sources: make(map[*structs.QueryOptions]blockingQuerySource),
+		queries: make(map[string]*blockingQueryEntry),
+	}
+}
+
+// trackSource records where a request came from if it's a blocking query.
+// This returns the query options to pass to clearSource once the request
+// has been answered, or nil if nothing was recorded.
+func (b *blockingQueries) trackSource(method, source string, body interface{}) *structs.QueryOptions {
+	holder, ok := body.(structs.QueryOptionsHolder)
+	if !ok {
+		return nil
+	}
+	opts := holder.GetQueryOptions()
+	if opts.MinQueryIndex == 0 {
+		return nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.sources[opts] = blockingQuerySource{
+		endpoint: method,
+		filter:   summarizeBlockingQuery(body),
+		source:   source,
+	}
+	return opts
+}
+
+// clearSource forgets the source recorded by trackSource.
+func (b *blockingQueries) clearSource(opts *structs.QueryOptions) {
+	if opts == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	delete(b.sources, opts)
+}
+
+// add starts tracking a blocking query. The caller must remove it when the
+// query returns.
+func (b *blockingQueries) add(opts *structs.QueryOptions) (*blockingQueryEntry, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	q := &blockingQueryEntry{
+		info: structs.BlockingQuery{
+			ID:            id,
+			TokenHash:     hashBlockingQueryToken(opts.Token),
+			Start:         time.Now(),
+			MinQueryIndex: opts.MinQueryIndex,
+		},
+		cancelCh: make(chan struct{}),
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if source, ok := b.sources[opts]; ok {
+		q.info.Endpoint = source.endpoint
+		q.info.Filter = source.filter
+		q.info.Source = source.source
+	}
+	b.queries[id] = q
+	return q, nil
+}
+
+// remove stops tracking a blocking query.
+func (b *blockingQueries) remove(q *blockingQueryEntry) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.queries, q.info.ID)
+}
+
+// list returns the blocking queries that are waiting, oldest first.
+func (b *blockingQueries) list() []structs.BlockingQuery {
+	b.Lock()
+	queries := make([]structs.BlockingQuery, 0, len(b.queries))
+	for _, q := range b.queries {
+		queries = append(queries, q.info)
+	}
+	b.Unlock()
+
+	sort.Slice(queries, func(i, j int) bool {
+		return queries[i].Start.Before(queries[j].Start)
+	})
+	return queries
+}
+
+// cancel makes the blocking query with the given ID return right away.
+func (b *blockingQueries) cancel(id string) error {
+	b.Lock()
+	defer b.Unlock()
+	q, ok := b.queries[id]
+	if !ok {
+		return fmt.Errorf("Unknown blocking query %q", id)
+	}
+
+	// The query stays tracked until it returns, so make sure it's only
+	// cancelled once.
+	select {
+	case <-q.cancelCh:
+	default:
+		close(q.cancelCh)
+	}
+	return nil
+}
+
+// hashBlockingQueryToken returns a short hash of the given token, or an
+// empty string for the anonymous token.
+func hashBlockingQueryToken(token string) string {
+	return hashToken(token)
+}
+
+// summarizeBlockingQuery describes what a blocking request is watching using
+// its filter fields, like "Key=foo/bar".
+func summarizeBlockingQuery(body interface{}) string {
+	v := reflect.Indirect(reflect.ValueOf(body))
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+
+	var parts []string
+	for _, name := range blockingQueryFilterFields {
+		f := v.FieldByName(name)
+		if !f.IsValid() || f.Kind() != reflect.String || f.String() == "" {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s=%s", name, f.String()))
+	}
+	return strings.Join(parts, " ")
+}
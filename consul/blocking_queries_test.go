@@ -0,0 +1,240 @@
+package consul
+
+import (
+	"fmt"
+	"net/rpc"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestOperator_BlockingQueries(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Nothing should be blocking yet.
+	listArg := structs.BlockingQueriesRequest{
+		Datacenter: "dc1",
+	}
+	var list structs.BlockingQueriesReply
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ListBlockingQueries", &listArg, &list); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if list.Node != s1.config.NodeName || len(list.Queries) != 0 {
+		t.Fatalf("bad: %#v", list)
+	}
+
+	// Write some keys so there's an index to block on.
+	keys := []string{"a", "b", "c"}
+	for _, key := range keys {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Value: []byte("hello"),
+			},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	getArg := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "c",
+	}
+	var entries structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Get", &getArg, &entries); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	index := entries.Index
+
+	// Start a blocking query on each key, each over its own connection.
+	type result struct {
+		key   string
+		reply structs.IndexedDirEntries
+		err   error
+	}
+	doneCh := make(chan result, len(keys))
+	for _, key := range keys {
+		go func(key string, codec rpc.ClientCodec) {
+			defer codec.Close()
+			arg := structs.KeyRequest{
+				Datacenter: "dc1",
+				Key:        key,
+				QueryOptions: structs.QueryOptions{
+					MinQueryIndex: index,
+					MaxQueryTime:  10 * time.Second,
+				},
+			}
+			res := result{key: key}
+			res.err = msgpackrpc.CallWithCodec(codec, "KVS.Get", &arg, &res.reply)
+			doneCh <- res
+		}(key, rpcClient(t, s1))
+	}
+
+	// Wait for them all to show up.
+	if err := testutil.WaitForResult(func() (bool, error) {
+		list = structs.BlockingQueriesReply{}
+		if err := msgpackrpc.CallWithCodec(codec, "Operator.ListBlockingQueries", &listArg, &list); err != nil {
+			return false, err
+		}
+		return len(list.Queries) == len(keys), fmt.Errorf("bad: %#v", list.Queries)
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var target string
+	for _, q := range list.Queries {
+		if q.Endpoint != "KVS.Get" || q.Source == "" || q.MinQueryIndex != index || q.Start.IsZero() {
+			t.Fatalf("bad: %#v", q)
+		}
+		if q.Filter == "Key=b" {
+			target = q.ID
+		}
+	}
+	if target == "" {
+		t.Fatalf("bad: %#v", list.Queries)
+	}
+
+	// Cancel the query on "b" and make sure only it returns, with the
+	// current value.
+	cancelArg := structs.CancelBlockingQueryRequest{
+		Datacenter: "dc1",
+		ID:         target,
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.CancelBlockingQuery", &cancelArg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case res := <-doneCh:
+		if res.err != nil {
+			t.Fatalf("err: %v", res.err)
+		}
+		if res.key != "b" || !res.reply.Cancelled || res.reply.Index > index ||
+			len(res.reply.Entries) != 1 || string(res.reply.Entries[0].Value) != "hello" {
+			t.Fatalf("bad: %#v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("query wasn't cancelled")
+	}
+	select {
+	case res := <-doneCh:
+		t.Fatalf("bad: %#v", res)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// The other queries should still be waiting.
+	list = structs.BlockingQueriesReply{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ListBlockingQueries", &listArg, &list); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(list.Queries) != 2 {
+		t.Fatalf("bad: %#v", list.Queries)
+	}
+	for _, q := range list.Queries {
+		if q.ID == target {
+			t.Fatalf("bad: %#v", q)
+		}
+	}
+
+	// It can't be cancelled again.
+	err := msgpackrpc.CallWithCodec(codec, "Operator.CancelBlockingQuery", &cancelArg, &out)
+	if err == nil || !strings.Contains(err.Error(), "Unknown blocking query") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Clean up the rest.
+	for _, q := range list.Queries {
+		cancelArg.ID = q.ID
+		if err := msgpackrpc.CallWithCodec(codec, "Operator.CancelBlockingQuery", &cancelArg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for i := 0; i < len(list.Queries); i++ {
+		res := <-doneCh
+		if res.err != nil || !res.reply.Cancelled {
+			t.Fatalf("bad: %#v", res)
+		}
+	}
+}
+
+func TestOperator_BlockingQueries_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Listing and cancelling should both be denied without a token.
+	listArg := structs.BlockingQueriesRequest{
+		Datacenter: "dc1",
+	}
+	var list structs.BlockingQueriesReply
+	err := msgpackrpc.CallWithCodec(codec, "Operator.ListBlockingQueries", &listArg, &list)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	cancelArg := structs.CancelBlockingQueryRequest{
+		Datacenter: "dc1",
+		ID:         "nope",
+	}
+	var out struct{}
+	err = msgpackrpc.CallWithCodec(codec, "Operator.CancelBlockingQuery", &cancelArg, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The master token gets through.
+	listArg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ListBlockingQueries", &listArg, &list); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cancelArg.Token = "root"
+	err = msgpackrpc.CallWithCodec(codec, "Operator.CancelBlockingQuery", &cancelArg, &out)
+	if err == nil || !strings.Contains(err.Error(), "Unknown blocking query") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestBlockingQueries_Summary(t *testing.T) {
+	cases := []struct {
+		body     interface{}
+		expected string
+	}{
+		{&structs.KeyRequest{Key: "foo/bar"}, "Key=foo/bar"},
+		{&structs.ServiceSpecificRequest{ServiceName: "web", ServiceTag: "v1"}, "ServiceName=web ServiceTag=v1"},
+		{&structs.DCSpecificRequest{Datacenter: "dc1"}, ""},
+		{&structs.ACLSpecificRequest{ACL: "secret"}, ""},
+	}
+	for _, c := range cases {
+		if actual := summarizeBlockingQuery(c.body); actual != c.expected {
+			t.Fatalf("bad: %q != %q", actual, c.expected)
+		}
+	}
+
+	if hashBlockingQueryToken("") != "" {
+		t.Fatalf("bad")
+	}
+	if h := hashBlockingQueryToken("secret"); h == "" || strings.Contains(h, "secret") ||
+		h != hashBlockingQueryToken("secret") {
+		t.Fatalf("bad: %q", h)
+	}
+}
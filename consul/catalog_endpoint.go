@@ -2,9 +2,12 @@ package consul
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/acl"
 	"github.com/hashicorp/consul/consul/state"
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/types"
@@ -35,11 +38,16 @@ func (c *Catalog) Register(args *structs.RegisterRequest, reply *struct{}) error
 	}
 
 	// Fetch the ACL token, if any.
-	acl, err := c.srv.resolveToken(args.Token)
+	acl, err := c.srv.resolveToken("Catalog.Register", args.Token)
 	if err != nil {
 		return err
 	}
 
+	// Tokens bound to a node can only register things for that node.
+	if err := vetNodeIdentity(acl, args.Node, c.srv.config.Datacenter); err != nil {
+		return err
+	}
+
 	// Handle a service registration.
 	if args.Service != nil {
 		// If no service id, but service name, use default
@@ -52,6 +60,15 @@ func (c *Catalog) Register(args *structs.RegisterRequest, reply *struct{}) error
 			return fmt.Errorf("Must provide service name with ID")
 		}
 
+		if err := structs.ValidateMetadata(args.Service.Meta); err != nil {
+			return fmt.Errorf("Invalid service meta: %v", err)
+		}
+
+		// Only known kinds of service can be registered.
+		if !c.srv.isServiceKindAllowed(args.Service.Kind) {
+			return fmt.Errorf("Unknown service kind %q", args.Service.Kind)
+		}
+
 		// Apply the ACL policy if any. The 'consul' service is excluded
 		// since it is managed automatically internally (that behavior
 		// is going away after version 0.8). We check this same policy
@@ -76,6 +93,12 @@ func (c *Catalog) Register(args *structs.RegisterRequest, reply *struct{}) error
 		if check.Node == "" {
 			check.Node = args.Node
 		}
+
+		// The leader registers the probe checks directly through Raft, so
+		// these IDs are off limits here.
+		if IsCriticalProbeCheck(check.CheckID) {
+			return fmt.Errorf("Check ID %q is reserved for critical service probes", check.CheckID)
+		}
 	}
 
 	// Check the complete register request against the given ACL policy.
@@ -90,14 +113,107 @@ func (c *Catalog) Register(args *structs.RegisterRequest, reply *struct{}) error
 		}
 	}
 
-	_, err = c.srv.raftApply(structs.RegisterRequestType, args)
+	// Refuse nodes that were deregistered with a block.
+	if err := c.checkNodeBlock(args.Node, args.ID); err != nil {
+		return err
+	}
+
+	// Make sure the service's name is allowed. Service constraints are
+	// checked by the state store when the registration is applied.
+	if args.Service != nil && args.Service.Service != "" {
+		if err := c.checkServiceNamePolicy(acl, args.Service.Service); err != nil {
+			return err
+		}
+	}
+
+	// A registration wins over a queued deregistration for a reaped node.
+	c.srv.cancelReapedDeregister(args.Node)
+
+	// Agents send the same full registration over and over when they
+	// restart, so skip the apply if it wouldn't change anything.
+	if !c.srv.config.DisableRegisterDedup {
+		skip, err := c.registrationUnchanged(args)
+		if err != nil {
+			return err
+		}
+		if skip {
+			metrics.IncrCounter([]string{"consul", "catalog", "register", "skipped"}, 1)
+			return nil
+		}
+	}
+
+	resp, err := c.srv.raftApply(structs.RegisterRequestType, args)
 	if err != nil {
 		return err
 	}
+	if respErr, ok := resp.(*structs.ServiceConstraintError); ok {
+		return respErr
+	}
 
 	return nil
 }
 
+// registrationUnchanged returns true if the given registration matches what's
+// already in the catalog. The leader's state has every write that's been
+// acknowledged, so once we've made sure we're still the leader, a write that
+// hasn't been applied yet is one that's racing with this registration, and
+// it's fine for the registration to come first.
+func (c *Catalog) registrationUnchanged(args *structs.RegisterRequest) (bool, error) {
+	state := c.srv.fsm.State()
+	unchanged, err := state.RegistrationUnchanged(args)
+	if err != nil || !unchanged {
+		return false, err
+	}
+	if err := c.srv.consistentRead(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// checkNodeBlock returns a NodeBlockedError if there's a block in place that
+// matches the given node name or ID.
+func (c *Catalog) checkNodeBlock(node string, id types.NodeID) error {
+	state := c.srv.fsm.State()
+	blocks, err := state.NodeBlocksMatching(node, id)
+	if err != nil {
+		return fmt.Errorf("Node block lookup failed: %v", err)
+	}
+
+	now := c.srv.clock.Now()
+	for _, block := range blocks {
+		if !block.Expired(now) {
+			metrics.IncrCounter([]string{"consul", "catalog", "node_blocked"}, 1)
+			return &structs.NodeBlockedError{Node: node}
+		}
+	}
+	return nil
+}
+
+// checkServiceNamePolicy returns a ServiceNameNotAllowedError if the service
+// name policy is enabled and doesn't cover the given name. Tokens with
+// operator write access can register any name, since they could change the
+// policy anyway.
+func (c *Catalog) checkServiceNamePolicy(acl acl.ACL, name string) error {
+	if name == ConsulServiceName {
+		return nil
+	}
+	if acl != nil && acl.OperatorWrite() {
+		return nil
+	}
+
+	state := c.srv.fsm.State()
+	_, policy, err := state.ServiceNamePolicy(nil)
+	if err != nil {
+		return fmt.Errorf("Service name policy lookup failed: %v", err)
+	}
+	if policy == nil || policy.Allows(name) {
+		return nil
+	}
+
+	metrics.IncrCounter([]string{"consul", "catalog", "service_name_refused"}, 1)
+	return &structs.ServiceNameNotAllowedError{Service: name}
+}
+
 // Deregister is used to remove a service registration for a given node.
 func (c *Catalog) Deregister(args *structs.DeregisterRequest, reply *struct{}) error {
 	if done, err := c.srv.forward("Catalog.Deregister", args, args, reply); done {
@@ -111,11 +227,27 @@ func (c *Catalog) Deregister(args *structs.DeregisterRequest, reply *struct{}) e
 	}
 
 	// Fetch the ACL token, if any.
-	acl, err := c.srv.resolveToken(args.Token)
+	acl, err := c.srv.resolveToken("Catalog.Deregister", args.Token)
 	if err != nil {
 		return err
 	}
 
+	// Tokens bound to a node can only deregister things for that node.
+	if err := vetNodeIdentity(acl, args.Node, c.srv.config.Datacenter); err != nil {
+		return err
+	}
+
+	// A block can only be put on a whole node, and it needs node write
+	// access whether or not the version 8 ACLs are enforced.
+	if args.Block {
+		if args.ServiceID != "" || args.CheckID != "" {
+			return fmt.Errorf("Can only block a node when deregistering the whole node")
+		}
+		if acl != nil && !acl.NodeWrite(args.Node) {
+			return permissionDeniedErr
+		}
+	}
+
 	// Check the complete deregister request against the given ACL policy.
 	if acl != nil && c.srv.config.ACLEnforceVersion8 {
 		state := c.srv.fsm.State()
@@ -141,12 +273,54 @@ func (c *Catalog) Deregister(args *structs.DeregisterRequest, reply *struct{}) e
 		}
 	}
 
+	// The block goes in first, so the node can't sneak back in between the
+	// two updates.
+	if args.Block {
+		if err := c.blockNode(args); err != nil {
+			return err
+		}
+	}
+
 	if _, err := c.srv.raftApply(structs.DeregisterRequestType, args); err != nil {
 		return err
 	}
 	return nil
 }
 
+// blockNode puts a block on the node being deregistered. The node's ID is
+// blocked along with its name, so the agent can't come back under a new
+// name either.
+func (c *Catalog) blockNode(args *structs.DeregisterRequest) error {
+	state := c.srv.fsm.State()
+	_, node, err := state.GetNode(args.Node)
+	if err != nil {
+		return fmt.Errorf("Node lookup failed: %v", err)
+	}
+
+	req := structs.NodeBlockRequest{
+		Datacenter: args.Datacenter,
+		Op:         structs.NodeBlockSet,
+		Block: structs.NodeBlock{
+			Node: args.Node,
+		},
+	}
+	if node != nil {
+		req.Block.ID = node.ID
+	}
+	if args.BlockFor > 0 {
+		req.Block.Expires = time.Now().Add(args.BlockFor)
+	}
+
+	resp, err := c.srv.raftApply(structs.NodeBlockRequestType, &req)
+	if err != nil {
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
 // ListDatacenters is used to query for the list of known datacenters
 func (c *Catalog) ListDatacenters(args *struct{}, reply *[]string) error {
 	dcs, err := c.srv.router.GetDatacentersByDistance()
@@ -154,7 +328,7 @@ func (c *Catalog) ListDatacenters(args *struct{}, reply *[]string) error {
 		return err
 	}
 
-	*reply = dcs
+	*reply = c.srv.filterHiddenDatacenters(dcs)
 	return nil
 }
 
@@ -181,10 +355,14 @@ func (c *Catalog) ListNodes(args *structs.DCSpecificRequest, reply *structs.Inde
 			}
 
 			reply.Index, reply.Nodes = index, nodes
-			if err := c.srv.filterACL(args.Token, reply); err != nil {
+			if err := c.srv.filterACL("Catalog.ListNodes", args.Token, reply); err != nil {
+				return err
+			}
+			if err := c.srv.sortNodesByDistanceFrom(args.Source, reply.Nodes); err != nil {
 				return err
 			}
-			return c.srv.sortNodesByDistanceFrom(args.Source, reply.Nodes)
+			c.srv.truncateResults(&reply.QueryMeta, &reply.Nodes)
+			return nil
 		})
 }
 
@@ -211,7 +389,66 @@ func (c *Catalog) ListServices(args *structs.DCSpecificRequest, reply *structs.I
 			}
 
 			reply.Index, reply.Services = index, services
-			return c.srv.filterACL(args.Token, reply)
+			if err := c.srv.filterACL("Catalog.ListServices", args.Token, reply); err != nil {
+				return err
+			}
+
+			// Page through what's left after the ACL filtering, so the
+			// pages don't depend on which services are visible.
+			if args.ServiceList {
+				reply.ServiceList, reply.NextAfter = pageServices(reply.Services, args.After, args.Limit)
+				reply.Services = nil
+			}
+			return nil
+		})
+}
+
+// pageServices returns the services sorted by name, starting after the given
+// name and with at most limit entries, or all of them if limit is zero. The
+// name of the last service is also returned if there are more to come.
+func pageServices(services structs.Services, after string, limit int) ([]structs.ServiceListEntry, string) {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		if name > after {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var next string
+	if limit > 0 && len(names) > limit {
+		names = names[:limit]
+		next = names[limit-1]
+	}
+
+	list := make([]structs.ServiceListEntry, 0, len(names))
+	for _, name := range names {
+		list = append(list, structs.ServiceListEntry{
+			Name: name,
+			Tags: services[name],
+		})
+	}
+	return list, next
+}
+
+// ServiceSummaries is used to summarize the instances of each service, with
+// counts by health state, in a single query
+func (c *Catalog) ServiceSummaries(args *structs.DCSpecificRequest, reply *structs.IndexedServiceSummaries) error {
+	if done, err := c.srv.forward("Catalog.ServiceSummaries", args, args, reply); done {
+		return err
+	}
+
+	return c.srv.blockingQuery(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, state *state.StateStore) error {
+			index, summaries, err := state.ServiceSummaries(ws)
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.Services = index, summaries
+			return c.srv.filterACL("Catalog.ServiceSummaries", args.Token, reply)
 		})
 }
 
@@ -222,8 +459,8 @@ func (c *Catalog) ServiceNodes(args *structs.ServiceSpecificRequest, reply *stru
 	}
 
 	// Verify the arguments
-	if args.ServiceName == "" {
-		return fmt.Errorf("Must provide service name")
+	if args.ServiceName == "" && args.ServiceKind == "" {
+		return fmt.Errorf("Must provide service name or kind")
 	}
 
 	err := c.srv.blockingQuery(
@@ -233,9 +470,13 @@ func (c *Catalog) ServiceNodes(args *structs.ServiceSpecificRequest, reply *stru
 			var index uint64
 			var services structs.ServiceNodes
 			var err error
-			if args.TagFilter {
+			switch {
+			case args.ServiceKind != "":
+				index, services, err = state.ServiceNodesByKind(ws, args.ServiceKind)
+				services = serviceKindFilter(args, services)
+			case args.TagFilter:
 				index, services, err = state.ServiceTagNodes(ws, args.ServiceName, args.ServiceTag)
-			} else {
+			default:
 				index, services, err = state.ServiceNodes(ws, args.ServiceName)
 			}
 			if err != nil {
@@ -251,14 +492,27 @@ func (c *Catalog) ServiceNodes(args *structs.ServiceSpecificRequest, reply *stru
 				}
 				reply.ServiceNodes = filtered
 			}
-			if err := c.srv.filterACL(args.Token, reply); err != nil {
+			if err := c.srv.filterACL("Catalog.ServiceNodes", args.Token, reply); err != nil {
+				return err
+			}
+			if err := c.srv.sortNodesByDistanceFrom(args.Source, reply.ServiceNodes); err != nil {
 				return err
 			}
-			return c.srv.sortNodesByDistanceFrom(args.Source, reply.ServiceNodes)
+			c.srv.truncateResults(&reply.QueryMeta, &reply.ServiceNodes)
+			if args.Signed {
+				sig, err := signResult(state, reply.Index, reply.ServiceNodes)
+				if err != nil {
+					return err
+				}
+				reply.Signature = sig
+			}
+			return nil
 		})
 
 	// Provide some metrics
-	if err == nil {
+	if err == nil && args.ServiceKind != "" {
+		metrics.IncrCounter([]string{"consul", "catalog", "service", "query-kind", args.ServiceKind}, 1)
+	} else if err == nil {
 		metrics.IncrCounter([]string{"consul", "catalog", "service", "query", args.ServiceName}, 1)
 		if args.ServiceTag != "" {
 			metrics.IncrCounter([]string{"consul", "catalog", "service", "query-tag", args.ServiceName, args.ServiceTag}, 1)
@@ -270,6 +524,54 @@ func (c *Catalog) ServiceNodes(args *structs.ServiceSpecificRequest, reply *stru
 	return err
 }
 
+// serviceKindFilter applies the service name and tag from a kind lookup to
+// its results.
+func serviceKindFilter(args *structs.ServiceSpecificRequest, services structs.ServiceNodes) structs.ServiceNodes {
+	if args.ServiceName == "" && !args.TagFilter {
+		return services
+	}
+
+	var filtered structs.ServiceNodes
+	for _, service := range services {
+		if args.ServiceName != "" && !strings.EqualFold(service.ServiceName, args.ServiceName) {
+			continue
+		}
+		if args.TagFilter {
+			found := false
+			for _, tag := range service.ServiceTags {
+				if strings.EqualFold(tag, args.ServiceTag) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		filtered = append(filtered, service)
+	}
+	return filtered
+}
+
+// isServiceKindAllowed returns true if services of the given kind can be
+// registered, either because it's built in or because it's configured.
+func (s *Server) isServiceKindAllowed(kind string) bool {
+	if kind == structs.ServiceKindTypical {
+		return true
+	}
+	for _, allowed := range structs.BuiltinServiceKinds {
+		if kind == allowed {
+			return true
+		}
+	}
+	for _, allowed := range s.config.ServiceKinds {
+		if kind == allowed {
+			return true
+		}
+	}
+	return false
+}
+
 // NodeServices returns all the services registered as part of a node
 func (c *Catalog) NodeServices(args *structs.NodeSpecificRequest, reply *structs.IndexedNodeServices) error {
 	if done, err := c.srv.forward("Catalog.NodeServices", args, args, reply); done {
@@ -291,6 +593,6 @@ func (c *Catalog) NodeServices(args *structs.NodeSpecificRequest, reply *structs
 			}
 
 			reply.Index, reply.NodeServices = index, services
-			return c.srv.filterACL(args.Token, reply)
+			return c.srv.filterACL("Catalog.NodeServices", args.Token, reply)
 		})
 }
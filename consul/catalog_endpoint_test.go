@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"net/rpc"
 	"os"
+	"reflect"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -77,6 +80,418 @@ func TestCatalog_Register_NodeID(t *testing.T) {
 	}
 }
 
+func TestCatalog_Register_Dedup(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		dir1, s1 := testServerWithConfig(t, func(c *Config) {
+			c.DisableRegisterDedup = disabled
+		})
+		defer os.RemoveAll(dir1)
+		defer s1.Shutdown()
+		codec := rpcClient(t, s1)
+		defer codec.Close()
+
+		testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+		// Count the applies for our node.
+		var applies int64
+		s1.raftApplyHook = func(t structs.MessageType, msg interface{}) {
+			if req, ok := msg.(*structs.RegisterRequest); ok && req.Node == "foo" {
+				atomic.AddInt64(&applies, 1)
+			}
+		}
+
+		makeArg := func() *structs.RegisterRequest {
+			return &structs.RegisterRequest{
+				Datacenter:      "dc1",
+				Node:            "foo",
+				Address:         "127.0.0.1",
+				TaggedAddresses: map[string]string{"wan": "127.0.0.2"},
+				NodeMeta:        map[string]string{"rack": "a"},
+				Service: &structs.NodeService{
+					Service: "db",
+					Tags:    []string{"master"},
+					Port:    8000,
+				},
+				Check: &structs.HealthCheck{
+					Name:      "db-check",
+					ServiceID: "db",
+					Status:    structs.HealthPassing,
+					Output:    "ok",
+				},
+			}
+		}
+		register := func(arg *structs.RegisterRequest, expected int64) {
+			var out struct{}
+			if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", arg, &out); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if n := atomic.LoadInt64(&applies); n != expected {
+				t.Fatalf("bad: %d", n)
+			}
+		}
+
+		// The same registration twice should only be applied once, unless
+		// the check is turned off.
+		register(makeArg(), 1)
+		if disabled {
+			register(makeArg(), 2)
+			continue
+		}
+		register(makeArg(), 1)
+
+		// Changing any part of it should be applied.
+		arg := makeArg()
+		arg.TaggedAddresses["wan"] = "127.0.0.3"
+		register(arg, 2)
+
+		arg = makeArg()
+		arg.TaggedAddresses["wan"] = "127.0.0.3"
+		arg.NodeMeta["rack"] = "b"
+		register(arg, 3)
+
+		arg = makeArg()
+		arg.TaggedAddresses["wan"] = "127.0.0.3"
+		arg.NodeMeta["rack"] = "b"
+		arg.Check.Output = "still ok"
+		register(arg, 4)
+		register(arg, 4)
+	}
+}
+
+func TestCatalog_Register_Replace(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register the old instance.
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "web",
+			Service: "web",
+			Port:    8000,
+		},
+		Check: &structs.HealthCheck{
+			CheckID:   "web-old",
+			ServiceID: "web",
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	args := structs.ServiceSpecificRequest{
+		Datacenter:  "dc1",
+		ServiceName: "web",
+	}
+	var nodes structs.IndexedCheckServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &args, &nodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodes.Nodes) != 1 {
+		t.Fatalf("bad: %v", nodes.Nodes)
+	}
+
+	// Setup a blocking query
+	args.MinQueryIndex = nodes.Index
+	args.MaxQueryTime = time.Second
+
+	// Async replace the instance with one on a new port.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       "foo",
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				ID:      "web",
+				Service: "web",
+				Port:    8001,
+			},
+			Check: &structs.HealthCheck{
+				CheckID:   "web-new",
+				ServiceID: "web",
+			},
+			Replace: true,
+		}
+		var out struct{}
+		if err := s1.RPC("Catalog.Register", &arg, &out); err != nil {
+			t.Errorf("err: %v", err)
+		}
+	}()
+
+	// The watcher should wake up once, and see just the new instance.
+	nodes = structs.IndexedCheckServiceNodes{}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &args, &nodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if nodes.Index <= args.MinQueryIndex || len(nodes.Nodes) != 1 {
+		t.Fatalf("bad: %d %v", nodes.Index, nodes.Nodes)
+	}
+	node := nodes.Nodes[0]
+	if node.Service.Port != 8001 || len(node.Checks) != 1 || node.Checks[0].CheckID != "web-new" {
+		t.Fatalf("bad: %#v", node)
+	}
+
+	// Nothing else should happen after that.
+	args.MinQueryIndex = nodes.Index
+	args.MaxQueryTime = 200 * time.Millisecond
+	start := time.Now()
+	nodes = structs.IndexedCheckServiceNodes{}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &args, &nodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("should block (returned in %s)", elapsed)
+	}
+	if nodes.Index != args.MinQueryIndex {
+		t.Fatalf("bad: %d", nodes.Index)
+	}
+}
+
+func TestCatalog_Register_ServiceConstraint(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Require all the web instances to use the same protocol.
+	constraint := structs.ServiceConstraintRequest{
+		Datacenter: "dc1",
+		Op:         structs.ServiceConstraintSet,
+		Constraint: structs.ServiceConstraint{
+			Service:  "web",
+			MetaKeys: []string{"protocol"},
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceConstraintApply", &constraint, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	register := func(node, protocol string) error {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				ID:      "web",
+				Service: "web",
+				Meta:    map[string]string{"protocol": protocol},
+			},
+		}
+		var out struct{}
+		return msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+	}
+
+	// The first instance sets the value.
+	if err := register("foo", "http"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A conflicting instance should be rejected and name what it
+	// conflicts with.
+	err := register("baz", "grpc")
+	if !structs.HasErrorCode(err, structs.ErrCodeServiceConstraint) {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.Contains(err.Error(), `node "foo"`) || !strings.Contains(err.Error(), `"http"`) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A matching instance can join.
+	if err := register("bar", "http"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The rejected instance shouldn't have been registered.
+	state := s1.fsm.State()
+	_, nodes, err := state.ServiceNodes(nil, "web")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("bad: %#v", nodes)
+	}
+
+	// An instance can't change its own value while others disagree, but
+	// it's ignored when it's the only one.
+	if err := register("foo", "grpc"); !structs.HasErrorCode(err, structs.ErrCodeServiceConstraint) {
+		t.Fatalf("err: %v", err)
+	}
+	arg := structs.DeregisterRequest{
+		Datacenter: "dc1",
+		Node:       "bar",
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Deregister", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := register("foo", "grpc"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Meta has to be valid.
+	bad := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "db",
+			Meta:    map[string]string{"consul-version": "1"},
+		},
+	}
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Register", &bad, &out)
+	if err == nil || !strings.Contains(err.Error(), "Invalid service meta") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCatalog_Register_ServiceNamePolicy(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	register := func(service string) error {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       "foo",
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				Service: service,
+			},
+		}
+		var out struct{}
+		return msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+	}
+
+	// Register a service before the policy is enabled.
+	if err := register("db"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Only allow approved names.
+	policy := structs.ServiceNamePolicyRequest{
+		Datacenter: "dc1",
+		Op:         structs.ServiceNamePolicySet,
+		Policy: structs.ServiceNamePolicy{
+			Enabled:  true,
+			Names:    []string{"web"},
+			Prefixes: []string{"batch-"},
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceNamePolicyApply", &policy, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A new name that isn't on the list should be rejected.
+	err := register("redis")
+	if !structs.HasErrorCode(err, structs.ErrCodeServiceNameNotAllowed) || !strings.Contains(err.Error(), `"redis"`) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Listed names, and the one that was already there, should be fine.
+	for _, service := range []string{"web", "batch-report", "db"} {
+		if err := register(service); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Once the policy's turned off anything goes again.
+	policy.Op = structs.ServiceNamePolicyDelete
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceNamePolicyApply", &policy, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := register("redis"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCatalog_Register_ServiceNamePolicy_Override(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	policy := structs.ServiceNamePolicyRequest{
+		Datacenter: "dc1",
+		Op:         structs.ServiceNamePolicySet,
+		Policy: structs.ServiceNamePolicy{
+			Enabled: true,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceNamePolicyApply", &policy, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	register := func(token string) error {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       "foo",
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				Service: "web",
+			},
+			WriteRequest: structs.WriteRequest{Token: token},
+		}
+		var out struct{}
+		return msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+	}
+
+	// A token that can only write the service gets stopped by the policy.
+	token := makeTestToken(t, codec, `
+service "web" {
+	policy = "write"
+}
+node "foo" {
+	policy = "write"
+}
+`, 0)
+	if err := register(token); !structs.HasErrorCode(err, structs.ErrCodeServiceNameNotAllowed) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// One that can change the policy can get around it.
+	token = makeTestToken(t, codec, `
+service "web" {
+	policy = "write"
+}
+node "foo" {
+	policy = "write"
+}
+operator = "write"
+`, 0)
+	if err := register(token); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := register("root"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestCatalog_Register_ACLDeny(t *testing.T) {
 	dir1, s1 := testServerWithConfig(t, func(c *Config) {
 		c.ACLDatacenter = "dc1"
@@ -439,60 +854,314 @@ service "service" {
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	err = msgpackrpc.CallWithCodec(codec, "Catalog.Deregister",
-		&structs.DeregisterRequest{
-			Datacenter: "dc1",
-			Node:       "node",
-			CheckID:    "node-check",
-			WriteRequest: structs.WriteRequest{
-				Token: id,
-			}}, &out)
-	if err != nil {
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Deregister",
+		&structs.DeregisterRequest{
+			Datacenter: "dc1",
+			Node:       "node",
+			CheckID:    "node-check",
+			WriteRequest: structs.WriteRequest{
+				Token: id,
+			}}, &out)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Deregister",
+		&structs.DeregisterRequest{
+			Datacenter: "dc1",
+			Node:       "node",
+			ServiceID:  "service",
+			WriteRequest: structs.WriteRequest{
+				Token: id,
+			}}, &out)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Deregister",
+		&structs.DeregisterRequest{
+			Datacenter: "dc1",
+			Node:       "node",
+			WriteRequest: structs.WriteRequest{
+				Token: id,
+			}}, &out)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Try a few error cases.
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Deregister",
+		&structs.DeregisterRequest{
+			Datacenter: "dc1",
+			Node:       "node",
+			ServiceID:  "nope",
+			WriteRequest: structs.WriteRequest{
+				Token: id,
+			}}, &out)
+	if err == nil || !strings.Contains(err.Error(), "Unknown service") {
+		t.Fatalf("err: %v", err)
+	}
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Deregister",
+		&structs.DeregisterRequest{
+			Datacenter: "dc1",
+			Node:       "node",
+			CheckID:    "nope",
+			WriteRequest: structs.WriteRequest{
+				Token: id,
+			}}, &out)
+	if err == nil || !strings.Contains(err.Error(), "Unknown check") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCatalog_Deregister_Block(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	id := types.NodeID("40e4a748-2192-161a-0510-9bf59fe950b5")
+	register := func(node string) error {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			ID:         id,
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				Service: "web",
+			},
+		}
+		var out struct{}
+		return msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+	}
+	if err := register("foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Blocks only apply to whole nodes.
+	arg := structs.DeregisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		ServiceID:  "web",
+		Block:      true,
+	}
+	var out struct{}
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.Deregister", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "whole node") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Deregister the node with a block.
+	arg.ServiceID = ""
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Deregister", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	state := s1.fsm.State()
+	_, node, err := state.GetNode("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node != nil {
+		t.Fatalf("bad: %#v", node)
+	}
+
+	// The agent coming back should be turned away, even under a new name.
+	for _, name := range []string{"foo", "bar"} {
+		err := register(name)
+		if !structs.HasErrorCode(err, structs.ErrCodeNodeBlocked) || !strings.Contains(err.Error(), name) {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The block should show up for operators.
+	list := structs.DCSpecificRequest{Datacenter: "dc1"}
+	var blocks structs.IndexedNodeBlocks
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.NodeBlockList", &list, &blocks); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(blocks.Blocks) != 1 || blocks.Blocks[0].Node != "foo" ||
+		blocks.Blocks[0].ID != id || !blocks.Blocks[0].Expires.IsZero() {
+		t.Fatalf("bad: %#v", blocks.Blocks)
+	}
+
+	// Once it's cleared the node can register again.
+	req := structs.NodeBlockRequest{
+		Datacenter: "dc1",
+		Op:         structs.NodeBlockClear,
+		Block: structs.NodeBlock{
+			Node: "foo",
+		},
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.NodeBlockApply", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := register("foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCatalog_Deregister_BlockExpires(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	register := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &register, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	arg := structs.DeregisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Block:      true,
+		BlockFor:   500 * time.Millisecond,
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Deregister", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &register, &out)
+	if !structs.HasErrorCode(err, structs.ErrCodeNodeBlocked) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The node can register again once the block runs out, and the leader
+	// should clean up the block after that.
+	if err := testutil.WaitForResult(func() (bool, error) {
+		err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &register, &out)
+		return err == nil, err
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	state := s1.fsm.State()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		_, blocks, err := state.NodeBlockList(nil)
+		return len(blocks) == 0, err
+	}); err != nil {
+		t.Fatalf("block not reaped: %v", err)
+	}
+}
+
+func TestCatalog_NodeIdentity(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register a sibling node with the master token.
+	argR := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "web-2",
+		Address:    "127.0.0.2",
+		Service: &structs.NodeService{
+			Service: "web",
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var outR struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &argR, &outR); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Bad identities should be rejected.
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name: "User token",
+			Type: structs.ACLTypeClient,
+			Rules: `
+node "web-" {
+	policy = "write"
+}
+service "web" {
+	policy = "write"
+}
+`,
+			NodeIdentity: "web-1",
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &id)
+	if err == nil || !strings.Contains(err.Error(), "Invalid node identity") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Make a token bound to web-1, whose rules also cover web-2.
+	arg.ACL.NodeIdentity = "web-1/dc1"
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The binding should show up when reading the token.
+	getR := structs.ACLSpecificRequest{
+		Datacenter: "dc1",
+		ACL:        id,
+	}
+	var acls structs.IndexedACLs
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Get", &getR, &acls); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(acls.ACLs) != 1 || acls.ACLs[0].NodeIdentity != "web-1/dc1" {
+		t.Fatalf("bad: %#v", acls.ACLs)
+	}
+
+	// The token can manage its own node.
+	argR.Node = "web-1"
+	argR.Address = "127.0.0.1"
+	argR.Token = id
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &argR, &outR); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	argD := structs.DeregisterRequest{
+		Datacenter:   "dc1",
+		Node:         "web-1",
+		ServiceID:    "web",
+		WriteRequest: structs.WriteRequest{Token: id},
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Deregister", &argD, &outR); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	err = msgpackrpc.CallWithCodec(codec, "Catalog.Deregister",
-		&structs.DeregisterRequest{
-			Datacenter: "dc1",
-			Node:       "node",
-			ServiceID:  "service",
-			WriteRequest: structs.WriteRequest{
-				Token: id,
-			}}, &out)
-	if err != nil {
+
+	// But not its sibling, even though the rules allow it.
+	argR.Node = "web-2"
+	argR.Address = "127.0.0.2"
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Register", &argR, &outR)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
 		t.Fatalf("err: %v", err)
 	}
-	err = msgpackrpc.CallWithCodec(codec, "Catalog.Deregister",
-		&structs.DeregisterRequest{
-			Datacenter: "dc1",
-			Node:       "node",
-			WriteRequest: structs.WriteRequest{
-				Token: id,
-			}}, &out)
-	if err != nil {
+	argD.Node = "web-2"
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Deregister", &argD, &outR)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
 		t.Fatalf("err: %v", err)
 	}
 
-	// Try a few error cases.
-	err = msgpackrpc.CallWithCodec(codec, "Catalog.Deregister",
-		&structs.DeregisterRequest{
-			Datacenter: "dc1",
-			Node:       "node",
-			ServiceID:  "nope",
-			WriteRequest: structs.WriteRequest{
-				Token: id,
-			}}, &out)
-	if err == nil || !strings.Contains(err.Error(), "Unknown service") {
+	// Binding it to the same node in another datacenter shuts it out here.
+	arg.ACL.ID = id
+	arg.ACL.NodeIdentity = "web-1/dc2"
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &id); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	err = msgpackrpc.CallWithCodec(codec, "Catalog.Deregister",
-		&structs.DeregisterRequest{
-			Datacenter: "dc1",
-			Node:       "node",
-			CheckID:    "nope",
-			WriteRequest: structs.WriteRequest{
-				Token: id,
-			}}, &out)
-	if err == nil || !strings.Contains(err.Error(), "Unknown check") {
+	argD.Node = "web-1"
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Deregister", &argD, &outR)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
 		t.Fatalf("err: %v", err)
 	}
 }
@@ -1209,6 +1878,112 @@ func TestCatalog_ListServices_Blocking(t *testing.T) {
 	}
 }
 
+func TestCatalog_ListServices_Paginated(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register a few hundred services, plus the consul service that's
+	// already there.
+	if err := s1.fsm.State().EnsureNode(1, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	const numServices = 300
+	for i := 0; i < numServices; i++ {
+		name := fmt.Sprintf("service-%d", i)
+		if err := s1.fsm.State().EnsureService(uint64(i+2), "foo", &structs.NodeService{ID: name, Service: name, Tags: []string{name}}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Page through them all.
+	args := structs.DCSpecificRequest{
+		Datacenter:  "dc1",
+		ServiceList: true,
+		Limit:       47,
+	}
+	var names []string
+	seen := make(map[string]bool)
+	var pages int
+	var index uint64
+	for {
+		var out structs.IndexedServices
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListServices", &args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(out.Services) != 0 || len(out.ServiceList) > args.Limit {
+			t.Fatalf("bad: %#v", out)
+		}
+		for _, entry := range out.ServiceList {
+			if seen[entry.Name] {
+				t.Fatalf("duplicate: %s", entry.Name)
+			}
+			seen[entry.Name] = true
+			if entry.Name != "consul" && !reflect.DeepEqual(entry.Tags, []string{entry.Name}) {
+				t.Fatalf("bad: %#v", entry)
+			}
+			names = append(names, entry.Name)
+		}
+		index = out.Index
+		pages++
+		if out.NextAfter == "" {
+			break
+		}
+		if out.NextAfter != out.ServiceList[len(out.ServiceList)-1].Name {
+			t.Fatalf("bad: %#v", out)
+		}
+		args.After = out.NextAfter
+	}
+	if len(names) != numServices+1 || !sort.StringsAreSorted(names) {
+		t.Fatalf("bad: %v", names)
+	}
+	if pages != (numServices+1+args.Limit-1)/args.Limit {
+		t.Fatalf("bad: %d", pages)
+	}
+
+	// Block on the first page. A change to a service on another page
+	// should still wake it up, since it's the table index that counts.
+	args.After = ""
+	args.MinQueryIndex = index
+	args.MaxQueryTime = time.Second
+	start := time.Now()
+	errCh := make(chan error, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		errCh <- s1.fsm.State().EnsureService(index+1, "foo", &structs.NodeService{ID: "zzz", Service: "zzz"})
+	}()
+	var out structs.IndexedServices
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListServices", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < 100*time.Millisecond || elapsed > 900*time.Millisecond {
+		t.Fatalf("bad: %v", elapsed)
+	}
+	if out.Index != index+1 || len(out.ServiceList) != args.Limit || out.ServiceList[0].Name != "consul" {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// The old shape is still there without the toggle.
+	args = structs.DCSpecificRequest{
+		Datacenter: "dc1",
+		Limit:      1,
+	}
+	out = structs.IndexedServices{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListServices", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Services) != numServices+2 || len(out.ServiceList) != 0 || out.NextAfter != "" {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
 func TestCatalog_ListServices_Timeout(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -1287,6 +2062,101 @@ func TestCatalog_ListServices_Stale(t *testing.T) {
 	}
 }
 
+func TestCatalog_ServiceSummaries(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register web on three nodes in varied health, and db on one.
+	state := s1.fsm.State()
+	for i, node := range []string{"foo", "bar", "baz"} {
+		if err := state.EnsureNode(uint64(100+i), &structs.Node{Node: node, Address: "127.0.0.1"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := state.EnsureService(uint64(110+i), node, &structs.NodeService{ID: "web", Service: "web", Tags: []string{node}}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := state.EnsureService(120, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"primary"}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	checks := []*structs.HealthCheck{
+		&structs.HealthCheck{Node: "foo", CheckID: "web", ServiceID: "web", Status: structs.HealthPassing},
+		&structs.HealthCheck{Node: "bar", CheckID: "web", ServiceID: "web", Status: structs.HealthCritical},
+		&structs.HealthCheck{Node: "baz", CheckID: "node", Status: structs.HealthWarning},
+		&structs.HealthCheck{Node: "foo", CheckID: "db", ServiceID: "db", Status: structs.HealthWarning},
+	}
+	for i, check := range checks {
+		if err := state.EnsureCheck(uint64(130+i), check); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	args := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var out structs.IndexedServiceSummaries
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceSummaries", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Services) != 3 {
+		t.Fatalf("bad: %#v", out.Services)
+	}
+	for _, sum := range out.Services {
+		var expected structs.ServiceSummary
+		switch sum.Name {
+		case "consul":
+			continue
+		case "db":
+			expected = structs.ServiceSummary{Name: "db", Tags: []string{"primary"}, Instances: 1, Warning: 1}
+		case "web":
+			expected = structs.ServiceSummary{Name: "web", Tags: []string{"bar", "baz", "foo"}, Instances: 3, Passing: 1, Warning: 1, Critical: 1}
+		default:
+			t.Fatalf("bad: %#v", sum)
+		}
+		if !reflect.DeepEqual(*sum, expected) {
+			t.Fatalf("bad: %#v", sum)
+		}
+	}
+
+	// Setup a blocking query
+	args.MinQueryIndex = out.Index
+	args.MaxQueryTime = time.Second
+
+	// Async add another instance of web
+	idx := out.Index
+	start := time.Now()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := state.EnsureService(idx+1, "baz", &structs.NodeService{ID: "web2", Service: "web"}); err != nil {
+			t.Errorf("err: %v", err)
+		}
+	}()
+
+	// Re-run the query
+	out = structs.IndexedServiceSummaries{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceSummaries", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Should block at least 100ms
+	if time.Now().Sub(start) < 100*time.Millisecond {
+		t.Fatalf("too fast")
+	}
+	if out.Index != idx+1 {
+		t.Fatalf("bad: %v", out)
+	}
+	for _, sum := range out.Services {
+		if sum.Name == "web" && (sum.Instances != 4 || sum.Warning != 2) {
+			t.Fatalf("bad: %#v", sum)
+		}
+	}
+}
+
 func TestCatalog_ListServiceNodes(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -1336,6 +2206,134 @@ func TestCatalog_ListServiceNodes(t *testing.T) {
 	}
 }
 
+func TestCatalog_ListServiceNodes_Kind(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ServiceKinds = []string{"gateway"}
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	register := func(node, service, kind string, tags ...string) error {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				Service: service,
+				Tags:    tags,
+				Kind:    kind,
+			},
+		}
+		var out struct{}
+		return msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+	}
+
+	// Unknown kinds are turned away, but built-in and configured ones are
+	// fine, as is leaving the kind out like older clients do.
+	if err := register("foo", "web", "nope"); err == nil || !strings.Contains(err.Error(), "Unknown service kind") {
+		t.Fatalf("err: %v", err)
+	}
+	if err := register("foo", "web-lb", structs.ServiceKindLoadBalancer, "public"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := register("bar", "api-lb", structs.ServiceKindLoadBalancer); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := register("foo", "edge", "gateway"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := register("foo", "web", ""); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	query := func(args structs.ServiceSpecificRequest) []string {
+		args.Datacenter = "dc1"
+		var out structs.IndexedServiceNodes
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var names []string
+		for _, sn := range out.ServiceNodes {
+			names = append(names, sn.Node+"/"+sn.ServiceName+"/"+sn.ServiceKind)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	// Look up everything of a kind, and narrow it down by name and tag.
+	cases := []struct {
+		args     structs.ServiceSpecificRequest
+		expected []string
+	}{
+		{
+			structs.ServiceSpecificRequest{ServiceKind: structs.ServiceKindLoadBalancer},
+			[]string{"bar/api-lb/load-balancer", "foo/web-lb/load-balancer"},
+		},
+		{
+			structs.ServiceSpecificRequest{ServiceKind: "gateway"},
+			[]string{"foo/edge/gateway"},
+		},
+		{
+			structs.ServiceSpecificRequest{ServiceKind: structs.ServiceKindMeshProxy},
+			nil,
+		},
+		{
+			structs.ServiceSpecificRequest{ServiceKind: structs.ServiceKindLoadBalancer, ServiceName: "api-lb"},
+			[]string{"bar/api-lb/load-balancer"},
+		},
+		{
+			structs.ServiceSpecificRequest{ServiceKind: structs.ServiceKindLoadBalancer, TagFilter: true, ServiceTag: "public"},
+			[]string{"foo/web-lb/load-balancer"},
+		},
+
+		// Lookups by name are the same as ever.
+		{
+			structs.ServiceSpecificRequest{ServiceName: "web"},
+			[]string{"foo/web/"},
+		},
+	}
+	for _, tc := range cases {
+		if actual := query(tc.args); !reflect.DeepEqual(actual, tc.expected) {
+			t.Fatalf("bad: %#v %v", tc.args, actual)
+		}
+	}
+
+	// A name or a kind is needed.
+	args := structs.ServiceSpecificRequest{Datacenter: "dc1"}
+	var out structs.IndexedServiceNodes
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &out)
+	if err == nil || !strings.Contains(err.Error(), "Must provide service name or kind") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The summary should break the instances down by kind.
+	var summaries structs.IndexedServiceSummaries
+	dc := structs.DCSpecificRequest{Datacenter: "dc1"}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceSummaries", &dc, &summaries); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, sum := range summaries.Services {
+		switch sum.Name {
+		case "web-lb", "api-lb":
+			if !reflect.DeepEqual(sum.Kinds, map[string]int{structs.ServiceKindLoadBalancer: 1}) {
+				t.Fatalf("bad: %#v", sum)
+			}
+		case "edge":
+			if !reflect.DeepEqual(sum.Kinds, map[string]int{"gateway": 1}) {
+				t.Fatalf("bad: %#v", sum)
+			}
+		default:
+			if sum.Kinds != nil {
+				t.Fatalf("bad: %#v", sum)
+			}
+		}
+	}
+}
+
 func TestCatalog_ListServiceNodes_NodeMetaFilter(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -1712,6 +2710,47 @@ func TestCatalog_ListServices_FilterACL(t *testing.T) {
 	if _, ok := reply.Services["bar"]; ok {
 		t.Fatalf("bad: %#v", reply.Services)
 	}
+
+	// The list is filtered the same way.
+	opt.ServiceList = true
+	reply = structs.IndexedServices{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListServices", &opt, &reply); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, entry := range reply.ServiceList {
+		if entry.Name == "bar" {
+			t.Fatalf("bad: %#v", reply.ServiceList)
+		}
+	}
+	if len(reply.ServiceList) == 0 {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestCatalog_ServiceSummaries_FilterACL(t *testing.T) {
+	dir, token, srv, codec := testACLFilterServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer codec.Close()
+
+	opt := structs.DCSpecificRequest{
+		Datacenter:   "dc1",
+		QueryOptions: structs.QueryOptions{Token: token},
+	}
+	reply := structs.IndexedServiceSummaries{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceSummaries", &opt, &reply); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var names []string
+	for _, sum := range reply.Services {
+		names = append(names, sum.Name)
+		if sum.Name == "foo" && sum.Instances != 1 {
+			t.Fatalf("bad: %#v", sum)
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"consul", "foo"}) {
+		t.Fatalf("bad: %#v", names)
+	}
 }
 
 func TestCatalog_ServiceNodes_FilterACL(t *testing.T) {
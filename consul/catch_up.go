@@ -0,0 +1,213 @@
+package consul
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/lib"
+)
+
+// catchUpInterval is how often a server that's catching up checks how far
+// behind the leader it is.
+const catchUpInterval = time.Second
+
+// catchUpTracker keeps track of a server replaying the log after it starts
+// up. Until it's caught up, its data could be very old, so it doesn't serve
+// stale reads. The target is the leader's last index when the server first
+// hears from it, so a busy leader doesn't keep moving the goalposts.
+type catchUpTracker struct {
+	clock     lib.Clock
+	threshold uint64
+
+	// active is true until the server has caught up. It never goes back
+	// to true once it's cleared.
+	active bool
+
+	// target is the leader's last index as of first contact, or 0 if
+	// we haven't heard from the leader yet.
+	target uint64
+
+	// applied is the applied index as of the last observation.
+	applied uint64
+
+	// start and startApplied are when the target was learned and the
+	// applied index at that point, which give the replay rate.
+	start        time.Time
+	startApplied uint64
+
+	lock sync.RWMutex
+}
+
+// newCatchUpTracker returns a catchUpTracker that considers the server
+// caught up once it's within threshold entries of the target.
+func newCatchUpTracker(clock lib.Clock, threshold uint64) *catchUpTracker {
+	return &catchUpTracker{
+		clock:     clock,
+		threshold: threshold,
+		active:    true,
+	}
+}
+
+// catchingUp returns true if the server hasn't caught up to the target yet.
+// Until the target is learned there's nothing to measure against, so this
+// returns false.
+func (c *catchUpTracker) catchingUp() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.active && c.target != 0
+}
+
+// hasTarget returns true if the target has been learned.
+func (c *catchUpTracker) hasTarget() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.target != 0
+}
+
+// setTarget records the leader's last index, along with where the server's
+// at, so progress can be measured from here.
+func (c *catchUpTracker) setTarget(target, applied uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.target = target
+	c.applied = applied
+	c.start = c.clock.Now()
+	c.startApplied = applied
+}
+
+// observe records the applied index and returns how many entries are left
+// to go, and whether the server just caught up. This needs a target.
+func (c *catchUpTracker) observe(applied uint64) (remaining uint64, caughtUp bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.applied = applied
+	remaining = c.remainingLocked()
+	if c.active && remaining <= c.threshold {
+		c.active = false
+		return remaining, true
+	}
+	return remaining, false
+}
+
+// finish clears the catching up state without a target, which is used once
+// the server is the leader, since it's as caught up as anyone.
+func (c *catchUpTracker) finish() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.active {
+		return false
+	}
+	c.active = false
+	return true
+}
+
+// remainingLocked returns how many entries are left to go. The lock must be
+// held.
+func (c *catchUpTracker) remainingLocked() uint64 {
+	if c.applied >= c.target {
+		return 0
+	}
+	return c.target - c.applied
+}
+
+// etaLocked estimates how long it'll take to get to the target, based on the
+// replay rate since it was learned. This returns false if there hasn't been
+// any progress to go on yet. The lock must be held.
+func (c *catchUpTracker) etaLocked() (time.Duration, bool) {
+	elapsed := c.clock.Now().Sub(c.start)
+	done := c.applied - c.startApplied
+	if c.applied < c.startApplied || done == 0 || elapsed <= 0 {
+		return 0, false
+	}
+	perEntry := elapsed / time.Duration(done)
+	return perEntry * time.Duration(c.remainingLocked()), true
+}
+
+// stats returns the catching up state for Stats.
+func (c *catchUpTracker) stats() map[string]string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	stats := map[string]string{
+		"catching_up":   fmt.Sprintf("%v", c.active),
+		"applied_index": strconv.FormatUint(c.applied, 10),
+		"target_index":  strconv.FormatUint(c.target, 10),
+		"eta":           "unknown",
+	}
+	if !c.active {
+		stats["eta"] = "0s"
+	} else if eta, ok := c.etaLocked(); ok {
+		stats["eta"] = eta.String()
+	}
+	return stats
+}
+
+// catchingUp returns true if the server is still replaying the log after
+// starting up, and shouldn't serve stale reads. This only applies while
+// there's a leader, since without one the server can't make progress, and
+// stale reads are all there is during an outage.
+func (s *Server) catchingUp() bool {
+	return s.catchUp != nil && s.catchUp.catchingUp() && s.raft.Leader() != ""
+}
+
+// catchUpLoop watches the server replay the log after starting up until it's
+// caught up or the server shuts down.
+func (s *Server) catchUpLoop() {
+	ticker := s.clock.NewTicker(catchUpInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdownCh:
+			return
+		case <-ticker.C():
+			done, err := s.checkCatchUp()
+			if err != nil {
+				s.logger.Printf("[WARN] consul: error checking if caught up with the leader: %v", err)
+			}
+			if done {
+				return
+			}
+		}
+	}
+}
+
+// checkCatchUp learns the leader's last index on first contact, and then
+// checks how far behind it the server is. This returns true once the server
+// has caught up.
+func (s *Server) checkCatchUp() (bool, error) {
+	isLeader, leader := s.getLeader()
+	if isLeader {
+		if s.catchUp.finish() {
+			s.logger.Printf("[INFO] consul: Server is the leader, serving stale reads")
+			metrics.SetGauge([]string{"consul", "raft", "catch_up", "remaining"}, 0)
+		}
+		return true, nil
+	}
+
+	if !s.catchUp.hasTarget() {
+		if leader == nil {
+			return false, nil
+		}
+		var args struct{}
+		var reply structs.ServerStats
+		if err := s.connPool.RPC(s.config.Datacenter, leader.Addr, leader.Version, "Status.RaftStats", &args, &reply); err != nil {
+			return false, fmt.Errorf("failed to get the leader's last index: %v", err)
+		}
+		s.catchUp.setTarget(reply.LastIndex, s.raft.AppliedIndex())
+		s.logger.Printf("[INFO] consul: Catching up with the leader, applied index %d, target index %d",
+			s.raft.AppliedIndex(), reply.LastIndex)
+	}
+
+	remaining, caughtUp := s.catchUp.observe(s.raft.AppliedIndex())
+	metrics.SetGauge([]string{"consul", "raft", "catch_up", "remaining"}, float32(remaining))
+	if caughtUp {
+		s.logger.Printf("[INFO] consul: Caught up with the leader, serving stale reads")
+	}
+	return caughtUp, nil
+}
@@ -0,0 +1,227 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/lib"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestCatchUpTracker(t *testing.T) {
+	clock := lib.NewFakeClock(time.Unix(1000, 0))
+	c := newCatchUpTracker(clock, 100)
+
+	// It starts out catching up, but with no target it isn't enforced.
+	if c.catchingUp() || c.hasTarget() {
+		t.Fatalf("bad: %#v", c)
+	}
+	if stats := c.stats(); stats["catching_up"] != "true" || stats["eta"] != "unknown" {
+		t.Fatalf("bad: %v", stats)
+	}
+
+	// Learn the target and make some progress.
+	c.setTarget(10000, 1000)
+	if !c.catchingUp() {
+		t.Fatalf("should be catching up")
+	}
+	clock.Advance(time.Second)
+	remaining, caughtUp := c.observe(2000)
+	if remaining != 8000 || caughtUp || !c.catchingUp() {
+		t.Fatalf("bad: %d %v", remaining, caughtUp)
+	}
+
+	// 1000 entries a second with 8000 to go should be 8 seconds out.
+	stats := c.stats()
+	if stats["applied_index"] != "2000" || stats["target_index"] != "10000" || stats["eta"] != "8s" {
+		t.Fatalf("bad: %v", stats)
+	}
+
+	// Getting within the threshold should flip it, once.
+	remaining, caughtUp = c.observe(9950)
+	if remaining != 50 || !caughtUp || c.catchingUp() {
+		t.Fatalf("bad: %d %v", remaining, caughtUp)
+	}
+	if _, caughtUp = c.observe(10000); caughtUp {
+		t.Fatalf("should only flip once")
+	}
+	if stats := c.stats(); stats["catching_up"] != "false" || stats["eta"] != "0s" {
+		t.Fatalf("bad: %v", stats)
+	}
+	if c.finish() {
+		t.Fatalf("should already be finished")
+	}
+}
+
+func TestServer_CatchUp(t *testing.T) {
+	// Keep the servers from taking snapshots so the follower has to replay
+	// the whole log when it comes back.
+	noSnapshots := func(c *Config) {
+		c.RaftConfig.SnapshotThreshold = 1 << 20
+		c.RaftConfig.SnapshotInterval = time.Hour
+	}
+	dir1, s1 := testServerWithConfig(t, noSnapshots)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		noSnapshots(c)
+		c.Bootstrap = false
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	dir3, config3 := testServerConfig(t, fmt.Sprintf("Node %d", getPort()))
+	defer os.RemoveAll(dir3)
+	noSnapshots(config3)
+	config3.Bootstrap = false
+	config3.CatchUpThreshold = 10
+	s3, err := NewServer(config3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s3.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	for _, s := range []*Server{s2, s3} {
+		if _, err := s.JoinLAN([]string{addr}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for _, s := range []*Server{s1, s2, s3} {
+		if err := testutil.WaitForResult(func() (bool, error) {
+			peers, _ := s.numPeers()
+			return peers == 3, fmt.Errorf("%d", peers)
+		}); err != nil {
+			t.Fatalf("should have 3 peers: %v", err)
+		}
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// The follower should catch up once it's heard from the leader.
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return s3.Stats()["catch_up"]["catching_up"] == "false", nil
+	}); err != nil {
+		t.Fatalf("should have caught up")
+	}
+
+	// Take the follower down and build up a backlog while it's gone. It
+	// may have been the leader, so wait for one of the others to take
+	// over and write through that.
+	s3.Shutdown()
+	var leader *Server
+	if err := testutil.WaitForResult(func() (bool, error) {
+		for _, s := range []*Server{s1, s2} {
+			if s.IsLeader() {
+				leader = s
+				return true, nil
+			}
+		}
+		return false, fmt.Errorf("no leader")
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	codec := rpcClient(t, leader)
+	defer codec.Close()
+	const keys = 2000
+	for i := 0; i < keys; i++ {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   fmt.Sprintf("backlog/%d", i),
+				Value: []byte("hello"),
+			},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Bring it back with the same identity and data.
+	_, config4 := testServerConfig(t, config3.NodeName)
+	defer os.RemoveAll(config4.DataDir)
+	noSnapshots(config4)
+	config4.DataDir = dir3
+	config4.NodeID = config3.NodeID
+	config4.RPCAddr = config3.RPCAddr
+	config4.SerfLANConfig.MemberlistConfig.BindPort = config3.SerfLANConfig.MemberlistConfig.BindPort
+	config4.SerfWANConfig.MemberlistConfig.BindPort = config3.SerfWANConfig.MemberlistConfig.BindPort
+	config4.Bootstrap = false
+	config4.CatchUpThreshold = 10
+	s4, err := NewServer(config4)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s4.Shutdown()
+
+	// Until it's heard from the leader there's nothing to catch up to, so
+	// stale reads are served.
+	codec4 := rpcClient(t, s4)
+	defer codec4.Close()
+	get := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        fmt.Sprintf("backlog/%d", keys-1),
+		QueryOptions: structs.QueryOptions{
+			AllowStale: true,
+		},
+	}
+	var out structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec4, "KVS.Get", &get, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats := s4.Stats()["catch_up"]; stats["catching_up"] != "true" || stats["target_index"] != "0" {
+		t.Fatalf("bad: %v", stats)
+	}
+
+	// Set a target it can't reach so it stays behind, then stale reads
+	// should be refused once there's a leader.
+	s4.catchUp.setTarget(1<<40, s4.raft.AppliedIndex())
+	if _, err := s4.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s4.RPC, "dc1")
+	err = msgpackrpc.CallWithCodec(codec4, "KVS.Get", &get, &out)
+	if err == nil || err.Error() != structs.ErrCatchingUp.Error() {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Consistent reads get forwarded to the leader, so they still work.
+	consistent := get
+	consistent.AllowStale = false
+	if err := testutil.WaitForResult(func() (bool, error) {
+		var out structs.IndexedDirEntries
+		if err := msgpackrpc.CallWithCodec(codec4, "KVS.Get", &consistent, &out); err != nil {
+			return false, err
+		}
+		return len(out.Entries) == 1, fmt.Errorf("bad: %#v", out)
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Once it's caught up to the leader's real index, it serves stale reads
+	// with the new data.
+	s4.catchUp.setTarget(leader.raft.LastIndex(), s4.raft.AppliedIndex())
+	if err := testutil.WaitForResult(func() (bool, error) {
+		var out structs.IndexedDirEntries
+		if err := msgpackrpc.CallWithCodec(codec4, "KVS.Get", &get, &out); err != nil {
+			return false, err
+		}
+		return len(out.Entries) == 1, fmt.Errorf("bad: %#v", out)
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stats := s4.Stats()["catch_up"]
+	if stats["catching_up"] != "false" || stats["target_index"] == "0" {
+		t.Fatalf("bad: %v", stats)
+	}
+	if s4.raft.AppliedIndex() < uint64(keys) {
+		t.Fatalf("bad: %d", s4.raft.AppliedIndex())
+	}
+}
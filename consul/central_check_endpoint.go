@@ -0,0 +1,215 @@
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/state"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+	"github.com/hashicorp/go-uuid"
+)
+
+var (
+	// ErrCentralCheckNotFound is returned if the check definition lookup
+	// failed.
+	ErrCentralCheckNotFound = errors.New("Central check not found")
+)
+
+// CentralCheck manages the central check definitions. These are check
+// definitions that are stored on the servers and picked up by the agents
+// whose nodes match the definition's selector via Internal.CentralChecks.
+type CentralCheck struct {
+	srv *Server
+}
+
+// Apply is used to create, update, or delete a central check definition. The
+// ID of the definition is returned in the reply.
+func (c *CentralCheck) Apply(args *structs.CentralCheckRequest, reply *string) (err error) {
+	if done, err := c.srv.forward("CentralCheck.Apply", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "central-check", "apply"}, time.Now())
+
+	// These definitions end up running on agents, so managing them is
+	// limited to operators.
+	acl, err := c.srv.resolveToken("CentralCheck.Apply", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	if args.Check == nil {
+		return fmt.Errorf("Must provide a check definition")
+	}
+
+	// Validate the ID. We must create new IDs before applying to the Raft
+	// log since it's not deterministic.
+	state := c.srv.fsm.State()
+	if args.Op == structs.CentralCheckCreate {
+		if args.Check.ID != "" {
+			return fmt.Errorf("ID must be empty when creating a new central check")
+		}
+
+		// We are relying on the fact that UUIDs are random and unlikely
+		// to collide since this isn't inside a write transaction.
+		for {
+			if args.Check.ID, err = uuid.GenerateUUID(); err != nil {
+				return fmt.Errorf("UUID generation for central check failed: %v", err)
+			}
+			_, check, err := state.CentralCheckGet(nil, args.Check.ID)
+			if err != nil {
+				return fmt.Errorf("Central check lookup failed: %v", err)
+			}
+			if check == nil {
+				break
+			}
+		}
+	} else {
+		_, check, err := state.CentralCheckGet(nil, args.Check.ID)
+		if err != nil {
+			return fmt.Errorf("Central check lookup failed: %v", err)
+		}
+		if check == nil {
+			return fmt.Errorf("Cannot modify non-existent central check: '%s'", args.Check.ID)
+		}
+	}
+	*reply = args.Check.ID
+
+	// Parse the definition and prep it for the state store.
+	switch args.Op {
+	case structs.CentralCheckCreate, structs.CentralCheckUpdate:
+		if err := parseCentralCheck(args.Check); err != nil {
+			return fmt.Errorf("Invalid central check: %v", err)
+		}
+
+	case structs.CentralCheckDelete:
+		// Nothing else to verify here, just do the delete (we only look
+		// at the ID field for this op).
+
+	default:
+		return fmt.Errorf("Unknown central check operation: %s", args.Op)
+	}
+
+	// Commit the definition to the state store.
+	resp, err := c.srv.raftApply(structs.CentralCheckRequestType, args)
+	if err != nil {
+		c.srv.logger.Printf("[ERR] consul.central_check: Apply failed %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+
+	return nil
+}
+
+// parseCentralCheck makes sure the entries of a check definition are valid for
+// a create or update operation. The agents do their own validation when they
+// load the definition, so this just catches the obvious mistakes up front.
+func parseCentralCheck(check *structs.CentralCheck) error {
+	if check.Name == "" {
+		return fmt.Errorf("Must provide a Name")
+	}
+
+	if err := structs.ValidateMetadata(check.NodeMeta); err != nil {
+		return err
+	}
+
+	// Exactly one kind of check must be given.
+	var kinds int
+	for _, set := range []bool{check.Script != "", check.HTTP != "", check.TCP != "", check.TTL != 0} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("Must provide exactly one of Script, HTTP, TCP, or TTL")
+	}
+	if check.DockerContainerID != "" && check.Script == "" {
+		return fmt.Errorf("DockerContainerID requires a Script")
+	}
+
+	if check.TTL < 0 {
+		return fmt.Errorf("Bad TTL '%s', must be >= 0", check.TTL)
+	}
+	if check.TTL == 0 && check.Interval <= 0 {
+		return fmt.Errorf("Bad Interval '%s', must be > 0", check.Interval)
+	}
+	if check.Timeout < 0 {
+		return fmt.Errorf("Bad Timeout '%s', must be >= 0", check.Timeout)
+	}
+
+	switch check.Status {
+	case "", structs.HealthPassing, structs.HealthWarning, structs.HealthCritical:
+	default:
+		return fmt.Errorf("Bad Status '%s'", check.Status)
+	}
+
+	return nil
+}
+
+// Get returns a single central check definition by ID.
+func (c *CentralCheck) Get(args *structs.CentralCheckSpecificRequest,
+	reply *structs.IndexedCentralChecks) error {
+	if done, err := c.srv.forward("CentralCheck.Get", args, args, reply); done {
+		return err
+	}
+
+	acl, err := c.srv.resolveToken("CentralCheck.Get", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	return c.srv.blockingQuery(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, state *state.StateStore) error {
+			index, check, err := state.CentralCheckGet(ws, args.CheckID)
+			if err != nil {
+				return err
+			}
+			if check == nil {
+				return ErrCentralCheckNotFound
+			}
+
+			reply.Index, reply.Checks = index, structs.CentralChecks{check}
+			return nil
+		})
+}
+
+// List returns all the central check definitions.
+func (c *CentralCheck) List(args *structs.DCSpecificRequest,
+	reply *structs.IndexedCentralChecks) error {
+	if done, err := c.srv.forward("CentralCheck.List", args, args, reply); done {
+		return err
+	}
+
+	acl, err := c.srv.resolveToken("CentralCheck.List", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	return c.srv.blockingQuery(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, state *state.StateStore) error {
+			index, checks, err := state.CentralCheckList(ws)
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.Checks = index, checks
+			return nil
+		})
+}
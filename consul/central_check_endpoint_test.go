@@ -0,0 +1,217 @@
+package consul
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestCentralCheck_Apply(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Set up a bare bones definition.
+	arg := structs.CentralCheckRequest{
+		Datacenter: "dc1",
+		Op:         structs.CentralCheckCreate,
+		Check: &structs.CentralCheck{
+			Name:     "disk",
+			NodeMeta: map[string]string{"rack": "a"},
+			Script:   "/bin/check-disk",
+			Interval: 10 * time.Second,
+		},
+	}
+	var reply string
+
+	// Set an ID which should fail the create.
+	arg.Check.ID = "nope"
+	err := msgpackrpc.CallWithCodec(codec, "CentralCheck.Apply", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), "ID must be empty") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Change it to a bogus modify which should also fail.
+	arg.Op = structs.CentralCheckUpdate
+	arg.Check.ID = generateUUID()
+	err = msgpackrpc.CallWithCodec(codec, "CentralCheck.Apply", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), "Cannot modify non-existent central check") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Fix up the ID but invalidate the definition itself.
+	arg.Op = structs.CentralCheckCreate
+	arg.Check.ID = ""
+	arg.Check.TTL = time.Minute
+	err = msgpackrpc.CallWithCodec(codec, "CentralCheck.Apply", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), "exactly one of") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Fix that and make sure the apply goes through.
+	arg.Check.TTL = 0
+	if err := msgpackrpc.CallWithCodec(codec, "CentralCheck.Apply", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Check.ID = reply
+
+	// Make sure we can read it back.
+	req := &structs.CentralCheckSpecificRequest{
+		Datacenter: "dc1",
+		CheckID:    arg.Check.ID,
+	}
+	var resp structs.IndexedCentralChecks
+	if err := msgpackrpc.CallWithCodec(codec, "CentralCheck.Get", req, &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(resp.Checks) != 1 {
+		t.Fatalf("bad: %v", resp)
+	}
+	actual := resp.Checks[0]
+	if resp.Index != actual.ModifyIndex {
+		t.Fatalf("bad index: %d", resp.Index)
+	}
+	actual.CreateIndex, actual.ModifyIndex = 0, 0
+	if !reflect.DeepEqual(actual, arg.Check) {
+		t.Fatalf("bad: %v", actual)
+	}
+
+	// Make an update and make sure it shows up in the list.
+	arg.Op = structs.CentralCheckUpdate
+	arg.Check.Interval = 30 * time.Second
+	if err := msgpackrpc.CallWithCodec(codec, "CentralCheck.Apply", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	list := &structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var listResp structs.IndexedCentralChecks
+	if err := msgpackrpc.CallWithCodec(codec, "CentralCheck.List", list, &listResp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(listResp.Checks) != 1 || listResp.Checks[0].Interval != 30*time.Second {
+		t.Fatalf("bad: %v", listResp)
+	}
+
+	// Delete it and make sure it's gone.
+	arg.Op = structs.CentralCheckDelete
+	if err := msgpackrpc.CallWithCodec(codec, "CentralCheck.Apply", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = msgpackrpc.CallWithCodec(codec, "CentralCheck.Get", req, &structs.IndexedCentralChecks{})
+	if err == nil || err.Error() != ErrCentralCheckNotFound.Error() {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestCentralCheck_parseCentralCheck(t *testing.T) {
+	cases := []struct {
+		check *structs.CentralCheck
+		err   string
+	}{
+		{&structs.CentralCheck{Script: "true", Interval: time.Second}, "Must provide a Name"},
+		{&structs.CentralCheck{Name: "a", Interval: time.Second}, "exactly one of"},
+		{&structs.CentralCheck{Name: "a", HTTP: "http://x", TCP: "x:1", Interval: time.Second}, "exactly one of"},
+		{&structs.CentralCheck{Name: "a", HTTP: "http://x"}, "Bad Interval"},
+		{&structs.CentralCheck{Name: "a", HTTP: "http://x", DockerContainerID: "c", Interval: time.Second}, "requires a Script"},
+		{&structs.CentralCheck{Name: "a", TTL: time.Second, Timeout: -1}, "Bad Timeout"},
+		{&structs.CentralCheck{Name: "a", TTL: time.Second, Status: "nope"}, "Bad Status"},
+		{&structs.CentralCheck{Name: "a", TTL: time.Second, NodeMeta: map[string]string{"": "a"}}, "Key cannot be blank"},
+		{&structs.CentralCheck{Name: "a", TTL: time.Second}, ""},
+		{&structs.CentralCheck{Name: "a", TCP: "x:1", Interval: time.Second, Status: structs.HealthCritical}, ""},
+	}
+	for i, c := range cases {
+		err := parseCentralCheck(c.check)
+		if c.err == "" {
+			if err != nil {
+				t.Fatalf("case %d: err: %v", i, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("case %d: bad: %v", i, err)
+		}
+	}
+}
+
+func TestCentralCheck_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Make a request with no token to make sure it gets denied.
+	arg := structs.CentralCheckRequest{
+		Datacenter: "dc1",
+		Op:         structs.CentralCheckCreate,
+		Check: &structs.CentralCheck{
+			Name: "ttl",
+			TTL:  time.Minute,
+		},
+	}
+	var reply string
+	err := msgpackrpc.CallWithCodec(codec, "CentralCheck.Apply", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	list := &structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var resp structs.IndexedCentralChecks
+	err = msgpackrpc.CallWithCodec(codec, "CentralCheck.List", list, &resp)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Create an ACL with operator write permissions.
+	var token string
+	{
+		var rules = `
+                    operator = "write"
+                `
+
+		req := structs.ACLRequest{
+			Datacenter: "dc1",
+			Op:         structs.ACLSet,
+			ACL: structs.ACL{
+				Name:  "User token",
+				Type:  structs.ACLTypeClient,
+				Rules: rules,
+			},
+			WriteRequest: structs.WriteRequest{Token: "root"},
+		}
+		if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &req, &token); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Now it should go through.
+	arg.Token = token
+	if err := msgpackrpc.CallWithCodec(codec, "CentralCheck.Apply", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	list.Token = token
+	if err := msgpackrpc.CallWithCodec(codec, "CentralCheck.List", list, &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(resp.Checks) != 1 || resp.Checks[0].ID != reply {
+		t.Fatalf("bad: %v", resp)
+	}
+}
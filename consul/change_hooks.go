@@ -0,0 +1,183 @@
+package consul
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// changeHookOps makes an empty request for each message type, so the FSM can
+// decode a copy of the request for change hooks.
+var changeHookOps = map[structs.MessageType]func() interface{}{
+	structs.RegisterRequestType:          func() interface{} { return new(structs.RegisterRequest) },
+	structs.DeregisterRequestType:        func() interface{} { return new(structs.DeregisterRequest) },
+	structs.KVSRequestType:               func() interface{} { return new(structs.KVSRequest) },
+	structs.SessionRequestType:           func() interface{} { return new(structs.SessionRequest) },
+	structs.ACLRequestType:               func() interface{} { return new(structs.ACLRequest) },
+	structs.TombstoneRequestType:         func() interface{} { return new(structs.TombstoneRequest) },
+	structs.CoordinateBatchUpdateType:    func() interface{} { return new(structs.Coordinates) },
+	structs.PreparedQueryRequestType:     func() interface{} { return new(structs.PreparedQueryRequest) },
+	structs.TxnRequestType:               func() interface{} { return new(structs.TxnRequest) },
+	structs.AutopilotRequestType:         func() interface{} { return new(structs.AutopilotSetConfigRequest) },
+	structs.ACLUsageRequestType:          func() interface{} { return new(structs.ACLUsageRequest) },
+	structs.CentralCheckRequestType:      func() interface{} { return new(structs.CentralCheckRequest) },
+	structs.QueryDefaultsRequestType:     func() interface{} { return new(structs.QueryDefaultsSetRequest) },
+	structs.DatacenterAliasRequestType:   func() interface{} { return new(structs.DatacenterAliasRequest) },
+	structs.ServiceConstraintRequestType: func() interface{} { return new(structs.ServiceConstraintRequest) },
+	structs.QueryFreezeRequestType:       func() interface{} { return new(structs.QueryFreezeRequest) },
+	structs.SigningKeyRequestType:        func() interface{} { return new(structs.SigningKeyRequest) },
+	structs.RemoteWritePolicyRequestType: func() interface{} { return new(structs.RemoteWritePolicyRequest) },
+	structs.ServiceNamePolicyRequestType: func() interface{} { return new(structs.ServiceNamePolicyRequest) },
+	structs.NodeBlockRequestType:         func() interface{} { return new(structs.NodeBlockRequest) },
+	structs.ServerEventRequestType:       func() interface{} { return new(structs.ServerEventRequest) },
+	structs.FederationPolicyRequestType:  func() interface{} { return new(structs.FederationPolicyRequest) },
+	structs.OrphanedLockRequestType:      func() interface{} { return new(structs.OrphanedLockRequest) },
+	structs.DeregisterBatchRequestType:   func() interface{} { return new(structs.DeregisterBatchRequest) },
+	structs.OperatorIntentRequestType:    func() interface{} { return new(structs.OperatorIntentRequest) },
+	structs.KVQuotaRequestType:           func() interface{} { return new(structs.KVQuotaRequest) },
+	structs.ClusterIDRequestType:         func() interface{} { return new(structs.ClusterIDRequest) },
+}
+
+// changeEvent is an apply waiting to be passed to a change hook.
+type changeEvent struct {
+	index uint64
+	op    interface{}
+}
+
+// ChangeHook is a function that's called after the FSM applies a certain type
+// of message. Each hook has its own queue and goroutine, so a slow hook only
+// holds up itself. When its queue is full, new changes are dropped and
+// counted rather than blocking the FSM.
+type ChangeHook struct {
+	fn      func(idx uint64, op interface{})
+	queue   chan changeEvent
+	dropped uint64
+
+	// onDrop, if set, is called from the FSM with the index of each change
+	// that's dropped, so the hook's owner can tell its consumers they
+	// missed something. It must not block.
+	onDrop func(idx uint64)
+}
+
+// Dropped returns the number of changes that were dropped because the hook's
+// queue was full.
+func (h *ChangeHook) Dropped() uint64 {
+	return atomic.LoadUint64(&h.dropped)
+}
+
+// run passes queued changes to the hook, in order, until the shutdown channel
+// is closed.
+func (h *ChangeHook) run(shutdownCh <-chan struct{}) {
+	for {
+		select {
+		case <-shutdownCh:
+			return
+		case event := <-h.queue:
+			h.fn(event.index, event.op)
+		}
+	}
+}
+
+// changeHooks holds the change hooks registered with the FSM.
+type changeHooks struct {
+	sync.RWMutex
+	hooks map[structs.MessageType][]*ChangeHook
+
+	// restores are called after the FSM is restored from a snapshot, which
+	// replaces the state without any applies for the hooks to see.
+	restores []func(idx uint64)
+}
+
+// add registers a hook for the given message type.
+func (c *changeHooks) add(msgType structs.MessageType, hook *ChangeHook) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.hooks == nil {
+		c.hooks = make(map[structs.MessageType][]*ChangeHook)
+	}
+	c.hooks[msgType] = append(c.hooks[msgType], hook)
+}
+
+// addRestore registers a function to call after snapshot restores.
+func (c *changeHooks) addRestore(fn func(idx uint64)) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.restores = append(c.restores, fn)
+}
+
+// notifyRestore calls the restore functions with the snapshot's last index.
+func (c *changeHooks) notifyRestore(index uint64) {
+	c.RLock()
+	defer c.RUnlock()
+
+	for _, fn := range c.restores {
+		fn(index)
+	}
+}
+
+// notify queues an apply for the hooks registered for its message type. The
+// request is decoded once and shared between the hooks. Applies that failed
+// didn't change anything, so they're skipped.
+func (c *changeHooks) notify(msgType structs.MessageType, index uint64, buf []byte, resp interface{}) {
+	c.RLock()
+	defer c.RUnlock()
+
+	hooks := c.hooks[msgType]
+	if len(hooks) == 0 {
+		return
+	}
+	if _, ok := resp.(error); ok {
+		return
+	}
+
+	var op interface{} = buf
+	if fn, ok := changeHookOps[msgType]; ok {
+		op = fn()
+		if err := structs.Decode(buf, op); err != nil {
+			return
+		}
+	}
+
+	for _, hook := range hooks {
+		select {
+		case hook.queue <- changeEvent{index, op}:
+		default:
+			atomic.AddUint64(&hook.dropped, 1)
+			metrics.IncrCounter([]string{"consul", "fsm", "change_hook", "dropped"}, 1)
+			if hook.onDrop != nil {
+				hook.onDrop(index)
+			}
+		}
+	}
+}
+
+// RegisterChangeHook registers a function to be called after the FSM applies
+// a message of the given type, which is useful for embedders that want to
+// react to changes without polling. The hook is called with the Raft index
+// and a pointer to the decoded request, such as a *structs.KVSRequest, which
+// is shared with other hooks and must not be modified. Hooks run on every
+// server as applies land, including followers, but not for snapshot
+// restores or applies that return an error. Calls to a hook are made one at a
+// time in apply order, and changes are dropped if the hook falls more than
+// ChangeHookQueueSize changes behind.
+func (s *Server) RegisterChangeHook(msgType structs.MessageType, hook func(idx uint64, op interface{})) *ChangeHook {
+	return s.registerChangeHook(msgType, hook, nil)
+}
+
+// registerChangeHook is RegisterChangeHook with a function to call when a
+// change is dropped.
+func (s *Server) registerChangeHook(msgType structs.MessageType, hook func(idx uint64, op interface{}),
+	onDrop func(idx uint64)) *ChangeHook {
+	h := &ChangeHook{
+		fn:     hook,
+		queue:  make(chan changeEvent, s.config.ChangeHookQueueSize),
+		onDrop: onDrop,
+	}
+	s.fsm.hooks.add(msgType, h)
+	go h.run(s.shutdownCh)
+	return h
+}
@@ -0,0 +1,159 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+// testKVHook records the keys set by the KV applies it's called with.
+type testKVHook struct {
+	sync.Mutex
+	keys    []string
+	indexes []uint64
+}
+
+func (h *testKVHook) hook(idx uint64, op interface{}) {
+	req := op.(*structs.KVSRequest)
+
+	h.Lock()
+	defer h.Unlock()
+	h.keys = append(h.keys, req.DirEnt.Key)
+	h.indexes = append(h.indexes, idx)
+}
+
+// check makes sure the hook saw the given keys in order, with increasing
+// indexes.
+func (h *testKVHook) check(keys []string) error {
+	h.Lock()
+	defer h.Unlock()
+
+	if len(h.keys) != len(keys) {
+		return fmt.Errorf("got %d keys, want %d", len(h.keys), len(keys))
+	}
+	for i, key := range keys {
+		if h.keys[i] != key {
+			return fmt.Errorf("bad key %d: %q", i, h.keys[i])
+		}
+		if i > 0 && h.indexes[i] <= h.indexes[i-1] {
+			return fmt.Errorf("bad index %d: %v", i, h.indexes)
+		}
+	}
+	return nil
+}
+
+func testKVSet(t *testing.T, s *Server, key string) {
+	codec := rpcClient(t, s)
+	defer codec.Close()
+
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   key,
+			Value: []byte("test"),
+		},
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestServer_RegisterChangeHook(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	// Hook into the KV applies on both servers.
+	var leader, follower testKVHook
+	s1.RegisterChangeHook(structs.KVSRequestType, leader.hook)
+	s2.RegisterChangeHook(structs.KVSRequestType, follower.hook)
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	if err := testutil.WaitForResult(func() (bool, error) {
+		peers, _ := s2.numPeers()
+		return peers == 2, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("test/%d", i)
+		testKVSet(t, s1, key)
+		keys = append(keys, key)
+	}
+
+	// Both servers should see all the writes, in order.
+	for _, h := range []*testKVHook{&leader, &follower} {
+		if err := testutil.WaitForResult(func() (bool, error) {
+			err := h.check(keys)
+			return err == nil, err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestServer_RegisterChangeHook_Overflow(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ChangeHookQueueSize = 2
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Make a hook that's stuck until we release it.
+	var h testKVHook
+	release := make(chan struct{})
+	hook := s1.RegisterChangeHook(structs.KVSRequestType, func(idx uint64, op interface{}) {
+		<-release
+		h.hook(idx, op)
+	})
+
+	for i := 0; i < 10; i++ {
+		testKVSet(t, s1, fmt.Sprintf("test/%d", i))
+	}
+
+	// The first write is with the hook, and two more can be queued, so
+	// the rest get dropped.
+	if dropped := hook.Dropped(); dropped != 7 {
+		t.Fatalf("bad: %d", dropped)
+	}
+
+	// The ones that weren't dropped are still delivered in order.
+	close(release)
+	if err := testutil.WaitForResult(func() (bool, error) {
+		err := h.check([]string{"test/0", "test/1", "test/2"})
+		return err == nil, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_RegisterChangeHook_BadQueueSize(t *testing.T) {
+	dir, config := testServerConfig(t, fmt.Sprintf("Node %d", getPort()))
+	defer os.RemoveAll(dir)
+	config.ChangeHookQueueSize = 0
+	if _, err := NewServer(config); err == nil ||
+		!strings.Contains(err.Error(), "ChangeHookQueueSize") {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -384,6 +384,17 @@ func (c *Client) SnapshotRPC(args *structs.SnapshotRequest, in io.Reader, out io
 	return nil
 }
 
+// Subscribe starts a stream of change notifications from one of the servers
+// for the given topics. The notifications don't carry any data, so the
+// caller should re-query for what changed.
+func (c *Client) Subscribe(args *structs.SubscribeRequest) (*Subscription, error) {
+	server := c.servers.FindServer()
+	if server == nil {
+		return nil, structs.ErrNoServers
+	}
+	return SubscribeRPC(c.connPool, c.config.Datacenter, server.Addr, server.Version, args)
+}
+
 // Stats is used to return statistics for debugging and insight
 // for various sub-systems
 func (c *Client) Stats() map[string]map[string]string {
@@ -0,0 +1,140 @@
+package consul
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/agent"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/serf/serf"
+)
+
+// clusterIDTag is the Serf tag servers advertise their cluster ID in.
+const clusterIDTag = "cluster_id"
+
+// getClusterID returns the ID of the cluster this server is part of, or an
+// empty string if it doesn't know it yet.
+func (s *Server) getClusterID() string {
+	s.clusterIDLock.RLock()
+	defer s.clusterIDLock.RUnlock()
+	return s.clusterID
+}
+
+// initializeClusterID is used to generate the cluster ID if we are the leader
+// and one has never been set. This happens when the cluster is first
+// bootstrapped, and for clusters that were bootstrapped before there were
+// cluster IDs.
+//
+// Servers that don't know about cluster IDs skip the entry that sets it, so
+// one that's upgraded and takes over can find it missing from its state. If
+// another server is already advertising an ID we adopt it rather than make
+// up a second one.
+func (s *Server) initializeClusterID() error {
+	state := s.fsm.State()
+	_, id, err := state.ClusterID(nil)
+	if err != nil {
+		return fmt.Errorf("failed to get cluster ID: %v", err)
+	}
+	if id != nil {
+		return nil
+	}
+
+	clusterID := s.advertisedClusterID()
+	if clusterID == "" {
+		generated, err := uuid.GenerateUUID()
+		if err != nil {
+			return fmt.Errorf("failed to generate cluster ID: %v", err)
+		}
+		clusterID = generated
+	}
+	req := structs.ClusterIDRequest{
+		Datacenter: s.config.Datacenter,
+		ClusterID: structs.ClusterID{
+			ID: clusterID,
+		},
+	}
+	t := structs.ClusterIDRequestType | structs.IgnoreUnknownTypeFlag
+	if _, err = s.raftApply(t, req); err != nil {
+		return fmt.Errorf("failed to initialize cluster ID: %v", err)
+	}
+
+	s.logger.Printf("[INFO] consul: Initialized cluster ID %s", clusterID)
+	return nil
+}
+
+// advertisedClusterID returns the cluster ID another server in our datacenter
+// is advertising, or an empty string if none are.
+func (s *Server) advertisedClusterID() string {
+	for _, member := range s.serfLAN.Members() {
+		ok, parts := agent.IsConsulServer(member)
+		if !ok || member.Status != serf.StatusAlive || parts.Datacenter != s.config.Datacenter {
+			continue
+		}
+		if parts.ClusterID != "" {
+			return parts.ClusterID
+		}
+	}
+	return ""
+}
+
+// clusterIDLoop watches the state store for the cluster ID, and advertises
+// it in the LAN pool once it's known. The ID never changes once it's set, but
+// a server doesn't know it until it's been bootstrapped or has caught up with
+// the leader.
+func (s *Server) clusterIDLoop() {
+	for {
+		state := s.fsm.State()
+		ws := memdb.NewWatchSet()
+		ws.Add(state.AbandonCh())
+		ws.Add(s.shutdownCh)
+		_, id, err := state.ClusterID(ws)
+		if err != nil {
+			s.logger.Printf("[ERR] consul: failed to get cluster ID: %v", err)
+		} else if id != nil && id.ID != s.getClusterID() {
+			if err := s.setClusterID(id.ID); err != nil {
+				s.logger.Printf("[ERR] consul: failed to advertise cluster ID: %v", err)
+			}
+		}
+
+		ws.Watch(nil)
+		select {
+		case <-s.shutdownCh:
+			return
+		default:
+		}
+	}
+}
+
+// setClusterID records the cluster ID and adds it to our LAN tags. The lock
+// isn't held while the tags are updated, since Serf runs our own update
+// through the merge delegate, which looks up the ID.
+func (s *Server) setClusterID(id string) error {
+	s.clusterIDLock.Lock()
+	s.clusterID = id
+	s.clusterIDLock.Unlock()
+
+	tags := s.serfLAN.LocalMember().Tags
+	updated := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		updated[k] = v
+	}
+	updated[clusterIDTag] = id
+	if err := s.serfLAN.SetTags(updated); err != nil {
+		return err
+	}
+
+	s.logger.Printf("[INFO] consul: Part of cluster %s", id)
+	return nil
+}
+
+// checkClusterID returns an error if the given server is part of a different
+// cluster than we are. Servers that don't know their cluster ID yet, either
+// because they're new or they're running an older version, are let through.
+func checkClusterID(name, theirs, ours string) error {
+	if theirs == "" || ours == "" || theirs == ours {
+		return nil
+	}
+	return fmt.Errorf("Member '%s' is part of cluster '%s', but this server is part of cluster '%s'",
+		name, theirs, ours)
+}
@@ -0,0 +1,134 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+// waitForClusterID waits for the given server to know its cluster ID, and
+// returns it.
+func waitForClusterID(t *testing.T, s *Server) string {
+	var id string
+	if err := testutil.WaitForResult(func() (bool, error) {
+		id = s.getClusterID()
+		return id != "", fmt.Errorf("no cluster ID")
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return id
+}
+
+func TestServer_ClusterID(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	id := waitForClusterID(t, s1)
+
+	// It should be advertised and show up in the stats and the Status
+	// endpoint.
+	if tag := s1.serfLAN.LocalMember().Tags[clusterIDTag]; tag != id {
+		t.Fatalf("bad: %q", tag)
+	}
+	if stat := s1.Stats()["consul"]["cluster_id"]; stat != id {
+		t.Fatalf("bad: %q", stat)
+	}
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+	var reply string
+	if err := msgpackrpc.CallWithCodec(codec, "Status.ClusterID", struct{}{}, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply != id {
+		t.Fatalf("bad: %q", reply)
+	}
+
+	// A new server should pick it up once it's joined.
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if id2 := waitForClusterID(t, s2); id2 != id {
+		t.Fatalf("bad: %q", id2)
+	}
+
+	// It shouldn't change across leader restarts.
+	if err := s1.revokeLeadership(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.establishLeadership(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if id1 := s1.getClusterID(); id1 != id {
+		t.Fatalf("bad: %q", id1)
+	}
+
+	// A leader that's missing the ID from its state would adopt the one
+	// the others advertise.
+	if advertised := s2.advertisedClusterID(); advertised != id {
+		t.Fatalf("bad: %q", advertised)
+	}
+}
+
+func TestServer_ClusterID_CrossJoin(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServer(t)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	// Bootstrap two independent clusters in the same datacenter.
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s2.RPC, "dc1")
+	id1 := waitForClusterID(t, s1)
+	id2 := waitForClusterID(t, s2)
+	if id1 == id2 {
+		t.Fatalf("bad: %q", id1)
+	}
+
+	// Joining across clusters should be refused.
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	_, err := s2.JoinLAN([]string{addr})
+	if err == nil {
+		t.Fatalf("should have failed")
+	}
+	if !strings.Contains(err.Error(), id1) || !strings.Contains(err.Error(), id2) {
+		t.Fatalf("err: %v", err)
+	}
+	if len(s1.LANMembers()) != 1 || len(s2.LANMembers()) != 1 {
+		t.Fatalf("bad: %v %v", s1.LANMembers(), s2.LANMembers())
+	}
+}
+
+func TestCheckClusterID(t *testing.T) {
+	cases := []struct {
+		theirs, ours string
+		ok           bool
+	}{
+		{"", "", true},
+		{"a", "", true},
+		{"", "a", true},
+		{"a", "a", true},
+		{"a", "b", false},
+	}
+	for _, c := range cases {
+		err := checkClusterID("foo", c.theirs, c.ours)
+		if (err == nil) != c.ok {
+			t.Fatalf("bad: %#v %v", c, err)
+		}
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"os"
 	"time"
 
+	"github.com/hashicorp/consul/acl"
 	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/lib"
 	"github.com/hashicorp/consul/tlsutil"
 	"github.com/hashicorp/consul/types"
 	"github.com/hashicorp/memberlist"
@@ -80,8 +82,21 @@ type Config struct {
 	// RaftConfig is the configuration used for Raft in the local DC
 	RaftConfig *raft.Config
 
-	// (Enterprise-only) NonVoter is used to prevent this server from being added
-	// as a voting member of the Raft cluster.
+	// LogStoreFactory, if set, is used to create the stores for the Raft
+	// log and stable state instead of the default BoltDB store in the data
+	// directory. See InmemLogStoreFactory.
+	LogStoreFactory LogStoreFactory
+
+	// SnapshotStoreFactory, if set, is used to create the Raft snapshot
+	// store instead of the default file store in the data directory. See
+	// InmemSnapshotStoreFactory.
+	SnapshotStoreFactory SnapshotStoreFactory
+
+	// NonVoter is used to prevent this server from being added as a voting
+	// member of the Raft cluster. It still gets the Raft log replicated to
+	// it, so it can serve stale reads, but it never becomes the leader or
+	// counts towards the quorum. This needs Raft protocol 3 on all servers,
+	// and can't be used with Bootstrap or BootstrapExpect.
 	NonVoter bool
 
 	// RPCAddr is the RPC address used by Consul. This should be reachable
@@ -94,12 +109,53 @@ type Config struct {
 	// reachable
 	RPCAdvertise *net.TCPAddr
 
+	// RPCListener, if set, is used in place of binding a listener to
+	// RPCAddr. This allows embedders to hand over a pre-bound listener,
+	// such as one obtained via systemd socket activation, or an in-memory
+	// listener for testing. RPCAdvertise must be set explicitly when this
+	// is used, since the listener's address may not be advertisable.
+	RPCListener net.Listener
+
+	// RPCDialer, if set, is used to open outgoing RPC and Raft connections
+	// to other servers instead of dialing TCP directly. This is mostly
+	// useful alongside RPCListener to run servers without real sockets.
+	RPCDialer DialerFunc
+
+	// WANProxyURL, if set, is a socks5:// or http:// proxy that RPC
+	// connections to servers in other datacenters go through. TLS is still
+	// end to end with the destination server. Raft, LAN, and gossip traffic
+	// don't use the proxy.
+	WANProxyURL string
+
+	// EnableFaultInjection turns on the hooks that let an operator add
+	// latency, drop connections, or blackhole peers on the server's
+	// outgoing RPC and Raft connections, for chaos testing. When this is
+	// off the connections aren't wrapped at all, and the operator
+	// endpoints refuse to change anything.
+	EnableFaultInjection bool
+
+	// FaultInjections are injected from startup when fault injection is
+	// enabled. Their TTLs count from when the server starts.
+	FaultInjections []*structs.FaultInjection
+
 	// SerfLANConfig is the configuration for the intra-dc serf
 	SerfLANConfig *serf.Config
 
 	// SerfWANConfig is the configuration for the cross-dc serf
 	SerfWANConfig *serf.Config
 
+	// RequireWAN makes a failure to start the WAN Serf fatal. When this is
+	// false the server will start anyway, log the error, and keep retrying
+	// in the background, which suits clusters that never federate.
+	RequireWAN bool
+
+	// SerfLANTransport and SerfWANTransport, if set, are used as the
+	// memberlist transports for the LAN and WAN Serf pools instead of
+	// binding to the addresses in the corresponding Serf configs. The
+	// advertise address is taken from the transport.
+	SerfLANTransport memberlist.Transport
+	SerfWANTransport memberlist.Transport
+
 	// SerfFloodInterval controls how often we attempt to flood local Serf
 	// Consul servers into the global areas (WAN and user-defined areas in
 	// Consul Enterprise).
@@ -111,10 +167,123 @@ type Config struct {
 	// leader election.
 	ReconcileInterval time.Duration
 
+	// LeaderReconcileHoldoff is how long a new leader waits before acting
+	// on failed, left, or reaped members when reconciling, since its view
+	// of Serf can lag right after an election. Until then it only
+	// registers members and marks them alive. Once it's over, the deferred
+	// members are checked against the current membership before anything
+	// is deregistered or marked critical. Zero disables the holdoff.
+	LeaderReconcileHoldoff time.Duration
+
+	// ReconcileCoalesceWindow is how long the leader holds on to Serf
+	// member events for a node before reconciling it. Events for the same
+	// node that come in during the window are merged, so only the node's
+	// final state is written to the catalog. Zero reconciles each event
+	// right away.
+	ReconcileCoalesceWindow time.Duration
+
+	// ExternalNodeReapInterval controls how often the leader looks for
+	// nodes that were registered directly via the catalog, are not known
+	// to Serf, and no longer have any services or checks, so they can be
+	// deregistered. Every server keeps track of the Raft index at this
+	// interval so the leader can tell how old a node is, even if it only
+	// recently took over. Setting this to zero disables the reaper.
+	ExternalNodeReapInterval time.Duration
+
+	// ExternalNodeReapAge is how long an empty external node must go
+	// without being modified before it's eligible to be reaped.
+	ExternalNodeReapAge time.Duration
+
+	// OrphanedCheckReapInterval controls how often the leader looks for
+	// checks tied to services that are no longer registered, so they can
+	// be deregistered. Setting this to zero disables the reaper.
+	OrphanedCheckReapInterval time.Duration
+
+	// OrphanedLockSweepInterval controls how often the leader looks for
+	// keys locked by sessions that no longer exist, so they can be
+	// released. Setting this to zero disables the sweep.
+	OrphanedLockSweepInterval time.Duration
+
+	// OrphanedLockSweepDryRun makes the sweep only log and count the
+	// orphaned locks it finds, without releasing them.
+	OrphanedLockSweepDryRun bool
+
+	// ReapBatchSize is the most nodes the leader deregisters in a single
+	// Raft entry after Serf reaps them. Reaped servers are still handled
+	// one at a time. Zero deregisters each node as it's reaped.
+	ReapBatchSize int
+
+	// ReapBatchRate is the most batches of reaped nodes the leader
+	// deregisters per second, so they don't crowd out agents registering
+	// again. Zero doesn't limit them. This only applies if ReapBatchSize
+	// is set.
+	ReapBatchRate float64
+
+	// ReadinessAddr is the address of a lightweight listener that load
+	// balancers can check to see if this server should be sent requests.
+	// It answers plain HTTP requests with a 200 or 503, and anything else
+	// with a single byte. This is disabled if empty.
+	ReadinessAddr string
+
+	// ReadinessMinDiskFree is the least free space, in bytes, the disk
+	// holding the data directory can have for the server to report that
+	// it's ready. Zero doesn't check the disk.
+	ReadinessMinDiskFree uint64
+
+	// ReadinessShutdownDelay is how long the server reports that it isn't
+	// ready during shutdown before it closes its listeners, so that load
+	// balancers can move traffic off it first.
+	ReadinessShutdownDelay time.Duration
+
+	// WANRepairInterval controls how often the leader compares its WAN
+	// pool with the view from a server in each other datacenter, and joins
+	// any servers it's missing. This repairs pools that gossip can't heal
+	// on its own, such as with asymmetric firewalls. Setting this to zero
+	// disables the repairs.
+	WANRepairInterval time.Duration
+
+	// WANRepairMaxJoins limits how many missing servers the leader will try
+	// to join each time it checks the WAN pool.
+	WANRepairMaxJoins int
+
+	// KeyringRotateInterval controls how often the leader retries a gossip
+	// keyring rotation that's waiting on members to acknowledge a step,
+	// such as one that's partitioned from the rest of the cluster.
+	KeyringRotateInterval time.Duration
+
+	// CriticalProbeInterval controls how often the leader connects directly
+	// to each service instance that has the CriticalProbeMetaKey meta set
+	// to "true", and updates a check for it in the catalog. This notices a
+	// dead instance much sooner than Serf would notice its node has failed.
+	// The probes go to the service port on the node's address, so anyone
+	// who can register a service can have the leader connect to that port
+	// on the node. Older agents remove the probe checks during anti-entropy,
+	// so all the agents should be upgraded first. Setting this to zero
+	// disables the probes.
+	CriticalProbeInterval time.Duration
+
+	// CriticalProbeTimeout is how long each probe gets before the instance
+	// is marked critical. It's capped at CriticalProbeInterval.
+	CriticalProbeTimeout time.Duration
+
+	// CriticalProbeMaxInstances limits how many service instances the
+	// leader probes. Past this, the extra instances aren't probed, and a
+	// warning is logged.
+	CriticalProbeMaxInstances int
+
 	// LogOutput is the location to write logs to. If this is not set,
 	// logs will go to stderr.
 	LogOutput io.Writer
 
+	// HistogramSink, if set, receives latency histograms for the server's
+	// key operations, on top of the regular metrics. See
+	// HistogramDefinitions for what's emitted.
+	HistogramSink HistogramSink
+
+	// HistogramBuckets overrides the bucket upper bounds, in seconds, for
+	// the histograms with the given names. The bounds must be increasing.
+	HistogramBuckets map[string][]float64
+
 	// ProtocolVersion is the protocol version to speak. This must be between
 	// ProtocolVersionMin and ProtocolVersionMax.
 	ProtocolVersion uint8
@@ -197,6 +366,12 @@ type Config struct {
 	// white-lists.
 	ACLDefaultPolicy string
 
+	// ACLDefaultPolicies overrides ACLDefaultPolicy for some resource
+	// types, keyed by type, see acl.ValidateDefaults. The ACL datacenter's
+	// setting is sent along with each policy other datacenters fetch, and
+	// they only fall back to their own if they've never heard from it.
+	ACLDefaultPolicies map[string]string
+
 	// ACLDownPolicy controls the behavior of ACLs if the ACLDatacenter
 	// cannot be contacted. It can be either "deny" to deny all requests,
 	// or "extend-cache" which ignores the ACLCacheInterval and uses
@@ -222,6 +397,30 @@ type Config struct {
 	// used to limit the amount of Raft bandwidth used for replication.
 	ACLReplicationApplyLimit int
 
+	// ACLUsageFlushInterval is how often each server sends the token usage
+	// it has seen to the ACL datacenter, where it's written to the state
+	// store in a single batch. Setting this to zero disables tracking.
+	ACLUsageFlushInterval time.Duration
+
+	// TokenRateWindow is how far back each server counts the requests it
+	// handles for each token, to find the busiest ones. Token rate limits
+	// are only enforced while this is set. Setting this to zero disables
+	// tracking.
+	TokenRateWindow time.Duration
+
+	// TokenRateMaxTokens is the most tokens each server tracks requests
+	// for. Past this, the least recently used token is forgotten.
+	TokenRateMaxTokens int
+
+	// CatalogDiffMaxEntries is the most changes Internal.CatalogDiff will
+	// return for a node. If there are more, the node is told to read its
+	// services and checks again in full.
+	CatalogDiffMaxEntries int
+
+	// ServiceKinds are the kinds of service that can be registered on top
+	// of the built-in ones in structs.BuiltinServiceKinds.
+	ServiceKinds []string
+
 	// ACLEnforceVersion8 is used to gate a set of ACL policy features that
 	// are opt-in prior to Consul 0.8 and opt-out in Consul 0.8 and later.
 	ACLEnforceVersion8 bool
@@ -249,9 +448,34 @@ type Config struct {
 	// to reduce overhead. It is unlikely a user would ever need to tune this.
 	TombstoneTTLGranularity time.Duration
 
+	// MaxTombstonesPerApply limits the number of tombstones a single KV
+	// delete-tree will create. Deleting a larger tree leaves one tombstone
+	// for the whole prefix instead, which keeps blocking queries working
+	// without holding on to every deleted key until the TTL passes. The
+	// leader's value goes into the Raft log along with each delete. Zero
+	// means there's no limit.
+	MaxTombstonesPerApply int
+
+	// ChangeHookQueueSize is how many applies each change hook can fall
+	// behind by before new ones are dropped. This must be at least 1. See
+	// Server.RegisterChangeHook.
+	ChangeHookQueueSize int
+
 	// Minimum Session TTL
 	SessionTTLMin time.Duration
 
+	// SessionTTLJitterPercent spreads out session expirations by adding up
+	// to this percentage of a session's TTL to its timer. The amount is
+	// derived from the session ID, so it stays the same across renewals
+	// and leader changes. Sessions never expire before their TTL. Zero
+	// disables it.
+	SessionTTLJitterPercent int
+
+	// SessionLimitPerNode is the most sessions a node can have at once.
+	// Creates over the limit are rejected with a SessionLimitError. Zero
+	// means there's no limit.
+	SessionLimitPerNode int
+
 	// ServerUp callback can be used to trigger a notification that
 	// a Consul server is now up and known about.
 	ServerUp func()
@@ -282,18 +506,179 @@ type Config struct {
 	// place, and a small jitter is applied to avoid a thundering herd.
 	RPCHoldTimeout time.Duration
 
+	// StrictRPCDecoding rejects RPC requests from clients that have fields
+	// this server doesn't know about, with an UnsupportedFieldsError, instead
+	// of quietly dropping the fields. Requests forwarded from other servers
+	// are never rejected, and the unknown fields are just logged.
+	StrictRPCDecoding bool
+
+	// RefuseRemoteWrites is used to set up the initial remote write policy
+	// when the datacenter is bootstrapped. Once the policy is stored in Raft
+	// it's changed with the operator endpoint instead.
+	RefuseRemoteWrites bool
+
+	// KVMetadata records the token that created and last modified each KV
+	// entry, along with when. This makes every entry a bit bigger, so it's
+	// off by default.
+	KVMetadata bool
+
+	// DisableRegisterDedup turns off the leader's check that skips catalog
+	// registrations that wouldn't change anything, so every registration is
+	// written to Raft.
+	DisableRegisterDedup bool
+
+	// StaleReadFenceDuration is how long a follower can go without hearing
+	// from the leader before it stops serving stale reads. Past that, stale
+	// reads are forwarded to the leader if it can still be reached, or fail
+	// with ErrStaleFenced if not. This is disabled if set to 0.
+	StaleReadFenceDuration time.Duration
+
+	// CatchUpThreshold is how many entries behind the leader a server can
+	// be after it starts up and still serve stale reads. Until it's caught
+	// up to within this many entries of where the leader was when it first
+	// heard from it, stale reads fail with ErrCatchingUp. This is disabled
+	// if set to 0.
+	CatchUpThreshold uint64
+
+	// WANConnectionWarming has servers keep an RPC connection open to a
+	// server in each remote datacenter, so that the first request forwarded
+	// there after a quiet period doesn't have to wait for the connection to
+	// be set up.
+	WANConnectionWarming bool
+
+	// WANConnectionWarmingMaxDCs limits connection warming to this many of
+	// the closest remote datacenters. Zero means there's no limit.
+	WANConnectionWarmingMaxDCs int
+
+	// WANLivenessCheck has servers ping a server in another datacenter
+	// before forwarding a write or consistent read to it, if no RPC to it
+	// has succeeded within WANLivenessThreshold. A server that doesn't
+	// answer within WANLivenessTimeout is skipped in favor of another one,
+	// instead of waiting out the full dial timeout.
+	WANLivenessCheck     bool
+	WANLivenessThreshold time.Duration
+	WANLivenessTimeout   time.Duration
+
+	// RPCMaxResultSize is a rough limit, in bytes, on the size of the
+	// results returned by the list endpoints. Larger results are cut short
+	// and flagged as truncated in the reply's metadata so that a huge reply
+	// can't exhaust the server's memory while being encoded. This is
+	// disabled if set to 0.
+	RPCMaxResultSize int
+
+	// RaftMaxEntrySize is the largest write, in bytes, that will be sent
+	// into Raft, measured by its encoded size. Larger writes are turned away
+	// with a TooLargeError. This is disabled if set to 0.
+	RaftMaxEntrySize int
+
+	// ApplyBackoffQueueDepth is the number of Raft applies in flight above
+	// which Status.ApplyBackoff tells agents to back off. This is disabled
+	// if set to 0.
+	ApplyBackoffQueueDepth int
+
+	// ApplyBackoffLatency is the average Raft apply latency above which
+	// Status.ApplyBackoff tells agents to back off. This is disabled if set
+	// to 0.
+	ApplyBackoffLatency time.Duration
+
+	// ApplyBackoffStep is how much backoff is suggested for each multiple of
+	// the thresholds above that the server is at, up to ApplyBackoffMax.
+	ApplyBackoffStep time.Duration
+	ApplyBackoffMax  time.Duration
+
+	// RPCLogDedupWindow is how long repeats of an identical error logged on
+	// the RPC and forwarding paths are held back before being summarized
+	// in a single line. This is disabled if set to 0.
+	RPCLogDedupWindow time.Duration
+
+	// RPCLogDedupExempt is a list of regular expressions for RPC error log
+	// lines that should never be deduplicated.
+	RPCLogDedupExempt []string
+
+	// Clock is used by the server's timer-driven subsystems, such as session
+	// TTLs, tombstone GC, the reconcile loop, autopilot, and coordinate
+	// updates. This defaults to the real clock but can be swapped out to
+	// drive these synthetically.
+	Clock lib.Clock
+
 	// AutopilotConfig is used to apply the initial autopilot config when
 	// bootstrapping.
 	AutopilotConfig *structs.AutopilotConfig
 
+	// BootstrapStallTimeout is how long a server in BootstrapExpect mode
+	// waits, once it has found enough servers, before it reports that
+	// bootstrapping has stalled.
+	BootstrapStallTimeout time.Duration
+
 	// ServerHealthInterval is the frequency with which the health of the
 	// servers in the cluster will be updated.
 	ServerHealthInterval time.Duration
 
+	// LeaderFlapThreshold is the number of leadership changes within
+	// LeaderFlapWindow above which the leader is considered to be flapping,
+	// which is reported as a cluster health warning. Setting this to zero
+	// disables flap detection.
+	LeaderFlapThreshold int
+
+	// LeaderFlapWindow is the window over which leadership changes are
+	// counted for LeaderFlapThreshold.
+	LeaderFlapWindow time.Duration
+
+	// GossipHealthInterval is how often the server samples the queue depths
+	// and health score of its LAN and WAN gossip pools.
+	GossipHealthInterval time.Duration
+
+	// GossipDegradedThreshold is the total depth of a gossip pool's intent,
+	// event, and query queues above which the pool is considered degraded.
+	// A degraded pool is logged and reported as a cluster health warning.
+	// Setting this to zero disables the check.
+	GossipDegradedThreshold int
+
+	// GossipDegradedEventDelay, if set, is how long the server waits before
+	// firing a user event while its LAN pool is degraded, to give the pool
+	// a chance to drain rather than adding to its backlog.
+	GossipDegradedEventDelay time.Duration
+
 	// AutopilotInterval is the frequency with which the leader will perform
 	// autopilot tasks, such as promoting eligible non-voters and removing
 	// dead servers.
 	AutopilotInterval time.Duration
+
+	// VoterDemotionTimeout is how long a voter can be failed before the
+	// leader demotes it to a non-voter. This shrinks the quorum while
+	// keeping the server in the Raft configuration, so autopilot can
+	// promote it again once it's back and stable. This is disabled if set
+	// to 0.
+	VoterDemotionTimeout time.Duration
+
+	// DeadServerCleanupTimeout is how long a server has to have been failed
+	// before autopilot's dead server cleanup removes it. If this is 0,
+	// failed servers are removed as soon as they're seen. This should be
+	// longer than VoterDemotionTimeout for demotion to have a chance to
+	// happen while cleanup is on.
+	DeadServerCleanupTimeout time.Duration
+
+	// JoinAsVoter adds new servers directly as voters instead of staging
+	// them as non-voters until autopilot promotes them. This is reasonable
+	// for small clusters where new servers can catch up quickly.
+	JoinAsVoter bool
+
+	// PromoteMaxApplyLag is how far a non-voter's applied index can trail
+	// the leader's and still be promoted to a voter by autopilot, so a
+	// server that has the log but is still working through applying it
+	// isn't given a vote yet. This is disabled if set to 0.
+	PromoteMaxApplyLag uint64
+
+	// AllowStaleRaftID lets the server start even if the Raft state or Serf
+	// snapshot on disk has this server's address registered under a
+	// different ID or node name. The Raft state is rewritten to use this
+	// server's NodeID.
+	AllowStaleRaftID bool
+
+	// ForceBootstrap lets a server with Bootstrap set start even if its
+	// Raft state shows it was part of a cluster with other servers, which
+	// is otherwise refused since it can split the cluster.
+	ForceBootstrap bool
 }
 
 // CheckVersion is used to check if the ProtocolVersion is valid
@@ -316,6 +701,9 @@ func (c *Config) CheckACL() error {
 	default:
 		return fmt.Errorf("Unsupported default ACL policy: %s", c.ACLDefaultPolicy)
 	}
+	if err := acl.ValidateDefaults(c.ACLDefaultPolicies); err != nil {
+		return err
+	}
 	switch c.ACLDownPolicy {
 	case "allow":
 	case "deny":
@@ -343,11 +731,16 @@ func DefaultConfig() *Config {
 		SerfWANConfig:            serf.DefaultConfig(),
 		SerfFloodInterval:        60 * time.Second,
 		ReconcileInterval:        60 * time.Second,
+		ExternalNodeReapAge:      72 * time.Hour,
 		ProtocolVersion:          ProtocolVersion2Compatible,
 		ACLTTL:                   30 * time.Second,
 		ACLDefaultPolicy:         "allow",
 		ACLDownPolicy:            "extend-cache",
 		ACLReplicationInterval:   30 * time.Second,
+		ACLUsageFlushInterval:    time.Minute,
+		TokenRateWindow:          time.Minute,
+		TokenRateMaxTokens:       1024,
+		CatalogDiffMaxEntries:    1024,
 		ACLReplicationApplyLimit: 100, // ops / sec
 		TombstoneTTL:             15 * time.Minute,
 		TombstoneTTLGranularity:  30 * time.Second,
@@ -366,6 +759,18 @@ func DefaultConfig() *Config {
 		// than enough when running in the high performance mode.
 		RPCHoldTimeout: 7 * time.Second,
 
+		WANConnectionWarmingMaxDCs: 10,
+
+		WANLivenessThreshold: 30 * time.Second,
+		WANLivenessTimeout:   500 * time.Millisecond,
+
+		RPCLogDedupWindow: 10 * time.Second,
+
+		ApplyBackoffStep: 15 * time.Second,
+		ApplyBackoffMax:  5 * time.Minute,
+
+		Clock: lib.RealClock{},
+
 		TLSMinVersion: "tls10",
 
 		AutopilotConfig: &structs.AutopilotConfig{
@@ -374,8 +779,29 @@ func DefaultConfig() *Config {
 			MaxTrailingLogs:         250,
 			ServerStabilizationTime: 10 * time.Second,
 		},
-		ServerHealthInterval: 2 * time.Second,
-		AutopilotInterval:    10 * time.Second,
+		PromoteMaxApplyLag:    250,
+		ServerHealthInterval:  2 * time.Second,
+		AutopilotInterval:     10 * time.Second,
+		BootstrapStallTimeout: time.Minute,
+		GossipHealthInterval:  5 * time.Second,
+
+		OrphanedCheckReapInterval: 5 * time.Minute,
+		OrphanedLockSweepInterval: 5 * time.Minute,
+
+		WANRepairInterval: 5 * time.Minute,
+		WANRepairMaxJoins: 5,
+
+		KeyringRotateInterval: 30 * time.Second,
+
+		CriticalProbeTimeout:      time.Second,
+		CriticalProbeMaxInstances: 64,
+
+		ChangeHookQueueSize: 256,
+
+		ReadinessMinDiskFree: 100 * 1024 * 1024,
+
+		LeaderFlapThreshold: 3,
+		LeaderFlapWindow:    5 * time.Minute,
 	}
 
 	// Increase our reap interval to 3 days instead of 24h.
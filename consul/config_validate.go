@@ -0,0 +1,188 @@
+package consul
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/consul/consul/agent"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	// lastContactRTTFactor is how many round trips to another server should
+	// fit in Autopilot's LastContactThreshold. Anything less leaves little
+	// room for a slow heartbeat before a healthy server is marked unhealthy.
+	lastContactRTTFactor = 10
+)
+
+// reloadableConfig returns the settings of the given config that Reload can
+// change on a running server.
+func reloadableConfig(c *Config) *structs.ReloadableConfig {
+	rc := &structs.ReloadableConfig{
+		AutopilotInterval:      c.AutopilotInterval,
+		ServerHealthInterval:   c.ServerHealthInterval,
+		CoordinateUpdatePeriod: c.CoordinateUpdatePeriod,
+		ACLDownPolicy:          c.ACLDownPolicy,
+		ACLTTL:                 c.ACLTTL,
+	}
+	if c.AutopilotConfig != nil {
+		conf := *c.AutopilotConfig
+		rc.Autopilot = &conf
+	}
+	return rc
+}
+
+// mergeReloadableConfig returns the proposed settings, with any that were
+// left at their zero value filled in from the running ones.
+func mergeReloadableConfig(running, proposed *structs.ReloadableConfig) *structs.ReloadableConfig {
+	merged := *running
+	if proposed.Autopilot != nil {
+		merged.Autopilot = proposed.Autopilot
+	}
+	if proposed.AutopilotInterval != 0 {
+		merged.AutopilotInterval = proposed.AutopilotInterval
+	}
+	if proposed.ServerHealthInterval != 0 {
+		merged.ServerHealthInterval = proposed.ServerHealthInterval
+	}
+	if proposed.CoordinateUpdatePeriod != 0 {
+		merged.CoordinateUpdatePeriod = proposed.CoordinateUpdatePeriod
+	}
+	if proposed.ACLDownPolicy != "" {
+		merged.ACLDownPolicy = proposed.ACLDownPolicy
+	}
+	if proposed.ACLTTL != 0 {
+		merged.ACLTTL = proposed.ACLTTL
+	}
+	return &merged
+}
+
+// validateReloadableConfig checks a complete set of reloadable settings,
+// returning an error for each one that can't be applied. This is what Reload
+// checks before changing anything, so it's also what Operator.ValidateConfig
+// reports as errors.
+func validateReloadableConfig(c *structs.ReloadableConfig) []error {
+	var errs []error
+	if ap := c.Autopilot; ap == nil {
+		errs = append(errs, fmt.Errorf("Autopilot must be set"))
+	} else {
+		if ap.LastContactThreshold < 0 {
+			errs = append(errs, fmt.Errorf("Autopilot.LastContactThreshold must not be negative"))
+		}
+		if ap.ServerStabilizationTime < 0 {
+			errs = append(errs, fmt.Errorf("Autopilot.ServerStabilizationTime must not be negative"))
+		}
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"AutopilotInterval", c.AutopilotInterval},
+		{"ServerHealthInterval", c.ServerHealthInterval},
+		{"CoordinateUpdatePeriod", c.CoordinateUpdatePeriod},
+	} {
+		if d.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %v", d.name, d.value))
+		}
+	}
+	switch c.ACLDownPolicy {
+	case "allow", "deny", "extend-cache":
+	default:
+		errs = append(errs, fmt.Errorf("Unsupported down ACL policy: %s", c.ACLDownPolicy))
+	}
+	if c.ACLTTL < 0 {
+		errs = append(errs, fmt.Errorf("ACLTTL must not be negative"))
+	}
+	return errs
+}
+
+// runningReloadableConfig returns the reloadable settings in effect now. The
+// Autopilot settings come from the state store when they're there, since
+// that's what the leader uses.
+func (s *Server) runningReloadableConfig() (*structs.ReloadableConfig, error) {
+	s.configLock.RLock()
+	rc := reloadableConfig(s.config)
+	s.configLock.RUnlock()
+
+	_, autopilotConf, err := s.fsm.State().AutopilotConfig()
+	if err != nil {
+		return nil, err
+	}
+	if autopilotConf != nil {
+		rc.Autopilot = autopilotConf
+	}
+	return rc, nil
+}
+
+// configCheckState is what's known about the running cluster when checking a
+// proposed configuration.
+type configCheckState struct {
+	// ElectionTimeout is the Raft election timeout in use now.
+	ElectionTimeout time.Duration
+
+	// ServerRTTs has the estimated round trip time from this server to each
+	// of the other servers, by node name.
+	ServerRTTs map[string]time.Duration
+}
+
+// getConfigCheckState gathers what's needed to check a proposed configuration
+// against the running cluster.
+func (s *Server) getConfigCheckState() (*configCheckState, error) {
+	cs := &configCheckState{
+		ElectionTimeout: s.config.RaftConfig.ElectionTimeout,
+		ServerRTTs:      make(map[string]time.Duration),
+	}
+
+	// Estimate the round trip times to the other servers from the Serf
+	// network coordinates.
+	self, err := s.serfLAN.GetCoordinate()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range s.LANMembers() {
+		if m.Name == s.config.NodeName || m.Status != serf.StatusAlive {
+			continue
+		}
+		if ok, _ := agent.IsConsulServer(m); !ok {
+			continue
+		}
+		if coord, ok := s.serfLAN.GetCachedCoordinate(m.Name); ok {
+			cs.ServerRTTs[m.Name] = self.DistanceTo(coord)
+		}
+	}
+	return cs, nil
+}
+
+// reloadableConfigWarnings checks a complete set of reloadable settings
+// against the running cluster, returning a warning for each setting that's
+// allowed but looks risky.
+func reloadableConfigWarnings(c *structs.ReloadableConfig, cs *configCheckState) []string {
+	var warnings []string
+	if c.Autopilot == nil {
+		return warnings
+	}
+	threshold := c.Autopilot.LastContactThreshold
+
+	var names []string
+	for name := range cs.ServerRTTs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rtt := cs.ServerRTTs[name]
+		if threshold < lastContactRTTFactor*rtt {
+			warnings = append(warnings, fmt.Sprintf(
+				"Autopilot.LastContactThreshold of %s is less than %d times the estimated round trip time of %s to server %q",
+				threshold, lastContactRTTFactor, rtt, name))
+		}
+	}
+
+	if threshold >= cs.ElectionTimeout {
+		warnings = append(warnings, fmt.Sprintf(
+			"Autopilot.LastContactThreshold of %s is not less than the Raft election timeout of %s, so servers will start an election before Autopilot sees them as unhealthy",
+			threshold, cs.ElectionTimeout))
+	}
+	return warnings
+}
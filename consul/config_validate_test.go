@@ -0,0 +1,191 @@
+package consul
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestValidateReloadableConfig(t *testing.T) {
+	// The default config is fine.
+	if errs := validateReloadableConfig(reloadableConfig(DefaultConfig())); len(errs) != 0 {
+		t.Fatalf("bad: %v", errs)
+	}
+
+	c := &structs.ReloadableConfig{
+		ServerHealthInterval:   time.Second,
+		CoordinateUpdatePeriod: -time.Second,
+		ACLDownPolicy:          "nope",
+		ACLTTL:                 -time.Second,
+	}
+	var actual []string
+	for _, err := range validateReloadableConfig(c) {
+		actual = append(actual, err.Error())
+	}
+	expected := []string{
+		"Autopilot must be set",
+		"AutopilotInterval must be positive, got 0s",
+		"CoordinateUpdatePeriod must be positive, got -1s",
+		"Unsupported down ACL policy: nope",
+		"ACLTTL must not be negative",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bad: %#v", actual)
+	}
+
+	c.Autopilot = &structs.AutopilotConfig{
+		LastContactThreshold:    -time.Second,
+		ServerStabilizationTime: -time.Second,
+	}
+	errs := validateReloadableConfig(c)
+	if len(errs) != 6 || errs[0].Error() != "Autopilot.LastContactThreshold must not be negative" ||
+		errs[1].Error() != "Autopilot.ServerStabilizationTime must not be negative" {
+		t.Fatalf("bad: %v", errs)
+	}
+}
+
+func TestMergeReloadableConfig(t *testing.T) {
+	running := reloadableConfig(DefaultConfig())
+
+	// Nothing proposed keeps everything as is.
+	if merged := mergeReloadableConfig(running, &structs.ReloadableConfig{}); !reflect.DeepEqual(merged, running) {
+		t.Fatalf("bad: %#v", merged)
+	}
+
+	proposed := &structs.ReloadableConfig{
+		Autopilot:     &structs.AutopilotConfig{LastContactThreshold: time.Second},
+		ACLDownPolicy: "deny",
+	}
+	merged := mergeReloadableConfig(running, proposed)
+	if merged.Autopilot != proposed.Autopilot || merged.ACLDownPolicy != "deny" ||
+		merged.AutopilotInterval != running.AutopilotInterval || merged.ACLTTL != running.ACLTTL {
+		t.Fatalf("bad: %#v", merged)
+	}
+	if running.ACLDownPolicy == "deny" {
+		t.Fatalf("running config should not change")
+	}
+}
+
+func TestReloadableConfigWarnings(t *testing.T) {
+	cs := &configCheckState{
+		ElectionTimeout: 5 * time.Second,
+		ServerRTTs: map[string]time.Duration{
+			"near": time.Millisecond,
+			"far":  200 * time.Millisecond,
+		},
+	}
+
+	// A threshold that leaves room for the round trips is fine.
+	c := &structs.ReloadableConfig{
+		Autopilot: &structs.AutopilotConfig{
+			LastContactThreshold: 3 * time.Second,
+		},
+	}
+	if warnings := reloadableConfigWarnings(c, cs); len(warnings) != 0 {
+		t.Fatalf("bad: %v", warnings)
+	}
+
+	// A smaller one is too close to the far server's RTT, and a bigger one
+	// is over the election timeout.
+	c.Autopilot.LastContactThreshold = time.Second
+	warnings := reloadableConfigWarnings(c, cs)
+	if len(warnings) != 1 || !strings.Contains(warnings[0], `to server "far"`) {
+		t.Fatalf("bad: %v", warnings)
+	}
+	c.Autopilot.LastContactThreshold = 10 * time.Second
+	warnings = reloadableConfigWarnings(c, cs)
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "Autopilot.LastContactThreshold of 10s is not less") {
+		t.Fatalf("bad: %v", warnings)
+	}
+}
+
+func TestOperator_ValidateConfig(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	state := s1.fsm.State()
+	_, before, err := state.AutopilotConfig()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	downPolicy := s1.config.ACLDownPolicy
+
+	// The down policy is bad, and the Autopilot threshold is longer than
+	// the election timeout.
+	arg := structs.ValidateConfigRequest{
+		Datacenter: "dc1",
+		Config: structs.ReloadableConfig{
+			ACLDownPolicy: "nope",
+			Autopilot: &structs.AutopilotConfig{
+				CleanupDeadServers:   !before.CleanupDeadServers,
+				LastContactThreshold: 2 * s1.config.RaftConfig.ElectionTimeout,
+			},
+		},
+	}
+	var reply structs.ValidateConfigReply
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ValidateConfig", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Errors) != 1 || !strings.Contains(reply.Errors[0], "down ACL policy") {
+		t.Fatalf("bad: %v", reply.Errors)
+	}
+	if len(reply.Warnings) != 1 || !strings.Contains(reply.Warnings[0], "election timeout") {
+		t.Fatalf("bad: %v", reply.Warnings)
+	}
+
+	// Nothing should have changed.
+	_, after, err := state.AutopilotConfig()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(after, before) {
+		t.Fatalf("bad: %#v", after)
+	}
+	if s1.config.ACLDownPolicy != downPolicy {
+		t.Fatalf("bad: %v", s1.config.ACLDownPolicy)
+	}
+}
+
+func TestOperator_ValidateConfig_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Try to validate without permission.
+	arg := structs.ValidateConfigRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.ValidateConfigReply
+	err := msgpackrpc.CallWithCodec(codec, "Operator.ValidateConfig", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The master token is allowed.
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ValidateConfig", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Errors) != 0 {
+		t.Fatalf("bad: %v", reply.Errors)
+	}
+}
@@ -0,0 +1,76 @@
+package consul
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// consistencyTokenVersion is the first byte of every consistency token, so
+// the format can change later without old tokens being misread.
+const consistencyTokenVersion = 1
+
+// encodeConsistencyToken returns an opaque token for the given Raft index.
+func encodeConsistencyToken(index uint64) string {
+	buf := make([]byte, 1+binary.MaxVarintLen64)
+	buf[0] = consistencyTokenVersion
+	n := binary.PutUvarint(buf[1:], index)
+	return base64.RawURLEncoding.EncodeToString(buf[:1+n])
+}
+
+// decodeConsistencyToken returns the Raft index from a token made by
+// encodeConsistencyToken.
+func decodeConsistencyToken(token string) (uint64, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buf) < 2 || buf[0] != consistencyTokenVersion {
+		return 0, fmt.Errorf("Invalid consistency token %q", token)
+	}
+	index, n := binary.Uvarint(buf[1:])
+	if n != len(buf)-1 {
+		return 0, fmt.Errorf("Invalid consistency token %q", token)
+	}
+	return index, nil
+}
+
+// waitForConsistencyToken blocks until this server has applied everything
+// up to the index in the query's consistency token, or the query's max time
+// runs out. The leader has always caught up, so this only ever waits on
+// followers serving stale reads.
+func (s *Server) waitForConsistencyToken(opts *structs.QueryOptions) error {
+	index, err := decodeConsistencyToken(opts.ConsistencyToken)
+	if err != nil {
+		return err
+	}
+	if s.fsm.AppliedIndex() >= index {
+		return nil
+	}
+
+	wait := opts.MaxQueryTime
+	if wait > maxQueryTime {
+		wait = maxQueryTime
+	} else if wait <= 0 {
+		wait = defaultQueryTime
+	}
+
+	defer metrics.MeasureSince([]string{"consul", "rpc", "consistency_wait"}, time.Now())
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		applied, appliedCh := s.fsm.AppliedIndexCh()
+		if applied >= index {
+			return nil
+		}
+		select {
+		case <-appliedCh:
+		case <-timeout.C:
+			metrics.IncrCounter([]string{"consul", "rpc", "consistency_timeout"}, 1)
+			return structs.ErrConsistencyTimeout
+		case <-s.shutdownCh:
+			return fmt.Errorf("shutdown waiting for consistency token")
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestConsistencyToken_EncodeDecode(t *testing.T) {
+	for _, index := range []uint64{0, 1, 127, 128, 1 << 40} {
+		token := encodeConsistencyToken(index)
+		got, err := decodeConsistencyToken(token)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if got != index {
+			t.Fatalf("bad: %d != %d", got, index)
+		}
+	}
+
+	for _, token := range []string{"", "nope!", "AQ", "Ag8", "AYCA"} {
+		if _, err := decodeConsistencyToken(token); err == nil {
+			t.Fatalf("token %q should be invalid", token)
+		}
+	}
+}
+
+func TestConsistencyToken_AppliedIndexCh(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The channel should only close once the index moves.
+	index, ch := fsm.AppliedIndexCh()
+	if index != 0 {
+		t.Fatalf("bad: %d", index)
+	}
+	select {
+	case <-ch:
+		t.Fatalf("should not be closed")
+	default:
+	}
+	fsm.setAppliedIndex(5)
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("should be closed")
+	}
+	if index, _ := fsm.AppliedIndexCh(); index != 5 {
+		t.Fatalf("bad: %d", index)
+	}
+}
+
+// waitForAgreedLeader waits until there's a leader that all the given
+// servers know about, and returns it.
+func waitForAgreedLeader(t *testing.T, servers []*Server) *Server {
+	var leader *Server
+	if err := testutil.WaitForResult(func() (bool, error) {
+		leader = nil
+		for _, s := range servers {
+			if s.IsLeader() {
+				leader = s
+			}
+		}
+		if leader == nil {
+			return false, fmt.Errorf("no leader")
+		}
+		addr := leader.raft.Leader()
+		for _, s := range servers {
+			if s.raft.Leader() != addr {
+				return false, fmt.Errorf("%s thinks the leader is %q, not %q",
+					s.config.NodeName, s.raft.Leader(), addr)
+			}
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return leader
+}
+
+func TestConsistencyToken_FollowerRead(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	dir3, s3 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir3)
+	defer s3.Shutdown()
+	servers := []*Server{s1, s2, s3}
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := s3.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, s := range servers {
+		if err := testutil.WaitForResult(func() (bool, error) {
+			peers, _ := s.numPeers()
+			return peers == 3, fmt.Errorf("%d", peers)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leader := waitForAgreedLeader(t, servers)
+	var follower *Server
+	for _, s := range servers {
+		if s != leader {
+			follower = s
+			break
+		}
+	}
+	lcodec := rpcClient(t, leader)
+	defer lcodec.Close()
+	fcodec := rpcClient(t, follower)
+	defer fcodec.Close()
+
+	// Each write on the leader should be visible right away on the
+	// follower when the token is passed along.
+	for i := 0; i < 20; i++ {
+		node := fmt.Sprintf("node%d", i)
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				Service: "web",
+				Port:    8000 + i,
+			},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(lcodec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		dc := structs.DCSpecificRequest{
+			Datacenter: "dc1",
+		}
+		var token string
+		if err := msgpackrpc.CallWithCodec(lcodec, "Status.ConsistencyToken", &dc, &token); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		req := structs.NodeSpecificRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			QueryOptions: structs.QueryOptions{
+				AllowStale:       true,
+				ConsistencyToken: token,
+			},
+		}
+		var services structs.IndexedNodeServices
+		if err := msgpackrpc.CallWithCodec(fcodec, "Catalog.NodeServices", &req, &services); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if services.ServerIsLeader || services.NodeServices == nil || len(services.NodeServices.Services) != 1 {
+			t.Fatalf("bad: %#v", services)
+		}
+	}
+
+	// A write sent to the follower is forwarded, and should come back with
+	// the leader's token.
+	arg := structs.OperatorTimersRequest{
+		Datacenter: "dc1",
+	}
+	var out structs.OperatorTimersReply
+	if err := msgpackrpc.CallWithCodec(fcodec, "Operator.SetTimersPaused", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	index, err := decodeConsistencyToken(out.ConsistencyToken)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	leader = waitForAgreedLeader(t, servers)
+	if applied := leader.fsm.AppliedIndex(); index == 0 || index > applied {
+		t.Fatalf("bad: %d > %d", index, applied)
+	}
+
+	// Writes without a structured reply can get a token afterwards, which
+	// is answered by the leader even when asked of the follower.
+	kv := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "test",
+			Value: []byte("hello"),
+		},
+	}
+	var ok bool
+	if err := msgpackrpc.CallWithCodec(fcodec, "KVS.Apply", &kv, &ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dc := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+		QueryOptions: structs.QueryOptions{
+			AllowStale: true,
+		},
+	}
+	var token string
+	if err := msgpackrpc.CallWithCodec(fcodec, "Status.ConsistencyToken", &dc, &token); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	get := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "test",
+		QueryOptions: structs.QueryOptions{
+			AllowStale:       true,
+			ConsistencyToken: token,
+		},
+	}
+	var entries structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(fcodec, "KVS.Get", &get, &entries); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries.Entries) != 1 || entries.ServerIsLeader {
+		t.Fatalf("bad: %#v", entries)
+	}
+
+	// Bad tokens are rejected.
+	req := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+		QueryOptions: structs.QueryOptions{
+			AllowStale:       true,
+			ConsistencyToken: "nope",
+		},
+	}
+	var nodes structs.IndexedNodes
+	err = msgpackrpc.CallWithCodec(fcodec, "Catalog.ListNodes", &req, &nodes)
+	if err == nil || !strings.Contains(err.Error(), "Invalid consistency token") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A token the follower can't catch up to times out.
+	req.ConsistencyToken = encodeConsistencyToken(leader.fsm.AppliedIndex() + 1000)
+	req.MaxQueryTime = 50 * time.Millisecond
+	start := time.Now()
+	err = msgpackrpc.CallWithCodec(fcodec, "Catalog.ListNodes", &req, &nodes)
+	if err == nil || err.Error() != structs.ErrConsistencyTimeout.Error() {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("took too long")
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/hashicorp/consul/consul/state"
 	"github.com/hashicorp/consul/consul/structs"
@@ -40,7 +39,7 @@ func NewCoordinate(srv *Server) *Coordinate {
 func (c *Coordinate) batchUpdate() {
 	for {
 		select {
-		case <-time.After(c.srv.config.CoordinateUpdatePeriod):
+		case <-c.srv.clock.After(c.srv.coordinateUpdatePeriod()):
 			if err := c.batchApplyUpdates(); err != nil {
 				c.srv.logger.Printf("[WARN] consul.coordinate: Batch update failed: %v", err)
 			}
@@ -121,7 +120,7 @@ func (c *Coordinate) Update(args *structs.CoordinateUpdateRequest, reply *struct
 	}
 
 	// Fetch the ACL token, if any, and enforce the node policy if enabled.
-	acl, err := c.srv.resolveToken(args.Token)
+	acl, err := c.srv.resolveToken("Coordinate.Update", args.Token)
 	if err != nil {
 		return err
 	}
@@ -147,6 +146,17 @@ func (c *Coordinate) ListDatacenters(args *struct{}, reply *[]structs.Datacenter
 		return err
 	}
 
+	// Leave out any datacenters that have been hidden.
+	if hidden := c.srv.hiddenDatacenters(); len(hidden) > 0 {
+		filtered := make([]structs.DatacenterMap, 0, len(maps))
+		for _, m := range maps {
+			if !hidden[m.Datacenter] {
+				filtered = append(filtered, m)
+			}
+		}
+		maps = filtered
+	}
+
 	// Strip the datacenter suffixes from all the node names.
 	for i := range maps {
 		suffix := fmt.Sprintf(".%s", maps[i].Datacenter)
@@ -176,9 +186,106 @@ func (c *Coordinate) ListNodes(args *structs.DCSpecificRequest, reply *structs.I
 			}
 
 			reply.Index, reply.Coordinates = index, coords
-			if err := c.srv.filterACL(args.Token, reply); err != nil {
+			if err := c.srv.filterACL("Coordinate.ListNodes", args.Token, reply); err != nil {
 				return err
 			}
 			return nil
 		})
 }
+
+// RTT returns the estimated round trip time between two nodes, computed
+// from their network coordinates.
+func (c *Coordinate) RTT(args *structs.CoordinateRTTRequest, reply *structs.IndexedCoordinateRTT) error {
+	if done, err := c.srv.forward("Coordinate.RTT", args, args, reply); done {
+		return err
+	}
+
+	if args.Target == "" {
+		return fmt.Errorf("Must provide target node")
+	}
+	return c.srv.blockingQuery(&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, state *state.StateStore) error {
+			index, rtts, err := c.computeRTTs("Coordinate.RTT", ws, state, args.Token, args.Source, []string{args.Target})
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.RTT = index, rtts[0]
+			return nil
+		})
+}
+
+// RTTBatch returns the estimated round trip times from a source node to
+// each of the given target nodes, computed from their network coordinates.
+func (c *Coordinate) RTTBatch(args *structs.CoordinateRTTBatchRequest, reply *structs.IndexedCoordinateRTTs) error {
+	if done, err := c.srv.forward("Coordinate.RTTBatch", args, args, reply); done {
+		return err
+	}
+
+	return c.srv.blockingQuery(&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, state *state.StateStore) error {
+			index, rtts, err := c.computeRTTs("Coordinate.RTTBatch", ws, state, args.Token, args.Source, args.Targets)
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.RTTs = index, rtts
+			return nil
+		})
+}
+
+// computeRTTs estimates the round trip times from the source node to each of
+// the targets. This returns an error if any of the nodes doesn't have a
+// coordinate, or if the coordinates aren't compatible with each other. The
+// endpoint is the one the ACL checks are made for.
+func (c *Coordinate) computeRTTs(endpoint string, ws memdb.WatchSet, state *state.StateStore,
+	token string, source string, targets []string) (uint64, []structs.CoordinateRTT, error) {
+	if source == "" {
+		return 0, nil, fmt.Errorf("Must provide source node")
+	}
+
+	// Fetch the ACL token, if any, and make sure it can read all the
+	// nodes involved if the node policy is enabled.
+	acl, err := c.srv.resolveToken(endpoint, token)
+	if err != nil {
+		return 0, nil, err
+	}
+	if acl != nil && c.srv.config.ACLEnforceVersion8 {
+		for _, node := range append([]string{source}, targets...) {
+			if !acl.NodeRead(node) {
+				return 0, nil, permissionDeniedErr
+			}
+		}
+	}
+
+	index, coords, err := state.Coordinates(ws)
+	if err != nil {
+		return 0, nil, err
+	}
+	lookup := make(map[string]*coordinate.Coordinate, len(coords))
+	for _, coord := range coords {
+		lookup[coord.Node] = coord.Coord
+	}
+
+	from, ok := lookup[source]
+	if !ok {
+		return 0, nil, fmt.Errorf("no coordinate available for node %q", source)
+	}
+	rtts := make([]structs.CoordinateRTT, 0, len(targets))
+	for _, target := range targets {
+		to, ok := lookup[target]
+		if !ok {
+			return 0, nil, fmt.Errorf("no coordinate available for node %q", target)
+		}
+		if !from.IsCompatibleWith(to) {
+			return 0, nil, fmt.Errorf("coordinates for nodes %q and %q are not compatible", source, target)
+		}
+		rtts = append(rtts, structs.CoordinateRTT{
+			Node: target,
+			RTT:  from.DistanceTo(to),
+		})
+	}
+	return index, rtts, nil
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/lib"
 	"github.com/hashicorp/consul/testutil"
 	"github.com/hashicorp/net-rpc-msgpackrpc"
 	"github.com/hashicorp/serf/coordinate"
@@ -509,3 +510,198 @@ node "foo" {
 		t.Fatalf("bad: %#v", resp.Coordinates)
 	}
 }
+
+func TestCoordinate_RTT(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Seed coordinates along a line so the distances are easy to work
+	// out. The "lonely" node doesn't get a coordinate.
+	offsets := map[string]time.Duration{
+		"foo": 0,
+		"bar": 5 * time.Millisecond,
+		"baz": 12 * time.Millisecond,
+	}
+	state := s1.fsm.State()
+	var updates structs.Coordinates
+	for i, node := range []string{"foo", "bar", "baz", "lonely"} {
+		if err := state.EnsureNode(uint64(i+1), &structs.Node{Node: node, Address: "127.0.0.1"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if offset, ok := offsets[node]; ok {
+			updates = append(updates, &structs.Coordinate{
+				Node:  node,
+				Coord: lib.GenerateCoordinate(offset),
+			})
+		}
+	}
+	if err := state.CoordinateBatchUpdate(5, updates); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	verifyRTT := func(rtt structs.CoordinateRTT, node string, expected time.Duration) {
+		if rtt.Node != node {
+			t.Fatalf("bad: %v", rtt)
+		}
+		if diff := rtt.RTT - expected; diff > time.Microsecond || diff < -time.Microsecond {
+			t.Fatalf("bad: %v != %v", rtt.RTT, expected)
+		}
+	}
+
+	// Ask for a single pair.
+	{
+		arg := structs.CoordinateRTTRequest{
+			Datacenter: "dc1",
+			Source:     "bar",
+			Target:     "baz",
+		}
+		var out structs.IndexedCoordinateRTT
+		if err := msgpackrpc.CallWithCodec(codec, "Coordinate.RTT", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out.Index != 5 {
+			t.Fatalf("bad: %v", out)
+		}
+		verifyRTT(out.RTT, "baz", 7*time.Millisecond)
+	}
+
+	// Ask for a batch.
+	{
+		arg := structs.CoordinateRTTBatchRequest{
+			Datacenter: "dc1",
+			Source:     "foo",
+			Targets:    []string{"baz", "foo", "bar"},
+		}
+		var out structs.IndexedCoordinateRTTs
+		if err := msgpackrpc.CallWithCodec(codec, "Coordinate.RTTBatch", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(out.RTTs) != 3 {
+			t.Fatalf("bad: %v", out)
+		}
+		verifyRTT(out.RTTs[0], "baz", 12*time.Millisecond)
+		verifyRTT(out.RTTs[1], "foo", 0)
+		verifyRTT(out.RTTs[2], "bar", 5*time.Millisecond)
+	}
+
+	// Missing coordinates should give an error for either side.
+	for _, arg := range []structs.CoordinateRTTRequest{
+		{Datacenter: "dc1", Source: "lonely", Target: "foo"},
+		{Datacenter: "dc1", Source: "foo", Target: "lonely"},
+		{Datacenter: "dc1", Source: "foo", Target: "nope"},
+	} {
+		var out structs.IndexedCoordinateRTT
+		err := msgpackrpc.CallWithCodec(codec, "Coordinate.RTT", &arg, &out)
+		if err == nil || !strings.Contains(err.Error(), "no coordinate available") {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// A single bad target should fail the whole batch.
+	{
+		arg := structs.CoordinateRTTBatchRequest{
+			Datacenter: "dc1",
+			Source:     "foo",
+			Targets:    []string{"bar", "lonely"},
+		}
+		var out structs.IndexedCoordinateRTTs
+		err := msgpackrpc.CallWithCodec(codec, "Coordinate.RTTBatch", &arg, &out)
+		if err == nil || !strings.Contains(err.Error(), `node "lonely"`) {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Give one node a coordinate with different dimensionality.
+	bad := lib.GenerateCoordinate(0)
+	bad.Vec = append(bad.Vec, 1.0)
+	if err := state.CoordinateBatchUpdate(6, structs.Coordinates{
+		&structs.Coordinate{Node: "lonely", Coord: bad},
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	{
+		arg := structs.CoordinateRTTRequest{
+			Datacenter: "dc1",
+			Source:     "foo",
+			Target:     "lonely",
+		}
+		var out structs.IndexedCoordinateRTT
+		err := msgpackrpc.CallWithCodec(codec, "Coordinate.RTT", &arg, &out)
+		if err == nil || !strings.Contains(err.Error(), "not compatible") {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func TestCoordinate_RTT_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+		c.ACLEnforceVersion8 = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	state := s1.fsm.State()
+	var updates structs.Coordinates
+	for i, node := range []string{"foo", "bar"} {
+		if err := state.EnsureNode(uint64(i+1), &structs.Node{Node: node, Address: "127.0.0.1"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		updates = append(updates, &structs.Coordinate{
+			Node:  node,
+			Coord: lib.GenerateCoordinate(time.Duration(i) * time.Millisecond),
+		})
+	}
+	if err := state.CoordinateBatchUpdate(3, updates); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Make a token that can only read one of the nodes.
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name: "User token",
+			Type: structs.ACLTypeClient,
+			Rules: `
+node "foo" {
+	policy = "read"
+}
+`,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.CoordinateRTTRequest{
+		Datacenter:   "dc1",
+		Source:       "foo",
+		Target:       "bar",
+		QueryOptions: structs.QueryOptions{Token: id},
+	}
+	var out structs.IndexedCoordinateRTT
+	err := msgpackrpc.CallWithCodec(codec, "Coordinate.RTT", &req, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The management token should work.
+	req.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Coordinate.RTT", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
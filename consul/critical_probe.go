@@ -0,0 +1,250 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/types"
+)
+
+const (
+	// CriticalProbeMetaKey is the service meta key that has the leader probe
+	// a service's instances directly, if set to "true". See
+	// CriticalProbeInterval.
+	CriticalProbeMetaKey = "CriticalProbe"
+
+	// CriticalProbeHTTPMetaKey is the service meta key that makes the probe
+	// an HTTP GET of the given path instead of a TCP connect. Any 2xx
+	// response counts as passing.
+	CriticalProbeHTTPMetaKey = "CriticalProbeHTTP"
+
+	// CriticalProbeCheckPrefix starts the ID of the check the leader keeps
+	// for each probed instance, which is followed by the service ID. These
+	// IDs are reserved, so agents can leave these checks alone during
+	// anti-entropy.
+	CriticalProbeCheckPrefix = "criticalProbe:"
+
+	// CriticalProbeCheckName is the name of the probe checks.
+	CriticalProbeCheckName = "Critical Service Probe"
+)
+
+// criticalProbeCheckID returns the ID of the probe check for the given
+// service.
+func criticalProbeCheckID(serviceID string) types.CheckID {
+	return types.CheckID(CriticalProbeCheckPrefix + serviceID)
+}
+
+// IsCriticalProbeCheck returns true if the given check is managed by the
+// leader's critical service probes.
+func IsCriticalProbeCheck(id types.CheckID) bool {
+	return strings.HasPrefix(string(id), CriticalProbeCheckPrefix)
+}
+
+// criticalProbeTarget identifies a probed service instance.
+type criticalProbeTarget struct {
+	node    string
+	service string
+}
+
+// criticalProber keeps track of how the leader's last pass went.
+type criticalProber struct {
+	// overCap is whether there were more instances to probe than allowed
+	// on the last pass, so we only warn when that starts.
+	overCap bool
+}
+
+// runCriticalProber periodically probes the service instances that have
+// asked for it. This runs until leadership is lost.
+func (s *Server) runCriticalProber(stopCh chan struct{}) {
+	ticker := s.clock.NewTicker(s.config.CriticalProbeInterval)
+	defer ticker.Stop()
+
+	p := &criticalProber{}
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-s.shutdownCh:
+			return
+		case <-ticker.C():
+		}
+
+		if err := s.probeCriticalServices(p); err != nil {
+			s.logger.Printf("[ERR] consul: failed to probe critical services: %v", err)
+		}
+	}
+}
+
+// probeCriticalServices probes each instance with the CriticalProbeMetaKey
+// meta set, up to CriticalProbeMaxInstances of them, and updates their probe
+// checks. The catalog is only written to when a check's status changes.
+// Any other probe checks in the catalog have been left behind, by this
+// leader or an earlier one, and are removed.
+func (s *Server) probeCriticalServices(p *criticalProber) error {
+	defer metrics.MeasureSince([]string{"consul", "leader", "probeCriticalServices"}, time.Now())
+
+	state := s.fsm.State()
+	_, instances, err := state.ServiceNodesByMeta(nil, CriticalProbeMetaKey, "true")
+	if err != nil {
+		return err
+	}
+
+	// Sort the instances so the same ones are left out each pass when
+	// there are too many.
+	sort.Slice(instances, func(i, j int) bool {
+		if instances[i].Node != instances[j].Node {
+			return instances[i].Node < instances[j].Node
+		}
+		return instances[i].ServiceID < instances[j].ServiceID
+	})
+	max := s.config.CriticalProbeMaxInstances
+	overCap := len(instances) > max
+	if overCap {
+		if !p.overCap {
+			s.logger.Printf("[WARN] consul: %d service instances want critical probes, only probing the first %d",
+				len(instances), max)
+		}
+		instances = instances[:max]
+	}
+	p.overCap = overCap
+	metrics.SetGauge([]string{"consul", "leader", "critical_probe", "instances"}, float32(len(instances)))
+
+	timeout := s.config.CriticalProbeTimeout
+	if timeout <= 0 || timeout > s.config.CriticalProbeInterval {
+		timeout = s.config.CriticalProbeInterval
+	}
+
+	// Run the probes in parallel so a few slow instances don't hold up
+	// the rest.
+	type result struct {
+		status string
+		output string
+	}
+	results := make([]result, len(instances))
+	var wg sync.WaitGroup
+	for i, sn := range instances {
+		wg.Add(1)
+		go func(i int, sn *structs.ServiceNode) {
+			defer wg.Done()
+			results[i].status, results[i].output = probeCriticalService(sn, timeout)
+		}(i, sn)
+	}
+	wg.Wait()
+
+	probed := make(map[criticalProbeTarget]struct{}, len(instances))
+	for i, sn := range instances {
+		target := criticalProbeTarget{sn.Node, sn.ServiceID}
+		probed[target] = struct{}{}
+		if err := s.updateCriticalProbeCheck(sn, results[i].status, results[i].output); err != nil {
+			return err
+		}
+	}
+
+	// Clean up the checks for instances that aren't being probed.
+	_, checks, err := state.ChecksByIDPrefix(nil, CriticalProbeCheckPrefix)
+	if err != nil {
+		return err
+	}
+	for _, check := range checks {
+		if _, ok := probed[criticalProbeTarget{check.Node, check.ServiceID}]; ok {
+			continue
+		}
+		s.logger.Printf("[INFO] consul: no longer probing service '%s' on node '%s'", check.ServiceID, check.Node)
+		req := structs.DeregisterRequest{
+			Datacenter: s.config.Datacenter,
+			Node:       check.Node,
+			CheckID:    check.CheckID,
+		}
+		if _, err := s.raftApply(structs.DeregisterRequestType, &req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateCriticalProbeCheck registers the probe check for the given instance
+// if its status has changed.
+func (s *Server) updateCriticalProbeCheck(sn *structs.ServiceNode, status, output string) error {
+	checkID := criticalProbeCheckID(sn.ServiceID)
+	_, check, err := s.fsm.State().NodeCheck(sn.Node, checkID)
+	if err != nil {
+		return err
+	}
+	if check != nil && check.Status == status {
+		return nil
+	}
+
+	if status == structs.HealthCritical {
+		s.logger.Printf("[WARN] consul: probe failed for service '%s' on node '%s', marking health critical: %s",
+			sn.ServiceID, sn.Node, output)
+		metrics.IncrCounter([]string{"consul", "leader", "critical_probe", "failed"}, 1)
+	}
+	req := structs.RegisterRequest{
+		Datacenter: s.config.Datacenter,
+		Node:       sn.Node,
+		Address:    sn.Address,
+		Check: &structs.HealthCheck{
+			Node:        sn.Node,
+			CheckID:     checkID,
+			Name:        CriticalProbeCheckName,
+			Status:      status,
+			Output:      output,
+			ServiceID:   sn.ServiceID,
+			ServiceName: sn.ServiceName,
+		},
+
+		// The node is already registered, so leave it alone.
+		SkipNodeUpdate: true,
+	}
+	_, err = s.raftApply(structs.RegisterRequestType, &req)
+	return err
+}
+
+// probeCriticalService connects to the given instance, and returns the status
+// and output for its probe check. This always goes to the node's address,
+// rather than the service address, since a token that can only register the
+// service could otherwise point the leader at any address it likes.
+func probeCriticalService(sn *structs.ServiceNode, timeout time.Duration) (string, string) {
+	if sn.ServicePort == 0 {
+		return structs.HealthCritical, "Service has no port to probe"
+	}
+	target := net.JoinHostPort(sn.Address, strconv.Itoa(sn.ServicePort))
+
+	path, ok := sn.ServiceMeta[CriticalProbeHTTPMetaKey]
+	if !ok {
+		conn, err := net.DialTimeout("tcp", target, timeout)
+		if err != nil {
+			return structs.HealthCritical, fmt.Sprintf("TCP connect %s: %v", target, err)
+		}
+		conn.Close()
+		return structs.HealthPassing, fmt.Sprintf("TCP connect %s: Success", target)
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	url := fmt.Sprintf("http://%s%s", target, path)
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return structs.HealthCritical, fmt.Sprintf("HTTP GET %s: %v", url, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return structs.HealthCritical, fmt.Sprintf("HTTP GET %s: %s", url, resp.Status)
+	}
+	return structs.HealthPassing, fmt.Sprintf("HTTP GET %s: %s", url, resp.Status)
+}
@@ -0,0 +1,252 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/consul/types"
+)
+
+// testRegisterProbedService registers a service on the given node that asks
+// to be probed at the given address.
+func testRegisterProbedService(t *testing.T, s *Server, node, id, addr string, meta map[string]string) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       node,
+		Address:    host,
+		Service: &structs.NodeService{
+			ID:      id,
+			Service: id,
+			Port:    port,
+			Meta:    meta,
+		},
+	}
+	var out struct{}
+	if err := s.RPC("Catalog.Register", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// waitForProbeStatus waits for the probe check of the given service to have
+// the given status, returning when it first saw it.
+func waitForProbeStatus(t *testing.T, s *Server, node, id, status string) time.Time {
+	var seen time.Time
+	if err := testutil.WaitForResult(func() (bool, error) {
+		_, check, err := s.fsm.State().NodeCheck(node, criticalProbeCheckID(id))
+		if err != nil {
+			return false, err
+		}
+		if check == nil {
+			return false, fmt.Errorf("no probe check")
+		}
+		seen = time.Now()
+		return check.Status == status, fmt.Errorf("status is %q", check.Status)
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return seen
+}
+
+func TestLeader_CriticalProbe(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.CriticalProbeInterval = 50 * time.Millisecond
+		c.CriticalProbeTimeout = 50 * time.Millisecond
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Stand up a listener for the service.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// Register a probed service, and one that didn't ask for it.
+	meta := map[string]string{CriticalProbeMetaKey: "true"}
+	testRegisterProbedService(t, s1, "foo", "db", ln.Addr().String(), meta)
+	testRegisterProbedService(t, s1, "foo", "web", ln.Addr().String(), nil)
+	waitForProbeStatus(t, s1, "foo", "db", structs.HealthPassing)
+	_, check, err := s1.fsm.State().NodeCheck("foo", criticalProbeCheckID("web"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if check != nil {
+		t.Fatalf("bad: %#v", check)
+	}
+
+	// Closing the listener should flip the check well before Serf's
+	// suspicion timeout would have with the default settings.
+	start := time.Now()
+	ln.Close()
+	failed := waitForProbeStatus(t, s1, "foo", "db", structs.HealthCritical)
+	memberlist := DefaultConfig().SerfLANConfig.MemberlistConfig
+	suspicion := time.Duration(memberlist.SuspicionMult) * memberlist.ProbeInterval
+	if elapsed := failed.Sub(start); elapsed >= suspicion/2 {
+		t.Fatalf("took %v to fail, serf suspicion is %v", elapsed, suspicion)
+	}
+
+	// The check should show up with the service's health.
+	_, checks, err := s1.fsm.State().ServiceChecks(nil, "db")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(checks) != 1 || checks[0].Name != CriticalProbeCheckName || checks[0].ServiceID != "db" {
+		t.Fatalf("bad: %#v", checks)
+	}
+
+	// Dropping the meta should remove the check.
+	testRegisterProbedService(t, s1, "foo", "db", ln.Addr().String(), nil)
+	if err := testutil.WaitForResult(func() (bool, error) {
+		_, check, err := s1.fsm.State().NodeCheck("foo", criticalProbeCheckID("db"))
+		return check == nil, err
+	}); err != nil {
+		t.Fatalf("probe check should be gone")
+	}
+}
+
+func TestLeader_CriticalProbe_HTTP(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.CriticalProbeInterval = 50 * time.Millisecond
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	var healthy int32 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	meta := map[string]string{
+		CriticalProbeMetaKey:     "true",
+		CriticalProbeHTTPMetaKey: "health",
+	}
+	testRegisterProbedService(t, s1, "foo", "db", srv.Listener.Addr().String(), meta)
+	waitForProbeStatus(t, s1, "foo", "db", structs.HealthPassing)
+
+	// A bad status should fail the check even though the port is open.
+	atomic.StoreInt32(&healthy, 0)
+	waitForProbeStatus(t, s1, "foo", "db", structs.HealthCritical)
+	atomic.StoreInt32(&healthy, 1)
+	waitForProbeStatus(t, s1, "foo", "db", structs.HealthPassing)
+}
+
+func TestLeader_CriticalProbe_MaxInstances(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.CriticalProbeInterval = 50 * time.Millisecond
+		c.CriticalProbeMaxInstances = 2
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Nothing is listening on these, so they'll all fail, but only the
+	// first two get probed.
+	meta := map[string]string{CriticalProbeMetaKey: "true"}
+	for _, id := range []string{"a", "b", "c"} {
+		testRegisterProbedService(t, s1, "foo", id, "127.0.0.1:1", meta)
+	}
+	waitForProbeStatus(t, s1, "foo", "a", structs.HealthCritical)
+	waitForProbeStatus(t, s1, "foo", "b", structs.HealthCritical)
+	time.Sleep(200 * time.Millisecond)
+	_, checks, err := s1.fsm.State().NodeChecks(nil, "foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var ids []types.CheckID
+	for _, check := range checks {
+		ids = append(ids, check.CheckID)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("bad: %v", ids)
+	}
+}
+
+func TestLeader_CriticalProbe_StaleChecks(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.CriticalProbeInterval = 50 * time.Millisecond
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Leave a probe check behind for a service that doesn't want probing
+	// any more, like an earlier leader might have.
+	testRegisterProbedService(t, s1, "foo", "db", "127.0.0.1:1", nil)
+	req := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Check: &structs.HealthCheck{
+			Node:      "foo",
+			CheckID:   criticalProbeCheckID("db"),
+			Name:      CriticalProbeCheckName,
+			Status:    structs.HealthCritical,
+			ServiceID: "db",
+		},
+		SkipNodeUpdate: true,
+	}
+	if _, err := s1.raftApply(structs.RegisterRequestType, &req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The leader should clean it up.
+	if err := testutil.WaitForResult(func() (bool, error) {
+		_, check, err := s1.fsm.State().NodeCheck("foo", criticalProbeCheckID("db"))
+		return check == nil, err
+	}); err != nil {
+		t.Fatalf("probe check should be gone")
+	}
+
+	// The probe check IDs can't be registered through the catalog.
+	req.Address = "127.0.0.1"
+	var out struct{}
+	err := s1.RPC("Catalog.Register", &req, &out)
+	if err == nil || !strings.Contains(err.Error(), "reserved") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestIsCriticalProbeCheck(t *testing.T) {
+	if !IsCriticalProbeCheck(criticalProbeCheckID("db")) {
+		t.Fatalf("bad")
+	}
+	if IsCriticalProbeCheck(SerfCheckID) {
+		t.Fatalf("bad")
+	}
+}
@@ -0,0 +1,128 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dataDirLockFile is the file in the data directory that's locked while a
+// server is using it.
+const dataDirLockFile = "server.lock"
+
+// errDataDirLocked is returned by lockFile when another process holds the
+// lock.
+var errDataDirLocked = fmt.Errorf("data dir is locked")
+
+// dataDirLockInfo is written into the lock file by the owner of the lock, so
+// a server that can't get the lock can say who has it.
+type dataDirLockInfo struct {
+	PID      int
+	Since    time.Time
+	NodeName string
+}
+
+// dataDirLock is an exclusive advisory lock on a server's data directory.
+// Two servers sharing a data directory will corrupt each other's Raft and
+// Serf state, so a server holds this for as long as it's running. The lock
+// is taken by the OS, so it goes away if the process dies without releasing
+// it.
+type dataDirLock struct {
+	file *os.File
+}
+
+// lockDataDir takes the lock on the given data directory, creating it if
+// needed. If another process has it, the error says which one and since
+// when.
+func lockDataDir(dir, nodeName string, logger *log.Logger) (*dataDirLock, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data dir: %v", err)
+	}
+
+	path := filepath.Join(dir, dataDirLockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data dir lock: %v", err)
+	}
+
+	// Whatever's in the file was written by the last owner of the lock.
+	prev := readDataDirLockInfo(f)
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if err != errDataDirLocked {
+			return nil, fmt.Errorf("failed to lock data dir: %v", err)
+		}
+		if prev == nil {
+			return nil, fmt.Errorf("data dir %q in use by another process", dir)
+		}
+		return nil, fmt.Errorf("data dir %q in use by PID %d since %s",
+			dir, prev.PID, prev.Since.Format(time.RFC3339))
+	}
+
+	// If we got the lock but the file still names an owner, that owner
+	// went away without cleaning up, such as after a crash.
+	if prev != nil && prev.PID != 0 && !processAlive(prev.PID) {
+		logger.Printf("[WARN] consul: Recovered stale data dir lock left by PID %d (since %s)",
+			prev.PID, prev.Since.Format(time.RFC3339))
+	}
+
+	info := dataDirLockInfo{
+		PID:      os.Getpid(),
+		Since:    time.Now().UTC(),
+		NodeName: nodeName,
+	}
+	if err := writeDataDirLockInfo(f, &info); err != nil {
+		unlockFile(f)
+		f.Close()
+		return nil, fmt.Errorf("failed to write data dir lock: %v", err)
+	}
+	return &dataDirLock{file: f}, nil
+}
+
+// Release clears the owner from the lock file and gives up the lock.
+func (l *dataDirLock) Release() error {
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := unlockFile(l.file); err != nil {
+		return err
+	}
+	return l.file.Close()
+}
+
+// readDataDirLockInfo returns the owner written into the lock file, or nil if
+// there isn't one.
+func readDataDirLockInfo(f *os.File) *dataDirLockInfo {
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil
+	}
+	buf, err := ioutil.ReadAll(f)
+	if err != nil || len(buf) == 0 {
+		return nil
+	}
+	var info dataDirLockInfo
+	if err := json.Unmarshal(buf, &info); err != nil {
+		return nil
+	}
+	return &info
+}
+
+// writeDataDirLockInfo replaces the contents of the lock file with the given
+// owner.
+func writeDataDirLockInfo(f *os.File, info *dataDirLockInfo) error {
+	buf, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,28 @@
+// +build !windows
+
+package consul
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock on the file without blocking.
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errDataDirLocked
+	}
+	return err
+}
+
+// unlockFile releases the flock on the file.
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+// processAlive returns true if there's a process with the given PID.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,66 @@
+// +build windows
+
+package consul
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x00000001
+	lockfileExclusiveLock   = 0x00000002
+
+	// errLockViolation is returned by LockFileEx when another process
+	// holds the lock.
+	errLockViolation syscall.Errno = 0x21
+
+	// lockOffsetHigh puts the locked byte well past the end of the file.
+	// Windows locks are mandatory, so locking the contents would stop
+	// other servers from reading who holds the lock.
+	lockOffsetHigh = 0x7fffffff
+)
+
+// lockFile takes an exclusive lock on the file without blocking.
+func lockFile(f *os.File) error {
+	ol := syscall.Overlapped{OffsetHigh: lockOffsetHigh}
+	r, _, err := procLockFileEx.Call(f.Fd(),
+		uintptr(lockfileExclusiveLock|lockfileFailImmediately), 0, 1, 0,
+		uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		if err == errLockViolation {
+			return errDataDirLocked
+		}
+		return err
+	}
+	return nil
+}
+
+// unlockFile releases the lock on the file.
+func unlockFile(f *os.File) error {
+	ol := syscall.Overlapped{OffsetHigh: lockOffsetHigh}
+	r, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0,
+		uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// processAlive returns true if there's a process with the given PID. Finding
+// a process on Windows opens a handle to it, which fails if it's gone.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,100 @@
+package consul
+
+import (
+	"github.com/hashicorp/consul/consul/agent"
+	"github.com/hashicorp/consul/types"
+	"github.com/hashicorp/serf/serf"
+)
+
+// isDatacenterDecommissioned returns true if the given datacenter has been
+// marked as decommissioned. This is used by the WAN merge delegate, so it
+// errs on the side of letting servers in if the state can't be read.
+func (s *Server) isDatacenterDecommissioned(dc string) bool {
+	if s.fsm == nil {
+		return false
+	}
+	_, policy, err := s.fsm.State().FederationPolicyGet(nil, dc)
+	if err != nil {
+		s.logger.Printf("[WARN] consul: Failed to look up federation policy for datacenter %q: %v", dc, err)
+		return false
+	}
+	return policy != nil && policy.IsDecommissioned()
+}
+
+// hiddenDatacenters returns the datacenters that have been decommissioned and
+// hidden, which are left out of the datacenter listings.
+func (s *Server) hiddenDatacenters() map[string]bool {
+	_, policies, err := s.fsm.State().FederationPolicyList(nil)
+	if err != nil {
+		s.logger.Printf("[WARN] consul: Failed to list federation policies: %v", err)
+		return nil
+	}
+	hidden := make(map[string]bool)
+	for _, policy := range policies {
+		if policy.IsDecommissioned() && policy.Hidden {
+			hidden[policy.Datacenter] = true
+		}
+	}
+	return hidden
+}
+
+// filterHiddenDatacenters returns the given datacenters without the hidden
+// ones.
+func (s *Server) filterHiddenDatacenters(dcs []string) []string {
+	hidden := s.hiddenDatacenters()
+	if len(hidden) == 0 {
+		return dcs
+	}
+
+	filtered := make([]string, 0, len(dcs))
+	for _, dc := range dcs {
+		if !hidden[dc] {
+			filtered = append(filtered, dc)
+		}
+	}
+	return filtered
+}
+
+// datacenterWANServers returns the WAN members that are servers in the given
+// datacenter and haven't left.
+func (s *Server) datacenterWANServers(dc string) []serf.Member {
+	wan := s.getSerfWAN()
+	if wan == nil {
+		return nil
+	}
+
+	var members []serf.Member
+	for _, m := range wan.Members() {
+		ok, parts := agent.IsConsulServer(m)
+		if !ok || parts.Datacenter != dc || m.Status == serf.StatusLeft {
+			continue
+		}
+		members = append(members, m)
+	}
+	return members
+}
+
+// purgeDatacenter force-leaves the given datacenter's servers from the WAN
+// pool and takes them out of the router, returning their names. Servers that
+// are still alive will refute the leave, so the datacenter should be shut
+// down first.
+func (s *Server) purgeDatacenter(dc string) ([]string, error) {
+	wan := s.getSerfWAN()
+	if wan == nil {
+		return nil, nil
+	}
+
+	var names []string
+	for _, m := range s.datacenterWANServers(dc) {
+		if err := wan.RemoveFailedNode(m.Name); err != nil {
+			return names, err
+		}
+		if _, parts := agent.IsConsulServer(m); parts != nil {
+			if err := s.router.RemoveServer(types.AreaWAN, parts); err != nil {
+				return names, err
+			}
+		}
+		names = append(names, m.Name)
+	}
+	return names, nil
+}
@@ -0,0 +1,266 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestOperator_DecommissionDatacenter(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerDC(t, "dc2")
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s1.RPC, "dc2")
+
+	// Confirming before the datacenter is marked should fail.
+	arg := structs.DecommissionDatacenterRequest{
+		Datacenter:   "dc1",
+		Decommission: "dc2",
+		Confirm:      true,
+	}
+	var reply structs.DecommissionDatacenterReply
+	err := msgpackrpc.CallWithCodec(codec, "Operator.DecommissionDatacenter", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), "must be marked") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The local datacenter can't be decommissioned.
+	local := structs.DecommissionDatacenterRequest{
+		Datacenter:   "dc1",
+		Decommission: "dc1",
+	}
+	err = msgpackrpc.CallWithCodec(codec, "Operator.DecommissionDatacenter", &local, &reply)
+	if err == nil || !strings.Contains(err.Error(), "Cannot decommission this datacenter") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Mark dc2 and hide it, which should report its server.
+	arg.Confirm, arg.Hide = false, true
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.DecommissionDatacenter", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.State != structs.DecommissionMarked ||
+		len(reply.Servers) != 1 || reply.Servers[0] != s2.config.NodeName+".dc2" {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	// Nothing should be forwarded to dc2 anymore.
+	list := structs.DCSpecificRequest{
+		Datacenter: "dc2",
+	}
+	var nodes structs.IndexedNodes
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &list, &nodes)
+	if !structs.HasErrorCode(err, structs.ErrCodeFederationPolicy) || !strings.Contains(err.Error(), "decommissioned") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Setting a federation policy shouldn't take the mark off.
+	policy := structs.FederationPolicyRequest{
+		Datacenter: "dc1",
+		Op:         structs.FederationPolicySet,
+		Policy: structs.FederationPolicy{
+			Datacenter: "dc2",
+			Forwarding: structs.FederationForwardAll,
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.FederationPolicyApply", &policy, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &list, &nodes)
+	if !structs.HasErrorCode(err, structs.ErrCodeFederationPolicy) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// It should be left out of the datacenter listings.
+	var dcs []string
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListDatacenters", struct{}{}, &dcs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dcs) != 1 || dcs[0] != "dc1" {
+		t.Fatalf("bad: %v", dcs)
+	}
+	var maps []structs.DatacenterMap
+	if err := msgpackrpc.CallWithCodec(codec, "Coordinate.ListDatacenters", struct{}{}, &maps); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(maps) != 1 || maps[0].Datacenter != "dc1" {
+		t.Fatalf("bad: %v", maps)
+	}
+
+	// And it shouldn't be offered for prepared query failover.
+	wrapper := &queryServerWrapper{s1}
+	others, err := wrapper.GetOtherDatacentersByDistance()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(others) != 0 {
+		t.Fatalf("bad: %v", others)
+	}
+
+	// Its server should still be in the WAN pool though.
+	if _, _, ok := s1.router.FindRoute("dc2"); !ok {
+		t.Fatalf("dc2 should still have a route")
+	}
+
+	// Shut dc2 down and wait for it to be seen as failed, then confirm.
+	s2.Shutdown()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		for _, m := range s1.WANMembers() {
+			if m.Tags["dc"] == "dc2" && m.Status != serf.StatusFailed {
+				return false, fmt.Errorf("%s is %s", m.Name, m.Status)
+			}
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Confirm = true
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.DecommissionDatacenter", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.State != structs.DecommissionPurged ||
+		len(reply.Servers) != 1 || reply.Servers[0] != s2.config.NodeName+".dc2" {
+		t.Fatalf("bad: %#v", reply)
+	}
+	if _, _, ok := s1.router.FindRoute("dc2"); ok {
+		t.Fatalf("dc2 should not have a route")
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		for _, m := range s1.WANMembers() {
+			if m.Tags["dc"] == "dc2" && m.Status != serf.StatusLeft {
+				return false, fmt.Errorf("%s is %s", m.Name, m.Status)
+			}
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A new dc2 server shouldn't be able to join the WAN pool.
+	dir3, s3 := testServerDC(t, "dc2")
+	defer os.RemoveAll(dir3)
+	defer s3.Shutdown()
+	addr3 := fmt.Sprintf("127.0.0.1:%d",
+		s3.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s1.JoinWAN([]string{addr3}); err == nil {
+		t.Fatalf("should have been refused")
+	}
+	if _, _, ok := s1.router.FindRoute("dc2"); ok {
+		t.Fatalf("dc2 should not have a route")
+	}
+
+	// Once the mark is cleared it can join, and shows up again.
+	clear := structs.DecommissionDatacenterRequest{
+		Datacenter:   "dc1",
+		Decommission: "dc2",
+		Clear:        true,
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.DecommissionDatacenter", &clear, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.State != structs.DecommissionNone {
+		t.Fatalf("bad: %#v", reply)
+	}
+	if _, err := s1.JoinWAN([]string{addr3}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc2")
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListDatacenters", struct{}{}, &dcs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dcs) != 2 {
+		t.Fatalf("bad: %v", dcs)
+	}
+}
+
+func TestOperator_DecommissionDatacenter_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Make a request with no token to make sure it gets denied.
+	arg := structs.DecommissionDatacenterRequest{
+		Datacenter:   "dc1",
+		Decommission: "dc2",
+	}
+	var reply structs.DecommissionDatacenterReply
+	err := msgpackrpc.CallWithCodec(codec, "Operator.DecommissionDatacenter", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// An operator read token isn't enough either.
+	arg.Token = makeTestToken(t, codec, `operator = "read"`, 0)
+	err = msgpackrpc.CallWithCodec(codec, "Operator.DecommissionDatacenter", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Now it should go through with an operator write token.
+	arg.Token = makeTestToken(t, codec, `operator = "write"`, 0)
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.DecommissionDatacenter", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.State != structs.DecommissionMarked {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestWANMergeDelegate_Decommissioned(t *testing.T) {
+	member := func(name, dc string) *serf.Member {
+		return &serf.Member{
+			Name: name + "." + dc,
+			Tags: map[string]string{
+				"role":  "consul",
+				"dc":    dc,
+				"port":  "8300",
+				"vsn":   "2",
+				"build": "0.8.0",
+			},
+		}
+	}
+	md := &wanMergeDelegate{
+		decommissioned: func(dc string) bool { return dc == "dc2" },
+	}
+
+	// A lone member from a decommissioned datacenter is refused.
+	if err := md.NotifyMerge([]*serf.Member{member("a", "dc2")}); err == nil {
+		t.Fatalf("should have been refused")
+	}
+
+	// A merge with other members goes through.
+	if err := md.NotifyMerge([]*serf.Member{member("a", "dc2"), member("b", "dc3")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := md.NotifyMerge([]*serf.Member{member("b", "dc3")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
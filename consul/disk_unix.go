@@ -0,0 +1,17 @@
+// +build !windows
+
+package consul
+
+import (
+	"syscall"
+)
+
+// diskFree returns the number of bytes free for unprivileged users on the
+// filesystem holding the given path.
+func diskFree(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,157 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/agent"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// drainTag is the Serf tag set on a server while it's draining.
+const drainTag = "drain"
+
+// IsDraining returns true if the server is in drain mode.
+func (s *Server) IsDraining() bool {
+	s.drainingLock.RLock()
+	defer s.drainingLock.RUnlock()
+	return s.draining
+}
+
+// SetDraining puts the server into drain mode, or takes it out again. While
+// it's draining, the server turns away requests that come straight from
+// clients with ErrDraining, including the Status.Ping health probes the
+// servers manager on agents uses, so agents move on to other servers. Raft,
+// Serf, and requests forwarded by other servers carry on as usual, so the
+// server still counts towards quorum.
+func (s *Server) SetDraining(draining bool) error {
+	s.drainingLock.Lock()
+	defer s.drainingLock.Unlock()
+	if s.draining == draining {
+		return nil
+	}
+
+	// Advertise the change in both pools.
+	if err := setDrainTag(s.serfLAN.LocalMember().Tags, draining, s.serfLAN.SetTags); err != nil {
+		return err
+	}
+	if wan := s.getSerfWAN(); wan != nil {
+		if err := setDrainTag(wan.LocalMember().Tags, draining, wan.SetTags); err != nil {
+			return err
+		}
+	}
+
+	s.draining = draining
+	if draining {
+		s.logger.Printf("[WARN] consul: Server is draining, client requests will be refused")
+		metrics.SetGauge([]string{"consul", "server", "draining"}, 1)
+	} else {
+		s.logger.Printf("[INFO] consul: Server is no longer draining")
+		metrics.SetGauge([]string{"consul", "server", "draining"}, 0)
+	}
+	return nil
+}
+
+// setDrainTag sets or clears the drain tag on a copy of the given tags, and
+// passes them to the given setter.
+func setDrainTag(tags map[string]string, draining bool, set func(map[string]string) error) error {
+	updated := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		updated[k] = v
+	}
+	if draining {
+		updated[drainTag] = "1"
+	} else {
+		delete(updated, drainTag)
+	}
+	return set(updated)
+}
+
+// drainRejects returns true if a request that came in over the network from
+// the given source address should be turned away because the server is
+// draining. Health probes and requests that don't come from another known
+// server are refused. Requests that don't carry RPC info, like the Status
+// endpoints other servers use, are let through, as is the request to stop
+// draining.
+func (s *Server) drainRejects(source net.Addr, method string, body interface{}) bool {
+	if !s.IsDraining() {
+		return false
+	}
+
+	switch method {
+	case "Status.Ping":
+		return true
+	case "Operator.SetDraining":
+		return false
+	}
+
+	if _, ok := body.(structs.RPCInfo); !ok {
+		return false
+	}
+	return !s.isServerSource(source)
+}
+
+// isServerSource returns true if the given remote address belongs to one of
+// the other servers this server knows about in the LAN or WAN pool. The hop
+// count in a request is set by whoever sent it, so the connection is the
+// only thing a client can't fake. This server never dials itself, so its
+// own address doesn't count, which keeps clients running on the same host
+// from getting through.
+func (s *Server) isServerSource(source net.Addr) bool {
+	tcp, ok := source.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	if tcp.IP.Equal(s.serfLAN.LocalMember().Addr) {
+		return false
+	}
+
+	s.localLock.RLock()
+	for _, server := range s.localConsuls {
+		if addr, ok := server.Addr.(*net.TCPAddr); ok && addr.IP.Equal(tcp.IP) {
+			s.localLock.RUnlock()
+			return true
+		}
+	}
+	s.localLock.RUnlock()
+
+	if wan := s.getSerfWAN(); wan != nil {
+		for _, m := range wan.Members() {
+			if ok, _ := agent.IsConsulServer(m); ok && m.Addr.Equal(tcp.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forwardServer is used to forward an RPC call to the named server in the
+// local datacenter. Like forward, it counts the hop in the request's trace
+// and refuses requests that look to be stuck in a forwarding loop.
+func (s *Server) forwardServer(name, method string, args structs.RPCInfo, reply interface{}) error {
+	id, hops := args.RequestTrace()
+	if hops > maxForwardHops {
+		return fmt.Errorf("RPC request forwarded too many times (%d hops), possible forwarding loop", hops)
+	}
+	args.SetRequestTrace(id, hops+1)
+
+	var server *agent.Server
+	s.localLock.RLock()
+	for _, parts := range s.localConsuls {
+		if parts.Name == name {
+			server = parts
+			break
+		}
+	}
+	s.localLock.RUnlock()
+	if server == nil {
+		return fmt.Errorf("Unknown server %q", name)
+	}
+
+	if err := s.connPool.RPC(s.config.Datacenter, server.Addr, server.Version, method, args, reply); err != nil {
+		return err
+	}
+	setReplyForwarded(reply, server)
+	return nil
+}
@@ -0,0 +1,213 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestOperator_SetDraining(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	dir3, s3 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir3)
+	defer s3.Shutdown()
+	servers := []*Server{s1, s2, s3}
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := s3.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, s := range servers {
+		if err := testutil.WaitForResult(func() (bool, error) {
+			peers, _ := s.numPeers()
+			return peers == 3, fmt.Errorf("%d", peers)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Drain the follower by sending the request to the leader, which
+	// should pass it along.
+	arg := structs.OperatorDrainRequest{
+		Datacenter: "dc1",
+		Node:       s2.config.NodeName,
+		Draining:   true,
+	}
+	var reply structs.OperatorDrainReply
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.SetDraining", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Node != s2.config.NodeName || !reply.Draining || !s2.IsDraining() || s1.IsDraining() {
+		t.Fatalf("bad: %#v", reply)
+	}
+	if s2.Stats()["consul"]["draining"] != "true" {
+		t.Fatalf("bad: %v", s2.Stats()["consul"])
+	}
+
+	// The other servers should see the tag.
+	if err := testutil.WaitForResult(func() (bool, error) {
+		for _, m := range s1.LANMembers() {
+			if m.Name == s2.config.NodeName {
+				return m.Tags[drainTag] == "1", fmt.Errorf("bad: %v", m.Tags)
+			}
+		}
+		return false, fmt.Errorf("missing member")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Client requests and health probes to the drained server should be
+	// refused, even if the client claims the request was forwarded. Each
+	// refusal only fails that request, so the connection stays usable.
+	register := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+	}
+	codec2 := rpcClient(t, s2)
+	defer codec2.Close()
+	var out struct{}
+	err := msgpackrpc.CallWithCodec(codec2, "Catalog.Register", &register, &out)
+	if err == nil || err.Error() != structs.ErrDraining.Error() {
+		t.Fatalf("err: %v", err)
+	}
+	register.SetRequestTrace("spoofed", 1)
+	err = msgpackrpc.CallWithCodec(codec2, "Catalog.Register", &register, &out)
+	if err == nil || err.Error() != structs.ErrDraining.Error() {
+		t.Fatalf("err: %v", err)
+	}
+	register.SetRequestTrace("", 0)
+	err = msgpackrpc.CallWithCodec(codec2, "Status.Ping", struct{}{}, &out)
+	if err == nil || err.Error() != structs.ErrDraining.Error() {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Writes should still commit and replicate to the drained server, and
+	// the other follower can still forward to the leader.
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &register, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	codec3 := rpcClient(t, s3)
+	defer codec3.Close()
+	register.Node = "bar"
+	if err := msgpackrpc.CallWithCodec(codec3, "Catalog.Register", &register, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		_, nodes, err := s2.fsm.State().Nodes(nil)
+		if err != nil {
+			return false, err
+		}
+		return len(nodes) == 5, fmt.Errorf("bad: %v", nodes)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The drained server can be told to stop draining directly, over the
+	// same connection.
+	arg.Draining = false
+	if err := msgpackrpc.CallWithCodec(codec2, "Operator.SetDraining", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Draining || s2.IsDraining() {
+		t.Fatalf("bad: %#v", reply)
+	}
+	if err := msgpackrpc.CallWithCodec(codec2, "Status.Ping", struct{}{}, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	register.Node = "baz"
+	if err := msgpackrpc.CallWithCodec(codec2, "Catalog.Register", &register, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Unknown servers are an error.
+	arg.Node = "nope"
+	err = msgpackrpc.CallWithCodec(codec, "Operator.SetDraining", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), "Unknown server") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestOperator_SetDraining_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Make a request with no token to make sure it gets denied.
+	arg := structs.OperatorDrainRequest{
+		Datacenter: "dc1",
+		Node:       s1.config.NodeName,
+		Draining:   true,
+	}
+	var reply structs.OperatorDrainReply
+	err := msgpackrpc.CallWithCodec(codec, "Operator.SetDraining", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	if s1.IsDraining() {
+		t.Fatalf("should not be draining")
+	}
+
+	// It should go through with the master token.
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.SetDraining", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !s1.IsDraining() {
+		t.Fatalf("should be draining")
+	}
+}
+
+func TestServer_ForwardServer_Hops(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	// Each forward should count a hop.
+	args := structs.OperatorDrainRequest{
+		Datacenter: "dc1",
+		Node:       "nope",
+	}
+	var reply structs.OperatorDrainReply
+	err := s1.forwardServer(args.Node, "Operator.SetDraining", &args, &reply)
+	if err == nil || !strings.Contains(err.Error(), "Unknown server") {
+		t.Fatalf("err: %v", err)
+	}
+	if args.ForwardHops != 1 {
+		t.Fatalf("bad: %d", args.ForwardHops)
+	}
+
+	// Requests that have been forwarded too many times should be rejected.
+	args.ForwardHops = maxForwardHops + 1
+	err = s1.forwardServer(args.Node, "Operator.SetDraining", &args, &reply)
+	if err == nil || !strings.Contains(err.Error(), "forwarded too many times") {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package consul
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/lib"
+	"github.com/hashicorp/go-uuid"
+)
+
+// faultInjector holds the faults an operator has asked a server to inject
+// into its outgoing connections to other servers, and wraps the dialers for
+// those connections to inject them. A server only has one of these when
+// fault injection is enabled, so nothing is wrapped otherwise.
+type faultInjector struct {
+	// clock is used to expire injections and to time blackholed dials.
+	clock lib.Clock
+
+	logger *log.Logger
+
+	// injections are the current injections, keyed by ID. Expired ones are
+	// removed lazily, whenever they're looked at.
+	injections map[string]*structs.FaultInjection
+	lock       sync.Mutex
+
+	// dropRoll returns a number in [0, 100) to decide whether to drop a new
+	// connection. This is swapped out in tests.
+	dropRoll func() int
+}
+
+// faultSet is the combined effect of all the injections that apply to a
+// connection.
+type faultSet struct {
+	latency     time.Duration
+	dropPercent int
+	blackhole   bool
+}
+
+// newFaultInjector returns a fault injector with the given injections in
+// place.
+func newFaultInjector(clock lib.Clock, logger *log.Logger,
+	injections []*structs.FaultInjection) (*faultInjector, error) {
+
+	f := &faultInjector{
+		clock:      clock,
+		logger:     logger,
+		injections: make(map[string]*structs.FaultInjection),
+		dropRoll: func() int {
+			return rand.Intn(100)
+		},
+	}
+	for _, injection := range injections {
+		if _, err := f.set(injection); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// validateFaultInjection checks that an injection makes sense.
+func validateFaultInjection(injection *structs.FaultInjection) error {
+	switch injection.Transport {
+	case "", structs.FaultInjectionRPC, structs.FaultInjectionRaft:
+	default:
+		return fmt.Errorf("unknown transport %q", injection.Transport)
+	}
+	if injection.Peer != "" {
+		if _, _, err := net.SplitHostPort(injection.Peer); err != nil {
+			return fmt.Errorf("invalid peer address %q: %v", injection.Peer, err)
+		}
+	}
+	if injection.Latency < 0 {
+		return fmt.Errorf("latency can't be negative")
+	}
+	if injection.DropPercent < 0 || injection.DropPercent > 100 {
+		return fmt.Errorf("drop percent must be between 0 and 100")
+	}
+	if injection.TTL < 0 {
+		return fmt.Errorf("TTL can't be negative")
+	}
+	return nil
+}
+
+// set adds an injection, or replaces the one with the same ID, and returns a
+// copy of what was stored. An ID is generated if the injection doesn't have
+// one.
+func (f *faultInjector) set(injection *structs.FaultInjection) (*structs.FaultInjection, error) {
+	if err := validateFaultInjection(injection); err != nil {
+		return nil, err
+	}
+
+	stored := *injection
+	if stored.ID == "" {
+		id, err := uuid.GenerateUUID()
+		if err != nil {
+			return nil, err
+		}
+		stored.ID = id
+	}
+	stored.Expires = time.Time{}
+	if stored.TTL > 0 {
+		stored.Expires = f.clock.Now().Add(stored.TTL)
+	}
+
+	f.lock.Lock()
+	f.injections[stored.ID] = &stored
+	f.lock.Unlock()
+
+	f.logger.Printf("[WARN] consul: Injecting fault %s: transport=%q peer=%q latency=%v drop=%d%% blackhole=%v ttl=%v",
+		stored.ID, stored.Transport, stored.Peer, stored.Latency, stored.DropPercent, stored.Blackhole, stored.TTL)
+	copy := stored
+	return &copy, nil
+}
+
+// delete removes the injection with the given ID, and returns whether there
+// was one.
+func (f *faultInjector) delete(id string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.pruneLocked()
+	if _, ok := f.injections[id]; !ok {
+		return false
+	}
+	delete(f.injections, id)
+	f.logger.Printf("[INFO] consul: Removed fault injection %s", id)
+	return true
+}
+
+// list returns copies of the current injections, sorted by ID.
+func (f *faultInjector) list() []*structs.FaultInjection {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.pruneLocked()
+	injections := make([]*structs.FaultInjection, 0, len(f.injections))
+	for _, injection := range f.injections {
+		copy := *injection
+		injections = append(injections, &copy)
+	}
+	sort.Slice(injections, func(i, j int) bool {
+		return injections[i].ID < injections[j].ID
+	})
+	return injections
+}
+
+// pruneLocked removes the injections that have expired. The lock must be
+// held.
+func (f *faultInjector) pruneLocked() {
+	now := f.clock.Now()
+	for id, injection := range f.injections {
+		if !injection.Expires.IsZero() && !now.Before(injection.Expires) {
+			delete(f.injections, id)
+			f.logger.Printf("[INFO] consul: Fault injection %s expired", id)
+		}
+	}
+}
+
+// active returns the combined faults to inject into a connection to the
+// given address over the given transport. Latencies add up, the highest drop
+// percentage wins, and any blackhole blackholes the connection.
+func (f *faultInjector) active(transport, address string) faultSet {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.pruneLocked()
+	var faults faultSet
+	for _, injection := range f.injections {
+		if injection.Transport != "" && injection.Transport != transport {
+			continue
+		}
+		if injection.Peer != "" && injection.Peer != address {
+			continue
+		}
+		faults.latency += injection.Latency
+		if injection.DropPercent > faults.dropPercent {
+			faults.dropPercent = injection.DropPercent
+		}
+		faults.blackhole = faults.blackhole || injection.Blackhole
+	}
+	return faults
+}
+
+// sleep waits for the given duration on the injector's clock.
+func (f *faultInjector) sleep(d time.Duration) {
+	if d > 0 {
+		<-f.clock.After(d)
+	}
+}
+
+// wrap returns a dialer for the given transport that injects faults into the
+// connections made by the given dialer. Drops and blackholes are checked when
+// dialing, and latency and blackholes on every write, so they also apply to
+// connections that were already open.
+func (f *faultInjector) wrap(transport string, dial DialerFunc) DialerFunc {
+	return func(network, address string, timeout time.Duration) (net.Conn, error) {
+		faults := f.active(transport, address)
+		if faults.blackhole {
+			if timeout <= 0 {
+				timeout = defaultDialTimeout
+			}
+			f.sleep(timeout)
+			return nil, fmt.Errorf("dial %s %s: i/o timeout (fault injected)", network, address)
+		}
+		if faults.dropPercent > 0 && f.dropRoll() < faults.dropPercent {
+			return nil, fmt.Errorf("dial %s %s: connection refused (fault injected)", network, address)
+		}
+		f.sleep(faults.latency)
+
+		conn, err := dial(network, address, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return &faultConn{Conn: conn, injector: f, transport: transport, address: address}, nil
+	}
+}
+
+// faultConn is a connection that has faults injected into its writes.
+type faultConn struct {
+	net.Conn
+	injector  *faultInjector
+	transport string
+	address   string
+}
+
+// Write delays the write by the injected latency, or closes the connection
+// if it's been blackholed.
+func (c *faultConn) Write(b []byte) (int, error) {
+	faults := c.injector.active(c.transport, c.address)
+	if faults.blackhole {
+		c.Conn.Close()
+		return 0, fmt.Errorf("write to %s: connection reset (fault injected)", c.address)
+	}
+	c.injector.sleep(faults.latency)
+	return c.Conn.Write(b)
+}
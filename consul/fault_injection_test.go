@@ -0,0 +1,320 @@
+package consul
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/lib"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestFaultInjection_ForwardedRPCLatency(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Bootstrap = false
+		c.EnableFaultInjection = true
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s2.RPC, "dc1")
+
+	// Time a read that s2 has to forward to the leader.
+	forwarded := func() time.Duration {
+		args := structs.KeyRequest{
+			Datacenter: "dc1",
+			Key:        "foo",
+		}
+		var out structs.IndexedDirEntries
+		start := time.Now()
+		if err := s2.RPC("KVS.Get", &args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return time.Since(start)
+	}
+	if d := forwarded(); d >= 200*time.Millisecond {
+		t.Fatalf("baseline too slow: %v", d)
+	}
+
+	// Have s1 pass the injection on to s2.
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+	arg := structs.FaultInjectionRequest{
+		Datacenter: "dc1",
+		Node:       s2.config.NodeName,
+		Op:         structs.FaultInjectionSet,
+		Injection: structs.FaultInjection{
+			Transport: structs.FaultInjectionRPC,
+			Peer:      s1.config.RPCAddr.String(),
+			Latency:   200 * time.Millisecond,
+			TTL:       time.Second,
+		},
+	}
+	var reply structs.FaultInjectionReply
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.FaultInjectionApply", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Node != s2.config.NodeName || len(reply.Injections) != 1 ||
+		reply.Injections[0].ID == "" || reply.Injections[0].Expires.IsZero() {
+		t.Fatalf("bad: %#v", reply)
+	}
+	if d := forwarded(); d < 200*time.Millisecond {
+		t.Fatalf("no latency injected: %v", d)
+	}
+
+	list := structs.FaultInjectionListRequest{
+		Datacenter: "dc1",
+		Node:       s2.config.NodeName,
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.FaultInjectionList", &list, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Injections) != 1 || reply.Injections[0].Latency != 200*time.Millisecond {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	// Once it expires, things should be back to normal.
+	time.Sleep(time.Second)
+	reply = structs.FaultInjectionReply{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.FaultInjectionList", &list, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Injections) != 0 {
+		t.Fatalf("bad: %#v", reply)
+	}
+	if d := forwarded(); d >= 200*time.Millisecond {
+		t.Fatalf("latency didn't expire: %v", d)
+	}
+}
+
+func TestFaultInjection_Disabled(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	if s1.faultInjector != nil {
+		t.Fatalf("should not have a fault injector")
+	}
+
+	arg := structs.FaultInjectionRequest{
+		Datacenter: "dc1",
+		Node:       s1.config.NodeName,
+		Op:         structs.FaultInjectionSet,
+		Injection: structs.FaultInjection{
+			Blackhole: true,
+		},
+	}
+	var reply structs.FaultInjectionReply
+	err := msgpackrpc.CallWithCodec(codec, "Operator.FaultInjectionApply", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), "not enabled") {
+		t.Fatalf("err: %v", err)
+	}
+
+	list := structs.FaultInjectionListRequest{
+		Datacenter: "dc1",
+		Node:       s1.config.NodeName,
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.FaultInjectionList", &list, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Node != s1.config.NodeName || len(reply.Injections) != 0 {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestFaultInjection_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+		c.EnableFaultInjection = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Make a request with no token to make sure it gets denied.
+	arg := structs.FaultInjectionRequest{
+		Datacenter: "dc1",
+		Node:       s1.config.NodeName,
+		Op:         structs.FaultInjectionSet,
+		Injection: structs.FaultInjection{
+			DropPercent: 50,
+		},
+	}
+	var reply structs.FaultInjectionReply
+	err := msgpackrpc.CallWithCodec(codec, "Operator.FaultInjectionApply", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	if len(s1.faultInjector.list()) != 0 {
+		t.Fatalf("should not have injected")
+	}
+
+	// With the master token it should go through, and be deletable.
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.FaultInjectionApply", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Injections) != 1 {
+		t.Fatalf("bad: %#v", reply)
+	}
+	arg.Op = structs.FaultInjectionDelete
+	arg.Injection = structs.FaultInjection{ID: reply.Injections[0].ID}
+	reply = structs.FaultInjectionReply{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.FaultInjectionApply", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Injections) != 0 {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestFaultInjector(t *testing.T) {
+	clock := lib.NewFakeClock(time.Now())
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	f, err := newFaultInjector(clock, logger, []*structs.FaultInjection{
+		&structs.FaultInjection{
+			ID:        "raft-latency",
+			Transport: structs.FaultInjectionRaft,
+			Peer:      "127.0.0.1:1",
+			Latency:   time.Second,
+			TTL:       time.Minute,
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var dials int
+	dialer := f.wrap(structs.FaultInjectionRaft, func(network, address string, timeout time.Duration) (net.Conn, error) {
+		dials++
+		conn, _ := net.Pipe()
+		return conn, nil
+	})
+
+	// Other transports and peers should be left alone.
+	if faults := f.active(structs.FaultInjectionRPC, "127.0.0.1:1"); faults != (faultSet{}) {
+		t.Fatalf("bad: %#v", faults)
+	}
+	if faults := f.active(structs.FaultInjectionRaft, "127.0.0.1:2"); faults != (faultSet{}) {
+		t.Fatalf("bad: %#v", faults)
+	}
+
+	// Injections should stack.
+	if _, err := f.set(&structs.FaultInjection{
+		ID:          "drop",
+		Latency:     time.Second,
+		DropPercent: 30,
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	faults := f.active(structs.FaultInjectionRaft, "127.0.0.1:1")
+	if faults != (faultSet{latency: 2 * time.Second, dropPercent: 30}) {
+		t.Fatalf("bad: %#v", faults)
+	}
+
+	// The dial should be dropped if the roll comes in under the percentage.
+	f.dropRoll = func() int { return 29 }
+	if _, err := dialer("tcp", "127.0.0.1:1", time.Second); err == nil ||
+		!strings.Contains(err.Error(), "fault injected") {
+		t.Fatalf("err: %v", err)
+	}
+	if dials != 0 {
+		t.Fatalf("bad: %d", dials)
+	}
+
+	// Otherwise it should wait out the latency before dialing.
+	f.dropRoll = func() int { return 30 }
+	done := make(chan error, 1)
+	go func() {
+		_, err := dialer("tcp", "127.0.0.1:1", time.Second)
+		done <- err
+	}()
+	waitForPending(t, clock)
+	clock.Advance(2 * time.Second)
+	if err := <-done; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if dials != 1 {
+		t.Fatalf("bad: %d", dials)
+	}
+
+	// A blackhole should hang until the dial times out.
+	if _, err := f.set(&structs.FaultInjection{
+		ID:        "drop",
+		Blackhole: true,
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		_, err := dialer("tcp", "127.0.0.1:1", 5*time.Second)
+		done <- err
+	}()
+	waitForPending(t, clock)
+	clock.Advance(5 * time.Second)
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("err: %v", err)
+	}
+	if dials != 1 {
+		t.Fatalf("bad: %d", dials)
+	}
+
+	// The TTL should expire the Raft injection, and deleting the other
+	// should leave nothing.
+	clock.Advance(time.Minute)
+	if list := f.list(); len(list) != 1 || list[0].ID != "drop" {
+		t.Fatalf("bad: %v", list)
+	}
+	if !f.delete("drop") || f.delete("drop") {
+		t.Fatalf("bad delete")
+	}
+	if list := f.list(); len(list) != 0 {
+		t.Fatalf("bad: %v", list)
+	}
+
+	// Bad injections should be refused.
+	bad := []*structs.FaultInjection{
+		&structs.FaultInjection{Transport: "serf"},
+		&structs.FaultInjection{Peer: "nope"},
+		&structs.FaultInjection{Latency: -time.Second},
+		&structs.FaultInjection{DropPercent: 101},
+		&structs.FaultInjection{TTL: -time.Second},
+	}
+	for _, injection := range bad {
+		if _, err := f.set(injection); err == nil {
+			t.Fatalf("should have failed: %#v", injection)
+		}
+	}
+}
+
+// waitForPending waits for something to be waiting on the given clock.
+func waitForPending(t *testing.T, clock *lib.FakeClock) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return clock.Pending() > 0, fmt.Errorf("nothing waiting on the clock")
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,44 @@
+package consul
+
+import (
+	"github.com/hashicorp/serf/serf"
+)
+
+// These are Serf tags servers set to say they can apply a kind of log entry
+// that older servers can't. If those servers skipping the entry would leave
+// them with different state, it can't be written with IgnoreUnknownTypeFlag,
+// so the leader only writes it once every server has the tag.
+const (
+	// featureKVQuotaTag is set by servers that enforce KV quotas.
+	featureKVQuotaTag = "ft_kvq"
+
+	// featureDeregisterBatchTag is set by servers that can apply batches
+	// of reaped node deregistrations.
+	featureDeregisterBatchTag = "ft_drb"
+
+	// featureOrphanedLockTag is set by servers that can release locks held
+	// by sessions that no longer exist.
+	featureOrphanedLockTag = "ft_olr"
+)
+
+// serverFeatureTags are the feature tags this server sets in the LAN pool.
+var serverFeatureTags = []string{
+	featureKVQuotaTag,
+	featureDeregisterBatchTag,
+	featureOrphanedLockTag,
+}
+
+// serversSupport returns true if every server in the given LAN members has
+// the given feature tag. Failed servers count, since they'll apply the log
+// once they're back, but servers that have left don't.
+func serversSupport(members []serf.Member, tag string) bool {
+	for _, m := range members {
+		if m.Tags["role"] != "consul" || m.Status == serf.StatusLeft {
+			continue
+		}
+		if m.Tags[tag] != "1" {
+			return false
+		}
+	}
+	return true
+}
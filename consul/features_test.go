@@ -0,0 +1,25 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestServersSupport(t *testing.T) {
+	members := []serf.Member{
+		{Name: "s1", Status: serf.StatusAlive, Tags: map[string]string{"role": "consul", featureKVQuotaTag: "1"}},
+		{Name: "c1", Status: serf.StatusAlive, Tags: map[string]string{"role": "node"}},
+		{Name: "s2", Status: serf.StatusLeft, Tags: map[string]string{"role": "consul"}},
+	}
+	if !serversSupport(members, featureKVQuotaTag) {
+		t.Fatalf("should be supported")
+	}
+
+	// A failed server without the tag could come back and apply the log.
+	members = append(members, serf.Member{Name: "s3", Status: serf.StatusFailed,
+		Tags: map[string]string{"role": "consul"}})
+	if serversSupport(members, featureKVQuotaTag) {
+		t.Fatalf("should not be supported")
+	}
+}
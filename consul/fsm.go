@@ -6,6 +6,7 @@ import (
 	"io"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/armon/go-metrics"
@@ -34,8 +35,35 @@ type consulFSM struct {
 	state     *state.StateStore
 
 	gc *state.TombstoneGC
+
+	// histograms is used to record how long it takes to apply logs. This
+	// may be nil.
+	histograms *serverHistograms
+
+	// chunks holds on to the chunks of snapshots being restored, so an
+	// interrupted restore doesn't have to write them all again. This may be
+	// nil.
+	chunks snapshotChunkStore
+
+	// hooks are the change hooks to notify after applies.
+	hooks changeHooks
+
+	// appliedIndex is the index of the last log applied to the state
+	// store, or the last index in the snapshot after a restore. This must
+	// be accessed atomically.
+	appliedIndex uint64
+
+	// appliedCh is closed and replaced each time appliedIndex moves, so
+	// anyone waiting for an index can be woken up.
+	appliedCh   chan struct{}
+	appliedLock sync.Mutex
 }
 
+// tombstonePrefixFlag is set in the flags of the KV entries that tombstones
+// are serialized as in snapshots to mark prefix tombstones. Older versions
+// will restore these as regular tombstones.
+const tombstonePrefixFlag uint64 = 1
+
 // consulSnapshot is used to provide a snapshot of the current
 // state in a way that can be accessed concurrently with operations
 // that may modify the live state.
@@ -48,8 +76,24 @@ type snapshotHeader struct {
 	// LastIndex is the last index that affects the data.
 	// This is used when we do the restore for watchers.
 	LastIndex uint64
+
+	// SchemaVersion is the version of the record layout that follows.
+	// Snapshots from before this was added decode it as zero.
+	SchemaVersion int
 }
 
+const (
+	// snapshotSchemaVersion is the schema version written by Persist. It
+	// only needs to be bumped when a change to the records can't be safely
+	// ignored by older servers; new record types that older servers can
+	// skip just need to be written with structs.IgnoreUnknownTypeFlag set.
+	snapshotSchemaVersion = 1
+
+	// minSnapshotSchemaVersion is the oldest schema version Restore can
+	// read.
+	minSnapshotSchemaVersion = 0
+)
+
 // NewFSM is used to construct a new FSM with a blank state
 func NewFSM(gc *state.TombstoneGC, logOutput io.Writer) (*consulFSM, error) {
 	stateNew, err := state.NewStateStore(gc)
@@ -73,7 +117,39 @@ func (c *consulFSM) State() *state.StateStore {
 	return c.state
 }
 
-func (c *consulFSM) Apply(log *raft.Log) interface{} {
+// AppliedIndex returns the index of the last log applied to the state store.
+// Unlike Raft's applied index, this doesn't move until the change is
+// visible to reads.
+func (c *consulFSM) AppliedIndex() uint64 {
+	return atomic.LoadUint64(&c.appliedIndex)
+}
+
+// AppliedIndexCh returns the applied index, along with a channel that's
+// closed the next time it moves.
+func (c *consulFSM) AppliedIndexCh() (uint64, <-chan struct{}) {
+	c.appliedLock.Lock()
+	defer c.appliedLock.Unlock()
+	if c.appliedCh == nil {
+		c.appliedCh = make(chan struct{})
+	}
+	return c.AppliedIndex(), c.appliedCh
+}
+
+// setAppliedIndex records the applied index and wakes up anyone waiting for
+// it to move.
+func (c *consulFSM) setAppliedIndex(index uint64) {
+	c.appliedLock.Lock()
+	defer c.appliedLock.Unlock()
+	atomic.StoreUint64(&c.appliedIndex, index)
+	if c.appliedCh != nil {
+		close(c.appliedCh)
+		c.appliedCh = nil
+	}
+}
+
+func (c *consulFSM) Apply(log *raft.Log) (resp interface{}) {
+	defer c.histograms.measureFSMApply(time.Now())
+
 	buf := log.Data
 	msgType := structs.MessageType(buf[0])
 
@@ -86,6 +162,12 @@ func (c *consulFSM) Apply(log *raft.Log) interface{} {
 		ignoreUnknown = true
 	}
 
+	// Let any change hooks know about the apply once it's done.
+	defer func() {
+		c.setAppliedIndex(log.Index)
+		c.hooks.notify(msgType, log.Index, buf[1:], resp)
+	}()
+
 	switch msgType {
 	case structs.RegisterRequestType:
 		return c.applyRegister(buf[1:], log.Index)
@@ -107,6 +189,40 @@ func (c *consulFSM) Apply(log *raft.Log) interface{} {
 		return c.applyTxn(buf[1:], log.Index)
 	case structs.AutopilotRequestType:
 		return c.applyAutopilotUpdate(buf[1:], log.Index)
+	case structs.ACLUsageRequestType:
+		return c.applyACLUsageUpdate(buf[1:], log.Index)
+	case structs.CentralCheckRequestType:
+		return c.applyCentralCheckOperation(buf[1:], log.Index)
+	case structs.QueryDefaultsRequestType:
+		return c.applyQueryDefaultsUpdate(buf[1:], log.Index)
+	case structs.DatacenterAliasRequestType:
+		return c.applyDatacenterAliasOperation(buf[1:], log.Index)
+	case structs.ServiceConstraintRequestType:
+		return c.applyServiceConstraintOperation(buf[1:], log.Index)
+	case structs.QueryFreezeRequestType:
+		return c.applyQueryFreezeUpdate(buf[1:], log.Index)
+	case structs.SigningKeyRequestType:
+		return c.applySigningKeyRotate(buf[1:], log.Index)
+	case structs.RemoteWritePolicyRequestType:
+		return c.applyRemoteWritePolicyUpdate(buf[1:], log.Index)
+	case structs.ServiceNamePolicyRequestType:
+		return c.applyServiceNamePolicyOperation(buf[1:], log.Index)
+	case structs.NodeBlockRequestType:
+		return c.applyNodeBlockOperation(buf[1:], log.Index)
+	case structs.ServerEventRequestType:
+		return c.applyServerEvent(buf[1:], log.Index)
+	case structs.FederationPolicyRequestType:
+		return c.applyFederationPolicyOperation(buf[1:], log.Index)
+	case structs.OrphanedLockRequestType:
+		return c.applyOrphanedLockRelease(buf[1:], log.Index)
+	case structs.DeregisterBatchRequestType:
+		return c.applyDeregisterBatch(buf[1:], log.Index)
+	case structs.OperatorIntentRequestType:
+		return c.applyOperatorIntentOperation(buf[1:], log.Index)
+	case structs.KVQuotaRequestType:
+		return c.applyKVQuotaOperation(buf[1:], log.Index)
+	case structs.ClusterIDRequestType:
+		return c.applyClusterIDUpdate(buf[1:], log.Index)
 	default:
 		if ignoreUnknown {
 			c.logger.Printf("[WARN] consul.fsm: ignoring unknown message type (%d), upgrade to newer version", msgType)
@@ -180,6 +296,18 @@ func (c *consulFSM) applyKVSOperation(buf []byte, index uint64) interface{} {
 			return act
 		}
 	case structs.KVSDeleteTree:
+		if req.SkipTombstones {
+			_, err := c.state.KVSDeleteTreeMaxTombstones(index, req.DirEnt.Key, 0)
+			return err
+		}
+		if req.MaxTombstones > 0 {
+			collapsed, err := c.state.KVSDeleteTreeMaxTombstones(index, req.DirEnt.Key, req.MaxTombstones)
+			if collapsed {
+				c.logger.Printf("[INFO] consul.fsm: Delete of tree '%s' would create more than %d tombstones, using a prefix tombstone instead",
+					req.DirEnt.Key, req.MaxTombstones)
+			}
+			return err
+		}
 		return c.state.KVSDeleteTree(index, req.DirEnt.Key)
 	case structs.KVSCAS:
 		act, err := c.state.KVSSetCAS(index, &req.DirEnt)
@@ -217,7 +345,7 @@ func (c *consulFSM) applySessionOperation(buf []byte, index uint64) interface{}
 	defer metrics.MeasureSince([]string{"consul", "fsm", "session", string(req.Op)}, time.Now())
 	switch req.Op {
 	case structs.SessionCreate:
-		if err := c.state.SessionCreate(index, &req.Session); err != nil {
+		if err := c.state.SessionCreateLimited(index, &req.Session, req.NodeSessionLimit, req.TokenSessionLimit); err != nil {
 			return err
 		} else {
 			return req.Session.ID
@@ -251,6 +379,20 @@ func (c *consulFSM) applyACLOperation(buf []byte, index uint64) interface{} {
 	}
 }
 
+// applyACLUsageUpdate adds a batch of token usage to the totals tracked in
+// the state store.
+func (c *consulFSM) applyACLUsageUpdate(buf []byte, index uint64) interface{} {
+	var req structs.ACLUsageRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "acl", "usage"}, time.Now())
+	if err := c.state.ACLUsageUpdate(index, req.Usage); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (c *consulFSM) applyTombstoneOperation(buf []byte, index uint64) interface{} {
 	var req structs.TombstoneRequest
 	if err := structs.Decode(buf, &req); err != nil {
@@ -334,6 +476,276 @@ func (c *consulFSM) applyAutopilotUpdate(buf []byte, index uint64) interface{} {
 	}
 }
 
+// applyQueryDefaultsUpdate sets the default query options.
+func (c *consulFSM) applyQueryDefaultsUpdate(buf []byte, index uint64) interface{} {
+	var req structs.QueryDefaultsSetRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "query_defaults"}, time.Now())
+
+	return c.state.QueryDefaultsSet(index, &req.Defaults)
+}
+
+// applyDatacenterAliasOperation applies the given datacenter alias operation
+// to the state store.
+func (c *consulFSM) applyDatacenterAliasOperation(buf []byte, index uint64) interface{} {
+	var req structs.DatacenterAliasRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	defer metrics.MeasureSince([]string{"consul", "fsm", "dc_alias", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.DatacenterAliasSet:
+		return c.state.DatacenterAliasSet(index, &req.Alias)
+	case structs.DatacenterAliasDelete:
+		return c.state.DatacenterAliasDelete(index, req.Alias.Alias)
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid DatacenterAlias operation '%s'", req.Op)
+		return fmt.Errorf("Invalid DatacenterAlias operation '%s'", req.Op)
+	}
+}
+
+// applyQueryFreezeUpdate sets or clears the prepared query freeze.
+func (c *consulFSM) applyQueryFreezeUpdate(buf []byte, index uint64) interface{} {
+	var req structs.QueryFreezeRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "query_freeze"}, time.Now())
+
+	return c.state.QueryFreezeSet(index, &req.Freeze)
+}
+
+// applySigningKeyRotate installs a new signing key.
+func (c *consulFSM) applySigningKeyRotate(buf []byte, index uint64) interface{} {
+	var req structs.SigningKeyRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "signing_key"}, time.Now())
+
+	return c.state.SigningKeyRotate(index, &req.Key)
+}
+
+// applyRemoteWritePolicyUpdate updates the remote write policy.
+func (c *consulFSM) applyRemoteWritePolicyUpdate(buf []byte, index uint64) interface{} {
+	var req structs.RemoteWritePolicyRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "remote_write_policy"}, time.Now())
+
+	return c.state.RemoteWritePolicySet(index, &req.Policy)
+}
+
+// applyServiceNamePolicyOperation applies the given service name policy
+// operation to the state store.
+func (c *consulFSM) applyServiceNamePolicyOperation(buf []byte, index uint64) interface{} {
+	var req structs.ServiceNamePolicyRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	defer metrics.MeasureSince([]string{"consul", "fsm", "service_name_policy", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.ServiceNamePolicySet:
+		return c.state.ServiceNamePolicySet(index, &req.Policy)
+	case structs.ServiceNamePolicyDelete:
+		return c.state.ServiceNamePolicyDelete(index)
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid ServiceNamePolicy operation '%s'", req.Op)
+		return fmt.Errorf("Invalid ServiceNamePolicy operation '%s'", req.Op)
+	}
+}
+
+// applyNodeBlockOperation applies the given node block operation to the
+// state store.
+func (c *consulFSM) applyNodeBlockOperation(buf []byte, index uint64) interface{} {
+	var req structs.NodeBlockRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	defer metrics.MeasureSince([]string{"consul", "fsm", "node_block", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.NodeBlockSet:
+		return c.state.NodeBlockSet(index, &req.Block)
+	case structs.NodeBlockClear:
+		return c.state.NodeBlockDelete(index, req.Block.Node)
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid NodeBlock operation '%s'", req.Op)
+		return fmt.Errorf("Invalid NodeBlock operation '%s'", req.Op)
+	}
+}
+
+// applyServerEvent adds a server event to the server history.
+func (c *consulFSM) applyServerEvent(buf []byte, index uint64) interface{} {
+	var req structs.ServerEventRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	defer metrics.MeasureSince([]string{"consul", "fsm", "server_event"}, time.Now())
+	return c.state.ServerEventAppend(index, &req.Event)
+}
+
+// applyFederationPolicyOperation applies the given federation policy
+// operation to the state store.
+func (c *consulFSM) applyFederationPolicyOperation(buf []byte, index uint64) interface{} {
+	var req structs.FederationPolicyRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	defer metrics.MeasureSince([]string{"consul", "fsm", "federation_policy", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.FederationPolicySet:
+		return c.state.FederationPolicySet(index, &req.Policy)
+	case structs.FederationPolicyDelete:
+		return c.state.FederationPolicyDelete(index, req.Policy.Datacenter)
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid FederationPolicy operation '%s'", req.Op)
+		return fmt.Errorf("Invalid FederationPolicy operation '%s'", req.Op)
+	}
+}
+
+// applyOrphanedLockRelease releases locks held by sessions that no longer
+// exist. This returns the number of locks released.
+func (c *consulFSM) applyOrphanedLockRelease(buf []byte, index uint64) interface{} {
+	var req structs.OrphanedLockRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	defer metrics.MeasureSince([]string{"consul", "fsm", "orphaned_lock"}, time.Now())
+	released, err := c.state.KVSReleaseOrphanedLocks(index, req.Locks)
+	if err != nil {
+		return err
+	}
+	return released
+}
+
+// applyDeregisterBatch deregisters a batch of reaped nodes, leaving alone any
+// that have come back since they were queued. This returns the number of
+// nodes deregistered.
+func (c *consulFSM) applyDeregisterBatch(buf []byte, index uint64) interface{} {
+	var req structs.DeregisterBatchRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	defer metrics.MeasureSince([]string{"consul", "fsm", "deregister_batch"}, time.Now())
+	deleted, err := c.state.DeleteNodesUnlessAlive(index, req.Nodes, SerfCheckID)
+	if err != nil {
+		c.logger.Printf("[INFO] consul.fsm: DeleteNodesUnlessAlive failed: %v", err)
+		return err
+	}
+	return len(deleted)
+}
+
+// applyOperatorIntentOperation applies the given operator intent operation
+// to the state store. Updates and deletes return whether they took effect.
+func (c *consulFSM) applyOperatorIntentOperation(buf []byte, index uint64) interface{} {
+	var req structs.OperatorIntentRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	defer metrics.MeasureSince([]string{"consul", "fsm", "operator_intent", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.OperatorIntentCreate:
+		return c.state.OperatorIntentCreate(index, &req.Intent)
+	case structs.OperatorIntentUpdate:
+		act, err := c.state.OperatorIntentUpdate(index, req.Intent.ID, req.Intent.Step, req.Intent.ModifyIndex)
+		if err != nil {
+			return err
+		}
+		return act
+	case structs.OperatorIntentDelete:
+		act, err := c.state.OperatorIntentDelete(index, req.Intent.ID, req.Intent.ModifyIndex)
+		if err != nil {
+			return err
+		}
+		return act
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid OperatorIntent operation '%s'", req.Op)
+		return fmt.Errorf("Invalid OperatorIntent operation '%s'", req.Op)
+	}
+}
+
+// applyKVQuotaOperation applies the given KV quota operation to the state
+// store.
+func (c *consulFSM) applyKVQuotaOperation(buf []byte, index uint64) interface{} {
+	var req structs.KVQuotaRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	defer metrics.MeasureSince([]string{"consul", "fsm", "kv_quota", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.KVQuotaSet:
+		return c.state.KVQuotaSet(index, &req.Quota)
+	case structs.KVQuotaDelete:
+		return c.state.KVQuotaDelete(index, req.Quota.Prefix)
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid KVQuota operation '%s'", req.Op)
+		return fmt.Errorf("Invalid KVQuota operation '%s'", req.Op)
+	}
+}
+
+// applyClusterIDUpdate sets the cluster ID, if it hasn't been set already.
+func (c *consulFSM) applyClusterIDUpdate(buf []byte, index uint64) interface{} {
+	var req structs.ClusterIDRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "cluster_id"}, time.Now())
+
+	return c.state.ClusterIDSet(index, &req.ClusterID)
+}
+
+// applyServiceConstraintOperation applies the given service constraint
+// operation to the state store.
+func (c *consulFSM) applyServiceConstraintOperation(buf []byte, index uint64) interface{} {
+	var req structs.ServiceConstraintRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	defer metrics.MeasureSince([]string{"consul", "fsm", "service_constraint", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.ServiceConstraintSet:
+		return c.state.ServiceConstraintSet(index, &req.Constraint)
+	case structs.ServiceConstraintDelete:
+		return c.state.ServiceConstraintDelete(index, req.Constraint.Service)
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid ServiceConstraint operation '%s'", req.Op)
+		return fmt.Errorf("Invalid ServiceConstraint operation '%s'", req.Op)
+	}
+}
+
+// applyCentralCheckOperation applies the given central check operation to
+// the state store.
+func (c *consulFSM) applyCentralCheckOperation(buf []byte, index uint64) interface{} {
+	var req structs.CentralCheckRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	defer metrics.MeasureSince([]string{"consul", "fsm", "central-check", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.CentralCheckCreate, structs.CentralCheckUpdate:
+		return c.state.CentralCheckSet(index, req.Check)
+	case structs.CentralCheckDelete:
+		return c.state.CentralCheckDelete(index, req.Check.ID)
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid CentralCheck operation '%s'", req.Op)
+		return fmt.Errorf("Invalid CentralCheck operation '%s'", req.Op)
+	}
+}
+
 func (c *consulFSM) Snapshot() (raft.FSMSnapshot, error) {
 	defer func(start time.Time) {
 		c.logger.Printf("[INFO] consul.fsm: snapshot created in %v", time.Now().Sub(start))
@@ -357,28 +769,54 @@ func (c *consulFSM) Restore(old io.ReadCloser) error {
 	restore := stateNew.Restore()
 	defer restore.Abort()
 
+	// Split the snapshot into chunks as it's read, if we're keeping them.
+	var records io.Reader = old
+	var chunks *snapshotChunkReader
+	if c.chunks != nil {
+		chunks = newSnapshotChunkReader(old, c.chunks)
+		records = chunks
+	}
+
 	// Create a decoder
-	dec := codec.NewDecoder(old, msgpackHandle)
+	dec := codec.NewDecoder(records, msgpackHandle)
 
 	// Read in the header
 	var header snapshotHeader
 	if err := dec.Decode(&header); err != nil {
 		return err
 	}
+	if header.SchemaVersion < minSnapshotSchemaVersion ||
+		header.SchemaVersion > snapshotSchemaVersion {
+		return &structs.SnapshotVersionError{
+			Version: header.SchemaVersion,
+			Min:     minSnapshotSchemaVersion,
+			Max:     snapshotSchemaVersion,
+		}
+	}
 
 	// Populate the new state
+	skipped := make(map[structs.MessageType]int)
 	msgType := make([]byte, 1)
 	for {
 		// Read the message type
-		_, err := old.Read(msgType)
+		_, err := records.Read(msgType)
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return err
 		}
 
+		// Record types that older servers can skip over are written with
+		// the ignore flag, like the Raft log entries in Apply.
+		msg := structs.MessageType(msgType[0])
+		ignoreUnknown := false
+		if msg&structs.IgnoreUnknownTypeFlag == structs.IgnoreUnknownTypeFlag {
+			msg &= ^structs.IgnoreUnknownTypeFlag
+			ignoreUnknown = true
+		}
+
 		// Decode
-		switch structs.MessageType(msgType[0]) {
+		switch msg {
 		case structs.RegisterRequestType:
 			var req structs.RegisterRequest
 			if err := dec.Decode(&req); err != nil {
@@ -407,8 +845,9 @@ func (c *consulFSM) Restore(old io.ReadCloser) error {
 			// snapshots as KV entries. We want to keep the snapshot
 			// format compatible with pre-0.6 versions for now.
 			stone := &state.Tombstone{
-				Key:   req.Key,
-				Index: req.ModifyIndex,
+				Key:    req.Key,
+				Index:  req.ModifyIndex,
+				Prefix: req.Flags&tombstonePrefixFlag != 0,
 			}
 			if err := restore.Tombstone(stone); err != nil {
 				return err
@@ -460,24 +899,192 @@ func (c *consulFSM) Restore(old io.ReadCloser) error {
 				return err
 			}
 
+		case structs.CentralCheckRequestType:
+			var req structs.CentralCheck
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.CentralCheck(&req); err != nil {
+				return err
+			}
+
+		case structs.QueryDefaultsRequestType:
+			var req structs.QueryDefaults
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.QueryDefaults(&req); err != nil {
+				return err
+			}
+
+		case structs.DatacenterAliasRequestType:
+			var req structs.DatacenterAlias
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.DatacenterAlias(&req); err != nil {
+				return err
+			}
+
+		case structs.ServiceConstraintRequestType:
+			var req structs.ServiceConstraint
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.ServiceConstraint(&req); err != nil {
+				return err
+			}
+
+		case structs.QueryFreezeRequestType:
+			var req structs.QueryFreeze
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.QueryFreeze(&req); err != nil {
+				return err
+			}
+
+		case structs.SigningKeyRequestType:
+			var req structs.SigningKey
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.SigningKey(&req); err != nil {
+				return err
+			}
+
+		case structs.RemoteWritePolicyRequestType:
+			var req structs.RemoteWritePolicy
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.RemoteWritePolicy(&req); err != nil {
+				return err
+			}
+
+		case structs.ServiceNamePolicyRequestType:
+			var req structs.ServiceNamePolicy
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.ServiceNamePolicy(&req); err != nil {
+				return err
+			}
+
+		case structs.NodeBlockRequestType:
+			var req structs.NodeBlock
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.NodeBlock(&req); err != nil {
+				return err
+			}
+
+		case structs.ServerEventRequestType:
+			var req structs.ServerEvent
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.ServerEvent(&req); err != nil {
+				return err
+			}
+
+		case structs.FederationPolicyRequestType:
+			var req structs.FederationPolicy
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.FederationPolicy(&req); err != nil {
+				return err
+			}
+
+		case structs.OperatorIntentRequestType:
+			var req structs.OperatorIntent
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.OperatorIntent(&req); err != nil {
+				return err
+			}
+
+		case structs.KVQuotaRequestType:
+			var req structs.KVQuota
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.KVQuota(&req); err != nil {
+				return err
+			}
+
+		case structs.ClusterIDRequestType:
+			var req structs.ClusterID
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.ClusterID(&req); err != nil {
+				return err
+			}
+
+		case structs.CatalogTombstoneRequestType:
+			var req state.CatalogTombstone
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if req.Node == "" {
+				if err := restore.CatalogTombstonesReaped(req.Index); err != nil {
+					return err
+				}
+			} else if err := restore.CatalogTombstone(&req); err != nil {
+				return err
+			}
+
 		default:
-			return fmt.Errorf("Unrecognized msg type: %v", msgType)
+			// A newer server wrote a record type we don't know about,
+			// which is only safe to skip over if it says so.
+			if !ignoreUnknown {
+				return fmt.Errorf("Unrecognized msg type: %v", msg)
+			}
+			var req interface{}
+			if err := dec.Decode(&req); err != nil {
+				return fmt.Errorf("failed skipping record of unknown type %d: %v", msg, err)
+			}
+			skipped[msg]++
 		}
 	}
 
 	restore.Commit()
 
+	// Report anything we had to skip.
+	for t, n := range skipped {
+		c.logger.Printf("[WARN] consul.fsm: Skipped %d snapshot records of unknown type %d", n, t)
+		metrics.IncrCounter([]string{"consul", "fsm", "restore", "skipped"}, float32(n))
+	}
+
+	// The chunks aren't needed once the snapshot is in.
+	if chunks != nil {
+		if err := c.chunks.Reset(); err != nil {
+			c.logger.Printf("[WARN] consul.fsm: Failed to clean up snapshot chunks: %v", err)
+		}
+		c.logger.Printf("[INFO] consul.fsm: Restored snapshot from %d chunks (%d written)",
+			len(chunks.hashes), chunks.written)
+	}
+
 	// External code might be calling State(), so we need to synchronize
 	// here to make sure we swap in the new state store atomically.
 	c.stateLock.Lock()
 	stateOld := c.state
 	c.state = stateNew
 	c.stateLock.Unlock()
+	c.setAppliedIndex(header.LastIndex)
 
 	// Signal that the old state store has been abandoned. This is required
 	// because we don't operate on it any more, we just throw it away, so
 	// blocking queries won't see any changes and need to be woken up.
 	stateOld.Abandon()
+
+	// Change hooks didn't see any of this, so let anyone who needs to
+	// start over know.
+	c.hooks.notifyRestore(header.LastIndex)
 	return nil
 }
 
@@ -489,7 +1096,8 @@ func (s *consulSnapshot) Persist(sink raft.SnapshotSink) error {
 
 	// Write the header
 	header := snapshotHeader{
-		LastIndex: s.state.LastIndex(),
+		LastIndex:     s.state.LastIndex(),
+		SchemaVersion: snapshotSchemaVersion,
 	}
 	if err := encoder.Encode(&header); err != nil {
 		sink.Cancel()
@@ -531,6 +1139,81 @@ func (s *consulSnapshot) Persist(sink raft.SnapshotSink) error {
 		return err
 	}
 
+	if err := s.persistCentralChecks(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistQueryDefaults(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistDatacenterAliases(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistServiceConstraints(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistQueryFreeze(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistSigningKeys(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistRemoteWritePolicy(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistCatalogTombstones(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistServiceNamePolicy(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistNodeBlocks(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistServerHistory(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistFederationPolicies(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistOperatorIntents(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistKVQuotas(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := s.persistClusterID(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
+
 	return nil
 }
 
@@ -671,6 +1354,9 @@ func (s *consulSnapshot) persistTombstones(sink raft.SnapshotSink,
 				ModifyIndex: s.Index,
 			},
 		}
+		if s.Prefix {
+			fake.Flags = tombstonePrefixFlag
+		}
 		if err := encoder.Encode(fake); err != nil {
 			return err
 		}
@@ -709,6 +1395,266 @@ func (s *consulSnapshot) persistAutopilot(sink raft.SnapshotSink,
 	return nil
 }
 
+func (s *consulSnapshot) persistCentralChecks(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	checks, err := s.state.CentralChecks()
+	if err != nil {
+		return err
+	}
+
+	for _, check := range checks {
+		sink.Write([]byte{byte(structs.CentralCheckRequestType | structs.IgnoreUnknownTypeFlag)})
+		if err := encoder.Encode(check); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistQueryDefaults(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	defaults, err := s.state.QueryDefaults()
+	if err != nil {
+		return err
+	}
+	if defaults == nil {
+		return nil
+	}
+
+	sink.Write([]byte{byte(structs.QueryDefaultsRequestType | structs.IgnoreUnknownTypeFlag)})
+	if err := encoder.Encode(defaults); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *consulSnapshot) persistDatacenterAliases(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	aliases, err := s.state.DatacenterAliases()
+	if err != nil {
+		return err
+	}
+
+	for _, alias := range aliases {
+		sink.Write([]byte{byte(structs.DatacenterAliasRequestType | structs.IgnoreUnknownTypeFlag)})
+		if err := encoder.Encode(alias); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistServiceConstraints(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	constraints, err := s.state.ServiceConstraints()
+	if err != nil {
+		return err
+	}
+
+	for _, constraint := range constraints {
+		sink.Write([]byte{byte(structs.ServiceConstraintRequestType | structs.IgnoreUnknownTypeFlag)})
+		if err := encoder.Encode(constraint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistQueryFreeze(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	freeze, err := s.state.QueryFreeze()
+	if err != nil {
+		return err
+	}
+	if freeze == nil {
+		return nil
+	}
+
+	sink.Write([]byte{byte(structs.QueryFreezeRequestType | structs.IgnoreUnknownTypeFlag)})
+	if err := encoder.Encode(freeze); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *consulSnapshot) persistSigningKeys(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	keys, err := s.state.SigningKeys()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		sink.Write([]byte{byte(structs.SigningKeyRequestType | structs.IgnoreUnknownTypeFlag)})
+		if err := encoder.Encode(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistRemoteWritePolicy(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	policy, err := s.state.RemoteWritePolicy()
+	if err != nil {
+		return err
+	}
+	if policy == nil {
+		return nil
+	}
+
+	sink.Write([]byte{byte(structs.RemoteWritePolicyRequestType | structs.IgnoreUnknownTypeFlag)})
+	if err := encoder.Encode(policy); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *consulSnapshot) persistServiceNamePolicy(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	policy, err := s.state.ServiceNamePolicy()
+	if err != nil {
+		return err
+	}
+	if policy == nil {
+		return nil
+	}
+
+	sink.Write([]byte{byte(structs.ServiceNamePolicyRequestType | structs.IgnoreUnknownTypeFlag)})
+	if err := encoder.Encode(policy); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *consulSnapshot) persistCatalogTombstones(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	stones, err := s.state.CatalogTombstones()
+	if err != nil {
+		return err
+	}
+
+	for stone := stones.Next(); stone != nil; stone = stones.Next() {
+		sink.Write([]byte{byte(structs.CatalogTombstoneRequestType | structs.IgnoreUnknownTypeFlag)})
+		if err := encoder.Encode(stone.(*state.CatalogTombstone)); err != nil {
+			return err
+		}
+	}
+
+	// A tombstone with no node records how far they've been reaped, so
+	// the servers that restore this still know which deletes they can't
+	// see any more.
+	if reaped := s.state.CatalogTombstonesReaped(); reaped > 0 {
+		sink.Write([]byte{byte(structs.CatalogTombstoneRequestType | structs.IgnoreUnknownTypeFlag)})
+		if err := encoder.Encode(&state.CatalogTombstone{Index: reaped}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistNodeBlocks(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	blocks, err := s.state.NodeBlocks()
+	if err != nil {
+		return err
+	}
+
+	for _, block := range blocks {
+		sink.Write([]byte{byte(structs.NodeBlockRequestType | structs.IgnoreUnknownTypeFlag)})
+		if err := encoder.Encode(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistServerHistory(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	events, err := s.state.ServerHistory()
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		sink.Write([]byte{byte(structs.ServerEventRequestType | structs.IgnoreUnknownTypeFlag)})
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistFederationPolicies(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	policies, err := s.state.FederationPolicies()
+	if err != nil {
+		return err
+	}
+
+	for _, policy := range policies {
+		sink.Write([]byte{byte(structs.FederationPolicyRequestType | structs.IgnoreUnknownTypeFlag)})
+		if err := encoder.Encode(policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistOperatorIntents(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	intents, err := s.state.OperatorIntents()
+	if err != nil {
+		return err
+	}
+
+	for _, intent := range intents {
+		sink.Write([]byte{byte(structs.OperatorIntentRequestType | structs.IgnoreUnknownTypeFlag)})
+		if err := encoder.Encode(intent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistKVQuotas(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	quotas, err := s.state.KVQuotas()
+	if err != nil {
+		return err
+	}
+
+	for _, quota := range quotas {
+		sink.Write([]byte{byte(structs.KVQuotaRequestType | structs.IgnoreUnknownTypeFlag)})
+		if err := encoder.Encode(quota); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistClusterID(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	id, err := s.state.ClusterID()
+	if err != nil {
+		return err
+	}
+	if id == nil {
+		return nil
+	}
+
+	sink.Write([]byte{byte(structs.ClusterIDRequestType | structs.IgnoreUnknownTypeFlag)})
+	if err := encoder.Encode(id); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (s *consulSnapshot) Release() {
 	s.state.Close()
 }
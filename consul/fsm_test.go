@@ -5,12 +5,14 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/consul/consul/state"
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/lib"
 	"github.com/hashicorp/consul/types"
+	"github.com/hashicorp/go-msgpack/codec"
 	"github.com/hashicorp/go-uuid"
 	"github.com/hashicorp/raft"
 	"time"
@@ -363,7 +365,7 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 	// Add some state
 	fsm.state.EnsureNode(1, &structs.Node{Node: "foo", Address: "127.0.0.1"})
 	fsm.state.EnsureNode(2, &structs.Node{Node: "baz", Address: "127.0.0.2", TaggedAddresses: map[string]string{"hello": "1.2.3.4"}})
-	fsm.state.EnsureService(3, "foo", &structs.NodeService{ID: "web", Service: "web", Tags: nil, Address: "127.0.0.1", Port: 80})
+	fsm.state.EnsureService(3, "foo", &structs.NodeService{ID: "web", Service: "web", Tags: nil, Address: "127.0.0.1", Port: 80, Kind: structs.ServiceKindLoadBalancer})
 	fsm.state.EnsureService(4, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"primary"}, Address: "127.0.0.1", Port: 5000})
 	fsm.state.EnsureService(5, "baz", &structs.NodeService{ID: "web", Service: "web", Tags: nil, Address: "127.0.0.2", Port: 80})
 	fsm.state.EnsureService(6, "baz", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"secondary"}, Address: "127.0.0.2", Port: 5000})
@@ -374,9 +376,12 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 		Status:    structs.HealthPassing,
 		ServiceID: "web",
 	})
+	kvTime := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
 	fsm.state.KVSSet(8, &structs.DirEntry{
-		Key:   "/test",
-		Value: []byte("foo"),
+		Key:        "/test",
+		Value:      []byte("foo"),
+		ModifiedBy: "writer",
+		ModifyTime: &kvTime,
 	})
 	session := &structs.Session{ID: generateUUID(), Node: "foo"}
 	fsm.state.SessionCreate(9, session)
@@ -433,6 +438,139 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 		t.Fatalf("err: %s", err)
 	}
 
+	centralCheck := &structs.CentralCheck{
+		ID:       generateUUID(),
+		Name:     "disk",
+		NodeMeta: map[string]string{"rack": "a"},
+		Script:   "/bin/check-disk",
+		Interval: 10 * time.Second,
+	}
+	if err := fsm.state.CentralCheckSet(16, centralCheck); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	queryDefaults := &structs.QueryDefaults{
+		AllowStale:   true,
+		MaxQueryTime: time.Minute,
+		Near:         "foo",
+	}
+	if err := fsm.state.QueryDefaultsSet(17, queryDefaults); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fsm.state.KVSSet(18, &structs.DirEntry{
+		Key:   "/tree/a",
+		Value: []byte("foo"),
+	})
+	if _, err := fsm.state.KVSDeleteTreeMaxTombstones(19, "/tree/", 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dcAlias := &structs.DatacenterAlias{
+		Alias:     "dc-old",
+		Canonical: "dc1",
+	}
+	if err := fsm.state.DatacenterAliasSet(20, dcAlias); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	constraint := &structs.ServiceConstraint{
+		Service:  "web",
+		MetaKeys: []string{"protocol"},
+	}
+	if err := fsm.state.ServiceConstraintSet(21, constraint); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	freeze := &structs.QueryFreeze{
+		Frozen: true,
+		SetBy:  "alice",
+		Reason: "incident",
+	}
+	if err := fsm.state.QueryFreezeSet(22, freeze); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	signingKey, err := structs.GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := fsm.state.SigningKeyRotate(23, signingKey); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	remoteWritePolicy := &structs.RemoteWritePolicy{
+		RefuseRemoteWrites: true,
+	}
+	if err := fsm.state.RemoteWritePolicySet(24, remoteWritePolicy); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	serviceNamePolicy := &structs.ServiceNamePolicy{
+		Enabled:  true,
+		Prefixes: []string{"web-"},
+	}
+	if err := fsm.state.ServiceNamePolicySet(25, serviceNamePolicy); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	nodeBlock := &structs.NodeBlock{
+		Node:    "zombie",
+		ID:      types.NodeID("40e4a748-2192-161a-0510-9bf59fe950b5"),
+		Expires: time.Now().Add(time.Hour).UTC(),
+	}
+	if err := fsm.state.NodeBlockSet(26, nodeBlock); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	serverEvent := &structs.ServerEvent{
+		ServerID:  "a5d1a1a6-f6f9-4b4b-8a93-3e1d2e4c0b6f",
+		Name:      "server2",
+		Address:   "127.0.0.2:8300",
+		Action:    structs.ServerEventAdded,
+		Reason:    "joined as a voter",
+		Initiator: structs.ServerEventByLeader,
+		Time:      time.Now().UTC(),
+	}
+	if err := fsm.state.ServerEventAppend(27, serverEvent); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	federationPolicy := &structs.FederationPolicy{
+		Datacenter: "partner",
+		Forwarding: structs.FederationForwardNone,
+	}
+	if err := fsm.state.FederationPolicySet(28, federationPolicy); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	operatorIntent := &structs.OperatorIntent{
+		ID:       generateUUID(),
+		Kind:     structs.OperatorIntentServerLeave,
+		Target:   "server3",
+		ServerID: "0f5c3d2e-6a3b-4c1d-9e8f-7a6b5c4d3e2f",
+		Address:  "127.0.0.3:8300",
+		Reason:   "left",
+		Step:     "deregister",
+		Started:  time.Now().UTC(),
+	}
+	if err := fsm.state.OperatorIntentCreate(29, operatorIntent); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	kvQuota := &structs.KVQuota{
+		Prefix:  "/te",
+		MaxKeys: 10,
+	}
+	if err := fsm.state.KVQuotaSet(30, kvQuota); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	clusterID := &structs.ClusterID{ID: "a5cd2e6b-4d6f-4f0b-9bd0-6d6fb5f6a1d2"}
+	if err := fsm.state.ClusterIDSet(31, clusterID); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
 	// Snapshot
 	snap, err := fsm.Snapshot()
 	if err != nil {
@@ -491,6 +629,9 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 	if fooSrv.Services["db"].Port != 5000 {
 		t.Fatalf("Bad: %v", fooSrv)
 	}
+	if fooSrv.Services["web"].Kind != structs.ServiceKindLoadBalancer {
+		t.Fatalf("Bad: %v", fooSrv)
+	}
 
 	_, checks, err := fsm2.state.NodeChecks(nil, "foo")
 	if err != nil {
@@ -508,6 +649,11 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 	if string(d.Value) != "foo" {
 		t.Fatalf("bad: %v", d)
 	}
+	if d.CreatedBy != "writer" || d.ModifiedBy != "writer" ||
+		d.CreateTime == nil || !d.CreateTime.Equal(kvTime) ||
+		d.ModifyTime == nil || !d.ModifyTime.Equal(kvTime) {
+		t.Fatalf("bad: %#v", d)
+	}
 
 	// Verify session is restored
 	idx, s, err := fsm2.state.SessionGet(nil, session.ID)
@@ -545,7 +691,11 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 		if stone == nil {
 			t.Fatalf("missing tombstone")
 		}
-		if stone.Key != "/remove" || stone.Index != 12 {
+		if stone.Key != "/remove" || stone.Index != 12 || stone.Prefix {
+			t.Fatalf("bad: %v", stone)
+		}
+		stone = stones.Next().(*state.Tombstone)
+		if stone.Key != "/tree/" || stone.Index != 19 || !stone.Prefix {
 			t.Fatalf("bad: %v", stone)
 		}
 		if stones.Next() != nil {
@@ -583,6 +733,133 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 		t.Fatalf("bad: %#v, %#v", restoredConf, autopilotConf)
 	}
 
+	// Verify central checks are restored.
+	_, restoredCheck, err := fsm2.state.CentralCheckGet(nil, centralCheck.ID)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(restoredCheck, centralCheck) {
+		t.Fatalf("bad: %#v, %#v", restoredCheck, centralCheck)
+	}
+
+	// Verify query defaults are restored.
+	_, restoredDefaults, err := fsm2.state.QueryDefaults(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(restoredDefaults, queryDefaults) {
+		t.Fatalf("bad: %#v, %#v", restoredDefaults, queryDefaults)
+	}
+
+	// Verify datacenter aliases are restored.
+	_, restoredAlias, err := fsm2.state.DatacenterAliasGet(nil, "dc-old")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(restoredAlias, dcAlias) {
+		t.Fatalf("bad: %#v, %#v", restoredAlias, dcAlias)
+	}
+
+	// Verify service constraints are restored.
+	_, restoredConstraint, err := fsm2.state.ServiceConstraintGet(nil, "web")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(restoredConstraint, constraint) {
+		t.Fatalf("bad: %#v, %#v", restoredConstraint, constraint)
+	}
+
+	// Verify the query freeze is restored.
+	_, restoredFreeze, err := fsm2.state.QueryFreeze(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(restoredFreeze, freeze) {
+		t.Fatalf("bad: %#v, %#v", restoredFreeze, freeze)
+	}
+
+	// Verify the signing key is restored.
+	restoredKey, err := fsm2.state.SigningKeyActive()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(restoredKey, signingKey) {
+		t.Fatalf("bad: %#v, %#v", restoredKey, signingKey)
+	}
+
+	// Verify the remote write policy is restored.
+	_, restoredPolicy, err := fsm2.state.RemoteWritePolicy(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(restoredPolicy, remoteWritePolicy) {
+		t.Fatalf("bad: %#v, %#v", restoredPolicy, remoteWritePolicy)
+	}
+
+	// Verify the service name policy is restored.
+	_, restoredNamePolicy, err := fsm2.state.ServiceNamePolicy(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(restoredNamePolicy, serviceNamePolicy) || len(restoredNamePolicy.Existing) == 0 {
+		t.Fatalf("bad: %#v, %#v", restoredNamePolicy, serviceNamePolicy)
+	}
+
+	// Verify the node block is restored.
+	_, restoredBlocks, err := fsm2.state.NodeBlockList(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(restoredBlocks) != 1 || !reflect.DeepEqual(restoredBlocks[0], nodeBlock) {
+		t.Fatalf("bad: %#v, %#v", restoredBlocks, nodeBlock)
+	}
+
+	// Verify the server history is restored.
+	_, restoredEvents, _, err := fsm2.state.ServerHistory(nil, 0, 10)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(restoredEvents) != 1 || !reflect.DeepEqual(restoredEvents[0], serverEvent) {
+		t.Fatalf("bad: %#v, %#v", restoredEvents, serverEvent)
+	}
+
+	// Verify the federation policy is restored.
+	_, restoredFederation, err := fsm2.state.FederationPolicyGet(nil, "partner")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(restoredFederation, federationPolicy) {
+		t.Fatalf("bad: %#v, %#v", restoredFederation, federationPolicy)
+	}
+
+	// Verify the operator intent is restored.
+	_, restoredIntents, err := fsm2.state.OperatorIntentList(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(restoredIntents) != 1 || !reflect.DeepEqual(restoredIntents[0], operatorIntent) {
+		t.Fatalf("bad: %#v, %#v", restoredIntents, operatorIntent)
+	}
+
+	// Verify the KV quota is restored, with its usage.
+	_, restoredQuotas, err := fsm2.state.KVQuotaList(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(restoredQuotas) != 1 || !reflect.DeepEqual(restoredQuotas[0], kvQuota) ||
+		restoredQuotas[0].Usage.Keys != 1 || restoredQuotas[0].Usage.Bytes != 3 {
+		t.Fatalf("bad: %#v, %#v", restoredQuotas, kvQuota)
+	}
+
+	// Verify the cluster ID is restored.
+	_, restoredClusterID, err := fsm2.state.ClusterID(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(restoredClusterID, clusterID) {
+		t.Fatalf("bad: %#v, %#v", restoredClusterID, clusterID)
+	}
+
 	// Snapshot
 	snap, err = fsm2.Snapshot()
 	if err != nil {
@@ -611,6 +888,64 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 
 }
 
+func TestFSM_SnapshotRestore_CatalogTombstones(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Delete a couple of services and reap the first delete.
+	fsm.state.EnsureNode(1, &structs.Node{Node: "foo", Address: "127.0.0.1"})
+	fsm.state.EnsureService(2, "foo", &structs.NodeService{ID: "web", Service: "web"})
+	fsm.state.EnsureService(3, "foo", &structs.NodeService{ID: "db", Service: "db"})
+	fsm.state.EnsureService(4, "foo", &structs.NodeService{ID: "cache", Service: "cache"})
+	if err := fsm.state.DeleteService(5, "foo", "web"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := fsm.state.DeleteService(6, "foo", "db"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := fsm.state.ReapTombstones(5); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Snapshot and restore it into a new FSM.
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+	buf := bytes.NewBuffer(nil)
+	sink := &MockSink{buf, false}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fsm2, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := fsm2.Restore(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The remaining delete should still be visible, and indexes from
+	// before the reap should still need a full resync.
+	diff, err := fsm2.state.NodeCatalogDiff("foo", map[string]uint64{"services": 5, "checks": 5}, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if diff.FullResync || !reflect.DeepEqual(diff.DeletedServices, []string{"db"}) {
+		t.Fatalf("bad: %#v", diff)
+	}
+	diff, err = fsm2.state.NodeCatalogDiff("foo", map[string]uint64{"services": 4, "checks": 4}, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !diff.FullResync {
+		t.Fatalf("bad: %#v", diff)
+	}
+}
+
 func TestFSM_BadRestore(t *testing.T) {
 	// Create an FSM with some state.
 	fsm, err := NewFSM(nil, os.Stderr)
@@ -649,94 +984,307 @@ func TestFSM_BadRestore(t *testing.T) {
 	}
 }
 
-func TestFSM_KVSDelete(t *testing.T) {
+func TestFSM_Persist_SchemaVersion(t *testing.T) {
 	fsm, err := NewFSM(nil, os.Stderr)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
+	fsm.state.EnsureNode(1, &structs.Node{Node: "foo", Address: "127.0.0.1"})
 
-	req := structs.KVSRequest{
-		Datacenter: "dc1",
-		Op:         structs.KVSSet,
-		DirEnt: structs.DirEntry{
-			Key:   "/test/path",
-			Flags: 0,
-			Value: []byte("test"),
-		},
-	}
-	buf, err := structs.Encode(structs.KVSRequestType, req)
+	snap, err := fsm.Snapshot()
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	resp := fsm.Apply(makeLog(buf))
-	if resp != nil {
-		t.Fatalf("resp: %v", resp)
+	defer snap.Release()
+	buf := bytes.NewBuffer(nil)
+	sink := &MockSink{buf, false}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
 	}
 
-	// Run the delete
-	req.Op = structs.KVSDelete
-	buf, err = structs.Encode(structs.KVSRequestType, req)
-	if err != nil {
+	// The header should always carry the current version.
+	var header snapshotHeader
+	if err := codec.NewDecoder(buf, msgpackHandle).Decode(&header); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	resp = fsm.Apply(makeLog(buf))
-	if resp != nil {
-		t.Fatalf("resp: %v", resp)
+	if header.SchemaVersion != snapshotSchemaVersion || header.LastIndex != 1 {
+		t.Fatalf("bad: %#v", header)
 	}
+}
 
-	// Verify key is not set
-	_, d, err := fsm.state.KVSGet(nil, "/test/path")
-	if err != nil {
+// encodeTestSnapshot hand-crafts a snapshot with the given header and
+// records.
+func encodeTestSnapshot(t *testing.T, header snapshotHeader, records ...interface{}) *bytes.Buffer {
+	buf := bytes.NewBuffer(nil)
+	enc := codec.NewEncoder(buf, msgpackHandle)
+	if err := enc.Encode(&header); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if d != nil {
-		t.Fatalf("key present")
+	for i := 0; i < len(records); i += 2 {
+		buf.WriteByte(byte(records[i].(structs.MessageType)))
+		if err := enc.Encode(records[i+1]); err != nil {
+			t.Fatalf("err: %v", err)
+		}
 	}
+	return buf
 }
 
-func TestFSM_KVSDeleteTree(t *testing.T) {
+func TestFSM_Restore_SchemaVersion(t *testing.T) {
 	fsm, err := NewFSM(nil, os.Stderr)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
+	fsm.state.EnsureNode(1, &structs.Node{Node: "foo", Address: "127.0.0.1"})
+	abandonCh := fsm.state.AbandonCh()
 
-	req := structs.KVSRequest{
-		Datacenter: "dc1",
-		Op:         structs.KVSSet,
-		DirEnt: structs.DirEntry{
-			Key:   "/test/path",
-			Flags: 0,
-			Value: []byte("test"),
-		},
+	// A snapshot from a newer server should be refused, naming both
+	// versions.
+	header := snapshotHeader{
+		LastIndex:     5,
+		SchemaVersion: snapshotSchemaVersion + 1,
 	}
-	buf, err := structs.Encode(structs.KVSRequestType, req)
-	if err != nil {
+	buf := encodeTestSnapshot(t, header,
+		structs.RegisterRequestType, &structs.RegisterRequest{Node: "bar", Address: "127.0.0.2"})
+	err = fsm.Restore(&MockSink{buf, false})
+	if !structs.HasErrorCode(err, structs.ErrCodeSnapshotVersion) {
 		t.Fatalf("err: %v", err)
 	}
-	resp := fsm.Apply(makeLog(buf))
-	if resp != nil {
-		t.Fatalf("resp: %v", resp)
+	expected := fmt.Sprintf("snapshot has version %d but this server supports %d through %d",
+		snapshotSchemaVersion+1, minSnapshotSchemaVersion, snapshotSchemaVersion)
+	if !strings.Contains(err.Error(), expected) {
+		t.Fatalf("err: %v", err)
 	}
 
-	// Run the delete tree
-	req.Op = structs.KVSDeleteTree
-	req.DirEnt.Key = "/test"
-	buf, err = structs.Encode(structs.KVSRequestType, req)
+	// Nothing should have changed.
+	_, nodes, err := fsm.state.Nodes(nil)
 	if err != nil {
-		t.Fatalf("err: %v", err)
+		t.Fatalf("err: %s", err)
 	}
-	resp = fsm.Apply(makeLog(buf))
-	if resp != nil {
-		t.Fatalf("resp: %v", resp)
+	if len(nodes) != 1 || nodes[0].Node != "foo" {
+		t.Fatalf("bad: %v", nodes)
+	}
+	select {
+	case <-abandonCh:
+		t.Fatalf("bad")
+	default:
 	}
 
-	// Verify key is not set
-	_, d, err := fsm.state.KVSGet(nil, "/test/path")
-	if err != nil {
+	// A snapshot from before versioning should still restore.
+	header.SchemaVersion = 0
+	buf = encodeTestSnapshot(t, header,
+		structs.RegisterRequestType, &structs.RegisterRequest{Node: "bar", Address: "127.0.0.2"})
+	if err := fsm.Restore(&MockSink{buf, false}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if d != nil {
-		t.Fatalf("key present")
+	_, nodes, err = fsm.state.Nodes(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(nodes) != 1 || nodes[0].Node != "bar" {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
+func TestFSM_Restore_UnknownTypes(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Records of types we don't know should be skipped over without
+	// throwing off the ones around them, as long as they're flagged.
+	type future struct {
+		Name  string
+		Items []string
+		Meta  map[string]int
+	}
+	header := snapshotHeader{
+		LastIndex:     5,
+		SchemaVersion: snapshotSchemaVersion,
+	}
+	buf := encodeTestSnapshot(t, header,
+		structs.RegisterRequestType, &structs.RegisterRequest{Node: "foo", Address: "127.0.0.1"},
+		structs.MessageType(100)|structs.IgnoreUnknownTypeFlag, &future{Name: "a", Items: []string{"x", "y"}, Meta: map[string]int{"z": 1}},
+		structs.KVSRequestType|structs.IgnoreUnknownTypeFlag, &structs.DirEntry{Key: "hello", Value: []byte("world")},
+		structs.MessageType(100)|structs.IgnoreUnknownTypeFlag, &future{Name: "b"},
+		structs.MessageType(101)|structs.IgnoreUnknownTypeFlag, "just a string",
+		structs.RegisterRequestType, &structs.RegisterRequest{Node: "bar", Address: "127.0.0.2"})
+	if err := fsm.Restore(&MockSink{buf, false}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, nodes, err := fsm.state.Nodes(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	_, d, err := fsm.state.KVSGet(nil, "hello")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if d == nil || string(d.Value) != "world" {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Unknown records without the flag should fail the restore.
+	buf = encodeTestSnapshot(t, header,
+		structs.RegisterRequestType, &structs.RegisterRequest{Node: "foo", Address: "127.0.0.1"},
+		structs.MessageType(100), &future{Name: "a"})
+	err = fsm.Restore(&MockSink{buf, false})
+	if err == nil || !strings.Contains(err.Error(), "Unrecognized msg type") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestFSM_KVSDelete(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "/test/path",
+			Flags: 0,
+			Value: []byte("test"),
+		},
+	}
+	buf, err := structs.Encode(structs.KVSRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// Run the delete
+	req.Op = structs.KVSDelete
+	buf, err = structs.Encode(structs.KVSRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// Verify key is not set
+	_, d, err := fsm.state.KVSGet(nil, "/test/path")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d != nil {
+		t.Fatalf("key present")
+	}
+}
+
+func TestFSM_KVSDeleteTree(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "/test/path",
+			Flags: 0,
+			Value: []byte("test"),
+		},
+	}
+	buf, err := structs.Encode(structs.KVSRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// Run the delete tree
+	req.Op = structs.KVSDeleteTree
+	req.DirEnt.Key = "/test"
+	buf, err = structs.Encode(structs.KVSRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// Verify key is not set
+	_, d, err := fsm.state.KVSGet(nil, "/test/path")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d != nil {
+		t.Fatalf("key present")
+	}
+}
+
+func TestFSM_KVSDeleteTree_MaxTombstones(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	apply := func(req structs.KVSRequest) {
+		buf, err := structs.Encode(structs.KVSRequestType, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp := fsm.Apply(makeLog(buf)); resp != nil {
+			t.Fatalf("resp: %v", resp)
+		}
+	}
+	for _, key := range []string{"/a/1", "/a/2", "/b/1"} {
+		apply(structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Value: []byte("test"),
+			},
+		})
+	}
+
+	// Deleting more keys than the limit should collapse, and asking to
+	// skip tombstones should collapse even under the limit.
+	apply(structs.KVSRequest{
+		Datacenter:    "dc1",
+		Op:            structs.KVSDeleteTree,
+		DirEnt:        structs.DirEntry{Key: "/a/"},
+		MaxTombstones: 1,
+	})
+	apply(structs.KVSRequest{
+		Datacenter:     "dc1",
+		Op:             structs.KVSDeleteTree,
+		DirEnt:         structs.DirEntry{Key: "/b/"},
+		SkipTombstones: true,
+	})
+
+	snap := fsm.state.Snapshot()
+	defer snap.Close()
+	stones, err := snap.Tombstones()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var keys []string
+	for stone := stones.Next(); stone != nil; stone = stones.Next() {
+		s := stone.(*state.Tombstone)
+		if !s.Prefix {
+			t.Fatalf("bad: %#v", s)
+		}
+		keys = append(keys, s.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"/a/", "/b/"}) {
+		t.Fatalf("bad: %v", keys)
 	}
 }
 
@@ -1394,6 +1942,599 @@ func TestFSM_Autopilot(t *testing.T) {
 	}
 }
 
+func TestFSM_QueryDefaults(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.QueryDefaultsSetRequest{
+		Datacenter: "dc1",
+		Defaults: structs.QueryDefaults{
+			AllowStale:   true,
+			MaxQueryTime: time.Minute,
+		},
+	}
+	buf, err := structs.Encode(structs.QueryDefaultsRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	_, defaults, err := fsm.state.QueryDefaults(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !defaults.AllowStale || defaults.MaxQueryTime != time.Minute || defaults.Near != "" {
+		t.Fatalf("bad: %#v", defaults)
+	}
+}
+
+func TestFSM_QueryFreeze(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.QueryFreezeRequest{
+		Datacenter: "dc1",
+		Freeze: structs.QueryFreeze{
+			Frozen: true,
+			SetBy:  "alice",
+			Reason: "incident",
+		},
+	}
+	buf, err := structs.Encode(structs.QueryFreezeRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	_, freeze, err := fsm.state.QueryFreeze(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !freeze.Frozen || freeze.SetBy != "alice" || freeze.Reason != "incident" {
+		t.Fatalf("bad: %#v", freeze)
+	}
+}
+
+func TestFSM_ClusterID(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.ClusterIDRequest{
+		Datacenter: "dc1",
+		ClusterID: structs.ClusterID{
+			ID: "a5cd2e6b-4d6f-4f0b-9bd0-6d6fb5f6a1d2",
+		},
+	}
+	buf, err := structs.Encode(structs.ClusterIDRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	// A second ID should be ignored.
+	req.ClusterID.ID = "d1f2b3a4-0000-4000-8000-000000000000"
+	buf, err = structs.Encode(structs.ClusterIDRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	_, id, err := fsm.state.ClusterID(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if id == nil || id.ID != "a5cd2e6b-4d6f-4f0b-9bd0-6d6fb5f6a1d2" {
+		t.Fatalf("bad: %#v", id)
+	}
+}
+
+func TestFSM_ServiceNamePolicy(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Set the policy.
+	req := structs.ServiceNamePolicyRequest{
+		Datacenter: "dc1",
+		Op:         structs.ServiceNamePolicySet,
+		Policy: structs.ServiceNamePolicy{
+			Enabled: true,
+			Names:   []string{"web"},
+		},
+	}
+	buf, err := structs.Encode(structs.ServiceNamePolicyRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	_, policy, err := fsm.state.ServiceNamePolicy(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !policy.Enabled || !reflect.DeepEqual(policy.Names, []string{"web"}) {
+		t.Fatalf("bad: %#v", policy)
+	}
+
+	// Delete it.
+	req.Op = structs.ServiceNamePolicyDelete
+	buf, err = structs.Encode(structs.ServiceNamePolicyRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	_, policy, err = fsm.state.ServiceNamePolicy(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if policy != nil {
+		t.Fatalf("bad: %#v", policy)
+	}
+}
+
+func TestFSM_RemoteWritePolicy(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.RemoteWritePolicyRequest{
+		Datacenter: "dc1",
+		Policy: structs.RemoteWritePolicy{
+			RefuseRemoteWrites: true,
+		},
+	}
+	buf, err := structs.Encode(structs.RemoteWritePolicyRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	_, policy, err := fsm.state.RemoteWritePolicy(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !policy.RefuseRemoteWrites {
+		t.Fatalf("bad: %#v", policy)
+	}
+}
+
+func TestFSM_SigningKey(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	key, err := structs.GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req := structs.SigningKeyRequest{
+		Datacenter: "dc1",
+		Key:        *key,
+	}
+	buf, err := structs.Encode(structs.SigningKeyRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	active, err := fsm.state.SigningKeyActive()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if active == nil || active.ID != key.ID || !active.Active {
+		t.Fatalf("bad: %#v", active)
+	}
+}
+
+func TestFSM_DatacenterAlias(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.DatacenterAliasRequest{
+		Datacenter: "dc1",
+		Op:         structs.DatacenterAliasSet,
+		Alias: structs.DatacenterAlias{
+			Alias:     "dc-old",
+			Canonical: "dc2",
+		},
+	}
+	buf, err := structs.Encode(structs.DatacenterAliasRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	_, alias, err := fsm.state.DatacenterAliasGet(nil, "dc-old")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if alias == nil || alias.Canonical != "dc2" {
+		t.Fatalf("bad: %#v", alias)
+	}
+
+	// Chaining an alias should come back as an error.
+	req.Alias = structs.DatacenterAlias{
+		Alias:     "dc-older",
+		Canonical: "dc-old",
+	}
+	buf, err = structs.Encode(structs.DatacenterAliasRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := fsm.Apply(makeLog(buf)).(error); !ok {
+		t.Fatalf("should fail")
+	}
+
+	// Now delete the first one.
+	req.Op = structs.DatacenterAliasDelete
+	req.Alias = structs.DatacenterAlias{Alias: "dc-old"}
+	buf, err = structs.Encode(structs.DatacenterAliasRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+	_, alias, err = fsm.state.DatacenterAliasGet(nil, "dc-old")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if alias != nil {
+		t.Fatalf("bad: %#v", alias)
+	}
+}
+
+func TestFSM_ServiceConstraint(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.ServiceConstraintRequest{
+		Datacenter: "dc1",
+		Op:         structs.ServiceConstraintSet,
+		Constraint: structs.ServiceConstraint{
+			Service:  "web",
+			MetaKeys: []string{"protocol"},
+		},
+	}
+	buf, err := structs.Encode(structs.ServiceConstraintRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	_, constraint, err := fsm.state.ServiceConstraintGet(nil, "web")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if constraint == nil || !reflect.DeepEqual(constraint.MetaKeys, []string{"protocol"}) {
+		t.Fatalf("bad: %#v", constraint)
+	}
+
+	// Now delete it.
+	req.Op = structs.ServiceConstraintDelete
+	req.Constraint = structs.ServiceConstraint{Service: "web"}
+	buf, err = structs.Encode(structs.ServiceConstraintRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+	_, constraint, err = fsm.state.ServiceConstraintGet(nil, "web")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if constraint != nil {
+		t.Fatalf("bad: %#v", constraint)
+	}
+}
+
+func TestFSM_NodeBlock(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.NodeBlockRequest{
+		Datacenter: "dc1",
+		Op:         structs.NodeBlockSet,
+		Block: structs.NodeBlock{
+			Node: "zombie",
+		},
+	}
+	buf, err := structs.Encode(structs.NodeBlockRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	_, blocks, err := fsm.state.NodeBlockList(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(blocks) != 1 || blocks[0].Node != "zombie" {
+		t.Fatalf("bad: %#v", blocks)
+	}
+
+	// Now clear it.
+	req.Op = structs.NodeBlockClear
+	buf, err = structs.Encode(structs.NodeBlockRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+	_, blocks, err = fsm.state.NodeBlockList(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(blocks) != 0 {
+		t.Fatalf("bad: %#v", blocks)
+	}
+}
+
+func TestFSM_OperatorIntent(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	apply := func(index uint64, req structs.OperatorIntentRequest) interface{} {
+		buf, err := structs.Encode(structs.OperatorIntentRequestType, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		log := makeLog(buf)
+		log.Index = index
+		return fsm.Apply(log)
+	}
+
+	id := generateUUID()
+	req := structs.OperatorIntentRequest{
+		Datacenter: "dc1",
+		Op:         structs.OperatorIntentCreate,
+		Intent: structs.OperatorIntent{
+			ID:     id,
+			Kind:   structs.OperatorIntentServerLeave,
+			Target: "server3",
+			Step:   "remove-peer",
+		},
+	}
+	if resp := apply(1, req); resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	// Move it along, which only works once from the same index.
+	req.Op = structs.OperatorIntentUpdate
+	req.Intent = structs.OperatorIntent{ID: id, Step: "deregister", RaftIndex: structs.RaftIndex{ModifyIndex: 1}}
+	if resp := apply(2, req); resp != true {
+		t.Fatalf("bad: %v", resp)
+	}
+	if resp := apply(3, req); resp != false {
+		t.Fatalf("bad: %v", resp)
+	}
+	_, intent, err := fsm.state.OperatorIntentGet(nil, id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if intent.Step != "deregister" || intent.ModifyIndex != 2 {
+		t.Fatalf("bad: %#v", intent)
+	}
+
+	// Now delete it.
+	req.Op = structs.OperatorIntentDelete
+	req.Intent = structs.OperatorIntent{ID: id, RaftIndex: structs.RaftIndex{ModifyIndex: 2}}
+	if resp := apply(4, req); resp != true {
+		t.Fatalf("bad: %v", resp)
+	}
+	_, intents, err := fsm.state.OperatorIntentList(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(intents) != 0 {
+		t.Fatalf("bad: %#v", intents)
+	}
+}
+
+func TestFSM_KVQuota(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	apply := func(index uint64, msgType structs.MessageType, req interface{}) interface{} {
+		buf, err := structs.Encode(msgType, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		log := makeLog(buf)
+		log.Index = index
+		return fsm.Apply(log)
+	}
+
+	req := structs.KVQuotaRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVQuotaSet,
+		Quota: structs.KVQuota{
+			Prefix:  "team/",
+			MaxKeys: 1,
+		},
+	}
+	if resp := apply(1, structs.KVQuotaRequestType, req); resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	// The second key should be refused.
+	set := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "team/a",
+			Value: []byte("a"),
+		},
+	}
+	if resp := apply(2, structs.KVSRequestType, set); resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+	set.DirEnt.Key = "team/b"
+	resp := apply(3, structs.KVSRequestType, set)
+	if err, ok := resp.(error); !ok || !structs.HasErrorCode(err, structs.ErrCodeKVQuotaExceeded) {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	// Once the quota is deleted it should go through.
+	req.Op = structs.KVQuotaDelete
+	req.Quota = structs.KVQuota{Prefix: "team/"}
+	if resp := apply(4, structs.KVQuotaRequestType, req); resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+	_, quotas, err := fsm.state.KVQuotaList(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(quotas) != 0 {
+		t.Fatalf("bad: %#v", quotas)
+	}
+	if resp := apply(5, structs.KVSRequestType, set); resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+}
+
+func TestFSM_ServerEvent(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.ServerEventRequest{
+		Datacenter: "dc1",
+		Event: structs.ServerEvent{
+			ServerID:  "server1",
+			Action:    structs.ServerEventRemoved,
+			Reason:    "dead server cleanup",
+			Initiator: structs.ServerEventByAutopilot,
+		},
+	}
+	buf, err := structs.Encode(structs.ServerEventRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	_, events, _, err := fsm.state.ServerHistory(nil, 0, 10)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(events) != 1 || events[0].ServerID != "server1" ||
+		events[0].Initiator != structs.ServerEventByAutopilot {
+		t.Fatalf("bad: %#v", events)
+	}
+}
+
+func TestFSM_FederationPolicy(t *testing.T) {
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.FederationPolicyRequest{
+		Datacenter: "dc1",
+		Op:         structs.FederationPolicySet,
+		Policy: structs.FederationPolicy{
+			Datacenter: "dc2",
+			Forwarding: structs.FederationForwardReads,
+		},
+	}
+	buf, err := structs.Encode(structs.FederationPolicyRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	_, policy, err := fsm.state.FederationPolicyGet(nil, "dc2")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if policy == nil || policy.Forwarding != structs.FederationForwardReads {
+		t.Fatalf("bad: %#v", policy)
+	}
+
+	// Now delete it.
+	req.Op = structs.FederationPolicyDelete
+	buf, err = structs.Encode(structs.FederationPolicyRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+	_, policy, err = fsm.state.FederationPolicyGet(nil, "dc2")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if policy != nil {
+		t.Fatalf("bad: %#v", policy)
+	}
+}
+
 func TestFSM_IgnoreUnknown(t *testing.T) {
 	fsm, err := NewFSM(nil, os.Stderr)
 	if err != nil {
@@ -0,0 +1,119 @@
+package consul
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/serf/serf"
+)
+
+// gossipQueues are the Serf queues that count towards a pool's depth when
+// checking it against GossipDegradedThreshold.
+var gossipQueues = []string{"intent_queue", "event_queue", "query_queue"}
+
+// gossipHealthLoop samples the health of the gossip pools until the server
+// shuts down.
+func (s *Server) gossipHealthLoop() {
+	ticker := s.clock.NewTicker(s.config.GossipHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdownCh:
+			return
+		case <-ticker.C():
+			s.checkGossipHealth()
+		}
+	}
+}
+
+// checkGossipHealth samples the LAN pool and, if it's been set up, the WAN
+// pool.
+func (s *Server) checkGossipHealth() {
+	s.checkGossipPool("lan", s.serfLAN)
+	if wan := s.getSerfWAN(); wan != nil {
+		s.checkGossipPool("wan", wan)
+	}
+}
+
+// checkGossipPool emits metrics for the given pool's queues and health, and
+// updates whether it's degraded, logging when that changes.
+func (s *Server) checkGossipPool(pool string, sf *serf.Serf) {
+	stats := sf.Stats()
+	depth := 0
+	for _, queue := range gossipQueues {
+		n, _ := strconv.Atoi(stats[queue])
+		depth += n
+		metrics.SetGauge([]string{"consul", "gossip", pool, queue}, float32(n))
+	}
+	score, _ := strconv.Atoi(stats["health_score"])
+	metrics.SetGauge([]string{"consul", "gossip", pool, "health_score"}, float32(score))
+	metrics.SetGauge([]string{"consul", "gossip", pool, "retransmit_limit"},
+		float32(s.gossipRetransmitLimit(pool, sf)))
+
+	threshold := s.config.GossipDegradedThreshold
+	degraded := threshold > 0 && depth > threshold
+
+	s.gossipDegradedLock.Lock()
+	wasDegraded := s.gossipDegraded[pool]
+	s.gossipDegraded[pool] = degraded
+	s.gossipDegradedLock.Unlock()
+
+	if degraded {
+		metrics.SetGauge([]string{"consul", "gossip", pool, "degraded"}, 1)
+	} else {
+		metrics.SetGauge([]string{"consul", "gossip", pool, "degraded"}, 0)
+	}
+	switch {
+	case degraded && !wasDegraded:
+		s.logger.Printf("[WARN] consul: %s gossip pool is degraded, %d messages are queued (threshold %d)",
+			pool, depth, threshold)
+	case !degraded && wasDegraded:
+		s.logger.Printf("[INFO] consul: %s gossip pool has recovered, %d messages are queued", pool, depth)
+	}
+}
+
+// gossipRetransmitLimit returns how many times each broadcast in the given
+// pool is retransmitted, which grows with the size of the pool. This mirrors
+// the limit memberlist computes internally.
+func (s *Server) gossipRetransmitLimit(pool string, sf *serf.Serf) int {
+	conf := s.config.SerfLANConfig
+	if pool == "wan" {
+		conf = s.config.SerfWANConfig
+	}
+	mult := conf.MemberlistConfig.RetransmitMult
+	scale := math.Ceil(math.Log10(float64(sf.NumNodes() + 1)))
+	return mult * int(scale)
+}
+
+// isGossipDegraded returns whether the given pool was degraded as of the last
+// check.
+func (s *Server) isGossipDegraded(pool string) bool {
+	s.gossipDegradedLock.RLock()
+	defer s.gossipDegradedLock.RUnlock()
+	return s.gossipDegraded[pool]
+}
+
+// gossipStats returns the Serf stats for the given pool, along with its
+// retransmit limit and whether it's degraded.
+func (s *Server) gossipStats(pool string, sf *serf.Serf) map[string]string {
+	stats := sf.Stats()
+	stats["retransmit_limit"] = strconv.Itoa(s.gossipRetransmitLimit(pool, sf))
+	stats["degraded"] = strconv.FormatBool(s.isGossipDegraded(pool))
+	return stats
+}
+
+// gossipEventDelay holds off firing a user event while the LAN pool is
+// degraded, if configured. It returns early if the server shuts down.
+func (s *Server) gossipEventDelay() {
+	delay := s.config.GossipDegradedEventDelay
+	if delay == 0 || !s.isGossipDegraded("lan") {
+		return
+	}
+	select {
+	case <-time.After(delay):
+	case <-s.shutdownCh:
+	}
+}
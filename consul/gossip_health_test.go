@@ -0,0 +1,122 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestServer_GossipHealth(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.RaftConfig.ProtocolVersion = 3
+		c.ServerHealthInterval = 100 * time.Millisecond
+		c.GossipDegradedThreshold = 10
+		c.GossipDegradedEventDelay = 200 * time.Millisecond
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Bootstrap = false
+		c.RaftConfig.ProtocolVersion = 3
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return len(s1.LANMembers()) == 2 && len(s2.LANMembers()) == 2, nil
+	}); err != nil {
+		t.Fatalf("should have 2 members: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Both pools should report their queues and health.
+	stats := s2.Stats()
+	for _, pool := range []string{"serf_lan", "serf_wan"} {
+		for _, key := range []string{"intent_queue", "event_queue", "query_queue", "health_score"} {
+			if _, ok := stats[pool][key]; !ok {
+				t.Fatalf("missing %s %s: %v", pool, key, stats[pool])
+			}
+		}
+		if stats[pool]["degraded"] != "false" {
+			t.Fatalf("bad: %v", stats[pool])
+		}
+	}
+	if stats["serf_lan"]["retransmit_limit"] != "4" {
+		t.Fatalf("bad: %v", stats["serf_lan"])
+	}
+
+	// Back up the leader's LAN pool with more events than it can
+	// send at once, which should push it over its threshold.
+	for i := 0; i < 50; i++ {
+		if err := s1.serfLAN.UserEvent(fmt.Sprintf("flood-%d", i), nil, false); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	s1.checkGossipHealth()
+	if !s1.isGossipDegraded("lan") {
+		t.Fatalf("should be degraded: %v", s1.Stats()["serf_lan"])
+	}
+	if s1.Stats()["serf_lan"]["degraded"] != "true" {
+		t.Fatalf("bad: %v", s1.Stats()["serf_lan"])
+	}
+
+	// Events fired through the server get held off while it's degraded.
+	event := structs.EventFireRequest{
+		Name:       "foo",
+		Datacenter: "dc1",
+	}
+	start := time.Now()
+	if err := msgpackrpc.CallWithCodec(codec, "Internal.EventFire", &event, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("event should have been delayed: %v", elapsed)
+	}
+
+	// The leader should call itself out in the cluster health.
+	if err := testutil.WaitForResult(func() (bool, error) {
+		health := s1.getClusterHealth()
+		for _, server := range health.Servers {
+			if server.Name == s1.config.NodeName && !server.GossipDegraded {
+				return false, fmt.Errorf("bad: %v", server)
+			}
+		}
+		for _, warning := range health.Warnings {
+			if strings.Contains(warning, s1.config.NodeName) {
+				return true, nil
+			}
+		}
+		return false, fmt.Errorf("bad: %v", health.Warnings)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the queue drains the pool should recover, and the warning
+	// should go away.
+	if err := testutil.WaitForResult(func() (bool, error) {
+		s1.checkGossipHealth()
+		return !s1.isGossipDegraded("lan"), nil
+	}); err != nil {
+		t.Fatalf("should have recovered: %v", s1.Stats()["serf_lan"])
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		health := s1.getClusterHealth()
+		return len(health.Warnings) == 0, fmt.Errorf("bad: %v", health.Warnings)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
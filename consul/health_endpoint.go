@@ -2,6 +2,8 @@ package consul
 
 import (
 	"fmt"
+	"strings"
+
 	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/consul/state"
 	"github.com/hashicorp/consul/consul/structs"
@@ -36,10 +38,14 @@ func (h *Health) ChecksInState(args *structs.ChecksInStateRequest,
 				return err
 			}
 			reply.Index, reply.HealthChecks = index, checks
-			if err := h.srv.filterACL(args.Token, reply); err != nil {
+			if err := h.srv.filterACL("Health.ChecksInState", args.Token, reply); err != nil {
+				return err
+			}
+			if err := h.srv.sortNodesByDistanceFrom(args.Source, reply.HealthChecks); err != nil {
 				return err
 			}
-			return h.srv.sortNodesByDistanceFrom(args.Source, reply.HealthChecks)
+			h.srv.truncateResults(&reply.QueryMeta, &reply.HealthChecks)
+			return nil
 		})
 }
 
@@ -59,7 +65,11 @@ func (h *Health) NodeChecks(args *structs.NodeSpecificRequest,
 				return err
 			}
 			reply.Index, reply.HealthChecks = index, checks
-			return h.srv.filterACL(args.Token, reply)
+			if err := h.srv.filterACL("Health.NodeChecks", args.Token, reply); err != nil {
+				return err
+			}
+			h.srv.truncateResults(&reply.QueryMeta, &reply.HealthChecks)
+			return nil
 		})
 }
 
@@ -92,10 +102,14 @@ func (h *Health) ServiceChecks(args *structs.ServiceSpecificRequest,
 				return err
 			}
 			reply.Index, reply.HealthChecks = index, checks
-			if err := h.srv.filterACL(args.Token, reply); err != nil {
+			if err := h.srv.filterACL("Health.ServiceChecks", args.Token, reply); err != nil {
 				return err
 			}
-			return h.srv.sortNodesByDistanceFrom(args.Source, reply.HealthChecks)
+			if err := h.srv.sortNodesByDistanceFrom(args.Source, reply.HealthChecks); err != nil {
+				return err
+			}
+			h.srv.truncateResults(&reply.QueryMeta, &reply.HealthChecks)
+			return nil
 		})
 }
 
@@ -106,8 +120,8 @@ func (h *Health) ServiceNodes(args *structs.ServiceSpecificRequest, reply *struc
 	}
 
 	// Verify the arguments
-	if args.ServiceName == "" {
-		return fmt.Errorf("Must provide service name")
+	if args.ServiceName == "" && args.ServiceAddress == "" {
+		return fmt.Errorf("Must provide service name or address")
 	}
 
 	err := h.srv.blockingQuery(
@@ -117,9 +131,13 @@ func (h *Health) ServiceNodes(args *structs.ServiceSpecificRequest, reply *struc
 			var index uint64
 			var nodes structs.CheckServiceNodes
 			var err error
-			if args.TagFilter {
+			switch {
+			case args.ServiceAddress != "":
+				index, nodes, err = state.CheckServiceNodesByAddress(ws, args.ServiceAddress)
+				nodes = serviceAddressFilter(args, nodes)
+			case args.TagFilter:
 				index, nodes, err = state.CheckServiceTagNodes(ws, args.ServiceName, args.ServiceTag)
-			} else {
+			default:
 				index, nodes, err = state.CheckServiceNodes(ws, args.ServiceName)
 			}
 			if err != nil {
@@ -130,14 +148,27 @@ func (h *Health) ServiceNodes(args *structs.ServiceSpecificRequest, reply *struc
 			if len(args.NodeMetaFilters) > 0 {
 				reply.Nodes = nodeMetaFilter(args.NodeMetaFilters, reply.Nodes)
 			}
-			if err := h.srv.filterACL(args.Token, reply); err != nil {
+			if err := h.srv.filterACL("Health.ServiceNodes", args.Token, reply); err != nil {
+				return err
+			}
+			if err := h.srv.sortNodesByDistanceFrom(args.Source, reply.Nodes); err != nil {
 				return err
 			}
-			return h.srv.sortNodesByDistanceFrom(args.Source, reply.Nodes)
+			h.srv.truncateResults(&reply.QueryMeta, &reply.Nodes)
+			if args.Signed {
+				sig, err := signResult(state, reply.Index, reply.Nodes)
+				if err != nil {
+					return err
+				}
+				reply.Signature = sig
+			}
+			return nil
 		})
 
 	// Provide some metrics
-	if err == nil {
+	if err == nil && args.ServiceAddress != "" {
+		metrics.IncrCounter([]string{"consul", "health", "service", "query-address"}, 1)
+	} else if err == nil {
 		metrics.IncrCounter([]string{"consul", "health", "service", "query", args.ServiceName}, 1)
 		if args.ServiceTag != "" {
 			metrics.IncrCounter([]string{"consul", "health", "service", "query-tag", args.ServiceName, args.ServiceTag}, 1)
@@ -148,3 +179,32 @@ func (h *Health) ServiceNodes(args *structs.ServiceSpecificRequest, reply *struc
 	}
 	return err
 }
+
+// serviceAddressFilter applies the service name and tag from an address lookup
+// to its results.
+func serviceAddressFilter(args *structs.ServiceSpecificRequest, nodes structs.CheckServiceNodes) structs.CheckServiceNodes {
+	if args.ServiceName == "" && !args.TagFilter {
+		return nodes
+	}
+
+	var filtered structs.CheckServiceNodes
+	for _, node := range nodes {
+		if args.ServiceName != "" && !strings.EqualFold(node.Service.Service, args.ServiceName) {
+			continue
+		}
+		if args.TagFilter {
+			found := false
+			for _, tag := range node.Service.Tags {
+				if strings.EqualFold(tag, args.ServiceTag) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		filtered = append(filtered, node)
+	}
+	return filtered
+}
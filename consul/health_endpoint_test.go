@@ -2,6 +2,9 @@ package consul
 
 import (
 	"os"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -592,6 +595,95 @@ func TestHealth_ServiceNodes(t *testing.T) {
 	}
 }
 
+func TestHealth_ServiceNodes_ByAddress(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Put a web instance on a VIP, and a db instance on a node with the
+	// same address.
+	for _, arg := range []structs.RegisterRequest{
+		structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       "foo",
+			Address:    "10.1.0.1",
+			Service: &structs.NodeService{
+				ID:      "web",
+				Service: "web",
+				Tags:    []string{"primary"},
+				Address: "10.1.0.100",
+			},
+		},
+		structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       "bar",
+			Address:    "10.1.0.100",
+			Service: &structs.NodeService{
+				ID:      "db",
+				Service: "db",
+			},
+		},
+		structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       "baz",
+			Address:    "10.1.0.2",
+			Service: &structs.NodeService{
+				ID:      "web",
+				Service: "web",
+				Address: "10.1.0.200",
+			},
+		},
+	} {
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	lookup := func(req structs.ServiceSpecificRequest) []string {
+		req.Datacenter = "dc1"
+		var out structs.IndexedCheckServiceNodes
+		if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var found []string
+		for _, node := range out.Nodes {
+			found = append(found, node.Node.Node+"/"+node.Service.ID)
+		}
+		sort.Strings(found)
+		return found
+	}
+
+	cases := []struct {
+		req      structs.ServiceSpecificRequest
+		expected []string
+	}{
+		{structs.ServiceSpecificRequest{ServiceAddress: "10.1.0.100"}, []string{"bar/db", "foo/web"}},
+		{structs.ServiceSpecificRequest{ServiceAddress: "10.1.0.200"}, []string{"baz/web"}},
+		{structs.ServiceSpecificRequest{ServiceAddress: "10.1.0.1"}, nil},
+		{structs.ServiceSpecificRequest{ServiceAddress: "10.1.0.100", ServiceName: "web"}, []string{"foo/web"}},
+		{structs.ServiceSpecificRequest{ServiceAddress: "10.1.0.100", ServiceTag: "primary", TagFilter: true}, []string{"foo/web"}},
+		{structs.ServiceSpecificRequest{ServiceAddress: "10.1.0.200", ServiceTag: "primary", TagFilter: true}, nil},
+	}
+	for _, tc := range cases {
+		if found := lookup(tc.req); !reflect.DeepEqual(found, tc.expected) {
+			t.Fatalf("bad: %#v %v", tc.req, found)
+		}
+	}
+
+	// One of the name or address is required.
+	req := structs.ServiceSpecificRequest{Datacenter: "dc1"}
+	var out structs.IndexedCheckServiceNodes
+	err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &out)
+	if err == nil || !strings.Contains(err.Error(), "Must provide service name or address") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestHealth_ServiceNodes_NodeMetaFilter(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -915,6 +1007,22 @@ func TestHealth_ServiceNodes_FilterACL(t *testing.T) {
 		t.Fatalf("bad: %#v", reply.Nodes)
 	}
 
+	// Address lookups should be filtered by service too. Both services
+	// are on the server's node, along with the consul service.
+	opt.ServiceName = ""
+	opt.ServiceAddress = "127.0.0.1"
+	reply = structs.IndexedCheckServiceNodes{}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &opt, &reply); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var services []string
+	for _, node := range reply.Nodes {
+		services = append(services, node.Service.Service)
+	}
+	if !lib.StrContains(services, "foo") || lib.StrContains(services, "bar") {
+		t.Fatalf("bad: %v", services)
+	}
+
 	// We've already proven that we call the ACL filtering function so we
 	// test node filtering down in acl.go for node cases. This also proves
 	// that we respect the version 8 ACL flag, since the test server sets
@@ -0,0 +1,332 @@
+package consul
+
+import (
+	"fmt"
+	"net/rpc"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// These are the names of the histograms the servers emit. Observations
+	// are in seconds, and the names follow the Prometheus convention of
+	// ending with the unit, so they won't collide with the regular metrics.
+	histogramRPCRequest = "consul.rpc.request_seconds"
+	histogramRaftApply  = "consul.raft.apply_seconds"
+	histogramFSMApply   = "consul.fsm.apply_seconds"
+	histogramCrossDC    = "consul.rpc.cross_dc_seconds"
+
+	// unknownRPCMethod is used as the method label for requests for methods
+	// that don't exist, since the names come from clients and would
+	// otherwise let them blow up the number of label values.
+	unknownRPCMethod = "unknown"
+)
+
+var (
+	// defaultLatencyBuckets are the default histogram buckets, in seconds,
+	// for operations that should normally finish quickly.
+	defaultLatencyBuckets = []float64{
+		0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+	}
+
+	// defaultRPCBuckets extend the default buckets to cover blocking
+	// queries, which can run for up to maxQueryTime.
+	defaultRPCBuckets = append(append([]float64{}, defaultLatencyBuckets...),
+		30, 60, 300, 600)
+)
+
+// HistogramDefinition describes a histogram the servers emit. This maps onto
+// a Prometheus histogram, with the dots in the name swapped for underscores.
+type HistogramDefinition struct {
+	Name string
+	Help string
+
+	// Labels are the names of the labels given with every observation. These
+	// are limited to values with a small, bounded set of values, like RPC
+	// method names and datacenters, and never hold things like node names or
+	// keys.
+	Labels []string
+
+	// Buckets holds the upper bounds of the buckets, in seconds, in
+	// increasing order.
+	Buckets []float64
+}
+
+// HistogramSink receives histograms from a server. This is separate from the
+// regular metrics sinks, which don't support labels and can only report
+// lossy quantiles for timings.
+type HistogramSink interface {
+	// DefineHistogram is called for each histogram when the server starts,
+	// before any observations are made for it.
+	DefineHistogram(def HistogramDefinition)
+
+	// ObserveHistogram records an observation, in seconds. The labels will
+	// be the ones from the histogram's definition.
+	ObserveHistogram(name string, labels map[string]string, value float64)
+}
+
+// HistogramDefinitions returns the histograms the servers emit, with their
+// default buckets.
+func HistogramDefinitions() []HistogramDefinition {
+	return []HistogramDefinition{
+		HistogramDefinition{
+			Name:    histogramRPCRequest,
+			Help:    "Time taken to serve an RPC request, including any blocking or forwarding.",
+			Labels:  []string{"method", "dc"},
+			Buckets: defaultRPCBuckets,
+		},
+		HistogramDefinition{
+			Name:    histogramRaftApply,
+			Help:    "Time taken to commit and apply a write through Raft.",
+			Labels:  []string{"dc"},
+			Buckets: defaultLatencyBuckets,
+		},
+		HistogramDefinition{
+			Name:    histogramFSMApply,
+			Help:    "Time taken to apply a committed Raft log to the state store.",
+			Labels:  []string{"dc"},
+			Buckets: defaultLatencyBuckets,
+		},
+		HistogramDefinition{
+			Name:    histogramCrossDC,
+			Help:    "Time taken by RPC requests forwarded to another datacenter.",
+			Labels:  []string{"method", "dc"},
+			Buckets: defaultLatencyBuckets,
+		},
+	}
+}
+
+// serverHistograms feeds a server's latency observations to its histogram
+// sink. A nil serverHistograms is valid and drops everything, which is what
+// servers without a sink use.
+type serverHistograms struct {
+	sink HistogramSink
+
+	// dc is the server's datacenter, used as the label for local
+	// operations.
+	dc string
+}
+
+// newServerHistograms checks the histogram configuration and defines the
+// histograms with the sink. This returns nil if there's no sink configured.
+func newServerHistograms(config *Config) (*serverHistograms, error) {
+	defs := HistogramDefinitions()
+	byName := make(map[string]*HistogramDefinition)
+	for i := range defs {
+		byName[defs[i].Name] = &defs[i]
+	}
+	for name, buckets := range config.HistogramBuckets {
+		def, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown histogram %q", name)
+		}
+		if len(buckets) == 0 {
+			return nil, fmt.Errorf("Histogram %q must have at least one bucket", name)
+		}
+		for i := 1; i < len(buckets); i++ {
+			if buckets[i] <= buckets[i-1] {
+				return nil, fmt.Errorf("Buckets for histogram %q must be increasing", name)
+			}
+		}
+		def.Buckets = buckets
+	}
+
+	if config.HistogramSink == nil {
+		return nil, nil
+	}
+	for _, def := range defs {
+		config.HistogramSink.DefineHistogram(def)
+	}
+	return &serverHistograms{
+		sink: config.HistogramSink,
+		dc:   config.Datacenter,
+	}, nil
+}
+
+// measureRPC records the time taken to serve a request for the given method.
+func (h *serverHistograms) measureRPC(method string, start time.Time) {
+	if h == nil {
+		return
+	}
+	h.observe(histogramRPCRequest, map[string]string{"method": method, "dc": h.dc}, start)
+}
+
+// measureRaftApply records the time taken to apply a write through Raft.
+func (h *serverHistograms) measureRaftApply(start time.Time) {
+	if h == nil {
+		return
+	}
+	h.observe(histogramRaftApply, map[string]string{"dc": h.dc}, start)
+}
+
+// measureFSMApply records the time taken to apply a log to the FSM.
+func (h *serverHistograms) measureFSMApply(start time.Time) {
+	if h == nil {
+		return
+	}
+	h.observe(histogramFSMApply, map[string]string{"dc": h.dc}, start)
+}
+
+// measureCrossDC records the time taken by a request for the given method
+// forwarded to another datacenter.
+func (h *serverHistograms) measureCrossDC(method, dc string, start time.Time) {
+	if h == nil {
+		return
+	}
+	h.observe(histogramCrossDC, map[string]string{"method": method, "dc": dc}, start)
+}
+
+func (h *serverHistograms) observe(name string, labels map[string]string, start time.Time) {
+	h.sink.ObserveHistogram(name, labels, time.Now().Sub(start).Seconds())
+}
+
+// rpcMethodLabel returns the method label to use for an RPC response. This
+// keeps requests for methods that don't exist from adding new label values.
+func rpcMethodLabel(r *rpc.Response) string {
+	if strings.HasPrefix(r.Error, "rpc: can't find") ||
+		strings.HasPrefix(r.Error, "rpc: service/method request ill-formed") {
+		return unknownRPCMethod
+	}
+	return r.ServiceMethod
+}
+
+// InmemHistogramSink is a HistogramSink that keeps the histograms in memory.
+// This is mainly useful for testing.
+type InmemHistogramSink struct {
+	// defs holds the histogram definitions, by name.
+	defs map[string]HistogramDefinition
+
+	// histograms holds the histograms that have been observed, by name and
+	// then by their labels.
+	histograms map[string]map[string]*InmemHistogram
+
+	lock sync.Mutex
+}
+
+// InmemHistogram is a histogram for a single set of labels.
+type InmemHistogram struct {
+	Labels  map[string]string
+	Buckets []float64
+
+	// Counts holds the cumulative count for each bucket, so Counts[i] is
+	// the number of observations less than or equal to Buckets[i].
+	// Observations past the last bucket are only reflected in Count.
+	Counts []uint64
+
+	Count uint64
+	Sum   float64
+}
+
+// NewInmemHistogramSink returns an empty InmemHistogramSink.
+func NewInmemHistogramSink() *InmemHistogramSink {
+	return &InmemHistogramSink{
+		defs:       make(map[string]HistogramDefinition),
+		histograms: make(map[string]map[string]*InmemHistogram),
+	}
+}
+
+// DefineHistogram registers a histogram. See HistogramSink.
+func (s *InmemHistogramSink) DefineHistogram(def HistogramDefinition) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.defs[def.Name] = def
+	if _, ok := s.histograms[def.Name]; !ok {
+		s.histograms[def.Name] = make(map[string]*InmemHistogram)
+	}
+}
+
+// ObserveHistogram records an observation. See HistogramSink. Observations
+// for histograms that haven't been defined are dropped.
+func (s *InmemHistogramSink) ObserveHistogram(name string, labels map[string]string, value float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	def, ok := s.defs[name]
+	if !ok {
+		return
+	}
+	key := inmemHistogramKey(labels)
+	h, ok := s.histograms[name][key]
+	if !ok {
+		h = &InmemHistogram{
+			Labels:  make(map[string]string),
+			Buckets: def.Buckets,
+			Counts:  make([]uint64, len(def.Buckets)),
+		}
+		for k, v := range labels {
+			h.Labels[k] = v
+		}
+		s.histograms[name][key] = h
+	}
+	for i, bound := range h.Buckets {
+		if value <= bound {
+			h.Counts[i]++
+		}
+	}
+	h.Count++
+	h.Sum += value
+}
+
+// Definition returns the definition for the histogram with the given name.
+func (s *InmemHistogramSink) Definition(name string) (HistogramDefinition, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	def, ok := s.defs[name]
+	return def, ok
+}
+
+// Histogram returns a copy of the histogram with the given name and labels,
+// or nil if nothing has been observed for it.
+func (s *InmemHistogramSink) Histogram(name string, labels map[string]string) *InmemHistogram {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	h, ok := s.histograms[name][inmemHistogramKey(labels)]
+	if !ok {
+		return nil
+	}
+	return h.copy()
+}
+
+// Histograms returns copies of all the histograms with the given name, one
+// for each set of labels that's been observed.
+func (s *InmemHistogramSink) Histograms(name string) []*InmemHistogram {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var keys []string
+	for key := range s.histograms[name] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var results []*InmemHistogram
+	for _, key := range keys {
+		results = append(results, s.histograms[name][key].copy())
+	}
+	return results
+}
+
+func (h *InmemHistogram) copy() *InmemHistogram {
+	c := *h
+	c.Labels = make(map[string]string)
+	for k, v := range h.Labels {
+		c.Labels[k] = v
+	}
+	c.Counts = append([]uint64{}, h.Counts...)
+	return &c
+}
+
+// inmemHistogramKey returns a key that's unique to a set of labels.
+func inmemHistogramKey(labels map[string]string) string {
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,211 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestInmemHistogramSink(t *testing.T) {
+	sink := NewInmemHistogramSink()
+	sink.DefineHistogram(HistogramDefinition{
+		Name:    "foo",
+		Labels:  []string{"dc"},
+		Buckets: []float64{0.1, 1},
+	})
+
+	labels := map[string]string{"dc": "dc1"}
+	for _, v := range []float64{0.05, 0.1, 0.5, 2} {
+		sink.ObserveHistogram("foo", labels, v)
+	}
+	sink.ObserveHistogram("foo", map[string]string{"dc": "dc2"}, 0.5)
+	sink.ObserveHistogram("bar", labels, 0.5)
+
+	// Buckets are cumulative, and the last observation is past them all.
+	h := sink.Histogram("foo", labels)
+	if h == nil {
+		t.Fatalf("missing histogram")
+	}
+	if !reflect.DeepEqual(h.Counts, []uint64{2, 3}) || h.Count != 4 || h.Sum != 2.65 {
+		t.Fatalf("bad: %#v", h)
+	}
+	if hs := sink.Histograms("foo"); len(hs) != 2 || hs[1].Labels["dc"] != "dc2" {
+		t.Fatalf("bad: %#v", hs)
+	}
+
+	// Undefined histograms are dropped.
+	if h := sink.Histogram("bar", labels); h != nil {
+		t.Fatalf("bad: %#v", h)
+	}
+
+	// Copies shouldn't change underneath us.
+	sink.ObserveHistogram("foo", labels, 0.05)
+	if h.Count != 4 {
+		t.Fatalf("bad: %#v", h)
+	}
+}
+
+func TestServer_Histograms_BadConfig(t *testing.T) {
+	cases := []struct {
+		buckets  map[string][]float64
+		expected string
+	}{
+		{map[string][]float64{"nope": {1}}, "Unknown histogram"},
+		{map[string][]float64{histogramRaftApply: {}}, "at least one bucket"},
+		{map[string][]float64{histogramRaftApply: {1, 0.5}}, "must be increasing"},
+		{map[string][]float64{histogramRaftApply: {1, 1}}, "must be increasing"},
+	}
+	for _, tc := range cases {
+		dir, config := testServerConfig(t, "Node 1")
+		config.HistogramSink = NewInmemHistogramSink()
+		config.HistogramBuckets = tc.buckets
+		_, err := NewServer(config)
+		os.RemoveAll(dir)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("bad: %v", err)
+		}
+	}
+}
+
+func TestServer_Histograms(t *testing.T) {
+	sink := NewInmemHistogramSink()
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.HistogramSink = sink
+		c.HistogramBuckets = map[string][]float64{
+			histogramRPCRequest: {0.1, 0.5, 10},
+		}
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Every histogram should have been defined, with our override applied.
+	for _, def := range HistogramDefinitions() {
+		actual, ok := sink.Definition(def.Name)
+		if !ok {
+			t.Fatalf("missing %q", def.Name)
+		}
+		if def.Name == histogramRPCRequest {
+			def.Buckets = []float64{0.1, 0.5, 10}
+		}
+		if !reflect.DeepEqual(actual, def) {
+			t.Fatalf("bad: %#v", actual)
+		}
+	}
+
+	// Make a quick request, and then a slow one by blocking until it times
+	// out.
+	args := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var out structs.IndexedServices
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListServices", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	args.MinQueryIndex = out.Index
+	args.MaxQueryTime = 200 * time.Millisecond
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListServices", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	h := sink.Histogram(histogramRPCRequest, map[string]string{"method": "Catalog.ListServices", "dc": "dc1"})
+	if h == nil {
+		t.Fatalf("missing histogram")
+	}
+	if !reflect.DeepEqual(h.Counts, []uint64{1, 2, 2}) || h.Count != 2 || h.Sum < 0.2 {
+		t.Fatalf("bad: %#v", h)
+	}
+
+	// A write should show up in the Raft and FSM histograms.
+	kv := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "test",
+			Value: []byte("test"),
+		},
+	}
+	var ok bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &kv, &ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, name := range []string{histogramRaftApply, histogramFSMApply} {
+		h := sink.Histogram(name, map[string]string{"dc": "dc1"})
+		if h == nil || h.Count == 0 {
+			t.Fatalf("bad: %s %#v", name, h)
+		}
+	}
+
+	// Methods that don't exist should all be lumped together. The server
+	// hangs up after these, so each needs its own connection.
+	for i := 0; i < 3; i++ {
+		method := fmt.Sprintf("Nope.Method%d", i)
+		codec := rpcClient(t, s1)
+		if err := msgpackrpc.CallWithCodec(codec, method, &args, &out); err == nil {
+			t.Fatalf("should fail")
+		}
+		codec.Close()
+	}
+	h = sink.Histogram(histogramRPCRequest, map[string]string{"method": unknownRPCMethod, "dc": "dc1"})
+	if h == nil || h.Count != 3 {
+		t.Fatalf("bad: %#v", h)
+	}
+
+	// Nothing should have been labeled with anything but method and dc.
+	for _, def := range HistogramDefinitions() {
+		for _, h := range sink.Histograms(def.Name) {
+			for label, value := range h.Labels {
+				if label != "method" && label != "dc" {
+					t.Fatalf("bad: %s %s=%s", def.Name, label, value)
+				}
+				if strings.Contains(value, "test") || strings.Contains(value, s1.config.NodeName) {
+					t.Fatalf("bad: %s %s=%s", def.Name, label, value)
+				}
+			}
+		}
+	}
+}
+
+func TestServer_Histograms_CrossDC(t *testing.T) {
+	sink := NewInmemHistogramSink()
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.HistogramSink = sink
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerDC(t, "dc2")
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	// Try to join
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc2")
+
+	args := structs.DCSpecificRequest{
+		Datacenter: "dc2",
+	}
+	var out structs.IndexedServices
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListServices", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	h := sink.Histogram(histogramCrossDC, map[string]string{"method": "Catalog.ListServices", "dc": "dc2"})
+	if h == nil || h.Count != 1 {
+		t.Fatalf("bad: %#v", h)
+	}
+}
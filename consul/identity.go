@@ -0,0 +1,392 @@
+package consul
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/types"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+)
+
+// latestRaftConfiguration returns the most recent Raft configuration found
+// in the given stores, looking at the log first and then falling back to the
+// latest snapshot. This returns false if there's no configuration.
+func latestRaftConfiguration(logs raft.LogStore, snaps raft.SnapshotStore) (raft.Configuration, bool, error) {
+	// Find the latest snapshot, if any.
+	var snapIndex uint64
+	var snapConfig raft.Configuration
+	metas, err := snaps.List()
+	if err != nil {
+		return raft.Configuration{}, false, fmt.Errorf("failed to list snapshots: %v", err)
+	}
+	if len(metas) > 0 {
+		snapIndex = metas[0].Index
+		snapConfig = metas[0].Configuration
+	}
+
+	// Walk the log backwards looking for a configuration change that's
+	// newer than the snapshot.
+	first, err := logs.FirstIndex()
+	if err != nil {
+		return raft.Configuration{}, false, fmt.Errorf("failed to get first log index: %v", err)
+	}
+	last, err := logs.LastIndex()
+	if err != nil {
+		return raft.Configuration{}, false, fmt.Errorf("failed to get last log index: %v", err)
+	}
+	for index := last; index >= first && index > snapIndex && index > 0; index-- {
+		var entry raft.Log
+		if err := logs.GetLog(index, &entry); err != nil {
+			// The log may have been compacted underneath the snapshot,
+			// so just stop looking.
+			break
+		}
+		if entry.Type != raft.LogConfiguration {
+			continue
+		}
+
+		var configuration raft.Configuration
+		if err := structs.Decode(entry.Data, &configuration); err != nil {
+			return raft.Configuration{}, false, fmt.Errorf("failed to decode configuration at index %d: %v", index, err)
+		}
+		return configuration, true, nil
+	}
+
+	if len(metas) > 0 {
+		return snapConfig, true, nil
+	}
+	return raft.Configuration{}, false, nil
+}
+
+// checkRaftID makes sure that the Raft state on disk doesn't have this
+// server's address registered under a different server ID, which can happen
+// if a data directory was restored from another server. That would leave a
+// ghost voter in the configuration, so we refuse to start unless the operator
+// has said it's ok with AllowStaleRaftID, in which case the Raft state is
+// rewritten to use our ID.
+//
+// Servers added before Raft protocol version 3 have their address as their
+// ID, and the leader swaps those for the real ID once the server's been
+// upgraded, so they aren't treated as a mismatch.
+func (s *Server) checkRaftID(logs raft.LogStore, stable raft.StableStore,
+	snaps raft.SnapshotStore, trans raft.Transport) error {
+	// Server IDs are just addresses before version 3, so there's nothing
+	// to check.
+	if s.config.RaftConfig.ProtocolVersion < 3 {
+		return nil
+	}
+
+	configuration, ok, err := latestRaftConfiguration(logs, snaps)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	localID, localAddr := s.config.RaftConfig.LocalID, trans.LocalAddr()
+	for i, server := range configuration.Servers {
+		if server.Address != localAddr || server.ID == localID ||
+			server.ID == raft.ServerID(server.Address) {
+			continue
+		}
+
+		if !s.config.AllowStaleRaftID {
+			return fmt.Errorf("Raft state in %q has this server's address %s registered with ID %q, "+
+				"but this server's node ID is %q. This usually means the data directory came from "+
+				"another server%s. Either remove the data directory, or set allow_stale_raft_id to "+
+				"take over the existing Raft state with this server's ID.",
+				s.config.DataDir, localAddr, server.ID, localID, s.lastIdentity.describe())
+		}
+
+		s.logger.Printf("[WARN] consul: Raft state has this server's address %s registered with ID %q, "+
+			"rewriting it to use this server's node ID %q since allow_stale_raft_id is set",
+			localAddr, server.ID, localID)
+		configuration.Servers[i].ID = localID
+		tmpFsm, err := NewFSM(s.tombstoneGC, s.config.LogOutput)
+		if err != nil {
+			return fmt.Errorf("failed to make temp FSM to rewrite Raft ID: %v", err)
+		}
+		if err := raft.RecoverCluster(s.config.RaftConfig, tmpFsm,
+			logs, stable, snaps, trans, configuration); err != nil {
+			return fmt.Errorf("failed to rewrite Raft ID: %v", err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// raftOriginKey is set in the Raft stable store when a server starts with no
+// Raft state, to record whether it bootstrapped the cluster or joined one. A
+// server restarted in bootstrap mode uses this to tell whether the cluster in
+// its Raft state is its own.
+var raftOriginKey = []byte("ConsulRaftOrigin")
+
+const (
+	// raftOriginJoined means the server joined a cluster that was
+	// bootstrapped by another server.
+	raftOriginJoined uint64 = 1
+
+	// raftOriginBootstrapped means the server bootstrapped the cluster.
+	raftOriginBootstrapped uint64 = 2
+)
+
+// setRaftOrigin records how this server came to be in its cluster.
+func setRaftOrigin(stable raft.StableStore, origin uint64) error {
+	if err := stable.SetUint64(raftOriginKey, origin); err != nil {
+		return fmt.Errorf("failed to record Raft origin: %v", err)
+	}
+	return nil
+}
+
+// bootstrappedHere returns true if this server bootstrapped the cluster in the
+// given Raft state. Servers whose Raft state predates the origin being
+// recorded are recognized by the first configuration in the log, since that's
+// the bootstrap configuration with just the server that made it. If that's
+// been compacted away there's no telling, so the server is given the benefit
+// of the doubt.
+func (s *Server) bootstrappedHere(logs raft.LogStore, stable raft.StableStore,
+	trans raft.Transport) (bool, error) {
+	// The stores return an error for keys that were never set.
+	origin, _ := stable.GetUint64(raftOriginKey)
+	switch origin {
+	case raftOriginBootstrapped:
+		return true, nil
+	case raftOriginJoined:
+		return false, nil
+	}
+
+	var entry raft.Log
+	if err := logs.GetLog(1, &entry); err != nil {
+		s.logger.Printf("[WARN] consul: Can't tell if this server bootstrapped the cluster in its " +
+			"Raft state, since the start of the log has been compacted; assuming it did")
+		return true, nil
+	}
+	if entry.Type != raft.LogConfiguration {
+		return false, nil
+	}
+	var configuration raft.Configuration
+	if err := structs.Decode(entry.Data, &configuration); err != nil {
+		return false, fmt.Errorf("failed to decode configuration at index 1: %v", err)
+	}
+	here := len(configuration.Servers) == 1 &&
+		(configuration.Servers[0].ID == s.config.RaftConfig.LocalID ||
+			configuration.Servers[0].Address == trans.LocalAddr())
+	origin = raftOriginJoined
+	if here {
+		origin = raftOriginBootstrapped
+	}
+	return here, setRaftOrigin(stable, origin)
+}
+
+// checkBootstrapState makes sure a server that's been told to bootstrap
+// doesn't have Raft state from a cluster with other servers, unless it's the
+// server that bootstrapped that cluster in the first place. Bootstrapping on
+// top of another cluster's state would let it elect itself leader of its own
+// cluster while the rest carry on without it. This is refused unless
+// ForceBootstrap is set.
+func (s *Server) checkBootstrapState(logs raft.LogStore, stable raft.StableStore,
+	snaps raft.SnapshotStore, trans raft.Transport) error {
+	here, err := s.bootstrappedHere(logs, stable, trans)
+	if err != nil {
+		return err
+	}
+	if here {
+		return nil
+	}
+
+	configuration, ok, err := latestRaftConfiguration(logs, snaps)
+	if err != nil {
+		return err
+	}
+	if !ok || len(configuration.Servers) <= 1 {
+		return nil
+	}
+
+	var servers []string
+	for _, server := range configuration.Servers {
+		if string(server.ID) == string(server.Address) {
+			servers = append(servers, string(server.Address))
+		} else {
+			servers = append(servers, fmt.Sprintf("%s (%s)", server.ID, server.Address))
+		}
+	}
+	if !s.config.ForceBootstrap {
+		return fmt.Errorf("Bootstrap mode is set, but the Raft state in %q shows this server was part of "+
+			"a cluster with %d servers: %s. Bootstrapping could split the cluster. Either start "+
+			"without bootstrap mode to rejoin the cluster, recover it with a peers.json file if the "+
+			"other servers are gone, remove the data directory to start over, or set force_bootstrap "+
+			"to start anyway.",
+			s.config.DataDir, len(configuration.Servers), strings.Join(servers, ", "))
+	}
+
+	s.logger.Printf("[WARN] consul: Bootstrap mode is set, but the Raft state shows this server was part "+
+		"of a cluster with %d servers: %s. Starting anyway since force_bootstrap is set",
+		len(configuration.Servers), strings.Join(servers, ", "))
+	return nil
+}
+
+// checkSerfSnapshot makes sure that the Serf snapshot doesn't have a node with
+// a different name recorded at this server's gossip address, which would
+// mean the snapshot came from another node. This is skipped if the address
+// isn't known ahead of time. Setting AllowStaleRaftID only logs a warning.
+func (s *Server) checkSerfSnapshot(conf *serf.Config) error {
+	if conf.SnapshotPath == "" {
+		return nil
+	}
+
+	// Figure out the address this node will be gossiping with.
+	addr, port := conf.MemberlistConfig.AdvertiseAddr, conf.MemberlistConfig.AdvertisePort
+	if addr == "" {
+		addr, port = conf.MemberlistConfig.BindAddr, conf.MemberlistConfig.BindPort
+	}
+	if ip := net.ParseIP(addr); ip == nil || ip.IsUnspecified() || conf.MemberlistConfig.Transport != nil {
+		return nil
+	}
+	local := net.JoinHostPort(addr, strconv.Itoa(port))
+
+	fh, err := os.Open(conf.SnapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open Serf snapshot: %v", err)
+	}
+	defer fh.Close()
+
+	// Replay the snapshot the same way Serf does to find the nodes it
+	// thinks are alive.
+	alive := make(map[string]string)
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "alive: ") {
+			info := strings.TrimPrefix(line, "alive: ")
+			idx := strings.LastIndex(info, " ")
+			if idx == -1 {
+				continue
+			}
+			alive[info[:idx]] = info[idx+1:]
+		} else if strings.HasPrefix(line, "not-alive: ") {
+			delete(alive, strings.TrimPrefix(line, "not-alive: "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read Serf snapshot: %v", err)
+	}
+
+	for name, addr := range alive {
+		if addr != local || name == conf.NodeName {
+			continue
+		}
+
+		if !s.config.AllowStaleRaftID {
+			return fmt.Errorf("Serf snapshot %q has node %q at this server's address %s, "+
+				"but this server's node name is %q. This usually means the data directory came "+
+				"from another server. Either remove the data directory, or set allow_stale_raft_id "+
+				"to start anyway.", conf.SnapshotPath, name, local, conf.NodeName)
+		}
+
+		s.logger.Printf("[WARN] consul: Serf snapshot %q has node %q at this server's address %s, "+
+			"starting anyway as %q since allow_stale_raft_id is set",
+			conf.SnapshotPath, name, local, conf.NodeName)
+	}
+	return nil
+}
+
+// nodeIdentityFile is the file in the data directory that records which node
+// last used it.
+const nodeIdentityFile = "node-identity.json"
+
+// nodeIdentity is the identity of the server using a data directory.
+type nodeIdentity struct {
+	NodeID     types.NodeID
+	NodeName   string
+	Datacenter string
+}
+
+// describe returns a phrase naming the node, for use in error messages. This
+// is empty if there's no identity.
+func (i *nodeIdentity) describe() string {
+	if i == nil {
+		return ""
+	}
+	return fmt.Sprintf(" (last used by node %q with ID %q in datacenter %q)",
+		i.NodeName, i.NodeID, i.Datacenter)
+}
+
+// readNodeIdentity returns the identity recorded in the given data
+// directory, or nil if there isn't one.
+func readNodeIdentity(dir string) (*nodeIdentity, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, nodeIdentityFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read node identity: %v", err)
+	}
+
+	var identity nodeIdentity
+	if err := json.Unmarshal(buf, &identity); err != nil {
+		return nil, fmt.Errorf("failed to parse node identity: %v", err)
+	}
+	return &identity, nil
+}
+
+// writeNodeIdentity records the given identity in the data directory. It's
+// written to a temp file and moved into place, so a crash can't leave a
+// partial file behind.
+func writeNodeIdentity(dir string, identity *nodeIdentity) error {
+	buf, err := json.MarshalIndent(identity, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, nodeIdentityFile)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return fmt.Errorf("failed to write node identity: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write node identity: %v", err)
+	}
+	return nil
+}
+
+// checkNodeIdentity makes sure the data directory was last used by a node
+// with this server's node ID, and then records this server as its user. A
+// mismatch is refused unless AllowStaleRaftID is set, the same as the Raft
+// and Serf checks.
+func (s *Server) checkNodeIdentity() error {
+	if s.config.DevMode {
+		return nil
+	}
+
+	last, localID := s.lastIdentity, s.config.NodeID
+	if last != nil && last.NodeID != "" && localID != "" && last.NodeID != localID {
+		if !s.config.AllowStaleRaftID {
+			return fmt.Errorf("Data directory %q belongs to node %q with ID %q, but this server's "+
+				"node ID is %q. This usually means the data directory came from another server. "+
+				"Either remove the data directory, or set allow_stale_raft_id to take it over.",
+				s.config.DataDir, last.NodeName, last.NodeID, localID)
+		}
+
+		s.logger.Printf("[WARN] consul: Data directory %q belongs to node %q with ID %q, "+
+			"taking it over as %q since allow_stale_raft_id is set",
+			s.config.DataDir, last.NodeName, last.NodeID, localID)
+	}
+
+	return writeNodeIdentity(s.config.DataDir, &nodeIdentity{
+		NodeID:     localID,
+		NodeName:   s.config.NodeName,
+		Datacenter: s.config.Datacenter,
+	})
+}
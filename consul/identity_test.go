@@ -0,0 +1,397 @@
+package consul
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/consul/types"
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb"
+)
+
+// testRestartConfig returns a config that reuses the data directory and
+// addresses of the given config, so it looks like the same server starting
+// back up.
+func testRestartConfig(t *testing.T, old *Config) *Config {
+	dir, config := testServerConfig(t, old.NodeName)
+	os.RemoveAll(dir)
+	config.DataDir = old.DataDir
+	config.NodeID = old.NodeID
+	config.RPCAddr = old.RPCAddr
+	config.RaftConfig.ProtocolVersion = old.RaftConfig.ProtocolVersion
+	config.SerfLANConfig.MemberlistConfig.BindPort = old.SerfLANConfig.MemberlistConfig.BindPort
+	config.SerfWANConfig.MemberlistConfig.BindPort = old.SerfWANConfig.MemberlistConfig.BindPort
+	return config
+}
+
+func testNodeID(t *testing.T) types.NodeID {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return types.NodeID(id)
+}
+
+func TestServer_RaftIDMismatch(t *testing.T) {
+	dir1, config1 := testServerConfig(t, fmt.Sprintf("Node %d", getPort()))
+	defer os.RemoveAll(dir1)
+	config1.RaftConfig.ProtocolVersion = 3
+	s1, err := NewServer(config1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	s1.Shutdown()
+
+	// Starting back up with the same ID should be fine.
+	config2 := testRestartConfig(t, config1)
+	s2, err := NewServer(config2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s2.RPC, "dc1")
+	s2.Shutdown()
+
+	// Now act like the data directory came from another server.
+	config3 := testRestartConfig(t, config1)
+	config3.NodeID = testNodeID(t)
+	if _, err := NewServer(config3); err == nil ||
+		!strings.Contains(err.Error(), "registered with ID") ||
+		!strings.Contains(err.Error(), string(config1.NodeID)) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Allow it and make sure the Raft configuration gets the new ID.
+	config4 := testRestartConfig(t, config1)
+	config4.NodeID = config3.NodeID
+	config4.AllowStaleRaftID = true
+	s4, err := NewServer(config4)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s4.Shutdown()
+	testutil.WaitForLeader(t, s4.RPC, "dc1")
+
+	future := s4.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	servers := future.Configuration().Servers
+	if len(servers) != 1 || servers[0].ID != raft.ServerID(config4.NodeID) {
+		t.Fatalf("bad: %v", servers)
+	}
+}
+
+func TestServer_RaftIDMismatch_ProtocolUpgrade(t *testing.T) {
+	dir1, config1 := testServerConfig(t, fmt.Sprintf("Node %d", getPort()))
+	defer os.RemoveAll(dir1)
+	config1.RaftConfig.ProtocolVersion = 3
+	s1, err := NewServer(config1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	s1.Shutdown()
+
+	// Add a configuration like the one a leader on an older version of
+	// the protocol would have written, with our address as our ID.
+	store, err := raftboltdb.NewBoltStore(filepath.Join(config1.DataDir, raftState, "raft.db"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	last, err := store.LastIndex()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr := raft.ServerAddress(config1.RPCAddr.String())
+	configuration := raft.Configuration{
+		Servers: []raft.Server{
+			{Suffrage: raft.Voter, ID: raft.ServerID(addr), Address: addr},
+		},
+	}
+	var buf []byte
+	if err := codec.NewEncoderBytes(&buf, msgpackHandle).Encode(configuration); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.StoreLog(&raft.Log{
+		Index: last + 1,
+		Term:  1,
+		Type:  raft.LogConfiguration,
+		Data:  buf,
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	store.Close()
+
+	// Coming back up finds our address used as our ID, which isn't a
+	// mismatch.
+	config2 := testRestartConfig(t, config1)
+	s2, err := NewServer(config2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+}
+
+func TestServer_BootstrapWithPeers(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, config2 := testServerConfig(t, fmt.Sprintf("Node %d", getPort()))
+	defer os.RemoveAll(dir2)
+	config2.Bootstrap = false
+	s2, err := NewServer(config2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		peers, _ := s2.numPeers()
+		return peers == 2, fmt.Errorf("%d", peers)
+	}); err != nil {
+		t.Fatalf("should have 2 peers: %v", err)
+	}
+	if err := s2.raft.Snapshot().Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s2.Shutdown()
+
+	// Bootstrapping on top of the old cluster's state should be refused.
+	config3 := testRestartConfig(t, config2)
+	config3.Bootstrap = true
+	if _, err := NewServer(config3); err == nil ||
+		!strings.Contains(err.Error(), "cluster with 2 servers") ||
+		!strings.Contains(err.Error(), s1.config.RPCAddr.String()) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Forcing it should let it start.
+	config4 := testRestartConfig(t, config2)
+	config4.Bootstrap = true
+	config4.ForceBootstrap = true
+	s4, err := NewServer(config4)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s4.Shutdown()
+
+	// The server that bootstrapped the cluster should still be able to
+	// restart in bootstrap mode.
+	s1.Shutdown()
+	config5 := testRestartConfig(t, s1.config)
+	s5, err := NewServer(config5)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s5.Shutdown()
+
+	// Raft state from before the origin was recorded is judged by the
+	// first configuration in the log, which names the first server.
+	editRaftStore := func(f func(store *raftboltdb.BoltStore) error) {
+		path := filepath.Join(config2.DataDir, raftState, "raft.db")
+		store, err := raftboltdb.NewBoltStore(path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer store.Close()
+		if err := f(store); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	editRaftStore(func(store *raftboltdb.BoltStore) error {
+		return store.SetUint64(raftOriginKey, 0)
+	})
+	config6 := testRestartConfig(t, config2)
+	config6.Bootstrap = true
+	if _, err := NewServer(config6); err == nil ||
+		!strings.Contains(err.Error(), "cluster with 2 servers") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// If that's been compacted away there's no telling, so it should be
+	// allowed to start.
+	editRaftStore(func(store *raftboltdb.BoltStore) error {
+		if err := store.SetUint64(raftOriginKey, 0); err != nil {
+			return err
+		}
+		return store.DeleteRange(1, 1)
+	})
+	config7 := testRestartConfig(t, config2)
+	config7.Bootstrap = true
+	s7, err := NewServer(config7)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s7.Shutdown()
+}
+
+func TestServer_SerfSnapshotNameMismatch(t *testing.T) {
+	dir1, config1 := testServerConfig(t, fmt.Sprintf("Node %d", getPort()))
+	defer os.RemoveAll(dir1)
+	s1, err := NewServer(config1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	s1.Shutdown()
+
+	// Start back up under a different name.
+	config2 := testRestartConfig(t, config1)
+	config2.NodeName = "other"
+	if _, err := NewServer(config2); err == nil ||
+		!strings.Contains(err.Error(), "Serf snapshot") ||
+		!strings.Contains(err.Error(), config1.NodeName) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// This should be allowed with the override.
+	config3 := testRestartConfig(t, config1)
+	config3.NodeName = "other"
+	config3.AllowStaleRaftID = true
+	s3, err := NewServer(config3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s3.Shutdown()
+}
+
+func TestServer_DataDirLock(t *testing.T) {
+	dir1, config1 := testServerConfig(t, fmt.Sprintf("Node %d", getPort()))
+	defer os.RemoveAll(dir1)
+	s1, err := NewServer(config1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// A second server on the same data directory should be turned away,
+	// and told who has it.
+	config2 := testRestartConfig(t, config1)
+	_, err = NewServer(config2)
+	if err == nil || !strings.Contains(err.Error(), "in use by PID "+strconv.Itoa(os.Getpid())+" since") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Once the first one shuts down, the second can start.
+	s1.Shutdown()
+	s2, err := NewServer(config2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+	testutil.WaitForLeader(t, s2.RPC, "dc1")
+}
+
+func TestDataDirLock_Stale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Leave behind a lock file from a process that's gone.
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stale := fmt.Sprintf(`{"PID":%d,"Since":"2017-01-01T00:00:00Z","NodeName":"old"}`, cmd.Process.Pid)
+	if err := ioutil.WriteFile(filepath.Join(dir, dataDirLockFile), []byte(stale), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var buf bytes.Buffer
+	lock, err := lockDataDir(dir, "new", log.New(&buf, "", 0))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.Contains(buf.String(), "Recovered stale data dir lock") {
+		t.Fatalf("bad: %s", buf.String())
+	}
+	info := readDataDirLockInfo(lock.file)
+	if info == nil || info.PID != os.Getpid() || info.NodeName != "new" {
+		t.Fatalf("bad: %#v", info)
+	}
+
+	// The lock can't be taken twice.
+	if _, err := lockDataDir(dir, "other", log.New(&buf, "", 0)); err == nil ||
+		!strings.Contains(err.Error(), "in use by PID") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Releasing it should clear the owner.
+	if err := lock.Release(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(dir, dataDirLockFile))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(contents) != 0 {
+		t.Fatalf("bad: %s", contents)
+	}
+}
+
+func TestServer_NodeIdentityMismatch(t *testing.T) {
+	dir1, config1 := testServerConfig(t, fmt.Sprintf("Node %d", getPort()))
+	defer os.RemoveAll(dir1)
+	s1, err := NewServer(config1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	s1.Shutdown()
+
+	// The identity should have been recorded.
+	identity, err := readNodeIdentity(config1.DataDir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if identity == nil || identity.NodeID != config1.NodeID ||
+		identity.NodeName != config1.NodeName || identity.Datacenter != "dc1" {
+		t.Fatalf("bad: %#v", identity)
+	}
+
+	// Starting up with a different node ID should fail. This uses Raft
+	// protocol version 2, so the Raft check doesn't catch it.
+	config2 := testRestartConfig(t, config1)
+	config2.NodeID = testNodeID(t)
+	if _, err := NewServer(config2); err == nil ||
+		!strings.Contains(err.Error(), "belongs to node") ||
+		!strings.Contains(err.Error(), string(config1.NodeID)) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// This should be allowed with the override, and the new ID recorded.
+	config3 := testRestartConfig(t, config1)
+	config3.NodeID = config2.NodeID
+	config3.AllowStaleRaftID = true
+	s3, err := NewServer(config3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s3.Shutdown()
+	identity, err = readNodeIdentity(config1.DataDir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if identity.NodeID != config3.NodeID {
+		t.Fatalf("bad: %#v", identity)
+	}
+}
@@ -3,6 +3,7 @@ package consul
 import (
 	"fmt"
 
+	"github.com/hashicorp/consul/consul/agent"
 	"github.com/hashicorp/consul/consul/state"
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/go-memdb"
@@ -33,7 +34,7 @@ func (m *Internal) NodeInfo(args *structs.NodeSpecificRequest,
 			}
 
 			reply.Index, reply.Dump = index, dump
-			return m.srv.filterACL(args.Token, reply)
+			return m.srv.filterACL("Internal.NodeInfo", args.Token, reply)
 		})
 }
 
@@ -54,7 +55,176 @@ func (m *Internal) NodeDump(args *structs.DCSpecificRequest,
 			}
 
 			reply.Index, reply.Dump = index, dump
-			return m.srv.filterACL(args.Token, reply)
+			if err := m.srv.filterACL("Internal.NodeDump", args.Token, reply); err != nil {
+				return err
+			}
+			m.srv.truncateResults(&reply.QueryMeta, &reply.Dump)
+			return nil
+		})
+}
+
+// ConsistentRead runs several catalog sub-queries against the same snapshot
+// of the state store, so callers that need more than one table, like the UI,
+// don't get results from different points in time.
+func (m *Internal) ConsistentRead(args *structs.ConsistentReadRequest,
+	reply *structs.IndexedConsistentRead) error {
+	if done, err := m.srv.forward("Internal.ConsistentRead", args, args, reply); done {
+		return err
+	}
+
+	// Verify the arguments. Each sub-query can only be given once, which
+	// also bounds how many there can be.
+	if len(args.Queries) == 0 {
+		return fmt.Errorf("Must provide at least one sub-query")
+	}
+	seen := make(map[string]bool)
+	for _, query := range args.Queries {
+		if seen[query] {
+			return fmt.Errorf("Sub-query %q given more than once", query)
+		}
+		seen[query] = true
+	}
+
+	return m.srv.blockingQuery(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, state *state.StateStore) error {
+			index, results, err := state.ConsistentRead(ws, args.Queries)
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.Results = index, *results
+			return m.srv.filterACL("Internal.ConsistentRead", args.Token, reply)
+		})
+}
+
+// CatalogDiff is used by an agent to get the changes to its node's services
+// and checks since the table indexes it last saw, so it doesn't have to read
+// them all again after it's been out of touch.
+func (m *Internal) CatalogDiff(args *structs.CatalogDiffRequest,
+	reply *structs.IndexedNodeCatalogDiff) error {
+	if done, err := m.srv.forward("Internal.CatalogDiff", args, args, reply); done {
+		return err
+	}
+
+	// Verify the arguments
+	if args.Node == "" {
+		return fmt.Errorf("Must provide node")
+	}
+
+	// This isn't a blocking query, since it's only used to catch up.
+	diff, err := m.srv.fsm.State().NodeCatalogDiff(args.Node, args.Indexes,
+		m.srv.config.CatalogDiffMaxEntries)
+	if err != nil {
+		return err
+	}
+	reply.Index = diff.Indexes["services"]
+	if idx := diff.Indexes["checks"]; idx > reply.Index {
+		reply.Index = idx
+	}
+	reply.Node, reply.Diff = args.Node, *diff
+	m.srv.setQueryMeta(&reply.QueryMeta)
+	return m.srv.filterACL("Internal.CatalogDiff", args.Token, reply)
+}
+
+// ReverseLookup is used to find the nodes with a given name or address, along
+// with everything in the catalog that's tied to them. This is handy when all
+// that's known about a problem is an IP address.
+func (m *Internal) ReverseLookup(args *structs.ReverseLookupRequest,
+	reply *structs.IndexedReverseLookup) error {
+	if done, err := m.srv.forward("Internal.ReverseLookup", args, args, reply); done {
+		return err
+	}
+
+	// Verify the arguments
+	if args.Query == "" {
+		return fmt.Errorf("Must provide a node name or address")
+	}
+
+	return m.srv.blockingQuery(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, state *state.StateStore) error {
+			index, matches, err := state.ReverseLookup(ws, args.Query)
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.Matches = index, matches
+			return m.srv.filterACL("Internal.ReverseLookup", args.Token, reply)
+		})
+}
+
+// CentralChecks returns the central check definitions that apply to the given
+// node. Agents watch this with a blocking query to learn which checks they
+// should be running.
+func (m *Internal) CentralChecks(args *structs.NodeSpecificRequest,
+	reply *structs.IndexedCentralChecks) error {
+	if done, err := m.srv.forward("Internal.CentralChecks", args, args, reply); done {
+		return err
+	}
+
+	acl, err := m.srv.resolveToken("Internal.CentralChecks", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && m.srv.config.ACLEnforceVersion8 && !acl.NodeRead(args.Node) {
+		return permissionDeniedErr
+	}
+
+	return m.srv.blockingQuery(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, state *state.StateStore) error {
+			index, checks, err := state.NodeCentralChecks(ws, args.Node)
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.Checks = index, checks
+			return nil
+		})
+}
+
+// WANMembers returns the servers in the WAN pool and the datacenters they
+// make up, as the server that answers sees them. Blocking queries on this
+// return when either changes, so federation changes can be watched without
+// polling.
+func (m *Internal) WANMembers(args *structs.DCSpecificRequest,
+	reply *structs.IndexedWANMembers) error {
+	if done, err := m.srv.forward("Internal.WANMembers", args, args, reply); done {
+		return err
+	}
+
+	return m.srv.blockingQuery(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, _ *state.StateStore) error {
+			// Grab the index first, so a change while we're looking
+			// wakes us up again.
+			index, ch := m.srv.router.Index()
+			ws.Add(ch)
+
+			var members structs.WANMembers
+			for _, member := range m.srv.WANMembers() {
+				ok, parts := agent.IsConsulServer(member)
+				if !ok {
+					continue
+				}
+				members = append(members, structs.WANMember{
+					Name:       member.Name,
+					Datacenter: parts.Datacenter,
+					Addr:       member.Addr.String(),
+					Port:       member.Port,
+					Status:     member.Status.String(),
+				})
+			}
+
+			reply.Index = index
+			reply.Members = members
+			reply.Datacenters = m.srv.router.GetDatacenters()
+			return nil
 		})
 }
 
@@ -68,7 +238,7 @@ func (m *Internal) EventFire(args *structs.EventFireRequest,
 	}
 
 	// Check ACLs
-	acl, err := m.srv.resolveToken(args.Token)
+	acl, err := m.srv.resolveToken("Internal.EventFire", args.Token)
 	if err != nil {
 		return err
 	}
@@ -84,7 +254,9 @@ func (m *Internal) EventFire(args *structs.EventFireRequest,
 	// Add the consul prefix to the event name
 	eventName := userEventName(args.Name)
 
-	// Fire the event
+	// Fire the event, giving a backed up gossip pool a chance to drain
+	// first if configured to.
+	m.srv.gossipEventDelay()
 	return m.srv.serfLAN.UserEvent(eventName, args.Payload, false)
 }
 
@@ -94,7 +266,7 @@ func (m *Internal) KeyringOperation(
 	reply *structs.KeyringResponses) error {
 
 	// Check ACLs
-	acl, err := m.srv.resolveToken(args.Token)
+	acl, err := m.srv.resolveToken("Internal.KeyringOperation", args.Token)
 	if err != nil {
 		return err
 	}
@@ -147,6 +319,17 @@ func (m *Internal) executeKeyringOp(
 		mgr = m.srv.KeyManagerLAN()
 	}
 
+	// The WAN Serf may not be up, so report that instead of failing the
+	// whole operation.
+	if mgr == nil {
+		reply.Responses = append(reply.Responses, &structs.KeyringResponse{
+			WAN:        wan,
+			Datacenter: m.srv.config.Datacenter,
+			Error:      m.srv.wanNotReady().Error(),
+		})
+		return
+	}
+
 	opts := &serf.KeyRequestOptions{RelayFactor: args.RelayFactor}
 	switch args.Operation {
 	case structs.KeyringList:
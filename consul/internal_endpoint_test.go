@@ -4,11 +4,14 @@ import (
 	"encoding/base64"
 	"fmt"
 	"os"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/lib"
 	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/consul/types"
 	"github.com/hashicorp/net-rpc-msgpackrpc"
 )
 
@@ -341,6 +344,377 @@ func TestInternal_NodeDump_FilterACL(t *testing.T) {
 	// for now until we change the sense of the version 8 ACL flag).
 }
 
+func TestInternal_ReverseLookup_FilterACL(t *testing.T) {
+	dir, token, srv, codec := testACLFilterServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer codec.Close()
+
+	// The server's own node has foo and bar at 127.0.0.1. Put that address
+	// on a bar instance and a foo instance on two other nodes.
+	for _, name := range []string{"bar", "foo"} {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       "node-" + name,
+			Address:    "10.0.0.1",
+			Service: &structs.NodeService{
+				ID:      name,
+				Service: name,
+				Address: "127.0.0.1",
+			},
+			WriteRequest: structs.WriteRequest{Token: "root"},
+		}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, nil); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// A management token sees everything.
+	args := structs.ReverseLookupRequest{
+		Datacenter:   "dc1",
+		Query:        "127.0.0.1",
+		QueryOptions: structs.QueryOptions{Token: "root"},
+	}
+	var reply structs.IndexedReverseLookup
+	if err := msgpackrpc.CallWithCodec(codec, "Internal.ReverseLookup", &args, &reply); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	matched := make(map[string][]string)
+	for _, match := range reply.Matches {
+		matched[match.Node.Node] = match.MatchedBy
+	}
+	expected := map[string][]string{
+		srv.config.NodeName: []string{structs.ReverseLookupAddress},
+		"node-bar":          []string{structs.ReverseLookupServiceAddress + ":bar"},
+		"node-foo":          []string{structs.ReverseLookupServiceAddress + ":foo"},
+	}
+	if !reflect.DeepEqual(matched, expected) {
+		t.Fatalf("bad: %#v", matched)
+	}
+
+	// The limited token can't see bar, so the node that only matched
+	// through bar's address should be gone, and bar should be stripped from
+	// the server's node.
+	args.Token = token
+	reply = structs.IndexedReverseLookup{}
+	if err := msgpackrpc.CallWithCodec(codec, "Internal.ReverseLookup", &args, &reply); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	matched = make(map[string][]string)
+	for _, match := range reply.Matches {
+		matched[match.Node.Node] = match.MatchedBy
+		for _, svc := range match.Services {
+			if svc.Service == "bar" {
+				t.Fatalf("bad: %#v", match.Services)
+			}
+		}
+		for _, chk := range match.Checks {
+			if chk.ServiceName == "bar" {
+				t.Fatalf("bad: %#v", match.Checks)
+			}
+		}
+	}
+	delete(expected, "node-bar")
+	if !reflect.DeepEqual(matched, expected) {
+		t.Fatalf("bad: %#v", matched)
+	}
+
+	// A query is required.
+	args.Query = ""
+	err := msgpackrpc.CallWithCodec(codec, "Internal.ReverseLookup", &args, &reply)
+	if err == nil || err.Error() != "Must provide a node name or address" {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestInternal_CatalogDiff(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	register := func(service, check string) {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       "foo",
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				ID:      service,
+				Service: service,
+			},
+			Check: &structs.HealthCheck{
+				CheckID:   types.CheckID(check),
+				Name:      check,
+				ServiceID: service,
+				Status:    structs.HealthPassing,
+			},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	register("web", "web-check")
+	register("db", "db-check")
+	register("cache", "cache-check")
+
+	// Get the indexes the agent would have seen.
+	args := structs.CatalogDiffRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+	}
+	var reply structs.IndexedNodeCatalogDiff
+	if err := msgpackrpc.CallWithCodec(codec, "Internal.CatalogDiff", &args, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Diff.FullResync || len(reply.Diff.Services) != 3 || len(reply.Diff.Checks) != 3 {
+		t.Fatalf("bad: %#v", reply.Diff)
+	}
+	since := reply.Diff.Indexes
+
+	// Make some changes and deletions while the agent is cut off.
+	register("api", "api-check")
+	dereg := structs.DeregisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		ServiceID:  "db",
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Deregister", &dereg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dereg.ServiceID, dereg.CheckID = "", "cache-check"
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Deregister", &dereg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The diff should have exactly those changes.
+	args.Indexes = since
+	reply = structs.IndexedNodeCatalogDiff{}
+	if err := msgpackrpc.CallWithCodec(codec, "Internal.CatalogDiff", &args, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	diff := reply.Diff
+	if diff.FullResync || len(diff.Services) != 1 || diff.Services[0].ID != "api" {
+		t.Fatalf("bad: %#v", diff)
+	}
+	if len(diff.Checks) != 1 || diff.Checks[0].CheckID != "api-check" {
+		t.Fatalf("bad: %#v", diff.Checks)
+	}
+	if !reflect.DeepEqual(diff.DeletedServices, []string{"db"}) {
+		t.Fatalf("bad: %#v", diff.DeletedServices)
+	}
+	if !reflect.DeepEqual(diff.DeletedChecks, []types.CheckID{"cache-check", "db-check"}) {
+		t.Fatalf("bad: %#v", diff.DeletedChecks)
+	}
+	if reply.Node != "foo" || reply.Index != diff.Indexes["checks"] || !reply.KnownLeader {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	// Once the deletes are reaped, the old indexes are too old to diff
+	// against.
+	reap := structs.TombstoneRequest{
+		Datacenter: "dc1",
+		Op:         structs.TombstoneReap,
+		ReapIndex:  diff.Indexes["checks"],
+	}
+	if _, err := s1.raftApply(structs.TombstoneRequestType, &reap); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reply = structs.IndexedNodeCatalogDiff{}
+	if err := msgpackrpc.CallWithCodec(codec, "Internal.CatalogDiff", &args, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reply.Diff.FullResync || len(reply.Diff.Services) != 0 || len(reply.Diff.DeletedServices) != 0 {
+		t.Fatalf("bad: %#v", reply.Diff)
+	}
+}
+
+func TestInternal_ConsistentRead(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Bad requests should be rejected.
+	bad := [][]string{
+		nil,
+		[]string{"nodes", "nodes"},
+		[]string{"nodes", "kvs"},
+	}
+	for _, queries := range bad {
+		arg := structs.ConsistentReadRequest{
+			Datacenter: "dc1",
+			Queries:    queries,
+		}
+		var out structs.IndexedConsistentRead
+		if err := msgpackrpc.CallWithCodec(codec, "Internal.ConsistentRead", &arg, &out); err == nil {
+			t.Fatalf("expected an error for %v", queries)
+		}
+	}
+
+	// Keep registering nodes that each have a service and a check, in a
+	// single update, while we read.
+	state := s1.fsm.State()
+	start, _, err := state.Nodes(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	doneCh := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		for i := start + 1; i <= start+500; i++ {
+			select {
+			case <-doneCh:
+				errCh <- nil
+				return
+			default:
+			}
+
+			name := fmt.Sprintf("node-%d", i)
+			req := &structs.RegisterRequest{
+				Node:    name,
+				Address: "127.0.0.1",
+				Service: &structs.NodeService{
+					ID:      "web",
+					Service: "web-" + name,
+				},
+				Check: &structs.HealthCheck{
+					Node:      name,
+					CheckID:   "web-check",
+					ServiceID: "web",
+				},
+			}
+			if err := state.EnsureRegistration(i, req); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- nil
+	}()
+
+	// Every read should see all three parts of each registration, and
+	// nothing from later ones.
+	arg := structs.ConsistentReadRequest{
+		Datacenter: "dc1",
+		Queries:    []string{"nodes", "services", "checks"},
+	}
+	var last uint64
+	for i := 0; i < 50; i++ {
+		var out structs.IndexedConsistentRead
+		if err := msgpackrpc.CallWithCodec(codec, "Internal.ConsistentRead", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out.Index < last || out.Results.Coordinates != nil {
+			t.Fatalf("bad: %#v", out)
+		}
+		last = out.Index
+
+		var registered int
+		for _, node := range out.Results.Nodes {
+			if node.Node == s1.config.NodeName {
+				continue
+			}
+			registered++
+			if _, ok := out.Results.Services["web-"+node.Node]; !ok {
+				t.Fatalf("missing service for %q at index %d", node.Node, out.Index)
+			}
+		}
+		if len(out.Results.Services) != registered+1 {
+			t.Fatalf("bad: %d nodes but %v", registered, out.Results.Services)
+		}
+		var checks int
+		for _, check := range out.Results.Checks {
+			if check.CheckID == "web-check" {
+				checks++
+			}
+		}
+		if checks != registered {
+			t.Fatalf("bad: %d nodes but %d checks", registered, checks)
+		}
+		if registered > 0 && out.Index != start+uint64(registered) {
+			t.Fatalf("bad: %d nodes at index %d", registered, out.Index)
+		}
+	}
+	close(doneCh)
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A blocking read should wake up for a change to any of the tables.
+	var out structs.IndexedConsistentRead
+	if err := msgpackrpc.CallWithCodec(codec, "Internal.ConsistentRead", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx := out.Index
+	arg.MinQueryIndex = idx
+	arg.MaxQueryTime = time.Second
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		check := &structs.HealthCheck{
+			Node:    s1.config.NodeName,
+			CheckID: "extra",
+			Status:  structs.HealthCritical,
+		}
+		errCh <- state.EnsureCheck(idx+1, check)
+	}()
+	begin := time.Now()
+	out = structs.IndexedConsistentRead{}
+	if err := msgpackrpc.CallWithCodec(codec, "Internal.ConsistentRead", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Now().Sub(begin); elapsed < 100*time.Millisecond || elapsed > 900*time.Millisecond {
+		t.Fatalf("bad: %v", elapsed)
+	}
+	if out.Index != idx+1 {
+		t.Fatalf("bad: %d", out.Index)
+	}
+}
+
+func TestInternal_ConsistentRead_FilterACL(t *testing.T) {
+	dir, token, srv, codec := testACLFilterServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer codec.Close()
+
+	arg := structs.ConsistentReadRequest{
+		Datacenter:   "dc1",
+		Queries:      []string{"services", "checks"},
+		QueryOptions: structs.QueryOptions{Token: token},
+	}
+	var out structs.IndexedConsistentRead
+	if err := msgpackrpc.CallWithCodec(codec, "Internal.ConsistentRead", &arg, &out); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, ok := out.Results.Services["foo"]; !ok {
+		t.Fatalf("bad: %#v", out.Results.Services)
+	}
+	if _, ok := out.Results.Services["bar"]; ok {
+		t.Fatalf("bad: %#v", out.Results.Services)
+	}
+	found := false
+	for _, check := range out.Results.Checks {
+		if check.ServiceName == "foo" {
+			found = true
+		}
+		if check.ServiceName == "bar" {
+			t.Fatalf("bad: %#v", out.Results.Checks)
+		}
+	}
+	if !found {
+		t.Fatalf("bad: %#v", out.Results.Checks)
+	}
+}
+
 func TestInternal_EventFire_Token(t *testing.T) {
 	dir, srv := testServerWithConfig(t, func(c *Config) {
 		c.ACLDatacenter = "dc1"
@@ -374,3 +748,177 @@ func TestInternal_EventFire_Token(t *testing.T) {
 		t.Fatalf("err: %s", err)
 	}
 }
+
+func TestInternal_CentralChecks(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register a node in each rack.
+	for node, rack := range map[string]string{"foo": "a", "bar": "b"} {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			NodeMeta:   map[string]string{"rack": rack},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Create a definition for rack a.
+	arg := structs.CentralCheckRequest{
+		Datacenter: "dc1",
+		Op:         structs.CentralCheckCreate,
+		Check: &structs.CentralCheck{
+			Name:     "disk",
+			NodeMeta: map[string]string{"rack": "a"},
+			Script:   "/bin/check-disk",
+			Interval: 10 * time.Second,
+		},
+	}
+	var id string
+	if err := msgpackrpc.CallWithCodec(codec, "CentralCheck.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The node in rack a should get it.
+	req := structs.NodeSpecificRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+	}
+	var out structs.IndexedCentralChecks
+	if err := msgpackrpc.CallWithCodec(codec, "Internal.CentralChecks", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Checks) != 1 || out.Checks[0].ID != id {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// The node in rack b shouldn't.
+	other := structs.NodeSpecificRequest{
+		Datacenter: "dc1",
+		Node:       "bar",
+	}
+	var otherOut structs.IndexedCentralChecks
+	if err := msgpackrpc.CallWithCodec(codec, "Internal.CentralChecks", &other, &otherOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(otherOut.Checks) != 0 {
+		t.Fatalf("bad: %v", otherOut)
+	}
+
+	// Edit the definition after a delay and make sure a blocking query
+	// wakes up with the change.
+	start := time.Now()
+	errCh := make(chan error, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		update := arg
+		update.Op = structs.CentralCheckUpdate
+		check := *arg.Check
+		check.ID = id
+		check.Interval = 30 * time.Second
+		update.Check = &check
+		codec := rpcClient(t, s1)
+		defer codec.Close()
+		var reply string
+		errCh <- msgpackrpc.CallWithCodec(codec, "CentralCheck.Apply", &update, &reply)
+	}()
+	req.MinQueryIndex = out.Index
+	req.MaxQueryTime = time.Second
+	var blockOut structs.IndexedCentralChecks
+	if err := msgpackrpc.CallWithCodec(codec, "Internal.CentralChecks", &req, &blockOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("bad: %v", elapsed)
+	}
+	if len(blockOut.Checks) != 1 || blockOut.Checks[0].Interval != 30*time.Second {
+		t.Fatalf("bad: %v", blockOut)
+	}
+	if blockOut.Index <= req.MinQueryIndex {
+		t.Fatalf("bad index: %d", blockOut.Index)
+	}
+}
+
+func TestInternal_WANMembers(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerDC(t, "dc2")
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// The first call should return right away.
+	args := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var out structs.IndexedWANMembers
+	if err := msgpackrpc.CallWithCodec(codec, "Internal.WANMembers", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Index == 0 || len(out.Members) != 1 || !reflect.DeepEqual(out.Datacenters, []string{"dc1"}) {
+		t.Fatalf("bad: %#v", out)
+	}
+	member := out.Members[0]
+	if member.Name != s1.config.NodeName+".dc1" || member.Datacenter != "dc1" || member.Status != "alive" {
+		t.Fatalf("bad: %#v", member)
+	}
+
+	// With nothing changing, a blocking query should give up after the
+	// max query time.
+	args.MinQueryIndex = out.Index
+	args.MaxQueryTime = 200 * time.Millisecond
+	start := time.Now()
+	out = structs.IndexedWANMembers{}
+	if err := msgpackrpc.CallWithCodec(codec, "Internal.WANMembers", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	elapsed := time.Now().Sub(start)
+	if elapsed > time.Second || (out.Index == args.MinQueryIndex && elapsed < 200*time.Millisecond) {
+		t.Fatalf("bad: %d in %s", out.Index, elapsed)
+	}
+
+	// Join dc2 while a blocking query is waiting, which should wake it up.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		addr := fmt.Sprintf("127.0.0.1:%d",
+			s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+		if _, err := s2.JoinWAN([]string{addr}); err != nil {
+			t.Errorf("err: %v", err)
+		}
+	}()
+	args.MaxQueryTime = 10 * time.Second
+	for i := 0; len(out.Datacenters) != 2; i++ {
+		if i == 3 {
+			t.Fatalf("bad: %#v", out)
+		}
+		args.MinQueryIndex = out.Index
+		start = time.Now()
+		out = structs.IndexedWANMembers{}
+		if err := msgpackrpc.CallWithCodec(codec, "Internal.WANMembers", &args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out.Index <= args.MinQueryIndex || time.Now().Sub(start) >= args.MaxQueryTime {
+			t.Fatalf("bad: %d in %s", out.Index, time.Now().Sub(start))
+		}
+	}
+	if !reflect.DeepEqual(out.Datacenters, []string{"dc1", "dc2"}) || len(out.Members) != 2 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
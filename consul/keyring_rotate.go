@@ -0,0 +1,248 @@
+package consul
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/serf/serf"
+)
+
+// A keyring rotation is run by the leader as an operator intent, so a new
+// leader picks it up where the old one left off. Each step is retried until
+// every member of the LAN and WAN pools has acknowledged it. Members that have
+// failed hold the rotation up too, since they'd be cut off if the old key was
+// removed while they were away, but members that have left don't.
+
+// keyringRotateError is returned by a keyring rotation step when some members
+// haven't acknowledged it.
+type keyringRotateError struct {
+	failures map[string]string
+}
+
+func (e *keyringRotateError) Error() string {
+	var names []string
+	for name := range e.failures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var reasons []string
+	for _, name := range names {
+		reasons = append(reasons, fmt.Sprintf("%s (%s)", name, e.failures[name]))
+	}
+	return fmt.Sprintf("waiting on %d member(s): %s", len(names), strings.Join(reasons, ", "))
+}
+
+// keyringPoolName returns the name a gossip pool goes by in the failures of
+// a keyring rotation.
+func keyringPoolName(wan bool) string {
+	if wan {
+		return "serf_wan"
+	}
+	return "serf_lan"
+}
+
+// setKeyringRotateFailures records the failures from the last attempt at a
+// keyring rotation step.
+func (s *Server) setKeyringRotateFailures(failures map[string]string) {
+	s.keyringRotateLock.Lock()
+	defer s.keyringRotateLock.Unlock()
+	s.keyringRotateFailures = failures
+}
+
+// getKeyringRotateFailures returns the failures from the last attempt at a
+// keyring rotation step.
+func (s *Server) getKeyringRotateFailures() map[string]string {
+	s.keyringRotateLock.Lock()
+	defer s.keyringRotateLock.Unlock()
+	return s.keyringRotateFailures
+}
+
+// finishKeyringRotateStep records the failures from a keyring rotation step,
+// and returns an error if there were any.
+func (s *Server) finishKeyringRotateStep(failures map[string]string) error {
+	if len(failures) == 0 {
+		s.setKeyringRotateFailures(nil)
+		return nil
+	}
+	s.setKeyringRotateFailures(failures)
+	return &keyringRotateError{failures}
+}
+
+// keyringOp runs a keyring operation on the LAN and WAN pools the same way
+// the internal keyring endpoint does, and adds any errors to failures.
+func (s *Server) keyringOp(op structs.KeyringOp, key string, failures map[string]string) *structs.KeyringResponses {
+	internal := &Internal{srv: s}
+	args := &structs.KeyringRequest{
+		Operation:  op,
+		Key:        key,
+		Datacenter: s.config.Datacenter,
+	}
+	var reply structs.KeyringResponses
+	internal.executeKeyringOp(args, &reply, false)
+	internal.executeKeyringOp(args, &reply, true)
+
+	for _, resp := range reply.Responses {
+		for node, msg := range resp.Messages {
+			failures[node] = msg
+		}
+		if resp.Error != "" && len(resp.Messages) == 0 {
+			failures[keyringPoolName(resp.WAN)] = resp.Error
+		}
+	}
+	return &reply
+}
+
+// keyringCheck lists the keys on every member of the LAN and WAN pools, and
+// adds the members that don't have the given key to failures. If only is set,
+// members that still have any other key are added too.
+func (s *Server) keyringCheck(key string, only bool, failures map[string]string) {
+	op := &Operator{srv: s}
+	for _, wan := range []bool{false, true} {
+		status := op.keyringPoolStatus(&structs.KeyringStatusRequest{}, wan)
+		if status.Error != "" {
+			failures[keyringPoolName(wan)] = status.Error
+			continue
+		}
+
+		pool := s.serfLAN
+		if wan {
+			pool = s.getSerfWAN()
+		}
+		answered := make(map[string]struct{})
+		for _, member := range pool.Members() {
+			switch member.Status {
+			case serf.StatusAlive:
+				answered[member.Name] = struct{}{}
+			case serf.StatusFailed:
+				failures[member.Name] = "member has failed"
+			}
+		}
+		for node, msg := range status.Messages {
+			delete(answered, node)
+			failures[node] = msg
+		}
+		for _, node := range status.NoResponse {
+			delete(answered, node)
+			failures[node] = "no response"
+		}
+
+		// Everyone who answered either has a key or is one of its missing
+		// nodes.
+		found := false
+		for _, k := range status.Keys {
+			missing := make(map[string]struct{})
+			for _, node := range k.MissingNodes {
+				missing[node] = struct{}{}
+			}
+			for node := range answered {
+				_, lacks := missing[node]
+				switch {
+				case k.Key == key && lacks:
+					failures[node] = "new key not installed"
+				case k.Key != key && !lacks && only:
+					failures[node] = "old key not removed"
+				}
+			}
+			if k.Key == key {
+				found = true
+			}
+		}
+		if !found {
+			for node := range answered {
+				failures[node] = "new key not installed"
+			}
+		}
+	}
+}
+
+// keyringRotateInstall installs the given key on every member, and checks
+// they've all got it.
+func (s *Server) keyringRotateInstall(key string) error {
+	s.logger.Printf("[INFO] consul: keyring rotation: installing new key")
+	failures := make(map[string]string)
+	s.keyringOp(structs.KeyringInstall, key, failures)
+	s.keyringCheck(key, false, failures)
+	return s.finishKeyringRotateStep(failures)
+}
+
+// keyringRotateUse makes the given key the primary key on every member.
+func (s *Server) keyringRotateUse(key string) error {
+	s.logger.Printf("[INFO] consul: keyring rotation: switching to new key")
+	failures := make(map[string]string)
+	s.keyringOp(structs.KeyringUse, key, failures)
+	return s.finishKeyringRotateStep(failures)
+}
+
+// keyringRotateRemove removes every key but the given one from every member,
+// and checks it's the only one left. The given key is made the primary key
+// again first, in case a member missed that step.
+func (s *Server) keyringRotateRemove(key string) error {
+	s.logger.Printf("[INFO] consul: keyring rotation: removing old keys")
+	failures := make(map[string]string)
+	if s.keyringOp(structs.KeyringUse, key, failures); len(failures) > 0 {
+		return s.finishKeyringRotateStep(failures)
+	}
+
+	old := make(map[string]struct{})
+	list := s.keyringOp(structs.KeyringList, "", failures)
+	for _, resp := range list.Responses {
+		for k := range resp.Keys {
+			if k != key {
+				old[k] = struct{}{}
+			}
+		}
+	}
+	for k := range old {
+		s.keyringOp(structs.KeyringRemove, k, failures)
+	}
+	s.keyringCheck(key, true, failures)
+	return s.finishKeyringRotateStep(failures)
+}
+
+// keyringRotation returns the pending keyring rotation, or nil if there
+// isn't one.
+func (s *Server) keyringRotation() (*structs.OperatorIntent, error) {
+	_, intents, err := s.fsm.State().OperatorIntentList(nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, intent := range intents {
+		if intent.Kind == structs.OperatorIntentKeyringRotate {
+			return intent, nil
+		}
+	}
+	return nil, nil
+}
+
+// runKeyringRotation is a long running routine that retries the pending
+// keyring rotation, if there is one, until it's done. This must only be run
+// on the leader.
+func (s *Server) runKeyringRotation(stopCh chan struct{}) {
+	ticker := s.clock.NewTicker(s.config.KeyringRotateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-s.shutdownCh:
+			return
+		case <-ticker.C():
+		}
+
+		intent, err := s.keyringRotation()
+		if err != nil {
+			s.logger.Printf("[ERR] consul: failed to look up keyring rotation: %v", err)
+			continue
+		}
+		if intent == nil {
+			continue
+		}
+		if err := s.runOperatorIntent(intent); err != nil {
+			s.logger.Printf("[WARN] consul: %v", err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package consul
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestOperator_KeyringRotate(t *testing.T) {
+	key1 := "H1dfkSZOVnP/JUnaBfTzXg=="
+	keyBytes1, err := base64.StdEncoding.DecodeString(key1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	key2 := "4kxNJTC6qFs6SQgPfAvqEw=="
+
+	withKey := func(c *Config) {
+		c.SerfLANConfig.MemberlistConfig.SecretKey = keyBytes1
+		c.SerfWANConfig.MemberlistConfig.SecretKey = keyBytes1
+		c.KeyringRotateInterval = 100 * time.Millisecond
+	}
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		withKey(c)
+		c.BootstrapExpect = 3
+		c.Bootstrap = false
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		withKey(c)
+		c.Bootstrap = false
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	dir3, s3 := testServerWithConfig(t, func(c *Config) {
+		withKey(c)
+		c.Bootstrap = false
+	})
+	defer os.RemoveAll(dir3)
+	defer s3.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	for _, s := range []*Server{s2, s3} {
+		if _, err := s.JoinLAN([]string{addr}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	if err := testutil.WaitForResult(func() (bool, error) {
+		peers, _ := s1.numPeers()
+		return peers == 3, fmt.Errorf("%d peers", peers)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut off one of the followers, so the rotation can't get past
+	// installing the new key.
+	s3.Shutdown()
+	arg := structs.KeyringRotateRequest{
+		Datacenter: "dc1",
+		Key:        key2,
+	}
+	leader := func() *Server {
+		for _, s := range []*Server{s1, s2} {
+			if s.IsLeader() {
+				return s
+			}
+		}
+		return nil
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		var reply structs.KeyringRotateResponse
+		if err := msgpackrpc.CallWithCodec(codec, "Operator.KeyringRotate", &arg, &reply); err != nil {
+			return false, err
+		}
+		if reply.ID == "" || reply.Done || reply.Step != intentStepKeyringInstall {
+			return false, fmt.Errorf("bad: %#v", reply)
+		}
+		_, ok := reply.Failures[s3.config.NodeName]
+		return ok, fmt.Errorf("bad: %#v", reply)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A rotation to some other key should be refused while this one is
+	// going.
+	other := arg
+	other.Key = key1
+	var reply structs.KeyringRotateResponse
+	err = msgpackrpc.CallWithCodec(codec, "Operator.KeyringRotate", &other, &reply)
+	if err == nil || !strings.Contains(err.Error(), "already in progress") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Bring the follower back with only the old key. The old key is still
+	// installed everywhere, so it can rejoin, and then the leader should
+	// finish the rotation on its own.
+	config := testRestartConfig(t, s3.config)
+	withKey(config)
+	config.Bootstrap = false
+	s3, err = NewServer(config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s3.Shutdown()
+	if _, err := s3.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := testutil.WaitForResult(func() (bool, error) {
+		s := leader()
+		if s == nil {
+			return false, fmt.Errorf("no leader")
+		}
+		intent, err := s.keyringRotation()
+		if err != nil || intent != nil {
+			return false, fmt.Errorf("still rotating: %#v (%v)", intent, err)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []*Server{s1, s2, s3} {
+		for _, keyring := range []interface {
+			GetKeys() [][]byte
+		}{
+			s.config.SerfLANConfig.MemberlistConfig.Keyring,
+			s.config.SerfWANConfig.MemberlistConfig.Keyring,
+		} {
+			keys := keyring.GetKeys()
+			if len(keys) != 1 || base64.StdEncoding.EncodeToString(keys[0]) != key2 {
+				t.Fatalf("bad: %s has %d keys", s.config.NodeName, len(keys))
+			}
+		}
+	}
+
+	// Asking again should report that it's done.
+	reply = structs.KeyringRotateResponse{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.KeyringRotate", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reply.Done {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestOperator_KeyringRotate_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Make a request with no token to make sure it gets denied.
+	arg := structs.KeyringRotateRequest{
+		Datacenter: "dc1",
+		Key:        "4kxNJTC6qFs6SQgPfAvqEw==",
+	}
+	var reply structs.KeyringRotateResponse
+	err := msgpackrpc.CallWithCodec(codec, "Operator.KeyringRotate", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// With the master token a bad key should still be refused.
+	arg.Token = "root"
+	arg.Key = "nope"
+	err = msgpackrpc.CallWithCodec(codec, "Operator.KeyringRotate", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), "Invalid key") {
+		t.Fatalf("err: %v", err)
+	}
+	if intent, err := s1.keyringRotation(); err != nil || intent != nil {
+		t.Fatalf("bad: %#v %v", intent, err)
+	}
+}
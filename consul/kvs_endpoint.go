@@ -17,9 +17,10 @@ type KVS struct {
 }
 
 // preApply does all the verification of a KVS update that is performed BEFORE
-// we submit as a Raft log entry. This includes enforcing the lock delay which
-// must only be done on the leader.
-func kvsPreApply(srv *Server, acl acl.ACL, op structs.KVSOp, dirEnt *structs.DirEntry) (bool, error) {
+// we submit as a Raft log entry. This includes enforcing the lock delay and
+// the reserved flags, which must only be done on the leader. Overriding the
+// flags needs a management token when ACLs are enabled.
+func kvsPreApply(srv *Server, acl acl.ACL, op structs.KVSOp, dirEnt *structs.DirEntry, overrideFlags bool) (bool, error) {
 	// Verify the entry.
 	if dirEnt.Key == "" && op != structs.KVSDeleteTree {
 		return false, fmt.Errorf("Must provide key")
@@ -51,6 +52,15 @@ func kvsPreApply(srv *Server, acl acl.ACL, op structs.KVSOp, dirEnt *structs.Dir
 		}
 	}
 
+	// Enforce the reserved flags, unless they're being overridden.
+	if overrideFlags {
+		if acl != nil && !acl.ACLModify() {
+			return false, permissionDeniedErr
+		}
+	} else if err := srv.fsm.State().KVSCheckFlags(op, dirEnt); err != nil {
+		return false, err
+	}
+
 	// If this is a lock, we must check for a lock-delay. Since lock-delay
 	// is based on wall-time, each peer would expire the lock-delay at a slightly
 	// different time. This means the enforcement of lock-delay cannot be done
@@ -70,6 +80,50 @@ func kvsPreApply(srv *Server, acl acl.ACL, op structs.KVSOp, dirEnt *structs.Dir
 	return true, nil
 }
 
+// kvsStampMetadata records a hash of the token making a KVS update, and the
+// time, in the entry if KV metadata is turned on. The token itself isn't
+// stored, since anyone who could read it back, or get hold of a snapshot,
+// could then use it. This is done before the update goes into Raft, so all
+// the servers store the same thing, and it means the time is from the
+// leader's clock. Anything the caller put in these fields is thrown away so
+// they can't be forged.
+func kvsStampMetadata(srv *Server, token string, dirEnt *structs.DirEntry) {
+	dirEnt.CreatedBy = ""
+	dirEnt.CreateTime = nil
+	dirEnt.ModifiedBy = ""
+	dirEnt.ModifyTime = nil
+	if !srv.config.KVMetadata {
+		return
+	}
+
+	by := anonymousToken
+	if token != "" && token != anonymousToken {
+		by = hashToken(token)
+	}
+	now := time.Now().UTC()
+	dirEnt.ModifiedBy = by
+	dirEnt.ModifyTime = &now
+}
+
+// redactDirEntMetadata blanks out the tokens in the metadata of the given
+// entries, unless the ACL is allowed to see tokens. The entries belong to the
+// state store, so they're copied before being changed.
+func redactDirEntMetadata(acl acl.ACL, ents structs.DirEntries) structs.DirEntries {
+	if acl == nil || acl.ACLList() {
+		return ents
+	}
+	for i, ent := range ents {
+		if ent.CreatedBy == "" && ent.ModifiedBy == "" {
+			continue
+		}
+		ent = ent.Clone()
+		ent.CreatedBy = ""
+		ent.ModifiedBy = ""
+		ents[i] = ent
+	}
+	return ents
+}
+
 // Apply is used to apply a KVS update request to the data store.
 func (k *KVS) Apply(args *structs.KVSRequest, reply *bool) error {
 	if done, err := k.srv.forward("KVS.Apply", args, args, reply); done {
@@ -78,11 +132,23 @@ func (k *KVS) Apply(args *structs.KVSRequest, reply *bool) error {
 	defer metrics.MeasureSince([]string{"consul", "kvs", "apply"}, time.Now())
 
 	// Perform the pre-apply checks.
-	acl, err := k.srv.resolveToken(args.Token)
+	acl, err := k.srv.resolveToken("KVS.Apply", args.Token)
 	if err != nil {
 		return err
 	}
-	ok, err := kvsPreApply(k.srv, acl, args.Op, &args.DirEnt)
+	if args.SkipTombstones {
+		if args.Op != structs.KVSDeleteTree {
+			return fmt.Errorf("Skipping tombstones is only supported for %s", structs.KVSDeleteTree)
+		}
+		if acl != nil && !acl.OperatorWrite() {
+			return permissionDeniedErr
+		}
+	}
+	args.MaxTombstones = 0
+	if args.Op == structs.KVSDeleteTree {
+		args.MaxTombstones = k.srv.config.MaxTombstonesPerApply
+	}
+	ok, err := kvsPreApply(k.srv, acl, args.Op, &args.DirEnt, args.OverrideFlags)
 	if err != nil {
 		return err
 	}
@@ -90,6 +156,7 @@ func (k *KVS) Apply(args *structs.KVSRequest, reply *bool) error {
 		*reply = false
 		return nil
 	}
+	kvsStampMetadata(k.srv, args.Token, &args.DirEnt)
 
 	// Apply the update.
 	resp, err := k.srv.raftApply(structs.KVSRequestType, args)
@@ -114,7 +181,7 @@ func (k *KVS) Get(args *structs.KeyRequest, reply *structs.IndexedDirEntries) er
 		return err
 	}
 
-	acl, err := k.srv.resolveToken(args.Token)
+	acl, err := k.srv.resolveToken("KVS.Get", args.Token)
 	if err != nil {
 		return err
 	}
@@ -141,19 +208,67 @@ func (k *KVS) Get(args *structs.KeyRequest, reply *structs.IndexedDirEntries) er
 				reply.Entries = nil
 			} else {
 				reply.Index = ent.ModifyIndex
-				reply.Entries = structs.DirEntries{ent}
+				reply.Entries = redactDirEntMetadata(acl, structs.DirEntries{ent})
 			}
 			return nil
 		})
 }
 
+// maxGetManyKeys limits how many keys can be fetched by a single GetMany
+// request, since each one adds to the watch set of a blocking query.
+const maxGetManyKeys = 64
+
+// GetMany is used to look up several exact keys at once. The index is the
+// highest index across the keys, so a blocking query only wakes up when one
+// of them changes.
+func (k *KVS) GetMany(args *structs.KeysRequest, reply *structs.IndexedDirEntries) error {
+	if done, err := k.srv.forward("KVS.GetMany", args, args, reply); done {
+		return err
+	}
+
+	if len(args.Keys) == 0 {
+		return fmt.Errorf("Must provide at least one key")
+	}
+	if len(args.Keys) > maxGetManyKeys {
+		return fmt.Errorf("Cannot request more than %d keys at once", maxGetManyKeys)
+	}
+
+	acl, err := k.srv.resolveToken("KVS.GetMany", args.Token)
+	if err != nil {
+		return err
+	}
+
+	return k.srv.blockingQuery(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, state *state.StateStore) error {
+			index, ents, err := state.KVSGetMany(ws, args.Keys)
+			if err != nil {
+				return err
+			}
+			if acl != nil {
+				ents = FilterDirEnt(acl, ents)
+			}
+
+			// Must provide non-zero index to prevent blocking
+			// Index 1 is impossible anyways (due to Raft internals)
+			if index == 0 {
+				reply.Index = 1
+			} else {
+				reply.Index = index
+			}
+			reply.Entries = redactDirEntMetadata(acl, ents)
+			return nil
+		})
+}
+
 // List is used to list all keys with a given prefix.
 func (k *KVS) List(args *structs.KeyRequest, reply *structs.IndexedDirEntries) error {
 	if done, err := k.srv.forward("KVS.List", args, args, reply); done {
 		return err
 	}
 
-	acl, err := k.srv.resolveToken(args.Token)
+	acl, err := k.srv.resolveToken("KVS.List", args.Token)
 	if err != nil {
 		return err
 	}
@@ -181,8 +296,9 @@ func (k *KVS) List(args *structs.KeyRequest, reply *structs.IndexedDirEntries) e
 				reply.Entries = nil
 			} else {
 				reply.Index = index
-				reply.Entries = ent
+				reply.Entries = redactDirEntMetadata(acl, ent)
 			}
+			k.srv.truncateResults(&reply.QueryMeta, &reply.Entries)
 			return nil
 		})
 }
@@ -193,7 +309,7 @@ func (k *KVS) ListKeys(args *structs.KeyListRequest, reply *structs.IndexedKeyLi
 		return err
 	}
 
-	acl, err := k.srv.resolveToken(args.Token)
+	acl, err := k.srv.resolveToken("KVS.ListKeys", args.Token)
 	if err != nil {
 		return err
 	}
@@ -219,6 +335,69 @@ func (k *KVS) ListKeys(args *structs.KeyListRequest, reply *structs.IndexedKeyLi
 				keys = FilterKeys(acl, keys)
 			}
 			reply.Keys = keys
+			k.srv.truncateResults(&reply.QueryMeta, &reply.Keys)
 			return nil
 		})
 }
+
+// ReadAtSnapshot is used to read a key, or all the keys with a given prefix,
+// as they were in one of the Raft snapshots retained by the server. With no
+// snapshot ID, the retained snapshots are listed instead. Snapshots are only
+// kept on the server that took them, so this should be pointed at the same
+// server each time, which is the leader unless stale reads are allowed.
+func (k *KVS) ReadAtSnapshot(args *structs.KeySnapshotRequest, reply *structs.KeySnapshotResponse) error {
+	if done, err := k.srv.forward("KVS.ReadAtSnapshot", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "kvs", "read_at_snapshot"}, time.Now())
+
+	// This can see data from before any ACL changes, so it's limited to
+	// operators, and the usual key rules still apply on top of that.
+	acl, err := k.srv.resolveToken("KVS.ReadAtSnapshot", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	snapshots, err := k.srv.snapshotReads.List()
+	if err != nil {
+		return err
+	}
+	reply.Snapshots = snapshots
+	k.srv.setQueryMeta(&reply.QueryMeta)
+	if args.SnapshotID == "" {
+		return nil
+	}
+
+	info, state, err := k.srv.snapshotReads.State(args.SnapshotID)
+	if err != nil {
+		return err
+	}
+
+	var ents structs.DirEntries
+	if args.Prefix {
+		_, ents, err = state.KVSList(nil, args.Key)
+		if err != nil {
+			return err
+		}
+	} else {
+		_, ent, err := state.KVSGet(nil, args.Key)
+		if err != nil {
+			return err
+		}
+		if ent != nil {
+			ents = structs.DirEntries{ent}
+		}
+	}
+	if acl != nil {
+		ents = FilterDirEnt(acl, ents)
+	}
+
+	reply.Snapshot = info
+	reply.Index = info.Index
+	reply.Entries = redactDirEntMetadata(acl, ents)
+	k.srv.truncateResults(&reply.QueryMeta, &reply.Entries)
+	return nil
+}
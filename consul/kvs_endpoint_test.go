@@ -1,11 +1,15 @@
 package consul
 
 import (
+	"fmt"
+	"net/rpc"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/consul/consul/state"
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/testutil"
 	"github.com/hashicorp/net-rpc-msgpackrpc"
@@ -129,6 +133,453 @@ func TestKVS_Apply_ACLDeny(t *testing.T) {
 	}
 }
 
+func TestKVS_Apply_ReservedFlags(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Create a token that can write all the keys.
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: `key "" { policy = "write" }`,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var user string
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &user); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	apply := func(token string, op structs.KVSOp, key string, flags uint64, override bool) error {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         op,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Flags: flags,
+				Value: []byte("test"),
+			},
+			OverrideFlags: override,
+			WriteRequest:  structs.WriteRequest{Token: token},
+		}
+		var out bool
+		return msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out)
+	}
+
+	immutable := structs.KVFlagImmutable | 42
+	once := structs.KVFlagWriteOnce | 42
+	cases := []struct {
+		token    string
+		op       structs.KVSOp
+		key      string
+		flags    uint64
+		override bool
+		reason   string
+	}{
+		// Reserved bits that aren't in use are stored like any other.
+		{user, structs.KVSSet, "unused", 1 << 56, false, ""},
+		{user, structs.KVSSet, "unused", 0, false, ""},
+
+		// Immutable entries can't be touched once the flag is set, even
+		// to clear it, and not even by a management token on its own.
+		{user, structs.KVSSet, "imm", 42, false, ""},
+		{user, structs.KVSSet, "imm", immutable, false, ""},
+		{user, structs.KVSSet, "imm", immutable, false, "is immutable"},
+		{user, structs.KVSSet, "imm", 42, false, "is immutable"},
+		{user, structs.KVSCAS, "imm", 42, false, "is immutable"},
+		{user, structs.KVSDelete, "imm", 0, false, "is immutable"},
+		{user, structs.KVSDeleteTree, "im", 0, false, "is immutable"},
+		{"root", structs.KVSSet, "imm", 42, false, "is immutable"},
+
+		// Write-once entries can only be made that way when they're
+		// created.
+		{user, structs.KVSSet, "plain", 42, false, ""},
+		{user, structs.KVSSet, "plain", once, false, "when it's created"},
+		{user, structs.KVSSet, "once", once, false, ""},
+		{user, structs.KVSSet, "once", once, false, "is write-once"},
+		{user, structs.KVSDelete, "once", 0, false, "is write-once"},
+		{user, structs.KVSDeleteTree, "", 0, false, "is"},
+
+		// Overriding the flags needs a management token.
+		{user, structs.KVSSet, "imm", 42, true, permissionDenied},
+		{"root", structs.KVSSet, "plain", once, true, ""},
+		{"root", structs.KVSSet, "imm", 42, true, ""},
+		{"root", structs.KVSDelete, "once", 0, true, ""},
+		{user, structs.KVSSet, "imm", 43, false, ""},
+	}
+	for i, c := range cases {
+		err := apply(c.token, c.op, c.key, c.flags, c.override)
+		switch c.reason {
+		case "":
+			if err != nil {
+				t.Fatalf("case %d: err: %v", i, err)
+			}
+		case permissionDenied:
+			if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+				t.Fatalf("case %d: err: %v", i, err)
+			}
+		default:
+			if !structs.HasErrorCode(err, structs.ErrCodeKVFlag) || !strings.Contains(err.Error(), c.reason) {
+				t.Fatalf("case %d: err: %v", i, err)
+			}
+		}
+	}
+
+	// The user's bits should be left alone.
+	state := s1.fsm.State()
+	_, d, err := state.KVSGet(nil, "plain")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || d.Flags != once || d.Flags&^structs.KVFlagsReserved != 42 {
+		t.Fatalf("bad: %v", d)
+	}
+	_, d, err = state.KVSGet(nil, "once")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d != nil {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestKVS_Apply_ReservedFlags_NoACLs(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "imm",
+			Flags: structs.KVFlagImmutable,
+			Value: []byte("test"),
+		},
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The flags are still enforced without ACLs.
+	arg.DirEnt.Flags = 0
+	err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out)
+	if !structs.HasErrorCode(err, structs.ErrCodeKVFlag) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// But anyone can override them.
+	arg.OverrideFlags = true
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, d, err := s1.fsm.State().KVSGet(nil, "imm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || d.Flags != 0 {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestKVS_Apply_SkipTombstones(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Make a token that can write keys, and another that can also operate.
+	var tokens []string
+	for _, rules := range []string{
+		`key "" { policy = "write" }`,
+		`key "" { policy = "write" }
+		 operator = "write"`,
+	} {
+		arg := structs.ACLRequest{
+			Datacenter: "dc1",
+			Op:         structs.ACLSet,
+			ACL: structs.ACL{
+				Name:  "User token",
+				Type:  structs.ACLTypeClient,
+				Rules: rules,
+			},
+			WriteRequest: structs.WriteRequest{Token: "root"},
+		}
+		var out string
+		if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		tokens = append(tokens, out)
+	}
+	keyToken, operatorToken := tokens[0], tokens[1]
+
+	for i := 0; i < 100; i++ {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key: fmt.Sprintf("test/%d", i),
+			},
+			WriteRequest: structs.WriteRequest{Token: "root"},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Only delete-tree can skip tombstones.
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSDelete,
+		DirEnt: structs.DirEntry{
+			Key: "test/0",
+		},
+		SkipTombstones: true,
+		WriteRequest:   structs.WriteRequest{Token: "root"},
+	}
+	var out bool
+	err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "only supported") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Being able to write the keys isn't enough.
+	arg.Op = structs.KVSDeleteTree
+	arg.DirEnt.Key = "test/"
+	arg.Token = keyToken
+	err = msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Set up a blocking query on one of the keys.
+	getR := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "test/50",
+		QueryOptions: structs.QueryOptions{
+			Token: "root",
+		},
+	}
+	var dirent structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Get", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	getR.MinQueryIndex = dirent.Index
+	getR.MaxQueryTime = 5 * time.Second
+
+	// Delete the tree from the side with the operator token.
+	start := time.Now()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		codec := rpcClient(t, s1)
+		defer codec.Close()
+		arg.Token = operatorToken
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Errorf("err: %v", err)
+		}
+	}()
+
+	dirent = structs.IndexedDirEntries{}
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Get", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	elapsed := time.Now().Sub(start)
+	if elapsed < 100*time.Millisecond || elapsed > 4*time.Second {
+		t.Fatalf("bad: %v", elapsed)
+	}
+	if len(dirent.Entries) != 0 || dirent.Index <= getR.MinQueryIndex {
+		t.Fatalf("bad: %#v", dirent)
+	}
+
+	// Only the one tombstone should have been made.
+	snap := s1.fsm.State().Snapshot()
+	defer snap.Close()
+	stones, err := snap.Tombstones()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stone := stones.Next().(*state.Tombstone)
+	if stone.Key != "test/" || !stone.Prefix || stones.Next() != nil {
+		t.Fatalf("bad: %#v", stone)
+	}
+}
+
+func TestKVS_Apply_TooLarge(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.RaftMaxEntrySize = 4096
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// A value just under the limit goes through.
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "test",
+			Value: make([]byte, 3500),
+		},
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// One just over it gets the typed error, with both sizes.
+	arg.DirEnt.Value = make([]byte, 4096)
+	err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out)
+	if !structs.HasErrorCode(err, structs.ErrCodeTooLarge) || !strings.Contains(err.Error(), "limit is 4096 bytes") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The limit should be in the stats so clients can find it.
+	if s1.Stats()["consul"]["raft_max_entry_size"] != "4096" {
+		t.Fatalf("bad: %v", s1.Stats()["consul"])
+	}
+}
+
+func TestKVS_Apply_Metadata(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+		c.KVMetadata = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Make a token that can write and one that can only read.
+	makeToken := func(rules string) string {
+		arg := structs.ACLRequest{
+			Datacenter: "dc1",
+			Op:         structs.ACLSet,
+			ACL: structs.ACL{
+				Name:  "User token",
+				Type:  structs.ACLTypeClient,
+				Rules: rules,
+			},
+			WriteRequest: structs.WriteRequest{Token: "root"},
+		}
+		var out string
+		if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return out
+	}
+	writer := makeToken(testListRules)
+	reader := makeToken(`key "test" { policy = "read" }`)
+
+	apply := func(token string) {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:       "test/meta",
+				Value:     []byte("test"),
+				CreatedBy: "mallory",
+			},
+			WriteRequest: structs.WriteRequest{Token: token},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	get := func(token string) *structs.DirEntry {
+		arg := structs.KeyRequest{
+			Datacenter:   "dc1",
+			Key:          "test/meta",
+			QueryOptions: structs.QueryOptions{Token: token},
+		}
+		var out structs.IndexedDirEntries
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Get", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(out.Entries) != 1 {
+			t.Fatalf("bad: %v", out)
+		}
+		return out.Entries[0]
+	}
+
+	// A hash of the writer should be recorded, not the token itself or
+	// whoever the request claims.
+	start := time.Now()
+	apply(writer)
+	d := get("root")
+	if d.CreatedBy != hashToken(writer) || d.ModifiedBy != hashToken(writer) ||
+		d.CreateTime == nil || d.CreateTime.Before(start.Add(-time.Second)) ||
+		d.ModifyTime == nil || !d.ModifyTime.Equal(*d.CreateTime) {
+		t.Fatalf("bad: %#v", d)
+	}
+	created := *d.CreateTime
+
+	// An update changes the modification metadata only.
+	apply("root")
+	d = get("root")
+	if d.CreatedBy != hashToken(writer) || d.ModifiedBy != hashToken("root") ||
+		!d.CreateTime.Equal(created) || d.ModifyTime.Before(created) {
+		t.Fatalf("bad: %#v", d)
+	}
+
+	// A reader without ACL read sees the times but not the tokens.
+	d = get(reader)
+	if d.CreatedBy != "" || d.ModifiedBy != "" ||
+		d.CreateTime == nil || d.ModifyTime == nil {
+		t.Fatalf("bad: %#v", d)
+	}
+	arg := structs.KeyRequest{
+		Datacenter:   "dc1",
+		Key:          "test",
+		QueryOptions: structs.QueryOptions{Token: reader},
+	}
+	var list structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.List", &arg, &list); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(list.Entries) != 1 || list.Entries[0].CreatedBy != "" || list.Entries[0].ModifiedBy != "" {
+		t.Fatalf("bad: %v", list)
+	}
+
+	// The redaction mustn't leak into the stored entry.
+	if d := get("root"); d.CreatedBy != hashToken(writer) || d.ModifiedBy != hashToken("root") {
+		t.Fatalf("bad: %#v", d)
+	}
+}
+
 func TestKVS_Get(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -221,6 +672,189 @@ func TestKVS_Get_ACLDeny(t *testing.T) {
 	}
 }
 
+func TestKVS_GetMany(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	set := func(codec rpc.ClientCodec, key string) (uint64, error) {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Value: []byte("test"),
+			},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			return 0, err
+		}
+		_, ent, err := s1.fsm.State().KVSGet(nil, key)
+		if err != nil {
+			return 0, err
+		}
+		return ent.ModifyIndex, nil
+	}
+	var last uint64
+	for _, key := range []string{"config/a", "config/b", "config/c", "unrelated"} {
+		idx, err := set(codec, key)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if key == "config/c" {
+			last = idx
+		}
+	}
+
+	getR := structs.KeysRequest{
+		Datacenter: "dc1",
+		Keys:       []string{"config/a", "config/b", "config/c", "config/missing"},
+	}
+	var dirent structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.GetMany", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if dirent.Index != last {
+		t.Fatalf("bad: %d", dirent.Index)
+	}
+	if len(dirent.Entries) != 3 {
+		t.Fatalf("bad: %v", dirent.Entries)
+	}
+
+	// Changing an unrelated key shouldn't wake up a blocking query.
+	getR.MinQueryIndex = dirent.Index
+	getR.MaxQueryTime = 300 * time.Millisecond
+	start := time.Now()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		codec := rpcClient(t, s1)
+		defer codec.Close()
+		if _, err := set(codec, "unrelated"); err != nil {
+			t.Errorf("err: %v", err)
+		}
+	}()
+	dirent = structs.IndexedDirEntries{}
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.GetMany", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("should have blocked: %v", elapsed)
+	}
+	if dirent.Index != last {
+		t.Fatalf("bad: %d", dirent.Index)
+	}
+
+	// Changing one of the keys should wake it up once, with that key's
+	// index.
+	getR.MaxQueryTime = time.Second
+	start = time.Now()
+	changed := make(chan uint64, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		codec := rpcClient(t, s1)
+		defer codec.Close()
+		idx, err := set(codec, "config/b")
+		if err != nil {
+			t.Errorf("err: %v", err)
+		}
+		changed <- idx
+	}()
+	dirent = structs.IndexedDirEntries{}
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.GetMany", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed >= time.Second {
+		t.Fatalf("bad: %v", elapsed)
+	}
+	if idx := <-changed; dirent.Index != idx {
+		t.Fatalf("bad: %d != %d", dirent.Index, idx)
+	}
+	if len(dirent.Entries) != 3 {
+		t.Fatalf("bad: %v", dirent.Entries)
+	}
+
+	// The number of keys is checked.
+	getR = structs.KeysRequest{Datacenter: "dc1"}
+	err := msgpackrpc.CallWithCodec(codec, "KVS.GetMany", &getR, &dirent)
+	if err == nil || !strings.Contains(err.Error(), "at least one key") {
+		t.Fatalf("bad: %v", err)
+	}
+	for i := 0; i <= maxGetManyKeys; i++ {
+		getR.Keys = append(getR.Keys, fmt.Sprintf("key%d", i))
+	}
+	err = msgpackrpc.CallWithCodec(codec, "KVS.GetMany", &getR, &dirent)
+	if err == nil || !strings.Contains(err.Error(), "Cannot request more") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestKVS_GetMany_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	for _, key := range []string{"bar", "foo", "zip"} {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Flags: 1,
+			},
+			WriteRequest: structs.WriteRequest{Token: "root"},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testListRules,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var out string
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Only the keys the token can read come back.
+	getR := structs.KeysRequest{
+		Datacenter:   "dc1",
+		Keys:         []string{"bar", "foo", "zip"},
+		QueryOptions: structs.QueryOptions{Token: out},
+	}
+	var dirent structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.GetMany", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if dirent.Index == 0 {
+		t.Fatalf("Bad: %v", dirent)
+	}
+	if len(dirent.Entries) != 1 || dirent.Entries[0].Key != "foo" {
+		t.Fatalf("Bad: %v", dirent.Entries)
+	}
+}
+
 func TestKVSEndpoint_List(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -618,6 +1252,196 @@ func TestKVSEndpoint_ListKeys_ACLDeny(t *testing.T) {
 	}
 }
 
+func TestKVS_ReadAtSnapshot(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	set := func(key, value string) {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Value: []byte(value),
+			},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Write some keys and take a snapshot, then change them.
+	set("app/config", "old")
+	set("app/other", "old")
+	if err := s1.raft.Snapshot().Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	set("app/config", "new")
+	set("app/added", "new")
+
+	// The snapshot should be listed.
+	args := structs.KeySnapshotRequest{Datacenter: "dc1"}
+	var list structs.KeySnapshotResponse
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.ReadAtSnapshot", &args, &list); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(list.Snapshots) != 1 || list.Snapshot != nil || len(list.Entries) != 0 {
+		t.Fatalf("bad: %#v", list)
+	}
+	snap := list.Snapshots[0]
+	if snap.ID == "" || snap.Index == 0 || snap.Time.IsZero() {
+		t.Fatalf("bad: %#v", snap)
+	}
+
+	// Reading from it should give the old value.
+	args.SnapshotID = snap.ID
+	args.Key = "app/config"
+	var out structs.KeySnapshotResponse
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.ReadAtSnapshot", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Snapshot == nil || out.Snapshot.ID != snap.ID || out.Index != snap.Index {
+		t.Fatalf("bad: %#v", out)
+	}
+	if len(out.Entries) != 1 || string(out.Entries[0].Value) != "old" {
+		t.Fatalf("bad: %#v", out.Entries)
+	}
+
+	// While the live value is the new one.
+	_, d, err := s1.fsm.State().KVSGet(nil, "app/config")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "new" {
+		t.Fatalf("bad: %#v", d)
+	}
+
+	// A prefix read should only see the keys as they were. This should come
+	// from the cache.
+	args.Key = "app/"
+	args.Prefix = true
+	out = structs.KeySnapshotResponse{}
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.ReadAtSnapshot", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var keys []string
+	for _, ent := range out.Entries {
+		keys = append(keys, ent.Key+"="+string(ent.Value))
+	}
+	if !reflect.DeepEqual(keys, []string{"app/config=old", "app/other=old"}) {
+		t.Fatalf("bad: %v", keys)
+	}
+	if len(s1.snapshotReads.cache) != 1 {
+		t.Fatalf("bad: %d", len(s1.snapshotReads.cache))
+	}
+
+	// Missing keys and unknown snapshots.
+	args.Key = "app/added"
+	args.Prefix = false
+	out = structs.KeySnapshotResponse{}
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.ReadAtSnapshot", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Entries) != 0 {
+		t.Fatalf("bad: %#v", out.Entries)
+	}
+	args.SnapshotID = "nope"
+	err = msgpackrpc.CallWithCodec(codec, "KVS.ReadAtSnapshot", &args, &out)
+	if err == nil || !strings.Contains(err.Error(), "Unknown snapshot") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestKVS_ReadAtSnapshot_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	for _, key := range []string{"foo", "secret"} {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key: key,
+			},
+			WriteRequest: structs.WriteRequest{Token: "root"},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := s1.raft.Snapshot().Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	makeToken := func(rules string) string {
+		arg := structs.ACLRequest{
+			Datacenter: "dc1",
+			Op:         structs.ACLSet,
+			ACL: structs.ACL{
+				Name:  "User token",
+				Type:  structs.ACLTypeClient,
+				Rules: rules,
+			},
+			WriteRequest: structs.WriteRequest{Token: "root"},
+		}
+		var out string
+		if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return out
+	}
+
+	// Being able to read keys isn't enough.
+	args := structs.KeySnapshotRequest{
+		Datacenter:   "dc1",
+		QueryOptions: structs.QueryOptions{Token: makeToken(`key "" { policy = "read" }`)},
+	}
+	var out structs.KeySnapshotResponse
+	err := msgpackrpc.CallWithCodec(codec, "KVS.ReadAtSnapshot", &args, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// An operator can read, but only the keys they're allowed to see.
+	args.Token = makeToken(`
+operator = "read"
+key "foo" {
+	policy = "read"
+}
+`)
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.ReadAtSnapshot", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Snapshots) != 1 {
+		t.Fatalf("bad: %#v", out)
+	}
+	args.SnapshotID = out.Snapshots[0].ID
+	args.Prefix = true
+	out = structs.KeySnapshotResponse{}
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.ReadAtSnapshot", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Entries) != 1 || out.Entries[0].Key != "foo" {
+		t.Fatalf("bad: %#v", out.Entries)
+	}
+}
+
 func TestKVS_Apply_LockDelay(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -23,6 +23,15 @@ const (
 	ConsulServiceID                     = "consul"
 	ConsulServiceName                   = "consul"
 	newLeaderEvent                      = "consul:new-leader"
+
+	// NoReapMetaKey is the node meta key that exempts an external node
+	// from being reaped when it has no services or checks, if set to
+	// "true". This is usually set alongside ExternalNodeMetaKey.
+	NoReapMetaKey = "no-reap"
+
+	// ExternalNodeMetaKey is the node meta key conventionally used to mark
+	// nodes that are registered directly via the catalog.
+	ExternalNodeMetaKey = "external-node"
 )
 
 // monitorLeadership is used to monitor if we acquire or lose our role
@@ -52,8 +61,15 @@ func (s *Server) monitorLeadership() {
 // leaderLoop runs as long as we are the leader to run various
 // maintenance activities
 func (s *Server) leaderLoop(stopCh chan struct{}) {
-	// Ensure we revoke leadership on stepdown
-	defer s.revokeLeadership()
+	// Ensure we revoke leadership on stepdown, if we got as far as
+	// establishing it. Leadership can be lost before then, such as when
+	// the first barrier fails.
+	establishedLeader := false
+	defer func() {
+		if establishedLeader {
+			s.revokeLeadership()
+		}
+	}()
 
 	// Fire a user event indicating a new leader
 	payload := []byte(s.config.NodeName)
@@ -61,15 +77,49 @@ func (s *Server) leaderLoop(stopCh chan struct{}) {
 		s.logger.Printf("[WARN] consul: failed to broadcast new leader event: %v", err)
 	}
 
+	// Start reaping checks orphaned by their services, if enabled.
+	if s.config.OrphanedCheckReapInterval > 0 {
+		go s.runOrphanedCheckReaper(stopCh)
+	}
+
+	// Start releasing locks held by missing sessions, if enabled.
+	if s.config.OrphanedLockSweepInterval > 0 {
+		go s.runOrphanedLockSweeper(stopCh)
+	}
+
+	// Start deregistering reaped nodes in batches, if enabled.
+	if s.reapBatcher != nil {
+		go s.runReapBatcher(stopCh)
+	}
+
+	// Start repairing the WAN pool, if enabled.
+	if s.config.WANRepairInterval > 0 {
+		go s.runWANRepair(stopCh)
+	}
+
+	// Start probing critical services, if enabled.
+	if s.config.CriticalProbeInterval > 0 {
+		go s.runCriticalProber(stopCh)
+	}
+
+	// Start retrying any pending keyring rotation, if enabled.
+	if s.config.KeyringRotateInterval > 0 {
+		go s.runKeyringRotation(stopCh)
+	}
+
 	// Reconcile channel is only used once initial reconcile
 	// has succeeded
 	var reconcileCh chan serf.Member
-	establishedLeader := false
+
+	// This fires when it's time to stop deferring destructive reconcile
+	// actions, if that's enabled.
+	var holdoffCh <-chan time.Time
+	s.reconcileHoldoff = reconcileHoldoff{}
 
 RECONCILE:
 	// Setup a reconciliation timer
 	reconcileCh = nil
-	interval := time.After(s.config.ReconcileInterval)
+	interval := s.clock.After(s.config.ReconcileInterval)
 
 	// Apply a raft barrier to ensure our FSM is caught up
 	start := time.Now()
@@ -88,6 +138,11 @@ RECONCILE:
 			goto WAIT
 		}
 		establishedLeader = true
+
+		if holdoff := s.config.LeaderReconcileHoldoff; holdoff > 0 {
+			s.startReconcileHoldoff()
+			holdoffCh = s.clock.After(holdoff)
+		}
 	}
 
 	// Reconcile any missing data
@@ -113,6 +168,9 @@ WAIT:
 			goto RECONCILE
 		case member := <-reconcileCh:
 			s.reconcileMember(member)
+		case <-holdoffCh:
+			holdoffCh = nil
+			s.endReconcileHoldoff()
 		case index := <-s.tombstoneGC.ExpireCh():
 			go s.reapTombstones(index)
 		}
@@ -159,6 +217,34 @@ func (s *Server) establishLeadership() error {
 		return err
 	}
 
+	// Set up the remote write policy if it's never been set.
+	if err := s.initializeRemoteWritePolicy(); err != nil {
+		s.logger.Printf("[ERR] consul: Remote write policy initialization failed: %v", err)
+		return err
+	}
+
+	// Give the cluster an ID if it doesn't have one. Nothing needs the ID
+	// to lead, so if this fails it's left for the reconcile to retry.
+	if err := s.initializeClusterID(); err != nil {
+		s.logger.Printf("[ERR] consul: Cluster ID initialization failed, will retry: %v", err)
+	}
+
+	// Make sure there's a key to sign results with.
+	if err := s.initializeSigningKey(); err != nil {
+		s.logger.Printf("[ERR] consul: Signing key initialization failed: %v", err)
+		return err
+	}
+
+	// Pick up any workflows the last leader didn't finish. Their steps can
+	// take a while, so this is done in the background rather than holding
+	// up leadership. Autopilot and the reconcile look for pending intents
+	// before starting new ones, so they won't start these over.
+	go func() {
+		if err := s.resumeOperatorIntents(); err != nil {
+			s.logger.Printf("[ERR] consul: Resuming operator intents failed: %v", err)
+		}
+	}()
+
 	s.startAutopilot()
 
 	return nil
@@ -263,7 +349,7 @@ func (s *Server) initializeAutopilot() error {
 	}
 
 	req := structs.AutopilotSetConfigRequest{
-		Config: *s.config.AutopilotConfig,
+		Config: s.autopilotConfig(),
 	}
 	if _, err = s.raftApply(structs.AutopilotRequestType, req); err != nil {
 		return fmt.Errorf("failed to initialize autopilot config")
@@ -272,6 +358,35 @@ func (s *Server) initializeAutopilot() error {
 	return nil
 }
 
+// initializeRemoteWritePolicy is used to store the remote write policy from
+// the config if we are the leader and it's never been set.
+func (s *Server) initializeRemoteWritePolicy() error {
+	state := s.fsm.State()
+	_, policy, err := state.RemoteWritePolicy(nil)
+	if err != nil {
+		return fmt.Errorf("failed to get remote write policy: %v", err)
+	}
+	if policy != nil {
+		return nil
+	}
+
+	req := structs.RemoteWritePolicyRequest{
+		Policy: structs.RemoteWritePolicy{
+			RefuseRemoteWrites: s.config.RefuseRemoteWrites,
+		},
+	}
+
+	// This is written the first time an upgraded server takes over, which
+	// is usually in the middle of a rolling upgrade, so servers that don't
+	// know about the policy are allowed to skip it.
+	t := structs.RemoteWritePolicyRequestType | structs.IgnoreUnknownTypeFlag
+	if _, err = s.raftApply(t, req); err != nil {
+		return fmt.Errorf("failed to initialize remote write policy: %v", err)
+	}
+
+	return nil
+}
+
 // reconcile is used to reconcile the differences between Serf
 // membership and what is reflected in our strongly consistent store.
 // Mainly we need to ensure all live nodes are registered, all failed
@@ -287,10 +402,59 @@ func (s *Server) reconcile() (err error) {
 		knownMembers[member.Name] = struct{}{}
 	}
 
+	// Retry giving the cluster an ID if that failed when we took over.
+	if err := s.initializeClusterID(); err != nil {
+		s.logger.Printf("[ERR] consul: Cluster ID initialization failed: %v", err)
+	}
+
+	// Clean up any node blocks that have run out. Expired blocks are
+	// already ignored, so a failure here shouldn't hold up the rest.
+	if err := s.reapNodeBlocks(); err != nil {
+		s.logger.Printf("[ERR] consul: failed to clear expired node blocks: %v", err)
+	}
+
 	// Reconcile any members that have been reaped while we were not the leader
 	return s.reconcileReaped(knownMembers)
 }
 
+// reapNodeBlocks clears any node blocks that have expired. Expired blocks
+// are already ignored, so this just keeps them from piling up. A block that
+// fails to clear is logged and left for the next pass.
+func (s *Server) reapNodeBlocks() error {
+	state := s.fsm.State()
+	_, blocks, err := state.NodeBlockList(nil)
+	if err != nil {
+		return err
+	}
+
+	now := s.clock.Now()
+	for _, block := range blocks {
+		if !block.Expired(now) {
+			continue
+		}
+
+		req := structs.NodeBlockRequest{
+			Datacenter: s.config.Datacenter,
+			Op:         structs.NodeBlockClear,
+			Block: structs.NodeBlock{
+				Node: block.Node,
+			},
+		}
+		resp, err := s.raftApply(structs.NodeBlockRequestType, &req)
+		if err == nil {
+			if respErr, ok := resp.(error); ok {
+				err = respErr
+			}
+		}
+		if err != nil {
+			s.logger.Printf("[ERR] consul: failed to clear expired block on node '%s': %v", block.Node, err)
+			continue
+		}
+		s.logger.Printf("[INFO] consul: cleared expired block on node '%s'", block.Node)
+	}
+	return nil
+}
+
 // reconcileReaped is used to reconcile nodes that have failed and been reaped
 // from Serf but remain in the catalog. This is done by looking for SerfCheckID
 // in a critical state that does not correspond to a known Serf member. We generate
@@ -340,7 +504,11 @@ func (s *Server) reconcileReaped(known map[string]struct{}) error {
 			member.Tags["port"] = strconv.FormatUint(uint64(serverPort), 10)
 		}
 
-		// Attempt to reap this member
+		// Attempt to reap this member, unless we're holding off
+		member.Status = StatusReap
+		if s.deferReconcile(member) {
+			continue
+		}
 		if err := s.handleReapMember(member); err != nil {
 			return err
 		}
@@ -356,6 +524,9 @@ func (s *Server) reconcileMember(member serf.Member) error {
 		s.logger.Printf("[WARN] consul: skipping reconcile of node %v", member)
 		return nil
 	}
+	if s.deferReconcile(member) {
+		return nil
+	}
 	defer metrics.MeasureSince([]string{"consul", "leader", "reconcileMember"}, time.Now())
 	var err error
 	switch member.Status {
@@ -395,6 +566,9 @@ func (s *Server) shouldHandleMember(member serf.Member) bool {
 // handleAliveMember is used to ensure the node
 // is registered, with a passing health check.
 func (s *Server) handleAliveMember(member serf.Member) error {
+	// A registration wins over a queued deregistration.
+	s.cancelReapedDeregister(member.Name)
+
 	// Register consul service if a server
 	var service *structs.NodeService
 	if valid, parts := agent.IsConsulServer(member); valid {
@@ -410,6 +584,11 @@ func (s *Server) handleAliveMember(member serf.Member) error {
 		}
 	}
 
+	// Leave blocked nodes out of the catalog.
+	if blocked, err := s.isMemberBlocked(member); err != nil || blocked {
+		return err
+	}
+
 	// Check if the node exists
 	state := s.fsm.State()
 	_, node, err := state.GetNode(member.Name)
@@ -425,8 +604,8 @@ func (s *Server) handleAliveMember(member serf.Member) error {
 				return err
 			}
 			if services != nil {
-				for id, _ := range services.Services {
-					if id == service.ID {
+				for id, svc := range services.Services {
+					if id == service.ID && svc.Port == service.Port {
 						match = true
 					}
 				}
@@ -469,13 +648,58 @@ AFTER_CHECK:
 		// clobber it.
 		SkipNodeUpdate: true,
 	}
+
+	// If the member's address has changed, for example after a Serf
+	// member-update event, then update the node in the catalog. Everything
+	// else about the node is kept, and since this is a register request
+	// the node's services and checks are left alone.
+	if node != nil && node.Address != member.Addr.String() {
+		s.logger.Printf("[INFO] consul: member '%s' changed address from %s to %s, updating catalog",
+			member.Name, node.Address, member.Addr.String())
+		req.SkipNodeUpdate = false
+		req.NodeMeta = node.Meta
+		if node.TaggedAddresses != nil {
+			req.TaggedAddresses = make(map[string]string, len(node.TaggedAddresses))
+			for tag, addr := range node.TaggedAddresses {
+				if addr == node.Address {
+					addr = member.Addr.String()
+				}
+				req.TaggedAddresses[tag] = addr
+			}
+		}
+	}
+
 	_, err = s.raftApply(structs.RegisterRequestType, &req)
 	return err
 }
 
+// isMemberBlocked returns true if the member matches a node block that
+// hasn't expired, in which case it shouldn't be put back into the catalog.
+func (s *Server) isMemberBlocked(member serf.Member) (bool, error) {
+	state := s.fsm.State()
+	blocks, err := state.NodeBlocksMatching(member.Name, types.NodeID(member.Tags["id"]))
+	if err != nil {
+		return false, err
+	}
+
+	now := s.clock.Now()
+	for _, block := range blocks {
+		if !block.Expired(now) {
+			s.logger.Printf("[DEBUG] consul: member '%s' is blocked, skipping catalog update", member.Name)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // handleFailedMember is used to mark the node's status
 // as being critical, along with all checks as unknown.
 func (s *Server) handleFailedMember(member serf.Member) error {
+	// Leave blocked nodes out of the catalog.
+	if blocked, err := s.isMemberBlocked(member); err != nil || blocked {
+		return err
+	}
+
 	// Check if the node exists
 	state := s.fsm.State()
 	_, node, err := state.GetNode(member.Name)
@@ -525,9 +749,28 @@ func (s *Server) handleLeftMember(member serf.Member) error {
 }
 
 // handleReapMember is used to handle members that have been
-// reaped after a prolonged failure. They are deregistered.
+// reaped after a prolonged failure. They are deregistered, in batches if
+// that's enabled. Servers are always handled right away so they're removed
+// from the Raft peers.
 func (s *Server) handleReapMember(member serf.Member) error {
-	return s.handleDeregisterMember("reaped", member)
+	if s.reapBatcher == nil || member.Name == s.config.NodeName {
+		return s.handleDeregisterMember("reaped", member)
+	}
+	if valid, _ := agent.IsConsulServer(member); valid {
+		return s.handleDeregisterMember("reaped", member)
+	}
+
+	state := s.fsm.State()
+	_, node, err := state.GetNode(member.Name)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return nil
+	}
+	s.logger.Printf("[INFO] consul: member '%s' reaped, queueing deregistration", member.Name)
+	s.reapBatcher.add(member.Name)
+	return nil
 }
 
 // handleDeregisterMember is used to deregister a member of a given reason
@@ -540,11 +783,11 @@ func (s *Server) handleDeregisterMember(reason string, member serf.Member) error
 		return nil
 	}
 
-	// Remove from Raft peers if this was a server
+	// Servers are removed from the Raft peers before they're deregistered,
+	// which is tracked as an operator intent so a new leader can finish
+	// the job if we fail part way.
 	if valid, parts := agent.IsConsulServer(member); valid {
-		if err := s.removeConsulServer(member, parts.Port); err != nil {
-			return err
-		}
+		return s.handleDeregisterServer(reason, member, parts)
 	}
 
 	// Check if the node does not exist
@@ -559,11 +802,46 @@ func (s *Server) handleDeregisterMember(reason string, member serf.Member) error
 
 	// Deregister the node
 	s.logger.Printf("[INFO] consul: member '%s' %s, deregistering", member.Name, reason)
+	return s.deregisterNode(member.Name)
+}
+
+// handleDeregisterServer removes a server that left or was reaped. If
+// there's already an operator intent for the server, that's run instead,
+// since left servers are reconciled over and over.
+func (s *Server) handleDeregisterServer(reason string, member serf.Member, parts *agent.Server) error {
+	intent, err := s.operatorIntentFor(member.Name)
+	if err != nil {
+		return err
+	}
+	if intent != nil {
+		return s.runOperatorIntent(intent)
+	}
+
+	// Only start removing it if there's something left to do.
+	addr := (&net.TCPAddr{IP: member.Addr, Port: parts.Port}).String()
+	present, err := s.inRaftConfig(raft.ServerID(parts.ID), raft.ServerAddress(addr))
+	if err != nil {
+		return err
+	}
+	_, node, err := s.fsm.State().GetNode(member.Name)
+	if err != nil {
+		return err
+	}
+	if !present && node == nil {
+		return nil
+	}
+
+	s.logger.Printf("[INFO] consul: server '%s' %s, removing", member.Name, reason)
+	return s.startOperatorIntent(structs.OperatorIntentServerLeave, member.Name, parts.ID, addr, reason)
+}
+
+// deregisterNode deregisters the given node from the catalog.
+func (s *Server) deregisterNode(name string) error {
 	req := structs.DeregisterRequest{
 		Datacenter: s.config.Datacenter,
-		Node:       member.Name,
+		Node:       name,
 	}
-	_, err = s.raftApply(structs.DeregisterRequestType, &req)
+	_, err := s.raftApply(structs.DeregisterRequestType, &req)
 	return err
 }
 
@@ -586,6 +864,12 @@ func (s *Server) joinConsulServer(m serf.Member, parts *agent.Server) error {
 		}
 	}
 
+	// Don't pull in servers from another cluster.
+	if err := checkClusterID(m.Name, parts.ClusterID, s.getClusterID()); err != nil {
+		s.logger.Printf("[ERR] consul: %v, not adding Raft peer", err)
+		return nil
+	}
+
 	addr := (&net.TCPAddr{IP: m.Addr, Port: parts.Port}).String()
 
 	minRaftProtocol, err := ServerMinRaftProtocol(s.serfLAN.Members())
@@ -610,8 +894,13 @@ func (s *Server) joinConsulServer(m serf.Member, parts *agent.Server) error {
 
 		// If the address or ID matches an existing server, see if we need to remove the old one first
 		if server.Address == raft.ServerAddress(addr) || server.ID == raft.ServerID(parts.ID) {
-			// Exit with no-op if this is being called on an existing server
+			// Exit with no-op if this is being called on an existing
+			// server, unless it's a voter that's since been made a
+			// non-voter.
 			if server.Address == raft.ServerAddress(addr) && server.ID == raft.ServerID(parts.ID) {
+				if parts.NonVoter && isVoter(server.Suffrage) {
+					return s.demoteNonVotingServer(server)
+				}
 				return nil
 			} else {
 				future := s.raft.RemoveServer(server.ID, 0, 0)
@@ -620,36 +909,68 @@ func (s *Server) joinConsulServer(m serf.Member, parts *agent.Server) error {
 						return fmt.Errorf("error removing server with duplicate address %q: %s", server.Address, err)
 					}
 					s.logger.Printf("[INFO] consul: removed server with duplicate address: %s", server.Address)
+					s.recordServerEvent(server.ID, server.Address, structs.ServerEventRemoved,
+						"another server joined with the same address", structs.ServerEventByLeader)
 				} else {
 					if err := future.Error(); err != nil {
 						return fmt.Errorf("error removing server with duplicate ID %q: %s", server.ID, err)
 					}
 					s.logger.Printf("[INFO] consul: removed server with duplicate ID: %s", server.ID)
+					s.recordServerEvent(server.ID, server.Address, structs.ServerEventRemoved,
+						"another server joined with the same ID", structs.ServerEventByLeader)
 				}
 			}
 		}
 	}
 
-	// Attempt to add as a peer
+	// Attempt to add as a peer. New servers are staged as non-voters when
+	// possible, so they don't count towards the quorum while they catch up,
+	// and autopilot promotes them once they're stable.
+	var id raft.ServerID
 	switch {
-	case minRaftProtocol >= 3:
-		addFuture := s.raft.AddNonvoter(raft.ServerID(parts.ID), raft.ServerAddress(addr), 0, 0)
+	case parts.NonVoter:
+		// Non-voting servers stay that way, and autopilot won't
+		// promote them. Raft can only tell them apart from voters in
+		// protocol 3, so we leave them out until then rather than
+		// letting them vote.
+		if minRaftProtocol < 3 {
+			s.logger.Printf("[ERR] consul: not adding non-voting server '%s' until all servers are on Raft protocol 3", m.Name)
+			return nil
+		}
+		id = raft.ServerID(parts.ID)
+		addFuture := s.raft.AddNonvoter(id, raft.ServerAddress(addr), 0, 0)
+		if err := addFuture.Error(); err != nil {
+			s.logger.Printf("[ERR] consul: failed to add raft peer: %v", err)
+			return err
+		}
+		s.recordServerEvent(id, raft.ServerAddress(addr), structs.ServerEventAdded,
+			"joined as a non-voting server", structs.ServerEventByLeader)
+	case minRaftProtocol >= 3 && !s.config.JoinAsVoter:
+		id = raft.ServerID(parts.ID)
+		addFuture := s.raft.AddNonvoter(id, raft.ServerAddress(addr), 0, 0)
 		if err := addFuture.Error(); err != nil {
 			s.logger.Printf("[ERR] consul: failed to add raft peer: %v", err)
 			return err
 		}
-	case minRaftProtocol == 2 && parts.RaftVersion >= 3:
-		addFuture := s.raft.AddVoter(raft.ServerID(parts.ID), raft.ServerAddress(addr), 0, 0)
+		s.recordServerEvent(id, raft.ServerAddress(addr), structs.ServerEventAdded,
+			"joined as a non-voter", structs.ServerEventByLeader)
+	case minRaftProtocol >= 3, minRaftProtocol == 2 && parts.RaftVersion >= 3:
+		id = raft.ServerID(parts.ID)
+		addFuture := s.raft.AddVoter(id, raft.ServerAddress(addr), 0, 0)
 		if err := addFuture.Error(); err != nil {
 			s.logger.Printf("[ERR] consul: failed to add raft peer: %v", err)
 			return err
 		}
+		s.recordServerEvent(id, raft.ServerAddress(addr), structs.ServerEventAdded,
+			"joined as a voter", structs.ServerEventByLeader)
 	default:
 		addFuture := s.raft.AddPeer(raft.ServerAddress(addr))
 		if err := addFuture.Error(); err != nil {
 			s.logger.Printf("[ERR] consul: failed to add raft peer: %v", err)
 			return err
 		}
+		s.recordServerEvent(id, raft.ServerAddress(addr), structs.ServerEventAdded,
+			"joined as a voter", structs.ServerEventByLeader)
 	}
 
 	// Trigger a check to remove dead servers
@@ -661,10 +982,38 @@ func (s *Server) joinConsulServer(m serf.Member, parts *agent.Server) error {
 	return nil
 }
 
-// removeConsulServer is used to try to remove a consul server that has left
-func (s *Server) removeConsulServer(m serf.Member, port int) error {
-	addr := (&net.TCPAddr{IP: m.Addr, Port: port}).String()
+// demoteNonVotingServer demotes a voter that has restarted as a non-voting
+// server.
+func (s *Server) demoteNonVotingServer(server raft.Server) error {
+	s.logger.Printf("[INFO] consul: Demoting server (ID %s) since it's now a non-voting server", server.ID)
+	future := s.raft.DemoteVoter(server.ID, 0, 0)
+	if err := future.Error(); err != nil {
+		s.logger.Printf("[ERR] consul: failed to demote raft peer: %v", err)
+		return err
+	}
+	s.recordServerEvent(server.ID, server.Address, structs.ServerEventDemoted,
+		"configured as a non-voting server", structs.ServerEventByLeader)
+	return nil
+}
 
+// inRaftConfig returns true if a server with the given ID or address is in
+// the Raft configuration.
+func (s *Server) inRaftConfig(id raft.ServerID, addr raft.ServerAddress) (bool, error) {
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return false, err
+	}
+	for _, server := range configFuture.Configuration().Servers {
+		if (id != "" && server.ID == id) || server.Address == addr {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// removeConsulServer is used to try to remove a consul server that has left.
+// The reason and initiator are recorded in the server history.
+func (s *Server) removeConsulServer(id raft.ServerID, addr raft.ServerAddress, reason, initiator string) error {
 	// See if it's already in the configuration. It's harmless to re-remove it
 	// but we want to avoid doing that if possible to prevent useless Raft
 	// log entries.
@@ -679,29 +1028,29 @@ func (s *Server) removeConsulServer(m serf.Member, port int) error {
 		return err
 	}
 
-	_, parts := agent.IsConsulServer(m)
-
 	// Pick which remove API to use based on how the server was added.
 	for _, server := range configFuture.Configuration().Servers {
 		// If we understand the new add/remove APIs and the server was added by ID, use the new remove API
-		if minRaftProtocol >= 2 && server.ID == raft.ServerID(parts.ID) {
+		if minRaftProtocol >= 2 && server.ID == id {
 			s.logger.Printf("[INFO] consul: removing server by ID: %q", server.ID)
-			future := s.raft.RemoveServer(raft.ServerID(parts.ID), 0, 0)
+			future := s.raft.RemoveServer(id, 0, 0)
 			if err := future.Error(); err != nil {
 				s.logger.Printf("[ERR] consul: failed to remove raft peer '%v': %v",
 					server.ID, err)
 				return err
 			}
+			s.recordServerEvent(server.ID, server.Address, structs.ServerEventRemoved, reason, initiator)
 			break
-		} else if server.Address == raft.ServerAddress(addr) {
+		} else if server.Address == addr {
 			// If not, use the old remove API
 			s.logger.Printf("[INFO] consul: removing server by address: %q", server.Address)
-			future := s.raft.RemovePeer(raft.ServerAddress(addr))
+			future := s.raft.RemovePeer(addr)
 			if err := future.Error(); err != nil {
 				s.logger.Printf("[ERR] consul: failed to remove raft peer '%v': %v",
 					addr, err)
 				return err
 			}
+			s.recordServerEvent(server.ID, server.Address, structs.ServerEventRemoved, reason, initiator)
 			break
 		}
 	}
@@ -728,3 +1077,281 @@ func (s *Server) reapTombstones(index uint64) {
 			index, err)
 	}
 }
+
+// indexCheckpoint records the last Raft index seen at a point in time.
+type indexCheckpoint struct {
+	time  time.Time
+	index uint64
+}
+
+// indexHistory is a record of the last Raft index at points in time, used
+// to find the index which is at least a given age.
+type indexHistory struct {
+	checkpoints []indexCheckpoint
+}
+
+// add records the index at the given time, and drops the checkpoints that
+// are older than we need, keeping the newest one that's at least the age.
+func (h *indexHistory) add(now time.Time, index uint64, age time.Duration) {
+	h.checkpoints = append(h.checkpoints, indexCheckpoint{now, index})
+	for len(h.checkpoints) > 1 && now.Sub(h.checkpoints[1].time) >= age {
+		h.checkpoints = h.checkpoints[1:]
+	}
+}
+
+// indexAtAge returns the newest index recorded at least the given age ago,
+// or false if the history doesn't go back that far yet.
+func (h *indexHistory) indexAtAge(now time.Time, age time.Duration) (uint64, bool) {
+	if len(h.checkpoints) == 0 || now.Sub(h.checkpoints[0].time) < age {
+		return 0, false
+	}
+	return h.checkpoints[0].index, true
+}
+
+// runExternalNodeReaper periodically reaps external nodes which have been
+// empty for longer than ExternalNodeReapAge. Nodes only track Raft indexes,
+// so we keep a history of the last index at each pass in order to find the
+// index which is at least that old. This runs on every server until it shuts
+// down so a new leader doesn't have to start its history over, but only the
+// leader reaps.
+func (s *Server) runExternalNodeReaper() {
+	ticker := s.clock.NewTicker(s.config.ExternalNodeReapInterval)
+	defer ticker.Stop()
+
+	var history indexHistory
+	for {
+		select {
+		case <-s.shutdownCh:
+			return
+		case <-ticker.C():
+		}
+
+		now := s.clock.Now()
+		age := s.config.ExternalNodeReapAge
+		history.add(now, s.raft.LastIndex(), age)
+		if !s.IsLeader() {
+			continue
+		}
+		maxIndex, ok := history.indexAtAge(now, age)
+		if !ok {
+			continue
+		}
+
+		if err := s.reapExternalNodes(maxIndex); err != nil {
+			s.logger.Printf("[ERR] consul: failed to reap external nodes: %v", err)
+		}
+	}
+}
+
+// reapExternalNodes deregisters nodes that are not Serf members, have no
+// services or checks, and haven't been modified since the given index.
+// Nodes with the NoReapMetaKey set to "true" are left alone.
+func (s *Server) reapExternalNodes(maxIndex uint64) error {
+	defer metrics.MeasureSince([]string{"consul", "leader", "reapExternalNodes"}, time.Now())
+
+	known := make(map[string]struct{})
+	for _, member := range s.serfLAN.Members() {
+		known[member.Name] = struct{}{}
+	}
+
+	state := s.fsm.State()
+	_, nodes, err := state.Nodes(nil)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if _, ok := known[node.Node]; ok {
+			continue
+		}
+		if node.ModifyIndex > maxIndex || node.Meta[NoReapMetaKey] == "true" {
+			continue
+		}
+
+		_, services, err := state.NodeServices(nil, node.Node)
+		if err != nil {
+			return err
+		}
+		if services != nil && len(services.Services) > 0 {
+			continue
+		}
+		_, checks, err := state.NodeChecks(nil, node.Node)
+		if err != nil {
+			return err
+		}
+		if len(checks) > 0 {
+			continue
+		}
+
+		// There's a small window where a service could be registered
+		// for this node before the deregister is applied, but a node
+		// that has sat empty this long is very unlikely to see that.
+		s.logger.Printf("[INFO] consul: reaping empty external node '%s'", node.Node)
+		req := structs.DeregisterRequest{
+			Datacenter: s.config.Datacenter,
+			Node:       node.Node,
+		}
+		if _, err := s.raftApply(structs.DeregisterRequestType, &req); err != nil {
+			return err
+		}
+		metrics.IncrCounter([]string{"consul", "leader", "reap_external_node"}, 1)
+	}
+	return nil
+}
+
+// orphanedCheckReapBatch limits how many services' worth of orphaned checks
+// are deregistered in a single pass of the reaper, so a big backlog doesn't
+// flood Raft.
+const orphanedCheckReapBatch = 64
+
+// runOrphanedCheckReaper periodically deregisters checks whose service is no
+// longer registered. This runs until leadership is lost.
+func (s *Server) runOrphanedCheckReaper(stopCh chan struct{}) {
+	ticker := s.clock.NewTicker(s.config.OrphanedCheckReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-s.shutdownCh:
+			return
+		case <-ticker.C():
+		}
+
+		if err := s.reapOrphanedChecks(); err != nil {
+			s.logger.Printf("[ERR] consul: failed to reap orphaned checks: %v", err)
+		}
+	}
+}
+
+// reapOrphanedChecks deregisters checks that are tied to a service which no
+// longer exists on their node. Deregistering the missing service cleans up
+// all of its checks, so we do one Raft apply per service, and only up to
+// orphanedCheckReapBatch of those per pass.
+func (s *Server) reapOrphanedChecks() error {
+	defer metrics.MeasureSince([]string{"consul", "leader", "reapOrphanedChecks"}, time.Now())
+
+	state := s.fsm.State()
+	orphans, err := state.OrphanedChecks()
+	if err != nil {
+		return err
+	}
+
+	// Group the checks by the node and service they belong to.
+	type nodeService struct {
+		node    string
+		service string
+	}
+	var order []nodeService
+	counts := make(map[nodeService]int)
+	for _, check := range orphans {
+		key := nodeService{check.Node, check.ServiceID}
+		if _, ok := counts[key]; !ok {
+			order = append(order, key)
+		}
+		counts[key]++
+	}
+	if len(order) > orphanedCheckReapBatch {
+		order = order[:orphanedCheckReapBatch]
+	}
+
+	for _, key := range order {
+		s.logger.Printf("[INFO] consul: reaping %d orphaned check(s) for missing service '%s' on node '%s'",
+			counts[key], key.service, key.node)
+		req := structs.DeregisterRequest{
+			Datacenter: s.config.Datacenter,
+			Node:       key.node,
+			ServiceID:  key.service,
+		}
+		if _, err := s.raftApply(structs.DeregisterRequestType, &req); err != nil {
+			return err
+		}
+		metrics.IncrCounter([]string{"consul", "leader", "reap_orphaned_checks"}, float32(counts[key]))
+	}
+	return nil
+}
+
+// orphanedLockSweepBatch limits how many orphaned locks are released in a
+// single Raft apply.
+const orphanedLockSweepBatch = 256
+
+// runOrphanedLockSweeper periodically releases keys locked by sessions that
+// no longer exist. This runs until leadership is lost.
+func (s *Server) runOrphanedLockSweeper(stopCh chan struct{}) {
+	ticker := s.clock.NewTicker(s.config.OrphanedLockSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-s.shutdownCh:
+			return
+		case <-ticker.C():
+		}
+
+		if _, _, err := s.sweepOrphanedLocks(s.config.OrphanedLockSweepDryRun); err != nil {
+			s.logger.Printf("[ERR] consul: failed to sweep orphaned locks: %v", err)
+		}
+	}
+}
+
+// sweepOrphanedLocks finds keys locked by sessions that no longer exist and,
+// unless it's a dry run, releases them. This returns the orphaned locks found
+// and how many were released. The FSM checks each lock again before
+// releasing it, so a lock that's changed hands since it was found is left
+// alone.
+func (s *Server) sweepOrphanedLocks(dryRun bool) ([]structs.OrphanedLock, int, error) {
+	defer metrics.MeasureSince([]string{"consul", "leader", "sweepOrphanedLocks"}, time.Now())
+
+	orphans, err := s.fsm.State().KVSOrphanedLocks()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(orphans) == 0 {
+		return nil, 0, nil
+	}
+	metrics.IncrCounter([]string{"consul", "leader", "orphaned_locks", "found"}, float32(len(orphans)))
+
+	if dryRun {
+		for _, lock := range orphans {
+			s.logger.Printf("[INFO] consul: key '%s' is locked by missing session '%s', not releasing it since this is a dry run",
+				lock.Key, lock.Session)
+		}
+		return orphans, 0, nil
+	}
+
+	// Servers that don't know about orphaned locks would keep holding
+	// them, so nothing's released until they've all been upgraded.
+	if !serversSupport(s.LANMembers(), featureOrphanedLockTag) {
+		return orphans, 0, fmt.Errorf("all servers must be upgraded to support releasing orphaned locks, not releasing %d", len(orphans))
+	}
+
+	released := 0
+	for start := 0; start < len(orphans); start += orphanedLockSweepBatch {
+		end := start + orphanedLockSweepBatch
+		if end > len(orphans) {
+			end = len(orphans)
+		}
+		for _, lock := range orphans[start:end] {
+			s.logger.Printf("[INFO] consul: releasing key '%s' locked by missing session '%s'", lock.Key, lock.Session)
+		}
+
+		req := structs.OrphanedLockRequest{
+			Datacenter: s.config.Datacenter,
+			Locks:      orphans[start:end],
+		}
+		resp, err := s.raftApply(structs.OrphanedLockRequestType, &req)
+		if err != nil {
+			return orphans, released, err
+		}
+		if respErr, ok := resp.(error); ok {
+			return orphans, released, respErr
+		}
+		if n, ok := resp.(int); ok {
+			released += n
+			metrics.IncrCounter([]string{"consul", "leader", "orphaned_locks", "released"}, float32(n))
+		}
+	}
+	return orphans, released, nil
+}
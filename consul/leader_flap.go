@@ -0,0 +1,148 @@
+package consul
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/lib"
+)
+
+// leaderFlapDetector keeps track of recent leadership changes so that a
+// cluster whose leader keeps changing can be called out. Each new Raft term
+// counts as a change, since every term starts with an election.
+type leaderFlapDetector struct {
+	clock     lib.Clock
+	threshold int
+	window    time.Duration
+
+	// lastTerm is the most recent term that was observed.
+	lastTerm uint64
+
+	// changes holds the times of the leadership changes within the window.
+	changes []time.Time
+
+	// flapping is true if there were more than threshold changes within
+	// the window as of the last observation.
+	flapping bool
+
+	lock sync.Mutex
+}
+
+// newLeaderFlapDetector returns a leaderFlapDetector that reports flapping
+// when there are more than threshold leadership changes within the window.
+func newLeaderFlapDetector(clock lib.Clock, threshold int, window time.Duration) *leaderFlapDetector {
+	return &leaderFlapDetector{
+		clock:     clock,
+		threshold: threshold,
+		window:    window,
+	}
+}
+
+// observe records the current Raft term and returns whether the leader is
+// flapping, and whether that's changed since the last observation.
+func (d *leaderFlapDetector) observe(term uint64) (flapping bool, changed bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// The first term we see is just where we're starting from.
+	now := d.clock.Now()
+	if d.lastTerm != 0 {
+		for t := d.lastTerm; t < term; t++ {
+			d.changes = append(d.changes, now)
+		}
+	}
+	if term > d.lastTerm {
+		d.lastTerm = term
+	}
+	d.pruneLocked(now)
+
+	flapping = len(d.changes) > d.threshold
+	changed = flapping != d.flapping
+	d.flapping = flapping
+	return flapping, changed
+}
+
+// status returns the number of leadership changes within the window, and
+// whether the leader was flapping as of the last observation.
+func (d *leaderFlapDetector) status() (int, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.pruneLocked(d.clock.Now())
+	return len(d.changes), d.flapping
+}
+
+// pruneLocked drops changes that have aged out of the window. The lock must
+// be held.
+func (d *leaderFlapDetector) pruneLocked(now time.Time) {
+	cutoff := now.Add(-d.window)
+	i := 0
+	for i < len(d.changes) && !d.changes[i].After(cutoff) {
+		i++
+	}
+	d.changes = d.changes[i:]
+}
+
+// leaderFlapLoop watches for leadership changes until the server shuts down.
+func (s *Server) leaderFlapLoop() {
+	ticker := s.newReloadTicker(s.serverHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdownCh:
+			return
+		case <-ticker.Reloaded():
+			ticker.Reset()
+		case <-ticker.C():
+			if err := s.checkLeaderFlaps(); err != nil {
+				s.logger.Printf("[ERR] consul: error checking for leader flapping: %v", err)
+			}
+		}
+	}
+}
+
+// checkLeaderFlaps feeds the current Raft term to the flap detector and acts
+// on any change in whether the leader is flapping.
+func (s *Server) checkLeaderFlaps() error {
+	term, err := strconv.ParseUint(s.raft.Stats()["term"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse Raft term: %v", err)
+	}
+
+	flapping, changed := s.leaderFlaps.observe(term)
+	if flapping {
+		metrics.SetGauge([]string{"consul", "raft", "leader_flapping"}, 1)
+	} else {
+		metrics.SetGauge([]string{"consul", "raft", "leader_flapping"}, 0)
+	}
+	if !changed {
+		return nil
+	}
+
+	count, _ := s.leaderFlaps.status()
+	if flapping {
+		s.logger.Printf("[WARN] consul: leadership has changed %d times in the last %v, the leader is flapping",
+			count, s.config.LeaderFlapWindow)
+		metrics.IncrCounter([]string{"consul", "raft", "leader_flap"}, 1)
+	} else {
+		s.logger.Printf("[INFO] consul: leadership is stable again")
+	}
+	return nil
+}
+
+// leaderFlapWarning returns a cluster health warning if the leader is
+// flapping, or an empty string if not.
+func (s *Server) leaderFlapWarning() string {
+	if s.leaderFlaps == nil {
+		return ""
+	}
+	count, flapping := s.leaderFlaps.status()
+	if !flapping {
+		return ""
+	}
+	return fmt.Sprintf("Leadership has changed %d times in the last %v", count, s.config.LeaderFlapWindow)
+}
@@ -0,0 +1,215 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/lib"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestLeaderFlapDetector(t *testing.T) {
+	clock := lib.NewFakeClock(time.Unix(1000, 0))
+	d := newLeaderFlapDetector(clock, 2, time.Minute)
+
+	// The first term is just a starting point.
+	if flapping, changed := d.observe(5); flapping || changed {
+		t.Fatalf("bad: %v %v", flapping, changed)
+	}
+	if count, _ := d.status(); count != 0 {
+		t.Fatalf("bad: %d", count)
+	}
+
+	// Two changes is at the threshold, which is fine.
+	clock.Advance(time.Second)
+	d.observe(6)
+	clock.Advance(time.Second)
+	if flapping, changed := d.observe(7); flapping || changed {
+		t.Fatalf("bad: %v %v", flapping, changed)
+	}
+
+	// One more puts us over, and it should only be flagged as a change
+	// once.
+	clock.Advance(time.Second)
+	if flapping, changed := d.observe(8); !flapping || !changed {
+		t.Fatalf("bad: %v %v", flapping, changed)
+	}
+	if flapping, changed := d.observe(8); !flapping || changed {
+		t.Fatalf("bad: %v %v", flapping, changed)
+	}
+	if count, flapping := d.status(); count != 3 || !flapping {
+		t.Fatalf("bad: %d %v", count, flapping)
+	}
+
+	// Once the changes age out of the window we're stable again.
+	clock.Advance(time.Minute)
+	if flapping, changed := d.observe(8); flapping || !changed {
+		t.Fatalf("bad: %v %v", flapping, changed)
+	}
+
+	// Jumping several terms at once counts each one.
+	if flapping, _ := d.observe(11); !flapping {
+		t.Fatalf("should be flapping")
+	}
+}
+
+func TestServer_LeaderFlap(t *testing.T) {
+	// Run the servers' timers off a fake clock that's kept moving, so we
+	// can skip ahead to the end of the flap window at the end.
+	clock := lib.NewFakeClock(time.Now())
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	go func() {
+		for {
+			select {
+			case <-doneCh:
+				return
+			case <-time.After(10 * time.Millisecond):
+				clock.Advance(10 * time.Millisecond)
+			}
+		}
+	}()
+
+	conf := func(c *Config) {
+		c.Bootstrap = false
+		c.Clock = clock
+		c.RaftConfig.ProtocolVersion = 3
+		c.ServerHealthInterval = 100 * time.Millisecond
+		c.LeaderFlapThreshold = 1
+		c.LeaderFlapWindow = 2 * time.Minute
+	}
+	var servers []*Server
+	start := func(bootstrap bool) *Server {
+		dir, s := testServerWithConfig(t, func(c *Config) {
+			conf(c)
+			c.Bootstrap = bootstrap
+		})
+		servers = append(servers, s)
+		defer func() {
+			os.RemoveAll(dir)
+		}()
+		return s
+	}
+	defer func() {
+		for _, s := range servers {
+			s.Shutdown()
+		}
+	}()
+	s1 := start(true)
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	s2, s3 := start(false), start(false)
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	join := func(s *Server) {
+		if _, err := s.JoinLAN([]string{addr}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	join(s2)
+	join(s3)
+
+	// Churn the leadership by having the leader leave and replacing it
+	// with a fresh server, twice.
+	live := []*Server{s1, s2, s3}
+	waitForPeers := func() {
+		for _, s := range live {
+			if err := testutil.WaitForResult(func() (bool, error) {
+				peers, _ := s.numPeers()
+				return peers == 3, fmt.Errorf("%d", peers)
+			}); err != nil {
+				t.Fatalf("should have 3 peers: %v", err)
+			}
+		}
+	}
+	var leader *Server
+	findLeader := func() *Server {
+		var found *Server
+		if err := testutil.WaitForResult(func() (bool, error) {
+			for _, s := range live {
+				if s.IsLeader() {
+					found = s
+					return true, nil
+				}
+			}
+			return false, fmt.Errorf("no leader")
+		}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return found
+	}
+	for i := 0; i < 2; i++ {
+		waitForPeers()
+		leader = findLeader()
+		if err := leader.Leave(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		leader.Shutdown()
+
+		var remain []*Server
+		for _, s := range live {
+			if s != leader {
+				remain = append(remain, s)
+			}
+		}
+		live = remain
+		findLeader()
+
+		fresh := start(false)
+		addr = fmt.Sprintf("127.0.0.1:%d",
+			live[0].config.SerfLANConfig.MemberlistConfig.BindPort)
+		join(fresh)
+		live = append(live, fresh)
+	}
+	waitForPeers()
+	leader = findLeader()
+
+	// The leader should have noticed the flapping and raised a warning.
+	codec := rpcClient(t, leader)
+	defer codec.Close()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		arg := structs.DCSpecificRequest{
+			Datacenter: "dc1",
+		}
+		var reply structs.OperatorHealthReply
+		if err := msgpackrpc.CallWithCodec(codec, "Operator.ServerHealth", &arg, &reply); err != nil {
+			return false, err
+		}
+		if len(reply.Warnings) != 1 || !strings.Contains(reply.Warnings[0], "Leadership has changed") {
+			return false, fmt.Errorf("bad: %#v", reply.Warnings)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Let the cluster settle down, since cleaning up the servers that left
+	// can cause a few more elections.
+	waitForPeers()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		term := leader.raft.Stats()["term"]
+		time.Sleep(time.Second)
+		return leader.IsLeader() && leader.raft.Stats()["term"] == term, nil
+	}); err != nil {
+		t.Fatalf("leadership should settle")
+	}
+
+	// Once the window is up, the warning should clear.
+	clock.Advance(2 * time.Minute)
+	if err := testutil.WaitForResult(func() (bool, error) {
+		arg := structs.DCSpecificRequest{
+			Datacenter: "dc1",
+		}
+		var reply structs.OperatorHealthReply
+		if err := msgpackrpc.CallWithCodec(codec, "Operator.ServerHealth", &arg, &reply); err != nil {
+			return false, err
+		}
+		return len(reply.Warnings) == 0, fmt.Errorf("bad: %#v", reply.Warnings)
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
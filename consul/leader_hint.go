@@ -0,0 +1,53 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/raft"
+)
+
+// noteLeader records the given leader address as the last leader this server
+// knew of, if it's set.
+func (s *Server) noteLeader(leader raft.ServerAddress) {
+	if leader == "" {
+		return
+	}
+	s.lastLeaderLock.Lock()
+	s.lastLeader = leader
+	s.lastLeaderLock.Unlock()
+}
+
+// getLastLeader returns the address of the last leader this server knew of.
+func (s *Server) getLastLeader() raft.ServerAddress {
+	s.lastLeaderLock.RLock()
+	defer s.lastLeaderLock.RUnlock()
+	return s.lastLeader
+}
+
+// leaderHint describes what this server knows about the cluster's
+// leadership, for clients to judge whether there's an election going on or
+// the server is cut off from the other servers. This is the NoLeaderError
+// returned when there's no leader to handle a request, and goes into the
+// metadata of query replies.
+func (s *Server) leaderHint() *structs.NoLeaderError {
+	s.noteLeader(s.raft.Leader())
+
+	lastContact := time.Duration(-1)
+	if s.IsLeader() {
+		lastContact = 0
+	} else if contact := s.raft.LastContact(); !contact.IsZero() {
+		lastContact = time.Now().Sub(contact)
+	}
+
+	s.localLock.RLock()
+	alive := len(s.localConsuls)
+	s.localLock.RUnlock()
+
+	return &structs.NoLeaderError{
+		LastLeader:   string(s.getLastLeader()),
+		LastContact:  lastContact,
+		RaftState:    s.raft.State().String(),
+		AliveServers: alive,
+	}
+}
@@ -0,0 +1,90 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/raft"
+)
+
+func TestServer_NoLeaderError(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Bootstrap = false
+		c.RPCHoldTimeout = 10 * time.Millisecond
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s2.RPC, "dc1")
+
+	// A stale read from the follower should say who the leader is.
+	args := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "foo",
+		QueryOptions: structs.QueryOptions{
+			AllowStale: true,
+		},
+	}
+	var out structs.IndexedDirEntries
+	if err := s2.RPC("KVS.Get", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	leader := s1.config.RPCAddr.String()
+	if !out.KnownLeader || out.LastLeader != leader || out.RaftState != "Follower" || out.AliveServers != 2 {
+		t.Fatalf("bad: %#v", out.QueryMeta)
+	}
+
+	// Take the leader away, which leaves the follower without a quorum.
+	s1.Shutdown()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		state := s2.raft.State()
+		return state == raft.Candidate, fmt.Errorf("state is %v", state)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A consistent read should fail with what the follower knows, once it
+	// sees the leader has failed.
+	args.AllowStale = false
+	var hint *structs.NoLeaderError
+	if err := testutil.WaitForResult(func() (bool, error) {
+		var out structs.IndexedDirEntries
+		err := s2.RPC("KVS.Get", &args, &out)
+		if !structs.IsErrNoLeader(err) {
+			return false, fmt.Errorf("bad: %v", err)
+		}
+		var ok bool
+		if hint, ok = structs.ParseNoLeaderError(err); !ok {
+			return false, fmt.Errorf("bad: %v", err)
+		}
+		return hint.AliveServers == 1, fmt.Errorf("bad: %#v", hint)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if hint.LastLeader != leader || hint.RaftState != "Candidate" || hint.LastContact <= 0 {
+		t.Fatalf("bad: %#v", hint)
+	}
+
+	// A stale read should still work, and carry the same details.
+	args.AllowStale = true
+	if err := s2.RPC("KVS.Get", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.KnownLeader || out.LastLeader != leader || out.RaftState != "Candidate" || out.AliveServers != 1 {
+		t.Fatalf("bad: %#v", out.QueryMeta)
+	}
+}
@@ -0,0 +1,78 @@
+package consul
+
+import (
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/serf/serf"
+)
+
+// reconcileHoldoff tracks the destructive reconcile actions a new leader is
+// holding off on. Right after an election the new leader's view of Serf can
+// lag behind, so for a while it only registers nodes and marks them alive,
+// and saves anything else until its view has had a chance to settle. This is
+// only touched by the leader loop.
+type reconcileHoldoff struct {
+	// active is true while destructive actions are being deferred.
+	active bool
+
+	// deferred has the latest member that was deferred for each node.
+	deferred map[string]serf.Member
+}
+
+// startReconcileHoldoff starts deferring destructive reconcile actions.
+func (s *Server) startReconcileHoldoff() {
+	s.logger.Printf("[INFO] consul: Deferring deregistrations and failed members for %s after gaining leadership",
+		s.config.LeaderReconcileHoldoff)
+	s.reconcileHoldoff = reconcileHoldoff{
+		active:   true,
+		deferred: make(map[string]serf.Member),
+	}
+}
+
+// deferReconcile returns true if the given member shouldn't be reconciled
+// yet, and saves it for when the holdoff is over. Alive members are always
+// handled, and replace anything that was deferred for the node.
+func (s *Server) deferReconcile(member serf.Member) bool {
+	if !s.reconcileHoldoff.active {
+		return false
+	}
+	if member.Status == serf.StatusAlive {
+		delete(s.reconcileHoldoff.deferred, member.Name)
+		return false
+	}
+
+	s.logger.Printf("[DEBUG] consul: Deferring reconcile of member '%s' (%s) during leader holdoff",
+		member.Name, member.Status)
+	metrics.IncrCounter([]string{"consul", "leader", "reconcile_holdoff", "deferred"}, 1)
+	s.reconcileHoldoff.deferred[member.Name] = member
+	return true
+}
+
+// endReconcileHoldoff stops deferring destructive reconcile actions, and
+// handles the ones that were deferred. Each one is checked against the
+// current Serf membership first, so members that turned out to be alive are
+// left alone, and ones Serf has since reaped get deregistered.
+func (s *Server) endReconcileHoldoff() {
+	deferred := s.reconcileHoldoff.deferred
+	s.reconcileHoldoff = reconcileHoldoff{}
+	if len(deferred) == 0 {
+		return
+	}
+
+	current := make(map[string]serf.Member)
+	for _, member := range s.serfLAN.Members() {
+		current[member.Name] = member
+	}
+
+	s.logger.Printf("[INFO] consul: Leader holdoff is over, reconciling %d deferred member(s)", len(deferred))
+	for name, member := range deferred {
+		if m, ok := current[name]; ok {
+			member = m
+		} else {
+			member.Status = StatusReap
+		}
+		if member.Status == serf.StatusAlive {
+			metrics.IncrCounter([]string{"consul", "leader", "reconcile_holdoff", "recovered"}, 1)
+		}
+		s.reconcileMember(member)
+	}
+}
@@ -3,13 +3,16 @@ package consul
 import (
 	"errors"
 	"fmt"
+	"net"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/testutil"
 	"github.com/hashicorp/net-rpc-msgpackrpc"
+	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
 )
 
@@ -311,6 +314,98 @@ func TestLeader_Reconcile_ReapMember(t *testing.T) {
 	}
 }
 
+func TestLeader_ReconcileHoldoff(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.LeaderReconcileHoldoff = 2 * time.Second
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Join a client, which should get registered during the holdoff.
+	dir2, c1 := testClient(t)
+	defer os.RemoveAll(dir2)
+	defer c1.Shutdown()
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := c1.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	state := s1.fsm.State()
+	serfStatus := func(node string) string {
+		_, checks, err := state.NodeChecks(nil, node)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		for _, check := range checks {
+			if check.CheckID == SerfCheckID {
+				return check.Status
+			}
+		}
+		return ""
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return serfStatus(c1.config.NodeName) == structs.HealthPassing, nil
+	}); err != nil {
+		t.Fatal("client should be registered")
+	}
+
+	// Register a node that isn't around anymore.
+	dead := structs.RegisterRequest{
+		Datacenter: s1.config.Datacenter,
+		Node:       "no-longer-around",
+		Address:    "127.1.1.1",
+		Check: &structs.HealthCheck{
+			Node:    "no-longer-around",
+			CheckID: SerfCheckID,
+			Name:    SerfCheckName,
+			Status:  structs.HealthPassing,
+		},
+	}
+	var out struct{}
+	if err := s1.RPC("Catalog.Register", &dead, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Send a stale failed event for the client, and a reap for the dead
+	// node. Neither should be acted on yet.
+	var c1mem serf.Member
+	for _, m := range s1.LANMembers() {
+		if m.Name == c1.config.NodeName {
+			c1mem = m
+			c1mem.Status = serf.StatusFailed
+		}
+	}
+	s1.reconcileCh <- c1mem
+	s1.reconcileCh <- serf.Member{
+		Name:   "no-longer-around",
+		Addr:   net.ParseIP("127.1.1.1"),
+		Tags:   map[string]string{"dc": "dc1", "role": "node"},
+		Status: StatusReap,
+	}
+	time.Sleep(200 * time.Millisecond)
+	if status := serfStatus(c1.config.NodeName); status != structs.HealthPassing {
+		t.Fatalf("bad: %s", status)
+	}
+	if status := serfStatus("no-longer-around"); status != structs.HealthPassing {
+		t.Fatalf("bad: %s", status)
+	}
+
+	// Once the holdoff is over the dead node should get deregistered, but
+	// the client is alive so it should be left alone.
+	if err := testutil.WaitForResult(func() (bool, error) {
+		_, node, err := state.GetNode("no-longer-around")
+		return node == nil, err
+	}); err != nil {
+		t.Fatal("node should be deregistered")
+	}
+	if status := serfStatus(c1.config.NodeName); status != structs.HealthPassing {
+		t.Fatalf("bad: %s", status)
+	}
+}
+
 func TestLeader_Reconcile(t *testing.T) {
 	dir1, s1 := testServerWithConfig(t, func(c *Config) {
 		c.ACLDatacenter = "dc1"
@@ -354,6 +449,79 @@ func TestLeader_Reconcile(t *testing.T) {
 	}
 }
 
+func TestLeader_Reconcile_NodeBlock(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, c1 := testClient(t)
+	defer os.RemoveAll(dir2)
+	defer c1.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := c1.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	state := s1.fsm.State()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		_, node, err := state.GetNode(c1.config.NodeName)
+		return node != nil, err
+	}); err != nil {
+		t.Fatal("client not registered")
+	}
+
+	// Deregister the client with a block while it's still alive.
+	arg := structs.DeregisterRequest{
+		Datacenter: "dc1",
+		Node:       c1.config.NodeName,
+		Block:      true,
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Deregister", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Reconciling shouldn't put it back.
+	if err := s1.reconcile(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, node, err := state.GetNode(c1.config.NodeName)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node != nil {
+		t.Fatalf("client should not be registered: %#v", node)
+	}
+
+	// Once the block is cleared it should come back.
+	req := structs.NodeBlockRequest{
+		Datacenter: "dc1",
+		Op:         structs.NodeBlockClear,
+		Block: structs.NodeBlock{
+			Node: c1.config.NodeName,
+		},
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.NodeBlockApply", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.reconcile(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, node, err = state.GetNode(c1.config.NodeName)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node == nil {
+		t.Fatalf("client should be registered")
+	}
+}
+
 func TestLeader_Reconcile_Races(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -1011,3 +1179,473 @@ func TestLeader_ChangeServerID(t *testing.T) {
 		}
 	}
 }
+
+func TestLeader_ReapExternalNodes(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ExternalNodeReapInterval = 50 * time.Millisecond
+		c.ExternalNodeReapAge = 200 * time.Millisecond
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register an empty node, an empty node that's flagged to not be
+	// reaped, and a node with a service.
+	reqs := []structs.RegisterRequest{
+		{
+			Datacenter: "dc1",
+			Node:       "empty",
+			Address:    "127.0.0.1",
+		},
+		{
+			Datacenter: "dc1",
+			Node:       "flagged",
+			Address:    "127.0.0.2",
+			NodeMeta: map[string]string{
+				ExternalNodeMetaKey: "true",
+				NoReapMetaKey:       "true",
+			},
+		},
+		{
+			Datacenter: "dc1",
+			Node:       "busy",
+			Address:    "127.0.0.3",
+			Service: &structs.NodeService{
+				ID:      "db",
+				Service: "db",
+			},
+		},
+	}
+	for _, req := range reqs {
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &req, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The empty node should get reaped once it's old enough.
+	state := s1.fsm.State()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		_, node, err := state.GetNode("empty")
+		return node == nil, err
+	}); err != nil {
+		t.Fatalf("node not reaped: %v", err)
+	}
+
+	// The rest, including the server which is a Serf member, should
+	// still be around.
+	for _, name := range []string{"flagged", "busy", s1.config.NodeName} {
+		_, node, err := state.GetNode(name)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if node == nil {
+			t.Fatalf("node %q should not have been reaped", name)
+		}
+	}
+}
+
+func TestLeader_ReapExternalNodes_Age(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ExternalNodeReapInterval = 10 * time.Millisecond
+		c.ExternalNodeReapAge = time.Hour
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register an empty node and make sure it's left alone since it's
+	// not old enough.
+	req := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "empty",
+		Address:    "127.0.0.1",
+	}
+	var out struct{}
+	if err := s1.RPC("Catalog.Register", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, node, err := s1.fsm.State().GetNode("empty")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node == nil {
+		t.Fatalf("node should not have been reaped")
+	}
+}
+
+func TestLeader_IndexHistory(t *testing.T) {
+	var h indexHistory
+	start := time.Now()
+	age := 3 * time.Second
+	at := func(secs int) time.Time {
+		return start.Add(time.Duration(secs) * time.Second)
+	}
+
+	// Nothing is old enough until the history goes back far enough.
+	if _, ok := h.indexAtAge(start, age); ok {
+		t.Fatalf("should not have an index")
+	}
+	for i := 0; i < 3; i++ {
+		h.add(at(i), uint64(10+i), age)
+		if _, ok := h.indexAtAge(at(i), age); ok {
+			t.Fatalf("should not have an index")
+		}
+	}
+
+	// After that we should get the newest index that's old enough, and
+	// only keep the checkpoints we still need.
+	for i := 3; i < 6; i++ {
+		h.add(at(i), uint64(10+i), age)
+		index, ok := h.indexAtAge(at(i), age)
+		if !ok || index != uint64(10+i-3) {
+			t.Fatalf("bad: %d %v", index, ok)
+		}
+		if len(h.checkpoints) != 4 {
+			t.Fatalf("bad: %v", h.checkpoints)
+		}
+	}
+}
+
+func TestLeader_ReapOrphanedChecks_LeavesLiveChecks(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.OrphanedCheckReapInterval = 10 * time.Millisecond
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register a service with a check, which isn't an orphan and should
+	// be left alone by the reaper.
+	req := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "web1",
+			Service: "web",
+		},
+		Check: &structs.HealthCheck{
+			CheckID:   "web1-check",
+			Name:      "web check",
+			ServiceID: "web1",
+		},
+	}
+	var out struct{}
+	if err := s1.RPC("Catalog.Register", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := s1.reapOrphanedChecks(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, checks, err := s1.fsm.State().NodeChecks(nil, "foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(checks) != 1 || checks[0].CheckID != "web1-check" {
+		t.Fatalf("bad: %#v", checks)
+	}
+}
+
+func TestLeader_SweepOrphanedLocks(t *testing.T) {
+	for _, dryRun := range []bool{true, false} {
+		dir1, s1 := testServerWithConfig(t, func(c *Config) {
+			c.OrphanedLockSweepInterval = 10 * time.Millisecond
+			c.OrphanedLockSweepDryRun = dryRun
+		})
+		defer os.RemoveAll(dir1)
+		defer s1.Shutdown()
+
+		testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+		// Make a key that's locked by a session that doesn't exist.
+		state := s1.fsm.State()
+		idx, _, err := state.KVSList(nil, "")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		session := generateUUID()
+		restore := state.Restore()
+		if err := restore.KVS(&structs.DirEntry{
+			Key:       "locked",
+			Session:   session,
+			RaftIndex: structs.RaftIndex{CreateIndex: idx + 1, ModifyIndex: idx + 1},
+		}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		restore.Commit()
+
+		if dryRun {
+			time.Sleep(100 * time.Millisecond)
+			_, e, err := state.KVSGet(nil, "locked")
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if e.Session != session {
+				t.Fatalf("lock should not be released: %#v", e)
+			}
+			continue
+		}
+
+		if err := testutil.WaitForResult(func() (bool, error) {
+			_, e, err := state.KVSGet(nil, "locked")
+			if err != nil {
+				return false, err
+			}
+			return e.Session == "", fmt.Errorf("lock not released: %#v", e)
+		}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func TestLeader_MemberUpdate_AddressChange(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		// Keep the periodic reconcile from reaping our fake member.
+		c.ReconcileInterval = time.Hour
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Simulate a client joining.
+	member := serf.Member{
+		Name:   "fake",
+		Addr:   net.ParseIP("127.0.0.10"),
+		Tags:   map[string]string{"role": "node", "dc": "dc1"},
+		Status: serf.StatusAlive,
+	}
+	s1.eventChLAN <- serf.MemberEvent{
+		Type:    serf.EventMemberJoin,
+		Members: []serf.Member{member},
+	}
+	state := s1.fsm.State()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		_, node, err := state.GetNode("fake")
+		return node != nil, err
+	}); err != nil {
+		t.Fatalf("client not registered: %v", err)
+	}
+
+	// Give the node a service and some extra node info.
+	arg := structs.RegisterRequest{
+		Datacenter:      "dc1",
+		Node:            "fake",
+		Address:         "127.0.0.10",
+		TaggedAddresses: map[string]string{"lan": "127.0.0.10", "wan": "198.18.0.1"},
+		NodeMeta:        map[string]string{"somekey": "somevalue"},
+		Service: &structs.NodeService{
+			ID:      "db",
+			Service: "db",
+			Port:    8000,
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A tag change that doesn't affect addressing shouldn't do anything.
+	index := s1.raft.LastIndex()
+	member.Tags["build"] = "0.8.0"
+	s1.eventChLAN <- serf.MemberEvent{
+		Type:    serf.EventMemberUpdate,
+		Members: []serf.Member{member},
+	}
+	time.Sleep(100 * time.Millisecond)
+	if after := s1.raft.LastIndex(); after != index {
+		t.Fatalf("bad: %d != %d", after, index)
+	}
+
+	// Now change the address.
+	member.Addr = net.ParseIP("127.0.0.20")
+	s1.eventChLAN <- serf.MemberEvent{
+		Type:    serf.EventMemberUpdate,
+		Members: []serf.Member{member},
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		_, node, err := state.GetNode("fake")
+		if err != nil {
+			return false, err
+		}
+		return node.Address == "127.0.0.20", fmt.Errorf("bad: %v", node)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if after := s1.raft.LastIndex(); after != index+1 {
+		t.Fatalf("bad: %d != %d", after, index+1)
+	}
+
+	// Make sure the rest of the node info, the service, and the check
+	// are all still there.
+	_, node, err := state.GetNode("fake")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node.TaggedAddresses["lan"] != "127.0.0.20" ||
+		node.TaggedAddresses["wan"] != "198.18.0.1" ||
+		node.Meta["somekey"] != "somevalue" {
+		t.Fatalf("bad: %v", node)
+	}
+	_, services, err := state.NodeServices(nil, "fake")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if services == nil || services.Services["db"] == nil {
+		t.Fatalf("bad: %v", services)
+	}
+	_, checks, err := state.NodeChecks(nil, "fake")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(checks) != 1 || checks[0].CheckID != SerfCheckID || checks[0].Status != structs.HealthPassing {
+		t.Fatalf("bad: %v", checks)
+	}
+}
+
+func TestLeader_NonVoter(t *testing.T) {
+	// Non-voters can't be used to bootstrap.
+	dir, config := testServerConfig(t, "bad")
+	defer os.RemoveAll(dir)
+	config.NonVoter = true
+	config.Bootstrap = false
+	config.BootstrapExpect = 3
+	if _, err := NewServer(config); err == nil || !strings.Contains(err.Error(), "non-voting") {
+		t.Fatalf("err: %v", err)
+	}
+
+	conf := func(c *Config) {
+		c.Datacenter = "dc1"
+		c.Bootstrap = false
+		c.BootstrapExpect = 3
+		c.RaftConfig.ProtocolVersion = 3
+	}
+	dir1, s1 := testServerWithConfig(t, conf)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerWithConfig(t, conf)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	dir3, s3 := testServerWithConfig(t, conf)
+	defer os.RemoveAll(dir3)
+	defer s3.Shutdown()
+
+	dir4, s4 := testServerWithConfig(t, func(c *Config) {
+		c.Datacenter = "dc1"
+		c.Bootstrap = false
+		c.NonVoter = true
+		c.RaftConfig.ProtocolVersion = 3
+	})
+	defer os.RemoveAll(dir4)
+	defer s4.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	for _, s := range []*Server{s2, s3, s4} {
+		if _, err := s.JoinLAN([]string{addr}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The non-voter should get added, but only the voters are counted.
+	suffrage := func() (map[raft.ServerID]raft.ServerSuffrage, error) {
+		future := s1.raft.GetConfiguration()
+		if err := future.Error(); err != nil {
+			return nil, err
+		}
+		servers := make(map[raft.ServerID]raft.ServerSuffrage)
+		for _, server := range future.Configuration().Servers {
+			servers[server.ID] = server.Suffrage
+		}
+		return servers, nil
+	}
+	nonVoterID := raft.ServerID(s4.config.NodeID)
+	if err := testutil.WaitForResult(func() (bool, error) {
+		servers, err := suffrage()
+		if err != nil {
+			return false, err
+		}
+		return len(servers) == 4 && servers[nonVoterID] == raft.Nonvoter, fmt.Errorf("bad: %v", servers)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*Server{s1, s2, s3, s4} {
+		if err := testutil.WaitForResult(func() (bool, error) {
+			peers, _ := s.numPeers()
+			return peers == 3, fmt.Errorf("%d peers", peers)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Give autopilot a chance to promote it, which it shouldn't.
+	time.Sleep(10 * s1.config.AutopilotInterval)
+	servers, err := suffrage()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if servers[nonVoterID] != raft.Nonvoter {
+		t.Fatalf("bad: %v", servers)
+	}
+	if s4.IsLeader() {
+		t.Fatalf("non-voter should not be the leader")
+	}
+
+	// Stale reads should be served by the non-voter.
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	reg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+	}
+	var out struct{}
+	if err := s1.RPC("Catalog.Register", &reg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	codec := rpcClient(t, s4)
+	defer codec.Close()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		args := structs.DCSpecificRequest{
+			Datacenter:   "dc1",
+			QueryOptions: structs.QueryOptions{AllowStale: true},
+		}
+		var nodes structs.IndexedNodes
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &args, &nodes); err != nil {
+			return false, err
+		}
+		for _, node := range nodes.Nodes {
+			if node.Node == "foo" {
+				return nodes.KnownLeader, nil
+			}
+		}
+		return false, fmt.Errorf("bad: %v", nodes.Nodes)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed non-voter gets cleaned up, since it doesn't affect the
+	// quorum.
+	s4.Shutdown()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		servers, err := suffrage()
+		if err != nil {
+			return false, err
+		}
+		_, ok := servers[nonVoterID]
+		return len(servers) == 3 && !ok, fmt.Errorf("bad: %v", servers)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,135 @@
+package consul
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// leaderTransferTimeout is how long we wait for the other servers to
+	// elect a new leader after we've stepped down.
+	leaderTransferTimeout = 30 * time.Second
+
+	// leaderTransferPollInterval is how often we check for the new leader.
+	leaderTransferPollInterval = 10 * time.Millisecond
+)
+
+// transferLeadership steps down so another healthy voter takes over, without
+// waiting for the followers to notice we're gone. This must be run on the
+// leader.
+//
+// Raft can't hand leadership to a particular server, so we demote ourselves,
+// which makes us step down once the change commits. The other voters still
+// make up the whole quorum, and Raft only lets one with all of the committed
+// log win, so there's no need to pick a successor. An operator intent recorded first has
+// the new leader promote us straight back, so we rejoin as a voter without
+// waiting for autopilot and without another election.
+func (s *Server) transferLeadership() (*structs.TransferLeaderReply, error) {
+	defer metrics.MeasureSince([]string{"consul", "leader", "transferLeadership"}, time.Now())
+
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	ourID := raft.ServerID(s.config.NodeID)
+	ourAddr := s.raft.Leader()
+	if err := checkLeaderTransfer(future.Configuration().Servers,
+		s.getClusterHealth().Servers, ourID); err != nil {
+		return nil, err
+	}
+
+	intent, err := s.createOperatorIntent(structs.OperatorIntent{
+		Kind:     structs.OperatorIntentLeaderTransfer,
+		Target:   s.config.NodeName,
+		ServerID: string(ourID),
+		Address:  string(ourAddr),
+		Reason:   "leadership transferred",
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Printf("[INFO] consul: Stepping down to transfer leadership")
+	if err := s.raft.DemoteVoter(ourID, 0, 0).Error(); err != nil {
+		// If we're still the leader this puts things back, otherwise
+		// the new leader will run the intent.
+		if err := s.runOperatorIntent(intent); err != nil {
+			s.logger.Printf("[ERR] consul: %v", err)
+		}
+		return nil, fmt.Errorf("failed to step down: %v", err)
+	}
+
+	// Wait for the other servers to elect a new leader.
+	ticker := s.clock.NewTicker(leaderTransferPollInterval)
+	defer ticker.Stop()
+	timeout := s.clock.After(leaderTransferTimeout)
+	for {
+		select {
+		case <-ticker.C():
+		case <-timeout:
+			return nil, fmt.Errorf("timed out waiting for a new leader")
+		case <-s.shutdownCh:
+			return nil, fmt.Errorf("server shutting down")
+		}
+
+		leader := s.raft.Leader()
+		if leader == "" || leader == ourAddr {
+			continue
+		}
+
+		reply := &structs.TransferLeaderReply{Address: leader}
+		future := s.raft.GetConfiguration()
+		if err := future.Error(); err != nil {
+			return nil, err
+		}
+		for _, server := range future.Configuration().Servers {
+			if server.Address == leader {
+				reply.ID = server.ID
+			}
+		}
+		reply.Node = s.serverName(reply.ID, leader)
+		s.logger.Printf("[INFO] consul: Transferred leadership to %s (%s)", reply.ID, leader)
+		metrics.IncrCounter([]string{"consul", "leader", "transferred"}, 1)
+		return reply, nil
+	}
+}
+
+// checkLeaderTransfer returns an error if the leader shouldn't step down,
+// which is when there aren't at least two healthy voters, counting the
+// leader, or when the other voters don't have enough healthy ones between
+// them to make up a quorum once the leader's gone, since they couldn't elect
+// a new leader.
+func checkLeaderTransfer(servers []raft.Server, health []structs.ServerHealth, leader raft.ServerID) error {
+	healthy := make(map[raft.ServerID]bool)
+	for _, h := range health {
+		if h.Healthy {
+			healthy[raft.ServerID(h.ID)] = true
+		}
+	}
+
+	var voters, healthyVoters, healthyOthers int
+	for _, server := range servers {
+		if !isVoter(server.Suffrage) {
+			continue
+		}
+		voters++
+		if !healthy[server.ID] {
+			continue
+		}
+		healthyVoters++
+		if server.ID != leader {
+			healthyOthers++
+		}
+	}
+	if healthyVoters < 2 {
+		return fmt.Errorf("need at least 2 healthy voters to transfer leadership, have %d", healthyVoters)
+	}
+	if remaining := voters - 1; healthyOthers < remaining/2+1 {
+		return fmt.Errorf("only %d of the %d other voters are healthy, which isn't enough to elect a new leader",
+			healthyOthers, remaining)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+	"github.com/hashicorp/raft"
+)
+
+// raftTerm returns the current Raft term of the given server.
+func raftTerm(t *testing.T, s *Server) uint64 {
+	term, err := strconv.ParseUint(s.raft.Stats()["term"], 10, 64)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return term
+}
+
+func TestOperator_TransferLeader(t *testing.T) {
+	conf := func(c *Config) {
+		c.Datacenter = "dc1"
+		c.RaftConfig.ProtocolVersion = 3
+		c.JoinAsVoter = true
+		c.ServerHealthInterval = 100 * time.Millisecond
+		c.AutopilotConfig.CleanupDeadServers = false
+		c.AutopilotConfig.ServerStabilizationTime = time.Hour
+	}
+	dir1, s1 := testServerWithConfig(t, conf)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	var servers []*Server
+	for i := 0; i < 2; i++ {
+		dir, s := testServerWithConfig(t, func(c *Config) {
+			conf(c)
+			c.Bootstrap = false
+		})
+		defer os.RemoveAll(dir)
+		defer s.Shutdown()
+		servers = append(servers, s)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	for _, s := range servers {
+		if _, err := s.JoinLAN([]string{addr}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	servers = append([]*Server{s1}, servers...)
+	if err := testutil.WaitForResult(func() (bool, error) {
+		health := s1.getClusterHealth()
+		return health.Healthy && len(health.Servers) == 3, fmt.Errorf("bad: %#v", health)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ask a follower, which should forward to the leader.
+	term := raftTerm(t, s1)
+	codec := rpcClient(t, servers[2])
+	defer codec.Close()
+	arg := structs.TransferLeaderRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.TransferLeaderReply
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.TransferLeader", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.ID == raft.ServerID(s1.config.NodeID) || reply.Address == "" {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	var leader *Server
+	for _, s := range servers {
+		if raft.ServerID(s.config.NodeID) == reply.ID {
+			leader = s
+		}
+	}
+	if leader == nil {
+		t.Fatalf("bad: %#v", reply)
+	}
+	if reply.Node != leader.config.NodeName {
+		t.Fatalf("bad: %#v", reply)
+	}
+	newTerm := raftTerm(t, leader)
+	if newTerm <= term {
+		t.Fatalf("bad: term %d, was %d", newTerm, term)
+	}
+
+	// The old leader should be promoted back, and stay a healthy follower.
+	if err := testutil.WaitForResult(func() (bool, error) {
+		if !leader.IsLeader() {
+			return false, fmt.Errorf("%s isn't the leader", leader.config.NodeName)
+		}
+		future := leader.raft.GetConfiguration()
+		if err := future.Error(); err != nil {
+			return false, err
+		}
+		for _, server := range future.Configuration().Servers {
+			if server.Suffrage != raft.Voter {
+				return false, fmt.Errorf("bad: %v", future.Configuration().Servers)
+			}
+		}
+		_, intents, err := leader.fsm.State().OperatorIntentList(nil)
+		if err != nil {
+			return false, err
+		}
+		if len(intents) != 0 {
+			return false, fmt.Errorf("bad: %v", intents)
+		}
+		health := leader.getServerHealth(string(s1.config.NodeID))
+		if health == nil || !health.Healthy || !health.Voter {
+			return false, fmt.Errorf("bad: %#v", health)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if s1.IsLeader() || s1.raft.State() != raft.Follower {
+		t.Fatalf("old leader is %v", s1.raft.State())
+	}
+
+}
+
+func TestOperator_TransferLeader_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+		c.RaftConfig.ProtocolVersion = 3
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Make a request with no token to make sure it gets denied.
+	arg := structs.TransferLeaderRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.TransferLeaderReply
+	err := msgpackrpc.CallWithCodec(codec, "Operator.TransferLeader", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// With the master token it should get as far as seeing there's no one
+	// to hand over to.
+	arg.Token = "root"
+	err = msgpackrpc.CallWithCodec(codec, "Operator.TransferLeader", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), "at least 2 healthy voters") {
+		t.Fatalf("err: %v", err)
+	}
+	if !s1.IsLeader() {
+		t.Fatalf("should still be leader")
+	}
+}
+
+func TestCheckLeaderTransfer(t *testing.T) {
+	servers := []raft.Server{
+		{ID: "a", Suffrage: raft.Voter},
+		{ID: "b", Suffrage: raft.Voter},
+		{ID: "c", Suffrage: raft.Voter},
+		{ID: "d", Suffrage: raft.Nonvoter},
+	}
+	health := []structs.ServerHealth{
+		{ID: "a", Healthy: true},
+		{ID: "b", Healthy: true},
+		{ID: "c", Healthy: true},
+		{ID: "d", Healthy: true},
+	}
+	if err := checkLeaderTransfer(servers, health, "a"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// With one of the other two voters unhealthy, they couldn't elect a
+	// new leader. The healthy non-voter doesn't count.
+	health[2].Healthy = false
+	if err := checkLeaderTransfer(servers, health, "a"); err == nil ||
+		!strings.Contains(err.Error(), "only 1 of the 2") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Without another healthy voter, it should refuse.
+	health[1].Healthy = false
+	if err := checkLeaderTransfer(servers, health, "a"); err == nil ||
+		!strings.Contains(err.Error(), "at least 2 healthy voters") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// With five voters, the other four need three healthy ones between
+	// them to elect a new leader.
+	servers = append(servers,
+		raft.Server{ID: "e", Suffrage: raft.Voter},
+		raft.Server{ID: "f", Suffrage: raft.Voter})
+	health = append(health,
+		structs.ServerHealth{ID: "e", Healthy: true},
+		structs.ServerHealth{ID: "f", Healthy: true})
+	if err := checkLeaderTransfer(servers, health, "a"); err == nil ||
+		!strings.Contains(err.Error(), "only 2 of the 4") {
+		t.Fatalf("err: %v", err)
+	}
+	health[1].Healthy = true
+	if err := checkLeaderTransfer(servers, health, "a"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package consul
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/lib"
+)
+
+// logDeduper keeps repeated log lines from drowning out everything else. The
+// first line logged under a given key is written right away, and any more
+// under the same key within the window are counted and then summarized in a
+// single line once the window is up. This is used on the RPC paths, which
+// can log the same error thousands of times during a leader outage.
+type logDeduper struct {
+	logger *log.Logger
+	clock  lib.Clock
+
+	// window is how long to hold back repeats of a line. Deduplication is
+	// disabled if this is zero.
+	window time.Duration
+
+	// exempt holds patterns for lines that should always be logged.
+	exempt []*regexp.Regexp
+
+	// pending tracks the lines that have been logged in the current window,
+	// by key.
+	pending map[string]*dedupedLine
+
+	// suppressed is the total number of lines that have been held back.
+	suppressed uint64
+
+	lock sync.Mutex
+}
+
+// dedupedLine tracks repeats of a line within a window.
+type dedupedLine struct {
+	// msg is the most recent message logged under the key.
+	msg string
+
+	// count is the number of repeats that have been held back.
+	count int
+}
+
+// newLogDeduper returns a logDeduper that writes to the given logger. An
+// error is returned if any of the exempt patterns are invalid.
+func newLogDeduper(logger *log.Logger, clock lib.Clock, window time.Duration, exempt []string) (*logDeduper, error) {
+	d := &logDeduper{
+		logger:  logger,
+		clock:   clock,
+		window:  window,
+		pending: make(map[string]*dedupedLine),
+	}
+	for _, pattern := range exempt {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid log dedup exempt pattern %q: %v", pattern, err)
+		}
+		d.exempt = append(d.exempt, re)
+	}
+	return d, nil
+}
+
+// Printf logs a line, unless one with the same key has already been logged
+// in the current window. The key should identify the message without the
+// details that vary from one occurrence to the next, like request IDs or
+// client addresses.
+func (d *logDeduper) Printf(key string, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if d.window <= 0 || d.isExempt(msg) {
+		d.logger.Print(msg)
+		return
+	}
+
+	d.lock.Lock()
+	if line, ok := d.pending[key]; ok {
+		line.msg = msg
+		line.count++
+		d.suppressed++
+		d.lock.Unlock()
+		metrics.IncrCounter([]string{"consul", "rpc", "log", "suppressed"}, 1)
+		return
+	}
+	d.pending[key] = &dedupedLine{msg: msg}
+	d.lock.Unlock()
+
+	d.logger.Print(msg)
+	d.clock.AfterFunc(d.window, func() {
+		d.flush(key)
+	})
+}
+
+// Suppressed returns the total number of lines that have been held back.
+func (d *logDeduper) Suppressed() uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.suppressed
+}
+
+// isExempt returns true if the message matches any of the exempt patterns.
+func (d *logDeduper) isExempt(msg string) bool {
+	for _, re := range d.exempt {
+		if re.MatchString(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// flush ends the window for the given key, and logs a summary of any repeats
+// that were held back.
+func (d *logDeduper) flush(key string) {
+	d.lock.Lock()
+	line := d.pending[key]
+	delete(d.pending, key)
+	d.lock.Unlock()
+
+	if line != nil && line.count > 0 {
+		d.logger.Printf("%s (x%d in last %v)", line.msg, line.count, d.window)
+	}
+}
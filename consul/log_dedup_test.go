@@ -0,0 +1,191 @@
+package consul
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/lib"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestLogDeduper(t *testing.T) {
+	var buf bytes.Buffer
+	clock := lib.NewFakeClock(time.Now())
+	d, err := newLogDeduper(log.New(&buf, "", 0), clock, 10*time.Second, []string{"^always"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	lines := func() []string {
+		return strings.Split(strings.TrimSpace(buf.String()), "\n")
+	}
+
+	// Only the first of a run of repeats should be logged.
+	for i := 0; i < 100; i++ {
+		d.Printf("foo", "foo %d", i)
+	}
+	d.Printf("bar", "bar")
+	if got := lines(); len(got) != 2 || got[0] != "foo 0" || got[1] != "bar" {
+		t.Fatalf("bad: %#v", got)
+	}
+	if n := d.Suppressed(); n != 99 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	// Exempt lines always go through.
+	for i := 0; i < 3; i++ {
+		d.Printf("always", "always %d", i)
+	}
+	if got := lines(); len(got) != 5 {
+		t.Fatalf("bad: %#v", got)
+	}
+
+	// Closing out the window should summarize the repeats, but not say
+	// anything about lines that weren't repeated.
+	clock.Advance(10 * time.Second)
+	got := lines()
+	if len(got) != 6 || got[5] != "foo 99 (x99 in last 10s)" {
+		t.Fatalf("bad: %#v", got)
+	}
+
+	// The next one starts a new window.
+	d.Printf("foo", "foo again")
+	if got := lines(); len(got) != 7 || got[6] != "foo again" {
+		t.Fatalf("bad: %#v", got)
+	}
+	if n := d.Suppressed(); n != 99 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestLogDeduper_TimersPaused(t *testing.T) {
+	clock := lib.NewFakeClock(time.Now())
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Clock = clock
+		c.RPCLogDedupWindow = 10 * time.Second
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	// Repeats should still be summarized at the end of the window while
+	// the server's timers are paused.
+	s1.clock.Pause()
+	defer s1.clock.Resume()
+	s1.rpcLogger.Printf("foo", "foo")
+	s1.rpcLogger.Printf("foo", "foo")
+	clock.Advance(10 * time.Second)
+
+	s1.rpcLogger.lock.Lock()
+	defer s1.rpcLogger.lock.Unlock()
+	if len(s1.rpcLogger.pending) != 0 {
+		t.Fatalf("bad: %#v", s1.rpcLogger.pending)
+	}
+}
+
+func TestLogDeduper_Disabled(t *testing.T) {
+	var buf bytes.Buffer
+	d, err := newLogDeduper(log.New(&buf, "", 0), lib.RealClock{}, 0, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		d.Printf("foo", "foo")
+	}
+	if n := strings.Count(buf.String(), "foo"); n != 10 {
+		t.Fatalf("bad: %d", n)
+	}
+	if n := d.Suppressed(); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestLogDeduper_BadExempt(t *testing.T) {
+	_, err := newLogDeduper(log.New(os.Stderr, "", 0), lib.RealClock{}, time.Second, []string{"("})
+	if err == nil || !strings.Contains(err.Error(), "Invalid log dedup exempt pattern") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestServer_RPCLogDedup_NoLeader(t *testing.T) {
+	logs := &syncBuffer{}
+	clock := lib.NewFakeClock(time.Now())
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Bootstrap = false
+		c.Clock = clock
+		c.LogOutput = logs
+		c.RPCHoldTimeout = time.Millisecond
+		c.RPCLogDedupWindow = 10 * time.Second
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	// Hammer the server with writes, which can't go anywhere without a
+	// leader.
+	const total = 50
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+	}
+	for i := 0; i < total; i++ {
+		var out struct{}
+		err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+		if !structs.IsErrNoLeader(err) {
+			t.Fatalf("bad: %v", err)
+		}
+	}
+
+	// The log should only have one line for all of them.
+	if n := strings.Count(logs.String(), "no leader to handle Catalog.Register"); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	if n := s1.rpcLogger.Suppressed(); n != total-1 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	// Once the window is up we should get the summary.
+	clock.Advance(10 * time.Second)
+	if !strings.Contains(logs.String(), "(x49 in last 10s)") {
+		t.Fatalf("bad: %s", logs.String())
+	}
+}
+
+func TestServer_RPCLogDedup_Exempt(t *testing.T) {
+	logs := &syncBuffer{}
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Bootstrap = false
+		c.LogOutput = logs
+		c.RPCHoldTimeout = time.Millisecond
+		c.RPCLogDedupExempt = []string{"no leader"}
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	const total = 10
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+	}
+	for i := 0; i < total; i++ {
+		var out struct{}
+		err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+		if !structs.IsErrNoLeader(err) {
+			t.Fatalf("bad: %v", err)
+		}
+	}
+	if n := strings.Count(logs.String(), "no leader to handle Catalog.Register"); n != total {
+		t.Fatalf("bad: %d", n)
+	}
+	if n := s1.rpcLogger.Suppressed(); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+}
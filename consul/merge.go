@@ -8,10 +8,14 @@ import (
 )
 
 // lanMergeDelegate is used to handle a cluster merge on the LAN gossip
-// ring. We check that the peers are in the same datacenter and abort the
-// merge if there is a mis-match.
+// ring. We check that the peers are in the same datacenter, and that servers
+// are part of the same cluster, and abort the merge if there is a mis-match.
 type lanMergeDelegate struct {
 	dc string
+
+	// clusterID returns the ID of our cluster, if it's set. This is only
+	// set for servers.
+	clusterID func() string
 }
 
 func (md *lanMergeDelegate) NotifyMerge(members []*serf.Member) error {
@@ -26,10 +30,18 @@ func (md *lanMergeDelegate) NotifyMerge(members []*serf.Member) error {
 		}
 
 		ok, parts := agent.IsConsulServer(*m)
-		if ok && parts.Datacenter != md.dc {
+		if !ok {
+			continue
+		}
+		if parts.Datacenter != md.dc {
 			return fmt.Errorf("Member '%s' part of wrong datacenter '%s'",
 				m.Name, parts.Datacenter)
 		}
+		if md.clusterID != nil {
+			if err := checkClusterID(m.Name, parts.ClusterID, md.clusterID()); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -38,14 +50,29 @@ func (md *lanMergeDelegate) NotifyMerge(members []*serf.Member) error {
 // ring. We check that the peers are server nodes and abort the merge
 // otherwise.
 type wanMergeDelegate struct {
+	// decommissioned returns true if the given datacenter has been
+	// decommissioned, if it's set.
+	decommissioned func(dc string) bool
 }
 
 func (md *wanMergeDelegate) NotifyMerge(members []*serf.Member) error {
+	refused := 0
 	for _, m := range members {
-		ok, _ := agent.IsConsulServer(*m)
+		ok, parts := agent.IsConsulServer(*m)
 		if !ok {
 			return fmt.Errorf("Member '%s' is not a server", m.Name)
 		}
+		if md.decommissioned != nil && md.decommissioned(parts.Datacenter) {
+			refused++
+		}
+	}
+
+	// Serf also calls this with each member that sends an alive message,
+	// so this keeps servers from decommissioned datacenters out. A merge
+	// with other members is let through, since their alive messages get
+	// checked one at a time after.
+	if len(members) > 0 && refused == len(members) {
+		return fmt.Errorf("Member '%s' is part of decommissioned datacenter", members[0].Name)
 	}
 	return nil
 }
@@ -0,0 +1,219 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/consul/agent"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	// defaultNetworkCheckTimeout is how long each port check gets if the
+	// request doesn't say.
+	defaultNetworkCheckTimeout = 2 * time.Second
+
+	// maxNetworkCheckTimeout caps the per-port timeout so a check can't tie
+	// up an RPC handler for long.
+	maxNetworkCheckTimeout = 10 * time.Second
+
+	// defaultRPCPort is assumed for targets that aren't known members.
+	defaultRPCPort = 8300
+)
+
+// networkCheckTarget is a port to check on the target server.
+type networkCheckTarget struct {
+	port string
+	addr *net.TCPAddr
+
+	// node is the name to send with a Serf ping so the other end can make
+	// sure it's the server we think it is. If it's blank, any node will
+	// answer.
+	node string
+
+	// pool is the Serf pool to ping from, or nil for the RPC port.
+	pool *serf.Serf
+
+	// dc is the target's datacenter, which is needed to set up TLS for the
+	// RPC port.
+	dc string
+}
+
+// networkCheckTargets works out which ports to check for the given target,
+// which is a LAN or WAN member name or an address. Addresses that don't
+// belong to a known server get the default ports.
+func (s *Server) networkCheckTargets(target string) (string, []networkCheckTarget, error) {
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	matches := func(m serf.Member) bool {
+		return m.Name == target || m.Addr.String() == host
+	}
+
+	wan := s.getSerfWAN()
+
+	// Look in the LAN pool first, since that tells us about all three
+	// ports.
+	for _, m := range s.LANMembers() {
+		if !matches(m) {
+			continue
+		}
+		ok, parts := agent.IsConsulServer(m)
+		if !ok {
+			return "", nil, fmt.Errorf("%q is not a Consul server", m.Name)
+		}
+		targets := []networkCheckTarget{
+			{"serf_lan", &net.TCPAddr{IP: m.Addr, Port: int(m.Port)}, m.Name, s.serfLAN, ""},
+			{"rpc", &net.TCPAddr{IP: m.Addr, Port: parts.Port}, "", nil, parts.Datacenter},
+		}
+		if wan != nil && parts.WanJoinPort != 0 {
+			targets = append(targets, networkCheckTarget{
+				"serf_wan", &net.TCPAddr{IP: m.Addr, Port: parts.WanJoinPort},
+				fmt.Sprintf("%s.%s", m.Name, parts.Datacenter), wan, "",
+			})
+		}
+		return m.Name, targets, nil
+	}
+
+	// Servers in other datacenters are only in the WAN pool.
+	if wan != nil {
+		for _, m := range wan.Members() {
+			if !matches(m) {
+				continue
+			}
+			ok, parts := agent.IsConsulServer(m)
+			if !ok {
+				return "", nil, fmt.Errorf("%q is not a Consul server", m.Name)
+			}
+			targets := []networkCheckTarget{
+				{"serf_wan", &net.TCPAddr{IP: m.Addr, Port: int(m.Port)}, m.Name, wan, ""},
+				{"rpc", &net.TCPAddr{IP: m.Addr, Port: parts.Port}, "", nil, parts.Datacenter},
+			}
+			return m.Name, targets, nil
+		}
+	}
+
+	// Fall back to the default ports for a bare address.
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", nil, fmt.Errorf("Unknown target %q", target)
+	}
+	targets := []networkCheckTarget{
+		{"serf_lan", &net.TCPAddr{IP: ip, Port: DefaultLANSerfPort}, "", s.serfLAN, ""},
+		{"rpc", &net.TCPAddr{IP: ip, Port: defaultRPCPort}, "", nil, s.config.Datacenter},
+	}
+	if wan != nil {
+		targets = append(targets, networkCheckTarget{
+			"serf_wan", &net.TCPAddr{IP: ip, Port: DefaultWANSerfPort}, "", wan, "",
+		})
+	}
+	return target, targets, nil
+}
+
+// networkCheck checks a single port. Connections are always made fresh, and
+// never go through the connection pool, so a result reflects the network as
+// it is now.
+func (s *Server) networkCheck(t networkCheckTarget, handshake bool, timeout time.Duration) structs.NetworkCheckResult {
+	result := structs.NetworkCheckResult{
+		Port: t.port,
+		Addr: t.addr.String(),
+	}
+
+	start := time.Now()
+	err := s.networkCheckDial(t, timeout)
+	if err == nil && handshake {
+		if err = s.networkCheckHandshake(t, timeout); err != nil {
+			result.Class = structs.NetworkCheckHandshakeFailed
+		}
+	}
+	result.Latency = time.Since(start)
+
+	if err != nil {
+		if result.Class == "" {
+			result.Class = classifyNetworkError(err)
+		}
+		result.Error = err.Error()
+		return result
+	}
+	result.OK = true
+	result.Class = structs.NetworkCheckOK
+	return result
+}
+
+// networkCheckDial makes sure a TCP connection can be opened to the port.
+func (s *Server) networkCheckDial(t networkCheckTarget, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", t.addr.String(), timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// networkCheckHandshake does a protocol-level exchange with the port: a UDP
+// ping for the Serf ports, and a Status.Ping for RPC.
+func (s *Server) networkCheckHandshake(t networkCheckTarget, timeout time.Duration) error {
+	if t.pool == nil {
+		return s.networkCheckRPCPing(t.dc, t.addr, timeout)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := t.pool.Memberlist().Ping(t.node, t.addr)
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out waiting for a ping ack")
+	}
+}
+
+// networkCheckRPCPing sends a Status.Ping over a new, unpooled connection.
+func (s *Server) networkCheckRPCPing(dc string, addr net.Addr, timeout time.Duration) error {
+	conn, _, err := s.connPool.dial(dc, addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte{byte(rpcConsul)}); err != nil {
+		return err
+	}
+
+	codec := msgpackrpc.NewClientCodec(conn)
+	var out struct{}
+	return msgpackrpc.CallWithCodec(codec, "Status.Ping", struct{}{}, &out)
+}
+
+// classifyNetworkError sorts a dial or handshake error into one of the
+// NetworkCheck* classes.
+func classifyNetworkError(err error) string {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return structs.NetworkCheckTimeout
+	}
+	if strings.Contains(err.Error(), "connection refused") {
+		return structs.NetworkCheckRefused
+	}
+	return structs.NetworkCheckError
+}
+
+// networkCheckTimeout returns the per-port timeout to use for a request.
+func networkCheckTimeout(requested time.Duration) time.Duration {
+	switch {
+	case requested <= 0:
+		return defaultNetworkCheckTimeout
+	case requested > maxNetworkCheckTimeout:
+		return maxNetworkCheckTimeout
+	default:
+		return requested
+	}
+}
@@ -0,0 +1,129 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestOperator_NetworkCheck(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return len(s1.LANMembers()) == 2, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(target string, handshake bool) structs.NetworkCheckReply {
+		arg := structs.NetworkCheckRequest{
+			Datacenter: "dc1",
+			Target:     target,
+			Handshake:  handshake,
+			Timeout:    time.Second,
+		}
+		var reply structs.NetworkCheckReply
+		if err := msgpackrpc.CallWithCodec(codec, "Operator.NetworkCheck", &arg, &reply); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return reply
+	}
+
+	// Everything should be reachable, with or without a handshake.
+	for _, handshake := range []bool{false, true} {
+		reply := check(s2.config.NodeName, handshake)
+		if reply.Node != s1.config.NodeName || reply.Target != s2.config.NodeName {
+			t.Fatalf("bad: %#v", reply)
+		}
+		ports := make(map[string]bool)
+		for _, r := range reply.Results {
+			if !r.OK || r.Class != structs.NetworkCheckOK || r.Error != "" {
+				t.Fatalf("bad: %#v", r)
+			}
+			ports[r.Port] = true
+		}
+		if len(ports) != 3 || !ports["serf_lan"] || !ports["serf_wan"] || !ports["rpc"] {
+			t.Fatalf("bad: %#v", reply.Results)
+		}
+	}
+
+	// An address works as well as a name.
+	if reply := check("127.0.0.1", false); len(reply.Results) != 3 {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	// Unknown names are rejected.
+	arg := structs.NetworkCheckRequest{
+		Datacenter: "dc1",
+		Target:     "nope",
+	}
+	var reply structs.NetworkCheckReply
+	err := msgpackrpc.CallWithCodec(codec, "Operator.NetworkCheck", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), "Unknown target") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Once the other server is gone its ports are closed, which should be
+	// reported as refused rather than timing out. Nothing is cached, so
+	// this shows up right away.
+	s2.Shutdown()
+	for _, r := range check(s2.config.NodeName, true).Results {
+		if r.OK || r.Class != structs.NetworkCheckRefused || r.Error == "" {
+			t.Fatalf("bad: %#v", r)
+		}
+	}
+}
+
+func TestOperator_NetworkCheck_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Make a request with no token to make sure it gets denied.
+	arg := structs.NetworkCheckRequest{
+		Datacenter: "dc1",
+		Target:     s1.config.NodeName,
+	}
+	var reply structs.NetworkCheckReply
+	err := msgpackrpc.CallWithCodec(codec, "Operator.NetworkCheck", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// It should go through with the master token.
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.NetworkCheck", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Results) != 3 {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
@@ -1,11 +1,18 @@
 package consul
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net"
+	"sort"
+	"time"
 
 	"github.com/hashicorp/consul/consul/agent"
+	"github.com/hashicorp/consul/consul/state"
 	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
 )
@@ -21,12 +28,12 @@ func (op *Operator) RaftGetConfiguration(args *structs.DCSpecificRequest, reply
 		return err
 	}
 
-	// This action requires operator read access.
-	acl, err := op.srv.resolveToken(args.Token)
+	// This action requires operator Raft read access.
+	acl, err := op.srv.resolveToken("Operator.RaftGetConfiguration", args.Token)
 	if err != nil {
 		return err
 	}
-	if acl != nil && !acl.OperatorRead() {
+	if acl != nil && !acl.OperatorRaftRead() {
 		return permissionDeniedErr
 	}
 
@@ -79,19 +86,20 @@ func (op *Operator) RaftRemovePeerByAddress(args *structs.RaftPeerByAddressReque
 		return err
 	}
 
-	// This is a super dangerous operation that requires operator write
-	// access.
-	acl, err := op.srv.resolveToken(args.Token)
+	// This is a super dangerous operation that requires operator Raft
+	// write access.
+	acl, err := op.srv.resolveToken("Operator.RaftRemovePeerByAddress", args.Token)
 	if err != nil {
 		return err
 	}
-	if acl != nil && !acl.OperatorWrite() {
+	if acl != nil && !acl.OperatorRaftWrite() {
 		return permissionDeniedErr
 	}
 
 	// Since this is an operation designed for humans to use, we will return
 	// an error if the supplied address isn't among the peers since it's
 	// likely they screwed up.
+	var id raft.ServerID
 	{
 		future := op.srv.raft.GetConfiguration()
 		if err := future.Error(); err != nil {
@@ -99,6 +107,7 @@ func (op *Operator) RaftRemovePeerByAddress(args *structs.RaftPeerByAddressReque
 		}
 		for _, s := range future.Configuration().Servers {
 			if s.Address == args.Address {
+				id = s.ID
 				goto REMOVE
 			}
 		}
@@ -123,6 +132,8 @@ REMOVE:
 	}
 
 	op.srv.logger.Printf("[WARN] consul.operator: Removed Raft peer %q", args.Address)
+	op.srv.recordServerEvent(id, args.Address, structs.ServerEventRemoved,
+		"removed by an operator", structs.ServerEventByOperator)
 	return nil
 }
 
@@ -132,12 +143,12 @@ func (op *Operator) AutopilotGetConfiguration(args *structs.DCSpecificRequest, r
 		return err
 	}
 
-	// This action requires operator read access.
-	acl, err := op.srv.resolveToken(args.Token)
+	// This action requires operator Autopilot read access.
+	acl, err := op.srv.resolveToken("Operator.AutopilotGetConfiguration", args.Token)
 	if err != nil {
 		return err
 	}
-	if acl != nil && !acl.OperatorRead() {
+	if acl != nil && !acl.OperatorAutopilotRead() {
 		return permissionDeniedErr
 	}
 
@@ -158,12 +169,12 @@ func (op *Operator) AutopilotSetConfiguration(args *structs.AutopilotSetConfigRe
 		return err
 	}
 
-	// This action requires operator write access.
-	acl, err := op.srv.resolveToken(args.Token)
+	// This action requires operator Autopilot write access.
+	acl, err := op.srv.resolveToken("Operator.AutopilotSetConfiguration", args.Token)
 	if err != nil {
 		return err
 	}
-	if acl != nil && !acl.OperatorWrite() {
+	if acl != nil && !acl.OperatorAutopilotWrite() {
 		return permissionDeniedErr
 	}
 
@@ -184,18 +195,14 @@ func (op *Operator) AutopilotSetConfiguration(args *structs.AutopilotSetConfigRe
 	return nil
 }
 
-// ServerHealth is used to get the current health of the servers.
-func (op *Operator) ServerHealth(args *structs.DCSpecificRequest, reply *structs.OperatorHealthReply) error {
-	// This must be sent to the leader, so we fix the args since we are
-	// re-using a structure where we don't support all the options.
-	args.RequireConsistent = true
-	args.AllowStale = false
-	if done, err := op.srv.forward("Operator.ServerHealth", args, args, reply); done {
+// QueryDefaultsGetConfiguration is used to retrieve the default query options.
+func (op *Operator) QueryDefaultsGetConfiguration(args *structs.DCSpecificRequest, reply *structs.QueryDefaults) error {
+	if done, err := op.srv.forward("Operator.QueryDefaultsGetConfiguration", args, args, reply); done {
 		return err
 	}
 
 	// This action requires operator read access.
-	acl, err := op.srv.resolveToken(args.Token)
+	acl, err := op.srv.resolveToken("Operator.QueryDefaultsGetConfiguration", args.Token)
 	if err != nil {
 		return err
 	}
@@ -203,16 +210,1680 @@ func (op *Operator) ServerHealth(args *structs.DCSpecificRequest, reply *structs
 		return permissionDeniedErr
 	}
 
-	// Exit early if the min Raft version is too low
-	minRaftProtocol, err := ServerMinRaftProtocol(op.srv.LANMembers())
+	state := op.srv.fsm.State()
+	_, defaults, err := state.QueryDefaults(nil)
 	if err != nil {
-		return fmt.Errorf("error getting server raft protocol versions: %s", err)
+		return err
 	}
-	if minRaftProtocol < 3 {
-		return fmt.Errorf("all servers must have raft_protocol set to 3 or higher to use this endpoint")
+	if defaults != nil {
+		*reply = *defaults
 	}
 
-	*reply = op.srv.getClusterHealth()
+	return nil
+}
+
+// QueryDefaultsSetConfiguration is used to set the default query options.
+func (op *Operator) QueryDefaultsSetConfiguration(args *structs.QueryDefaultsSetRequest, reply *struct{}) error {
+	if done, err := op.srv.forward("Operator.QueryDefaultsSetConfiguration", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator write access.
+	acl, err := op.srv.resolveToken("Operator.QueryDefaultsSetConfiguration", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	// Sanity check the defaults.
+	if args.Defaults.MaxQueryTime < 0 || args.Defaults.MaxQueryTime > maxQueryTime {
+		return fmt.Errorf("MaxQueryTime must be between 0 and %v", maxQueryTime)
+	}
+
+	// Apply the update
+	resp, err := op.srv.raftApply(structs.QueryDefaultsRequestType, args)
+	if err != nil {
+		op.srv.logger.Printf("[ERR] consul.operator: Apply failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// SigningKeys returns the public halves of the keys used to sign results, so
+// consumers can verify signed results. These are public, so no ACL is
+// needed.
+func (op *Operator) SigningKeys(args *structs.DCSpecificRequest, reply *structs.IndexedSigningPublicKeys) error {
+	if done, err := op.srv.forward("Operator.SigningKeys", args, args, reply); done {
+		return err
+	}
+
+	return op.srv.blockingQuery(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, state *state.StateStore) error {
+			index, keys, err := state.SigningKeys(ws)
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.Keys = index, nil
+			for _, key := range keys {
+				reply.Keys = append(reply.Keys, key.Public())
+			}
+			return nil
+		})
+}
+
+// SigningKeyRotate makes a new signing key and makes it the active one. The
+// previous key is kept so results it signed can still be verified; any key
+// before that is dropped.
+func (op *Operator) SigningKeyRotate(args *structs.SigningKeyRequest, reply *structs.SigningPublicKey) error {
+	if done, err := op.srv.forward("Operator.SigningKeyRotate", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator write access.
+	acl, err := op.srv.resolveToken("Operator.SigningKeyRotate", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	key, err := op.srv.rotateSigningKey()
+	if err != nil {
+		op.srv.logger.Printf("[ERR] consul.operator: Signing key rotation failed: %v", err)
+		return err
+	}
+	*reply = *key.Public()
+	return nil
+}
+
+// QueryFreezeGet is used to retrieve the prepared query freeze.
+func (op *Operator) QueryFreezeGet(args *structs.DCSpecificRequest, reply *structs.QueryFreeze) error {
+	if done, err := op.srv.forward("Operator.QueryFreezeGet", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator read access.
+	acl, err := op.srv.resolveToken("Operator.QueryFreezeGet", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	state := op.srv.fsm.State()
+	_, freeze, err := state.QueryFreeze(nil)
+	if err != nil {
+		return err
+	}
+	if freeze != nil {
+		*reply = *freeze
+	}
+
+	return nil
+}
+
+// QueryFreezeSet is used to set or clear the prepared query freeze.
+func (op *Operator) QueryFreezeSet(args *structs.QueryFreezeRequest, reply *struct{}) error {
+	if done, err := op.srv.forward("Operator.QueryFreezeSet", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator write access.
+	acl, err := op.srv.resolveToken("Operator.QueryFreezeSet", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	// Record who made the change and when. The time has to be set here
+	// since it wouldn't be deterministic in the FSM.
+	if args.Freeze.SetBy == "" {
+		return fmt.Errorf("Must say who is setting the freeze")
+	}
+	args.Freeze.SetAt = time.Now().UTC()
+
+	// Apply the update
+	resp, err := op.srv.raftApply(structs.QueryFreezeRequestType, args)
+	if err != nil {
+		op.srv.logger.Printf("[ERR] consul.operator: Apply failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+
+	if args.Freeze.Frozen {
+		op.srv.logger.Printf("[WARN] consul.operator: Prepared queries frozen by %q: %s",
+			args.Freeze.SetBy, args.Freeze.Reason)
+	} else {
+		op.srv.logger.Printf("[INFO] consul.operator: Prepared queries unfrozen by %q", args.Freeze.SetBy)
+	}
+	return nil
+}
+
+// RemoteWritePolicyGet is used to retrieve the remote write policy.
+func (op *Operator) RemoteWritePolicyGet(args *structs.DCSpecificRequest, reply *structs.RemoteWritePolicy) error {
+	if done, err := op.srv.forward("Operator.RemoteWritePolicyGet", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator read access.
+	acl, err := op.srv.resolveToken("Operator.RemoteWritePolicyGet", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	state := op.srv.fsm.State()
+	_, policy, err := state.RemoteWritePolicy(nil)
+	if err != nil {
+		return err
+	}
+	if policy != nil {
+		*reply = *policy
+	}
+
+	return nil
+}
+
+// RemoteWritePolicySet is used to update the remote write policy.
+func (op *Operator) RemoteWritePolicySet(args *structs.RemoteWritePolicyRequest, reply *struct{}) error {
+	if done, err := op.srv.forward("Operator.RemoteWritePolicySet", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator write access.
+	acl, err := op.srv.resolveToken("Operator.RemoteWritePolicySet", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	// Apply the update
+	resp, err := op.srv.raftApply(structs.RemoteWritePolicyRequestType, args)
+	if err != nil {
+		op.srv.logger.Printf("[ERR] consul.operator: Apply failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+
+	op.srv.logger.Printf("[INFO] consul.operator: Remote write policy updated, refuse_remote_writes=%v",
+		args.Policy.RefuseRemoteWrites)
+	return nil
+}
+
+// ServiceNamePolicyGet is used to retrieve the service name policy.
+func (op *Operator) ServiceNamePolicyGet(args *structs.DCSpecificRequest, reply *structs.ServiceNamePolicy) error {
+	if done, err := op.srv.forward("Operator.ServiceNamePolicyGet", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator read access.
+	acl, err := op.srv.resolveToken("Operator.ServiceNamePolicyGet", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	state := op.srv.fsm.State()
+	_, policy, err := state.ServiceNamePolicy(nil)
+	if err != nil {
+		return err
+	}
+	if policy != nil {
+		*reply = *policy
+	}
+
+	return nil
+}
+
+// ServiceNamePolicyApply is used to set or delete the service name policy.
+func (op *Operator) ServiceNamePolicyApply(args *structs.ServiceNamePolicyRequest, reply *struct{}) error {
+	if done, err := op.srv.forward("Operator.ServiceNamePolicyApply", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator write access.
+	acl, err := op.srv.resolveToken("Operator.ServiceNamePolicyApply", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	// Sanity check the request.
+	switch args.Op {
+	case structs.ServiceNamePolicySet:
+		for _, name := range args.Policy.Names {
+			if name == "" {
+				return fmt.Errorf("Service names can't be empty")
+			}
+		}
+		for _, prefix := range args.Policy.Prefixes {
+			if prefix == "" {
+				return fmt.Errorf("Service name prefixes can't be empty")
+			}
+		}
+	case structs.ServiceNamePolicyDelete:
+	default:
+		return fmt.Errorf("Invalid service name policy operation '%s'", args.Op)
+	}
+
+	// Apply the update
+	resp, err := op.srv.raftApply(structs.ServiceNamePolicyRequestType, args)
+	if err != nil {
+		op.srv.logger.Printf("[ERR] consul.operator: Apply failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+
+	op.srv.logger.Printf("[INFO] consul.operator: Service name policy updated, op=%s enabled=%v",
+		args.Op, args.Policy.Enabled)
+	return nil
+}
+
+// DatacenterAliasList returns the datacenter aliases.
+func (op *Operator) DatacenterAliasList(args *structs.DCSpecificRequest, reply *structs.IndexedDatacenterAliases) error {
+	if done, err := op.srv.forward("Operator.DatacenterAliasList", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator read access.
+	acl, err := op.srv.resolveToken("Operator.DatacenterAliasList", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	return op.srv.blockingQuery(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, state *state.StateStore) error {
+			index, aliases, err := state.DatacenterAliasList(ws)
+			if err != nil {
+				return err
+			}
 
+			reply.Index, reply.Aliases = index, aliases
+			return nil
+		})
+}
+
+// DatacenterAliasApply is used to set or delete a datacenter alias. Aliases
+// must point straight at the canonical name of a datacenter, so chained and
+// circular aliases are rejected.
+func (op *Operator) DatacenterAliasApply(args *structs.DatacenterAliasRequest, reply *struct{}) error {
+	if done, err := op.srv.forward("Operator.DatacenterAliasApply", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator write access.
+	acl, err := op.srv.resolveToken("Operator.DatacenterAliasApply", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	// Sanity check the request.
+	switch args.Op {
+	case structs.DatacenterAliasSet:
+		if args.Alias.Alias == "" || args.Alias.Canonical == "" {
+			return fmt.Errorf("Must provide an alias and a canonical datacenter name")
+		}
+		if args.Alias.Alias == op.srv.config.Datacenter {
+			return fmt.Errorf("Cannot alias the name of this datacenter")
+		}
+	case structs.DatacenterAliasDelete:
+		if args.Alias.Alias == "" {
+			return fmt.Errorf("Must provide an alias to delete")
+		}
+	default:
+		return fmt.Errorf("Invalid datacenter alias operation '%s'", args.Op)
+	}
+
+	// Apply the update
+	resp, err := op.srv.raftApply(structs.DatacenterAliasRequestType, args)
+	if err != nil {
+		op.srv.logger.Printf("[ERR] consul.operator: Apply failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
 	return nil
 }
+
+// FederationPolicyList returns the federation policies.
+func (op *Operator) FederationPolicyList(args *structs.DCSpecificRequest, reply *structs.IndexedFederationPolicies) error {
+	if done, err := op.srv.forward("Operator.FederationPolicyList", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator read access.
+	acl, err := op.srv.resolveToken("Operator.FederationPolicyList", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	return op.srv.blockingQuery(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, state *state.StateStore) error {
+			index, policies, err := state.FederationPolicyList(ws)
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.Policies = index, policies
+			return nil
+		})
+}
+
+// FederationPolicyApply is used to set or delete the federation policy for a
+// datacenter. Policies are kept under the datacenter's canonical name, so an
+// alias given here is resolved first.
+func (op *Operator) FederationPolicyApply(args *structs.FederationPolicyRequest, reply *struct{}) error {
+	if done, err := op.srv.forward("Operator.FederationPolicyApply", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator write access.
+	acl, err := op.srv.resolveToken("Operator.FederationPolicyApply", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	// Sanity check the request.
+	if args.Policy.Datacenter == "" {
+		return fmt.Errorf("Must provide a datacenter name")
+	}
+	args.Policy.Datacenter = op.srv.router.ResolveDatacenter(args.Policy.Datacenter)
+	switch args.Op {
+	case structs.FederationPolicySet:
+		if args.Policy.Datacenter == op.srv.config.Datacenter {
+			return fmt.Errorf("Cannot set a federation policy for this datacenter")
+		}
+		switch args.Policy.Forwarding {
+		case structs.FederationForwardNone, structs.FederationForwardReads, structs.FederationForwardAll:
+		default:
+			return fmt.Errorf("Invalid federation forwarding '%s', must be one of '%s', '%s', or '%s'",
+				args.Policy.Forwarding, structs.FederationForwardNone,
+				structs.FederationForwardReads, structs.FederationForwardAll)
+		}
+
+		// The decommission mark is only changed by DecommissionDatacenter,
+		// so keep whatever's there.
+		_, existing, err := op.srv.fsm.State().FederationPolicyGet(nil, args.Policy.Datacenter)
+		if err != nil {
+			return err
+		}
+		args.Policy.Decommission, args.Policy.Hidden = structs.DecommissionNone, false
+		if existing != nil {
+			args.Policy.Decommission, args.Policy.Hidden = existing.Decommission, existing.Hidden
+		}
+	case structs.FederationPolicyDelete:
+	default:
+		return fmt.Errorf("Invalid federation policy operation '%s'", args.Op)
+	}
+
+	// Apply the update
+	resp, err := op.srv.raftApply(structs.FederationPolicyRequestType, args)
+	if err != nil {
+		op.srv.logger.Printf("[ERR] consul.operator: Apply failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+
+	op.srv.logger.Printf("[INFO] consul.operator: Federation policy updated, op=%s datacenter=%q forwarding=%s",
+		args.Op, args.Policy.Datacenter, args.Policy.Forwarding)
+	return nil
+}
+
+// DecommissionDatacenter is used to decommission another datacenter, in two
+// phases. The first marks it in its federation policy, which stops all
+// forwarding to it and keeps its servers from rejoining the WAN pool. The
+// second, with Confirm set, force-leaves its servers from the WAN pool and
+// takes them out of the router. Clear takes the mark back off.
+func (op *Operator) DecommissionDatacenter(args *structs.DecommissionDatacenterRequest, reply *structs.DecommissionDatacenterReply) error {
+	if done, err := op.srv.forward("Operator.DecommissionDatacenter", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator write access.
+	acl, err := op.srv.resolveToken("Operator.DecommissionDatacenter", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	// Sanity check the request.
+	if args.Decommission == "" {
+		return fmt.Errorf("Must provide a datacenter name")
+	}
+	dc := op.srv.router.ResolveDatacenter(args.Decommission)
+	if dc == op.srv.config.Datacenter {
+		return fmt.Errorf("Cannot decommission this datacenter")
+	}
+	if dc == op.srv.config.ACLDatacenter {
+		return fmt.Errorf("Cannot decommission the ACL datacenter")
+	}
+	if args.Confirm && args.Clear {
+		return fmt.Errorf("Cannot confirm and clear a decommission at the same time")
+	}
+
+	// Start from the existing policy so the forwarding setting is kept.
+	_, existing, err := op.srv.fsm.State().FederationPolicyGet(nil, dc)
+	if err != nil {
+		return err
+	}
+	policy := structs.FederationPolicy{
+		Datacenter: dc,
+		Forwarding: structs.FederationForwardAll,
+	}
+	if existing != nil {
+		policy.Forwarding = existing.Forwarding
+		policy.Decommission, policy.Hidden = existing.Decommission, existing.Hidden
+	}
+	switch {
+	case args.Clear:
+		policy.Decommission, policy.Hidden = structs.DecommissionNone, false
+	case args.Confirm:
+		if !policy.IsDecommissioned() {
+			return fmt.Errorf("Datacenter %q must be marked as decommissioned before it can be purged", dc)
+		}
+		policy.Decommission = structs.DecommissionPurged
+	default:
+		if policy.Decommission != structs.DecommissionPurged {
+			policy.Decommission = structs.DecommissionMarked
+		}
+		policy.Hidden = args.Hide
+	}
+
+	// Apply the update
+	req := structs.FederationPolicyRequest{
+		Datacenter: args.Datacenter,
+		Op:         structs.FederationPolicySet,
+		Policy:     policy,
+	}
+	resp, err := op.srv.raftApply(structs.FederationPolicyRequestType, &req)
+	if err != nil {
+		op.srv.logger.Printf("[ERR] consul.operator: Apply failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	reply.State = policy.Decommission
+
+	// The mark is in place, so the servers can't rejoin once they're
+	// purged.
+	if args.Confirm {
+		reply.Servers, err = op.srv.purgeDatacenter(dc)
+		if err != nil {
+			return fmt.Errorf("Failed to purge datacenter %q: %v", dc, err)
+		}
+	} else {
+		for _, m := range op.srv.datacenterWANServers(dc) {
+			reply.Servers = append(reply.Servers, m.Name)
+		}
+	}
+
+	op.srv.logger.Printf("[INFO] consul.operator: Datacenter decommission updated, datacenter=%q state=%q servers=%d",
+		dc, reply.State, len(reply.Servers))
+	return nil
+}
+
+// SweepOrphanedLocks finds keys locked by sessions that no longer exist and
+// releases them, without waiting for the leader's periodic sweep. A dry run
+// only needs operator read access, and just reports the locks.
+func (op *Operator) SweepOrphanedLocks(args *structs.OrphanedLockSweepRequest, reply *structs.OrphanedLockSweepReply) error {
+	if done, err := op.srv.forward("Operator.SweepOrphanedLocks", args, args, reply); done {
+		return err
+	}
+
+	acl, err := op.srv.resolveToken("Operator.SweepOrphanedLocks", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil {
+		if args.DryRun && !acl.OperatorRead() {
+			return permissionDeniedErr
+		}
+		if !args.DryRun && !acl.OperatorWrite() {
+			return permissionDeniedErr
+		}
+	}
+
+	reply.Locks, reply.Released, err = op.srv.sweepOrphanedLocks(args.DryRun)
+	if err != nil {
+		return err
+	}
+	if !args.DryRun && reply.Released > 0 {
+		op.srv.logger.Printf("[INFO] consul.operator: Released %d orphaned lock(s)", reply.Released)
+	}
+	return nil
+}
+
+// ServiceConstraintList returns the service constraints.
+func (op *Operator) ServiceConstraintList(args *structs.DCSpecificRequest, reply *structs.IndexedServiceConstraints) error {
+	if done, err := op.srv.forward("Operator.ServiceConstraintList", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator read access.
+	acl, err := op.srv.resolveToken("Operator.ServiceConstraintList", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	return op.srv.blockingQuery(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, state *state.StateStore) error {
+			index, constraints, err := state.ServiceConstraintList(ws)
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.Constraints = index, constraints
+			return nil
+		})
+}
+
+// ServiceConstraintApply is used to set or delete the constraint for a
+// service. Constraints are checked against new registrations, so setting one
+// doesn't affect instances that are already registered.
+func (op *Operator) ServiceConstraintApply(args *structs.ServiceConstraintRequest, reply *struct{}) error {
+	if done, err := op.srv.forward("Operator.ServiceConstraintApply", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator write access.
+	acl, err := op.srv.resolveToken("Operator.ServiceConstraintApply", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	// Sanity check the request.
+	switch args.Op {
+	case structs.ServiceConstraintSet:
+		if args.Constraint.Service == "" {
+			return fmt.Errorf("Must provide a service name")
+		}
+		if len(args.Constraint.MetaKeys) == 0 {
+			return fmt.Errorf("Must provide at least one meta key")
+		}
+		for _, key := range args.Constraint.MetaKeys {
+			if key == "" {
+				return fmt.Errorf("Meta keys can't be empty")
+			}
+		}
+	case structs.ServiceConstraintDelete:
+		if args.Constraint.Service == "" {
+			return fmt.Errorf("Must provide a service name to delete")
+		}
+	default:
+		return fmt.Errorf("Invalid service constraint operation '%s'", args.Op)
+	}
+
+	// Apply the update
+	resp, err := op.srv.raftApply(structs.ServiceConstraintRequestType, args)
+	if err != nil {
+		op.srv.logger.Printf("[ERR] consul.operator: Apply failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// NodeBlockList returns the node blocks, including any that have expired but
+// haven't been cleaned up by the leader yet.
+func (op *Operator) NodeBlockList(args *structs.DCSpecificRequest, reply *structs.IndexedNodeBlocks) error {
+	if done, err := op.srv.forward("Operator.NodeBlockList", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator read access.
+	acl, err := op.srv.resolveToken("Operator.NodeBlockList", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	return op.srv.blockingQuery(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, state *state.StateStore) error {
+			index, blocks, err := state.NodeBlockList(ws)
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.Blocks = index, blocks
+			return nil
+		})
+}
+
+// NodeBlockApply is used to set or clear the block on a node. Clearing a
+// block doesn't register the node again, that's left to its agent.
+func (op *Operator) NodeBlockApply(args *structs.NodeBlockRequest, reply *struct{}) error {
+	if done, err := op.srv.forward("Operator.NodeBlockApply", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator write access.
+	acl, err := op.srv.resolveToken("Operator.NodeBlockApply", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	// Sanity check the request.
+	switch args.Op {
+	case structs.NodeBlockSet:
+		if args.Block.Node == "" {
+			return fmt.Errorf("Must provide a node name")
+		}
+		if args.Block.ID != "" {
+			if _, err := uuid.ParseUUID(string(args.Block.ID)); err != nil {
+				return fmt.Errorf("Bad node ID: %v", err)
+			}
+		}
+	case structs.NodeBlockClear:
+		if args.Block.Node == "" {
+			return fmt.Errorf("Must provide a node name to clear")
+		}
+	default:
+		return fmt.Errorf("Invalid node block operation '%s'", args.Op)
+	}
+
+	// Apply the update
+	resp, err := op.srv.raftApply(structs.NodeBlockRequestType, args)
+	if err != nil {
+		op.srv.logger.Printf("[ERR] consul.operator: Apply failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// These limit the size of a page of the server history.
+const (
+	defaultServerHistoryLimit = 100
+	maxServerHistoryLimit     = 1000
+)
+
+// ServerHistory returns a page of the history of changes to the Raft
+// membership of the servers, oldest first.
+func (op *Operator) ServerHistory(args *structs.ServerHistoryRequest, reply *structs.IndexedServerHistory) error {
+	if done, err := op.srv.forward("Operator.ServerHistory", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator read access.
+	acl, err := op.srv.resolveToken("Operator.ServerHistory", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRaftRead() {
+		return permissionDeniedErr
+	}
+
+	limit := args.Limit
+	if limit <= 0 {
+		limit = defaultServerHistoryLimit
+	}
+	if limit > maxServerHistoryLimit {
+		limit = maxServerHistoryLimit
+	}
+
+	return op.srv.blockingQuery(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, state *state.StateStore) error {
+			index, events, more, err := state.ServerHistory(ws, args.After, limit)
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.Events, reply.Next = index, events, 0
+			if more {
+				reply.Next = events[len(events)-1].ID
+			}
+			return nil
+		})
+}
+
+// OperatorIntentList returns the multi-step workflows the leader has started
+// but not finished, oldest first, along with the step each one is on.
+func (op *Operator) OperatorIntentList(args *structs.DCSpecificRequest, reply *structs.IndexedOperatorIntents) error {
+	if done, err := op.srv.forward("Operator.OperatorIntentList", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator read access.
+	acl, err := op.srv.resolveToken("Operator.OperatorIntentList", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	return op.srv.blockingQuery(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, state *state.StateStore) error {
+			index, intents, err := state.OperatorIntentList(ws)
+			if err != nil {
+				return err
+			}
+
+			// Keep the keys being rotated to from tokens that can't
+			// read the keyring.
+			if acl != nil && !acl.KeyringRead() {
+				redacted := make([]*structs.OperatorIntent, 0, len(intents))
+				for _, intent := range intents {
+					if intent.Key != "" {
+						copy := *intent
+						copy.Key = ""
+						intent = &copy
+					}
+					redacted = append(redacted, intent)
+				}
+				intents = redacted
+			}
+
+			reply.Index, reply.Intents = index, intents
+			return nil
+		})
+}
+
+// KVQuotaList returns the KV quotas, along with how much is currently stored
+// under each prefix.
+func (op *Operator) KVQuotaList(args *structs.DCSpecificRequest, reply *structs.IndexedKVQuotas) error {
+	if done, err := op.srv.forward("Operator.KVQuotaList", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator read access.
+	acl, err := op.srv.resolveToken("Operator.KVQuotaList", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	return op.srv.blockingQuery(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, state *state.StateStore) error {
+			index, quotas, err := state.KVQuotaList(ws)
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.Quotas = index, quotas
+			return nil
+		})
+}
+
+// KVQuotaApply is used to set or delete the quota on a KV prefix. Quotas are
+// checked when KV writes are applied, so setting one doesn't remove anything
+// that's already stored over the limit.
+func (op *Operator) KVQuotaApply(args *structs.KVQuotaRequest, reply *struct{}) error {
+	if done, err := op.srv.forward("Operator.KVQuotaApply", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator write access.
+	acl, err := op.srv.resolveToken("Operator.KVQuotaApply", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	// Sanity check the request.
+	switch args.Op {
+	case structs.KVQuotaSet:
+		if args.Quota.Prefix == "" {
+			return fmt.Errorf("Must provide a prefix")
+		}
+		if args.Quota.MaxKeys < 0 || args.Quota.MaxBytes < 0 {
+			return fmt.Errorf("Quota limits can't be negative")
+		}
+		if args.Quota.MaxKeys == 0 && args.Quota.MaxBytes == 0 {
+			return fmt.Errorf("Must provide a key or byte limit")
+		}
+	case structs.KVQuotaDelete:
+		if args.Quota.Prefix == "" {
+			return fmt.Errorf("Must provide a prefix to delete")
+		}
+	default:
+		return fmt.Errorf("Invalid KV quota operation '%s'", args.Op)
+	}
+
+	// Servers that don't know about quotas would let writes through that
+	// the others refuse, so quotas can't be used until they're upgraded.
+	if !serversSupport(op.srv.LANMembers(), featureKVQuotaTag) {
+		return fmt.Errorf("all servers must be upgraded to support KV quotas before using them")
+	}
+
+	// Apply the update
+	resp, err := op.srv.raftApply(structs.KVQuotaRequestType, args)
+	if err != nil {
+		op.srv.logger.Printf("[ERR] consul.operator: Apply failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// ServerHealth is used to get the current health of the servers.
+func (op *Operator) ServerHealth(args *structs.DCSpecificRequest, reply *structs.OperatorHealthReply) error {
+	// If this server is stuck waiting to bootstrap then there's no leader
+	// to ask, so report the stall directly.
+	if stall := op.srv.getBootstrapStall(); stall != nil && args.Datacenter == op.srv.config.Datacenter {
+		acl, err := op.srv.resolveToken("Operator.ServerHealth", args.Token)
+		if err != nil {
+			return err
+		}
+		if acl != nil && !acl.OperatorAutopilotRead() {
+			return permissionDeniedErr
+		}
+
+		reply.Healthy = false
+		reply.BootstrapStall = stall
+		return nil
+	}
+
+	// This must be sent to the leader, so we fix the args since we are
+	// re-using a structure where we don't support all the options.
+	args.RequireConsistent = true
+	args.AllowStale = false
+	if done, err := op.srv.forward("Operator.ServerHealth", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator Autopilot read access.
+	acl, err := op.srv.resolveToken("Operator.ServerHealth", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorAutopilotRead() {
+		return permissionDeniedErr
+	}
+
+	// Exit early if the min Raft version is too low
+	minRaftProtocol, err := ServerMinRaftProtocol(op.srv.LANMembers())
+	if err != nil {
+		return fmt.Errorf("error getting server raft protocol versions: %s", err)
+	}
+	if minRaftProtocol < 3 {
+		return fmt.Errorf("all servers must have raft_protocol set to 3 or higher to use this endpoint")
+	}
+
+	*reply = op.srv.getClusterHealth()
+
+	return nil
+}
+
+// RemovalImpact estimates what removing a server from the Raft configuration
+// would do to the cluster's failure tolerance, quorum, and redundancy zones,
+// without changing anything.
+func (op *Operator) RemovalImpact(args *structs.RemovalImpactRequest, reply *structs.RemovalImpactReply) error {
+	// This uses Autopilot's health data, which only the leader has.
+	args.RequireConsistent = true
+	args.AllowStale = false
+	if done, err := op.srv.forward("Operator.RemovalImpact", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator Raft read access.
+	acl, err := op.srv.resolveToken("Operator.RemovalImpact", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRaftRead() {
+		return permissionDeniedErr
+	}
+
+	if args.ID == "" {
+		return fmt.Errorf("Must provide a server ID")
+	}
+
+	// Exit early if the min Raft version is too low
+	minRaftProtocol, err := ServerMinRaftProtocol(op.srv.LANMembers())
+	if err != nil {
+		return fmt.Errorf("error getting server raft protocol versions: %s", err)
+	}
+	if minRaftProtocol < 3 {
+		return fmt.Errorf("all servers must have raft_protocol set to 3 or higher to use this endpoint")
+	}
+
+	impact, err := op.srv.removalImpact(args.ID)
+	if err != nil {
+		return err
+	}
+	*reply = *impact
+	return nil
+}
+
+// TransferLeader has the leader step down and hand over to another healthy
+// voter, so restarting it only causes one election. The reply names the new
+// leader.
+func (op *Operator) TransferLeader(args *structs.TransferLeaderRequest, reply *structs.TransferLeaderReply) error {
+	if done, err := op.srv.forward("Operator.TransferLeader", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator write access.
+	acl, err := op.srv.resolveToken("Operator.TransferLeader", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	// This uses Autopilot's health data, and demotes the leader, which
+	// needs Raft protocol 3.
+	minRaftProtocol, err := ServerMinRaftProtocol(op.srv.LANMembers())
+	if err != nil {
+		return fmt.Errorf("error getting server raft protocol versions: %s", err)
+	}
+	if minRaftProtocol < 3 {
+		return fmt.Errorf("all servers must have raft_protocol set to 3 or higher to use this endpoint")
+	}
+
+	transferred, err := op.srv.transferLeadership()
+	if err != nil {
+		return err
+	}
+	*reply = *transferred
+	return nil
+}
+
+// ValidateConfig checks a proposed set of reloadable settings without
+// applying them. Settings that are left out keep their running values. It
+// runs the same checks Server.Reload would, and also looks for settings that
+// don't suit the running cluster, which are reported as warnings.
+func (op *Operator) ValidateConfig(args *structs.ValidateConfigRequest, reply *structs.ValidateConfigReply) error {
+	// The checks against the cluster want the leader's view of it.
+	args.RequireConsistent = true
+	args.AllowStale = false
+	if done, err := op.srv.forward("Operator.ValidateConfig", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator read access.
+	acl, err := op.srv.resolveToken("Operator.ValidateConfig", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	running, err := op.srv.runningReloadableConfig()
+	if err != nil {
+		return err
+	}
+	cs, err := op.srv.getConfigCheckState()
+	if err != nil {
+		return err
+	}
+
+	config := mergeReloadableConfig(running, &args.Config)
+	reply.Errors = nil
+	for _, err := range validateReloadableConfig(config) {
+		reply.Errors = append(reply.Errors, err.Error())
+	}
+	reply.Warnings = reloadableConfigWarnings(config, cs)
+	return nil
+}
+
+// TopTokens returns the tokens that have made the most requests to the server
+// recently, which helps find who's responsible when the servers are
+// overloaded. Each server counts the requests it handles itself, so this
+// goes to the leader unless stale results are allowed.
+func (op *Operator) TopTokens(args *structs.TopTokensRequest, reply *structs.TopTokensReply) error {
+	if done, err := op.srv.forward("Operator.TopTokens", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator read access.
+	acl, err := op.srv.resolveToken("Operator.TopTokens", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	reply.Node = op.srv.config.NodeName
+	reply.Tokens = nil
+	if op.srv.isTokenRateEnabled() {
+		limit := args.Limit
+		if limit <= 0 {
+			limit = defaultTopTokens
+		}
+
+		// Token IDs are secrets, so only show them to callers who could
+		// list them anyway.
+		reply.Window = op.srv.tokenRates.window
+		reply.Tokens = op.srv.topTokens(limit, acl != nil && acl.ACLList())
+	}
+	op.srv.setQueryMeta(&reply.QueryMeta)
+	return nil
+}
+
+// ACLShadowReport returns the checks that tokens' shadow rules would have
+// denied. Each server tracks the checks it makes itself, so the leader asks
+// the other servers for theirs and adds them up. If stale results are
+// allowed, the server that gets the request just reports its own checks.
+func (op *Operator) ACLShadowReport(args *structs.DCSpecificRequest, reply *structs.ACLShadowReport) error {
+	if done, err := op.srv.forward("Operator.ACLShadowReport", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator read access.
+	acl, err := op.srv.resolveToken("Operator.ACLShadowReport", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	reply.Node = op.srv.config.NodeName
+	reply.Servers = []string{op.srv.config.NodeName}
+	reply.Denials = op.srv.aclShadow.report()
+	if !args.AllowStale {
+		if err := op.srv.gatherACLShadowReports(args, reply); err != nil {
+			return err
+		}
+	}
+	op.srv.setQueryMeta(&reply.QueryMeta)
+	return nil
+}
+
+// KVPrefixSizes returns the KV prefixes that take up the most memory, going
+// by the same estimates as the state store's table sizes.
+func (op *Operator) KVPrefixSizes(args *structs.KVPrefixSizesRequest, reply *structs.KVPrefixSizesReply) error {
+	if done, err := op.srv.forward("Operator.KVPrefixSizes", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator read access.
+	acl, err := op.srv.resolveToken("Operator.KVPrefixSizes", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	depth := args.Depth
+	if depth <= 0 {
+		depth = defaultKVPrefixDepth
+	}
+	limit := args.Limit
+	if limit <= 0 {
+		limit = defaultKVPrefixLimit
+	}
+
+	return op.srv.blockingQuery(
+		&args.QueryOptions,
+		&reply.QueryMeta,
+		func(ws memdb.WatchSet, state *state.StateStore) error {
+			index, prefixes, err := state.KVSPrefixSizes(ws, depth, limit)
+			if err != nil {
+				return err
+			}
+
+			reply.Index, reply.Prefixes = index, prefixes
+			return nil
+		})
+}
+
+// ListBlockingQueries returns the blocking queries a server is waiting to
+// answer. Each server tracks the queries it's serving, so this is answered
+// by the server named in the request, or the one that gets it if none is
+// given.
+func (op *Operator) ListBlockingQueries(args *structs.BlockingQueriesRequest, reply *structs.BlockingQueriesReply) error {
+	if args.Datacenter != op.srv.config.Datacenter {
+		return op.srv.forwardDC("Operator.ListBlockingQueries", args.Datacenter, args, reply)
+	}
+	if args.Node != "" && args.Node != op.srv.config.NodeName {
+		return op.srv.forwardServer(args.Node, "Operator.ListBlockingQueries", args, reply)
+	}
+
+	// This action requires operator read access.
+	acl, err := op.srv.resolveToken("Operator.ListBlockingQueries", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	reply.Node = op.srv.config.NodeName
+	reply.Queries = op.srv.blockingQueries.list()
+	op.srv.setQueryMeta(&reply.QueryMeta)
+	return nil
+}
+
+// CancelBlockingQuery makes a blocking query return right away with the
+// results it has, and the Cancelled flag set in its query meta. This is
+// handled by the server serving the query, in the same way as
+// ListBlockingQueries.
+func (op *Operator) CancelBlockingQuery(args *structs.CancelBlockingQueryRequest, reply *struct{}) error {
+	if args.Datacenter != op.srv.config.Datacenter {
+		return op.srv.forwardDC("Operator.CancelBlockingQuery", args.Datacenter, args, reply)
+	}
+	if args.Node != "" && args.Node != op.srv.config.NodeName {
+		return op.srv.forwardServer(args.Node, "Operator.CancelBlockingQuery", args, reply)
+	}
+
+	// This action requires operator write access.
+	acl, err := op.srv.resolveToken("Operator.CancelBlockingQuery", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	if args.ID == "" {
+		return fmt.Errorf("Must provide a blocking query ID")
+	}
+	return op.srv.blockingQueries.cancel(args.ID)
+}
+
+// WANStatus is used to get the status of the WAN Serf pool on the server
+// handling the request.
+func (op *Operator) WANStatus(args *structs.DCSpecificRequest, reply *structs.OperatorWANStatusReply) error {
+	// This reports on whichever server gets the request, so we fix the args
+	// to allow any server in the datacenter to answer.
+	args.AllowStale = true
+	args.RequireConsistent = false
+	if done, err := op.srv.forward("Operator.WANStatus", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator read access.
+	acl, err := op.srv.resolveToken("Operator.WANStatus", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	status, lastErr := op.srv.WANStatus()
+	reply.Node = op.srv.config.NodeName
+	reply.Status = status
+	if lastErr != nil {
+		reply.LastError = lastErr.Error()
+	}
+	reply.NumMembers = len(op.srv.WANMembers())
+	return nil
+}
+
+// NetworkCheck tests whether the server handling the request can reach the
+// Serf LAN, Serf WAN, and RPC ports of another server. The checks are run
+// fresh every time and never cached.
+func (op *Operator) NetworkCheck(args *structs.NetworkCheckRequest, reply *structs.NetworkCheckReply) error {
+	// This runs from whichever server gets the request, so we fix the args
+	// to allow any server in the datacenter to answer.
+	args.AllowStale = true
+	args.RequireConsistent = false
+	if done, err := op.srv.forward("Operator.NetworkCheck", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator read access.
+	acl, err := op.srv.resolveToken("Operator.NetworkCheck", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	if args.Target == "" {
+		return fmt.Errorf("Must provide a target")
+	}
+	name, targets, err := op.srv.networkCheckTargets(args.Target)
+	if err != nil {
+		return err
+	}
+
+	timeout := networkCheckTimeout(args.Timeout)
+	reply.Node = op.srv.config.NodeName
+	reply.Target = name
+	reply.Results = make([]structs.NetworkCheckResult, 0, len(targets))
+	for _, t := range targets {
+		reply.Results = append(reply.Results, op.srv.networkCheck(t, args.Handshake, timeout))
+	}
+	return nil
+}
+
+// SetTimersPaused pauses or resumes the leader's timers. While they're
+// paused, session TTLs don't expire, tombstones aren't reaped, and the
+// reconcile and autopilot loops sit idle, which gives an operator a stable
+// cluster to look at while debugging an incident. Anything that comes due
+// while paused is run once the timers are resumed.
+func (op *Operator) SetTimersPaused(args *structs.OperatorTimersRequest, reply *structs.OperatorTimersReply) error {
+	if done, err := op.srv.forward("Operator.SetTimersPaused", args, args, reply); done {
+		return err
+	}
+
+	// This action requires operator write access.
+	acl, err := op.srv.resolveToken("Operator.SetTimersPaused", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	if args.Paused {
+		op.srv.clock.Pause()
+		op.srv.logger.Printf("[WARN] consul.operator: Timers paused by operator")
+	} else {
+		op.srv.clock.Resume()
+		op.srv.logger.Printf("[INFO] consul.operator: Timers resumed by operator")
+	}
+
+	reply.Node = op.srv.config.NodeName
+	reply.Paused = op.srv.clock.Paused()
+	return nil
+}
+
+// SetDraining puts a server into drain mode, or takes it out again. Drain
+// mode is per server, so rather than going to the leader, this is sent to the
+// named server. See Server.SetDraining for what draining does.
+func (op *Operator) SetDraining(args *structs.OperatorDrainRequest, reply *structs.OperatorDrainReply) error {
+	if args.Datacenter != op.srv.config.Datacenter {
+		return op.srv.forwardDC("Operator.SetDraining", args.Datacenter, args, reply)
+	}
+	if args.Node == "" {
+		return fmt.Errorf("Must provide a server node name")
+	}
+	if args.Node != op.srv.config.NodeName {
+		return op.srv.forwardServer(args.Node, "Operator.SetDraining", args, reply)
+	}
+
+	// This action requires operator write access.
+	acl, err := op.srv.resolveToken("Operator.SetDraining", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	if err := op.srv.SetDraining(args.Draining); err != nil {
+		return err
+	}
+	reply.Node = op.srv.config.NodeName
+	reply.Draining = op.srv.IsDraining()
+	return nil
+}
+
+// FaultInjectionApply adds, replaces, or removes a fault injection on a
+// server's outgoing connections. Like drain mode, injections are per server,
+// so this is sent to the named server, which must have fault injection
+// enabled.
+func (op *Operator) FaultInjectionApply(args *structs.FaultInjectionRequest, reply *structs.FaultInjectionReply) error {
+	if args.Datacenter != op.srv.config.Datacenter {
+		return op.srv.forwardDC("Operator.FaultInjectionApply", args.Datacenter, args, reply)
+	}
+	if args.Node == "" {
+		return fmt.Errorf("Must provide a server node name")
+	}
+	if args.Node != op.srv.config.NodeName {
+		return op.srv.forwardServer(args.Node, "Operator.FaultInjectionApply", args, reply)
+	}
+
+	// This action requires operator write access.
+	acl, err := op.srv.resolveToken("Operator.FaultInjectionApply", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	injector := op.srv.faultInjector
+	if injector == nil {
+		return fmt.Errorf("Fault injection is not enabled on server %q", op.srv.config.NodeName)
+	}
+	switch args.Op {
+	case structs.FaultInjectionSet:
+		if _, err := injector.set(&args.Injection); err != nil {
+			return err
+		}
+	case structs.FaultInjectionDelete:
+		if !injector.delete(args.Injection.ID) {
+			return fmt.Errorf("Unknown fault injection %q", args.Injection.ID)
+		}
+	default:
+		return fmt.Errorf("Invalid fault injection operation %q", args.Op)
+	}
+
+	reply.Node = op.srv.config.NodeName
+	reply.Injections = injector.list()
+	return nil
+}
+
+// FaultInjectionList returns the fault injections active on a server. This
+// is empty if the server doesn't have fault injection enabled.
+func (op *Operator) FaultInjectionList(args *structs.FaultInjectionListRequest, reply *structs.FaultInjectionReply) error {
+	if args.Datacenter != op.srv.config.Datacenter {
+		return op.srv.forwardDC("Operator.FaultInjectionList", args.Datacenter, args, reply)
+	}
+	if args.Node == "" {
+		return fmt.Errorf("Must provide a server node name")
+	}
+	if args.Node != op.srv.config.NodeName {
+		return op.srv.forwardServer(args.Node, "Operator.FaultInjectionList", args, reply)
+	}
+
+	// This action requires operator read access.
+	acl, err := op.srv.resolveToken("Operator.FaultInjectionList", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	reply.Node = op.srv.config.NodeName
+	reply.Injections = []*structs.FaultInjection{}
+	if op.srv.faultInjector != nil {
+		reply.Injections = op.srv.faultInjector.list()
+	}
+	return nil
+}
+
+const (
+	// serfListKeysQuery is the name of Serf's internal query for listing
+	// the keys installed on each member.
+	serfListKeysQuery = serf.InternalQueryPrefix + "list-keys"
+
+	// serfKeyRequestType and serfKeyResponseType are the message types that
+	// Serf uses on the wire for its key queries.
+	serfKeyRequestType  = 7
+	serfKeyResponseType = 8
+)
+
+// KeyringStatus reports which gossip keys are installed on which nodes,
+// across the LAN and WAN pools of every datacenter. This is used after
+// rotating keys to find out whether it's safe to remove an old one.
+func (op *Operator) KeyringStatus(args *structs.KeyringStatusRequest, reply *structs.KeyringStatusResponse) error {
+	// This action requires keyring read access.
+	acl, err := op.srv.resolveToken("Operator.KeyringStatus", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.KeyringRead() {
+		return permissionDeniedErr
+	}
+
+	// Only query the WAN pool and fan out to the datacenters once; each
+	// datacenter then reports on its own LAN pool.
+	if !args.Forwarded {
+		args.Forwarded = true
+		reply.Pools = append(reply.Pools, op.keyringPoolStatus(args, true))
+		if err := op.srv.globalRPC("Operator.KeyringStatus", args, reply); err != nil {
+			return err
+		}
+
+		reply.RemoveSafe = true
+		for _, pool := range reply.Pools {
+			if !pool.RemoveSafe {
+				reply.RemoveSafe = false
+			}
+		}
+		return nil
+	}
+
+	reply.Pools = append(reply.Pools, op.keyringPoolStatus(args, false))
+	return nil
+}
+
+// KeyringRotate has the leader rotate the gossip encryption key of its LAN
+// pool and the WAN pool to the given key. The new key is installed on every
+// member, made the primary key, and then every other key is removed, waiting
+// at each step until every member has acknowledged it. This makes one attempt
+// at the rotation and reports how far it got; the leader keeps retrying in the
+// background, and calling this again with the same key checks on it.
+func (op *Operator) KeyringRotate(args *structs.KeyringRotateRequest, reply *structs.KeyringRotateResponse) error {
+	if done, err := op.srv.forward("Operator.KeyringRotate", args, args, reply); done {
+		return err
+	}
+
+	// This action requires keyring write access.
+	acl, err := op.srv.resolveToken("Operator.KeyringRotate", args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.KeyringWrite() {
+		return permissionDeniedErr
+	}
+
+	key, err := base64.StdEncoding.DecodeString(args.Key)
+	if err != nil {
+		return fmt.Errorf("Invalid key: %v", err)
+	}
+	if err := memberlist.ValidateKey(key); err != nil {
+		return fmt.Errorf("Invalid key: %v", err)
+	}
+
+	// Pick up the rotation that's already going, or start a new one.
+	intent, err := op.srv.keyringRotation()
+	if err != nil {
+		return err
+	}
+	if intent != nil && intent.Key != args.Key {
+		return fmt.Errorf("A rotation to another key is already in progress (%s)", intent.ID)
+	}
+	if intent == nil {
+		op.srv.setKeyringRotateFailures(nil)
+		intent, err = op.srv.createOperatorIntent(structs.OperatorIntent{
+			Kind:   structs.OperatorIntentKeyringRotate,
+			Target: op.srv.config.Datacenter,
+			Reason: "operator rotated the keyring",
+			Key:    args.Key,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	reply.ID = intent.ID
+
+	// Members that haven't caught up yet aren't an error, we just report
+	// them.
+	if err := op.srv.runOperatorIntent(intent); err != nil && len(op.srv.getKeyringRotateFailures()) == 0 {
+		return err
+	}
+
+	_, intent, err = op.srv.fsm.State().OperatorIntentGet(nil, intent.ID)
+	if err != nil {
+		return err
+	}
+	if intent == nil {
+		reply.Done = true
+		return nil
+	}
+	reply.Step = intent.Step
+	reply.Failures = op.srv.getKeyringRotateFailures()
+	return nil
+}
+
+// keyringPoolStatus lists the keys installed on every member of the LAN or
+// WAN pool and works out which members are missing each key. Serf's key
+// manager only hands back aggregate counts, so we run its list-keys query
+// ourselves to see the individual responses.
+func (op *Operator) keyringPoolStatus(args *structs.KeyringStatusRequest, wan bool) *structs.KeyringPoolStatus {
+	status := &structs.KeyringPoolStatus{
+		WAN:        wan,
+		Datacenter: op.srv.config.Datacenter,
+	}
+
+	pool := op.srv.serfLAN
+	if wan {
+		if pool = op.srv.getSerfWAN(); pool == nil {
+			status.Error = op.srv.wanNotReady().Error()
+			return status
+		}
+	}
+
+	// Figure out who we expect to hear from.
+	pending := make(map[string]struct{})
+	for _, member := range pool.Members() {
+		if member.Status == serf.StatusAlive {
+			pending[member.Name] = struct{}{}
+		}
+	}
+	status.NumNodes = len(pending)
+
+	params := pool.DefaultQueryParams()
+	params.RelayFactor = args.RelayFactor
+	resp, err := pool.Query(serfListKeysQuery, []byte{serfKeyRequestType}, params)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	defer resp.Close()
+
+	// Gather the keys from each node, stopping early once everyone has
+	// answered.
+	installed := make(map[string]map[string]struct{})
+	var responded []string
+	for r := range resp.ResponseCh() {
+		if _, ok := pending[r.From]; !ok {
+			continue
+		}
+		delete(pending, r.From)
+
+		var nodeResp struct {
+			Result  bool
+			Message string
+			Keys    []string
+		}
+		switch {
+		case len(r.Payload) < 1 || r.Payload[0] != serfKeyResponseType:
+			addKeyringMessage(status, r.From, "Invalid key query response type")
+		case structs.Decode(r.Payload[1:], &nodeResp) != nil:
+			addKeyringMessage(status, r.From, "Failed to decode key query response")
+		case !nodeResp.Result:
+			addKeyringMessage(status, r.From, nodeResp.Message)
+		default:
+			responded = append(responded, r.From)
+			for _, key := range nodeResp.Keys {
+				if _, ok := installed[key]; !ok {
+					installed[key] = make(map[string]struct{})
+				}
+				installed[key][r.From] = struct{}{}
+			}
+		}
+
+		if len(pending) == 0 {
+			break
+		}
+	}
+	for name := range pending {
+		status.NoResponse = append(status.NoResponse, name)
+	}
+	sort.Strings(status.NoResponse)
+	sort.Strings(responded)
+
+	// Work out who's missing each key.
+	for key, nodes := range installed {
+		keyStatus := &structs.KeyringKeyStatus{
+			Key:      key,
+			NumNodes: len(nodes),
+		}
+		for _, name := range responded {
+			if _, ok := nodes[name]; !ok {
+				keyStatus.MissingNodes = append(keyStatus.MissingNodes, name)
+			}
+		}
+		status.Keys = append(status.Keys, keyStatus)
+	}
+	sort.Slice(status.Keys, func(i, j int) bool {
+		return status.Keys[i].Key < status.Keys[j].Key
+	})
+
+	status.RemoveSafe = status.SafeToRemove(args.Key)
+	return status
+}
+
+// addKeyringMessage records an error reported by a node during a keyring
+// status query.
+func addKeyringMessage(status *structs.KeyringPoolStatus, node, msg string) {
+	if status.Messages == nil {
+		status.Messages = make(map[string]string)
+	}
+	status.Messages[node] = msg
+}
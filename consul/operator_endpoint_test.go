@@ -1,6 +1,7 @@
 package consul
 
 import (
+	"encoding/base64"
 	"fmt"
 	"os"
 	"reflect"
@@ -10,6 +11,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/lib"
 	"github.com/hashicorp/consul/testutil"
 	"github.com/hashicorp/net-rpc-msgpackrpc"
 	"github.com/hashicorp/raft"
@@ -246,6 +248,135 @@ func TestOperator_RaftRemovePeerByAddress_ACLDeny(t *testing.T) {
 	}
 }
 
+func TestOperator_ACLAreas(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+		c.RaftConfig.ProtocolVersion = 3
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Each call needs one area of the operator policy.
+	type call struct {
+		area   string
+		method string
+		args   func(token string) interface{}
+		reply  func() interface{}
+	}
+	dcArgs := func(token string) interface{} {
+		return &structs.DCSpecificRequest{
+			Datacenter:   "dc1",
+			QueryOptions: structs.QueryOptions{Token: token},
+		}
+	}
+	calls := []call{
+		{"raft:read", "Operator.RaftGetConfiguration", dcArgs,
+			func() interface{} { return new(structs.RaftConfigurationResponse) }},
+		{"raft:read", "Operator.RemovalImpact",
+			func(token string) interface{} {
+				return &structs.RemovalImpactRequest{
+					Datacenter:   "dc1",
+					ID:           "nope",
+					QueryOptions: structs.QueryOptions{Token: token},
+				}
+			},
+			func() interface{} { return new(structs.RemovalImpactReply) }},
+		{"raft:write", "Operator.RaftRemovePeerByAddress",
+			func(token string) interface{} {
+				return &structs.RaftPeerByAddressRequest{
+					Datacenter:   "dc1",
+					Address:      "127.0.0.1:1",
+					WriteRequest: structs.WriteRequest{Token: token},
+				}
+			},
+			func() interface{} { return new(struct{}) }},
+		{"autopilot:read", "Operator.AutopilotGetConfiguration", dcArgs,
+			func() interface{} { return new(structs.AutopilotConfig) }},
+		{"autopilot:read", "Operator.ServerHealth", dcArgs,
+			func() interface{} { return new(structs.OperatorHealthReply) }},
+		{"autopilot:write", "Operator.AutopilotSetConfiguration",
+			func(token string) interface{} {
+				return &structs.AutopilotSetConfigRequest{
+					Datacenter: "dc1",
+					Config: structs.AutopilotConfig{
+						CleanupDeadServers: true,
+					},
+					WriteRequest: structs.WriteRequest{Token: token},
+				}
+			},
+			func() interface{} { return new(bool) }},
+		{"keyring:read", "Operator.KeyringStatus",
+			func(token string) interface{} {
+				return &structs.KeyringStatusRequest{
+					Datacenter:   "dc1",
+					QueryOptions: structs.QueryOptions{Token: token},
+				}
+			},
+			func() interface{} { return new(structs.KeyringStatusResponse) }},
+		{"keyring:read", "Internal.KeyringOperation",
+			func(token string) interface{} {
+				return &structs.KeyringRequest{
+					Datacenter:   "dc1",
+					Operation:    structs.KeyringList,
+					QueryOptions: structs.QueryOptions{Token: token},
+				}
+			},
+			func() interface{} { return new(structs.KeyringResponses) }},
+		{"keyring:write", "Internal.KeyringOperation",
+			func(token string) interface{} {
+				return &structs.KeyringRequest{
+					Datacenter:   "dc1",
+					Operation:    structs.KeyringRemove,
+					Key:          "nope",
+					QueryOptions: structs.QueryOptions{Token: token},
+				}
+			},
+			func() interface{} { return new(structs.KeyringResponses) }},
+	}
+
+	// Mint a token for each capability, plus the old operator rule, and
+	// note which areas each one should get into.
+	cases := []struct {
+		rules   string
+		allowed []string
+	}{
+		{`operator_raft = "read"`, []string{"raft:read"}},
+		{`operator_raft = "write"`, []string{"raft:read", "raft:write"}},
+		{`operator_autopilot = "read"`, []string{"autopilot:read"}},
+		{`operator_autopilot = "write"`, []string{"autopilot:read", "autopilot:write"}},
+		{`keyring = "read"`, []string{"keyring:read"}},
+		{`keyring = "write"`, []string{"keyring:read", "keyring:write"}},
+		{`operator = "read"`, []string{"raft:read", "autopilot:read"}},
+		{`operator = "write"`, []string{"raft:read", "raft:write", "autopilot:read", "autopilot:write"}},
+		{`operator = "write"
+operator_raft = "read"`, []string{"raft:read", "autopilot:read", "autopilot:write"}},
+	}
+	for _, c := range cases {
+		token := makeTestToken(t, codec, c.rules, 0)
+		allowed := make(map[string]bool)
+		for _, area := range c.allowed {
+			allowed[area] = true
+		}
+
+		for _, call := range calls {
+			// The calls can fail for other reasons, like the made up
+			// peer address, but they shouldn't be denied unless the
+			// token doesn't cover their area.
+			err := msgpackrpc.CallWithCodec(codec, call.method, call.args(token), call.reply())
+			denied := err != nil && strings.Contains(err.Error(), "denied")
+			if denied == allowed[call.area] {
+				t.Fatalf("%q calling %s (%s): %v", c.rules, call.method, call.area, err)
+			}
+		}
+	}
+}
+
 func TestOperator_Autopilot_GetConfiguration(t *testing.T) {
 	dir1, s1 := testServerWithConfig(t, func(c *Config) {
 		c.AutopilotConfig.CleanupDeadServers = false
@@ -429,90 +560,2029 @@ func TestOperator_Autopilot_SetConfiguration_ACLDeny(t *testing.T) {
 	}
 }
 
-func TestOperator_ServerHealth(t *testing.T) {
-	conf := func(c *Config) {
-		c.Datacenter = "dc1"
-		c.Bootstrap = false
-		c.BootstrapExpect = 3
-		c.RaftConfig.ProtocolVersion = 3
-		c.ServerHealthInterval = 100 * time.Millisecond
-		c.AutopilotInterval = 100 * time.Millisecond
+func TestOperator_QueryDefaults(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Should start out empty.
+	getArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
 	}
-	dir1, s1 := testServerWithConfig(t, conf)
+	var reply structs.QueryDefaults
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.QueryDefaultsGetConfiguration", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.AllowStale || reply.MaxQueryTime != 0 || reply.Near != "" {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	// Bad wait times should be rejected.
+	arg := structs.QueryDefaultsSetRequest{
+		Datacenter: "dc1",
+		Defaults: structs.QueryDefaults{
+			MaxQueryTime: time.Hour,
+		},
+	}
+	var out struct{}
+	err := msgpackrpc.CallWithCodec(codec, "Operator.QueryDefaultsSetConfiguration", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "MaxQueryTime must be") {
+		t.Fatalf("err: %v", err)
+	}
+
+	arg.Defaults = structs.QueryDefaults{
+		AllowStale:   true,
+		MaxQueryTime: 2 * time.Minute,
+		Near:         s1.config.NodeName,
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.QueryDefaultsSetConfiguration", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var reply2 structs.QueryDefaults
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.QueryDefaultsGetConfiguration", &getArg, &reply2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reply2.AllowStale || reply2.MaxQueryTime != 2*time.Minute || reply2.Near != s1.config.NodeName {
+		t.Fatalf("bad: %#v", reply2)
+	}
+}
+
+func TestOperator_QueryDefaults_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
 	defer os.RemoveAll(dir1)
 	defer s1.Shutdown()
 	codec := rpcClient(t, s1)
 	defer codec.Close()
 
-	dir2, s2 := testServerWithConfig(t, conf)
-	defer os.RemoveAll(dir2)
-	defer s2.Shutdown()
-	addr := fmt.Sprintf("127.0.0.1:%d",
-		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
-	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Reading and writing should both be denied without a token.
+	getArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.QueryDefaults
+	err := msgpackrpc.CallWithCodec(codec, "Operator.QueryDefaultsGetConfiguration", &getArg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	arg := structs.QueryDefaultsSetRequest{
+		Datacenter: "dc1",
+		Defaults: structs.QueryDefaults{
+			AllowStale: true,
+		},
+	}
+	var out struct{}
+	err = msgpackrpc.CallWithCodec(codec, "Operator.QueryDefaultsSetConfiguration", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
 		t.Fatalf("err: %v", err)
 	}
 
-	dir3, s3 := testServerWithConfig(t, conf)
-	defer os.RemoveAll(dir3)
-	defer s3.Shutdown()
-	if _, err := s3.JoinLAN([]string{addr}); err != nil {
+	// The master token can do both.
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.QueryDefaultsSetConfiguration", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	getArg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.QueryDefaultsGetConfiguration", &getArg, &reply); err != nil {
 		t.Fatalf("err: %v", err)
 	}
+	if !reply.AllowStale {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestOperator_QueryFreeze(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
 
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
-	if err := testutil.WaitForResult(func() (bool, error) {
-		arg := structs.DCSpecificRequest{
-			Datacenter: "dc1",
-		}
-		var reply structs.OperatorHealthReply
-		err := msgpackrpc.CallWithCodec(codec, "Operator.ServerHealth", &arg, &reply)
-		if err != nil {
-			return false, fmt.Errorf("err: %v", err)
-		}
-		if !reply.Healthy {
-			return false, fmt.Errorf("bad: %v", reply)
-		}
-		if reply.FailureTolerance != 1 {
-			return false, fmt.Errorf("bad: %v", reply)
-		}
-		if len(reply.Servers) != 3 {
-			return false, fmt.Errorf("bad: %v", reply)
-		}
-		// Leader should have LastContact == 0, others should be positive
-		for _, s := range reply.Servers {
-			isLeader := s1.raft.Leader() == raft.ServerAddress(s.Address)
-			if isLeader && s.LastContact != 0 {
-				return false, fmt.Errorf("bad: %v", reply)
-			}
-			if !isLeader && s.LastContact <= 0 {
-				return false, fmt.Errorf("bad: %v", reply)
-			}
-		}
-		return true, nil
-	}); err != nil {
-		t.Fatal(err)
+	// Should start out unfrozen.
+	getArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.QueryFreeze
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.QueryFreezeGet", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Frozen || reply.SetBy != "" {
+		t.Fatalf("bad: %#v", reply)
+	}
+	if s1.Stats()["consul"]["query_frozen"] != "false" {
+		t.Fatalf("bad: %v", s1.Stats()["consul"])
+	}
+
+	// We need to know who's setting it.
+	arg := structs.QueryFreezeRequest{
+		Datacenter: "dc1",
+		Freeze: structs.QueryFreeze{
+			Frozen: true,
+			Reason: "incident",
+		},
+	}
+	var out struct{}
+	err := msgpackrpc.CallWithCodec(codec, "Operator.QueryFreezeSet", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "Must say who") {
+		t.Fatalf("err: %v", err)
+	}
+
+	start := time.Now().UTC()
+	arg.Freeze.SetBy = "alice"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.QueryFreezeSet", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.QueryFreezeGet", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reply.Frozen || reply.SetBy != "alice" || reply.Reason != "incident" || reply.SetAt.Before(start.Add(-time.Second)) {
+		t.Fatalf("bad: %#v", reply)
+	}
+	stats := s1.Stats()["consul"]
+	if stats["query_frozen"] != "true" || stats["query_frozen_by"] != "alice" || stats["query_frozen_at"] == "" {
+		t.Fatalf("bad: %v", stats)
+	}
+
+	// Clear it.
+	arg.Freeze = structs.QueryFreeze{SetBy: "bob"}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.QueryFreezeSet", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.QueryFreezeGet", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Frozen || reply.SetBy != "bob" {
+		t.Fatalf("bad: %#v", reply)
+	}
+	if s1.Stats()["consul"]["query_frozen"] != "false" {
+		t.Fatalf("bad: %v", s1.Stats()["consul"])
 	}
 }
 
-func TestOperator_ServerHealth_UnsupportedRaftVersion(t *testing.T) {
+func TestOperator_QueryFreeze_ACLDeny(t *testing.T) {
 	dir1, s1 := testServerWithConfig(t, func(c *Config) {
-		c.Datacenter = "dc1"
-		c.Bootstrap = true
-		c.RaftConfig.ProtocolVersion = 2
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
 	})
 	defer os.RemoveAll(dir1)
 	defer s1.Shutdown()
 	codec := rpcClient(t, s1)
 	defer codec.Close()
 
-	arg := structs.DCSpecificRequest{
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Reading and writing should both be denied without a token.
+	getArg := structs.DCSpecificRequest{
 		Datacenter: "dc1",
 	}
-	var reply structs.OperatorHealthReply
-	err := msgpackrpc.CallWithCodec(codec, "Operator.ServerHealth", &arg, &reply)
-	if err == nil || !strings.Contains(err.Error(), "raft_protocol set to 3 or higher") {
-		t.Fatalf("bad: %v", err)
+	var reply structs.QueryFreeze
+	err := msgpackrpc.CallWithCodec(codec, "Operator.QueryFreezeGet", &getArg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	arg := structs.QueryFreezeRequest{
+		Datacenter: "dc1",
+		Freeze: structs.QueryFreeze{
+			Frozen: true,
+			SetBy:  "alice",
+		},
+	}
+	var out struct{}
+	err = msgpackrpc.CallWithCodec(codec, "Operator.QueryFreezeSet", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The master token can do both.
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.QueryFreezeSet", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	getArg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.QueryFreezeGet", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reply.Frozen {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestOperator_RemoteWritePolicy(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.RefuseRemoteWrites = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// The policy should have been set up from the config.
+	getArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.RemoteWritePolicy
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.RemoteWritePolicyGet", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reply.RefuseRemoteWrites {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	// Turn it off.
+	arg := structs.RemoteWritePolicyRequest{
+		Datacenter: "dc1",
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.RemoteWritePolicySet", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.RemoteWritePolicyGet", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.RefuseRemoteWrites {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestOperator_RemoteWritePolicy_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Reading and writing should both be denied without a token.
+	getArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.RemoteWritePolicy
+	err := msgpackrpc.CallWithCodec(codec, "Operator.RemoteWritePolicyGet", &getArg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	arg := structs.RemoteWritePolicyRequest{
+		Datacenter: "dc1",
+		Policy: structs.RemoteWritePolicy{
+			RefuseRemoteWrites: true,
+		},
+	}
+	var out struct{}
+	err = msgpackrpc.CallWithCodec(codec, "Operator.RemoteWritePolicySet", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The master token can do both.
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.RemoteWritePolicySet", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	getArg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.RemoteWritePolicyGet", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reply.RefuseRemoteWrites {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestOperator_ServiceNamePolicy(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// There shouldn't be a policy yet.
+	getArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.ServiceNamePolicy
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceNamePolicyGet", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Enabled || reply.ModifyIndex != 0 {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	// Bad requests should be rejected.
+	var out struct{}
+	cases := []structs.ServiceNamePolicyRequest{
+		{Op: "nope"},
+		{Op: structs.ServiceNamePolicySet, Policy: structs.ServiceNamePolicy{Names: []string{""}}},
+		{Op: structs.ServiceNamePolicySet, Policy: structs.ServiceNamePolicy{Prefixes: []string{""}}},
+	}
+	for i, arg := range cases {
+		arg.Datacenter = "dc1"
+		if err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceNamePolicyApply", &arg, &out); err == nil {
+			t.Fatalf("case %d: expected an error", i)
+		}
+	}
+
+	// Set it, picking up the consul service that's already registered.
+	arg := structs.ServiceNamePolicyRequest{
+		Datacenter: "dc1",
+		Op:         structs.ServiceNamePolicySet,
+		Policy: structs.ServiceNamePolicy{
+			Enabled:  true,
+			Names:    []string{"web"},
+			Prefixes: []string{"batch-"},
+		},
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceNamePolicyApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceNamePolicyGet", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reply.Enabled || !reflect.DeepEqual(reply.Names, arg.Policy.Names) ||
+		!reflect.DeepEqual(reply.Prefixes, arg.Policy.Prefixes) ||
+		!reflect.DeepEqual(reply.Existing, []string{"consul"}) {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	// Delete it.
+	arg.Op = structs.ServiceNamePolicyDelete
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceNamePolicyApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reply = structs.ServiceNamePolicy{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceNamePolicyGet", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Enabled || reply.ModifyIndex != 0 {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestOperator_ServiceNamePolicy_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Reading and writing should both be denied without a token.
+	getArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.ServiceNamePolicy
+	err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceNamePolicyGet", &getArg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	arg := structs.ServiceNamePolicyRequest{
+		Datacenter: "dc1",
+		Op:         structs.ServiceNamePolicySet,
+		Policy: structs.ServiceNamePolicy{
+			Enabled: true,
+		},
+	}
+	var out struct{}
+	err = msgpackrpc.CallWithCodec(codec, "Operator.ServiceNamePolicyApply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The master token can do both.
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceNamePolicyApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	getArg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceNamePolicyGet", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reply.Enabled {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestOperator_DatacenterAlias(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Bad requests should be rejected.
+	cases := []struct {
+		op       structs.DatacenterAliasOp
+		alias    structs.DatacenterAlias
+		expected string
+	}{
+		{structs.DatacenterAliasSet, structs.DatacenterAlias{Alias: "dc-old"}, "Must provide"},
+		{structs.DatacenterAliasSet, structs.DatacenterAlias{Alias: "dc1", Canonical: "dc2"}, "Cannot alias"},
+		{structs.DatacenterAliasDelete, structs.DatacenterAlias{}, "Must provide"},
+		{"nope", structs.DatacenterAlias{Alias: "dc-old"}, "Invalid datacenter alias operation"},
+	}
+	for _, tc := range cases {
+		arg := structs.DatacenterAliasRequest{
+			Datacenter: "dc1",
+			Op:         tc.op,
+			Alias:      tc.alias,
+		}
+		var out struct{}
+		err := msgpackrpc.CallWithCodec(codec, "Operator.DatacenterAliasApply", &arg, &out)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Add an alias.
+	arg := structs.DatacenterAliasRequest{
+		Datacenter: "dc1",
+		Op:         structs.DatacenterAliasSet,
+		Alias: structs.DatacenterAlias{
+			Alias:     "dc-old",
+			Canonical: "dc2",
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.DatacenterAliasApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Chains and cycles should be rejected.
+	for _, alias := range []structs.DatacenterAlias{
+		structs.DatacenterAlias{Alias: "dc-older", Canonical: "dc-old"},
+		structs.DatacenterAlias{Alias: "dc2", Canonical: "dc-old"},
+		structs.DatacenterAlias{Alias: "dc2", Canonical: "dc3"},
+	} {
+		arg.Alias = alias
+		err := msgpackrpc.CallWithCodec(codec, "Operator.DatacenterAliasApply", &arg, &out)
+		if err == nil || !strings.Contains(err.Error(), "Datacenter alias") {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	getArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.IndexedDatacenterAliases
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.DatacenterAliasList", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Index == 0 || len(reply.Aliases) != 1 ||
+		reply.Aliases[0].Alias != "dc-old" || reply.Aliases[0].Canonical != "dc2" {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	// Now delete it.
+	arg.Op = structs.DatacenterAliasDelete
+	arg.Alias = structs.DatacenterAlias{Alias: "dc-old"}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.DatacenterAliasApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var reply2 structs.IndexedDatacenterAliases
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.DatacenterAliasList", &getArg, &reply2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply2.Index <= reply.Index || len(reply2.Aliases) != 0 {
+		t.Fatalf("bad: %#v", reply2)
+	}
+}
+
+func TestOperator_DatacenterAlias_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Reading and writing should both be denied without a token.
+	getArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.IndexedDatacenterAliases
+	err := msgpackrpc.CallWithCodec(codec, "Operator.DatacenterAliasList", &getArg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	arg := structs.DatacenterAliasRequest{
+		Datacenter: "dc1",
+		Op:         structs.DatacenterAliasSet,
+		Alias: structs.DatacenterAlias{
+			Alias:     "dc-old",
+			Canonical: "dc2",
+		},
+	}
+	var out struct{}
+	err = msgpackrpc.CallWithCodec(codec, "Operator.DatacenterAliasApply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The master token can do both.
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.DatacenterAliasApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	getArg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.DatacenterAliasList", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Aliases) != 1 {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestOperator_DatacenterAlias_Forwarding(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerDC(t, "dc2")
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+	codec2 := rpcClient(t, s2)
+	defer codec2.Close()
+
+	// Join the servers.
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s2.RPC, "dc2")
+
+	// Write a key in dc2.
+	kv := structs.KVSRequest{
+		Datacenter: "dc2",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "foo",
+			Value: []byte("bar"),
+		},
+	}
+	var ok bool
+	if err := msgpackrpc.CallWithCodec(codec2, "KVS.Apply", &kv, &ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Reads using the old name should fail before there's an alias.
+	get := structs.KeyRequest{
+		Datacenter: "dc-old",
+		Key:        "foo",
+	}
+	var entries structs.IndexedDirEntries
+	err := msgpackrpc.CallWithCodec(codec, "KVS.Get", &get, &entries)
+	if err == nil || err.Error() != structs.ErrNoDCPath.Error() {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Alias the old name in dc1.
+	arg := structs.DatacenterAliasRequest{
+		Datacenter: "dc1",
+		Op:         structs.DatacenterAliasSet,
+		Alias: structs.DatacenterAlias{
+			Alias:     "dc-old",
+			Canonical: "dc2",
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.DatacenterAliasApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Now the read should make it to dc2, which doesn't know about the
+	// alias, and the reply should have the canonical name.
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Get", &get, &entries); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries.Entries) != 1 || string(entries.Entries[0].Value) != "bar" {
+		t.Fatalf("bad: %#v", entries)
+	}
+	if entries.ResolvedDatacenter != "dc2" || !entries.Forwarded {
+		t.Fatalf("bad: %#v", entries.ReplyMeta)
+	}
+}
+
+func TestOperator_FederationPolicy(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Bad requests should be rejected.
+	cases := []struct {
+		op       structs.FederationPolicyOp
+		policy   structs.FederationPolicy
+		expected string
+	}{
+		{structs.FederationPolicySet, structs.FederationPolicy{Forwarding: structs.FederationForwardNone}, "Must provide"},
+		{structs.FederationPolicySet, structs.FederationPolicy{Datacenter: "dc1", Forwarding: structs.FederationForwardNone}, "Cannot set"},
+		{structs.FederationPolicySet, structs.FederationPolicy{Datacenter: "dc2", Forwarding: "writes"}, "Invalid federation forwarding"},
+		{structs.FederationPolicyDelete, structs.FederationPolicy{}, "Must provide"},
+		{"nope", structs.FederationPolicy{Datacenter: "dc2"}, "Invalid federation policy operation"},
+	}
+	for _, tc := range cases {
+		arg := structs.FederationPolicyRequest{
+			Datacenter: "dc1",
+			Op:         tc.op,
+			Policy:     tc.policy,
+		}
+		var out struct{}
+		err := msgpackrpc.CallWithCodec(codec, "Operator.FederationPolicyApply", &arg, &out)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Alias an old name for dc2, then set a policy using it, which should
+	// end up under the canonical name.
+	alias := structs.DatacenterAliasRequest{
+		Datacenter: "dc1",
+		Op:         structs.DatacenterAliasSet,
+		Alias: structs.DatacenterAlias{
+			Alias:     "dc-old",
+			Canonical: "dc2",
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.DatacenterAliasApply", &alias, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg := structs.FederationPolicyRequest{
+		Datacenter: "dc1",
+		Op:         structs.FederationPolicySet,
+		Policy: structs.FederationPolicy{
+			Datacenter: "dc-old",
+			Forwarding: structs.FederationForwardReads,
+		},
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.FederationPolicyApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	getArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.IndexedFederationPolicies
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.FederationPolicyList", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Index == 0 || len(reply.Policies) != 1 ||
+		reply.Policies[0].Datacenter != "dc2" ||
+		reply.Policies[0].Forwarding != structs.FederationForwardReads {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	// Now delete it.
+	arg.Op = structs.FederationPolicyDelete
+	arg.Policy = structs.FederationPolicy{Datacenter: "dc2"}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.FederationPolicyApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var reply2 structs.IndexedFederationPolicies
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.FederationPolicyList", &getArg, &reply2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply2.Index <= reply.Index || len(reply2.Policies) != 0 {
+		t.Fatalf("bad: %#v", reply2)
+	}
+}
+
+func TestOperator_FederationPolicy_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Reading and writing should both be denied without a token.
+	getArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.IndexedFederationPolicies
+	err := msgpackrpc.CallWithCodec(codec, "Operator.FederationPolicyList", &getArg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	arg := structs.FederationPolicyRequest{
+		Datacenter: "dc1",
+		Op:         structs.FederationPolicySet,
+		Policy: structs.FederationPolicy{
+			Datacenter: "dc2",
+			Forwarding: structs.FederationForwardNone,
+		},
+	}
+	var out struct{}
+	err = msgpackrpc.CallWithCodec(codec, "Operator.FederationPolicyApply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The master token can do both.
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.FederationPolicyApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	getArg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.FederationPolicyList", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Policies) != 1 {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestOperator_ServiceConstraint(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Bad requests should be rejected.
+	cases := []struct {
+		op         structs.ServiceConstraintOp
+		constraint structs.ServiceConstraint
+		expected   string
+	}{
+		{structs.ServiceConstraintSet, structs.ServiceConstraint{MetaKeys: []string{"protocol"}}, "Must provide a service name"},
+		{structs.ServiceConstraintSet, structs.ServiceConstraint{Service: "web"}, "Must provide at least one meta key"},
+		{structs.ServiceConstraintSet, structs.ServiceConstraint{Service: "web", MetaKeys: []string{""}}, "can't be empty"},
+		{structs.ServiceConstraintDelete, structs.ServiceConstraint{}, "Must provide"},
+		{"nope", structs.ServiceConstraint{Service: "web"}, "Invalid service constraint operation"},
+	}
+	for _, tc := range cases {
+		arg := structs.ServiceConstraintRequest{
+			Datacenter: "dc1",
+			Op:         tc.op,
+			Constraint: tc.constraint,
+		}
+		var out struct{}
+		err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceConstraintApply", &arg, &out)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Add a constraint.
+	arg := structs.ServiceConstraintRequest{
+		Datacenter: "dc1",
+		Op:         structs.ServiceConstraintSet,
+		Constraint: structs.ServiceConstraint{
+			Service:  "web",
+			MetaKeys: []string{"protocol"},
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceConstraintApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	getArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.IndexedServiceConstraints
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceConstraintList", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Index == 0 || len(reply.Constraints) != 1 || reply.Constraints[0].Service != "web" ||
+		!reflect.DeepEqual(reply.Constraints[0].MetaKeys, []string{"protocol"}) {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	// Now delete it.
+	arg.Op = structs.ServiceConstraintDelete
+	arg.Constraint = structs.ServiceConstraint{Service: "web"}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceConstraintApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var reply2 structs.IndexedServiceConstraints
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceConstraintList", &getArg, &reply2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply2.Index <= reply.Index || len(reply2.Constraints) != 0 {
+		t.Fatalf("bad: %#v", reply2)
+	}
+}
+
+func TestOperator_ServiceConstraint_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Reading and writing should both be denied without a token.
+	getArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.IndexedServiceConstraints
+	err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceConstraintList", &getArg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	arg := structs.ServiceConstraintRequest{
+		Datacenter: "dc1",
+		Op:         structs.ServiceConstraintSet,
+		Constraint: structs.ServiceConstraint{
+			Service:  "web",
+			MetaKeys: []string{"protocol"},
+		},
+	}
+	var out struct{}
+	err = msgpackrpc.CallWithCodec(codec, "Operator.ServiceConstraintApply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The master token can do both.
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceConstraintApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	getArg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServiceConstraintList", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Constraints) != 1 {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestOperator_NodeBlock(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Bad requests should be rejected.
+	var out struct{}
+	bad := []structs.NodeBlockRequest{
+		{Datacenter: "dc1", Op: structs.NodeBlockSet},
+		{Datacenter: "dc1", Op: structs.NodeBlockSet, Block: structs.NodeBlock{Node: "foo", ID: "nope"}},
+		{Datacenter: "dc1", Op: structs.NodeBlockClear},
+		{Datacenter: "dc1", Op: "nope", Block: structs.NodeBlock{Node: "foo"}},
+	}
+	for _, arg := range bad {
+		if err := msgpackrpc.CallWithCodec(codec, "Operator.NodeBlockApply", &arg, &out); err == nil {
+			t.Fatalf("should fail: %#v", arg)
+		}
+	}
+
+	// Block a node that was never registered.
+	arg := structs.NodeBlockRequest{
+		Datacenter: "dc1",
+		Op:         structs.NodeBlockSet,
+		Block: structs.NodeBlock{
+			Node: "foo",
+		},
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.NodeBlockApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	getArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.IndexedNodeBlocks
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.NodeBlockList", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Blocks) != 1 || reply.Blocks[0].Node != "foo" {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	// Clear it.
+	arg.Op = structs.NodeBlockClear
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.NodeBlockApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.NodeBlockList", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Blocks) != 0 {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestOperator_NodeBlock_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Reading and writing should both be denied without a token.
+	getArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.IndexedNodeBlocks
+	err := msgpackrpc.CallWithCodec(codec, "Operator.NodeBlockList", &getArg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	arg := structs.NodeBlockRequest{
+		Datacenter: "dc1",
+		Op:         structs.NodeBlockSet,
+		Block: structs.NodeBlock{
+			Node: "foo",
+		},
+	}
+	var out struct{}
+	err = msgpackrpc.CallWithCodec(codec, "Operator.NodeBlockApply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Putting a block on through a deregister needs node write access.
+	dereg := structs.DeregisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Block:      true,
+	}
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Deregister", &dereg, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The master token can do all of it.
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.NodeBlockApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dereg.Node = "bar"
+	dereg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Deregister", &dereg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	getArg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.NodeBlockList", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Blocks) != 2 {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestOperator_KVQuota(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Bad requests should be rejected.
+	var out struct{}
+	bad := []structs.KVQuotaRequest{
+		{Datacenter: "dc1", Op: structs.KVQuotaSet, Quota: structs.KVQuota{MaxKeys: 1}},
+		{Datacenter: "dc1", Op: structs.KVQuotaSet, Quota: structs.KVQuota{Prefix: "foo/"}},
+		{Datacenter: "dc1", Op: structs.KVQuotaSet, Quota: structs.KVQuota{Prefix: "foo/", MaxKeys: -1}},
+		{Datacenter: "dc1", Op: structs.KVQuotaDelete},
+		{Datacenter: "dc1", Op: "nope", Quota: structs.KVQuota{Prefix: "foo/"}},
+	}
+	for _, arg := range bad {
+		if err := msgpackrpc.CallWithCodec(codec, "Operator.KVQuotaApply", &arg, &out); err == nil {
+			t.Fatalf("should fail: %#v", arg)
+		}
+	}
+
+	// Set a small quota.
+	arg := structs.KVQuotaRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVQuotaSet,
+		Quota: structs.KVQuota{
+			Prefix:   "team/",
+			MaxKeys:  2,
+			MaxBytes: 100,
+		},
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.KVQuotaApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Fill it up.
+	set := func(key string) error {
+		req := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Value: []byte("test"),
+			},
+		}
+		var ok bool
+		return msgpackrpc.CallWithCodec(codec, "KVS.Apply", &req, &ok)
+	}
+	for _, key := range []string{"team/a", "team/b"} {
+		if err := set(key); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The usage should be reported along with the limits.
+	getArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.IndexedKVQuotas
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.KVQuotaList", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Quotas) != 1 || reply.Quotas[0].MaxKeys != 2 ||
+		reply.Quotas[0].Usage != (structs.KVQuotaUsage{Keys: 2, Bytes: 8}) {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	// Writes over the quota should be refused, through a KV apply or a
+	// transaction.
+	err := set("team/c")
+	if !structs.HasErrorCode(err, structs.ErrCodeKVQuotaExceeded) || !strings.Contains(err.Error(), `"team/"`) {
+		t.Fatalf("err: %v", err)
+	}
+	txn := structs.TxnRequest{
+		Datacenter: "dc1",
+		Ops: structs.TxnOps{
+			&structs.TxnOp{
+				KV: &structs.TxnKVOp{
+					Verb: structs.KVSSet,
+					DirEnt: structs.DirEntry{
+						Key: "team/c",
+					},
+				},
+			},
+		},
+	}
+	var txnOut structs.TxnResponse
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &txn, &txnOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(txnOut.Errors) != 1 || !structs.HasErrorCode(txnOut.Errors[0], structs.ErrCodeKVQuotaExceeded) {
+		t.Fatalf("bad: %#v", txnOut)
+	}
+
+	// Deletes still work, and make room for more writes.
+	del := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSDelete,
+		DirEnt: structs.DirEntry{
+			Key: "team/a",
+		},
+	}
+	var ok bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &del, &ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := set("team/c"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := set("team/d"); !structs.HasErrorCode(err, structs.ErrCodeKVQuotaExceeded) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Delete the quota, which lifts the limit.
+	arg.Op = structs.KVQuotaDelete
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.KVQuotaApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := set("team/d"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.KVQuotaList", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Quotas) != 0 {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestOperator_KVQuota_OldServers(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Make it look like a server that doesn't know about quotas.
+	tags := make(map[string]string)
+	for k, v := range s1.serfLAN.LocalMember().Tags {
+		tags[k] = v
+	}
+	delete(tags, featureKVQuotaTag)
+	if err := s1.serfLAN.SetTags(tags); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	arg := structs.KVQuotaRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVQuotaSet,
+		Quota: structs.KVQuota{
+			Prefix:  "team/",
+			MaxKeys: 1,
+		},
+	}
+	var out struct{}
+	err := msgpackrpc.CallWithCodec(codec, "Operator.KVQuotaApply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "must be upgraded") {
+		t.Fatalf("err: %v", err)
+	}
+	_, quotas, err := s1.fsm.State().KVQuotaList(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(quotas) != 0 {
+		t.Fatalf("bad: %v", quotas)
+	}
+
+	// Once it's upgraded the quota can be set.
+	tags[featureKVQuotaTag] = "1"
+	if err := s1.serfLAN.SetTags(tags); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.KVQuotaApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestOperator_KVQuota_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Reading and writing should both be denied without a token.
+	getArg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.IndexedKVQuotas
+	err := msgpackrpc.CallWithCodec(codec, "Operator.KVQuotaList", &getArg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	arg := structs.KVQuotaRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVQuotaSet,
+		Quota: structs.KVQuota{
+			Prefix:  "team/",
+			MaxKeys: 1,
+		},
+	}
+	var out struct{}
+	err = msgpackrpc.CallWithCodec(codec, "Operator.KVQuotaApply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The master token can do both.
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.KVQuotaApply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	getArg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.KVQuotaList", &getArg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Quotas) != 1 {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestOperator_ServerHistory(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Add a peer manually and have an operator remove it.
+	addr := raft.ServerAddress(fmt.Sprintf("127.0.0.1:%d", getPort()))
+	if err := s1.raft.AddPeer(addr).Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	remove := structs.RaftPeerByAddressRequest{
+		Datacenter: "dc1",
+		Address:    addr,
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.RaftRemovePeerByAddress", &remove, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Record a couple more so there's something to page through.
+	s1.recordServerEvent("server2", "127.0.0.2:8300", structs.ServerEventAdded,
+		"joined as a voter", structs.ServerEventByLeader)
+	s1.recordServerEvent("server2", "127.0.0.2:8300", structs.ServerEventDemoted,
+		"failed for 10s", structs.ServerEventByAutopilot)
+
+	arg := structs.ServerHistoryRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.IndexedServerHistory
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServerHistory", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Index == 0 || reply.Next != 0 || len(reply.Events) != 3 {
+		t.Fatalf("bad: %#v", reply)
+	}
+	removed := reply.Events[0]
+	if removed.Address != string(addr) ||
+		removed.Action != structs.ServerEventRemoved ||
+		removed.Initiator != structs.ServerEventByOperator ||
+		removed.Time.IsZero() {
+		t.Fatalf("bad: %#v", removed)
+	}
+
+	// Page through them one at a time.
+	var actions []structs.ServerEventAction
+	arg.Limit = 1
+	for {
+		var reply structs.IndexedServerHistory
+		if err := msgpackrpc.CallWithCodec(codec, "Operator.ServerHistory", &arg, &reply); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(reply.Events) != 1 {
+			t.Fatalf("bad: %#v", reply)
+		}
+		actions = append(actions, reply.Events[0].Action)
+		if reply.Next == 0 {
+			break
+		}
+		arg.After = reply.Next
+	}
+	expected := []structs.ServerEventAction{
+		structs.ServerEventRemoved,
+		structs.ServerEventAdded,
+		structs.ServerEventDemoted,
+	}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Fatalf("bad: %v", actions)
+	}
+}
+
+func TestOperator_ServerHistory_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Make a request with no token to make sure it gets denied.
+	arg := structs.ServerHistoryRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.IndexedServerHistory
+	err := msgpackrpc.CallWithCodec(codec, "Operator.ServerHistory", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Create an ACL with operator read permissions.
+	var token string
+	{
+		var rules = `
+                    operator = "read"
+                `
+
+		req := structs.ACLRequest{
+			Datacenter: "dc1",
+			Op:         structs.ACLSet,
+			ACL: structs.ACL{
+				Name:  "User token",
+				Type:  structs.ACLTypeClient,
+				Rules: rules,
+			},
+			WriteRequest: structs.WriteRequest{Token: "root"},
+		}
+		if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &req, &token); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Now it should go through.
+	arg.Token = token
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.ServerHistory", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestOperator_QueryDefaults_Applied(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s2.RPC, "dc1")
+
+	codec := rpcClient(t, s2)
+	defer codec.Close()
+
+	// Make all reads stale by default, with a short blocking wait.
+	arg := structs.QueryDefaultsSetRequest{
+		Datacenter: "dc1",
+		Defaults: structs.QueryDefaults{
+			AllowStale:   true,
+			MaxQueryTime: 100 * time.Millisecond,
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.QueryDefaultsSetConfiguration", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		_, d, err := s2.fsm.State().QueryDefaults(nil)
+		return d != nil, err
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Wait for both servers to be in the catalog so the node list doesn't
+	// change underneath the blocking queries below.
+	req := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		var out structs.IndexedNodes
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &req, &out); err != nil {
+			return false, err
+		}
+		return len(out.Nodes) == 2, fmt.Errorf("bad: %v", out.Nodes)
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A request that doesn't say anything should be answered by the
+	// follower, which reports its contact with the leader.
+	var staleOut structs.IndexedNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &req, &staleOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if staleOut.LastContact == 0 || staleOut.Forwarded || staleOut.Server != s2.config.NodeName {
+		t.Fatalf("bad: %#v", staleOut.QueryMeta)
+	}
+
+	// An explicitly consistent request should still go to the leader.
+	req.RequireConsistent = true
+	var consistentOut structs.IndexedNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &req, &consistentOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if consistentOut.LastContact != 0 || !consistentOut.Forwarded || consistentOut.ForwardedTo != s1.config.NodeName {
+		t.Fatalf("bad: %#v", consistentOut.QueryMeta)
+	}
+
+	// A blocking query without a wait time should use the default.
+	req.RequireConsistent = false
+	req.MinQueryIndex = staleOut.Index
+	start := time.Now()
+	var blockOut structs.IndexedNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &req, &blockOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("bad: %v", elapsed)
+	}
+
+	// A longer wait time should be clamped to the default.
+	req.MaxQueryTime = 10 * time.Minute
+	start = time.Now()
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &req, &blockOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("bad: %v", elapsed)
+	}
+}
+
+func TestOperator_ServerHealth(t *testing.T) {
+	conf := func(c *Config) {
+		c.Datacenter = "dc1"
+		c.Bootstrap = false
+		c.BootstrapExpect = 3
+		c.RaftConfig.ProtocolVersion = 3
+		c.ServerHealthInterval = 100 * time.Millisecond
+		c.AutopilotInterval = 100 * time.Millisecond
+	}
+	dir1, s1 := testServerWithConfig(t, conf)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerWithConfig(t, conf)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	dir3, s3 := testServerWithConfig(t, conf)
+	defer os.RemoveAll(dir3)
+	defer s3.Shutdown()
+	if _, err := s3.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	if err := testutil.WaitForResult(func() (bool, error) {
+		arg := structs.DCSpecificRequest{
+			Datacenter: "dc1",
+		}
+		var reply structs.OperatorHealthReply
+		err := msgpackrpc.CallWithCodec(codec, "Operator.ServerHealth", &arg, &reply)
+		if err != nil {
+			return false, fmt.Errorf("err: %v", err)
+		}
+		if !reply.Healthy {
+			return false, fmt.Errorf("bad: %v", reply)
+		}
+		if reply.FailureTolerance != 1 {
+			return false, fmt.Errorf("bad: %v", reply)
+		}
+		if len(reply.Servers) != 3 {
+			return false, fmt.Errorf("bad: %v", reply)
+		}
+		// Leader should have LastContact == 0, others should be positive
+		for _, s := range reply.Servers {
+			isLeader := s1.raft.Leader() == raft.ServerAddress(s.Address)
+			if isLeader && s.LastContact != 0 {
+				return false, fmt.Errorf("bad: %v", reply)
+			}
+			if !isLeader && s.LastContact <= 0 {
+				return false, fmt.Errorf("bad: %v", reply)
+			}
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOperator_ServerHealth_UnsupportedRaftVersion(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Datacenter = "dc1"
+		c.Bootstrap = true
+		c.RaftConfig.ProtocolVersion = 2
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	arg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.OperatorHealthReply
+	err := msgpackrpc.CallWithCodec(codec, "Operator.ServerHealth", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), "raft_protocol set to 3 or higher") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestOperator_WANStatus(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.OperatorWANStatusReply
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.WANStatus", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := structs.OperatorWANStatusReply{
+		Node:       s1.config.NodeName,
+		Status:     structs.WANStatusUp,
+		NumMembers: 1,
+	}
+	if !reflect.DeepEqual(reply, expected) {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestOperator_KeyringStatus(t *testing.T) {
+	key1 := "H1dfkSZOVnP/JUnaBfTzXg=="
+	keyBytes1, err := base64.StdEncoding.DecodeString(key1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	key2 := "4kxNJTC6qFs6SQgPfAvqEw=="
+	keyBytes2, err := base64.StdEncoding.DecodeString(key2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.SerfLANConfig.MemberlistConfig.SecretKey = keyBytes1
+		c.SerfWANConfig.MemberlistConfig.SecretKey = keyBytes1
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Bootstrap = false
+		c.SerfLANConfig.MemberlistConfig.SecretKey = keyBytes1
+		c.SerfWANConfig.MemberlistConfig.SecretKey = keyBytes1
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return len(s1.LANMembers()) == 2 && len(s2.LANMembers()) == 2, nil
+	}); err != nil {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Install the second key on the first server only.
+	if err := s1.config.SerfLANConfig.MemberlistConfig.Keyring.AddKey(keyBytes2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Removing the first key would cut off the second server.
+	arg := structs.KeyringStatusRequest{
+		Datacenter: "dc1",
+		Key:        key1,
+	}
+	var reply structs.KeyringStatusResponse
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.KeyringStatus", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.RemoveSafe {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	var lan, wan *structs.KeyringPoolStatus
+	for _, pool := range reply.Pools {
+		if pool.Datacenter != "dc1" {
+			t.Fatalf("bad: %#v", pool)
+		}
+		if pool.WAN {
+			wan = pool
+		} else {
+			lan = pool
+		}
+	}
+	if len(reply.Pools) != 2 || lan == nil || wan == nil {
+		t.Fatalf("bad: %#v", reply.Pools)
+	}
+	if lan.NumNodes != 2 || len(lan.NoResponse) != 0 || lan.RemoveSafe {
+		t.Fatalf("bad: %#v", lan)
+	}
+	expected := []*structs.KeyringKeyStatus{
+		&structs.KeyringKeyStatus{
+			Key:      key2,
+			NumNodes: 1,
+			MissingNodes: []string{
+				s2.config.NodeName,
+			},
+		},
+		&structs.KeyringKeyStatus{
+			Key:      key1,
+			NumNodes: 2,
+		},
+	}
+	if !reflect.DeepEqual(lan.Keys, expected) {
+		t.Fatalf("bad: %#v", lan.Keys)
+	}
+
+	// The WAN pool only has the first key, so that's not safe either.
+	if wan.RemoveSafe || len(wan.Keys) != 1 || wan.Keys[0].Key != key1 {
+		t.Fatalf("bad: %#v", wan)
+	}
+
+	// Removing the second key is fine since everyone has the first.
+	arg.Key = key2
+	var reply2 structs.KeyringStatusResponse
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.KeyringStatus", &arg, &reply2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reply2.RemoveSafe {
+		t.Fatalf("bad: %#v", reply2)
+	}
+}
+
+func TestOperator_KeyringStatus_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.KeyringStatusRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.KeyringStatusResponse
+	err := msgpackrpc.CallWithCodec(codec, "Operator.KeyringStatus", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The management token can read the keyring. Gossip encryption isn't
+	// on, so the nodes will report that back.
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.KeyringStatus", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Pools) != 2 || reply.RemoveSafe {
+		t.Fatalf("bad: %#v", reply)
+	}
+	for _, pool := range reply.Pools {
+		if pool.NumNodes != 1 || len(pool.Messages) != 1 || pool.RemoveSafe {
+			t.Fatalf("bad: %#v", pool)
+		}
+	}
+}
+
+func TestOperator_SetTimersPaused(t *testing.T) {
+	clock := lib.NewFakeClock(time.Now())
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Clock = clock
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	hasTimer := func() bool {
+		s1.sessionTimersLock.Lock()
+		defer s1.sessionTimersLock.Unlock()
+		_, ok := s1.sessionTimers["foo"]
+		return ok
+	}
+
+	s1.sessionTimersLock.Lock()
+	s1.resetSessionTimerLocked("foo", 5*time.Millisecond)
+	s1.sessionTimersLock.Unlock()
+
+	// Pause the timers.
+	arg := structs.OperatorTimersRequest{
+		Datacenter: "dc1",
+		Paused:     true,
+	}
+	var reply structs.OperatorTimersReply
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.SetTimersPaused", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reply.Paused || reply.Node != s1.config.NodeName {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	// The session timer should be held even though it's come due.
+	clock.Advance(time.Second)
+	if !hasTimer() {
+		t.Fatalf("timer should be held")
+	}
+
+	// Resuming should run it.
+	arg.Paused = false
+	var resumeReply structs.OperatorTimersReply
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.SetTimersPaused", &arg, &resumeReply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resumeReply.Paused {
+		t.Fatalf("bad: %#v", resumeReply)
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return !hasTimer(), fmt.Errorf("timer should have fired")
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestOperator_SetTimersPaused_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Try to pause without permissions.
+	arg := structs.OperatorTimersRequest{
+		Datacenter: "dc1",
+		Paused:     true,
+	}
+	var reply structs.OperatorTimersReply
+	err := msgpackrpc.CallWithCodec(codec, "Operator.SetTimersPaused", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	if s1.clock.Paused() {
+		t.Fatalf("should not be paused")
+	}
+
+	// Create an ACL with operator write permissions.
+	var token string
+	{
+		var rules = `
+                    operator = "write"
+                `
+
+		req := structs.ACLRequest{
+			Datacenter: "dc1",
+			Op:         structs.ACLSet,
+			ACL: structs.ACL{
+				Name:  "User token",
+				Type:  structs.ACLTypeClient,
+				Rules: rules,
+			},
+			WriteRequest: structs.WriteRequest{Token: "root"},
+		}
+		if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &req, &token); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Now it should go through.
+	arg.Token = token
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.SetTimersPaused", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !s1.clock.Paused() {
+		t.Fatalf("should be paused")
+	}
+}
+
+func TestOperator_SweepOrphanedLocks(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		// Keep the leader from sweeping on its own.
+		c.OrphanedLockSweepInterval = 0
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Make a key that's locked by a session that doesn't exist.
+	state := s1.fsm.State()
+	idx, _, err := state.KVSList(nil, "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := generateUUID()
+	restore := state.Restore()
+	if err := restore.KVS(&structs.DirEntry{
+		Key:       "locked",
+		Value:     []byte("hello"),
+		Session:   session,
+		LockIndex: 1,
+		RaftIndex: structs.RaftIndex{CreateIndex: idx + 1, ModifyIndex: idx + 1},
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	restore.Commit()
+
+	// A dry run should report it without touching it.
+	arg := structs.OrphanedLockSweepRequest{
+		Datacenter: "dc1",
+		DryRun:     true,
+	}
+	var reply structs.OrphanedLockSweepReply
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.SweepOrphanedLocks", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []structs.OrphanedLock{{Key: "locked", Session: session}}
+	if !reflect.DeepEqual(reply.Locks, expected) || reply.Released != 0 {
+		t.Fatalf("bad: %#v", reply)
+	}
+	_, e, err := state.KVSGet(nil, "locked")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if e.Session != session {
+		t.Fatalf("bad: %#v", e)
+	}
+
+	// Servers that don't know about orphaned locks would keep holding it,
+	// so nothing should be released until they're upgraded.
+	tags := make(map[string]string)
+	for k, v := range s1.serfLAN.LocalMember().Tags {
+		tags[k] = v
+	}
+	delete(tags, featureOrphanedLockTag)
+	if err := s1.serfLAN.SetTags(tags); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.DryRun = false
+	err = msgpackrpc.CallWithCodec(codec, "Operator.SweepOrphanedLocks", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), "must be upgraded") {
+		t.Fatalf("err: %v", err)
+	}
+	_, e, err = state.KVSGet(nil, "locked")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if e.Session != session {
+		t.Fatalf("bad: %#v", e)
+	}
+	tags[featureOrphanedLockTag] = "1"
+	if err := s1.serfLAN.SetTags(tags); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Start a blocking query on the key.
+	type result struct {
+		out structs.IndexedDirEntries
+		err error
+	}
+	doneCh := make(chan result, 1)
+	go func() {
+		get := structs.KeyRequest{
+			Datacenter: "dc1",
+			Key:        "locked",
+			QueryOptions: structs.QueryOptions{
+				MinQueryIndex: e.ModifyIndex,
+				MaxQueryTime:  10 * time.Second,
+			},
+		}
+		var out structs.IndexedDirEntries
+		err := s1.RPC("KVS.Get", &get, &out)
+		doneCh <- result{out, err}
+	}()
+
+	// Now sweep for real.
+	time.Sleep(100 * time.Millisecond)
+	arg.DryRun = false
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.SweepOrphanedLocks", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(reply.Locks, expected) || reply.Released != 1 {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	// The watcher should wake up and see the lock released.
+	select {
+	case r := <-doneCh:
+		if r.err != nil {
+			t.Fatalf("err: %v", r.err)
+		}
+		if len(r.out.Entries) != 1 {
+			t.Fatalf("bad: %#v", r.out)
+		}
+		e := r.out.Entries[0]
+		if e.Session != "" || e.LockIndex != 2 || string(e.Value) != "hello" ||
+			r.out.Index <= e.CreateIndex {
+			t.Fatalf("bad: %#v", r.out)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("blocking query didn't wake up")
+	}
+
+	// There should be nothing left to do.
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.SweepOrphanedLocks", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Locks) != 0 || reply.Released != 0 {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
+
+func TestOperator_SweepOrphanedLocks_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Operator read is enough for a dry run, but not to release locks.
+	token := makeTestToken(t, codec, `operator = "read"`, 0)
+	arg := structs.OrphanedLockSweepRequest{
+		Datacenter:   "dc1",
+		WriteRequest: structs.WriteRequest{Token: token},
+	}
+	var reply structs.OrphanedLockSweepReply
+	err := msgpackrpc.CallWithCodec(codec, "Operator.SweepOrphanedLocks", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	arg.DryRun = true
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.SweepOrphanedLocks", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Anonymous can't do either.
+	arg.Token = ""
+	err = msgpackrpc.CallWithCodec(codec, "Operator.SweepOrphanedLocks", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
 	}
 }
@@ -0,0 +1,411 @@
+package consul
+
+import (
+	"fmt"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+)
+
+// Multi-step workflows the leader runs, like removing a server, record their
+// progress as operator intents in the state store. Each step is run, and
+// then the intent is moved on to the next one, so if the leader fails part
+// way a new leader can pick up where it left off, or abort the workflow if
+// that's what the workflow's rules call for. Steps have to be safe to run
+// again, since a leader can fail after running a step but before recording
+// that it did. Moving an intent along is a check-and-set on its modify index,
+// so each step is only ever moved past once, even if two leaders overlap.
+
+// These are the steps operator intents are made of.
+const (
+	// intentStepForceLeave forces the target to leave the LAN pool.
+	intentStepForceLeave = "force-leave"
+
+	// intentStepRemovePeer removes the target from the Raft peers.
+	intentStepRemovePeer = "remove-peer"
+
+	// intentStepDeregister deregisters the target from the catalog.
+	intentStepDeregister = "deregister"
+
+	// intentStepPromote makes the target a voter again.
+	intentStepPromote = "promote"
+
+	// intentStepKeyringInstall, intentStepKeyringUse, and
+	// intentStepKeyringRemove install the intent's key on every gossip
+	// member, make it the primary key, and then remove all the others.
+	intentStepKeyringInstall = "keyring-install"
+	intentStepKeyringUse     = "keyring-use"
+	intentStepKeyringRemove  = "keyring-remove"
+)
+
+// intentWorkflow describes how to run a kind of operator intent.
+type intentWorkflow struct {
+	// steps are the workflow's steps, in order.
+	steps []string
+
+	// initiator is recorded in the server history for the changes the
+	// workflow makes.
+	initiator string
+
+	// resume is called by a new leader for each intent the old leader
+	// didn't finish. It returns false if the intent should be aborted
+	// instead of picked up where it left off.
+	resume func(s *Server, intent *structs.OperatorIntent) bool
+
+	// background is set for workflows that can wait a long time on a
+	// step. A new leader leaves these to a loop of their own, rather than
+	// holding up establishing leadership to run them.
+	background bool
+}
+
+// intentWorkflows has the workflow for each kind of operator intent.
+var intentWorkflows = map[structs.OperatorIntentKind]intentWorkflow{
+	structs.OperatorIntentServerLeave: {
+		steps:     []string{intentStepRemovePeer, intentStepDeregister},
+		initiator: structs.ServerEventByLeader,
+
+		// The server is already gone, so there's no going back.
+		resume: func(*Server, *structs.OperatorIntent) bool { return true },
+	},
+	structs.OperatorIntentDeadServerCleanup: {
+		steps:     []string{intentStepForceLeave, intentStepRemovePeer, intentStepDeregister},
+		initiator: structs.ServerEventByAutopilot,
+		resume:    resumeDeadServerCleanup,
+	},
+	structs.OperatorIntentLeaderTransfer: {
+		steps:     []string{intentStepPromote},
+		initiator: structs.ServerEventByOperator,
+		resume:    resumeLeaderTransfer,
+	},
+	structs.OperatorIntentKeyringRotate: {
+		steps:      []string{intentStepKeyringInstall, intentStepKeyringUse, intentStepKeyringRemove},
+		initiator:  structs.ServerEventByOperator,
+		resume:     func(*Server, *structs.OperatorIntent) bool { return true },
+		background: true,
+	},
+}
+
+// resumeDeadServerCleanup aborts a dead server cleanup if the server came
+// back before it was forced to leave. Once it's been forced out, the rest of
+// the cleanup is always run.
+func resumeDeadServerCleanup(s *Server, intent *structs.OperatorIntent) bool {
+	if intent.Step != intentStepForceLeave {
+		return true
+	}
+	for _, member := range s.serfLAN.Members() {
+		if member.Name == intent.Target && member.Status == serf.StatusAlive {
+			return false
+		}
+	}
+	return true
+}
+
+// resumeLeaderTransfer aborts promoting a server back after a leadership
+// transfer if it's failed since, so a dead server isn't made a voter.
+// Autopilot will promote it once it's back and stable.
+func resumeLeaderTransfer(s *Server, intent *structs.OperatorIntent) bool {
+	for _, member := range s.serfLAN.Members() {
+		if member.Name == intent.Target && member.Status == serf.StatusAlive {
+			return true
+		}
+	}
+	return false
+}
+
+// operatorIntentFor returns the pending operator intent for the given server,
+// or nil if there isn't one.
+func (s *Server) operatorIntentFor(target string) (*structs.OperatorIntent, error) {
+	_, intents, err := s.fsm.State().OperatorIntentList(nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, intent := range intents {
+		if intent.Target == target {
+			return intent, nil
+		}
+	}
+	return nil, nil
+}
+
+// startOperatorIntent records a new operator intent for the given server and
+// runs it.
+func (s *Server) startOperatorIntent(kind structs.OperatorIntentKind, target, serverID, addr, reason string) error {
+	intent, err := s.createOperatorIntent(structs.OperatorIntent{
+		Kind:     kind,
+		Target:   target,
+		ServerID: serverID,
+		Address:  addr,
+		Reason:   reason,
+	})
+	if err != nil {
+		return err
+	}
+	if intent == nil {
+		return nil
+	}
+	return s.runOperatorIntent(intent)
+}
+
+// createOperatorIntent records the given operator intent at the first step
+// of its workflow without running it, and returns it.
+func (s *Server) createOperatorIntent(intent structs.OperatorIntent) (*structs.OperatorIntent, error) {
+	wf, ok := intentWorkflows[intent.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown operator intent kind %q", intent.Kind)
+	}
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	intent.ID = id
+	intent.Step = wf.steps[0]
+	intent.Started = s.clock.Now()
+	req := structs.OperatorIntentRequest{
+		Datacenter: s.config.Datacenter,
+		Op:         structs.OperatorIntentCreate,
+		Intent:     intent,
+	}
+	resp, err := s.applyOperatorIntent(&req)
+	if err != nil {
+		return nil, err
+	}
+	if respErr, ok := resp.(error); ok {
+		return nil, respErr
+	}
+	metrics.IncrCounter([]string{"consul", "leader", "operator_intent", "started"}, 1)
+
+	_, created, err := s.fsm.State().OperatorIntentGet(nil, id)
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// runOperatorIntent runs the rest of the given operator intent's steps,
+// recording its progress after each one, and deletes it once it's done. If
+// this server is already running the intent, this returns right away.
+func (s *Server) runOperatorIntent(intent *structs.OperatorIntent) error {
+	wf, ok := intentWorkflows[intent.Kind]
+	if !ok {
+		return fmt.Errorf("unknown operator intent kind %q", intent.Kind)
+	}
+
+	if !s.claimOperatorIntent(intent.ID) {
+		return nil
+	}
+	defer s.releaseOperatorIntent(intent.ID)
+
+	for {
+		next := -1
+		for i, step := range wf.steps {
+			if step == intent.Step {
+				next = i + 1
+				break
+			}
+		}
+		if next < 0 {
+			return fmt.Errorf("operator intent %s has unknown step %q", intent.ID, intent.Step)
+		}
+
+		if err := s.runOperatorIntentStep(wf, intent); err != nil {
+			return fmt.Errorf("operator intent %s (%s of %s) failed at step %q: %v",
+				intent.ID, intent.Kind, intent.Target, intent.Step, err)
+		}
+
+		// Move on to the next step, or delete the intent if that was
+		// the last one.
+		req := structs.OperatorIntentRequest{
+			Datacenter: s.config.Datacenter,
+			Op:         structs.OperatorIntentUpdate,
+			Intent: structs.OperatorIntent{
+				ID:        intent.ID,
+				RaftIndex: structs.RaftIndex{ModifyIndex: intent.ModifyIndex},
+			},
+		}
+		if next < len(wf.steps) {
+			req.Intent.Step = wf.steps[next]
+		} else {
+			req.Op = structs.OperatorIntentDelete
+		}
+		resp, err := s.applyOperatorIntent(&req)
+		if err != nil {
+			return err
+		}
+		if respErr, ok := resp.(error); ok {
+			return respErr
+		}
+		if done, ok := resp.(bool); !ok || !done {
+			s.logger.Printf("[WARN] consul: operator intent %s (%s of %s) was moved along by someone else",
+				intent.ID, intent.Kind, intent.Target)
+			return nil
+		}
+		if req.Op == structs.OperatorIntentDelete {
+			s.logger.Printf("[INFO] consul: completed operator intent %s (%s of %s)",
+				intent.ID, intent.Kind, intent.Target)
+			metrics.IncrCounter([]string{"consul", "leader", "operator_intent", "completed"}, 1)
+			return nil
+		}
+
+		_, intent, err = s.fsm.State().OperatorIntentGet(nil, intent.ID)
+		if err != nil {
+			return err
+		}
+		if intent == nil {
+			return nil
+		}
+	}
+}
+
+// runOperatorIntentStep runs the given intent's current step.
+func (s *Server) runOperatorIntentStep(wf intentWorkflow, intent *structs.OperatorIntent) error {
+	switch intent.Step {
+	case intentStepForceLeave:
+		s.logger.Printf("[INFO] consul: forcing server '%s' to leave (%s)", intent.Target, intent.Reason)
+		return s.serfLAN.RemoveFailedNode(intent.Target)
+
+	case intentStepRemovePeer:
+		return s.removeConsulServer(raft.ServerID(intent.ServerID), raft.ServerAddress(intent.Address),
+			intent.Reason, wf.initiator)
+
+	case intentStepDeregister:
+		_, node, err := s.fsm.State().GetNode(intent.Target)
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			return nil
+		}
+		s.logger.Printf("[INFO] consul: deregistering server '%s' (%s)", intent.Target, intent.Reason)
+		return s.deregisterNode(intent.Target)
+
+	case intentStepPromote:
+		future := s.raft.GetConfiguration()
+		if err := future.Error(); err != nil {
+			return err
+		}
+		for _, server := range future.Configuration().Servers {
+			if server.ID != raft.ServerID(intent.ServerID) || isVoter(server.Suffrage) {
+				continue
+			}
+			s.logger.Printf("[INFO] consul: promoting server '%s' back to voter (%s)", intent.Target, intent.Reason)
+			if err := s.raft.AddVoter(server.ID, server.Address, 0, 0).Error(); err != nil {
+				return err
+			}
+			s.recordServerEvent(server.ID, server.Address, structs.ServerEventPromoted,
+				intent.Reason, wf.initiator)
+		}
+		return nil
+
+	case intentStepKeyringInstall:
+		return s.keyringRotateInstall(intent.Key)
+
+	case intentStepKeyringUse:
+		return s.keyringRotateUse(intent.Key)
+
+	case intentStepKeyringRemove:
+		return s.keyringRotateRemove(intent.Key)
+
+	default:
+		return fmt.Errorf("unknown step %q", intent.Step)
+	}
+}
+
+// claimOperatorIntent marks the given intent as running on this server. It
+// returns false if it's already running.
+func (s *Server) claimOperatorIntent(id string) bool {
+	s.intentsRunningLock.Lock()
+	defer s.intentsRunningLock.Unlock()
+
+	if _, ok := s.intentsRunning[id]; ok {
+		return false
+	}
+	if s.intentsRunning == nil {
+		s.intentsRunning = make(map[string]struct{})
+	}
+	s.intentsRunning[id] = struct{}{}
+	return true
+}
+
+// releaseOperatorIntent marks the given intent as no longer running.
+func (s *Server) releaseOperatorIntent(id string) {
+	s.intentsRunningLock.Lock()
+	defer s.intentsRunningLock.Unlock()
+
+	delete(s.intentsRunning, id)
+}
+
+// resumeOperatorIntents is called when we become the leader, to resume or
+// abort the operator intents the last leader didn't finish. Failures are
+// logged, and the intents are left for the workflows to retry, like the
+// reconcile does for servers that left.
+func (s *Server) resumeOperatorIntents() error {
+	_, intents, err := s.fsm.State().OperatorIntentList(nil)
+	if err != nil {
+		return err
+	}
+
+	for _, intent := range intents {
+		wf, ok := intentWorkflows[intent.Kind]
+		if !ok {
+			s.logger.Printf("[WARN] consul: skipping operator intent %s with unknown kind %q",
+				intent.ID, intent.Kind)
+			continue
+		}
+
+		if !wf.resume(s, intent) {
+			if err := s.abortOperatorIntent(intent); err != nil {
+				s.logger.Printf("[ERR] consul: failed to abort operator intent %s: %v", intent.ID, err)
+			}
+			continue
+		}
+
+		s.logger.Printf("[INFO] consul: resuming operator intent %s (%s of %s) at step %q",
+			intent.ID, intent.Kind, intent.Target, intent.Step)
+		metrics.IncrCounter([]string{"consul", "leader", "operator_intent", "resumed"}, 1)
+		if wf.background {
+			continue
+		}
+		if err := s.runOperatorIntent(intent); err != nil {
+			s.logger.Printf("[ERR] consul: %v", err)
+		}
+	}
+	return nil
+}
+
+// applyOperatorIntent applies a change to an operator intent. These are
+// written automatically as servers come and go, which includes the old
+// servers leaving during a rolling upgrade, so servers that don't know about
+// operator intents are allowed to skip them.
+func (s *Server) applyOperatorIntent(req *structs.OperatorIntentRequest) (interface{}, error) {
+	t := structs.OperatorIntentRequestType | structs.IgnoreUnknownTypeFlag
+	return s.raftApply(t, req)
+}
+
+// abortOperatorIntent deletes the given intent without running the rest of
+// its steps.
+func (s *Server) abortOperatorIntent(intent *structs.OperatorIntent) error {
+	req := structs.OperatorIntentRequest{
+		Datacenter: s.config.Datacenter,
+		Op:         structs.OperatorIntentDelete,
+		Intent: structs.OperatorIntent{
+			ID:        intent.ID,
+			RaftIndex: structs.RaftIndex{ModifyIndex: intent.ModifyIndex},
+		},
+	}
+	resp, err := s.applyOperatorIntent(&req)
+	if err != nil {
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+
+	s.logger.Printf("[INFO] consul: aborted operator intent %s (%s of %s) at step %q",
+		intent.ID, intent.Kind, intent.Target, intent.Step)
+	metrics.IncrCounter([]string{"consul", "leader", "operator_intent", "aborted"}, 1)
+	return nil
+}
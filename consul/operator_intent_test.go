@@ -0,0 +1,221 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestLeader_OperatorIntent_Failover(t *testing.T) {
+	conf := func(c *Config) {
+		c.Datacenter = "dc1"
+		c.Bootstrap = false
+		c.BootstrapExpect = 3
+	}
+	var servers []*Server
+	for i := 0; i < 3; i++ {
+		dir, s := testServerWithConfig(t, conf)
+		defer os.RemoveAll(dir)
+		defer s.Shutdown()
+		servers = append(servers, s)
+	}
+
+	// Count the intents each server sees finished.
+	var lock sync.Mutex
+	deletes := make(map[*Server]int)
+	for _, s := range servers {
+		s := s
+		s.RegisterChangeHook(structs.OperatorIntentRequestType, func(idx uint64, op interface{}) {
+			if req := op.(*structs.OperatorIntentRequest); req.Op == structs.OperatorIntentDelete {
+				lock.Lock()
+				deletes[s]++
+				lock.Unlock()
+			}
+		})
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		servers[0].config.SerfLANConfig.MemberlistConfig.BindPort)
+	for _, s := range servers[1:] {
+		if _, err := s.JoinLAN([]string{addr}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		peers, _ := servers[0].numPeers()
+		return peers == 3, fmt.Errorf("%d peers", peers)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leave behind a server removal that the leader got as far as the
+	// last step of, as if it failed right after removing the peer. This
+	// is retried in case leadership is still settling.
+	var leader *Server
+	if err := testutil.WaitForResult(func() (bool, error) {
+		leader = nil
+		for _, s := range servers {
+			if s.IsLeader() {
+				leader = s
+			}
+		}
+		if leader == nil {
+			return false, fmt.Errorf("no leader")
+		}
+
+		reg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       "gone",
+			Address:    "127.0.0.9",
+		}
+		var out struct{}
+		if err := leader.RPC("Catalog.Register", &reg, &out); err != nil {
+			return false, err
+		}
+		req := structs.OperatorIntentRequest{
+			Datacenter: "dc1",
+			Op:         structs.OperatorIntentCreate,
+			Intent: structs.OperatorIntent{
+				ID:      generateUUID(),
+				Kind:    structs.OperatorIntentServerLeave,
+				Target:  "gone",
+				Address: "127.0.0.9:8300",
+				Reason:  "left",
+				Step:    intentStepDeregister,
+			},
+		}
+		if _, err := leader.applyOperatorIntent(&req); err != nil {
+			return false, err
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	leader.Shutdown()
+
+	var survivor *Server
+	for _, s := range servers {
+		if s != leader {
+			survivor = s
+			break
+		}
+	}
+
+	// The new leader should finish the job.
+	if err := testutil.WaitForResult(func() (bool, error) {
+		state := survivor.fsm.State()
+		_, intents, err := state.OperatorIntentList(nil)
+		if err != nil {
+			return false, err
+		}
+		_, node, err := state.GetNode("gone")
+		if err != nil {
+			return false, err
+		}
+		return len(intents) == 0 && node == nil, fmt.Errorf("%d intents, node %v", len(intents), node)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// It should have only been finished once.
+	time.Sleep(100 * time.Millisecond)
+	lock.Lock()
+	finished := deletes[survivor]
+	lock.Unlock()
+	if finished != 1 {
+		t.Fatalf("bad: %d", finished)
+	}
+}
+
+func TestLeader_OperatorIntent_Resume(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register a node for a server that's already been forced out, and
+	// make up a cleanup for a server that's alive again.
+	reg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "ghost",
+		Address:    "127.0.0.9",
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &reg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, intent := range []structs.OperatorIntent{
+		{
+			ID:      generateUUID(),
+			Kind:    structs.OperatorIntentDeadServerCleanup,
+			Target:  "ghost",
+			Address: "127.0.0.9:8300",
+			Reason:  "dead server cleanup",
+			Step:    intentStepRemovePeer,
+		},
+		{
+			ID:      generateUUID(),
+			Kind:    structs.OperatorIntentDeadServerCleanup,
+			Target:  s1.config.NodeName,
+			Address: s1.config.RPCAddr.String(),
+			Reason:  "dead server cleanup",
+			Step:    intentStepForceLeave,
+		},
+	} {
+		req := structs.OperatorIntentRequest{
+			Datacenter: "dc1",
+			Op:         structs.OperatorIntentCreate,
+			Intent:     intent,
+		}
+		if _, err := s1.raftApply(structs.OperatorIntentRequestType, &req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Both should be listed.
+	arg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.IndexedOperatorIntents
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.OperatorIntentList", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Intents) != 2 || reply.Intents[0].Target != "ghost" || reply.Index == 0 {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	// Resuming should finish the first and abort the second.
+	if err := s1.resumeOperatorIntents(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, intents, err := s1.fsm.State().OperatorIntentList(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(intents) != 0 {
+		t.Fatalf("bad: %#v", intents)
+	}
+	_, node, err := s1.fsm.State().GetNode("ghost")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node != nil {
+		t.Fatalf("bad: %#v", node)
+	}
+	peers, err := s1.numPeers()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if peers != 1 {
+		t.Fatalf("bad: %d", peers)
+	}
+}
@@ -18,6 +18,10 @@ import (
 
 const defaultDialTimeout = 10 * time.Second
 
+// DialerFunc is used to open a raw connection to a Consul server. It has the
+// same signature as net.DialTimeout, which is what's used by default.
+type DialerFunc func(network, address string, timeout time.Duration) (net.Conn, error)
+
 // muxSession is used to provide an interface for a stream multiplexer.
 type muxSession interface {
 	Open() (net.Conn, error)
@@ -75,7 +79,7 @@ func (c *Conn) getClient() (*StreamClient, error) {
 	}
 
 	// Create the RPC client
-	codec := msgpackrpc.NewClientCodec(stream)
+	codec := newPooledCodec(true, stream, stream)
 
 	// Return a new stream client
 	sc := &StreamClient{
@@ -141,6 +145,21 @@ type ConnPool struct {
 	// TLS wrapper
 	tlsWrap tlsutil.DCWrapper
 
+	// dialer is used to open new raw connections
+	dialer DialerFunc
+
+	// wanDialer, if set, is used instead of dialer for connections to
+	// servers outside of datacenter, such as through an egress proxy.
+	wanDialer  DialerFunc
+	datacenter string
+
+	// dials counts the RPC connections the pool has set up. This must be
+	// accessed atomically.
+	dials uint64
+
+	// lastSuccess is when an RPC to each address last succeeded.
+	lastSuccess map[string]time.Time
+
 	// Used to indicate the pool is shutdown
 	shutdown   bool
 	shutdownCh chan struct{}
@@ -153,13 +172,15 @@ type ConnPool struct {
 // If TLS settings are provided outgoing connections use TLS.
 func NewPool(logOutput io.Writer, maxTime time.Duration, maxStreams int, tlsWrap tlsutil.DCWrapper) *ConnPool {
 	pool := &ConnPool{
-		logOutput:  logOutput,
-		maxTime:    maxTime,
-		maxStreams: maxStreams,
-		pool:       make(map[string]*Conn),
-		limiter:    make(map[string]chan struct{}),
-		tlsWrap:    tlsWrap,
-		shutdownCh: make(chan struct{}),
+		logOutput:   logOutput,
+		maxTime:     maxTime,
+		maxStreams:  maxStreams,
+		pool:        make(map[string]*Conn),
+		limiter:     make(map[string]chan struct{}),
+		lastSuccess: make(map[string]time.Time),
+		tlsWrap:     tlsWrap,
+		dialer:      net.DialTimeout,
+		shutdownCh:  make(chan struct{}),
 	}
 	if maxTime > 0 {
 		go pool.reap()
@@ -264,8 +285,18 @@ type HalfCloser interface {
 // DialTimeout is used to establish a raw connection to the given server, with a
 // given connection timeout.
 func (p *ConnPool) DialTimeout(dc string, addr net.Addr, timeout time.Duration) (net.Conn, HalfCloser, error) {
+	return p.dial(dc, addr, defaultDialTimeout)
+}
+
+// dial establishes a raw connection to the given server, giving up on the
+// dial after the given timeout.
+func (p *ConnPool) dial(dc string, addr net.Addr, timeout time.Duration) (net.Conn, HalfCloser, error) {
 	// Try to dial the conn
-	conn, err := net.DialTimeout("tcp", addr.String(), defaultDialTimeout)
+	dialer := p.dialer
+	if p.wanDialer != nil && dc != p.datacenter {
+		dialer = p.wanDialer
+	}
+	conn, err := dialer("tcp", addr.String(), timeout)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -305,6 +336,7 @@ func (p *ConnPool) getNewConn(dc string, addr net.Addr, version int) (*Conn, err
 	if err != nil {
 		return nil, err
 	}
+	atomic.AddUint64(&p.dials, 1)
 
 	// Switch the multiplexing based on version
 	var session muxSession
@@ -411,6 +443,7 @@ func (p *ConnPool) RPC(dc string, addr net.Addr, version int, method string, arg
 	// Done with the connection
 	conn.returnClient(sc)
 	p.releaseConn(conn)
+	p.markSuccess(addr)
 	return nil
 }
 
@@ -435,9 +468,44 @@ func (p *ConnPool) PingConsulServer(s *agent.Server) (bool, error) {
 	// Done with the connection
 	conn.returnClient(sc)
 	p.releaseConn(conn)
+	p.markSuccess(s.Addr)
 	return true, nil
 }
 
+// markSuccess records that an RPC to the given address just succeeded.
+func (p *ConnPool) markSuccess(addr net.Addr) {
+	p.Lock()
+	p.lastSuccess[addr.String()] = time.Now()
+	p.Unlock()
+}
+
+// LastSuccess returns when an RPC to the given address last succeeded, or
+// the zero time if one never has.
+func (p *ConnPool) LastSuccess(addr net.Addr) time.Time {
+	p.Lock()
+	defer p.Unlock()
+	return p.lastSuccess[addr.String()]
+}
+
+// Dials returns the number of RPC connections the pool has set up.
+func (p *ConnPool) Dials() uint64 {
+	return atomic.LoadUint64(&p.dials)
+}
+
+// Warm makes sure the pool has a working connection to the given server,
+// setting one up if needed, and marks it as used so it won't be reaped. This
+// returns true if a new connection was made.
+func (p *ConnPool) Warm(s *agent.Server) (bool, error) {
+	p.Lock()
+	_, ok := p.pool[s.Addr.String()]
+	p.Unlock()
+
+	if _, err := p.PingConsulServer(s); err != nil {
+		return false, err
+	}
+	return !ok, nil
+}
+
 // Reap is used to close conns open over maxTime
 func (p *ConnPool) reap() {
 	for {
@@ -472,6 +540,14 @@ func (p *ConnPool) reap() {
 		for _, host := range removed {
 			delete(p.pool, host)
 		}
+
+		// Forget about successes from long ago, so servers that have
+		// gone away don't stick around.
+		for host, last := range p.lastSuccess {
+			if now.Sub(last) >= p.maxTime {
+				delete(p.lastSuccess, host)
+			}
+		}
 		p.Unlock()
 	}
 }
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/acl"
 	"github.com/hashicorp/consul/consul/state"
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/go-memdb"
@@ -59,7 +60,7 @@ func (p *PreparedQuery) Apply(args *structs.PreparedQueryRequest, reply *string)
 	*reply = args.Query.ID
 
 	// Get the ACL token for the request for the checks below.
-	acl, err := p.srv.resolveToken(args.Token)
+	acl, err := p.srv.resolveToken("PreparedQuery.Apply", args.Token)
 	if err != nil {
 		return err
 	}
@@ -95,6 +96,12 @@ func (p *PreparedQuery) Apply(args *structs.PreparedQueryRequest, reply *string)
 		}
 	}
 
+	// Changes aren't allowed while prepared queries are frozen, unless
+	// they're forced through with a management token.
+	if err := p.checkFreeze(args, acl); err != nil {
+		return err
+	}
+
 	// Parse the query and prep it for the state store.
 	switch args.Op {
 	case structs.PreparedQueryCreate, structs.PreparedQueryUpdate:
@@ -123,6 +130,29 @@ func (p *PreparedQuery) Apply(args *structs.PreparedQueryRequest, reply *string)
 	return nil
 }
 
+// checkFreeze returns a QueryFrozenError if prepared queries are frozen,
+// unless the request is forced through with a management token.
+func (p *PreparedQuery) checkFreeze(args *structs.PreparedQueryRequest, acl acl.ACL) error {
+	_, freeze, err := p.srv.fsm.State().QueryFreeze(nil)
+	if err != nil {
+		return fmt.Errorf("Query freeze lookup failed: %v", err)
+	}
+	if freeze == nil || !freeze.Frozen {
+		return nil
+	}
+
+	if args.Force && (acl == nil || acl.ACLModify()) {
+		p.srv.logger.Printf("[WARN] consul.prepared_query: Forcing %s of prepared query '%s' through freeze",
+			args.Op, args.Query.ID)
+		return nil
+	}
+	return &structs.QueryFrozenError{
+		SetBy:  freeze.SetBy,
+		SetAt:  freeze.SetAt,
+		Reason: freeze.Reason,
+	}
+}
+
 // parseQuery makes sure the entries of a query are valid for a create or
 // update operation. Some of the fields are not checked or are partially
 // checked, as noted in the comments below. This also updates all the parsed
@@ -236,11 +266,11 @@ func (p *PreparedQuery) Get(args *structs.PreparedQuerySpecificRequest,
 			reply.Index = index
 			reply.Queries = structs.PreparedQueries{query}
 			if _, ok := query.GetACLPrefix(); !ok {
-				return p.srv.filterACL(args.Token, &reply.Queries[0])
+				return p.srv.filterACL("PreparedQuery.Get", args.Token, &reply.Queries[0])
 			}
 
 			// Otherwise, attempt to filter it the usual way.
-			if err := p.srv.filterACL(args.Token, reply); err != nil {
+			if err := p.srv.filterACL("PreparedQuery.Get", args.Token, reply); err != nil {
 				return err
 			}
 
@@ -272,7 +302,7 @@ func (p *PreparedQuery) List(args *structs.DCSpecificRequest, reply *structs.Ind
 			}
 
 			reply.Index, reply.Queries = index, queries
-			return p.srv.filterACL(args.Token, reply)
+			return p.srv.filterACL("PreparedQuery.List", args.Token, reply)
 		})
 }
 
@@ -310,7 +340,7 @@ func (p *PreparedQuery) Explain(args *structs.PreparedQueryExecuteRequest,
 	queries := &structs.IndexedPreparedQueries{
 		Queries: structs.PreparedQueries{query},
 	}
-	if err := p.srv.filterACL(args.Token, queries); err != nil {
+	if err := p.srv.filterACL("PreparedQuery.Explain", args.Token, queries); err != nil {
 		return err
 	}
 
@@ -363,7 +393,7 @@ func (p *PreparedQuery) Execute(args *structs.PreparedQueryExecuteRequest,
 	if query.Token != "" {
 		token = query.Token
 	}
-	if err := p.srv.filterACL(token, &reply.Nodes); err != nil {
+	if err := p.srv.filterACL("PreparedQuery.Execute", token, &reply.Nodes); err != nil {
 		return err
 	}
 
@@ -463,7 +493,7 @@ func (p *PreparedQuery) ExecuteRemote(args *structs.PreparedQueryExecuteRemoteRe
 	if args.Query.Token != "" {
 		token = args.Query.Token
 	}
-	if err := p.srv.filterACL(token, &reply.Nodes); err != nil {
+	if err := p.srv.filterACL("PreparedQuery.ExecuteRemote", token, &reply.Nodes); err != nil {
 		return err
 	}
 
@@ -584,6 +614,7 @@ func nodeMetaFilter(filters map[string]string, nodes structs.CheckServiceNodes)
 type queryServer interface {
 	GetLogger() *log.Logger
 	GetOtherDatacentersByDistance() ([]string, error)
+	ResolveDatacenter(dc string) string
 	ForwardDC(method, dc string, args interface{}, reply interface{}) error
 }
 
@@ -598,7 +629,8 @@ func (q *queryServerWrapper) GetLogger() *log.Logger {
 }
 
 // GetOtherDatacentersByDistance calls into the server's fn and filters out the
-// server's own DC.
+// server's own DC, along with any DCs whose federation policy doesn't allow
+// reads to be forwarded there.
 func (q *queryServerWrapper) GetOtherDatacentersByDistance() ([]string, error) {
 	// TODO (slackpad) - We should cache this result since it's expensive to
 	// compute.
@@ -609,13 +641,24 @@ func (q *queryServerWrapper) GetOtherDatacentersByDistance() ([]string, error) {
 
 	var result []string
 	for _, dc := range dcs {
-		if dc != q.srv.config.Datacenter {
-			result = append(result, dc)
+		if dc == q.srv.config.Datacenter {
+			continue
+		}
+		if err := q.srv.checkFederationPolicy(dc, true); err != nil {
+			q.srv.logger.Printf("[DEBUG] consul.prepared_query: Skipping datacenter '%s' for failover: %v", dc, err)
+			continue
 		}
+		result = append(result, dc)
 	}
 	return result, nil
 }
 
+// ResolveDatacenter returns the canonical name of the given datacenter, in
+// case it's been renamed.
+func (q *queryServerWrapper) ResolveDatacenter(dc string) string {
+	return q.srv.router.ResolveDatacenter(dc)
+}
+
 // ForwardDC calls into the server's RPC forwarder.
 func (q *queryServerWrapper) ForwardDC(method, dc string, args interface{}, reply interface{}) error {
 	return q.srv.forwardDC(method, dc, args, reply)
@@ -657,6 +700,9 @@ func queryFailover(q queryServer, query *structs.PreparedQuery,
 
 	// Then add any DCs explicitly listed that weren't selected above.
 	for _, dc := range query.Service.Failover.Datacenters {
+		// Queries may still list datacenters by their old names.
+		dc = q.ResolveDatacenter(dc)
+
 		// This will prevent a log of other log spammage if we do not
 		// attempt to talk to datacenters we don't know about.
 		if _, ok := known[dc]; !ok {
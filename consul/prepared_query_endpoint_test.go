@@ -459,6 +459,145 @@ func TestPreparedQuery_Apply_ACLDeny(t *testing.T) {
 	}
 }
 
+func TestPreparedQuery_Apply_Frozen(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Create an ACL with write permissions for redis queries.
+	var token string
+	{
+		var rules = `
+                    query "redis" {
+                        policy = "write"
+                    }
+                `
+
+		req := structs.ACLRequest{
+			Datacenter: "dc1",
+			Op:         structs.ACLSet,
+			ACL: structs.ACL{
+				Name:  "User token",
+				Type:  structs.ACLTypeClient,
+				Rules: rules,
+			},
+			WriteRequest: structs.WriteRequest{Token: "root"},
+		}
+		if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &req, &token); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Create a query before the freeze.
+	query := structs.PreparedQueryRequest{
+		Datacenter: "dc1",
+		Op:         structs.PreparedQueryCreate,
+		Query: &structs.PreparedQuery{
+			Name: "redis-master",
+			Service: structs.ServiceQuery{
+				Service: "the-redis",
+			},
+		},
+		WriteRequest: structs.WriteRequest{Token: token},
+	}
+	var reply string
+	if err := msgpackrpc.CallWithCodec(codec, "PreparedQuery.Apply", &query, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	query.Query.ID = reply
+
+	setFreeze := func(frozen bool) {
+		arg := structs.QueryFreezeRequest{
+			Datacenter: "dc1",
+			Freeze: structs.QueryFreeze{
+				Frozen: frozen,
+				SetBy:  "alice",
+				Reason: "incident",
+			},
+			WriteRequest: structs.WriteRequest{Token: "root"},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Operator.QueryFreezeSet", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	setFreeze(true)
+
+	// Creates, updates, and deletes should all be refused.
+	for _, op := range []structs.PreparedQueryOp{
+		structs.PreparedQueryCreate,
+		structs.PreparedQueryUpdate,
+		structs.PreparedQueryDelete,
+	} {
+		req := query
+		req.Op = op
+		req.Query = &structs.PreparedQuery{
+			Name:    "redis-master",
+			Service: structs.ServiceQuery{Service: "the-redis"},
+		}
+		if op != structs.PreparedQueryCreate {
+			req.Query.ID = query.Query.ID
+		}
+		err := msgpackrpc.CallWithCodec(codec, "PreparedQuery.Apply", &req, &reply)
+		if !structs.HasErrorCode(err, structs.ErrCodeQueryFrozen) || !strings.Contains(err.Error(), "alice") {
+			t.Fatalf("op %s: bad: %v", op, err)
+		}
+	}
+
+	// The query can still be executed.
+	{
+		req := structs.PreparedQueryExecuteRequest{
+			Datacenter:    "dc1",
+			QueryIDOrName: query.Query.ID,
+			QueryOptions:  structs.QueryOptions{Token: "root"},
+		}
+		var resp structs.PreparedQueryExecuteResponse
+		if err := msgpackrpc.CallWithCodec(codec, "PreparedQuery.Execute", &req, &resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp.Service != "the-redis" {
+			t.Fatalf("bad: %#v", resp)
+		}
+	}
+
+	// Forcing the change through takes a management token.
+	query.Op = structs.PreparedQueryUpdate
+	query.Query.Service.Service = "other-redis"
+	query.Force = true
+	err := msgpackrpc.CallWithCodec(codec, "PreparedQuery.Apply", &query, &reply)
+	if !structs.HasErrorCode(err, structs.ErrCodeQueryFrozen) {
+		t.Fatalf("bad: %v", err)
+	}
+	query.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "PreparedQuery.Apply", &query, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, actual, err := s1.fsm.State().PreparedQueryGet(nil, query.Query.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if actual.Service.Service != "other-redis" {
+		t.Fatalf("bad: %#v", actual)
+	}
+
+	// Once it's unfrozen, regular changes work again.
+	setFreeze(false)
+	query.Force = false
+	query.Token = token
+	query.Query.Service.Service = "the-redis"
+	if err := msgpackrpc.CallWithCodec(codec, "PreparedQuery.Apply", &query, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestPreparedQuery_Apply_ForwardLeader(t *testing.T) {
 	dir1, s1 := testServerWithConfig(t, func(c *Config) {
 		c.Bootstrap = false
@@ -2723,11 +2862,29 @@ func TestPreparedQuery_Wrapper(t *testing.T) {
 	if err := wrapper.ForwardDC("Status.Ping", "dc2", &struct{}{}, &struct{}{}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
+
+	// A datacenter that reads can't be forwarded to shouldn't be offered
+	// for failover.
+	policy := &structs.FederationPolicy{
+		Datacenter: "dc2",
+		Forwarding: structs.FederationForwardNone,
+	}
+	if err := s1.fsm.State().FederationPolicySet(1000, policy); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ret, err = wrapper.GetOtherDatacentersByDistance()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ret) != 0 {
+		t.Fatalf("bad: %v", ret)
+	}
 }
 
 type mockQueryServer struct {
 	Datacenters      []string
 	DatacentersError error
+	Aliases          map[string]string
 	QueryLog         []string
 	QueryFn          func(dc string, args interface{}, reply interface{}) error
 	Logger           *log.Logger
@@ -2750,6 +2907,13 @@ func (m *mockQueryServer) GetOtherDatacentersByDistance() ([]string, error) {
 	return m.Datacenters, m.DatacentersError
 }
 
+func (m *mockQueryServer) ResolveDatacenter(dc string) string {
+	if canonical, ok := m.Aliases[dc]; ok {
+		return canonical
+	}
+	return dc
+}
+
 func (m *mockQueryServer) ForwardDC(method, dc string, args interface{}, reply interface{}) error {
 	m.QueryLog = append(m.QueryLog, fmt.Sprintf("%s:%s", dc, method))
 	if ret, ok := reply.(*structs.PreparedQueryExecuteResponse); ok {
@@ -3101,4 +3265,38 @@ func TestPreparedQuery_queryFailover(t *testing.T) {
 			t.Fatalf("bad: %s", queries)
 		}
 	}
+
+	// Datacenters listed by their old names should be resolved, and not
+	// tried twice.
+	query.Service.Failover.NearestN = 1
+	query.Service.Failover.Datacenters = []string{"dc-old", "dc1", "dc-gone"}
+	{
+		mock := &mockQueryServer{
+			Datacenters: []string{"dc1", "dc2", "dc3", "xxx", "dc4"},
+			Aliases: map[string]string{
+				"dc-old":  "dc3",
+				"dc-gone": "dc-nope",
+			},
+			QueryFn: func(dc string, args interface{}, reply interface{}) error {
+				ret := reply.(*structs.PreparedQueryExecuteResponse)
+				if dc == "dc3" {
+					ret.Nodes = nodes()
+				}
+				return nil
+			},
+		}
+
+		var reply structs.PreparedQueryExecuteResponse
+		if err := queryFailover(mock, query, 0, structs.QueryOptions{}, &reply); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(reply.Nodes) != 3 ||
+			reply.Datacenter != "dc3" || reply.Failovers != 2 ||
+			!reflect.DeepEqual(reply.Nodes, nodes()) {
+			t.Fatalf("bad: %v", reply)
+		}
+		if queries := mock.JoinQueryLog(); queries != "dc1:PreparedQuery.ExecuteRemote|dc3:PreparedQuery.ExecuteRemote" {
+			t.Fatalf("bad: %s", queries)
+		}
+	}
 }
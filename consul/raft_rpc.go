@@ -22,6 +22,9 @@ type RaftLayer struct {
 	// TLS wrapper
 	tlsWrap tlsutil.Wrapper
 
+	// dialer is used to open new outgoing connections
+	dialer DialerFunc
+
 	// Tracks if we are closed
 	closed    bool
 	closeCh   chan struct{}
@@ -36,6 +39,7 @@ func NewRaftLayer(addr net.Addr, tlsWrap tlsutil.Wrapper) *RaftLayer {
 		addr:    addr,
 		connCh:  make(chan net.Conn),
 		tlsWrap: tlsWrap,
+		dialer:  net.DialTimeout,
 		closeCh: make(chan struct{}),
 	}
 	return layer
@@ -82,7 +86,7 @@ func (l *RaftLayer) Addr() net.Addr {
 
 // Dial is used to create a new outgoing connection
 func (l *RaftLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
-	conn, err := net.DialTimeout("tcp", string(address), timeout)
+	conn, err := l.dialer("tcp", string(address), timeout)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,162 @@
+package consul
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// LogStoreFactory creates the stores Raft uses for its log and its stable
+// state, which are often the same underlying store. If the returned log store
+// implements io.Closer, it will be closed when the server shuts down.
+type LogStoreFactory func(config *Config) (raft.LogStore, raft.StableStore, error)
+
+// SnapshotStoreFactory creates the store Raft uses for its snapshots.
+type SnapshotStoreFactory func(config *Config) (raft.SnapshotStore, error)
+
+// InmemLogStoreFactory is a LogStoreFactory that keeps everything in memory,
+// so nothing survives a restart. This is used for dev mode.
+func InmemLogStoreFactory(config *Config) (raft.LogStore, raft.StableStore, error) {
+	store := raft.NewInmemStore()
+	return store, store, nil
+}
+
+// InmemSnapshotStoreFactory is a SnapshotStoreFactory that keeps snapshots in
+// memory, so nothing survives a restart. This is used for dev mode.
+func InmemSnapshotStoreFactory(config *Config) (raft.SnapshotStore, error) {
+	return &inmemSnapshotStore{}, nil
+}
+
+// inmemSnapshotStore is a raft.SnapshotStore that keeps the latest snapshot
+// in memory. Raft's own InmemSnapshotStore hands out its buffer when a snapshot
+// is opened, so it can only be read once, which breaks as soon as the snapshot
+// needs to be sent to more than one follower.
+type inmemSnapshotStore struct {
+	latest *inmemSnapshot
+	lock   sync.RWMutex
+}
+
+// inmemSnapshot is a complete snapshot held by an inmemSnapshotStore.
+type inmemSnapshot struct {
+	meta     raft.SnapshotMeta
+	contents []byte
+}
+
+func (s *inmemSnapshotStore) Create(version raft.SnapshotVersion, index, term uint64,
+	configuration raft.Configuration, configurationIndex uint64, trans raft.Transport) (raft.SnapshotSink, error) {
+	if version != 1 {
+		return nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	sink := &inmemSnapshotSink{
+		store: s,
+		meta: raft.SnapshotMeta{
+			Version:            version,
+			ID:                 fmt.Sprintf("%d-%d-%d", term, index, now),
+			Index:              index,
+			Term:               term,
+			Configuration:      configuration,
+			ConfigurationIndex: configurationIndex,
+		},
+	}
+	return sink, nil
+}
+
+func (s *inmemSnapshotStore) List() ([]*raft.SnapshotMeta, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.latest == nil {
+		return []*raft.SnapshotMeta{}, nil
+	}
+	meta := s.latest.meta
+	return []*raft.SnapshotMeta{&meta}, nil
+}
+
+func (s *inmemSnapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.latest == nil || s.latest.meta.ID != id {
+		return nil, nil, fmt.Errorf("failed to open snapshot id: %s", id)
+	}
+	meta := s.latest.meta
+	return &meta, ioutil.NopCloser(bytes.NewReader(s.latest.contents)), nil
+}
+
+// inmemSnapshotSink buffers a snapshot being written to an
+// inmemSnapshotStore. The snapshot only replaces the store's latest one once
+// it's closed successfully.
+type inmemSnapshotSink struct {
+	store    *inmemSnapshotStore
+	meta     raft.SnapshotMeta
+	contents bytes.Buffer
+	canceled bool
+}
+
+func (s *inmemSnapshotSink) Write(p []byte) (int, error) {
+	n, err := s.contents.Write(p)
+	s.meta.Size += int64(n)
+	return n, err
+}
+
+func (s *inmemSnapshotSink) Close() error {
+	if s.canceled {
+		return nil
+	}
+
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	s.store.latest = &inmemSnapshot{
+		meta:     s.meta,
+		contents: s.contents.Bytes(),
+	}
+	return nil
+}
+
+func (s *inmemSnapshotSink) ID() string {
+	return s.meta.ID
+}
+
+func (s *inmemSnapshotSink) Cancel() error {
+	s.canceled = true
+	return nil
+}
+
+// checkNoDiskRaftState makes sure there's no Raft state from the default
+// stores sitting in the data directory when factories are taking their place,
+// since the server would otherwise come up as if it were brand new and
+// silently ignore it.
+func checkNoDiskRaftState(config *Config) error {
+	if config.DataDir == "" {
+		return nil
+	}
+	path := filepath.Join(config.DataDir, raftState)
+
+	if config.LogStoreFactory != nil {
+		db := filepath.Join(path, "raft.db")
+		if _, err := os.Stat(db); err == nil {
+			return fmt.Errorf("Raft log store found at %q, but a log store factory is configured; move it out of the way to start with the new store", db)
+		}
+	}
+
+	if config.SnapshotStoreFactory != nil {
+		dir := filepath.Join(path, "snapshots")
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(entries) > 0 {
+			return fmt.Errorf("Raft snapshots found in %q, but a snapshot store factory is configured; move them out of the way to start with the new store", dir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestServer_InmemRaftStores(t *testing.T) {
+	var dirs []string
+	var servers []*Server
+	for i := 0; i < 3; i++ {
+		dir, s := testServerWithConfig(t, func(c *Config) {
+			c.Bootstrap = false
+			c.BootstrapExpect = 3
+			c.LogStoreFactory = InmemLogStoreFactory
+			c.SnapshotStoreFactory = InmemSnapshotStoreFactory
+		})
+		defer os.RemoveAll(dir)
+		defer s.Shutdown()
+		dirs = append(dirs, dir)
+		servers = append(servers, s)
+	}
+
+	// Join everyone up and wait for an election.
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		servers[0].config.SerfLANConfig.MemberlistConfig.BindPort)
+	for _, s := range servers[1:] {
+		if _, err := s.JoinLAN([]string{addr}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for _, s := range servers {
+		if err := testutil.WaitForResult(func() (bool, error) {
+			peers, _ := s.numPeers()
+			return peers == 3, fmt.Errorf("%d", peers)
+		}); err != nil {
+			t.Fatalf("should have 3 peers: %v", err)
+		}
+		testutil.WaitForLeader(t, s.RPC, "dc1")
+	}
+
+	// Write through a follower and make sure it lands everywhere.
+	codec := rpcClient(t, servers[1])
+	defer codec.Close()
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "foo",
+			Value: []byte("bar"),
+		},
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, s := range servers {
+		if err := testutil.WaitForResult(func() (bool, error) {
+			_, d, err := s.fsm.State().KVSGet(nil, "foo")
+			if err != nil {
+				return false, err
+			}
+			return d != nil && string(d.Value) == "bar", errors.New("not replicated")
+		}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Snapshot and restore should work with the in-memory snapshot store.
+	verifySnapshot(t, servers[0], "dc1", "")
+
+	// Nothing should have been written to the Raft directories.
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(dir, raftState, "raft.db")); !os.IsNotExist(err) {
+			t.Fatalf("should not have a raft.db: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, raftState, "snapshots")); !os.IsNotExist(err) {
+			t.Fatalf("should not have snapshots: %v", err)
+		}
+	}
+
+	// Take out the leader and make sure the others elect a new one.
+	var remaining []*Server
+	for _, s := range servers {
+		if s.IsLeader() {
+			s.Shutdown()
+		} else {
+			remaining = append(remaining, s)
+		}
+	}
+	if len(remaining) != 2 {
+		t.Fatalf("bad: %d", len(remaining))
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return remaining[0].IsLeader() || remaining[1].IsLeader(), nil
+	}); err != nil {
+		t.Fatalf("should have elected a new leader")
+	}
+}
+
+func TestServer_RaftStoreFactory_DiskStateFound(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	s1.Shutdown()
+
+	// Starting back up on the same data directory with a log store factory
+	// should refuse to ignore the BoltDB store that's there.
+	dir2, config := testServerConfig(t, "Node 2")
+	defer os.RemoveAll(dir2)
+	config.DataDir = dir1
+	config.LogStoreFactory = InmemLogStoreFactory
+	if _, err := NewServer(config); err == nil || !strings.Contains(err.Error(), "log store factory") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Same for snapshots, once there are some.
+	snaps := filepath.Join(dir1, raftState, "snapshots", "1-2-3")
+	if err := os.MkdirAll(snaps, 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dir3, config := testServerConfig(t, "Node 3")
+	defer os.RemoveAll(dir3)
+	config.DataDir = dir1
+	config.SnapshotStoreFactory = InmemSnapshotStoreFactory
+	if _, err := NewServer(config); err == nil || !strings.Contains(err.Error(), "snapshot store factory") {
+		t.Fatalf("bad: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package consul
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	// readinessReadTimeout is how long the readiness listener waits for an
+	// HTTP request before it falls back to answering with a single byte.
+	readinessReadTimeout = 250 * time.Millisecond
+
+	// readinessWriteTimeout bounds how long we spend sending an answer.
+	readinessWriteTimeout = time.Second
+)
+
+// These are the single byte answers the readiness listener gives to clients
+// that don't speak HTTP.
+const (
+	readinessReady    byte = '1'
+	readinessNotReady byte = '0'
+)
+
+// readinessStatus is the body of the readiness listener's HTTP answers.
+type readinessStatus struct {
+	Ready   bool
+	Reasons []string
+}
+
+// readinessReasons returns the reasons the server shouldn't be sent requests
+// right now, or nothing if it's ready. These are the same conditions the
+// server already acts on internally, so a load balancer sees the server the
+// way its peers do.
+func (s *Server) readinessReasons() []string {
+	var reasons []string
+	if atomic.LoadInt32(&s.stopping) == 1 {
+		reasons = append(reasons, "shutting down")
+	}
+	if s.raft.Leader() == "" {
+		reasons = append(reasons, "no cluster leader")
+	}
+	if s.catchingUp() {
+		reasons = append(reasons, "catching up with the leader")
+	}
+	if s.IsDraining() {
+		reasons = append(reasons, "draining")
+	}
+	if min := s.config.ReadinessMinDiskFree; min > 0 && s.config.DataDir != "" {
+		free, err := diskFree(s.config.DataDir)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("failed to check free disk space: %v", err))
+		} else if free < min {
+			reasons = append(reasons, fmt.Sprintf("only %d bytes free on disk", free))
+		}
+	}
+	return reasons
+}
+
+// setupReadiness starts the readiness listener on ReadinessAddr.
+func (s *Server) setupReadiness() error {
+	list, err := net.Listen("tcp", s.config.ReadinessAddr)
+	if err != nil {
+		return err
+	}
+	s.readinessListener = list
+	s.logger.Printf("[INFO] consul: readiness checks are being answered on %v", list.Addr())
+
+	go s.serveReadiness(list)
+	return nil
+}
+
+// serveReadiness answers readiness checks until the listener is closed.
+func (s *Server) serveReadiness(list net.Listener) {
+	for {
+		conn, err := list.Accept()
+		if err != nil {
+			select {
+			case <-s.shutdownCh:
+				return
+			default:
+			}
+			s.logger.Printf("[ERR] consul: failed to accept readiness conn: %v", err)
+			continue
+		}
+
+		go s.handleReadinessConn(conn)
+	}
+}
+
+// handleReadinessConn answers a single readiness check. A client that sends
+// an HTTP request gets a 200 or 503 with the reasons in the body. Anything
+// else, including a client that sends nothing, gets a single byte.
+func (s *Server) handleReadinessConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(readinessReadTimeout))
+	req, reqErr := http.ReadRequest(bufio.NewReader(conn))
+
+	reasons := s.readinessReasons()
+	ready := len(reasons) == 0
+	if ready {
+		metrics.SetGauge([]string{"consul", "server", "ready"}, 1)
+	} else {
+		metrics.SetGauge([]string{"consul", "server", "ready"}, 0)
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(readinessWriteTimeout))
+	if reqErr != nil {
+		answer := readinessNotReady
+		if ready {
+			answer = readinessReady
+		}
+		conn.Write([]byte{answer})
+		return
+	}
+
+	status := readinessStatus{Ready: ready, Reasons: reasons}
+	if status.Reasons == nil {
+		status.Reasons = []string{}
+	}
+	body, err := json.Marshal(&status)
+	if err != nil {
+		s.logger.Printf("[ERR] consul: failed to encode readiness status: %v", err)
+		return
+	}
+
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		Close:         true,
+		Request:       req,
+	}
+	if !ready {
+		resp.StatusCode = http.StatusServiceUnavailable
+	}
+	resp.Write(conn)
+}
@@ -0,0 +1,146 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+// readinessByte connects to the readiness listener without sending anything
+// and returns the byte it answers with.
+func readinessByte(addr string) (byte, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	buf, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) != 1 {
+		return 0, fmt.Errorf("bad: %q", buf)
+	}
+	return buf[0], nil
+}
+
+// readinessHTTP makes an HTTP request to the readiness listener and returns
+// the status code and the decoded body.
+func readinessHTTP(addr string) (int, *readinessStatus, error) {
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	var status readinessStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, &status, nil
+}
+
+func TestServer_Readiness(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ReadinessAddr = "127.0.0.1:0"
+		c.ReadinessShutdownDelay = 500 * time.Millisecond
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	addr := s1.readinessListener.Addr().String()
+
+	// The server isn't ready until it has a leader.
+	if err := testutil.WaitForResult(func() (bool, error) {
+		answer, err := readinessByte(addr)
+		if err != nil {
+			return false, err
+		}
+		return answer == readinessReady, fmt.Errorf("answer %q", answer)
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	code, status, err := readinessHTTP(addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if code != http.StatusOK || !status.Ready || len(status.Reasons) != 0 {
+		t.Fatalf("bad: %d %#v", code, status)
+	}
+
+	// Draining takes it out.
+	if err := s1.SetDraining(true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if answer, err := readinessByte(addr); err != nil || answer != readinessNotReady {
+		t.Fatalf("bad: %q %v", answer, err)
+	}
+	code, status, err = readinessHTTP(addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if code != http.StatusServiceUnavailable || status.Ready ||
+		len(status.Reasons) != 1 || status.Reasons[0] != "draining" {
+		t.Fatalf("bad: %d %#v", code, status)
+	}
+	if err := s1.SetDraining(false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if answer, err := readinessByte(addr); err != nil || answer != readinessReady {
+		t.Fatalf("bad: %q %v", answer, err)
+	}
+
+	// So does a full disk.
+	s1.config.ReadinessMinDiskFree = 1 << 62
+	code, status, err = readinessHTTP(addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if code != http.StatusServiceUnavailable || len(status.Reasons) != 1 ||
+		!strings.Contains(status.Reasons[0], "free on disk") {
+		t.Fatalf("bad: %d %#v", code, status)
+	}
+	s1.config.ReadinessMinDiskFree = 0
+
+	// During shutdown it should report not ready while the RPC listener
+	// is still up, and then go away.
+	doneCh := make(chan struct{})
+	go func() {
+		s1.Shutdown()
+		close(doneCh)
+	}()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		code, status, err := readinessHTTP(addr)
+		if err != nil {
+			return false, err
+		}
+		return code == http.StatusServiceUnavailable, fmt.Errorf("bad: %d %#v", code, status)
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, status, err = readinessHTTP(addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if status.Reasons[0] != "shutting down" {
+		t.Fatalf("bad: %#v", status)
+	}
+	conn, err := net.Dial("tcp", s1.config.RPCAddr.String())
+	if err != nil {
+		t.Fatalf("RPC listener should still be up: %v", err)
+	}
+	conn.Close()
+
+	<-doneCh
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatalf("readiness listener should be closed")
+	}
+}
@@ -0,0 +1,206 @@
+package consul
+
+import (
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// reapBatcher queues up deregistrations for nodes that Serf has reaped, so a
+// burst of them, like when a whole rack reboots, goes into Raft as a few
+// batches instead of one write per node. The batches are rate limited so
+// they don't crowd out the agents that are registering themselves again.
+type reapBatcher struct {
+	// size is the most nodes in a batch.
+	size int
+
+	// interval is the least time between batches, or zero for no limit.
+	interval time.Duration
+
+	// pending has the queued nodes in order, and queued is used to look
+	// them up.
+	pending []string
+	queued  map[string]struct{}
+	lock    sync.Mutex
+
+	// kickCh is signaled when a node is queued.
+	kickCh chan struct{}
+}
+
+// newReapBatcher returns a batcher that deregisters up to size nodes at a
+// time, at most rate times a second. A rate of zero doesn't limit batches.
+func newReapBatcher(size int, rate float64) *reapBatcher {
+	b := &reapBatcher{
+		size:   size,
+		queued: make(map[string]struct{}),
+		kickCh: make(chan struct{}, 1),
+	}
+	if rate > 0 {
+		b.interval = time.Duration(float64(time.Second) / rate)
+	}
+	return b
+}
+
+// add queues the node to be deregistered, if it isn't already.
+func (b *reapBatcher) add(node string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.queued[node]; ok {
+		return
+	}
+	b.queued[node] = struct{}{}
+	b.pending = append(b.pending, node)
+
+	select {
+	case b.kickCh <- struct{}{}:
+	default:
+	}
+}
+
+// cancel takes the node out of the queue, and returns true if it was there.
+// This is used when a node registers again, since the registration wins.
+func (b *reapBatcher) cancel(node string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.queued[node]; !ok {
+		return false
+	}
+	delete(b.queued, node)
+	for i, pending := range b.pending {
+		if pending == node {
+			b.pending = append(b.pending[:i], b.pending[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// next takes the next batch of nodes out of the queue. This is empty if
+// there's nothing queued.
+func (b *reapBatcher) next() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	n := len(b.pending)
+	if n > b.size {
+		n = b.size
+	}
+	batch := make([]string, n)
+	copy(batch, b.pending[:n])
+	b.pending = b.pending[n:]
+	for _, node := range batch {
+		delete(b.queued, node)
+	}
+	return batch
+}
+
+// reset empties the queue.
+func (b *reapBatcher) reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.pending = nil
+	b.queued = make(map[string]struct{})
+}
+
+// runReapBatcher deregisters queued reaped nodes in batches until leadership
+// is lost. Anything still queued then is dropped, and left to the next
+// leader's reconcile.
+func (s *Server) runReapBatcher(stopCh chan struct{}) {
+	b := s.reapBatcher
+	defer b.reset()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-s.shutdownCh:
+			return
+		case <-b.kickCh:
+		}
+
+		for {
+			nodes := b.next()
+			if len(nodes) == 0 {
+				break
+			}
+			if err := s.deregisterReapedBatch(nodes); err != nil {
+				s.logger.Printf("[ERR] consul: failed to deregister reaped members, will retry on the next reconcile: %v", err)
+			}
+
+			if b.interval > 0 {
+				select {
+				case <-stopCh:
+					return
+				case <-s.shutdownCh:
+					return
+				case <-s.clock.After(b.interval):
+				}
+			}
+		}
+	}
+}
+
+// deregisterReapedBatch deregisters the given reaped nodes in a single Raft
+// entry, or one entry per node if some servers don't know about batches.
+func (s *Server) deregisterReapedBatch(nodes []string) error {
+	defer metrics.MeasureSince([]string{"consul", "leader", "reap_batch", "apply"}, time.Now())
+	metrics.AddSample([]string{"consul", "leader", "reap_batch", "size"}, float32(len(nodes)))
+
+	if !serversSupport(s.LANMembers(), featureDeregisterBatchTag) {
+		return s.deregisterReapedNodes(nodes)
+	}
+
+	req := structs.DeregisterBatchRequest{
+		Datacenter: s.config.Datacenter,
+		Nodes:      nodes,
+	}
+	resp, err := s.raftApply(structs.DeregisterBatchRequestType, &req)
+	if err != nil {
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	if deleted, ok := resp.(int); ok {
+		s.logger.Printf("[INFO] consul: deregistered %d of %d reaped members in a batch", deleted, len(nodes))
+	}
+	return nil
+}
+
+// deregisterReapedNodes deregisters the given reaped nodes with a Raft entry
+// each, which servers that don't know about batches can apply. Like a batch,
+// this skips nodes that have come back since they were queued.
+func (s *Server) deregisterReapedNodes(nodes []string) error {
+	state := s.fsm.State()
+	deleted := 0
+	for _, node := range nodes {
+		_, check, err := state.NodeCheck(node, SerfCheckID)
+		if err != nil {
+			return err
+		}
+		if check != nil && check.Status == structs.HealthPassing {
+			continue
+		}
+		if err := s.deregisterNode(node); err != nil {
+			return err
+		}
+		deleted++
+	}
+	s.logger.Printf("[INFO] consul: deregistered %d of %d reaped members one at a time", deleted, len(nodes))
+	return nil
+}
+
+// cancelReapedDeregister drops any queued deregistration for the node, since
+// it's registering again.
+func (s *Server) cancelReapedDeregister(node string) {
+	if s.reapBatcher == nil || !s.reapBatcher.cancel(node) {
+		return
+	}
+	metrics.IncrCounter([]string{"consul", "leader", "reap_batch", "cancelled"}, 1)
+	s.logger.Printf("[INFO] consul: member '%s' registered again, cancelled its deregistration", node)
+}
@@ -0,0 +1,228 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/lib"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestReapBatcher(t *testing.T) {
+	b := newReapBatcher(2, 4)
+	if b.interval != 250*time.Millisecond {
+		t.Fatalf("bad: %v", b.interval)
+	}
+
+	b.add("a")
+	b.add("b")
+	b.add("a")
+	b.add("c")
+	b.add("d")
+	if !b.cancel("b") || b.cancel("b") || b.cancel("nope") {
+		t.Fatalf("bad")
+	}
+
+	if batch := b.next(); !reflect.DeepEqual(batch, []string{"a", "c"}) {
+		t.Fatalf("bad: %v", batch)
+	}
+	if batch := b.next(); !reflect.DeepEqual(batch, []string{"d"}) {
+		t.Fatalf("bad: %v", batch)
+	}
+	if batch := b.next(); len(batch) != 0 {
+		t.Fatalf("bad: %v", batch)
+	}
+
+	// Nodes can be queued again once they've been taken out.
+	b.add("a")
+	b.reset()
+	if batch := b.next(); len(batch) != 0 {
+		t.Fatalf("bad: %v", batch)
+	}
+}
+
+func TestLeader_ReapBatch(t *testing.T) {
+	clock := lib.NewFakeClock(time.Now())
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Clock = clock
+		c.LeaderReconcileHoldoff = 0
+		c.ReconcileInterval = time.Hour
+		c.ReapBatchSize = 5
+		c.ReapBatchRate = 10
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	// Keep track of the batches.
+	var lock sync.Mutex
+	var batches [][]string
+	s1.RegisterChangeHook(structs.DeregisterBatchRequestType, func(idx uint64, op interface{}) {
+		req := op.(*structs.DeregisterBatchRequest)
+		lock.Lock()
+		batches = append(batches, req.Nodes)
+		lock.Unlock()
+	})
+	getBatches := func() [][]string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([][]string(nil), batches...)
+	}
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register a bunch of failed nodes.
+	const numNodes = 20
+	var members []serf.Member
+	for i := 0; i < numNodes; i++ {
+		member := serf.Member{
+			Name:   fmt.Sprintf("node%d", i),
+			Addr:   net.ParseIP(fmt.Sprintf("127.0.1.%d", i)),
+			Port:   8301,
+			Tags:   map[string]string{"role": "node", "dc": "dc1"},
+			Status: serf.StatusFailed,
+		}
+		if err := s1.handleFailedMember(member); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		members = append(members, member)
+	}
+
+	// Reap them all at once, and then have the last one come back before
+	// its batch.
+	s1.localMemberEvent(serf.MemberEvent{Type: serf.EventMemberReap, Members: members})
+	back := members[numNodes-1]
+	back.Status = serf.StatusAlive
+	s1.localMemberEvent(serf.MemberEvent{Type: serf.EventMemberJoin, Members: []serf.Member{back}})
+
+	// The first batch goes right away, but the rest have to wait.
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return len(getBatches()) == 1, nil
+	}); err != nil {
+		t.Fatalf("should have a batch")
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		_, checks, err := s1.fsm.State().NodeChecks(nil, back.Name)
+		if err != nil {
+			return false, err
+		}
+		return len(checks) == 1 && checks[0].Status == structs.HealthPassing, nil
+	}); err != nil {
+		t.Fatalf("node should be alive again")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(getBatches()); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	// Let the rest through.
+	if err := testutil.WaitForResult(func() (bool, error) {
+		clock.Advance(100 * time.Millisecond)
+		_, nodes, err := s1.fsm.State().Nodes(nil)
+		if err != nil {
+			return false, err
+		}
+		return len(nodes) == 2, fmt.Errorf("%d nodes left", len(nodes))
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The node that came back should still be there, and shouldn't have
+	// been in any batch.
+	_, node, err := s1.fsm.State().GetNode(back.Name)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node == nil {
+		t.Fatalf("node should still be registered")
+	}
+	total, largest := 0, 0
+	for _, batch := range getBatches() {
+		for _, name := range batch {
+			if name == back.Name {
+				t.Fatalf("bad: %v", batch)
+			}
+		}
+		if len(batch) > largest {
+			largest = len(batch)
+		}
+		total += len(batch)
+	}
+	if total != numNodes-1 || largest != 5 {
+		t.Fatalf("bad: %v", getBatches())
+	}
+}
+
+func TestLeader_ReapBatch_OldServers(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.LeaderReconcileHoldoff = 0
+		c.ReconcileInterval = time.Hour
+		c.ReapBatchSize = 5
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	var lock sync.Mutex
+	var batches, deregistered int
+	s1.RegisterChangeHook(structs.DeregisterBatchRequestType, func(idx uint64, op interface{}) {
+		lock.Lock()
+		batches++
+		lock.Unlock()
+	})
+	s1.RegisterChangeHook(structs.DeregisterRequestType, func(idx uint64, op interface{}) {
+		lock.Lock()
+		deregistered++
+		lock.Unlock()
+	})
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Make it look like a server that doesn't know about batches.
+	tags := make(map[string]string)
+	for k, v := range s1.serfLAN.LocalMember().Tags {
+		tags[k] = v
+	}
+	delete(tags, featureDeregisterBatchTag)
+	if err := s1.serfLAN.SetTags(tags); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	const numNodes = 3
+	var members []serf.Member
+	for i := 0; i < numNodes; i++ {
+		member := serf.Member{
+			Name:   fmt.Sprintf("node%d", i),
+			Addr:   net.ParseIP(fmt.Sprintf("127.0.1.%d", i)),
+			Port:   8301,
+			Tags:   map[string]string{"role": "node", "dc": "dc1"},
+			Status: serf.StatusFailed,
+		}
+		if err := s1.handleFailedMember(member); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		members = append(members, member)
+	}
+	s1.localMemberEvent(serf.MemberEvent{Type: serf.EventMemberReap, Members: members})
+
+	// They should each get their own deregistration instead of a batch.
+	if err := testutil.WaitForResult(func() (bool, error) {
+		_, nodes, err := s1.fsm.State().Nodes(nil)
+		if err != nil {
+			return false, err
+		}
+		return len(nodes) == 1, fmt.Errorf("%d nodes left", len(nodes))
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if batches != 0 || deregistered != numNodes {
+		t.Fatalf("bad: %d batches, %d deregistrations", batches, deregistered)
+	}
+}
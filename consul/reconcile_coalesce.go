@@ -0,0 +1,65 @@
+package consul
+
+import (
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/lib"
+	"github.com/hashicorp/serf/serf"
+)
+
+// reconcileCoalescer holds on to Serf member events for a short window per
+// node, so a burst of events for one node, like the failed, alive, and
+// update events from an agent restart, turns into a single reconcile of the
+// node's final state.
+type reconcileCoalescer struct {
+	window time.Duration
+	clock  lib.Clock
+
+	// out is called with each node's final state once its window is up.
+	out func(serf.Member)
+
+	pending map[string]*serf.Member
+	lock    sync.Mutex
+}
+
+// newReconcileCoalescer returns a coalescer that passes members to out once
+// the given window has passed since the first event for them.
+func newReconcileCoalescer(window time.Duration, clock lib.Clock, out func(serf.Member)) *reconcileCoalescer {
+	return &reconcileCoalescer{
+		window:  window,
+		clock:   clock,
+		out:     out,
+		pending: make(map[string]*serf.Member),
+	}
+}
+
+// add queues the member's latest state. The first event for a node starts
+// its window; later ones in the window just replace the state that will be
+// passed along.
+func (c *reconcileCoalescer) add(m serf.Member) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.pending[m.Name]; ok {
+		c.pending[m.Name] = &m
+		metrics.IncrCounter([]string{"consul", "leader", "reconcile", "coalesced"}, 1)
+		return
+	}
+
+	c.pending[m.Name] = &m
+	c.clock.AfterFunc(c.window, func() { c.flush(m.Name) })
+}
+
+// flush passes along the final state for the node.
+func (c *reconcileCoalescer) flush(name string) {
+	c.lock.Lock()
+	m, ok := c.pending[name]
+	delete(c.pending, name)
+	c.lock.Unlock()
+
+	if ok {
+		c.out(*m)
+	}
+}
@@ -0,0 +1,131 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/lib"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestLeader_ReconcileCoalesce(t *testing.T) {
+	clock := lib.NewFakeClock(time.Now())
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Clock = clock
+		c.LeaderReconcileHoldoff = 0
+
+		// The test node isn't a real Serf member, so put off the
+		// periodic reconcile to keep it from being reaped.
+		c.ReconcileInterval = time.Hour
+		c.ReconcileCoalesceWindow = time.Second
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	// Count the registrations for the test node.
+	var lock sync.Mutex
+	var applies []*structs.RegisterRequest
+	s1.RegisterChangeHook(structs.RegisterRequestType, func(idx uint64, op interface{}) {
+		req := op.(*structs.RegisterRequest)
+		if req.Node != "flappy" {
+			return
+		}
+		lock.Lock()
+		applies = append(applies, req)
+		lock.Unlock()
+	})
+	countApplies := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(applies)
+	}
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Feed in the events an agent restart would make, along with an
+	// address change on the way.
+	member := serf.Member{
+		Name:   "flappy",
+		Addr:   net.ParseIP("127.0.0.5"),
+		Port:   8301,
+		Tags:   map[string]string{"role": "node", "dc": "dc1"},
+		Status: serf.StatusFailed,
+	}
+	event := func(typ serf.EventType, status serf.MemberStatus, addr string) {
+		m := member
+		m.Status = status
+		m.Addr = net.ParseIP(addr)
+		s1.localMemberEvent(serf.MemberEvent{Type: typ, Members: []serf.Member{m}})
+	}
+	event(serf.EventMemberJoin, serf.StatusAlive, "127.0.0.5")
+	event(serf.EventMemberFailed, serf.StatusFailed, "127.0.0.5")
+	event(serf.EventMemberJoin, serf.StatusAlive, "127.0.0.5")
+	event(serf.EventMemberUpdate, serf.StatusAlive, "127.0.0.6")
+
+	// Nothing should happen until the window is up.
+	time.Sleep(100 * time.Millisecond)
+	if n := countApplies(); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	// Then there should be exactly one registration, with the final state.
+	clock.Advance(time.Second)
+	if err := testutil.WaitForResult(func() (bool, error) {
+		n := countApplies()
+		return n == 1, fmt.Errorf("%d applies", n)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := countApplies(); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	state := s1.fsm.State()
+	_, node, err := state.GetNode("flappy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node == nil || node.Address != "127.0.0.6" {
+		t.Fatalf("bad: %#v", node)
+	}
+	_, checks, err := state.NodeChecks(nil, "flappy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(checks) != 1 || checks[0].Status != structs.HealthPassing {
+		t.Fatalf("bad: %#v", checks)
+	}
+
+	// A flap that ends up back where it started shouldn't write anything.
+	event(serf.EventMemberFailed, serf.StatusFailed, "127.0.0.6")
+	event(serf.EventMemberJoin, serf.StatusAlive, "127.0.0.6")
+	clock.Advance(time.Second)
+	time.Sleep(100 * time.Millisecond)
+	if n := countApplies(); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	// A flap that ends up failed should be written as failed.
+	event(serf.EventMemberJoin, serf.StatusAlive, "127.0.0.6")
+	event(serf.EventMemberFailed, serf.StatusFailed, "127.0.0.6")
+	clock.Advance(time.Second)
+	if err := testutil.WaitForResult(func() (bool, error) {
+		n := countApplies()
+		return n == 2, fmt.Errorf("%d applies", n)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	_, checks, err = state.NodeChecks(nil, "flappy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(checks) != 1 || checks[0].Status != structs.HealthCritical {
+		t.Fatalf("bad: %#v", checks)
+	}
+}
@@ -0,0 +1,249 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/lib"
+	"github.com/hashicorp/serf/serf"
+)
+
+// Reload applies the tunable parts of the given config to the running
+// server, without restarting Serf or Raft. The new config has to match the
+// running one for everything that can't be changed live, like the data
+// directory and bind addresses, or the reload is rejected with an error
+// naming those fields and nothing is changed.
+//
+// The reloadable fields are AutopilotConfig, AutopilotInterval,
+// ServerHealthInterval, CoordinateUpdatePeriod, ACLDownPolicy, and ACLTTL.
+// AutopilotConfig is only the initial configuration, since the live one is
+// kept in the state store, so a change to it is written there when this
+// server is the leader.
+func (s *Server) Reload(config *Config) error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	if fixed := fixedConfigChanges(s.config, config); len(fixed) > 0 {
+		return fmt.Errorf("cannot change %s without a restart", strings.Join(fixed, ", "))
+	}
+	if errs := validateReloadableConfig(reloadableConfig(config)); len(errs) > 0 {
+		var msgs []string
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		return fmt.Errorf("invalid config: %s", strings.Join(msgs, ", "))
+	}
+
+	s.configLock.Lock()
+	var changed []string
+	autopilotChanged := !reflect.DeepEqual(s.config.AutopilotConfig, config.AutopilotConfig)
+	if autopilotChanged {
+		conf := *config.AutopilotConfig
+		s.config.AutopilotConfig = &conf
+		changed = append(changed, "AutopilotConfig")
+	}
+	if s.config.AutopilotInterval != config.AutopilotInterval {
+		s.config.AutopilotInterval = config.AutopilotInterval
+		changed = append(changed, "AutopilotInterval")
+	}
+	if s.config.ServerHealthInterval != config.ServerHealthInterval {
+		s.config.ServerHealthInterval = config.ServerHealthInterval
+		changed = append(changed, "ServerHealthInterval")
+	}
+	if s.config.CoordinateUpdatePeriod != config.CoordinateUpdatePeriod {
+		s.config.CoordinateUpdatePeriod = config.CoordinateUpdatePeriod
+		changed = append(changed, "CoordinateUpdatePeriod")
+	}
+	if s.config.ACLDownPolicy != config.ACLDownPolicy {
+		s.config.ACLDownPolicy = config.ACLDownPolicy
+		changed = append(changed, "ACLDownPolicy")
+	}
+	if s.config.ACLTTL != config.ACLTTL {
+		s.config.ACLTTL = config.ACLTTL
+		changed = append(changed, "ACLTTL")
+	}
+
+	// Wake up anything that needs to look at the new values.
+	if len(changed) > 0 {
+		close(s.reloadCh)
+		s.reloadCh = make(chan struct{})
+	}
+	s.configLock.Unlock()
+
+	if len(changed) == 0 {
+		return nil
+	}
+	s.aclCache.setDownPolicy(config.ACLDownPolicy, config.ACLTTL)
+	s.logger.Printf("[INFO] consul: reloaded config, changed %s", strings.Join(changed, ", "))
+
+	if autopilotChanged && s.IsLeader() {
+		req := structs.AutopilotSetConfigRequest{
+			Datacenter: s.config.Datacenter,
+			Config:     *config.AutopilotConfig,
+		}
+		resp, err := s.raftApply(structs.AutopilotRequestType, &req)
+		if err != nil {
+			return fmt.Errorf("failed to apply autopilot config: %v", err)
+		}
+		if respErr, ok := resp.(error); ok {
+			return fmt.Errorf("failed to apply autopilot config: %v", respErr)
+		}
+	}
+	return nil
+}
+
+// fixedConfigChanges returns the names of the fields that differ between the
+// two configs but can't be changed without restarting the server.
+func fixedConfigChanges(old, new *Config) []string {
+	var fixed []string
+	if old.Datacenter != new.Datacenter {
+		fixed = append(fixed, "Datacenter")
+	}
+	if old.NodeName != new.NodeName {
+		fixed = append(fixed, "NodeName")
+	}
+	if old.NodeID != new.NodeID {
+		fixed = append(fixed, "NodeID")
+	}
+	if old.DataDir != new.DataDir {
+		fixed = append(fixed, "DataDir")
+	}
+	if old.DevMode != new.DevMode {
+		fixed = append(fixed, "DevMode")
+	}
+	if !sameTCPAddr(old.RPCAddr, new.RPCAddr) {
+		fixed = append(fixed, "RPCAddr")
+	}
+	if !sameTCPAddr(old.RPCAdvertise, new.RPCAdvertise) {
+		fixed = append(fixed, "RPCAdvertise")
+	}
+	for _, pool := range []struct {
+		name     string
+		old, new *serf.Config
+	}{
+		{"SerfLANConfig", old.SerfLANConfig, new.SerfLANConfig},
+		{"SerfWANConfig", old.SerfWANConfig, new.SerfWANConfig},
+	} {
+		var oldAddr, newAddr string
+		var oldPort, newPort int
+		if pool.old != nil && pool.old.MemberlistConfig != nil {
+			oldAddr, oldPort = pool.old.MemberlistConfig.BindAddr, pool.old.MemberlistConfig.BindPort
+		}
+		if pool.new != nil && pool.new.MemberlistConfig != nil {
+			newAddr, newPort = pool.new.MemberlistConfig.BindAddr, pool.new.MemberlistConfig.BindPort
+		}
+		if oldAddr != newAddr {
+			fixed = append(fixed, pool.name+".MemberlistConfig.BindAddr")
+		}
+		if oldPort != newPort {
+			fixed = append(fixed, pool.name+".MemberlistConfig.BindPort")
+		}
+	}
+	return fixed
+}
+
+// sameTCPAddr returns true if the two addresses are the same.
+func sameTCPAddr(a, b *net.TCPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Port == b.Port && a.Zone == b.Zone
+}
+
+// reloadNotify returns a channel that's closed the next time the config is
+// reloaded with changes.
+func (s *Server) reloadNotify() <-chan struct{} {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.reloadCh
+}
+
+// autopilotConfig returns a copy of the configured Autopilot settings.
+func (s *Server) autopilotConfig() structs.AutopilotConfig {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return *s.config.AutopilotConfig
+}
+
+// autopilotInterval returns how often the Autopilot loop runs.
+func (s *Server) autopilotInterval() time.Duration {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.config.AutopilotInterval
+}
+
+// serverHealthInterval returns how often server health is checked.
+func (s *Server) serverHealthInterval() time.Duration {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.config.ServerHealthInterval
+}
+
+// coordinateUpdatePeriod returns how often coordinate updates are flushed.
+func (s *Server) coordinateUpdatePeriod() time.Duration {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.config.CoordinateUpdatePeriod
+}
+
+// aclTTL returns how long non-authoritative servers may cache ACLs.
+func (s *Server) aclTTL() time.Duration {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.config.ACLTTL
+}
+
+// reloadTicker is a ticker whose interval is looked up again whenever the
+// server's config is reloaded. It's only meant to be used by one goroutine.
+type reloadTicker struct {
+	srv      *Server
+	interval func() time.Duration
+	current  time.Duration
+	ticker   lib.Ticker
+	reloadCh <-chan struct{}
+}
+
+// newReloadTicker returns a ticker that ticks at the period returned by the
+// given function.
+func (s *Server) newReloadTicker(interval func() time.Duration) *reloadTicker {
+	t := &reloadTicker{
+		srv:      s,
+		interval: interval,
+	}
+	t.reloadCh = s.reloadNotify()
+	t.current = interval()
+	t.ticker = s.clock.NewTicker(t.current)
+	return t
+}
+
+// C returns the channel the ticks are sent on. This changes when the
+// interval does, so it should be called each time around the loop.
+func (t *reloadTicker) C() <-chan time.Time {
+	return t.ticker.C()
+}
+
+// Reloaded returns a channel that's closed when the config is reloaded, at
+// which point Reset should be called.
+func (t *reloadTicker) Reloaded() <-chan struct{} {
+	return t.reloadCh
+}
+
+// Reset picks up the interval after a reload, restarting the ticker if it
+// changed.
+func (t *reloadTicker) Reset() {
+	t.reloadCh = t.srv.reloadNotify()
+	if d := t.interval(); d != t.current {
+		t.ticker.Stop()
+		t.current = d
+		t.ticker = t.srv.clock.NewTicker(d)
+	}
+}
+
+// Stop stops the ticker.
+func (t *reloadTicker) Stop() {
+	t.ticker.Stop()
+}
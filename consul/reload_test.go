@@ -0,0 +1,144 @@
+package consul
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestServer_Reload(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.AutopilotInterval = 100 * time.Millisecond
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Keep some RPCs going the whole time.
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codec := rpcClient(t, s1)
+			defer codec.Close()
+			for {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				arg := structs.DCSpecificRequest{
+					Datacenter: "dc1",
+				}
+				var out structs.IndexedNodes
+				if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &arg, &out); err != nil {
+					t.Errorf("err: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(stopCh)
+
+	// Turn off dead server cleanup and change the intervals.
+	conf := *s1.config
+	autopilotConf := *conf.AutopilotConfig
+	autopilotConf.CleanupDeadServers = false
+	conf.AutopilotConfig = &autopilotConf
+	conf.AutopilotInterval = 200 * time.Millisecond
+	conf.ServerHealthInterval = time.Second
+	conf.ACLDownPolicy = "deny"
+	conf.ACLTTL = time.Minute
+	if err := s1.Reload(&conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The leader should be using the new Autopilot config by the next
+	// time the loop runs.
+	time.Sleep(100 * time.Millisecond)
+	_, state, err := s1.fsm.State().AutopilotConfig()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if state == nil || state.CleanupDeadServers {
+		t.Fatalf("bad: %#v", state)
+	}
+
+	if d := s1.autopilotInterval(); d != 200*time.Millisecond {
+		t.Fatalf("bad: %v", d)
+	}
+	if d := s1.serverHealthInterval(); d != time.Second {
+		t.Fatalf("bad: %v", d)
+	}
+	if policy, ttl := s1.aclCache.getDownPolicy(); policy != "deny" || ttl != time.Minute {
+		t.Fatalf("bad: %s %v", policy, ttl)
+	}
+
+	// Reloading the same thing again shouldn't do anything.
+	reloadCh := s1.reloadNotify()
+	if err := s1.Reload(&conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-reloadCh:
+		t.Fatalf("should not have been notified")
+	default:
+	}
+}
+
+func TestServer_Reload_Fixed(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	// Try to change things that need a restart along with something that
+	// doesn't.
+	conf := *s1.config
+	conf.DataDir = "/nope"
+	conf.Datacenter = "dc2"
+	lan := *conf.SerfLANConfig
+	memberlist := *lan.MemberlistConfig
+	memberlist.BindPort++
+	lan.MemberlistConfig = &memberlist
+	conf.SerfLANConfig = &lan
+	conf.ACLTTL = time.Hour
+	err := s1.Reload(&conf)
+	if err == nil {
+		t.Fatalf("should fail")
+	}
+	for _, field := range []string{"Datacenter", "DataDir", "SerfLANConfig.MemberlistConfig.BindPort"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Fatalf("missing %s: %v", field, err)
+		}
+	}
+	if strings.Contains(err.Error(), "ACLTTL") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Nothing should have changed.
+	if ttl := s1.aclTTL(); ttl == time.Hour {
+		t.Fatalf("bad: %v", ttl)
+	}
+
+	// Bad values should be caught too.
+	conf = *s1.config
+	conf.ACLDownPolicy = "nope"
+	if err := s1.Reload(&conf); err == nil || !strings.Contains(err.Error(), "down ACL policy") {
+		t.Fatalf("err: %v", err)
+	}
+	conf = *s1.config
+	conf.AutopilotInterval = 0
+	if err := s1.Reload(&conf); err == nil || !strings.Contains(err.Error(), "AutopilotInterval") {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package consul
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/consul/consul/agent"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/raft"
+)
+
+// removalImpact works out what the cluster would look like if the server with
+// the given ID were removed from the Raft configuration, using Autopilot's
+// latest view of server health. This must be run on the leader.
+func (s *Server) removalImpact(id raft.ServerID) (*structs.RemovalImpactReply, error) {
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	health := make(map[raft.ServerID]structs.ServerHealth)
+	for _, h := range s.getClusterHealth().Servers {
+		health[raft.ServerID(h.ID)] = h
+	}
+
+	// Redundancy zones come from the servers' LAN Serf tags.
+	_, autopilotConf, err := s.fsm.State().AutopilotConfig()
+	if err != nil {
+		return nil, err
+	}
+	var zones map[raft.ServerID]string
+	if autopilotConf != nil && autopilotConf.RedundancyZoneTag != "" {
+		zones = make(map[raft.ServerID]string)
+		for _, m := range s.LANMembers() {
+			if ok, parts := agent.IsConsulServer(m); ok {
+				zones[raft.ServerID(parts.ID)] = m.Tags[autopilotConf.RedundancyZoneTag]
+			}
+		}
+	}
+
+	return computeRemovalImpact(future.Configuration().Servers, health, zones, id)
+}
+
+// computeRemovalImpact does the work for removalImpact. Servers missing from
+// the health map are treated as unhealthy, and servers missing from the zones
+// map, or with a blank zone, aren't counted in any zone. A nil zones map means
+// redundancy zones aren't in use.
+func computeRemovalImpact(servers []raft.Server, health map[raft.ServerID]structs.ServerHealth,
+	zones map[raft.ServerID]string, id raft.ServerID) (*structs.RemovalImpactReply, error) {
+
+	reply := &structs.RemovalImpactReply{ID: id}
+	found := false
+	healthyBefore := make(map[string]int)
+	zoneStats := make(map[string]*structs.RemovalImpactZone)
+	healthyVoters := 0
+	for _, server := range servers {
+		h, ok := health[server.ID]
+		if !ok {
+			h = structs.ServerHealth{
+				ID:      string(server.ID),
+				Address: string(server.Address),
+				Voter:   server.Suffrage == raft.Voter,
+			}
+		}
+		zone := zones[server.ID]
+		if zone != "" {
+			if _, ok := zoneStats[zone]; !ok {
+				zoneStats[zone] = &structs.RemovalImpactZone{Name: zone}
+			}
+			if h.Healthy {
+				healthyBefore[zone]++
+			}
+		}
+
+		if server.ID == id {
+			found = true
+			reply.Node = h.Name
+			reply.Voter = isVoter(server.Suffrage)
+			reply.Zone = zone
+			continue
+		}
+
+		reply.Servers = append(reply.Servers, h)
+		if isVoter(server.Suffrage) {
+			reply.Voters++
+			if h.Healthy {
+				healthyVoters++
+			}
+		}
+		if zone != "" {
+			z := zoneStats[zone]
+			z.Servers++
+			if h.Healthy {
+				z.HealthyServers++
+			}
+			if isVoter(server.Suffrage) {
+				z.Voters++
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Server %q was not found in the Raft configuration", id)
+	}
+
+	// Raft needs a majority of the voters, so non-voters don't count
+	// towards the quorum size.
+	quorum := reply.Voters/2 + 1
+	reply.QuorumMaintained = reply.Voters > 0 && healthyVoters >= quorum
+	if healthyVoters > quorum {
+		reply.FailureTolerance = healthyVoters - quorum
+	}
+
+	reply.Healthy = len(reply.Servers) > 0
+	for _, h := range reply.Servers {
+		if !h.Healthy {
+			reply.Healthy = false
+			break
+		}
+	}
+
+	if zones != nil {
+		for name, z := range zoneStats {
+			z.LosesRedundancy = healthyBefore[name] > 1 && z.HealthyServers == 1
+			z.Empty = healthyBefore[name] > 0 && z.HealthyServers == 0
+			reply.Zones = append(reply.Zones, *z)
+		}
+		sort.Slice(reply.Zones, func(i, j int) bool {
+			return reply.Zones[i].Name < reply.Zones[j].Name
+		})
+	}
+	return reply, nil
+}
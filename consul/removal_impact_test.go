@@ -0,0 +1,258 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+	"github.com/hashicorp/raft"
+)
+
+// testRemovalImpactCluster starts a cluster with a server in each of the
+// given redundancy zones, all as healthy voters. The first server is the
+// leader.
+func testRemovalImpactCluster(t *testing.T, zones ...string) ([]string, []*Server) {
+	var dirs []string
+	var servers []*Server
+	for i, zone := range zones {
+		zone := zone
+		dir, s := testServerWithConfig(t, func(c *Config) {
+			c.Datacenter = "dc1"
+			c.Bootstrap = i == 0
+			c.RaftConfig.ProtocolVersion = 3
+			c.JoinAsVoter = true
+			c.ServerHealthInterval = 500 * time.Millisecond
+			c.AutopilotConfig.CleanupDeadServers = false
+			c.AutopilotConfig.ServerStabilizationTime = time.Hour
+			c.AutopilotConfig.RedundancyZoneTag = "zone"
+			c.SerfLANConfig.Tags = map[string]string{"zone": zone}
+
+			// Give the leader some slack so it doesn't step down while
+			// the new voters catch up.
+			c.RaftConfig.LeaderLeaseTimeout = 200 * time.Millisecond
+			c.RaftConfig.HeartbeatTimeout = 400 * time.Millisecond
+			c.RaftConfig.ElectionTimeout = 400 * time.Millisecond
+		})
+		dirs = append(dirs, dir)
+		servers = append(servers, s)
+	}
+	s1 := servers[0]
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Add the servers one at a time, so there's never a quorum of voters
+	// that are still catching up.
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	for i, s := range servers[1:] {
+		if _, err := s.JoinLAN([]string{addr}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := testutil.WaitForResult(func() (bool, error) {
+			future := s1.raft.GetConfiguration()
+			if err := future.Error(); err != nil {
+				return false, err
+			}
+			voters := 0
+			for _, server := range future.Configuration().Servers {
+				if server.Suffrage == raft.Voter {
+					voters++
+				}
+			}
+			return voters == i+2, fmt.Errorf("bad: %v", future.Configuration().Servers)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := testutil.WaitForResult(func() (bool, error) {
+		health := s1.getClusterHealth()
+		if !s1.IsLeader() || !health.Healthy || len(health.Servers) != len(zones) {
+			return false, fmt.Errorf("bad: %#v", health)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return dirs, servers
+}
+
+func getRemovalImpact(t *testing.T, s *Server, id string) structs.RemovalImpactReply {
+	codec := rpcClient(t, s)
+	defer codec.Close()
+
+	arg := structs.RemovalImpactRequest{
+		Datacenter: "dc1",
+		ID:         raft.ServerID(id),
+	}
+	var reply structs.RemovalImpactReply
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.RemovalImpact", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return reply
+}
+
+func TestOperator_RemovalImpact_ThreeServers(t *testing.T) {
+	dirs, servers := testRemovalImpactCluster(t, "a", "a", "b")
+	for i, s := range servers {
+		defer os.RemoveAll(dirs[i])
+		defer s.Shutdown()
+	}
+	s1, s2, s3 := servers[0], servers[1], servers[2]
+
+	// Removing a voter leaves two voters, which is still a quorum but
+	// can't lose another server. Asking a follower gets forwarded.
+	reply := getRemovalImpact(t, s3, string(s2.config.NodeID))
+	if reply.Node != s2.config.NodeName || !reply.Voter || reply.Zone != "a" {
+		t.Fatalf("bad: %#v", reply)
+	}
+	if reply.Voters != 2 || reply.FailureTolerance != 0 || !reply.QuorumMaintained || !reply.Healthy {
+		t.Fatalf("bad: %#v", reply)
+	}
+	if len(reply.Servers) != 2 {
+		t.Fatalf("bad: %#v", reply.Servers)
+	}
+	for _, h := range reply.Servers {
+		if h.ID == string(s2.config.NodeID) {
+			t.Fatalf("bad: %#v", reply.Servers)
+		}
+	}
+	expected := []structs.RemovalImpactZone{
+		{Name: "a", Servers: 1, HealthyServers: 1, Voters: 1, LosesRedundancy: true},
+		{Name: "b", Servers: 1, HealthyServers: 1, Voters: 1},
+	}
+	if fmt.Sprintf("%v", reply.Zones) != fmt.Sprintf("%v", expected) {
+		t.Fatalf("bad: %#v", reply.Zones)
+	}
+
+	// Nothing should have changed.
+	future := s1.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(future.Configuration().Servers) != 3 {
+		t.Fatalf("bad: %v", future.Configuration().Servers)
+	}
+
+	// Make the third server a non-voter. Removing it doesn't change the
+	// voters, but empties its zone.
+	if err := s1.raft.DemoteVoter(raft.ServerID(s3.config.NodeID), 0, 0).Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reply = getRemovalImpact(t, s1, string(s3.config.NodeID))
+	if reply.Voter || reply.Zone != "b" {
+		t.Fatalf("bad: %#v", reply)
+	}
+	if reply.Voters != 2 || reply.FailureTolerance != 0 || !reply.QuorumMaintained || !reply.Healthy {
+		t.Fatalf("bad: %#v", reply)
+	}
+	expected = []structs.RemovalImpactZone{
+		{Name: "a", Servers: 2, HealthyServers: 2, Voters: 2},
+		{Name: "b", Empty: true},
+	}
+	if fmt.Sprintf("%v", reply.Zones) != fmt.Sprintf("%v", expected) {
+		t.Fatalf("bad: %#v", reply.Zones)
+	}
+
+	// Unknown servers are an error.
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+	arg := structs.RemovalImpactRequest{
+		Datacenter: "dc1",
+		ID:         "nope",
+	}
+	err := msgpackrpc.CallWithCodec(codec, "Operator.RemovalImpact", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), "was not found") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestOperator_RemovalImpact_FiveServers(t *testing.T) {
+	dirs, servers := testRemovalImpactCluster(t, "a", "a", "b", "b", "c")
+	for i, s := range servers {
+		defer os.RemoveAll(dirs[i])
+		defer s.Shutdown()
+	}
+	s1 := servers[0]
+
+	// Removing a voter leaves four, which needs three for a quorum.
+	reply := getRemovalImpact(t, s1, string(servers[1].config.NodeID))
+	if !reply.Voter || reply.Voters != 4 || reply.FailureTolerance != 1 ||
+		!reply.QuorumMaintained || !reply.Healthy || len(reply.Servers) != 4 {
+		t.Fatalf("bad: %#v", reply)
+	}
+
+	// Removing a non-voter doesn't change the voters.
+	s5 := servers[4]
+	if err := s1.raft.DemoteVoter(raft.ServerID(s5.config.NodeID), 0, 0).Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reply = getRemovalImpact(t, s1, string(s5.config.NodeID))
+	if reply.Voter || reply.Voters != 4 || reply.FailureTolerance != 1 ||
+		!reply.QuorumMaintained || !reply.Healthy || len(reply.Servers) != 4 {
+		t.Fatalf("bad: %#v", reply)
+	}
+	if len(reply.Zones) != 3 || reply.Zones[2].Name != "c" || !reply.Zones[2].Empty {
+		t.Fatalf("bad: %#v", reply.Zones)
+	}
+
+	// Once a voter has failed, the unhealthy server counts against the
+	// remaining set. Removing another voter from the four leaves only two
+	// healthy voters out of three.
+	s4 := servers[3]
+	s4.Shutdown()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		health := s1.getServerHealth(string(s4.config.NodeID))
+		return health != nil && !health.Healthy, fmt.Errorf("bad: %#v", health)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	reply = getRemovalImpact(t, s1, string(servers[2].config.NodeID))
+	if !reply.Voter || reply.Voters != 3 || reply.FailureTolerance != 0 ||
+		!reply.QuorumMaintained || reply.Healthy {
+		t.Fatalf("bad: %#v", reply)
+	}
+	if len(reply.Zones) != 3 || reply.Zones[1].Name != "b" || !reply.Zones[1].Empty {
+		t.Fatalf("bad: %#v", reply.Zones)
+	}
+}
+
+func TestOperator_RemovalImpact_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+		c.RaftConfig.ProtocolVersion = 3
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Make a request with no token to make sure it gets denied.
+	arg := structs.RemovalImpactRequest{
+		Datacenter: "dc1",
+		ID:         raft.ServerID(s1.config.NodeID),
+	}
+	var reply structs.RemovalImpactReply
+	err := msgpackrpc.CallWithCodec(codec, "Operator.RemovalImpact", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// It should go through with the master token. Removing the only
+	// server would lose the quorum.
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.RemovalImpact", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Voters != 0 || reply.QuorumMaintained || reply.Healthy {
+		t.Fatalf("bad: %#v", reply)
+	}
+}
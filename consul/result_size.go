@@ -0,0 +1,85 @@
+package consul
+
+import (
+	"reflect"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// truncateResults cuts the slice pointed to by results short, at a record
+// boundary, so that its estimated encoded size fits in RPCMaxResultSize. The
+// query meta is updated to say whether anything was left off. This should be
+// called once the results are fully assembled (filtered and sorted) so the
+// records that are kept are the ones the caller cares about most.
+//
+// The index in the query meta is left alone, so it's always the index of the
+// full result set. That way a blocking query on a truncated result will
+// block until something actually changes, rather than spinning.
+func (s *Server) truncateResults(meta *structs.QueryMeta, results interface{}) {
+	meta.Truncated, meta.Omitted = false, 0
+
+	limit := s.config.RPCMaxResultSize
+	if limit <= 0 {
+		return
+	}
+
+	v := reflect.ValueOf(results).Elem()
+	size := 0
+	for i := 0; i < v.Len(); i++ {
+		// We always keep the first record so callers can make progress
+		// even if a single record is over the limit.
+		size += estimateSize(v.Index(i))
+		if size > limit && i > 0 {
+			meta.Truncated, meta.Omitted = true, v.Len()-i
+			v.Set(v.Slice(0, i))
+			metrics.IncrCounter([]string{"consul", "rpc", "query", "truncated"}, 1)
+			return
+		}
+	}
+}
+
+// estimateSize returns a rough estimate of how many bytes it will take to
+// encode the given value. This isn't exact, but it's cheap and it's in the
+// right proportion, which is all we need to keep replies bounded.
+func estimateSize(v reflect.Value) int {
+	switch v.Kind() {
+	case reflect.String:
+		return v.Len() + 2
+
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Len() + 2
+		}
+		size := 2
+		for i := 0; i < v.Len(); i++ {
+			size += estimateSize(v.Index(i))
+		}
+		return size
+
+	case reflect.Map:
+		size := 2
+		for _, key := range v.MapKeys() {
+			size += estimateSize(key) + estimateSize(v.MapIndex(key))
+		}
+		return size
+
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return 1
+		}
+		return estimateSize(v.Elem())
+
+	case reflect.Struct:
+		// Field names are encoded along with the values.
+		size := 2
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			size += len(t.Field(i).Name) + estimateSize(v.Field(i))
+		}
+		return size
+
+	default:
+		return 8
+	}
+}
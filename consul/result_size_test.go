@@ -0,0 +1,219 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestServer_estimateSize(t *testing.T) {
+	small := &structs.Node{Node: "a", Address: "127.0.0.1"}
+	big := &structs.Node{
+		Node:    "a",
+		Address: "127.0.0.1",
+		Meta:    map[string]string{"rack": "this-is-a-long-rack-name"},
+	}
+	smallSize := estimateSize(reflect.ValueOf(small))
+	bigSize := estimateSize(reflect.ValueOf(big))
+	if smallSize <= 0 || bigSize <= smallSize {
+		t.Fatalf("bad: %d %d", smallSize, bigSize)
+	}
+
+	// Byte slices should be counted by length, not per element.
+	ent := &structs.DirEntry{Key: "foo", Value: make([]byte, 1024)}
+	if size := estimateSize(reflect.ValueOf(ent)); size < 1024 || size > 2048 {
+		t.Fatalf("bad: %d", size)
+	}
+}
+
+func TestServer_truncateResults(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.RPCMaxResultSize = 0
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	var nodes structs.Nodes
+	for i := 0; i < 10; i++ {
+		nodes = append(nodes, &structs.Node{Node: fmt.Sprintf("node%d", i)})
+	}
+	recordSize := estimateSize(reflect.ValueOf(nodes[0]))
+
+	// Disabled should leave things alone, and reset the flags.
+	meta := structs.QueryMeta{Truncated: true, Omitted: 5}
+	results := nodes
+	s1.truncateResults(&meta, &results)
+	if meta.Truncated || meta.Omitted != 0 || len(results) != 10 {
+		t.Fatalf("bad: %#v %d", meta, len(results))
+	}
+
+	// Cut it down to three records.
+	s1.config.RPCMaxResultSize = 3*recordSize + recordSize/2
+	results = nodes
+	s1.truncateResults(&meta, &results)
+	if !meta.Truncated || meta.Omitted != 7 || len(results) != 3 {
+		t.Fatalf("bad: %#v %d", meta, len(results))
+	}
+	if results[2].Node != "node2" {
+		t.Fatalf("bad: %#v", results)
+	}
+
+	// We should always get at least one record back.
+	s1.config.RPCMaxResultSize = 1
+	results = nodes
+	s1.truncateResults(&meta, &results)
+	if !meta.Truncated || meta.Omitted != 9 || len(results) != 1 {
+		t.Fatalf("bad: %#v %d", meta, len(results))
+	}
+
+	// A result that fits shouldn't be flagged.
+	s1.config.RPCMaxResultSize = 100 * recordSize
+	results = nodes
+	s1.truncateResults(&meta, &results)
+	if meta.Truncated || meta.Omitted != 0 || len(results) != 10 {
+		t.Fatalf("bad: %#v %d", meta, len(results))
+	}
+}
+
+func TestServer_RPCMaxResultSize(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.RPCMaxResultSize = 1024
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register enough instances of a service to go well over the limit.
+	const total = 50
+	for i := 0; i < total; i++ {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       fmt.Sprintf("node%d", i),
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				Service: "web",
+				Port:    8080,
+			},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The catalog should be truncated and say how much it left off.
+	req := structs.ServiceSpecificRequest{
+		Datacenter:  "dc1",
+		ServiceName: "web",
+	}
+	var out structs.IndexedServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out.Truncated || out.Omitted == 0 || len(out.ServiceNodes) == 0 {
+		t.Fatalf("bad: %#v", out.QueryMeta)
+	}
+	if len(out.ServiceNodes)+out.Omitted != total {
+		t.Fatalf("bad: %d %d", len(out.ServiceNodes), out.Omitted)
+	}
+
+	// Same for health.
+	var healthOut structs.IndexedCheckServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &healthOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !healthOut.Truncated || len(healthOut.Nodes)+healthOut.Omitted != total {
+		t.Fatalf("bad: %#v", healthOut.QueryMeta)
+	}
+
+	// And the node dump.
+	dumpReq := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var dumpOut structs.IndexedNodeDump
+	if err := msgpackrpc.CallWithCodec(codec, "Internal.NodeDump", &dumpReq, &dumpOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !dumpOut.Truncated || len(dumpOut.Dump)+dumpOut.Omitted < total {
+		t.Fatalf("bad: %#v", dumpOut.QueryMeta)
+	}
+
+	// The index is that of the full result set, so a blocking query
+	// should wait out its timeout rather than spinning.
+	req.MinQueryIndex = out.Index
+	req.MaxQueryTime = 200 * time.Millisecond
+	start := time.Now()
+	var blockOut structs.IndexedServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &req, &blockOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("should have blocked: %v", elapsed)
+	}
+	if blockOut.Index != out.Index || !blockOut.Truncated {
+		t.Fatalf("bad: %#v", blockOut.QueryMeta)
+	}
+}
+
+func TestServer_RPCMaxResultSize_KVS(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.RPCMaxResultSize = 4096
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Write a handful of 1k values.
+	const total = 10
+	for i := 0; i < total; i++ {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   fmt.Sprintf("foo/%d", i),
+				Value: make([]byte, 1024),
+			},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	req := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "foo/",
+	}
+	var out structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.List", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out.Truncated || len(out.Entries) != 3 || out.Omitted != total-3 {
+		t.Fatalf("bad: %d %#v", len(out.Entries), out.QueryMeta)
+	}
+
+	// The keys alone are small enough to fit.
+	keysReq := structs.KeyListRequest{
+		Datacenter: "dc1",
+		Prefix:     "foo/",
+	}
+	var keysOut structs.IndexedKeyList
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.ListKeys", &keysReq, &keysOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if keysOut.Truncated || len(keysOut.Keys) != total {
+		t.Fatalf("bad: %d %#v", len(keysOut.Keys), keysOut.QueryMeta)
+	}
+}
@@ -1,10 +1,12 @@
 package consul
 
 import (
+	"bytes"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
+	"net/rpc"
 	"strings"
 	"time"
 
@@ -14,8 +16,9 @@ import (
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/lib"
 	"github.com/hashicorp/go-memdb"
+	"github.com/hashicorp/go-uuid"
 	"github.com/hashicorp/memberlist"
-	"github.com/hashicorp/net-rpc-msgpackrpc"
+	"github.com/hashicorp/raft"
 	"github.com/hashicorp/yamux"
 )
 
@@ -29,6 +32,13 @@ const (
 	rpcMultiplexV2
 	rpcSnapshot
 	rpcGossip
+
+	// rpcSubscribe marks a subscription stream. It's only valid as the
+	// first byte of a stream inside an rpcMultiplexV2 connection, not as
+	// the first byte of a connection. Regular RPC streams start with the
+	// msgpack map header of the request, so they can't be mistaken for
+	// it.
+	rpcSubscribe
 )
 
 const (
@@ -54,6 +64,12 @@ const (
 	// value is ever reached. However, it prevents us from blocking
 	// the requesting goroutine forever.
 	enqueueLimit = 30 * time.Second
+
+	// maxForwardHops limits how many times a request can be forwarded
+	// between servers. A request normally takes at most two hops, to
+	// a server in a remote datacenter and then on to its leader, so
+	// anything more than this is likely a forwarding loop.
+	maxForwardHops = 3
 )
 
 // listen is used to listen for incoming RPC connections
@@ -146,14 +162,54 @@ func (s *Server) handleMultiplexV2(conn net.Conn) {
 			}
 			return
 		}
-		go s.handleConsulConn(sub)
+		go s.handleMultiplexStream(sub)
 	}
 }
 
+// handleMultiplexStream dispatches a single stream from a multiplexed
+// connection. Streams are normally RPC connections, but subscriptions are
+// marked with a leading byte so they can share the connection.
+func (s *Server) handleMultiplexStream(conn net.Conn) {
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		conn.Close()
+		return
+	}
+
+	if RPCType(buf[0]) == rpcSubscribe {
+		defer conn.Close()
+		if err := s.handleSubscribeRequest(conn); err != nil {
+			s.logger.Printf("[ERR] consul.rpc: Subscribe RPC error: %v %s", err, logConn(conn))
+		}
+		return
+	}
+
+	// Put the byte back for the RPC codec.
+	s.handleConsulConn(&peekedConn{
+		Conn:   conn,
+		reader: io.MultiReader(bytes.NewReader(buf), conn),
+	})
+}
+
+// peekedConn is a connection that's had bytes read off the front of it, which
+// are replayed by reader.
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
 // handleConsulConn is used to service a single Consul RPC connection
 func (s *Server) handleConsulConn(conn net.Conn) {
 	defer conn.Close()
-	rpcCodec := msgpackrpc.NewServerCodec(conn)
+	rpcCodec := &replyMetaCodec{
+		ServerCodec: s.newFieldCheckCodec(conn),
+		srv:         s,
+		source:      conn.RemoteAddr(),
+	}
 	for {
 		select {
 		case <-s.shutdownCh:
@@ -162,8 +218,14 @@ func (s *Server) handleConsulConn(conn net.Conn) {
 		}
 
 		if err := s.rpcServer.ServeRequest(rpcCodec); err != nil {
+			// A request turned away because the server is draining has
+			// already had its error sent back, and its body was read in
+			// full, so the connection can carry on.
+			if err == structs.ErrDraining {
+				continue
+			}
 			if err != io.EOF && !strings.Contains(err.Error(), "closed") {
-				s.logger.Printf("[ERR] consul.rpc: RPC error: %v %s", err, logConn(conn))
+				s.rpcLogger.Printf("rpc-error:"+err.Error(), "[ERR] consul.rpc: RPC error: %v %s", err, logConn(conn))
 				metrics.IncrCounter([]string{"consul", "rpc", "request_error"}, 1)
 			}
 			return
@@ -172,6 +234,111 @@ func (s *Server) handleConsulConn(conn net.Conn) {
 	}
 }
 
+// replyMetaCodec wraps a server codec to fill in the reply metadata for
+// each request it serves. The RPC server handles one request at a time per
+// codec, so it's safe to track the start time here.
+type replyMetaCodec struct {
+	rpc.ServerCodec
+	srv    *Server
+	source net.Addr
+	start  time.Time
+	method string
+
+	// opts are the query options of a blocking request, see
+	// blockingQueries.trackSource.
+	opts *structs.QueryOptions
+
+	// args is the body of the request being served.
+	args interface{}
+}
+
+func (c *replyMetaCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.ServerCodec.ReadRequestHeader(r)
+	c.start = time.Now()
+	c.method = r.ServiceMethod
+	return err
+}
+
+// ReadRequestBody decodes the body and then turns the request away if it's
+// from a client and the server is draining. The RPC server sends the error
+// back as the reply to that one request.
+func (c *replyMetaCodec) ReadRequestBody(out interface{}) error {
+	if err := c.ServerCodec.ReadRequestBody(out); err != nil {
+		return err
+	}
+	if c.srv.drainRejects(c.source, c.method, out) {
+		metrics.IncrCounter([]string{"consul", "rpc", "drain_rejected"}, 1)
+		return structs.ErrDraining
+	}
+	c.opts = c.srv.blockingQueries.trackSource(c.method, c.source.String(), out)
+	c.args = out
+	return nil
+}
+
+func (c *replyMetaCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.srv.blockingQueries.clearSource(c.opts)
+	c.opts = nil
+	if r.Error == "" {
+		c.srv.setReplyMeta(c.args, body, c.start)
+	}
+	c.args = nil
+	c.srv.histograms.measureRPC(rpcMethodLabel(r), c.start)
+	return c.ServerCodec.WriteResponse(r, body)
+}
+
+// setReplyMeta fills in the details of this server for replies that carry
+// them. This is done for every RPC once the endpoint returns, which keeps
+// the endpoints from having to do it themselves and drifting apart.
+func (s *Server) setReplyMeta(args interface{}, reply interface{}, start time.Time) {
+	holder, ok := reply.(structs.ReplyMetaHolder)
+	if !ok {
+		return
+	}
+
+	meta := holder.GetReplyMeta()
+	meta.Server = s.config.NodeName
+	meta.ServerDatacenter = s.config.Datacenter
+	meta.ServerIsLeader = s.IsLeader()
+	meta.ServiceTime = time.Now().Sub(start)
+
+	writer, ok := reply.(structs.WriteMetaHolder)
+	if !ok {
+		return
+	}
+	wm := writer.GetWriteMeta()
+
+	// Hand back the ID the write was traced with. By the time the endpoint
+	// returns, forward has filled it in if the caller didn't give one.
+	if info, ok := args.(structs.RPCInfo); ok && wm.RequestID == "" {
+		wm.RequestID, _ = info.RequestTrace()
+	}
+
+	// Writes are applied by the leader, so it hands out a consistency token
+	// for them. A follower that forwarded the write passes the leader's
+	// token through as is.
+	if meta.ServerIsLeader && wm.ConsistencyToken == "" {
+		wm.ConsistencyToken = encodeConsistencyToken(s.fsm.AppliedIndex())
+	}
+}
+
+// setReplyForwarded marks the reply as having been answered by the given
+// server on our behalf.
+func setReplyForwarded(reply interface{}, server *agent.Server) {
+	if holder, ok := reply.(structs.ReplyMetaHolder); ok {
+		meta := holder.GetReplyMeta()
+		meta.Forwarded = true
+		meta.ForwardedTo = server.Name
+	}
+}
+
+// setReplyResolved records the canonical name of the datacenter a request
+// was sent to using an alias.
+func setReplyResolved(reply interface{}, dc string) {
+	if holder, ok := reply.(structs.ReplyMetaHolder); ok {
+		holder.GetReplyMeta().ResolvedDatacenter = dc
+	}
+}
+
 // handleSnapshotConn is used to dispatch snapshot saves and restores, which
 // stream so don't use the normal RPC mechanism.
 func (s *Server) handleSnapshotConn(conn net.Conn) {
@@ -188,16 +355,100 @@ func (s *Server) handleSnapshotConn(conn net.Conn) {
 func (s *Server) forward(method string, info structs.RPCInfo, args interface{}, reply interface{}) (bool, error) {
 	var firstCheck time.Time
 
-	// Handle DC forwarding
+	// Tag the request so it can be traced through the servers that
+	// handle it, and make sure it's not stuck in a forwarding loop.
+	id, hops := info.RequestTrace()
+	if id == "" {
+		var err error
+		if id, err = uuid.GenerateUUID(); err != nil {
+			return true, err
+		}
+		info.SetRequestTrace(id, hops)
+	}
+	if hops > maxForwardHops {
+		s.logger.Printf("[ERR] consul.rpc: RPC request %s forwarded too many times (request_id=%s, hops=%d)",
+			method, id, hops)
+		return true, fmt.Errorf("RPC request forwarded too many times (%d hops), possible forwarding loop", hops)
+	}
+
+	// Start the clock on the caller's timeout for a write, if it gave one.
+	if req, ok := info.(structs.DeadlineRequest); ok {
+		req.StartDeadline(time.Now())
+	}
+
+	// Requests that use the old name of a renamed datacenter carry the
+	// canonical name along once it's been resolved, so the servers they're
+	// forwarded to don't need to know about the alias.
 	dc := info.RequestDatacenter()
+	if resolved := info.ResolvedDatacenter(); resolved != "" {
+		dc = resolved
+	} else if canonical := s.router.ResolveDatacenter(dc); canonical != dc {
+		info.SetResolvedDatacenter(canonical)
+		dc = canonical
+	}
+	if dc != info.RequestDatacenter() {
+		defer setReplyResolved(reply, dc)
+	}
+
+	// Handle DC forwarding
 	if dc != s.config.Datacenter {
+		if !info.IsRead() {
+			if err := s.checkRemoteWrite(method, dc, info); err != nil {
+				s.logger.Printf("[WARN] consul.rpc: refusing to forward %s to datacenter %q (request_id=%s, hops=%d): %v",
+					method, dc, id, hops, err)
+				return true, err
+			}
+		}
+		if err := s.passDeadline(info); err != nil {
+			return true, err
+		}
+		info.SetRequestTrace(id, hops+1)
+		s.logger.Printf("[DEBUG] consul.rpc: forwarding %s to datacenter %q (request_id=%s, hops=%d)",
+			method, dc, id, hops)
 		err := s.forwardDC(method, dc, args, reply)
 		return true, err
 	}
 
+	// Fill in the datacenter's defaults for anything the request left
+	// unset, now that we know it's for this datacenter.
+	if info.IsRead() {
+		if err := s.applyQueryDefaults(info); err != nil {
+			return true, err
+		}
+	}
+
 	// Check if we can allow a stale read
 	if info.IsRead() && info.AllowStaleRead() {
-		return false, nil
+		// A server that's still replaying the log after starting up could
+		// serve very old data. Clients try another server on an error, so
+		// refuse the read rather than piling more onto the leader.
+		if s.catchingUp() {
+			metrics.IncrCounter([]string{"consul", "rpc", "catching_up"}, 1)
+			s.rpcLogger.Printf("catching-up:"+method,
+				"[WARN] consul.rpc: refusing stale read %s, still catching up with the leader (request_id=%s, hops=%d)",
+				method, id, hops)
+			return true, structs.ErrCatchingUp
+		}
+
+		if !s.staleReadFenced() {
+			s.logger.Printf("[DEBUG] consul.rpc: handling %s (request_id=%s, hops=%d)", method, id, hops)
+			return s.handleLocal(info)
+		}
+
+		// We've been out of touch with the leader for too long to serve
+		// stale reads. If the partition is one-way we may still be able
+		// to reach the leader, so send it there.
+		if _, remoteServer := s.getLeader(); remoteServer != nil {
+			info.SetRequestTrace(id, hops+1)
+			s.logger.Printf("[DEBUG] consul.rpc: forwarding fenced stale read %s to leader %s (request_id=%s, hops=%d)",
+				method, remoteServer.Addr, id, hops)
+			err := s.forwardLeader(remoteServer, method, args, reply)
+			return true, err
+		}
+		s.rpcLogger.Printf("stale-fenced:"+method,
+			"[WARN] consul.rpc: refusing stale read %s, no recent contact with the leader (request_id=%s, hops=%d)",
+			method, id, hops)
+		return true, structs.ErrStaleFenced
 	}
 
 CHECK_LEADER:
@@ -206,11 +457,18 @@ CHECK_LEADER:
 
 	// Handle the case we are the leader
 	if isLeader {
-		return false, nil
+		s.logger.Printf("[DEBUG] consul.rpc: handling %s (request_id=%s, hops=%d)", method, id, hops)
+		return s.handleLocal(info)
 	}
 
 	// Handle the case of a known leader
 	if remoteServer != nil {
+		if err := s.passDeadline(info); err != nil {
+			return true, err
+		}
+		info.SetRequestTrace(id, hops+1)
+		s.logger.Printf("[DEBUG] consul.rpc: forwarding %s to leader %s (request_id=%s, hops=%d)",
+			method, remoteServer.Addr, id, hops)
 		err := s.forwardLeader(remoteServer, method, args, reply)
 		return true, err
 	}
@@ -229,7 +487,80 @@ CHECK_LEADER:
 	}
 
 	// No leader found and hold time exceeded
-	return true, structs.ErrNoLeader
+	hint := s.leaderHint()
+	s.rpcLogger.Printf("no-leader:"+method, "[ERR] consul.rpc: no leader to handle %s (request_id=%s, hops=%d, last_leader=%q, raft_state=%s)",
+		method, id, hops, hint.LastLeader, hint.RaftState)
+	return true, hint
+}
+
+// handleLocal is called by forward once it's decided that this server will
+// handle a request. Requests are counted against their token here, so each
+// one is only counted once no matter how many times it's forwarded. A token
+// that's over its rate limit gets an error instead.
+func (s *Server) handleLocal(info structs.RPCInfo) (bool, error) {
+	if err := s.trackTokenRate(info.ACLToken()); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+// checkRemoteWrite returns an error if the given mutating request to the given
+// method for another datacenter shouldn't be forwarded there, because this datacenter's remote
+// write policy refuses it and the request's token isn't allowed to write
+// across datacenters.
+func (s *Server) checkRemoteWrite(method, dc string, info structs.RPCInfo) error {
+	_, policy, err := s.fsm.State().RemoteWritePolicy(nil)
+	if err != nil {
+		return err
+	}
+	if policy == nil || !policy.RefuseRemoteWrites {
+		return nil
+	}
+
+	acl, err := s.resolveToken(method, info.ACLToken())
+	if err != nil {
+		return err
+	}
+	if acl != nil && acl.CrossDCWrite() {
+		return nil
+	}
+
+	metrics.IncrCounter([]string{"consul", "rpc", "remote_write_refused"}, 1)
+	return &structs.RemoteWriteRefusedError{
+		Local:      s.config.Datacenter,
+		Datacenter: dc,
+	}
+}
+
+// forwardIsRead returns true if forwarding the given request counts as a read
+// for federation policies. Requests that aren't an RPCInfo, like the bare
+// status requests, don't change anything, so they're reads.
+func forwardIsRead(args interface{}) bool {
+	if info, ok := args.(structs.RPCInfo); ok {
+		return info.IsRead()
+	}
+	return true
+}
+
+// checkFederationPolicy returns an error if requests of the given kind
+// shouldn't be forwarded to the given datacenter, because its federation
+// policy doesn't allow it.
+func (s *Server) checkFederationPolicy(dc string, read bool) error {
+	_, policy, err := s.fsm.State().FederationPolicyGet(nil, dc)
+	if err != nil {
+		return err
+	}
+	if policy == nil || policy.Allows(read) {
+		return nil
+	}
+
+	metrics.IncrCounter([]string{"consul", "rpc", "federation_policy_refused"}, 1)
+	return &structs.FederationPolicyError{
+		Local:          s.config.Datacenter,
+		Datacenter:     dc,
+		Forwarding:     policy.Forwarding,
+		Decommissioned: policy.IsDecommissioned(),
+	}
 }
 
 // getLeader returns if the current node is the leader, and if not then it
@@ -246,6 +577,7 @@ func (s *Server) getLeader() (bool, *agent.Server) {
 	if leader == "" {
 		return false, nil
 	}
+	s.noteLeader(leader)
 
 	// Lookup the server
 	s.localLock.RLock()
@@ -256,29 +588,96 @@ func (s *Server) getLeader() (bool, *agent.Server) {
 	return false, server
 }
 
+// applyQueryDefaults fills in the datacenter's default query options for any
+// that the request has left at their zero values. The default MaxQueryTime is
+// also a limit, so longer wait times are clamped to it.
+func (s *Server) applyQueryDefaults(info structs.RPCInfo) error {
+	_, defaults, err := s.fsm.State().QueryDefaults(nil)
+	if err != nil {
+		return err
+	}
+	if defaults == nil {
+		return nil
+	}
+
+	if holder, ok := info.(structs.QueryOptionsHolder); ok {
+		opts := holder.GetQueryOptions()
+		if defaults.AllowStale && !opts.AllowStale && !opts.RequireConsistent {
+			opts.AllowStale = true
+		}
+		if defaults.MaxQueryTime > 0 &&
+			(opts.MaxQueryTime == 0 || opts.MaxQueryTime > defaults.MaxQueryTime) {
+			opts.MaxQueryTime = defaults.MaxQueryTime
+		}
+	}
+
+	if holder, ok := info.(structs.QuerySourceHolder); ok && defaults.Near != "" {
+		source := holder.GetQuerySource()
+		if source.Node == "" && (source.Datacenter == "" || source.Datacenter == s.config.Datacenter) {
+			source.Datacenter = s.config.Datacenter
+			source.Node = defaults.Near
+		}
+	}
+	return nil
+}
+
+// lookupDatacenterAlias returns the canonical name for the given datacenter
+// if it's an alias. This is hooked into the router.
+func (s *Server) lookupDatacenterAlias(dc string) (string, bool) {
+	_, alias, err := s.fsm.State().DatacenterAliasGet(nil, dc)
+	if err != nil {
+		s.logger.Printf("[ERR] consul.rpc: Failed to look up datacenter alias %q: %v", dc, err)
+		return "", false
+	}
+	if alias == nil {
+		return "", false
+	}
+	return alias.Canonical, true
+}
+
 // forwardLeader is used to forward an RPC call to the leader, or fail if no leader
 func (s *Server) forwardLeader(server *agent.Server, method string, args interface{}, reply interface{}) error {
 	// Handle a missing server
 	if server == nil {
-		return structs.ErrNoLeader
+		return s.leaderHint()
 	}
-	return s.connPool.RPC(s.config.Datacenter, server.Addr, server.Version, method, args, reply)
+	if err := s.connPool.RPC(s.config.Datacenter, server.Addr, server.Version, method, args, reply); err != nil {
+		return err
+	}
+	setReplyForwarded(reply, server)
+	return nil
 }
 
 // forwardDC is used to forward an RPC call to a remote DC, or fail if no servers
+//
+// Everything that goes to another datacenter passes through here, so this is
+// where its federation policy is enforced.
 func (s *Server) forwardDC(method, dc string, args interface{}, reply interface{}) error {
+	if err := s.checkFederationPolicy(dc, forwardIsRead(args)); err != nil {
+		s.logger.Printf("[WARN] consul.rpc: refusing to forward %s to datacenter %q: %v", method, dc, err)
+		return err
+	}
+
 	manager, server, ok := s.router.FindRoute(dc)
 	if !ok {
-		s.logger.Printf("[WARN] consul.rpc: RPC request for DC %q, no path found", dc)
+		s.rpcLogger.Printf("no-path:"+dc, "[WARN] consul.rpc: RPC request for DC %q, no path found", dc)
 		return structs.ErrNoDCPath
 	}
 
+	if s.config.WANLivenessCheck && isCostlyForward(args) {
+		manager, server = s.checkWANServer(dc, manager, server)
+	}
+
 	metrics.IncrCounter([]string{"consul", "rpc", "cross-dc", dc}, 1)
+	defer s.histograms.measureCrossDC(method, dc, time.Now())
 	if err := s.connPool.RPC(dc, server.Addr, server.Version, method, args, reply); err != nil {
 		manager.NotifyFailedServer(server)
-		s.logger.Printf("[ERR] consul: RPC failed to server %s in DC %q: %v", server.Addr, dc, err)
+		s.triggerWANWarming()
+		s.rpcLogger.Printf(fmt.Sprintf("dc-failed:%s:%s:%v", dc, server.Addr, err),
+			"[ERR] consul: RPC failed to server %s in DC %q: %v", server.Addr, dc, err)
 		return err
 	}
+	setReplyForwarded(reply, server)
 
 	return nil
 }
@@ -292,8 +691,17 @@ func (s *Server) globalRPC(method string, args interface{},
 	errorCh := make(chan error)
 	respCh := make(chan interface{})
 
-	// Make a new request into each datacenter
-	dcs := s.router.GetDatacenters()
+	// Make a new request into each datacenter, leaving out any whose
+	// federation policy doesn't allow it, since the request is meant for
+	// the datacenters we're still working with.
+	var dcs []string
+	for _, dc := range s.router.GetDatacenters() {
+		if err := s.checkFederationPolicy(dc, forwardIsRead(args)); err != nil {
+			s.logger.Printf("[DEBUG] consul.rpc: skipping datacenter %q for %s: %v", dc, method, err)
+			continue
+		}
+		dcs = append(dcs, dc)
+	}
 	for _, dc := range dcs {
 		go func(dc string) {
 			rr := reply.New()
@@ -326,16 +734,51 @@ func (s *Server) raftApply(t structs.MessageType, msg interface{}) (interface{},
 		return nil, fmt.Errorf("Failed to encode request: %v", err)
 	}
 
+	// Turn away writes that are too big.
+	if max := s.config.RaftMaxEntrySize; max > 0 && len(buf) > max {
+		metrics.IncrCounter([]string{"consul", "raft", "apply", "too_large"}, 1)
+		return nil, &structs.TooLargeError{Size: len(buf), Max: max}
+	}
+
 	// Warn if the command is very large
 	if n := len(buf); n > raftWarnSize {
 		s.logger.Printf("[WARN] consul: Attempting to apply large raft entry (%d bytes)", n)
 	}
 
-	future := s.raft.Apply(buf, enqueueLimit)
+	defer s.histograms.measureRaftApply(time.Now())
+	defer s.applyLoad.begin()()
+	if s.raftApplyHook != nil {
+		s.raftApplyHook(t, msg)
+	}
+
+	// If the caller gave a timeout, don't hand the write to Raft once it's
+	// run out, and don't wait any longer than it allows to enqueue it.
+	timeout := enqueueLimit
+	deadline := requestDeadline(msg)
+	if !deadline.IsZero() {
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			return nil, s.applyDeadlines.abandon()
+		}
+		if left < timeout {
+			timeout = left
+		}
+	}
+
+	future := s.raft.Apply(buf, timeout)
 	if err := future.Error(); err != nil {
+		if err == raft.ErrEnqueueTimeout && !deadline.IsZero() && !time.Now().Before(deadline) {
+			return nil, s.applyDeadlines.abandon()
+		}
 		return nil, err
 	}
 
+	// The write has been committed, so it succeeded even if the caller's
+	// timeout ran out while it was being applied.
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		s.applyDeadlines.finishLate()
+	}
+
 	return future.Response(), nil
 }
 
@@ -350,6 +793,8 @@ type queryFn func(memdb.WatchSet, *state.StateStore) error
 func (s *Server) blockingQuery(queryOpts *structs.QueryOptions, queryMeta *structs.QueryMeta,
 	fn queryFn) error {
 	var timeout *time.Timer
+	var query *blockingQueryEntry
+	var err error
 
 	// Fast path right to the non-blocking query.
 	if queryOpts.MinQueryIndex == 0 {
@@ -370,9 +815,24 @@ func (s *Server) blockingQuery(queryOpts *structs.QueryOptions, queryMeta *struc
 	timeout = time.NewTimer(queryOpts.MaxQueryTime)
 	defer timeout.Stop()
 
+	// Track the query so an operator can cancel it.
+	query, err = s.blockingQueries.add(queryOpts)
+	if err != nil {
+		return err
+	}
+	defer s.blockingQueries.remove(query)
+
 RUN_QUERY:
+	// Catch up to the caller's earlier writes before reading anything.
+	if queryOpts.ConsistencyToken != "" {
+		if err := s.waitForConsistencyToken(queryOpts); err != nil {
+			return err
+		}
+	}
+
 	// Update the query metadata.
 	s.setQueryMeta(queryMeta)
+	queryMeta.RequestID = queryOpts.RequestID
 
 	// If the read must be consistent we verify that we are still the leader.
 	if queryOpts.RequireConsistent {
@@ -397,10 +857,13 @@ RUN_QUERY:
 		// This channel will be closed if a snapshot is restored and the
 		// whole state store is abandoned.
 		ws.Add(state.AbandonCh())
+
+		// This one will be closed if an operator cancels the query.
+		ws.Add(query.cancelCh)
 	}
 
 	// Block up to the timeout if we didn't see anything fresh.
-	err := fn(ws, state)
+	err = fn(ws, state)
 	if err == nil && queryMeta.Index > 0 && queryMeta.Index <= queryOpts.MinQueryIndex {
 		if expired := ws.Watch(timeout.C); !expired {
 			// If a restore may have woken us up then bail out from
@@ -410,6 +873,8 @@ RUN_QUERY:
 			// case.
 			select {
 			case <-state.AbandonCh():
+			case <-query.cancelCh:
+				queryMeta.Cancelled = true
 			default:
 				goto RUN_QUERY
 			}
@@ -424,9 +889,35 @@ func (s *Server) setQueryMeta(m *structs.QueryMeta) {
 		m.LastContact = 0
 		m.KnownLeader = true
 	} else {
+		// Only count the leader as known if we could forward to it, so
+		// this agrees with whether a consistent read would get a
+		// NoLeaderError.
+		_, leader := s.getLeader()
 		m.LastContact = time.Now().Sub(s.raft.LastContact())
-		m.KnownLeader = (s.raft.Leader() != "")
+		m.KnownLeader = leader != nil
+	}
+
+	hint := s.leaderHint()
+	m.LastLeader = hint.LastLeader
+	m.RaftState = hint.RaftState
+	m.AliveServers = hint.AliveServers
+}
+
+// staleReadFenced returns true if this server has gone too long without
+// hearing from the leader to serve stale reads. This also updates the
+// staleness gauge.
+func (s *Server) staleReadFenced() bool {
+	if s.IsLeader() {
+		metrics.SetGauge([]string{"consul", "rpc", "stale_read", "last_contact"}, 0)
+		return false
 	}
+
+	staleness := time.Now().Sub(s.raft.LastContact())
+	metrics.SetGauge([]string{"consul", "rpc", "stale_read", "last_contact"},
+		float32(staleness.Nanoseconds()/int64(time.Millisecond)))
+
+	fence := s.config.StaleReadFenceDuration
+	return fence > 0 && staleness > fence
 }
 
 // consistentRead is used to ensure we do not perform a stale
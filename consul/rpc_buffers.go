@@ -0,0 +1,239 @@
+package consul
+
+import (
+	"bytes"
+	"io"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+// The connection pool opens a new stream for most concurrent RPCs, so any
+// buffers that live as long as a stream turn into a lot of garbage, and a
+// buffer that lives as long as a connection can end up as big as the largest
+// message it's ever seen. Instead, each message is encoded into a buffer
+// from a shared pool and written out in one go, and the buffer goes back to
+// the pool as soon as it's been written. The bytes on the wire are the same
+// as with a buffered writer.
+
+const (
+	// rpcBufferMaxRetained is the largest buffer kept in the pool. A buffer
+	// that grew past this for a huge reply is left for the GC, so one big
+	// reply doesn't pin memory for good.
+	rpcBufferMaxRetained = 4 * 1024 * 1024
+)
+
+var (
+	// rpcBufferClasses are the sizes of the buffers in the pool, and how
+	// many of each size are kept.
+	rpcBufferClasses = []bufferClass{
+		{size: 4 * 1024, depth: 64},
+		{size: 64 * 1024, depth: 16},
+		{size: 1024 * 1024, depth: 4},
+	}
+
+	// rpcBuffers is the pool shared by the RPC server and the connection
+	// pool.
+	rpcBuffers = newBufferPool(rpcBufferClasses, rpcBufferMaxRetained)
+
+	// The metric keys are made once up front, since they're used for every
+	// message.
+	bufferPoolHitKey      = []string{"consul", "rpc", "buffer_pool", "hit"}
+	bufferPoolMissKey     = []string{"consul", "rpc", "buffer_pool", "miss"}
+	bufferPoolDiscardKey  = []string{"consul", "rpc", "buffer_pool", "discard"}
+	bufferPoolRetainedKey = []string{"consul", "rpc", "buffer_pool", "retained_bytes"}
+)
+
+// bufferClass is a size of buffer kept by a bufferPool.
+type bufferClass struct {
+	// size is the smallest capacity of the buffers in this class.
+	size int
+
+	// depth is how many buffers of this class are kept.
+	depth int
+}
+
+// bufferPool keeps buffers of a few different sizes for reuse. Buffers are
+// handed out from the smallest class that fits the size asked for, and go
+// back into the largest class they fit.
+type bufferPool struct {
+	classes     []bufferClass
+	free        []chan *bytes.Buffer
+	maxRetained int
+
+	// retained is the total capacity of the buffers in the pool. This must
+	// be accessed atomically.
+	retained int64
+}
+
+// newBufferPool returns an empty pool with the given classes, which must be
+// sorted by size. Buffers bigger than maxRetained aren't kept.
+func newBufferPool(classes []bufferClass, maxRetained int) *bufferPool {
+	p := &bufferPool{
+		classes:     classes,
+		free:        make([]chan *bytes.Buffer, len(classes)),
+		maxRetained: maxRetained,
+	}
+	for i, class := range classes {
+		p.free[i] = make(chan *bytes.Buffer, class.depth)
+	}
+	return p
+}
+
+// get returns an empty buffer that can hold at least size bytes without
+// growing, if size is within the largest class. If there are no buffers of
+// the right size, a bigger one is handed out before a new one is made.
+func (p *bufferPool) get(size int) *bytes.Buffer {
+	i := 0
+	for i < len(p.classes)-1 && p.classes[i].size < size {
+		i++
+	}
+
+	for j := i; j < len(p.classes); j++ {
+		select {
+		case buf := <-p.free[j]:
+			metrics.IncrCounter(bufferPoolHitKey, 1)
+			p.updateRetained(-buf.Cap())
+			return buf
+		default:
+		}
+	}
+
+	metrics.IncrCounter(bufferPoolMissKey, 1)
+	if size < p.classes[i].size {
+		size = p.classes[i].size
+	}
+	return bytes.NewBuffer(make([]byte, 0, size))
+}
+
+// put returns a buffer to the pool. The buffer must not be used after this.
+func (p *bufferPool) put(buf *bytes.Buffer) {
+	if buf.Cap() > p.maxRetained || buf.Cap() < p.classes[0].size {
+		metrics.IncrCounter(bufferPoolDiscardKey, 1)
+		return
+	}
+
+	i := len(p.classes) - 1
+	for p.classes[i].size > buf.Cap() {
+		i--
+	}
+
+	buf.Reset()
+	select {
+	case p.free[i] <- buf:
+		p.updateRetained(buf.Cap())
+	default:
+		metrics.IncrCounter(bufferPoolDiscardKey, 1)
+	}
+}
+
+// updateRetained adjusts the retained byte count and reports it.
+func (p *bufferPool) updateRetained(delta int) {
+	retained := atomic.AddInt64(&p.retained, int64(delta))
+	metrics.SetGauge(bufferPoolRetainedKey, float32(retained))
+}
+
+// pooledWriter collects a message in a buffer from the pool, until it's
+// flushed out to the underlying writer. The codec writes a byte or a string
+// at a time, so this implements those directly.
+type pooledWriter struct {
+	pool *bufferPool
+	w    io.Writer
+	buf  *bytes.Buffer
+
+	// last is the size of the last message written, which is used to pick
+	// the buffer for the next one, since they tend to be about the same.
+	last int
+}
+
+func (p *pooledWriter) buffer() *bytes.Buffer {
+	if p.buf == nil {
+		p.buf = p.pool.get(p.last)
+	}
+	return p.buf
+}
+
+func (p *pooledWriter) Write(b []byte) (int, error) {
+	return p.buffer().Write(b)
+}
+
+func (p *pooledWriter) WriteByte(c byte) error {
+	return p.buffer().WriteByte(c)
+}
+
+func (p *pooledWriter) WriteString(s string) (int, error) {
+	return p.buffer().WriteString(s)
+}
+
+// flush writes out the message and returns its buffer to the pool.
+func (p *pooledWriter) flush() error {
+	if p.buf == nil {
+		return nil
+	}
+	p.last = p.buf.Len()
+	_, err := p.w.Write(p.buf.Bytes())
+	p.reset()
+	return err
+}
+
+// reset throws away the message and returns its buffer to the pool.
+func (p *pooledWriter) reset() {
+	if p.buf == nil {
+		return
+	}
+	p.pool.put(p.buf)
+	p.buf = nil
+}
+
+// pooledCodec is a msgpack codec that encodes each message with a
+// pooledWriter. It can be used as either a client or a server codec.
+type pooledCodec struct {
+	*msgpackrpc.MsgpackCodec
+	w         pooledWriter
+	conn      pooledConn
+	writeLock sync.Mutex
+}
+
+// newPooledCodec returns a codec that reads from r, which can be buffered
+// by the codec, and writes to conn through the RPC buffer pool.
+func newPooledCodec(bufReads bool, r io.Reader, conn io.ReadWriteCloser) *pooledCodec {
+	c := &pooledCodec{
+		w: pooledWriter{pool: rpcBuffers, w: conn},
+	}
+	c.conn = pooledConn{r, &c.w, conn}
+	c.MsgpackCodec = msgpackrpc.NewCodecFromHandle(bufReads, false, &c.conn, msgpackHandle)
+	return c
+}
+
+// pooledConn is what the codec reads from and writes to. The writer is
+// embedded directly, so the encoder can see it writes bytes and strings.
+type pooledConn struct {
+	io.Reader
+	*pooledWriter
+	io.Closer
+}
+
+func (c *pooledCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.finish(c.MsgpackCodec.WriteRequest(r, body))
+}
+
+func (c *pooledCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.finish(c.MsgpackCodec.WriteResponse(r, body))
+}
+
+// finish sends the message that was just encoded, or drops it if encoding
+// failed part way through.
+func (c *pooledCodec) finish(err error) error {
+	if err != nil {
+		c.w.reset()
+		return err
+	}
+	return c.w.flush()
+}
@@ -0,0 +1,238 @@
+package consul
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/rpc"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func testBufferPool() *bufferPool {
+	classes := []bufferClass{
+		{size: 16, depth: 2},
+		{size: 256, depth: 1},
+	}
+	return newBufferPool(classes, 1024)
+}
+
+func TestBufferPool(t *testing.T) {
+	p := testBufferPool()
+
+	// Buffers come from the smallest class that fits.
+	small := p.get(0)
+	if small.Cap() != 16 {
+		t.Fatalf("bad: %d", small.Cap())
+	}
+	medium := p.get(17)
+	if medium.Cap() != 256 {
+		t.Fatalf("bad: %d", medium.Cap())
+	}
+	big := p.get(300)
+	if big.Cap() != 300 {
+		t.Fatalf("bad: %d", big.Cap())
+	}
+
+	// They should be reused once they're returned, and come back empty.
+	small.WriteString("hello")
+	p.put(small)
+	p.put(medium)
+	if p.retained != 16+256 {
+		t.Fatalf("bad: %d", p.retained)
+	}
+	if buf := p.get(10); buf != small || buf.Len() != 0 {
+		t.Fatalf("bad: %#v", buf)
+	}
+	if buf := p.get(200); buf != medium {
+		t.Fatalf("bad: %#v", buf)
+	}
+	if p.retained != 0 {
+		t.Fatalf("bad: %d", p.retained)
+	}
+
+	// A buffer goes back into the largest class it fits, so this one can
+	// be handed out for anything up to the largest class.
+	p.put(big)
+	if buf := p.get(256); buf != big {
+		t.Fatalf("bad: %#v", buf)
+	}
+
+	// Only so many are kept.
+	bufs := []*bytes.Buffer{p.get(0), p.get(0), p.get(0)}
+	for _, buf := range bufs {
+		p.put(buf)
+	}
+	if len(p.free[0]) != 2 || p.retained != 32 {
+		t.Fatalf("bad: %d %d", len(p.free[0]), p.retained)
+	}
+}
+
+func TestBufferPool_MaxRetained(t *testing.T) {
+	p := testBufferPool()
+
+	// A buffer that grew past the cap shouldn't be returned to the pool.
+	buf := p.get(200)
+	buf.Write(make([]byte, 2048))
+	if buf.Cap() <= 1024 {
+		t.Fatalf("bad: %d", buf.Cap())
+	}
+	p.put(buf)
+	if len(p.free[1]) != 0 || p.retained != 0 {
+		t.Fatalf("bad: %d %d", len(p.free[1]), p.retained)
+	}
+	if other := p.get(200); other == buf {
+		t.Fatalf("should not be reused")
+	}
+}
+
+// testCodecConn collects everything written to it.
+type testCodecConn struct {
+	bytes.Buffer
+	writes int
+}
+
+func (c *testCodecConn) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Buffer.Write(p)
+}
+
+func (c *testCodecConn) Close() error {
+	return nil
+}
+
+// testServiceNodesReply returns a large Health.ServiceNodes reply.
+func testServiceNodesReply(n int) *structs.IndexedCheckServiceNodes {
+	reply := &structs.IndexedCheckServiceNodes{}
+	reply.Index = 1234
+	for i := 0; i < n; i++ {
+		node := fmt.Sprintf("node-%d", i)
+		reply.Nodes = append(reply.Nodes, structs.CheckServiceNode{
+			Node: &structs.Node{
+				Node:    node,
+				Address: fmt.Sprintf("10.0.%d.%d", i/256, i%256),
+				TaggedAddresses: map[string]string{
+					"wan": fmt.Sprintf("198.18.%d.%d", i/256, i%256),
+				},
+			},
+			Service: &structs.NodeService{
+				ID:      "web",
+				Service: "web",
+				Tags:    []string{"primary", "v1"},
+				Port:    8080,
+			},
+			Checks: structs.HealthChecks{
+				&structs.HealthCheck{
+					Node:        node,
+					CheckID:     "serfHealth",
+					Name:        "Serf Health Status",
+					Status:      structs.HealthPassing,
+					Output:      "Agent alive and reachable",
+					ServiceName: "",
+				},
+				&structs.HealthCheck{
+					Node:        node,
+					CheckID:     "service:web",
+					Name:        "Service 'web' check",
+					Status:      structs.HealthPassing,
+					ServiceID:   "web",
+					ServiceName: "web",
+				},
+			},
+		})
+	}
+	return reply
+}
+
+func TestPooledCodec_Wire(t *testing.T) {
+	req := &rpc.Request{ServiceMethod: "Health.ServiceNodes", Seq: 7}
+	args := &structs.ServiceSpecificRequest{Datacenter: "dc1", ServiceName: "web"}
+	resp := &rpc.Response{ServiceMethod: "Health.ServiceNodes", Seq: 7}
+	reply := testServiceNodesReply(500)
+
+	// The pooled codec should put exactly the same bytes on the wire as
+	// the buffered one, in a single write per message.
+	expected := &testCodecConn{}
+	codec := msgpackrpc.NewCodec(true, true, expected)
+	if err := codec.WriteRequest(req, args); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := codec.WriteResponse(resp, reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	actual := &testCodecConn{}
+	pooled := newPooledCodec(true, actual, actual)
+	if err := pooled.WriteRequest(req, args); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := pooled.WriteResponse(resp, reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(actual.Bytes(), expected.Bytes()) {
+		t.Fatalf("wire format changed")
+	}
+	if actual.writes != 2 {
+		t.Fatalf("bad: %d", actual.writes)
+	}
+	if pooled.w.buf != nil || pooled.w.last == 0 {
+		t.Fatalf("bad: %#v", pooled.w)
+	}
+
+	// It should read them back too.
+	var outReq rpc.Request
+	var outArgs structs.ServiceSpecificRequest
+	if err := pooled.ReadRequestHeader(&outReq); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := pooled.ReadRequestBody(&outArgs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var outResp rpc.Response
+	var outReply structs.IndexedCheckServiceNodes
+	if err := pooled.ReadResponseHeader(&outResp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := pooled.ReadResponseBody(&outReply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if outReq.Seq != 7 || outArgs.ServiceName != "web" || len(outReply.Nodes) != 500 {
+		t.Fatalf("bad: %#v %#v %d", outReq, outArgs, len(outReply.Nodes))
+	}
+}
+
+// benchmarkServiceNodesReply writes a large Health.ServiceNodes reply on a
+// new codec each time, the way it's done for a new stream.
+func benchmarkServiceNodesReply(b *testing.B, newCodec func(io.ReadWriteCloser) rpc.ServerCodec) {
+	resp := &rpc.Response{ServiceMethod: "Health.ServiceNodes", Seq: 1}
+	reply := testServiceNodesReply(1000)
+	conn := struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{&bytes.Buffer{}, ioutil.Discard, ioutil.NopCloser(nil)}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		codec := newCodec(conn)
+		if err := codec.WriteResponse(resp, reply); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func BenchmarkRPCCodec_ServiceNodes_Buffered(b *testing.B) {
+	benchmarkServiceNodesReply(b, func(conn io.ReadWriteCloser) rpc.ServerCodec {
+		return msgpackrpc.NewCodec(true, true, conn)
+	})
+}
+
+func BenchmarkRPCCodec_ServiceNodes_Pooled(b *testing.B) {
+	benchmarkServiceNodesReply(b, func(conn io.ReadWriteCloser) rpc.ServerCodec {
+		return newPooledCodec(true, conn, conn)
+	})
+}
@@ -0,0 +1,402 @@
+package consul
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// Request structs are decoded from msgpack maps, and any keys that don't
+// match a field in the struct are dropped. When a newer client sends a field
+// this server doesn't know about, that can leave it with a request that only
+// does part of what the client asked for. To catch this, the server codec
+// keeps the raw bytes of each request body and compares its keys against the
+// fields of the struct it was decoded into.
+
+// fieldCheckCodec is a server codec that looks for unknown fields in request
+// bodies.
+type fieldCheckCodec struct {
+	rpc.ServerCodec
+	srv    *Server
+	rec    *recordingReader
+	method string
+}
+
+// newFieldCheckCodec returns a server codec for the given connection that
+// checks requests for unknown fields.
+func (s *Server) newFieldCheckCodec(conn net.Conn) rpc.ServerCodec {
+	rec := &recordingReader{r: bufio.NewReader(conn), pool: rpcBuffers}
+	return &fieldCheckCodec{
+		ServerCodec: newPooledCodec(false, rec, conn),
+		srv:         s,
+		rec:         rec,
+	}
+}
+
+func (c *fieldCheckCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.ServerCodec.ReadRequestHeader(r)
+	c.method = r.ServiceMethod
+	return err
+}
+
+// ReadRequestBody decodes the body and then checks it for unknown fields. If
+// there are any, they're counted and logged, and in strict mode requests from
+// clients are rejected.
+func (c *fieldCheckCodec) ReadRequestBody(out interface{}) error {
+	if out == nil {
+		return c.ServerCodec.ReadRequestBody(nil)
+	}
+
+	c.rec.start()
+	err := c.ServerCodec.ReadRequestBody(out)
+	body := c.rec.stop()
+	defer c.rec.release()
+	if err != nil {
+		return err
+	}
+
+	unknown, err := unknownFields(body, out)
+	if err != nil {
+		c.srv.logger.Printf("[WARN] consul.rpc: failed to check %s request for unknown fields: %v",
+			c.method, err)
+		return nil
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	metrics.IncrCounter([]string{"consul", "rpc", "unknown_fields"}, 1)
+	forwarded := false
+	if info, ok := out.(structs.RPCInfo); ok {
+		_, hops := info.RequestTrace()
+		forwarded = hops > 0
+	}
+	switch {
+	case forwarded:
+		c.srv.logger.Printf("[WARN] consul.rpc: %s request forwarded from another server has unknown field(s): %s",
+			c.method, strings.Join(unknown, ", "))
+	case c.srv.config.StrictRPCDecoding:
+		return &structs.UnsupportedFieldsError{Fields: unknown}
+	default:
+		c.srv.logger.Printf("[DEBUG] consul.rpc: %s request has unknown field(s): %s",
+			c.method, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// recordingReader keeps a copy of everything read through it while it's
+// recording, in a buffer from the pool.
+type recordingReader struct {
+	r         io.Reader
+	pool      *bufferPool
+	buf       *bytes.Buffer
+	recording bool
+
+	// last is the size of the last recording, which is used to pick the
+	// buffer for the next one.
+	last int
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.recording {
+		r.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+// start starts recording from scratch.
+func (r *recordingReader) start() {
+	r.release()
+	r.buf = r.pool.get(r.last)
+	r.recording = true
+}
+
+// stop stops recording and returns what was read. The result is only good
+// until release is called.
+func (r *recordingReader) stop() []byte {
+	r.recording = false
+	r.last = r.buf.Len()
+	return r.buf.Bytes()
+}
+
+// release returns the recording's buffer to the pool.
+func (r *recordingReader) release() {
+	if r.buf == nil {
+		return
+	}
+	r.pool.put(r.buf)
+	r.buf = nil
+}
+
+var (
+	// knownFields caches the msgpack field names of each struct type we've
+	// checked.
+	knownFields     = make(map[reflect.Type]map[string]struct{})
+	knownFieldsLock sync.RWMutex
+)
+
+// fieldsOf returns the names msgpack uses for the fields of the given struct
+// type. This follows the codec's rules, so fields of embedded structs
+// without a tag are included as if they were fields of the outer struct.
+func fieldsOf(t reflect.Type) map[string]struct{} {
+	knownFieldsLock.RLock()
+	fields, ok := knownFields[t]
+	knownFieldsLock.RUnlock()
+	if ok {
+		return fields
+	}
+
+	fields = make(map[string]struct{})
+	addFields(t, fields)
+
+	knownFieldsLock.Lock()
+	knownFields[t] = fields
+	knownFieldsLock.Unlock()
+	return fields
+}
+
+func addFields(t reflect.Type, fields map[string]struct{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("codec")
+		if tag == "-" || f.PkgPath != "" {
+			continue
+		}
+		if f.Anonymous && tag == "" {
+			ft := f.Type
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				addFields(ft, fields)
+				continue
+			}
+		}
+
+		name := f.Name
+		if tagName := strings.Split(tag, ",")[0]; tagName != "" {
+			name = tagName
+		}
+		fields[name] = struct{}{}
+	}
+}
+
+// unknownFields returns the sorted keys in the msgpack-encoded body that
+// aren't fields of the struct it was decoded into. Bodies that aren't maps,
+// or that weren't decoded into structs, don't have any unknown fields.
+func unknownFields(body []byte, out interface{}) ([]string, error) {
+	t := reflect.TypeOf(out)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, nil
+	}
+
+	keys, err := msgpackMapKeys(body)
+	if err != nil {
+		return nil, err
+	}
+	fields := fieldsOf(t)
+	var unknown []string
+	for _, key := range keys {
+		if _, ok := fields[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// msgpackMapKeys returns the string keys of the msgpack map in b, skipping
+// over the values without decoding them. If b doesn't hold a map, there are
+// no keys.
+func msgpackMapKeys(b []byte) ([]string, error) {
+	s := &msgpackScanner{b: b}
+	n, ok, err := s.mapLen()
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	var keys []string
+	for i := 0; i < n; i++ {
+		key, err := s.str()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		if err := s.skip(); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// msgpackScanner walks over msgpack-encoded data.
+type msgpackScanner struct {
+	b []byte
+}
+
+var errMsgpackShort = fmt.Errorf("msgpack data is truncated")
+
+// next returns the next n bytes.
+func (s *msgpackScanner) next(n int) ([]byte, error) {
+	if n < 0 || n > len(s.b) {
+		return nil, errMsgpackShort
+	}
+	out := s.b[:n]
+	s.b = s.b[n:]
+	return out, nil
+}
+
+// uint reads a big-endian unsigned integer that's n bytes long.
+func (s *msgpackScanner) uint(n int) (int, error) {
+	b, err := s.next(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	default:
+		return int(binary.BigEndian.Uint32(b)), nil
+	}
+}
+
+// mapLen reads a map header, returning false if the next value isn't a map.
+func (s *msgpackScanner) mapLen() (int, bool, error) {
+	if len(s.b) == 0 {
+		return 0, false, errMsgpackShort
+	}
+	switch c := s.b[0]; {
+	case c >= 0x80 && c <= 0x8f:
+		s.b = s.b[1:]
+		return int(c & 0x0f), true, nil
+	case c == 0xde:
+		s.b = s.b[1:]
+		n, err := s.uint(2)
+		return n, true, err
+	case c == 0xdf:
+		s.b = s.b[1:]
+		n, err := s.uint(4)
+		return n, true, err
+	default:
+		return 0, false, nil
+	}
+}
+
+// str reads a string, which the codec may have written as either a str or
+// a raw bin.
+func (s *msgpackScanner) str() (string, error) {
+	b, err := s.next(1)
+	if err != nil {
+		return "", err
+	}
+
+	var n int
+	switch c := b[0]; {
+	case c >= 0xa0 && c <= 0xbf:
+		n = int(c & 0x1f)
+	case c == 0xd9 || c == 0xc4:
+		n, err = s.uint(1)
+	case c == 0xda || c == 0xc5:
+		n, err = s.uint(2)
+	case c == 0xdb || c == 0xc6:
+		n, err = s.uint(4)
+	default:
+		return "", fmt.Errorf("msgpack map key isn't a string (type 0x%x)", c)
+	}
+	if err != nil {
+		return "", err
+	}
+	str, err := s.next(n)
+	return string(str), err
+}
+
+// skip steps over the next value, including everything inside it.
+func (s *msgpackScanner) skip() error {
+	b, err := s.next(1)
+	if err != nil {
+		return err
+	}
+
+	// Work out how many bytes of data follow, and how many nested values.
+	var data, values int
+	switch c := b[0]; {
+	case c <= 0x7f || c >= 0xe0 || c == 0xc0 || c == 0xc2 || c == 0xc3:
+	case c >= 0x80 && c <= 0x8f:
+		values = 2 * int(c&0x0f)
+	case c >= 0x90 && c <= 0x9f:
+		values = int(c & 0x0f)
+	case c >= 0xa0 && c <= 0xbf:
+		data = int(c & 0x1f)
+	case c == 0xc4 || c == 0xd9:
+		data, err = s.uint(1)
+	case c == 0xc5 || c == 0xda:
+		data, err = s.uint(2)
+	case c == 0xc6 || c == 0xdb:
+		data, err = s.uint(4)
+	case c == 0xc7:
+		data, err = s.uint(1)
+		data++
+	case c == 0xc8:
+		data, err = s.uint(2)
+		data++
+	case c == 0xc9:
+		data, err = s.uint(4)
+		data++
+	case c == 0xca:
+		data = 4
+	case c == 0xcb:
+		data = 8
+	case c == 0xcc || c == 0xd0:
+		data = 1
+	case c == 0xcd || c == 0xd1:
+		data = 2
+	case c == 0xce || c == 0xd2:
+		data = 4
+	case c == 0xcf || c == 0xd3:
+		data = 8
+	case c >= 0xd4 && c <= 0xd8:
+		data = 1 + 1<<(c-0xd4)
+	case c == 0xdc:
+		values, err = s.uint(2)
+	case c == 0xdd:
+		values, err = s.uint(4)
+	case c == 0xde:
+		values, err = s.uint(2)
+		values *= 2
+	case c == 0xdf:
+		values, err = s.uint(4)
+		values *= 2
+	default:
+		return fmt.Errorf("unknown msgpack type 0x%x", c)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.next(data); err != nil {
+		return err
+	}
+	for i := 0; i < values; i++ {
+		if err := s.skip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package consul
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestRPC_UnknownFields_Scan(t *testing.T) {
+	// Make a value with every kind of thing in it, at sizes that need each
+	// length encoding.
+	body := map[string]interface{}{
+		"Datacenter":  "dc1",
+		"Token":       strings.Repeat("x", 40),
+		"Nope":        strings.Repeat("x", 300),
+		"AlsoNope":    strings.Repeat("x", 70000),
+		"Ints":        []interface{}{1, -1, -100, 200, 70000, -70000, 1 << 40, -(1 << 40)},
+		"Floats":      []interface{}{float32(1.5), 2.5},
+		"Bytes":       []byte("hello"),
+		"Nested":      map[string]interface{}{"a": []interface{}{nil, true, false}},
+		"ForwardHops": 1,
+	}
+	for i := 0; i < 20; i++ {
+		body["Ints"] = append(body["Ints"].([]interface{}), i)
+	}
+	var buf []byte
+	if err := codec.NewEncoderBytes(&buf, msgpackHandle).Encode(body); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	unknown, err := unknownFields(buf, &structs.DCSpecificRequest{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []string{"AlsoNope", "Bytes", "Floats", "Ints", "Nested", "Nope"}
+	if !reflect.DeepEqual(unknown, expected) {
+		t.Fatalf("bad: %v", unknown)
+	}
+
+	// A request with just the fields it should have is fine.
+	buf = nil
+	req := structs.DCSpecificRequest{Datacenter: "dc1"}
+	if err := codec.NewEncoderBytes(&buf, msgpackHandle).Encode(&req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if unknown, err := unknownFields(buf, &structs.DCSpecificRequest{}); err != nil || len(unknown) != 0 {
+		t.Fatalf("bad: %v %v", unknown, err)
+	}
+
+	// Things that aren't maps and structs are skipped.
+	if unknown, err := unknownFields([]byte{0x01}, &structs.DCSpecificRequest{}); err != nil || unknown != nil {
+		t.Fatalf("bad: %v %v", unknown, err)
+	}
+	var s string
+	if unknown, err := unknownFields(buf, &s); err != nil || unknown != nil {
+		t.Fatalf("bad: %v %v", unknown, err)
+	}
+
+	// Truncated data is an error.
+	if _, err := unknownFields(buf[:len(buf)-1], &structs.DCSpecificRequest{}); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestRPC_UnknownFields(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		dir1, s1 := testServerWithConfig(t, func(c *Config) {
+			c.StrictRPCDecoding = strict
+		})
+		defer os.RemoveAll(dir1)
+		defer s1.Shutdown()
+		testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+		// Hand-craft a request from a newer client.
+		args := map[string]interface{}{
+			"Datacenter": "dc1",
+			"NewThing":   true,
+			"OtherThing": "hello",
+		}
+		var out structs.IndexedNodes
+		codec := rpcClient(t, s1)
+		err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &args, &out)
+		codec.Close()
+		if strict {
+			if !structs.HasErrorCode(err, structs.ErrCodeUnsupportedFields) ||
+				!strings.Contains(err.Error(), "NewThing, OtherThing") {
+				t.Fatalf("err: %v", err)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if len(out.Nodes) != 1 {
+				t.Fatalf("bad: %v", out.Nodes)
+			}
+		}
+
+		// Forwarded requests are always let through.
+		args["ForwardHops"] = 1
+		codec = rpcClient(t, s1)
+		err = msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &args, &out)
+		codec.Close()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// Requests with just the fields we know about are fine.
+		known := structs.DCSpecificRequest{Datacenter: "dc1"}
+		codec = rpcClient(t, s1)
+		err = msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &known, &out)
+		codec.Close()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
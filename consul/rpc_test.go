@@ -2,7 +2,11 @@ package consul
 
 import (
 	"bytes"
+	"fmt"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -32,7 +36,7 @@ func TestRPC_NoLeader_Fail(t *testing.T) {
 	// Make sure we eventually fail with a no leader error, which we should
 	// see given the short timeout.
 	err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
-	if err.Error() != structs.ErrNoLeader.Error() {
+	if !structs.IsErrNoLeader(err) {
 		t.Fatalf("bad: %v", err)
 	}
 
@@ -163,3 +167,733 @@ func TestRPC_blockingQuery(t *testing.T) {
 		}
 	}
 }
+
+// syncBuffer is a goroutine-safe buffer used to capture log output.
+type syncBuffer struct {
+	buf bytes.Buffer
+	sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestRPC_RequestTracing(t *testing.T) {
+	logs1 := &syncBuffer{}
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.LogOutput = logs1
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	logs2 := &syncBuffer{}
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Bootstrap = false
+		c.LogOutput = logs2
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	// Join the servers and wait for s2 to know about the leader.
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	if err := testutil.WaitForResult(func() (bool, error) {
+		peers, _ := s2.numPeers()
+		return peers == 2, fmt.Errorf("%d", peers)
+	}); err != nil {
+		t.Fatalf("should have 2 peers: %v", err)
+	}
+	testutil.WaitForLeader(t, s2.RPC, "dc1")
+
+	// Send a write to the follower without an ID, so it generates one and
+	// forwards it to the leader.
+	codec := rpcClient(t, s2)
+	defer codec.Close()
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	re := regexp.MustCompile(`forwarding Catalog.Register to leader \S+ \(request_id=(\S+), hops=0\)`)
+	match := re.FindStringSubmatch(logs2.String())
+	if match == nil {
+		t.Fatalf("no forwarding log line: %s", logs2.String())
+	}
+	id := match[1]
+	handled := fmt.Sprintf("handling Catalog.Register (request_id=%s, hops=1)", id)
+	if !strings.Contains(logs1.String(), handled) {
+		t.Fatalf("leader didn't log request %q", id)
+	}
+
+	// A forwarded write with a structured reply should hand back the ID
+	// it was logged with.
+	timers := structs.OperatorTimersRequest{
+		Datacenter: "dc1",
+		Paused:     false,
+	}
+	var timersOut structs.OperatorTimersReply
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.SetTimersPaused", &timers, &timersOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	re = regexp.MustCompile(`forwarding Operator.SetTimersPaused to leader \S+ \(request_id=(\S+), hops=0\)`)
+	match = re.FindStringSubmatch(logs2.String())
+	if match == nil {
+		t.Fatalf("no forwarding log line: %s", logs2.String())
+	}
+	if timersOut.RequestID == "" || timersOut.RequestID != match[1] {
+		t.Fatalf("bad: %q != %q", timersOut.RequestID, match[1])
+	}
+	handled = fmt.Sprintf("handling Operator.SetTimersPaused (request_id=%s, hops=1)", match[1])
+	if !strings.Contains(logs1.String(), handled) {
+		t.Fatalf("leader didn't log request %q", match[1])
+	}
+
+	// A forwarded read should keep the given ID and return it.
+	args := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+		QueryOptions: structs.QueryOptions{
+			RequestID: "my-request",
+		},
+	}
+	var nodes structs.IndexedNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &args, &nodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if nodes.RequestID != "my-request" {
+		t.Fatalf("bad: %#v", nodes.QueryMeta)
+	}
+	for _, logs := range []*syncBuffer{logs1, logs2} {
+		if !strings.Contains(logs.String(), "request_id=my-request") {
+			t.Fatalf("request not logged: %s", logs.String())
+		}
+	}
+
+	// Requests that have been forwarded too many times should be rejected.
+	args.ForwardHops = maxForwardHops + 1
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &args, &nodes)
+	if err == nil || !strings.Contains(err.Error(), "forwarded too many times") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestRPC_StaleReadFence(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	const fence = time.Second
+	dir3, s3 := testServerWithConfig(t, func(c *Config) {
+		c.Bootstrap = false
+		c.StaleReadFenceDuration = fence
+	})
+	defer os.RemoveAll(dir3)
+	defer s3.Shutdown()
+
+	// Join the servers and wait for the follower to hear from the leader.
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	for _, s := range []*Server{s2, s3} {
+		if _, err := s.JoinLAN([]string{addr}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for _, s := range []*Server{s1, s2, s3} {
+		if err := testutil.WaitForResult(func() (bool, error) {
+			peers, _ := s.numPeers()
+			return peers == 3, fmt.Errorf("%d", peers)
+		}); err != nil {
+			t.Fatalf("should have 3 peers: %v", err)
+		}
+	}
+	testutil.WaitForLeader(t, s3.RPC, "dc1")
+
+	// Write a key and wait for it to show up on the follower.
+	codec := rpcClient(t, s3)
+	defer codec.Close()
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "foo",
+			Value: []byte("bar"),
+		},
+	}
+	var applied bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &applied); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	get := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "foo",
+		QueryOptions: structs.QueryOptions{
+			AllowStale: true,
+		},
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		var out structs.IndexedDirEntries
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Get", &get, &out); err != nil {
+			return false, err
+		}
+		return len(out.Entries) == 1, fmt.Errorf("bad: %#v", out)
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Cut the follower off from the others. It's heard from the leader
+	// recently, so it should keep serving stale reads for now.
+	s1.Shutdown()
+	s2.Shutdown()
+	isolated := time.Now()
+	var out structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Get", &get, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Entries) != 1 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Once the fence is up, stale reads should fail with the typed error.
+	if err := testutil.WaitForResult(func() (bool, error) {
+		var out structs.IndexedDirEntries
+		err := msgpackrpc.CallWithCodec(codec, "KVS.Get", &get, &out)
+		if err == nil {
+			return false, fmt.Errorf("should have been fenced")
+		}
+		if err.Error() != structs.ErrStaleFenced.Error() {
+			return false, err
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Now().Sub(isolated); elapsed < fence/2 {
+		t.Fatalf("fenced too early: %v", elapsed)
+	}
+}
+
+func TestRPC_StaleReadFence_ForwardToLeader(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	// Use a fence so short that the follower is always fenced, which
+	// looks the same as a one-way partition where it can still reach the
+	// leader.
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Bootstrap = false
+		c.StaleReadFenceDuration = time.Nanosecond
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		peers, _ := s2.numPeers()
+		return peers == 2, fmt.Errorf("%d", peers)
+	}); err != nil {
+		t.Fatalf("should have 2 peers: %v", err)
+	}
+	testutil.WaitForLeader(t, s2.RPC, "dc1")
+
+	// The stale read should be answered by the leader, which always
+	// reports zero for the last contact.
+	codec := rpcClient(t, s2)
+	defer codec.Close()
+	get := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "foo",
+		QueryOptions: structs.QueryOptions{
+			AllowStale: true,
+		},
+	}
+	var out structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Get", &get, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out.KnownLeader || out.LastContact != 0 {
+		t.Fatalf("bad: %#v", out.QueryMeta)
+	}
+}
+
+func TestRPC_RefuseRemoteWrites(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.RefuseRemoteWrites = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerDC(t, "dc2")
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s1.RPC, "dc2")
+
+	// A write for the other datacenter should be refused by s1.
+	arg := structs.RegisterRequest{
+		Datacenter: "dc2",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "db",
+		},
+	}
+	var out struct{}
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+	if !structs.HasErrorCode(err, structs.ErrCodeRemoteWriteRefused) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// It should never have made it to the other datacenter.
+	_, node, err := s2.fsm.State().GetNode("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node != nil {
+		t.Fatalf("bad: %#v", node)
+	}
+
+	// Reads still get forwarded.
+	list := structs.DCSpecificRequest{
+		Datacenter: "dc2",
+	}
+	var nodes structs.IndexedNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &list, &nodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Writes for the local datacenter are fine.
+	arg.Datacenter = "dc1"
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Once the policy is turned off the write goes through.
+	policy := structs.RemoteWritePolicyRequest{
+		Datacenter: "dc1",
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.RemoteWritePolicySet", &policy, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Datacenter = "dc2"
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, node, err = s2.fsm.State().GetNode("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node == nil {
+		t.Fatalf("missing node")
+	}
+}
+
+func TestRPC_RefuseRemoteWrites_CrossDCToken(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.RefuseRemoteWrites = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Datacenter = "dc2"
+		c.ACLDatacenter = "dc1"
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s1.RPC, "dc2")
+
+	// The default policy allows the write in both datacenters, but the
+	// anonymous token can't send it across.
+	arg := structs.RegisterRequest{
+		Datacenter: "dc2",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+	}
+	var out struct{}
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+	if !structs.HasErrorCode(err, structs.ErrCodeRemoteWriteRefused) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A token with cross-datacenter write access can.
+	arg.Token = makeTestToken(t, codec, `cross_dc = "write"`, 0)
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, node, err := s2.fsm.State().GetNode("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node == nil {
+		t.Fatalf("missing node")
+	}
+}
+
+func TestRPC_FederationPolicy(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerDC(t, "dc2")
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s1.RPC, "dc2")
+
+	// Stop forwarding anything to dc2.
+	policy := structs.FederationPolicyRequest{
+		Datacenter: "dc1",
+		Op:         structs.FederationPolicySet,
+		Policy: structs.FederationPolicy{
+			Datacenter: "dc2",
+			Forwarding: structs.FederationForwardNone,
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.FederationPolicyApply", &policy, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Reads and writes for dc2 should both be refused by s1.
+	list := structs.DCSpecificRequest{
+		Datacenter: "dc2",
+	}
+	var nodes structs.IndexedNodes
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &list, &nodes)
+	if !structs.HasErrorCode(err, structs.ErrCodeFederationPolicy) {
+		t.Fatalf("err: %v", err)
+	}
+	arg := structs.RegisterRequest{
+		Datacenter: "dc2",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+	}
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+	if !structs.HasErrorCode(err, structs.ErrCodeFederationPolicy) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// So should requests that endpoints forward themselves.
+	cancel := structs.CancelBlockingQueryRequest{
+		Datacenter: "dc2",
+		ID:         "nope",
+	}
+	err = msgpackrpc.CallWithCodec(codec, "Operator.CancelBlockingQuery", &cancel, &out)
+	if !structs.HasErrorCode(err, structs.ErrCodeFederationPolicy) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The datacenter should still be federated.
+	found := false
+	for _, m := range s1.WANMembers() {
+		if m.Tags["dc"] == "dc2" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("dc2 missing from WAN members: %v", s1.WANMembers())
+	}
+	if _, _, ok := s1.router.FindRoute("dc2"); !ok {
+		t.Fatalf("dc2 should still have a route")
+	}
+
+	// Allow reads, which should go through while writes are still refused.
+	policy.Policy.Forwarding = structs.FederationForwardReads
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.FederationPolicyApply", &policy, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &list, &nodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+	if !structs.HasErrorCode(err, structs.ErrCodeFederationPolicy) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Once the policy is deleted the write goes through.
+	policy.Op = structs.FederationPolicyDelete
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.FederationPolicyApply", &policy, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, node, err := s2.fsm.State().GetNode("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node == nil {
+		t.Fatalf("missing node")
+	}
+}
+
+func TestForwardIsRead(t *testing.T) {
+	cases := []struct {
+		args interface{}
+		read bool
+	}{
+		{&structs.DCSpecificRequest{}, true},
+		{&structs.RegisterRequest{}, false},
+		{&structs.KeyringRequest{Operation: structs.KeyringList}, true},
+		{&structs.KeyringRequest{Operation: structs.KeyringInstall}, false},
+		{struct{}{}, true},
+	}
+	for i, c := range cases {
+		if read := forwardIsRead(c.args); read != c.read {
+			t.Fatalf("case %d: bad: %v", i, read)
+		}
+	}
+}
+
+func TestRPC_ReplyMeta(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	dir3, s3 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir3)
+	defer s3.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	for _, s := range []*Server{s2, s3} {
+		if _, err := s.JoinLAN([]string{addr}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for _, s := range []*Server{s1, s2, s3} {
+		if err := testutil.WaitForResult(func() (bool, error) {
+			peers, _ := s.numPeers()
+			return peers == 3, fmt.Errorf("%d", peers)
+		}); err != nil {
+			t.Fatalf("should have 3 peers: %v", err)
+		}
+	}
+	testutil.WaitForLeader(t, s3.RPC, "dc1")
+
+	codec := rpcClient(t, s3)
+	defer codec.Close()
+
+	// A stale read should be answered by the follower itself.
+	args := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+		QueryOptions: structs.QueryOptions{
+			AllowStale: true,
+		},
+	}
+	var stale structs.IndexedNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &args, &stale); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	meta := stale.ReplyMeta
+	if meta.Server != s3.config.NodeName || meta.ServerDatacenter != "dc1" || meta.ServerIsLeader {
+		t.Fatalf("bad: %#v", meta)
+	}
+	if meta.Forwarded || meta.ForwardedTo != "" || meta.ServiceTime <= 0 {
+		t.Fatalf("bad: %#v", meta)
+	}
+
+	// A consistent read should be forwarded to the leader, but still name
+	// the follower as the server that answered.
+	args.AllowStale = false
+	args.RequireConsistent = true
+	var consistent structs.IndexedNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &args, &consistent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	meta = consistent.ReplyMeta
+	if meta.Server != s3.config.NodeName || meta.ServerIsLeader {
+		t.Fatalf("bad: %#v", meta)
+	}
+	if !meta.Forwarded || meta.ForwardedTo != s1.config.NodeName || meta.ServiceTime <= 0 {
+		t.Fatalf("bad: %#v", meta)
+	}
+
+	// The leader should say so when it answers directly.
+	leaderCodec := rpcClient(t, s1)
+	defer leaderCodec.Close()
+	var direct structs.IndexedNodes
+	if err := msgpackrpc.CallWithCodec(leaderCodec, "Catalog.ListNodes", &args, &direct); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	meta = direct.ReplyMeta
+	if meta.Server != s1.config.NodeName || !meta.ServerIsLeader || meta.Forwarded {
+		t.Fatalf("bad: %#v", meta)
+	}
+
+	// In-memory calls get the same treatment.
+	var inmem structs.IndexedNodes
+	if err := s3.RPC("Catalog.ListNodes", &args, &inmem); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	meta = inmem.ReplyMeta
+	if meta.Server != s3.config.NodeName || !meta.Forwarded || meta.ForwardedTo != s1.config.NodeName {
+		t.Fatalf("bad: %#v", meta)
+	}
+
+	// Structured write replies carry it too.
+	timers := structs.OperatorTimersRequest{
+		Datacenter: "dc1",
+	}
+	var timersOut structs.OperatorTimersReply
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.SetTimersPaused", &timers, &timersOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	meta = timersOut.ReplyMeta
+	if meta.Server != s3.config.NodeName || !meta.Forwarded || meta.ForwardedTo != s1.config.NodeName {
+		t.Fatalf("bad: %#v", meta)
+	}
+}
+
+func TestRPC_FollowerBlockingQuery_WakesOnApply(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		peers, _ := s2.numPeers()
+		return peers == 2, fmt.Errorf("%d", peers)
+	}); err != nil {
+		t.Fatalf("should have 2 peers: %v", err)
+	}
+	testutil.WaitForLeader(t, s2.RPC, "dc1")
+
+	leader := rpcClient(t, s1)
+	defer leader.Close()
+	follower := rpcClient(t, s2)
+	defer follower.Close()
+
+	set := func(value string) {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   "foo",
+				Value: []byte(value),
+			},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(leader, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	set("before")
+
+	// Wait for the follower to catch up.
+	var index uint64
+	if err := testutil.WaitForResult(func() (bool, error) {
+		idx, entry, err := s2.fsm.State().KVSGet(nil, "foo")
+		index = idx
+		return entry != nil, err
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Note when the follower applies the next change to the key, straight
+	// from its state store.
+	ws := memdb.NewWatchSet()
+	if _, _, err := s2.fsm.State().KVSGet(ws, "foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	appliedCh := make(chan time.Time, 1)
+	go func() {
+		ws.Watch(time.After(10 * time.Second))
+		appliedCh <- time.Now()
+	}()
+
+	// Block on the follower and make the change through the leader.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		set("after")
+	}()
+	get := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "foo",
+		QueryOptions: structs.QueryOptions{
+			AllowStale:    true,
+			MinQueryIndex: index,
+			MaxQueryTime:  10 * time.Second,
+		},
+	}
+	var out structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(follower, "KVS.Get", &get, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	returned := time.Now()
+	applied := <-appliedCh
+
+	// The query shouldn't come back with the old value, and it should come
+	// back as soon as the follower has the new one. Since the wake is tied
+	// to the local apply, nothing the leader could tell the follower any
+	// sooner would get the new value to the caller any faster.
+	if out.Index <= index || len(out.Entries) != 1 || string(out.Entries[0].Value) != "after" {
+		t.Fatalf("bad: %#v", out)
+	}
+	if lag := returned.Sub(applied); lag > 100*time.Millisecond {
+		t.Fatalf("query returned %v after the follower applied the change", lag)
+	}
+}
@@ -1,10 +1,14 @@
 package consul
 
 import (
+	"fmt"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/consul/agent"
+	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
 )
@@ -87,10 +91,21 @@ func (s *Server) localMemberEvent(me serf.MemberEvent) {
 		if isReap {
 			m.Status = StatusReap
 		}
-		select {
-		case s.reconcileCh <- m:
-		default:
+		if s.reconcileCoalescer != nil {
+			s.reconcileCoalescer.add(m)
+			continue
 		}
+		s.queueReconcile(m)
+	}
+}
+
+// queueReconcile passes a member along to the leader loop to be reconciled.
+// If the queue is full the member is dropped, and left to the periodic
+// reconcile.
+func (s *Server) queueReconcile(m serf.Member) {
+	select {
+	case s.reconcileCh <- m:
+	default:
 	}
 }
 
@@ -153,7 +168,7 @@ func (s *Server) maybeBootstrap() {
 	// Bootstrap can only be done if there are no committed logs, remove our
 	// expectations of bootstrapping. This is slightly cheaper than the full
 	// check that BootstrapCluster will do, so this is a good pre-filter.
-	index, err := s.raftStore.LastIndex()
+	index, err := s.raftLog.LastIndex()
 	if err != nil {
 		s.logger.Printf("[ERR] consul: Failed to read last raft index: %v", err)
 		return
@@ -184,6 +199,9 @@ func (s *Server) maybeBootstrap() {
 			s.logger.Printf("[ERR] consul: Member %v has bootstrap mode. Expect disabled.", member)
 			return
 		}
+		if p.NonVoter {
+			continue
+		}
 		servers = append(servers, *p)
 	}
 
@@ -262,6 +280,124 @@ func (s *Server) maybeBootstrap() {
 	s.config.BootstrapExpect = 0
 }
 
+// bootstrapStallChecks is how many times the bootstrap monitor checks in
+// during each BootstrapStallTimeout. This bounds how late past the timeout a
+// stall gets reported.
+const bootstrapStallChecks = 10
+
+// bootstrapMonitor watches for this server finding enough servers to meet
+// its expect value without bootstrapping. maybeBootstrap quietly gives up if
+// the servers disagree about the expect value, which would otherwise leave
+// the cluster without a leader and nobody the wiser until writes fail. This
+// runs until the server has a Raft configuration, or it shuts down.
+func (s *Server) bootstrapMonitor(expect int) {
+	interval := s.config.BootstrapStallTimeout / bootstrapStallChecks
+	if interval <= 0 {
+		interval = s.config.BootstrapStallTimeout
+	}
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	var since time.Time
+	for {
+		select {
+		case <-s.shutdownCh:
+			return
+		case <-ticker.C():
+		}
+
+		peers, err := s.numPeers()
+		if err != nil {
+			s.logger.Printf("[ERR] consul: Failed to get Raft configuration: %v", err)
+			continue
+		}
+		if peers > 0 {
+			s.setBootstrapStall(nil)
+			metrics.SetGauge([]string{"consul", "bootstrap", "stalled"}, 0)
+			return
+		}
+
+		// Reset the clock if we lose sight of enough servers, so we only
+		// report a stall once we've had them for the whole timeout.
+		servers := s.bootstrapServers()
+		if len(servers) < expect {
+			since = time.Time{}
+			s.setBootstrapStall(nil)
+			metrics.SetGauge([]string{"consul", "bootstrap", "stalled"}, 0)
+			continue
+		}
+		now := s.clock.Now()
+		if since.IsZero() {
+			since = now
+		}
+		if now.Sub(since) < s.config.BootstrapStallTimeout {
+			continue
+		}
+
+		stall := &structs.BootstrapStall{
+			Node:    s.config.NodeName,
+			Expect:  expect,
+			Since:   since,
+			Servers: servers,
+		}
+		if s.getBootstrapStall() == nil {
+			var found []string
+			for _, server := range servers {
+				if server.Bootstrap {
+					found = append(found, fmt.Sprintf("%s (bootstrap)", server.Name))
+				} else {
+					found = append(found, fmt.Sprintf("%s (expect=%d)", server.Name, server.Expect))
+				}
+			}
+			s.logger.Printf("[ERR] consul: Found %d servers, which meets the expected %d, but bootstrap "+
+				"hasn't completed after %v. All servers must be started with the same expect value "+
+				"and none in bootstrap mode. Servers found: %s",
+				len(servers), expect, now.Sub(since), strings.Join(found, ", "))
+		}
+		s.setBootstrapStall(stall)
+		metrics.SetGauge([]string{"consul", "bootstrap", "stalled"}, 1)
+	}
+}
+
+// bootstrapServers returns the servers in the local datacenter along with
+// the expect values they advertise, sorted by name.
+func (s *Server) bootstrapServers() []structs.BootstrapStallServer {
+	var servers []structs.BootstrapStallServer
+	for _, member := range s.serfLAN.Members() {
+		valid, p := agent.IsConsulServer(member)
+		if !valid || p.Datacenter != s.config.Datacenter {
+			continue
+		}
+		if member.Status != serf.StatusAlive {
+			continue
+		}
+		servers = append(servers, structs.BootstrapStallServer{
+			Name:      p.Name,
+			Expect:    p.Expect,
+			Bootstrap: p.Bootstrap,
+		})
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Name < servers[j].Name
+	})
+	return servers
+}
+
+// setBootstrapStall records whether bootstrapping has stalled.
+func (s *Server) setBootstrapStall(stall *structs.BootstrapStall) {
+	s.bootstrapStallLock.Lock()
+	defer s.bootstrapStallLock.Unlock()
+	s.bootstrapStall = stall
+}
+
+// getBootstrapStall returns a description of the stall if bootstrapping has
+// stalled, or nil otherwise.
+func (s *Server) getBootstrapStall() *structs.BootstrapStall {
+	s.bootstrapStallLock.RLock()
+	defer s.bootstrapStallLock.RUnlock()
+	return s.bootstrapStall
+}
+
 // lanNodeFailed is used to handle fail events on the LAN pool.
 func (s *Server) lanNodeFailed(me serf.MemberEvent) {
 	for _, m := range me.Members {
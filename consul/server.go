@@ -14,6 +14,7 @@ import (
 	"reflect"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/consul/acl"
@@ -52,6 +53,10 @@ const (
 	raftState         = "raft/"
 	snapshotsRetained = 2
 
+	// snapshotChunks is where the chunks of a snapshot being restored are
+	// kept, inside the Raft directory.
+	snapshotChunks = "snapshot-chunks"
+
 	// serverRPCCache controls how long we keep an idle connection
 	// open to a server
 	serverRPCCache = 2 * time.Minute
@@ -67,8 +72,30 @@ const (
 	// raftRemoveGracePeriod is how long we wait to allow a RemovePeer
 	// to replicate to gracefully leave the cluster.
 	raftRemoveGracePeriod = 5 * time.Second
+
+	// wanRetryBase and wanRetryMax bound the backoff used when retrying
+	// the WAN Serf setup in the background after a failure.
+	wanRetryBase = 1 * time.Second
+	wanRetryMax  = 1 * time.Minute
 )
 
+// WANNotReadyError is returned by operations that require the WAN Serf pool
+// when it isn't up, such as while it's being retried in the background.
+type WANNotReadyError struct {
+	// Status is the current WAN status, see structs.WANStatus*.
+	Status string
+
+	// LastError is the last error seen while starting the WAN Serf pool.
+	LastError error
+}
+
+func (e *WANNotReadyError) Error() string {
+	if e.LastError != nil {
+		return fmt.Sprintf("WAN Serf is not available (status: %s): %v", e.Status, e.LastError)
+	}
+	return fmt.Sprintf("WAN Serf is not available (status: %s)", e.Status)
+}
+
 // Server is Consul server which manages the service discovery,
 // health checking, DC forwarding, Raft, and multiple Serf pools.
 type Server struct {
@@ -78,15 +105,39 @@ type Server struct {
 	// aclCache is the non-authoritative ACL cache.
 	aclCache *aclCache
 
+	// aclShadow tracks what tokens' shadow rules would deny.
+	aclShadow *aclShadow
+
+	// aclUsage tracks token usage that hasn't been flushed yet.
+	aclUsage *aclUsageTracker
+
+	// tokenRates counts recent requests by token, and enforces token rate
+	// limits. This is nil if it's disabled.
+	tokenRates *tokenRateTracker
+
 	// autopilotPolicy controls the behavior of Autopilot for certain tasks.
 	autopilotPolicy AutopilotPolicy
 
+	// blockingQueries tracks the blocking queries this server is serving,
+	// so they can be listed and cancelled.
+	blockingQueries *blockingQueries
+
 	// autopilotRemoveDeadCh is used to trigger a check for dead server removals.
 	autopilotRemoveDeadCh chan struct{}
 
 	// autopilotShutdownCh is used to stop the Autopilot loop.
 	autopilotShutdownCh chan struct{}
 
+	// autopilotFailed tracks when the Autopilot loop first saw each failed
+	// server, by node name. This is only touched by the Autopilot loop, and
+	// starts over each time this server becomes the leader.
+	autopilotFailed map[string]*failedServer
+
+	// intentsRunning has the IDs of the operator intents this server is
+	// running, so the same one isn't run twice at once.
+	intentsRunning     map[string]struct{}
+	intentsRunningLock sync.Mutex
+
 	// autopilotWaitGroup is used to block until Autopilot shuts down.
 	autopilotWaitGroup sync.WaitGroup
 
@@ -94,12 +145,96 @@ type Server struct {
 	clusterHealth     structs.OperatorHealthReply
 	clusterHealthLock sync.RWMutex
 
+	// leaderFlaps tracks recent leadership changes.
+	leaderFlaps *leaderFlapDetector
+
+	// applyLoad tracks how busy the Raft apply path is, so catalog writes
+	// can ask agents to back off when it's overloaded.
+	applyLoad applyLoad
+
+	// raftApplyHook is called by raftApply before handing each entry to
+	// Raft. It's only set by tests, to slow down or hold up applies.
+	raftApplyHook func(t structs.MessageType, msg interface{})
+
+	// applyDeadlines counts the writes whose RequestTimeout ran out before
+	// they were done.
+	applyDeadlines applyDeadlines
+
+	// gossipDegraded tracks which gossip pools ("lan" and "wan") had queue
+	// depths over GossipDegradedThreshold as of the last check.
+	gossipDegraded     map[string]bool
+	gossipDegradedLock sync.RWMutex
+
+	// draining is set while the server is refusing requests from clients,
+	// see SetDraining.
+	draining     bool
+	drainingLock sync.RWMutex
+
+	// clusterID is the ID of the cluster this server is part of, once it's
+	// known. See clusterIDLoop.
+	clusterID     string
+	clusterIDLock sync.RWMutex
+
+	// faultInjector injects faults into the server's outgoing RPC and Raft
+	// connections. This is nil unless fault injection is enabled.
+	faultInjector *faultInjector
+
+	// keyringRotateFailures are the members that held up the last attempt
+	// at a keyring rotation step, and why. See runKeyringRotation.
+	keyringRotateFailures map[string]string
+	keyringRotateLock     sync.Mutex
+
+	// bootstrapStall is set if this server has found enough servers to
+	// meet its BootstrapExpect value but bootstrapping hasn't completed.
+	bootstrapStall     *structs.BootstrapStall
+	bootstrapStallLock sync.RWMutex
+
+	// configLock guards the fields of config that can be changed by
+	// Reload, and reloadCh, which is closed and replaced each time they
+	// are. reloadLock makes sure only one reload runs at a time.
+	configLock sync.RWMutex
+	reloadCh   chan struct{}
+	reloadLock sync.Mutex
+
+	// clock drives the timer-driven subsystems. It wraps the configured
+	// clock so that the timers can be paused by an operator.
+	clock *lib.PausableClock
+
+	// dataDirLock is held on the data directory for as long as the server
+	// is running, so a second server can't start up on it. This is nil in
+	// dev mode.
+	dataDirLock *dataDirLock
+
+	// lastIdentity is the identity recorded in the data directory by the
+	// last server that used it, or nil if there isn't one.
+	lastIdentity *nodeIdentity
+
 	// Consul configuration
 	config *Config
 
+	// rpcLogger is used to log errors on the RPC and forwarding paths,
+	// which can repeat a lot during an outage.
+	rpcLogger *logDeduper
+
+	// histograms feeds latency observations to the configured histogram
+	// sink. This is nil if there isn't one.
+	histograms *serverHistograms
+
 	// Connection pool to other consul servers
 	connPool *ConnPool
 
+	// catchUp tracks the server replaying the log after it starts up. This
+	// is nil if catch-up mode isn't enabled.
+	catchUp *catchUpTracker
+
+	// subscriptions holds the streams of change notifications being sent
+	// to clients.
+	subscriptions *subscriptions
+
+	// wanWarmCh is used to ask the WAN connection warming loop to check its
+	// connections. This is nil if connection warming isn't enabled.
+	wanWarmCh chan struct{}
+
 	// Endpoints holds our RPC endpoints
 	endpoints endpoints
 
@@ -111,6 +246,19 @@ type Server struct {
 	// serf cluster that spans datacenters
 	eventChWAN chan serf.Event
 
+	// reapBatcher queues deregistrations for reaped nodes so they can be
+	// applied in batches. This is nil if ReapBatchSize is zero.
+	reapBatcher *reapBatcher
+
+	// reconcileCoalescer merges bursts of Serf events for the same node
+	// before they're reconciled. This is nil if ReconcileCoalesceWindow
+	// isn't set.
+	reconcileCoalescer *reconcileCoalescer
+
+	// reconcileHoldoff tracks the reconcile actions a new leader is
+	// deferring, see Config.LeaderReconcileHoldoff.
+	reconcileHoldoff reconcileHoldoff
+
 	// fsm is the state machine used with Raft to provide
 	// strong consistency.
 	fsm *consulFSM
@@ -120,6 +268,11 @@ type Server struct {
 	localConsuls map[raft.ServerAddress]*agent.Server
 	localLock    sync.RWMutex
 
+	// lastLeader is the address of the last leader this server knew of,
+	// see leaderHint.
+	lastLeader     raft.ServerAddress
+	lastLeaderLock sync.RWMutex
+
 	// Logger uses the provided LogOutput
 	logger *log.Logger
 
@@ -128,9 +281,16 @@ type Server struct {
 	// the state directly.
 	raft          *raft.Raft
 	raftLayer     *RaftLayer
-	raftStore     *raftboltdb.BoltStore
 	raftTransport *raft.NetworkTransport
-	raftInmem     *raft.InmemStore
+
+	// raftLog is the log store in use by Raft, and raftStore is closed
+	// along with Raft, if the log store needs it.
+	raftLog   raft.LogStore
+	raftStore io.Closer
+
+	// snapshotReads reads KV data out of the Raft snapshots that have been
+	// retained, for looking at what the data was in the past.
+	snapshotReads *snapshotReader
 
 	// reconcileCh is used to pass events from the serf handler
 	// into the leader manager, so that the strong state can be
@@ -148,13 +308,25 @@ type Server struct {
 	// rpcTLS is the TLS config for incoming TLS requests
 	rpcTLS *tls.Config
 
+	// readinessListener answers load balancers' readiness checks. This is
+	// nil if ReadinessAddr isn't set.
+	readinessListener net.Listener
+
 	// serfLAN is the Serf cluster maintained inside the DC
 	// which contains all the DC nodes
 	serfLAN *serf.Serf
 
 	// serfWAN is the Serf cluster maintained between DC's
-	// which SHOULD only consist of Consul servers
-	serfWAN *serf.Serf
+	// which SHOULD only consist of Consul servers. This will be nil if
+	// the WAN pool failed to start and is being retried, so outside of
+	// setup it should be accessed via getSerfWAN().
+	serfWAN     *serf.Serf
+	serfWANLock sync.RWMutex
+
+	// wanStatus and wanLastError track the state of the WAN Serf pool,
+	// and are protected by serfWANLock.
+	wanStatus    string
+	wanLastError error
 
 	// floodLock controls access to floodCh.
 	floodLock sync.RWMutex
@@ -163,7 +335,7 @@ type Server struct {
 	// sessionTimers track the expiration time of each Session that has
 	// a TTL. On expiration, a SessionDestroy event will occur, and
 	// destroy the session via standard session destroy processing
-	sessionTimers     map[string]*time.Timer
+	sessionTimers     map[string]lib.Timer
 	sessionTimersLock sync.Mutex
 
 	// statsFetcher is used by autopilot to check the status of the other
@@ -185,12 +357,17 @@ type Server struct {
 	shutdown     bool
 	shutdownCh   chan struct{}
 	shutdownLock sync.Mutex
+
+	// stopping is set atomically as soon as a shutdown starts, before
+	// shutdownLock is released, so the readiness check can report it.
+	stopping int32
 }
 
 // Holds the RPC endpoints
 type endpoints struct {
 	ACL           *ACL
 	Catalog       *Catalog
+	CentralCheck  *CentralCheck
 	Coordinate    *Coordinate
 	Health        *Health
 	Internal      *Internal
@@ -220,6 +397,18 @@ func NewServer(config *Config) (*Server, error) {
 		return nil, err
 	}
 
+	// Non-voters can't bootstrap, since they'd never be able to elect
+	// themselves.
+	if config.NonVoter && (config.Bootstrap || config.BootstrapExpect != 0) {
+		return nil, fmt.Errorf("A non-voting server can't be used to bootstrap the cluster")
+	}
+
+	// Change hooks need room to queue at least one change, otherwise every
+	// change would be dropped unless the hook happened to be waiting.
+	if config.ChangeHookQueueSize < 1 {
+		return nil, fmt.Errorf("ChangeHookQueueSize must be at least 1")
+	}
+
 	// Ensure we have a log output and create a logger.
 	if config.LogOutput == nil {
 		config.LogOutput = os.Stderr
@@ -239,8 +428,29 @@ func NewServer(config *Config) (*Server, error) {
 		return nil, err
 	}
 
+	// Wrap the clock so the timers can be paused by an operator.
+	clock := config.Clock
+	if clock == nil {
+		clock = lib.RealClock{}
+	}
+	pausableClock := lib.NewPausableClock(clock)
+
+	// Set up the deduplicating logger for RPC errors. This doesn't use the
+	// pausable clock, since windows held open while the timers are paused
+	// would swallow every repeat logged in the meantime.
+	rpcLogger, err := newLogDeduper(logger, clock, config.RPCLogDedupWindow, config.RPCLogDedupExempt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set up the latency histograms.
+	histograms, err := newServerHistograms(config)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create the tombstone GC.
-	gc, err := state.NewTombstoneGC(config.TombstoneTTL, config.TombstoneTTLGranularity)
+	gc, err := state.NewTombstoneGC(config.TombstoneTTL, config.TombstoneTTLGranularity, pausableClock)
 	if err != nil {
 		return nil, err
 	}
@@ -252,43 +462,118 @@ func NewServer(config *Config) (*Server, error) {
 	s := &Server{
 		autopilotRemoveDeadCh: make(chan struct{}),
 		autopilotShutdownCh:   make(chan struct{}),
+		blockingQueries:       newBlockingQueries(),
+		clock:                 pausableClock,
 		config:                config,
 		connPool:              NewPool(config.LogOutput, serverRPCCache, serverMaxStreams, tlsWrap),
 		eventChLAN:            make(chan serf.Event, 256),
 		eventChWAN:            make(chan serf.Event, 256),
+		gossipDegraded:        make(map[string]bool),
+		histograms:            histograms,
 		localConsuls:          make(map[raft.ServerAddress]*agent.Server),
 		logger:                logger,
 		reconcileCh:           make(chan serf.Member, 32),
+		reloadCh:              make(chan struct{}),
 		router:                servers.NewRouter(logger, shutdownCh, config.Datacenter),
+		rpcLogger:             rpcLogger,
 		rpcServer:             rpc.NewServer(),
 		rpcTLS:                incomingTLS,
+		subscriptions:         newSubscriptions(),
 		tombstoneGC:           gc,
+		wanStatus:             structs.WANStatusDisabled,
 		shutdownCh:            make(chan struct{}),
 	}
 
+	// Use the provided dialer for outgoing server connections, if any.
+	if config.RPCDialer != nil {
+		s.connPool.dialer = config.RPCDialer
+	}
+
+	// Send connections to other datacenters through the WAN proxy, if
+	// there is one.
+	if config.WANProxyURL != "" {
+		wanDialer, err := newWANProxyDialer(config.WANProxyURL, s.connPool.dialer)
+		if err != nil {
+			s.Shutdown()
+			return nil, err
+		}
+		s.connPool.wanDialer = wanDialer
+		s.connPool.datacenter = config.Datacenter
+	}
+
+	// Wrap the outgoing connections to inject faults into them, if that's
+	// enabled. This uses the unpaused clock so injections still expire
+	// while the timers are paused.
+	if config.EnableFaultInjection {
+		if s.faultInjector, err = newFaultInjector(clock, logger, config.FaultInjections); err != nil {
+			s.Shutdown()
+			return nil, fmt.Errorf("Failed to set up fault injection: %v", err)
+		}
+		s.connPool.dialer = s.faultInjector.wrap(structs.FaultInjectionRPC, s.connPool.dialer)
+		if s.connPool.wanDialer != nil {
+			s.connPool.wanDialer = s.faultInjector.wrap(structs.FaultInjectionRPC, s.connPool.wanDialer)
+		}
+		logger.Printf("[WARN] consul: Fault injection is enabled")
+	}
+
+	// Lock the data directory before touching anything in it, and find
+	// out who used it last.
+	if !config.DevMode {
+		if s.dataDirLock, err = lockDataDir(config.DataDir, config.NodeName, logger); err != nil {
+			s.Shutdown()
+			return nil, err
+		}
+		if s.lastIdentity, err = readNodeIdentity(config.DataDir); err != nil {
+			s.Shutdown()
+			return nil, err
+		}
+	}
+
 	// Set up the autopilot policy
 	s.autopilotPolicy = &BasicAutopilot{server: s}
 
+	// Set up coalescing of Serf events before they're reconciled.
+	if config.ReapBatchSize > 0 {
+		s.reapBatcher = newReapBatcher(config.ReapBatchSize, config.ReapBatchRate)
+	}
+	if config.ReconcileCoalesceWindow > 0 {
+		s.reconcileCoalescer = newReconcileCoalescer(config.ReconcileCoalesceWindow,
+			pausableClock, s.queueReconcile)
+	}
+
 	// Initialize the stats fetcher that autopilot will use.
 	s.statsFetcher = NewStatsFetcher(logger, s.connPool, s.config.Datacenter)
 
 	// Initialize the authoritative ACL cache.
-	s.aclAuthCache, err = acl.NewCache(aclCacheSize, s.aclLocalFault)
+	s.aclAuthCache, err = acl.NewCacheWithDefaults(aclCacheSize, s.aclLocalFault, config.ACLDefaultPolicies)
 	if err != nil {
 		s.Shutdown()
 		return nil, fmt.Errorf("Failed to create authoritative ACL cache: %v", err)
 	}
 
+	// Set up the shadow rule tracker, which both ACL caches use.
+	if s.aclShadow, err = newACLShadow(logger); err != nil {
+		s.Shutdown()
+		return nil, err
+	}
+
 	// Set up the non-authoritative ACL cache. A nil local function is given
 	// if ACL replication isn't enabled.
-	var local acl.FaultFunc
+	var local aclLocalFunc
 	if s.IsACLReplicationEnabled() {
-		local = s.aclLocalFault
+		local = s.aclLocalLookup
 	}
-	if s.aclCache, err = newAclCache(config, logger, s.RPC, local); err != nil {
+	if s.aclCache, err = newAclCache(config, logger, s.RPC, local, s.aclShadow); err != nil {
 		s.Shutdown()
 		return nil, fmt.Errorf("Failed to create non-authoritative ACL cache: %v", err)
 	}
+	s.aclUsage = newACLUsageTracker()
+	if config.TokenRateWindow > 0 {
+		if s.tokenRates, err = newTokenRateTracker(config.TokenRateWindow, config.TokenRateMaxTokens); err != nil {
+			s.Shutdown()
+			return nil, fmt.Errorf("Failed to create token rate tracker: %v", err)
+		}
+	}
 
 	// Initialize the RPC layer.
 	if err := s.setupRPC(tlsWrap); err != nil {
@@ -302,7 +587,13 @@ func NewServer(config *Config) (*Server, error) {
 		return nil, fmt.Errorf("Failed to start Raft: %v", err)
 	}
 
+	// Let the router find renamed datacenters by their old names.
+	s.router.SetAliasFn(s.lookupDatacenterAlias)
+
 	// Initialize the LAN Serf.
+	if config.SerfLANTransport != nil {
+		config.SerfLANConfig.MemberlistConfig.Transport = config.SerfLANTransport
+	}
 	s.serfLAN, err = s.setupSerf(config.SerfLANConfig,
 		s.eventChLAN, serfLANSnapshot, false)
 	if err != nil {
@@ -311,30 +602,32 @@ func NewServer(config *Config) (*Server, error) {
 	}
 	go s.lanEventHandler()
 
-	// Initialize the WAN Serf.
-	s.serfWAN, err = s.setupSerf(config.SerfWANConfig,
-		s.eventChWAN, serfWANSnapshot, true)
-	if err != nil {
+	// The Raft and Serf checks above catch most data directories copied
+	// from other servers; this catches the rest and records our identity.
+	if err := s.checkNodeIdentity(); err != nil {
 		s.Shutdown()
-		return nil, fmt.Errorf("Failed to start WAN Serf: %v", err)
+		return nil, err
 	}
 
-	// Add a "static route" to the WAN Serf and hook it up to Serf events.
-	if err := s.router.AddArea(types.AreaWAN, s.serfWAN, s.connPool); err != nil {
-		s.Shutdown()
-		return nil, fmt.Errorf("Failed to add WAN serf route: %v", err)
-	}
-	go servers.HandleSerfEvents(s.logger, s.router, types.AreaWAN, s.serfWAN.ShutdownCh(), s.eventChWAN)
+	// Advertise the cluster ID once we know it.
+	go s.clusterIDLoop()
 
-	// Fire up the LAN <-> WAN join flooder.
-	portFn := func(s *agent.Server) (int, bool) {
-		if s.WanJoinPort > 0 {
-			return s.WanJoinPort, true
-		} else {
-			return 0, false
+	// Initialize the WAN Serf.
+	if config.SerfWANTransport != nil {
+		config.SerfWANConfig.MemberlistConfig.Transport = config.SerfWANTransport
+	}
+	if err := s.setupWAN(); err != nil {
+		if config.RequireWAN {
+			s.Shutdown()
+			return nil, err
 		}
+
+		// Clusters that never federate shouldn't be taken down by
+		// a WAN problem, so keep trying in the background.
+		s.logger.Printf("[WARN] consul: %v, will retry in the background", err)
+		s.setWANStatus(structs.WANStatusRetrying, err)
+		go s.retrySetupWAN()
 	}
-	go s.Flood(portFn, s.serfWAN)
 
 	// Start monitoring leadership. This must happen after Serf is set up
 	// since it can fire events when leadership is obtained.
@@ -345,27 +638,90 @@ func NewServer(config *Config) (*Server, error) {
 		go s.runACLReplication()
 	}
 
+	// Start flushing token usage.
+	if s.isACLUsageEnabled() {
+		go s.runACLUsageFlush()
+	}
+
+	// Start emitting the busiest tokens' rates.
+	if s.isTokenRateEnabled() {
+		go s.tokenRateStats()
+	}
+
 	// Start listening for RPC requests.
 	go s.listen()
 
 	// Start the metrics handlers.
 	go s.sessionStats()
+	go s.stateSizeStats()
+	go s.sessionCountStats()
+
+	// Start the empty external node reaper, if enabled.
+	if config.ExternalNodeReapInterval > 0 {
+		go s.runExternalNodeReaper()
+	}
 
 	// Start the server health checking.
 	go s.serverHealthLoop()
 
+	// Keep an eye on the gossip pools.
+	go s.gossipHealthLoop()
+
+	// Watch for a flapping leader.
+	if config.LeaderFlapThreshold > 0 {
+		s.leaderFlaps = newLeaderFlapDetector(s.clock, config.LeaderFlapThreshold, config.LeaderFlapWindow)
+		go s.leaderFlapLoop()
+	}
+
+	// Hold off on stale reads until we've caught up with the leader.
+	if config.CatchUpThreshold > 0 {
+		s.catchUp = newCatchUpTracker(s.clock, config.CatchUpThreshold)
+		go s.catchUpLoop()
+	}
+
+	// Keep connections to other datacenters warm.
+	if config.WANConnectionWarming {
+		s.wanWarmCh = make(chan struct{}, 1)
+		go s.wanWarmingLoop()
+	}
+
+	// Keep an eye on bootstrapping so a cluster with mismatched expect
+	// values doesn't sit without a leader unnoticed.
+	if config.BootstrapExpect != 0 {
+		go s.bootstrapMonitor(config.BootstrapExpect)
+	}
+
+	// Let load balancers check if we're ready for requests.
+	if config.ReadinessAddr != "" {
+		if err := s.setupReadiness(); err != nil {
+			s.Shutdown()
+			return nil, fmt.Errorf("Failed to start readiness listener: %v", err)
+		}
+	}
+
 	return s, nil
 }
 
 // setupSerf is used to setup and initialize a Serf
 func (s *Server) setupSerf(conf *serf.Config, ch chan serf.Event, path string, wan bool) (*serf.Serf, error) {
-	addr := s.rpcListener.Addr().(*net.TCPAddr)
+	addr, ok := s.rpcListener.Addr().(*net.TCPAddr)
+	if !ok || s.config.RPCListener != nil {
+		addr = s.config.RPCAdvertise
+	}
 	conf.Init()
 	if wan {
 		conf.NodeName = fmt.Sprintf("%s.%s", s.config.NodeName, s.config.Datacenter)
 	} else {
 		conf.NodeName = s.config.NodeName
-		conf.Tags["wan_join_port"] = fmt.Sprintf("%d", s.config.SerfWANConfig.MemberlistConfig.BindPort)
+		wanPort := s.config.SerfWANConfig.MemberlistConfig.BindPort
+		if t := s.config.SerfWANTransport; t != nil {
+			_, port, err := t.FinalAdvertiseAddr("", 0)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get WAN transport advertise address: %v", err)
+			}
+			wanPort = port
+		}
+		conf.Tags["wan_join_port"] = fmt.Sprintf("%d", wanPort)
 	}
 	conf.Tags["role"] = "consul"
 	conf.Tags["dc"] = s.config.Datacenter
@@ -385,6 +741,11 @@ func (s *Server) setupSerf(conf *serf.Config, ch chan serf.Event, path string, w
 	if s.config.NonVoter {
 		conf.Tags["nonvoter"] = "1"
 	}
+	if !wan {
+		for _, tag := range serverFeatureTags {
+			conf.Tags[tag] = "1"
+		}
+	}
 	conf.MemberlistConfig.LogOutput = s.config.LogOutput
 	conf.LogOutput = s.config.LogOutput
 	conf.EventCh = ch
@@ -394,9 +755,9 @@ func (s *Server) setupSerf(conf *serf.Config, ch chan serf.Event, path string, w
 	conf.ProtocolVersion = protocolVersionMap[s.config.ProtocolVersion]
 	conf.RejoinAfterLeave = s.config.RejoinAfterLeave
 	if wan {
-		conf.Merge = &wanMergeDelegate{}
+		conf.Merge = &wanMergeDelegate{decommissioned: s.isDatacenterDecommissioned}
 	} else {
-		conf.Merge = &lanMergeDelegate{dc: s.config.Datacenter}
+		conf.Merge = &lanMergeDelegate{dc: s.config.Datacenter, clusterID: s.getClusterID}
 	}
 
 	// Until Consul supports this fully, we disable automatic resolution.
@@ -406,10 +767,111 @@ func (s *Server) setupSerf(conf *serf.Config, ch chan serf.Event, path string, w
 	if err := lib.EnsurePath(conf.SnapshotPath, false); err != nil {
 		return nil, err
 	}
+	if err := s.checkSerfSnapshot(conf); err != nil {
+		return nil, err
+	}
 
 	return serf.Create(conf)
 }
 
+// setupWAN is used to start the WAN Serf, add it as a "static route" to the
+// router, and fire up the LAN <-> WAN join flooder.
+func (s *Server) setupWAN() error {
+	wan, err := s.setupSerf(s.config.SerfWANConfig,
+		s.eventChWAN, serfWANSnapshot, true)
+	if err != nil {
+		return fmt.Errorf("Failed to start WAN Serf: %v", err)
+	}
+
+	// Make sure we don't race with a shutdown when this is being retried
+	// in the background.
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	if s.shutdown {
+		wan.Shutdown()
+		return fmt.Errorf("Failed to start WAN Serf: server is shutting down")
+	}
+
+	// Add a "static route" to the WAN Serf and hook it up to Serf events.
+	if err := s.router.AddArea(types.AreaWAN, wan, s.connPool); err != nil {
+		wan.Shutdown()
+		return fmt.Errorf("Failed to add WAN serf route: %v", err)
+	}
+	go servers.HandleSerfEvents(s.logger, s.router, types.AreaWAN, wan.ShutdownCh(), s.eventChWAN)
+
+	s.serfWANLock.Lock()
+	s.serfWAN = wan
+	s.wanStatus = structs.WANStatusUp
+	s.wanLastError = nil
+	s.serfWANLock.Unlock()
+
+	// Fire up the LAN <-> WAN join flooder.
+	portFn := func(s *agent.Server) (int, bool) {
+		if s.WanJoinPort > 0 {
+			return s.WanJoinPort, true
+		} else {
+			return 0, false
+		}
+	}
+	go s.Flood(portFn, wan)
+	return nil
+}
+
+// retrySetupWAN keeps trying to start the WAN Serf with an exponential
+// backoff until it comes up or the server shuts down.
+func (s *Server) retrySetupWAN() {
+	wait := wanRetryBase
+	for {
+		select {
+		case <-time.After(wait):
+		case <-s.shutdownCh:
+			return
+		}
+
+		err := s.setupWAN()
+		if err == nil {
+			s.logger.Printf("[INFO] consul: WAN Serf started")
+			return
+		}
+
+		wait *= 2
+		if wait > wanRetryMax {
+			wait = wanRetryMax
+		}
+		s.logger.Printf("[WARN] consul: %v, retrying in %v", err, wait)
+		s.setWANStatus(structs.WANStatusRetrying, err)
+	}
+}
+
+// setWANStatus records the current status of the WAN Serf.
+func (s *Server) setWANStatus(status string, err error) {
+	s.serfWANLock.Lock()
+	defer s.serfWANLock.Unlock()
+	s.wanStatus = status
+	s.wanLastError = err
+}
+
+// getSerfWAN returns the WAN Serf, or nil if it isn't up.
+func (s *Server) getSerfWAN() *serf.Serf {
+	s.serfWANLock.RLock()
+	defer s.serfWANLock.RUnlock()
+	return s.serfWAN
+}
+
+// WANStatus returns the current status of the WAN Serf, see
+// structs.WANStatus*, along with the last error seen while starting it.
+func (s *Server) WANStatus() (string, error) {
+	s.serfWANLock.RLock()
+	defer s.serfWANLock.RUnlock()
+	return s.wanStatus, s.wanLastError
+}
+
+// wanNotReady builds an error for operations that need the WAN Serf.
+func (s *Server) wanNotReady() error {
+	status, err := s.WANStatus()
+	return &WANNotReadyError{Status: status, LastError: err}
+}
+
 // setupRaft is used to setup and initialize Raft
 func (s *Server) setupRaft() error {
 	// If we have an unclean exit then attempt to close the Raft store.
@@ -427,6 +889,7 @@ func (s *Server) setupRaft() error {
 	if err != nil {
 		return err
 	}
+	s.fsm.histograms = s.histograms
 
 	// Create a transport layer.
 	trans := raft.NewNetworkTransport(s.raftLayer, 3, 10*time.Second, s.config.LogOutput)
@@ -442,25 +905,51 @@ func (s *Server) setupRaft() error {
 		s.config.RaftConfig.LocalID = raft.ServerID(s.config.NodeID)
 	}
 
-	// Build an all in-memory setup for dev mode, otherwise prepare a full
-	// disk-based setup.
-	var log raft.LogStore
-	var stable raft.StableStore
-	var snap raft.SnapshotStore
+	// Dev mode keeps everything in memory, unless it's been told otherwise.
 	if s.config.DevMode {
-		store := raft.NewInmemStore()
-		s.raftInmem = store
-		stable = store
-		log = store
-		snap = raft.NewInmemSnapshotStore()
-	} else {
-		// Create the base raft path.
-		path := filepath.Join(s.config.DataDir, raftState)
+		if s.config.LogStoreFactory == nil {
+			s.config.LogStoreFactory = InmemLogStoreFactory
+		}
+		if s.config.SnapshotStoreFactory == nil {
+			s.config.SnapshotStoreFactory = InmemSnapshotStoreFactory
+		}
+	}
+
+	// Make sure we aren't about to ignore Raft state left on disk by the
+	// default stores.
+	if err := checkNoDiskRaftState(s.config); err != nil {
+		return err
+	}
+
+	// Create the base raft path.
+	path := filepath.Join(s.config.DataDir, raftState)
+	if !s.config.DevMode {
 		if err := lib.EnsurePath(path, true); err != nil {
 			return err
 		}
 
-		// Create the backend raft store for logs and stable storage.
+		// Keep the chunks of snapshots being restored on disk so an
+		// interrupted restore can pick up where it left off.
+		chunks, err := newDirChunkStore(filepath.Join(path, snapshotChunks))
+		if err != nil {
+			return err
+		}
+		s.fsm.chunks = chunks
+	}
+
+	// Create the stores for logs and stable storage.
+	var log raft.LogStore
+	var stable raft.StableStore
+	var snap raft.SnapshotStore
+	if s.config.LogStoreFactory != nil {
+		log, stable, err = s.config.LogStoreFactory(s.config)
+		if err != nil {
+			return err
+		}
+		if closer, ok := log.(io.Closer); ok {
+			s.raftStore = closer
+		}
+	} else {
 		store, err := raftboltdb.NewBoltStore(filepath.Join(path, "raft.db"))
 		if err != nil {
 			return err
@@ -474,14 +963,24 @@ func (s *Server) setupRaft() error {
 			return err
 		}
 		log = cacheStore
+	}
+	s.raftLog = log
 
-		// Create the snapshot store.
-		snapshots, err := raft.NewFileSnapshotStore(path, snapshotsRetained, s.config.LogOutput)
+	// Create the snapshot store.
+	if s.config.SnapshotStoreFactory != nil {
+		snap, err = s.config.SnapshotStoreFactory(s.config)
+		if err != nil {
+			return err
+		}
+	} else {
+		snap, err = raft.NewFileSnapshotStore(path, snapshotsRetained, s.config.LogOutput)
 		if err != nil {
 			return err
 		}
-		snap = snapshots
+	}
+	s.snapshotReads = newSnapshotReader(snap, s.config.LogOutput)
 
+	if !s.config.DevMode {
 		// For an existing cluster being upgraded to the new version of
 		// Raft, we almost never want to run recovery based on the old
 		// peers.json file. We create a peers.info file with a helpful
@@ -523,14 +1022,33 @@ func (s *Server) setupRaft() error {
 			}
 			s.logger.Printf("[INFO] consul: deleted peers.json file after successful recovery")
 		}
+
+		// Make sure the Raft state on disk actually belongs to us.
+		if err := s.checkRaftID(log, stable, snap, trans); err != nil {
+			return err
+		}
+	}
+
+	hasState, err := raft.HasExistingState(log, stable, snap)
+	if err != nil {
+		return err
+	}
+
+	// Remember if we're starting out without bootstrapping, so we won't be
+	// mistaken for the server that bootstrapped the cluster later on.
+	if !hasState && !s.config.Bootstrap && !s.config.DevMode {
+		if err := setRaftOrigin(stable, raftOriginJoined); err != nil {
+			return err
+		}
 	}
 
 	// If we are in bootstrap or dev mode and the state is clean then we can
 	// bootstrap now.
 	if s.config.Bootstrap || s.config.DevMode {
-		hasState, err := raft.HasExistingState(log, stable, snap)
-		if err != nil {
-			return err
+		if hasState && s.config.Bootstrap {
+			if err := s.checkBootstrapState(log, stable, snap, trans); err != nil {
+				return err
+			}
 		}
 		if !hasState {
 			// TODO (slackpad) - This will need to be updated when
@@ -547,6 +1065,11 @@ func (s *Server) setupRaft() error {
 				log, stable, snap, trans, configuration); err != nil {
 				return err
 			}
+			if s.config.Bootstrap {
+				if err := setRaftOrigin(stable, raftOriginBootstrapped); err != nil {
+					return err
+				}
+			}
 		}
 	}
 
@@ -563,6 +1086,7 @@ func (s *Server) setupRPC(tlsWrap tlsutil.DCWrapper) error {
 	// Create endpoints
 	s.endpoints.ACL = &ACL{s}
 	s.endpoints.Catalog = &Catalog{s}
+	s.endpoints.CentralCheck = &CentralCheck{s}
 	s.endpoints.Coordinate = NewCoordinate(s)
 	s.endpoints.Health = &Health{s}
 	s.endpoints.Internal = &Internal{s}
@@ -576,6 +1100,7 @@ func (s *Server) setupRPC(tlsWrap tlsutil.DCWrapper) error {
 	// Register the handlers
 	s.rpcServer.Register(s.endpoints.ACL)
 	s.rpcServer.Register(s.endpoints.Catalog)
+	s.rpcServer.Register(s.endpoints.CentralCheck)
 	s.rpcServer.Register(s.endpoints.Coordinate)
 	s.rpcServer.Register(s.endpoints.Health)
 	s.rpcServer.Register(s.endpoints.Internal)
@@ -586,9 +1111,18 @@ func (s *Server) setupRPC(tlsWrap tlsutil.DCWrapper) error {
 	s.rpcServer.Register(s.endpoints.Status)
 	s.rpcServer.Register(s.endpoints.Txn)
 
-	list, err := net.ListenTCP("tcp", s.config.RPCAddr)
-	if err != nil {
-		return err
+	var list net.Listener
+	if s.config.RPCListener != nil {
+		if s.config.RPCAdvertise == nil {
+			return fmt.Errorf("RPC advertise address must be set when providing an RPC listener")
+		}
+		list = s.config.RPCListener
+	} else {
+		tcpList, err := net.ListenTCP("tcp", s.config.RPCAddr)
+		if err != nil {
+			return err
+		}
+		list = tcpList
 	}
 	s.rpcListener = list
 
@@ -614,6 +1148,12 @@ func (s *Server) setupRPC(tlsWrap tlsutil.DCWrapper) error {
 	// ever done in the same datacenter, so we can provide it as a constant.
 	wrapper := tlsutil.SpecificDC(s.config.Datacenter, tlsWrap)
 	s.raftLayer = NewRaftLayer(advertise, wrapper)
+	if s.config.RPCDialer != nil {
+		s.raftLayer.dialer = s.config.RPCDialer
+	}
+	if s.faultInjector != nil {
+		s.raftLayer.dialer = s.faultInjector.wrap(structs.FaultInjectionRaft, s.raftLayer.dialer)
+	}
 	return nil
 }
 
@@ -627,6 +1167,14 @@ func (s *Server) Shutdown() error {
 		return nil
 	}
 
+	// Report that we aren't ready before anything stops, and give load
+	// balancers a chance to notice.
+	atomic.StoreInt32(&s.stopping, 1)
+	if s.readinessListener != nil && s.config.ReadinessShutdownDelay > 0 {
+		s.logger.Printf("[INFO] consul: waiting %v for load balancers to drain before shutting down", s.config.ReadinessShutdownDelay)
+		time.Sleep(s.config.ReadinessShutdownDelay)
+	}
+
 	s.shutdown = true
 	close(s.shutdownCh)
 
@@ -634,12 +1182,13 @@ func (s *Server) Shutdown() error {
 		s.serfLAN.Shutdown()
 	}
 
-	if s.serfWAN != nil {
-		s.serfWAN.Shutdown()
+	if wan := s.getSerfWAN(); wan != nil {
+		wan.Shutdown()
 		if err := s.router.RemoveArea(types.AreaWAN); err != nil {
 			s.logger.Printf("[WARN] consul: error removing WAN area: %v", err)
 		}
 	}
+	s.setWANStatus(structs.WANStatusDisabled, nil)
 
 	if s.raft != nil {
 		s.raftTransport.Close()
@@ -656,10 +1205,20 @@ func (s *Server) Shutdown() error {
 	if s.rpcListener != nil {
 		s.rpcListener.Close()
 	}
+	if s.readinessListener != nil {
+		s.readinessListener.Close()
+	}
 
 	// Close the connection pool
 	s.connPool.Shutdown()
 
+	// Give up the data directory last, once nothing is using it.
+	if s.dataDirLock != nil {
+		if err := s.dataDirLock.Release(); err != nil {
+			s.logger.Printf("[WARN] consul: error releasing data dir lock: %v", err)
+		}
+	}
+
 	return nil
 }
 
@@ -691,8 +1250,8 @@ func (s *Server) Leave() error {
 	}
 
 	// Leave the WAN pool
-	if s.serfWAN != nil {
-		if err := s.serfWAN.Leave(); err != nil {
+	if wan := s.getSerfWAN(); wan != nil {
+		if err := wan.Leave(); err != nil {
 			s.logger.Printf("[ERR] consul: failed to leave WAN Serf cluster: %v", err)
 		}
 	}
@@ -754,15 +1313,20 @@ func (s *Server) Leave() error {
 	return nil
 }
 
-// numPeers is used to check on the number of known peers, including the local
-// node.
+// numPeers is used to check on the number of known voting peers, including
+// the local node. Non-voters don't count, since they don't affect the quorum.
 func (s *Server) numPeers() (int, error) {
 	future := s.raft.GetConfiguration()
 	if err := future.Error(); err != nil {
 		return 0, err
 	}
-	configuration := future.Configuration()
-	return len(configuration.Servers), nil
+	numPeers := 0
+	for _, server := range future.Configuration().Servers {
+		if isVoter(server.Suffrage) {
+			numPeers++
+		}
+	}
+	return numPeers, nil
 }
 
 // JoinLAN is used to have Consul join the inner-DC pool
@@ -774,9 +1338,14 @@ func (s *Server) JoinLAN(addrs []string) (int, error) {
 
 // JoinWAN is used to have Consul join the cross-WAN Consul ring
 // The target address should be another node listening on the
-// Serf WAN address
+// Serf WAN address. A *WANNotReadyError is returned if the WAN Serf
+// isn't up.
 func (s *Server) JoinWAN(addrs []string) (int, error) {
-	return s.serfWAN.Join(addrs, true)
+	wan := s.getSerfWAN()
+	if wan == nil {
+		return 0, s.wanNotReady()
+	}
+	return wan.Join(addrs, true)
 }
 
 // LocalMember is used to return the local node
@@ -789,9 +1358,14 @@ func (s *Server) LANMembers() []serf.Member {
 	return s.serfLAN.Members()
 }
 
-// WANMembers is used to return the members of the LAN cluster
+// WANMembers is used to return the members of the WAN cluster, which will
+// be empty if the WAN Serf isn't up.
 func (s *Server) WANMembers() []serf.Member {
-	return s.serfWAN.Members()
+	wan := s.getSerfWAN()
+	if wan == nil {
+		return nil
+	}
+	return wan.Members()
 }
 
 // RemoveFailedNode is used to remove a failed node from the cluster
@@ -799,8 +1373,10 @@ func (s *Server) RemoveFailedNode(node string) error {
 	if err := s.serfLAN.RemoveFailedNode(node); err != nil {
 		return err
 	}
-	if err := s.serfWAN.RemoveFailedNode(node); err != nil {
-		return err
+	if wan := s.getSerfWAN(); wan != nil {
+		if err := wan.RemoveFailedNode(node); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -815,22 +1391,38 @@ func (s *Server) KeyManagerLAN() *serf.KeyManager {
 	return s.serfLAN.KeyManager()
 }
 
-// KeyManagerWAN returns the WAN Serf keyring manager
+// KeyManagerWAN returns the WAN Serf keyring manager, or nil if the WAN
+// Serf isn't up.
 func (s *Server) KeyManagerWAN() *serf.KeyManager {
-	return s.serfWAN.KeyManager()
+	wan := s.getSerfWAN()
+	if wan == nil {
+		return nil
+	}
+	return wan.KeyManager()
 }
 
 // Encrypted determines if gossip is encrypted
 func (s *Server) Encrypted() bool {
-	return s.serfLAN.EncryptionEnabled() && s.serfWAN.EncryptionEnabled()
+	if wan := s.getSerfWAN(); wan != nil && !wan.EncryptionEnabled() {
+		return false
+	}
+	return s.serfLAN.EncryptionEnabled()
 }
 
 // inmemCodec is used to do an RPC call without going over a network
 type inmemCodec struct {
+	srv    *Server
 	method string
 	args   interface{}
 	reply  interface{}
 	err    error
+
+	// opts are the query options of a blocking request, see
+	// blockingQueries.trackSource.
+	opts *structs.QueryOptions
+
+	// body is the copy of args that the endpoint was handed.
+	body interface{}
 }
 
 func (i *inmemCodec) ReadRequestHeader(req *rpc.Request) error {
@@ -842,10 +1434,13 @@ func (i *inmemCodec) ReadRequestBody(args interface{}) error {
 	sourceValue := reflect.Indirect(reflect.Indirect(reflect.ValueOf(i.args)))
 	dst := reflect.Indirect(reflect.Indirect(reflect.ValueOf(args)))
 	dst.Set(sourceValue)
+	i.opts = i.srv.blockingQueries.trackSource(i.method, blockingQuerySourceLocal, args)
+	i.body = args
 	return nil
 }
 
 func (i *inmemCodec) WriteResponse(resp *rpc.Response, reply interface{}) error {
+	i.srv.blockingQueries.clearSource(i.opts)
 	if resp.Error != "" {
 		i.err = errors.New(resp.Error)
 		return nil
@@ -863,13 +1458,18 @@ func (i *inmemCodec) Close() error {
 // RPC is used to make a local RPC call
 func (s *Server) RPC(method string, args interface{}, reply interface{}) error {
 	codec := &inmemCodec{
+		srv:    s,
 		method: method,
 		args:   args,
 		reply:  reply,
 	}
+	start := time.Now()
 	if err := s.rpcServer.ServeRequest(codec); err != nil {
 		return err
 	}
+	if codec.err == nil {
+		s.setReplyMeta(codec.body, reply, start)
+	}
 	return codec.err
 }
 
@@ -913,24 +1513,46 @@ func (s *Server) InjectEndpoint(endpoint interface{}) error {
 }
 
 // Stats is used to return statistics for debugging and insight
-// for various sub-systems
+// for various sub-systems. See StatsTyped for the main ones in typed form.
 func (s *Server) Stats() map[string]map[string]string {
-	toString := func(v uint64) string {
-		return strconv.FormatUint(v, 10)
+	typed := s.StatsTyped()
+	serfLANStats := s.gossipStats("lan", s.serfLAN)
+	serfLANStats["members"] = strconv.Itoa(typed.LANMembers)
+	serfWANStats := make(map[string]string)
+	if wan := s.getSerfWAN(); wan != nil {
+		serfWANStats = s.gossipStats("wan", wan)
+		serfWANStats["members"] = strconv.Itoa(typed.WANMembers)
 	}
-	numKnownDCs := len(s.router.GetDatacenters())
 	stats := map[string]map[string]string{
 		"consul": map[string]string{
-			"server":            "true",
-			"leader":            fmt.Sprintf("%v", s.IsLeader()),
-			"leader_addr":       string(s.raft.Leader()),
-			"bootstrap":         fmt.Sprintf("%v", s.config.Bootstrap),
-			"known_datacenters": toString(uint64(numKnownDCs)),
+			"server":              "true",
+			"leader":              strconv.FormatBool(typed.Leader),
+			"leader_addr":         typed.LeaderAddr,
+			"bootstrap":           strconv.FormatBool(typed.Bootstrap),
+			"bootstrap_stalled":   strconv.FormatBool(typed.BootstrapStalled),
+			"known_datacenters":   strconv.Itoa(typed.KnownDatacenters),
+			"wan_status":          typed.WANStatus,
+			"draining":            strconv.FormatBool(typed.Draining),
+			"cluster_id":          typed.ClusterID,
+			"raft_max_entry_size": strconv.Itoa(typed.RaftMaxEntrySize),
 		},
-		"raft":     s.raft.Stats(),
-		"serf_lan": s.serfLAN.Stats(),
-		"serf_wan": s.serfWAN.Stats(),
+		"raft":     typed.Raft.toMap(),
+		"serf_lan": serfLANStats,
+		"serf_wan": serfWANStats,
 		"runtime":  runtimeStats(),
+		"state":    s.stateSizeStatsMap(),
+	}
+	if s.catchUp != nil {
+		stats["catch_up"] = s.catchUp.stats()
+	}
+
+	// Call out a prepared query freeze, since it's usually set during an
+	// incident.
+	stats["consul"]["query_frozen"] = "false"
+	if _, freeze, err := s.fsm.State().QueryFreeze(nil); err == nil && freeze != nil && freeze.Frozen {
+		stats["consul"]["query_frozen"] = "true"
+		stats["consul"]["query_frozen_by"] = freeze.SetBy
+		stats["consul"]["query_frozen_at"] = freeze.SetAt.Format(time.RFC3339)
 	}
 	return stats
 }
@@ -942,7 +1564,11 @@ func (s *Server) GetLANCoordinate() (*coordinate.Coordinate, error) {
 
 // GetWANCoordinate returns the coordinate of the server in the WAN gossip pool.
 func (s *Server) GetWANCoordinate() (*coordinate.Coordinate, error) {
-	return s.serfWAN.GetCoordinate()
+	wan := s.getSerfWAN()
+	if wan == nil {
+		return nil, s.wanNotReady()
+	}
+	return wan.GetCoordinate()
 }
 
 // peersInfoContent is used to help operators understand what happened to the
@@ -0,0 +1,63 @@
+package consul
+
+import (
+	"github.com/hashicorp/consul/consul/agent"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/raft"
+)
+
+// Changes to the Raft membership of the servers are recorded in a capped
+// history in the state store, so there's still a trace of a server after
+// it's been removed and the logs have rotated away. The leader records each
+// change after it's made, so a change that fails isn't recorded, and a
+// change that's made by a leader that loses leadership before it can record
+// it may be missing.
+
+// recordServerEvent adds an event to the server history. The change has
+// already been made by the time this is called, so failing to record it is
+// only logged.
+func (s *Server) recordServerEvent(id raft.ServerID, addr raft.ServerAddress,
+	action structs.ServerEventAction, reason, initiator string) {
+	req := structs.ServerEventRequest{
+		Datacenter: s.config.Datacenter,
+		Event: structs.ServerEvent{
+			ServerID:  string(id),
+			Name:      s.serverName(id, addr),
+			Address:   string(addr),
+			Action:    action,
+			Reason:    reason,
+			Initiator: initiator,
+			Time:      s.clock.Now(),
+		},
+	}
+
+	// These are recorded as servers join and leave, which includes the
+	// old servers leaving during a rolling upgrade, so servers that don't
+	// know about the history are allowed to skip them.
+	t := structs.ServerEventRequestType | structs.IgnoreUnknownTypeFlag
+	resp, err := s.raftApply(t, &req)
+	if err == nil {
+		if respErr, ok := resp.(error); ok {
+			err = respErr
+		}
+	}
+	if err != nil {
+		s.logger.Printf("[WARN] consul: Failed to record that server %s (%s) was %s: %v",
+			id, addr, action, err)
+	}
+}
+
+// serverName looks up the node name of the server with the given ID or
+// address in the LAN pool, returning an empty string if it's not there.
+func (s *Server) serverName(id raft.ServerID, addr raft.ServerAddress) string {
+	for _, member := range s.serfLAN.Members() {
+		valid, parts := agent.IsConsulServer(member)
+		if !valid {
+			continue
+		}
+		if (id != "" && parts.ID == string(id)) || parts.Addr.String() == string(addr) {
+			return member.Name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,116 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestServerHistory_AutopilotCleanup(t *testing.T) {
+	conf := func(c *Config) {
+		c.Datacenter = "dc1"
+		c.Bootstrap = false
+		c.BootstrapExpect = 3
+	}
+	dir1, s1 := testServerWithConfig(t, conf)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerWithConfig(t, conf)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	dir3, s3 := testServerWithConfig(t, conf)
+	defer os.RemoveAll(dir3)
+	defer s3.Shutdown()
+
+	// Try to join
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := s3.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		peers, _ := s1.numPeers()
+		return peers == 3, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bring up a new server and kill a non-leader one.
+	dir4, s4 := testServerWithConfig(t, conf)
+	defer os.RemoveAll(dir4)
+	defer s4.Shutdown()
+
+	s3.Shutdown()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		alive := 0
+		for _, m := range s1.LANMembers() {
+			if m.Status == serf.StatusAlive {
+				alive++
+			}
+		}
+		return alive == 2, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Join the new server, which should get Autopilot to clean up the
+	// dead one.
+	if _, err := s4.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Both changes should end up in the history, on whichever server is
+	// asked.
+	var events structs.ServerEvents
+	if err := testutil.WaitForResult(func() (bool, error) {
+		arg := structs.ServerHistoryRequest{
+			Datacenter: "dc1",
+		}
+		var reply structs.IndexedServerHistory
+		if err := s2.RPC("Operator.ServerHistory", &arg, &reply); err != nil {
+			return false, err
+		}
+		events = reply.Events
+
+		var added, removed bool
+		for _, event := range events {
+			switch {
+			case event.Name == s4.config.NodeName && event.Action == structs.ServerEventAdded:
+				added = true
+			case event.Name == s3.config.NodeName && event.Action == structs.ServerEventRemoved:
+				removed = true
+			}
+		}
+		return added && removed, fmt.Errorf("missing events: %#v", events)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, event := range events {
+		if i > 0 && event.ID <= events[i-1].ID {
+			t.Fatalf("out of order: %#v", events)
+		}
+		if event.Time.IsZero() || event.Address == "" {
+			t.Fatalf("bad: %#v", event)
+		}
+		switch {
+		case event.Name == s4.config.NodeName && event.Action == structs.ServerEventAdded:
+			if event.Initiator != structs.ServerEventByLeader {
+				t.Fatalf("bad: %#v", event)
+			}
+		case event.Name == s3.config.NodeName && event.Action == structs.ServerEventRemoved:
+			if event.Initiator != structs.ServerEventByAutopilot || event.Reason != "dead server cleanup" {
+				t.Fatalf("bad: %#v", event)
+			}
+		}
+	}
+}
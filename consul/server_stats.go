@@ -0,0 +1,154 @@
+package consul
+
+import (
+	"strconv"
+
+	"github.com/hashicorp/raft"
+)
+
+// Stats is a typed snapshot of a server's state, for building monitoring on
+// top of the server without having to parse the string maps from
+// Server.Stats, which are built from this.
+type Stats struct {
+	// Leader is true if this server is the leader, and LeaderAddr is the
+	// address of the leader, if there is one.
+	Leader     bool
+	LeaderAddr string
+
+	// Bootstrap is true if the server is in bootstrap mode, and
+	// BootstrapStalled is true if it's waiting on bootstrapping that
+	// hasn't happened.
+	Bootstrap        bool
+	BootstrapStalled bool
+
+	// KnownDatacenters is the number of datacenters the router knows about,
+	// including this one.
+	KnownDatacenters int
+
+	// WANStatus is the state of the server's WAN pool, see WANStatus.
+	WANStatus string
+
+	// Draining is true if the server is in drain mode.
+	Draining bool
+
+	// ClusterID is the ID of the cluster this server is part of, or empty
+	// if it doesn't know it yet.
+	ClusterID string
+
+	// RaftMaxEntrySize is the largest Raft log entry the server will
+	// write, in bytes.
+	RaftMaxEntrySize int
+
+	// LANMembers and WANMembers are the number of members in each gossip
+	// pool, in any state. WANMembers is zero if the WAN pool isn't up.
+	LANMembers int
+	WANMembers int
+
+	// Raft has the server's Raft stats.
+	Raft RaftStats
+}
+
+// RaftStats are the Raft library's stats, parsed.
+type RaftStats struct {
+	// State is the server's Raft state.
+	State raft.RaftState
+
+	// Term is the current term.
+	Term uint64
+
+	// LastLogIndex and LastLogTerm describe the last entry in the log.
+	LastLogIndex uint64
+	LastLogTerm  uint64
+
+	// CommitIndex is the index of the last committed entry, and
+	// AppliedIndex is the index of the last entry applied to the FSM.
+	CommitIndex  uint64
+	AppliedIndex uint64
+
+	// LastSnapshotIndex and LastSnapshotTerm describe the last snapshot.
+	LastSnapshotIndex uint64
+	LastSnapshotTerm  uint64
+
+	// NumPeers is the number of other voters, or zero if this server isn't
+	// a voter.
+	NumPeers int
+
+	// other has the Raft stats that don't have fields, so Server.Stats
+	// can still report them.
+	other map[string]string
+}
+
+// raftStateNames maps the names Raft gives its states back to the states.
+var raftStateNames = map[string]raft.RaftState{
+	raft.Follower.String():  raft.Follower,
+	raft.Candidate.String(): raft.Candidate,
+	raft.Leader.String():    raft.Leader,
+	raft.Shutdown.String():  raft.Shutdown,
+}
+
+// parseRaftStats parses the stats from the Raft library. The numbers are all
+// formatted by the library, so ones that don't parse are left as zero.
+func parseRaftStats(stats map[string]string) RaftStats {
+	parse := func(key string) uint64 {
+		v, _ := strconv.ParseUint(stats[key], 10, 64)
+		return v
+	}
+	typed := RaftStats{
+		State:             raftStateNames[stats["state"]],
+		Term:              parse("term"),
+		LastLogIndex:      parse("last_log_index"),
+		LastLogTerm:       parse("last_log_term"),
+		CommitIndex:       parse("commit_index"),
+		AppliedIndex:      parse("applied_index"),
+		LastSnapshotIndex: parse("last_snapshot_index"),
+		LastSnapshotTerm:  parse("last_snapshot_term"),
+		NumPeers:          int(parse("num_peers")),
+		other:             make(map[string]string),
+	}
+	for k, v := range stats {
+		typed.other[k] = v
+	}
+	return typed
+}
+
+// toMap returns the stats in the form the Raft library reports them.
+func (r *RaftStats) toMap() map[string]string {
+	toString := func(v uint64) string {
+		return strconv.FormatUint(v, 10)
+	}
+	stats := make(map[string]string, len(r.other))
+	for k, v := range r.other {
+		stats[k] = v
+	}
+	stats["state"] = r.State.String()
+	stats["term"] = toString(r.Term)
+	stats["last_log_index"] = toString(r.LastLogIndex)
+	stats["last_log_term"] = toString(r.LastLogTerm)
+	stats["commit_index"] = toString(r.CommitIndex)
+	stats["applied_index"] = toString(r.AppliedIndex)
+	stats["last_snapshot_index"] = toString(r.LastSnapshotIndex)
+	stats["last_snapshot_term"] = toString(r.LastSnapshotTerm)
+	stats["num_peers"] = strconv.Itoa(r.NumPeers)
+	return stats
+}
+
+// StatsTyped returns a typed snapshot of the server's state.
+func (s *Server) StatsTyped() *Stats {
+	wanStatus, _ := s.WANStatus()
+	raftStats := parseRaftStats(s.raft.Stats())
+	stats := &Stats{
+		Leader:           raftStats.State == raft.Leader,
+		LeaderAddr:       string(s.raft.Leader()),
+		Bootstrap:        s.config.Bootstrap,
+		BootstrapStalled: s.getBootstrapStall() != nil,
+		KnownDatacenters: len(s.router.GetDatacenters()),
+		WANStatus:        wanStatus,
+		Draining:         s.IsDraining(),
+		ClusterID:        s.getClusterID(),
+		RaftMaxEntrySize: s.config.RaftMaxEntrySize,
+		LANMembers:       len(s.LANMembers()),
+		WANMembers:       len(s.WANMembers()),
+		Raft:             raftStats,
+	}
+	return stats
+}
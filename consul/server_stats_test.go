@@ -0,0 +1,75 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/raft"
+)
+
+func TestServer_StatsTyped(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// The leader writes in the background, so retry until we get a
+	// consistent view.
+	var stats *Stats
+	if err := testutil.WaitForResult(func() (bool, error) {
+		raw := s1.raft.Stats()
+		stats = s1.StatsTyped()
+		expected := map[string]uint64{
+			"term":           stats.Raft.Term,
+			"last_log_index": stats.Raft.LastLogIndex,
+			"last_log_term":  stats.Raft.LastLogTerm,
+			"commit_index":   stats.Raft.CommitIndex,
+			"applied_index":  stats.Raft.AppliedIndex,
+			"num_peers":      uint64(stats.Raft.NumPeers),
+		}
+		for key, v := range expected {
+			if raw[key] != strconv.FormatUint(v, 10) {
+				return false, fmt.Errorf("%s is %q, typed %d", key, raw[key], v)
+			}
+		}
+		if raw["state"] != stats.Raft.State.String() {
+			return false, fmt.Errorf("state is %q, typed %v", raw["state"], stats.Raft.State)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Raft.State != raft.Leader || !stats.Leader {
+		t.Fatalf("bad: %#v", stats)
+	}
+	if stats.Raft.Term == 0 || stats.Raft.LastLogIndex == 0 || stats.Raft.NumPeers != 0 {
+		t.Fatalf("bad: %#v", stats.Raft)
+	}
+	if stats.LeaderAddr != string(s1.raft.Leader()) || stats.LeaderAddr == "" {
+		t.Fatalf("bad: %q", stats.LeaderAddr)
+	}
+	if stats.LANMembers != 1 || stats.WANMembers != 1 || stats.KnownDatacenters != 1 {
+		t.Fatalf("bad: %#v", stats)
+	}
+
+	// The string maps should be built from the same values.
+	raw := stats.Raft.toMap()
+	reparsed := parseRaftStats(raw)
+	if !reflect.DeepEqual(raw, reparsed.toMap()) {
+		t.Fatalf("bad: %v", raw)
+	}
+	legacy := s1.Stats()
+	if legacy["consul"]["leader"] != "true" || legacy["consul"]["known_datacenters"] != "1" ||
+		legacy["consul"]["leader_addr"] != stats.LeaderAddr || legacy["serf_lan"]["members"] != "1" {
+		t.Fatalf("bad: %v", legacy)
+	}
+	if legacy["raft"]["protocol_version"] == "" || legacy["raft"]["latest_configuration"] == "" {
+		t.Fatalf("bad: %v", legacy["raft"])
+	}
+}
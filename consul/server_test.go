@@ -7,13 +7,18 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/lib"
 	"github.com/hashicorp/consul/testutil"
 	"github.com/hashicorp/consul/types"
 	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
 )
 
 var nextPort int32 = 15000
@@ -778,3 +783,389 @@ func TestServer_Encrypted(t *testing.T) {
 		t.Fatalf("should be encrypted")
 	}
 }
+
+// inmemNetwork hands out in-memory RPC listeners along with a dialer that can
+// reach them, so servers can talk to each other without binding TCP ports.
+type inmemNetwork struct {
+	listeners map[string]*inmemListener
+	sync.Mutex
+}
+
+func newInmemNetwork() *inmemNetwork {
+	return &inmemNetwork{
+		listeners: make(map[string]*inmemListener),
+	}
+}
+
+// Listen returns a new in-memory listener reachable at the given address.
+func (n *inmemNetwork) Listen(addr *net.TCPAddr) *inmemListener {
+	n.Lock()
+	defer n.Unlock()
+
+	l := &inmemListener{
+		addr:    addr,
+		connCh:  make(chan net.Conn),
+		closeCh: make(chan struct{}),
+	}
+	n.listeners[addr.String()] = l
+	return l
+}
+
+// Dial implements DialerFunc by connecting a pipe to the listener at the
+// given address.
+func (n *inmemNetwork) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	n.Lock()
+	l, ok := n.listeners[address]
+	n.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no listener at %q", address)
+	}
+
+	client, server := net.Pipe()
+	select {
+	case l.connCh <- server:
+		return client, nil
+	case <-l.closeCh:
+	case <-time.After(timeout):
+	}
+	client.Close()
+	server.Close()
+	return nil, fmt.Errorf("failed to dial %q", address)
+}
+
+// inmemListener is a net.Listener that accepts connections made through an
+// inmemNetwork.
+type inmemListener struct {
+	addr      *net.TCPAddr
+	connCh    chan net.Conn
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *inmemListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connCh:
+		return conn, nil
+	case <-l.closeCh:
+		return nil, fmt.Errorf("listener closed")
+	}
+}
+
+func (l *inmemListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closeCh) })
+	return nil
+}
+
+func (l *inmemListener) Addr() net.Addr {
+	return l.addr
+}
+
+func TestServer_ProvidedListeners(t *testing.T) {
+	rpcNet := newInmemNetwork()
+	serfNet := &memberlist.MockNetwork{}
+	inmem := func(c *Config) {
+		addr := &net.TCPAddr{IP: []byte{127, 0, 0, 1}, Port: getPort()}
+		c.RPCAdvertise = addr
+		c.RPCListener = rpcNet.Listen(addr)
+		c.RPCDialer = rpcNet.Dial
+		c.SerfLANTransport = serfNet.NewTransport()
+		c.SerfWANTransport = serfNet.NewTransport()
+	}
+
+	dir1, s1 := testServerWithConfig(t, inmem)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		inmem(c)
+		c.Bootstrap = false
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	// The RPC layer should be using the provided listener.
+	if s1.rpcListener != s1.config.RPCListener {
+		t.Fatalf("provided RPC listener not used")
+	}
+
+	// Join over the mock Serf transport.
+	ip, port, err := s1.config.SerfLANTransport.FinalAdvertiseAddr("", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr := fmt.Sprintf("%s:%d", ip, port)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Raft runs over the in-memory connections, so both servers should see
+	// each other as peers.
+	for _, s := range []*Server{s1, s2} {
+		if err := testutil.WaitForResult(func() (bool, error) {
+			peers, _ := s.numPeers()
+			return peers == 2, fmt.Errorf("%d", peers)
+		}); err != nil {
+			t.Fatalf("should have 2 peers: %v", err)
+		}
+	}
+
+	// A write to the follower has to be forwarded to the leader.
+	testutil.WaitForLeader(t, s2.RPC, "dc1")
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+	}
+	var out struct{}
+	for _, s := range []*Server{s1, s2} {
+		if err := s.RPC("Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for _, s := range []*Server{s1, s2} {
+		if err := testutil.WaitForResult(func() (bool, error) {
+			_, node, err := s.fsm.State().GetNode("foo")
+			return node != nil, err
+		}); err != nil {
+			t.Fatalf("node not replicated: %v", err)
+		}
+	}
+
+	// Serf must not have bound the ports from the config.
+	lanPort := s1.config.SerfLANConfig.MemberlistConfig.BindPort
+	conn, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%d", lanPort))
+	if err != nil {
+		t.Fatalf("LAN Serf port should be free: %v", err)
+	}
+	conn.Close()
+}
+
+func TestServer_ProvidedListener_RequiresAdvertise(t *testing.T) {
+	dir, config := testServerConfig(t, "a")
+	defer os.RemoveAll(dir)
+
+	config.RPCListener = newInmemNetwork().Listen(config.RPCAddr)
+	server, err := NewServer(config)
+	if err == nil {
+		server.Shutdown()
+		t.Fatalf("should fail without an advertise address")
+	}
+	if !strings.Contains(err.Error(), "advertise") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestServer_WANBindFailure(t *testing.T) {
+	// Occupy the WAN port before starting the server.
+	wanPort := getPort()
+	addr := fmt.Sprintf("127.0.0.1:%d", wanPort)
+	list, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer list.Close()
+
+	// This should fail outright if the WAN is required.
+	dir, config := testServerConfig(t, "required")
+	defer os.RemoveAll(dir)
+	config.SerfWANConfig.MemberlistConfig.BindPort = wanPort
+	config.RequireWAN = true
+	if server, err := NewServer(config); err == nil {
+		server.Shutdown()
+		t.Fatalf("should fail to start")
+	}
+
+	// Otherwise the server should come up without the WAN.
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.SerfWANConfig.MemberlistConfig.BindPort = wanPort
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	if status, err := s1.WANStatus(); status != structs.WANStatusRetrying || err == nil {
+		t.Fatalf("bad: %s %v", status, err)
+	}
+	if s1.Stats()["consul"]["wan_status"] != structs.WANStatusRetrying {
+		t.Fatalf("bad: %v", s1.Stats())
+	}
+	if members := s1.WANMembers(); len(members) != 0 {
+		t.Fatalf("bad: %v", members)
+	}
+	_, err = s1.JoinWAN([]string{"127.0.0.1:1"})
+	if _, ok := err.(*WANNotReadyError); !ok {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Free up the port and make sure the WAN comes up.
+	list.Close()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		status, err := s1.WANStatus()
+		return status == structs.WANStatusUp, fmt.Errorf("%s: %v", status, err)
+	}); err != nil {
+		t.Fatalf("WAN never came up: %v", err)
+	}
+	if members := s1.WANMembers(); len(members) != 1 {
+		t.Fatalf("bad: %v", members)
+	}
+	if len(s1.router.GetDatacenters()) != 1 {
+		t.Fatalf("bad: %v", s1.router.GetDatacenters())
+	}
+}
+
+func TestServer_BadExpect_Stalled(t *testing.T) {
+	expects := []int{3, 2, 3}
+	var servers []*Server
+	for _, expect := range expects {
+		dir, s := testServerWithConfig(t, func(c *Config) {
+			c.Bootstrap = false
+			c.BootstrapExpect = expect
+			c.BootstrapStallTimeout = 100 * time.Millisecond
+		})
+		defer os.RemoveAll(dir)
+		defer s.Shutdown()
+		servers = append(servers, s)
+	}
+
+	// Join them all up.
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		servers[0].config.SerfLANConfig.MemberlistConfig.BindPort)
+	for _, s := range servers[1:] {
+		if _, err := s.JoinLAN([]string{addr}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Every server should report the stall, naming the conflicting
+	// values.
+	for i, s := range servers {
+		if err := testutil.WaitForResult(func() (bool, error) {
+			stall := s.getBootstrapStall()
+			if stall == nil {
+				return false, fmt.Errorf("server %d not stalled", i)
+			}
+			if len(stall.Servers) != 3 {
+				return false, fmt.Errorf("server %d: bad: %#v", i, stall)
+			}
+			return true, nil
+		}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		stall := s.getBootstrapStall()
+		if stall.Node != s.config.NodeName || stall.Expect != expects[i] {
+			t.Fatalf("bad: %#v", stall)
+		}
+		seen := make(map[int]int)
+		for _, server := range stall.Servers {
+			seen[server.Expect]++
+		}
+		if seen[2] != 1 || seen[3] != 2 {
+			t.Fatalf("bad: %#v", stall.Servers)
+		}
+
+		if stats := s.Stats(); stats["consul"]["bootstrap_stalled"] != "true" {
+			t.Fatalf("bad: %#v", stats["consul"])
+		}
+		if peers, _ := s.numPeers(); peers != 0 {
+			t.Fatalf("bad: %d", peers)
+		}
+
+		// The health RPC should report it too, rather than waiting on a
+		// leader that'll never show up.
+		codec := rpcClient(t, s)
+		arg := structs.DCSpecificRequest{
+			Datacenter: "dc1",
+		}
+		var reply structs.OperatorHealthReply
+		err := msgpackrpc.CallWithCodec(codec, "Operator.ServerHealth", &arg, &reply)
+		codec.Close()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if reply.Healthy || reply.BootstrapStall == nil || reply.BootstrapStall.Expect != expects[i] {
+			t.Fatalf("bad: %#v", reply)
+		}
+	}
+}
+
+func TestServer_BadExpect_StalledOnTime(t *testing.T) {
+	clock := lib.NewFakeClock(time.Now())
+	timeout := 10 * time.Second
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Bootstrap = false
+		c.BootstrapExpect = 2
+		c.BootstrapStallTimeout = timeout
+		c.Clock = clock
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Bootstrap = false
+		c.BootstrapExpect = 3
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		servers := s1.bootstrapServers()
+		return len(servers) == 2, fmt.Errorf("%d", len(servers))
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The stall should be reported soon after the timeout runs out, not a
+	// whole timeout later.
+	step := timeout / bootstrapStallChecks
+	for i := 0; i <= bootstrapStallChecks; i++ {
+		clock.Advance(step)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return s1.getBootstrapStall() != nil, fmt.Errorf("not stalled")
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestServer_Expect_NotStalled(t *testing.T) {
+	var servers []*Server
+	for i := 0; i < 3; i++ {
+		dir, s := testServerWithConfig(t, func(c *Config) {
+			c.Bootstrap = false
+			c.BootstrapExpect = 3
+			c.BootstrapStallTimeout = 100 * time.Millisecond
+		})
+		defer os.RemoveAll(dir)
+		defer s.Shutdown()
+		servers = append(servers, s)
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		servers[0].config.SerfLANConfig.MemberlistConfig.BindPort)
+	for _, s := range servers[1:] {
+		if _, err := s.JoinLAN([]string{addr}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for _, s := range servers {
+		testutil.WaitForLeader(t, s.RPC, "dc1")
+	}
+
+	// Give the monitors a few rounds and make sure nobody complains.
+	time.Sleep(500 * time.Millisecond)
+	for _, s := range servers {
+		if stall := s.getBootstrapStall(); stall != nil {
+			t.Fatalf("bad: %#v", stall)
+		}
+		if stats := s.Stats(); stats["consul"]["bootstrap_stalled"] != "false" {
+			t.Fatalf("bad: %#v", stats["consul"])
+		}
+	}
+}
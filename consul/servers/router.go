@@ -36,6 +36,21 @@ type Router struct {
 	// routeFn is a hook to actually do the routing.
 	routeFn func(datacenter string) (*Manager, *agent.Server, bool)
 
+	// aliasFn is a hook to look up the canonical name of a datacenter that
+	// has been renamed. This may be nil.
+	aliasFn func(datacenter string) (string, bool)
+
+	// changeCh gets a value whenever servers are added, removed, or failed,
+	// for anything that wants to react to changes in the routes. It has a
+	// buffer of one so changes that pile up are coalesced.
+	changeCh chan struct{}
+
+	// index goes up whenever the Serf membership of an area changes, for
+	// blocking queries on the members and datacenters. indexCh is closed
+	// and replaced each time it does.
+	index   uint64
+	indexCh chan struct{}
+
 	// This top-level lock covers all the internal state.
 	sync.RWMutex
 }
@@ -82,6 +97,9 @@ func NewRouter(logger *log.Logger, shutdownCh chan struct{}, localDatacenter str
 		localDatacenter: localDatacenter,
 		areas:           make(map[types.AreaID]*areaInfo),
 		managers:        make(map[string][]*Manager),
+		changeCh:        make(chan struct{}, 1),
+		index:           1,
+		indexCh:         make(chan struct{}),
 	}
 
 	// Hook the direct route lookup by default.
@@ -121,6 +139,7 @@ func (r *Router) AddArea(areaID types.AreaID, cluster RouterSerfCluster, pinger
 		managers: make(map[string]*managerInfo),
 	}
 	r.areas[areaID] = area
+	r.bumpIndexLocked()
 
 	// Do an initial populate of the manager so that we don't have to wait
 	// for events to fire. This lets us attempt to use all the known servers
@@ -176,6 +195,7 @@ func (r *Router) RemoveArea(areaID types.AreaID) error {
 	}
 
 	delete(r.areas, areaID)
+	r.bumpIndexLocked()
 	return nil
 }
 
@@ -199,6 +219,7 @@ func (r *Router) addServer(area *areaInfo, s *agent.Server) error {
 	}
 
 	info.manager.AddServer(s)
+	r.notifyChange()
 	return nil
 }
 
@@ -243,6 +264,7 @@ func (r *Router) RemoveServer(areaID types.AreaID, s *agent.Server) error {
 		delete(area.managers, s.Datacenter)
 	}
 
+	r.notifyChange()
 	return nil
 }
 
@@ -268,9 +290,50 @@ func (r *Router) FailServer(areaID types.AreaID, s *agent.Server) error {
 	}
 
 	info.manager.NotifyFailedServer(s)
+	r.notifyChange()
 	return nil
 }
 
+// ChangeCh returns a channel that gets a value whenever servers are added,
+// removed, or failed. Several changes may be reported with one value.
+func (r *Router) ChangeCh() <-chan struct{} {
+	return r.changeCh
+}
+
+// notifyChange signals the change channel without blocking.
+func (r *Router) notifyChange() {
+	select {
+	case r.changeCh <- struct{}{}:
+	default:
+	}
+}
+
+// Index returns the current membership index, along with a channel that's
+// closed when it next changes. The index starts over when the server
+// restarts, like the Raft index does when a cluster is rebuilt, so clients
+// should start over if it goes backwards.
+func (r *Router) Index() (uint64, <-chan struct{}) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.index, r.indexCh
+}
+
+// BumpIndex moves the membership index along and wakes up anything waiting
+// on it. This is called for every Serf member event.
+func (r *Router) BumpIndex() {
+	r.Lock()
+	defer r.Unlock()
+	r.bumpIndexLocked()
+}
+
+// bumpIndexLocked moves the membership index along. The lock must be held
+// for writing.
+func (r *Router) bumpIndexLocked() {
+	r.index++
+	close(r.indexCh)
+	r.indexCh = make(chan struct{})
+}
+
 // FindRoute returns a healthy server with a route to the given datacenter. The
 // Boolean return parameter will indicate if a server was available. In some
 // cases this may return a best-effort unhealthy server that can be used for a
@@ -278,7 +341,42 @@ func (r *Router) FailServer(areaID types.AreaID, s *agent.Server) error {
 // should feed that back to the manager associated with the server, which is
 // also returned, by calling NofifyFailedServer().
 func (r *Router) FindRoute(datacenter string) (*Manager, *agent.Server, bool) {
-	return r.routeFn(datacenter)
+	if manager, server, ok := r.routeFn(datacenter); ok {
+		return manager, server, ok
+	}
+
+	// See if it's the old name of a datacenter we know about.
+	if canonical := r.ResolveDatacenter(datacenter); canonical != datacenter {
+		return r.routeFn(canonical)
+	}
+	return nil, nil, false
+}
+
+// SetAliasFn sets the hook used to look up the canonical names of renamed
+// datacenters. The hook should return false if the name isn't an alias.
+func (r *Router) SetAliasFn(fn func(datacenter string) (string, bool)) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.aliasFn = fn
+}
+
+// ResolveDatacenter returns the canonical name of the given datacenter. Names
+// of datacenters the router knows about are returned as-is, and aliases are
+// only consulted for names it doesn't know.
+func (r *Router) ResolveDatacenter(datacenter string) string {
+	r.RLock()
+	_, known := r.managers[datacenter]
+	fn := r.aliasFn
+	r.RUnlock()
+
+	if known || datacenter == r.localDatacenter || fn == nil {
+		return datacenter
+	}
+	if canonical, ok := fn(datacenter); ok {
+		return canonical
+	}
+	return datacenter
 }
 
 // findDirectRoute looks for a route to the given datacenter if it's directly
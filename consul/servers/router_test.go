@@ -313,6 +313,150 @@ func TestRouter_Routing_Offline(t *testing.T) {
 	}
 }
 
+func TestRouter_DatacenterAliases(t *testing.T) {
+	r := testRouter("dc0")
+	wan := testCluster("node0.dc0")
+	if err := r.AddArea(types.AreaWAN, wan, &fauxConnPool{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Without a hook, names pass straight through.
+	if dc := r.ResolveDatacenter("dc-old"); dc != "dc-old" {
+		t.Fatalf("bad: %s", dc)
+	}
+	if _, _, ok := r.FindRoute("dc-old"); ok {
+		t.Fatalf("bad")
+	}
+
+	// Set up some aliases, including ones that shadow known datacenters.
+	aliases := map[string]string{
+		"dc-old":  "dc1",
+		"dc-gone": "dc-nope",
+		"dc2":     "dc1",
+		"dc0":     "dc1",
+	}
+	r.SetAliasFn(func(datacenter string) (string, bool) {
+		canonical, ok := aliases[datacenter]
+		return canonical, ok
+	})
+
+	// Known names, including our own, are never aliased.
+	cases := map[string]string{
+		"dc-old":  "dc1",
+		"dc-gone": "dc-nope",
+		"dc-what": "dc-what",
+		"dc0":     "dc0",
+		"dc2":     "dc2",
+	}
+	for name, expected := range cases {
+		if dc := r.ResolveDatacenter(name); dc != expected {
+			t.Fatalf("bad: %s -> %s", name, dc)
+		}
+	}
+
+	// Routes should follow the alias.
+	_, s, ok := r.FindRoute("dc-old")
+	if !ok || s.Datacenter != "dc1" {
+		t.Fatalf("bad: %#v", s)
+	}
+	_, s, ok = r.FindRoute("dc2")
+	if !ok || s.Datacenter != "dc2" {
+		t.Fatalf("bad: %#v", s)
+	}
+	if _, _, ok := r.FindRoute("dc-gone"); ok {
+		t.Fatalf("bad")
+	}
+}
+
+func TestRouter_ChangeCh(t *testing.T) {
+	r := testRouter("dc0")
+	changed := func() bool {
+		select {
+		case <-r.ChangeCh():
+			return true
+		default:
+			return false
+		}
+	}
+	if changed() {
+		t.Fatalf("bad")
+	}
+
+	// Adding an area adds a bunch of servers, which should only get
+	// reported once.
+	wan := testCluster("node0.dc0")
+	if err := r.AddArea(types.AreaWAN, wan, &fauxConnPool{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !changed() {
+		t.Fatalf("bad")
+	}
+	if changed() {
+		t.Fatalf("bad")
+	}
+
+	// Failing and removing servers should be reported.
+	_, s, ok := r.FindRoute("dc1")
+	if !ok {
+		t.Fatalf("bad")
+	}
+	if err := r.FailServer(types.AreaWAN, s); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !changed() {
+		t.Fatalf("bad")
+	}
+	if err := r.RemoveServer(types.AreaWAN, s); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !changed() {
+		t.Fatalf("bad")
+	}
+}
+
+func TestRouter_Index(t *testing.T) {
+	r := testRouter("dc0")
+
+	// A fresh router should have a non-zero index, so the first blocking
+	// query returns right away.
+	index, ch := r.Index()
+	if index == 0 {
+		t.Fatalf("bad: %d", index)
+	}
+	closed := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+	if closed(ch) {
+		t.Fatalf("bad")
+	}
+
+	// Adding an area and bumping should each move the index along and wake
+	// up the last watcher.
+	wan := testCluster("node0.dc0")
+	if err := r.AddArea(types.AreaWAN, wan, &fauxConnPool{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !closed(ch) {
+		t.Fatalf("bad")
+	}
+	next, ch := r.Index()
+	if next <= index || closed(ch) {
+		t.Fatalf("bad: %d", next)
+	}
+	r.BumpIndex()
+	if !closed(ch) {
+		t.Fatalf("bad")
+	}
+	if last, _ := r.Index(); last <= next {
+		t.Fatalf("bad: %d", last)
+	}
+}
+
 func TestRouter_GetDatacenters(t *testing.T) {
 	r := testRouter("dc0")
 
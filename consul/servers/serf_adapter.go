@@ -68,6 +68,12 @@ func HandleSerfEvents(logger *log.Logger, router *Router, areaID types.AreaID, s
 			default:
 				logger.Printf("[WARN] consul: Unhandled Serf Event: %#v", e)
 			}
+
+			// Any change to the members, even ones the router
+			// ignores, wakes up blocking queries on them.
+			if _, ok := e.(serf.MemberEvent); ok {
+				router.BumpIndex()
+			}
 		}
 	}
 }
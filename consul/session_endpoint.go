@@ -22,6 +22,33 @@ func (s *Session) Apply(args *structs.SessionRequest, reply *string) error {
 	if done, err := s.srv.forward("Session.Apply", args, args, reply); done {
 		return err
 	}
+
+	var out structs.SessionCreateReply
+	if err := s.apply("Session.Apply", args, &out); err != nil {
+		return err
+	}
+	*reply = out.ID
+	return nil
+}
+
+// Create is used to create a session the same way as Apply, but it also
+// returns when the leader will expire the session if it has a TTL. Apply's
+// reply is just the session ID, which older clients rely on, so this gets an
+// endpoint of its own.
+func (s *Session) Create(args *structs.SessionRequest, reply *structs.SessionCreateReply) error {
+	if done, err := s.srv.forward("Session.Create", args, args, reply); done {
+		return err
+	}
+
+	if args.Op != structs.SessionCreate {
+		return fmt.Errorf("Invalid session operation %q", args.Op)
+	}
+	return s.apply("Session.Create", args, reply)
+}
+
+// apply runs a session create or destroy on the leader for the given
+// endpoint.
+func (s *Session) apply(endpoint string, args *structs.SessionRequest, reply *structs.SessionCreateReply) error {
 	defer metrics.MeasureSince([]string{"consul", "session", "apply"}, time.Now())
 
 	// Verify the args
@@ -33,7 +60,7 @@ func (s *Session) Apply(args *structs.SessionRequest, reply *string) error {
 	}
 
 	// Fetch the ACL token, if any, and apply the policy.
-	acl, err := s.srv.resolveToken(args.Token)
+	acl, err := s.srv.resolveToken(endpoint, args.Token)
 	if err != nil {
 		return err
 	}
@@ -105,6 +132,11 @@ func (s *Session) Apply(args *structs.SessionRequest, reply *string) error {
 				break
 			}
 		}
+
+		// Record who made the session, which can't be forged, along
+		// with the limits it's checked against when it's applied.
+		args.Session.TokenHash = hashToken(args.Token)
+		args.NodeSessionLimit, args.TokenSessionLimit = s.srv.sessionLimits(args.Token, &args.Session)
 	}
 
 	// Apply the update
@@ -113,10 +145,14 @@ func (s *Session) Apply(args *structs.SessionRequest, reply *string) error {
 		s.srv.logger.Printf("[ERR] consul.session: Apply failed: %v", err)
 		return err
 	}
+	if _, ok := resp.(*structs.SessionLimitError); ok {
+		metrics.IncrCounter([]string{"consul", "session", "limited"}, 1)
+		return resp.(error)
+	}
 
 	if args.Op == structs.SessionCreate && args.Session.TTL != "" {
 		// If we created a session with a TTL, reset the expiration timer
-		s.srv.resetSessionTimer(args.Session.ID, &args.Session)
+		reply.ExpiresAt, _ = s.srv.resetSessionTimer(args.Session.ID, &args.Session)
 	} else if args.Op == structs.SessionDestroy {
 		// If we destroyed a session, it might potentially have a TTL,
 		// and we need to clear the timer
@@ -129,7 +165,7 @@ func (s *Session) Apply(args *structs.SessionRequest, reply *string) error {
 
 	// Check if the return type is a string
 	if respString, ok := resp.(string); ok {
-		*reply = respString
+		reply.ID = respString
 	}
 	return nil
 }
@@ -156,7 +192,7 @@ func (s *Session) Get(args *structs.SessionSpecificRequest,
 			} else {
 				reply.Sessions = nil
 			}
-			if err := s.srv.filterACL(args.Token, reply); err != nil {
+			if err := s.srv.filterACL("Session.Get", args.Token, reply); err != nil {
 				return err
 			}
 			return nil
@@ -180,7 +216,7 @@ func (s *Session) List(args *structs.DCSpecificRequest,
 			}
 
 			reply.Index, reply.Sessions = index, sessions
-			if err := s.srv.filterACL(args.Token, reply); err != nil {
+			if err := s.srv.filterACL("Session.List", args.Token, reply); err != nil {
 				return err
 			}
 			return nil
@@ -204,7 +240,7 @@ func (s *Session) NodeSessions(args *structs.NodeSpecificRequest,
 			}
 
 			reply.Index, reply.Sessions = index, sessions
-			if err := s.srv.filterACL(args.Token, reply); err != nil {
+			if err := s.srv.filterACL("Session.NodeSessions", args.Token, reply); err != nil {
 				return err
 			}
 			return nil
@@ -232,7 +268,7 @@ func (s *Session) Renew(args *structs.SessionSpecificRequest,
 	}
 
 	// Fetch the ACL token, if any, and apply the policy.
-	acl, err := s.srv.resolveToken(args.Token)
+	acl, err := s.srv.resolveToken("Session.Renew", args.Token)
 	if err != nil {
 		return err
 	}
@@ -244,10 +280,12 @@ func (s *Session) Renew(args *structs.SessionSpecificRequest,
 
 	// Reset the session TTL timer.
 	reply.Sessions = structs.Sessions{session}
-	if err := s.srv.resetSessionTimer(args.Session, session); err != nil {
+	expires, err := s.srv.resetSessionTimer(args.Session, session)
+	if err != nil {
 		s.srv.logger.Printf("[ERR] consul.session: Session renew failed: %v", err)
 		return err
 	}
+	reply.ExpiresAt = expires
 
 	return nil
 }
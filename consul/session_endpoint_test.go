@@ -71,6 +71,114 @@ func TestSession_Apply(t *testing.T) {
 	}
 }
 
+func TestSession_Apply_ServiceChecks(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register a service with a passing check.
+	reg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "web1",
+			Service: "web",
+		},
+		Check: &structs.HealthCheck{
+			CheckID:   "web1-check",
+			Name:      "web check",
+			ServiceID: "web1",
+			Status:    structs.HealthPassing,
+		},
+	}
+	var regOut struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &reg, &regOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Make a session tied to the service's check and grab a lock with it.
+	arg := structs.SessionRequest{
+		Datacenter: "dc1",
+		Op:         structs.SessionCreate,
+		Session: structs.Session{
+			Node:      "foo",
+			LockDelay: 100 * time.Millisecond,
+			ServiceChecks: []structs.SessionServiceCheck{
+				{ID: "web1-check", ServiceID: "web1"},
+			},
+		},
+	}
+	var id string
+	if err := msgpackrpc.CallWithCodec(codec, "Session.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	lock := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSLock,
+		DirEnt: structs.DirEntry{
+			Key:     "web/leader",
+			Session: id,
+		},
+	}
+	var locked bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &lock, &locked); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !locked {
+		t.Fatalf("should acquire")
+	}
+
+	// Fail the service's check.
+	reg.Check.Status = structs.HealthCritical
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &reg, &regOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The session should be gone and the lock released.
+	state := s1.fsm.State()
+	_, sess, err := state.SessionGet(nil, id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if sess != nil {
+		t.Fatalf("session should be invalidated")
+	}
+	_, d, err := state.KVSGet(nil, "web/leader")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || d.Session != "" {
+		t.Fatalf("bad: %#v", d)
+	}
+
+	// A new session on the node can't take the lock until the lock
+	// delay is up.
+	arg.Session.ServiceChecks = nil
+	var id2 string
+	if err := msgpackrpc.CallWithCodec(codec, "Session.Apply", &arg, &id2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	lock.DirEnt.Session = id2
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &lock, &locked); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if locked {
+		t.Fatalf("should not acquire")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &lock, &locked); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !locked {
+		t.Fatalf("should acquire")
+	}
+}
+
 func TestSession_DeleteApply(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -228,6 +336,183 @@ session "foo" {
 	}
 }
 
+func TestSession_Apply_NodeLimit(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.SessionLimitPerNode = 2
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	s1.fsm.State().EnsureNode(1, &structs.Node{Node: "foo", Address: "127.0.0.1"})
+	s1.fsm.State().EnsureNode(2, &structs.Node{Node: "bar", Address: "127.0.0.1"})
+
+	create := func(node string) (string, error) {
+		arg := structs.SessionRequest{
+			Datacenter: "dc1",
+			Op:         structs.SessionCreate,
+			Session: structs.Session{
+				Node: node,
+			},
+		}
+		var out string
+		err := msgpackrpc.CallWithCodec(codec, "Session.Apply", &arg, &out)
+		return out, err
+	}
+
+	// Fill up the node.
+	var ids []string
+	for i := 0; i < 2; i++ {
+		id, err := create("foo")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	// The next one should be refused, even if the client tries to set
+	// its own limit, but other nodes are fine.
+	_, err := create("foo")
+	if !structs.HasErrorCode(err, structs.ErrCodeSessionLimit) || !strings.Contains(err.Error(), "per node") {
+		t.Fatalf("err: %v", err)
+	}
+	sneaky := structs.SessionRequest{
+		Datacenter:       "dc1",
+		Op:               structs.SessionCreate,
+		Session:          structs.Session{Node: "foo"},
+		NodeSessionLimit: 100,
+	}
+	var sneakyOut string
+	err = msgpackrpc.CallWithCodec(codec, "Session.Apply", &sneaky, &sneakyOut)
+	if !structs.HasErrorCode(err, structs.ErrCodeSessionLimit) {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := create("bar"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Destroying one should make room right away.
+	arg := structs.SessionRequest{
+		Datacenter: "dc1",
+		Op:         structs.SessionDestroy,
+		Session: structs.Session{
+			ID: ids[0],
+		},
+	}
+	var out string
+	if err := msgpackrpc.CallWithCodec(codec, "Session.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := create("foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The per-node counts should come from the state store, so they keep
+	// up with sessions that go away when their node does.
+	emitted := s1.emitNodeSessionCounts(nil)
+	if len(emitted) != 2 || !emitted["foo"] || !emitted["bar"] {
+		t.Fatalf("bad: %v", emitted)
+	}
+	if err := s1.fsm.State().DeleteNode(20, "bar"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	emitted = s1.emitNodeSessionCounts(emitted)
+	if len(emitted) != 1 || !emitted["foo"] {
+		t.Fatalf("bad: %v", emitted)
+	}
+}
+
+func TestSession_Apply_TokenLimit(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Negative limits aren't allowed.
+	req := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:         "User token",
+			Type:         structs.ACLTypeClient,
+			Rules:        `session "" { policy = "write" }`,
+			SessionLimit: -1,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var token string
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &req, &token); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	req.ACL.SessionLimit = 1
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &req, &token); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s1.fsm.State().EnsureNode(1, &structs.Node{Node: "foo", Address: "127.0.0.1"})
+
+	arg := structs.SessionRequest{
+		Datacenter: "dc1",
+		Op:         structs.SessionCreate,
+		Session: structs.Session{
+			Node:      "foo",
+			TokenHash: "forged",
+		},
+		WriteRequest: structs.WriteRequest{Token: token},
+	}
+	var out string
+	if err := msgpackrpc.CallWithCodec(codec, "Session.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The session should record a hash of the token, not the token or
+	// what was sent.
+	_, sess, err := s1.fsm.State().SessionGet(nil, out)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if sess.TokenHash != hashToken(token) {
+		t.Fatalf("bad: %#v", sess)
+	}
+
+	// The token is at its limit, but other tokens aren't affected.
+	var out2 string
+	err = msgpackrpc.CallWithCodec(codec, "Session.Apply", &arg, &out2)
+	if !structs.HasErrorCode(err, structs.ErrCodeSessionLimit) || !strings.Contains(err.Error(), "per token") {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Session.Apply", &arg, &out2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Destroying the token's session makes room for another.
+	destroy := structs.SessionRequest{
+		Datacenter: "dc1",
+		Op:         structs.SessionDestroy,
+		Session: structs.Session{
+			ID: out,
+		},
+		WriteRequest: structs.WriteRequest{Token: token},
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Session.Apply", &destroy, &out2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Token = token
+	if err := msgpackrpc.CallWithCodec(codec, "Session.Apply", &arg, &out2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestSession_Get(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
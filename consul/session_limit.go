@@ -0,0 +1,88 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// sessionCountStatsInterval is how often the leader emits the number of
+// sessions each node has.
+const sessionCountStatsInterval = 10 * time.Second
+
+// tokenSessionLimit returns the session limit for the given token, or zero
+// if it has none. This works like tokenRateLimit, so the token needs to have
+// been resolved if we don't have a copy of the tokens.
+func (s *Server) tokenSessionLimit(id string) int {
+	if s.config.Datacenter == s.config.ACLDatacenter || s.IsACLReplicationEnabled() {
+		_, token, err := s.fsm.State().ACLGet(nil, id)
+		if err == nil && token != nil {
+			return token.SessionLimit
+		}
+	}
+	return s.aclCache.tokenSessionLimit(id)
+}
+
+// sessionLimits returns the most sessions the node and token of the given
+// session can have, or zero for no limit. The session's token hash must
+// already be set. The limits are checked against the sessions in the state
+// store when the create is applied.
+func (s *Server) sessionLimits(token string, sess *structs.Session) (int, int) {
+	nodeLimit := s.config.SessionLimitPerNode
+	if sess.TokenHash == "" || s.config.ACLDatacenter == "" {
+		return nodeLimit, 0
+	}
+	return nodeLimit, s.tokenSessionLimit(token)
+}
+
+// sessionCountStats is a long running routine that emits the number of
+// sessions each node has while this server is the leader, until the server
+// shuts down. Sessions go away in lots of ways, like when a node's checks
+// fail, so they're counted from the state store rather than as they're
+// created and destroyed.
+func (s *Server) sessionCountStats() {
+	var emitted map[string]bool
+	for {
+		select {
+		case <-time.After(sessionCountStatsInterval):
+			if s.IsLeader() {
+				emitted = s.emitNodeSessionCounts(emitted)
+			}
+
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// emitNodeSessionCounts sets the gauge for the number of sessions each node
+// has, if there's a per-node session limit. Nodes in emitted that don't have
+// any sessions any more get zeroed. This returns the nodes that have a gauge
+// now.
+func (s *Server) emitNodeSessionCounts(emitted map[string]bool) map[string]bool {
+	if s.config.SessionLimitPerNode <= 0 {
+		return emitted
+	}
+	_, sessions, err := s.fsm.State().SessionList(nil)
+	if err != nil {
+		s.logger.Printf("[WARN] consul.session: failed to count sessions: %v", err)
+		return emitted
+	}
+
+	counts := make(map[string]int)
+	for _, sess := range sessions {
+		counts[sess.Node]++
+	}
+	for node := range emitted {
+		if _, ok := counts[node]; !ok {
+			metrics.SetGauge([]string{"consul", "session", "node", node}, 0)
+		}
+	}
+	next := make(map[string]bool, len(counts))
+	for node, count := range counts {
+		metrics.SetGauge([]string{"consul", "session", "node", node}, float32(count))
+		next[node] = true
+	}
+	return next
+}
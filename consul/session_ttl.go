@@ -2,10 +2,12 @@ package consul
 
 import (
 	"fmt"
+	"hash/fnv"
 	"time"
 
 	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/lib"
 )
 
 const (
@@ -27,7 +29,7 @@ func (s *Server) initializeSessionTimers() error {
 		return err
 	}
 	for _, session := range sessions {
-		if err := s.resetSessionTimer(session.ID, session); err != nil {
+		if _, err := s.resetSessionTimer(session.ID, session); err != nil {
 			return err
 		}
 	}
@@ -36,17 +38,18 @@ func (s *Server) initializeSessionTimers() error {
 
 // resetSessionTimer is used to renew the TTL of a session.
 // This can be used for new sessions and existing ones. A session
-// will be faulted in if not given.
-func (s *Server) resetSessionTimer(id string, session *structs.Session) error {
+// will be faulted in if not given. It returns when the session will
+// expire, or the zero time if it has no TTL.
+func (s *Server) resetSessionTimer(id string, session *structs.Session) (time.Time, error) {
 	// Fault the session in if not given
 	if session == nil {
 		state := s.fsm.State()
 		_, s, err := state.SessionGet(nil, id)
 		if err != nil {
-			return err
+			return time.Time{}, err
 		}
 		if s == nil {
-			return fmt.Errorf("Session '%s' not found", id)
+			return time.Time{}, fmt.Errorf("Session '%s' not found", id)
 		}
 		session = s
 	}
@@ -54,51 +57,72 @@ func (s *Server) resetSessionTimer(id string, session *structs.Session) error {
 	// Bail if the session has no TTL, fast-path some common inputs
 	switch session.TTL {
 	case "", "0", "0s", "0m", "0h":
-		return nil
+		return time.Time{}, nil
 	}
 
 	// Parse the TTL, and skip if zero time
 	ttl, err := time.ParseDuration(session.TTL)
 	if err != nil {
-		return fmt.Errorf("Invalid Session TTL '%s': %v", session.TTL, err)
+		return time.Time{}, fmt.Errorf("Invalid Session TTL '%s': %v", session.TTL, err)
 	}
 	if ttl == 0 {
-		return nil
+		return time.Time{}, nil
 	}
 
 	// Reset the session timer
 	s.sessionTimersLock.Lock()
 	defer s.sessionTimersLock.Unlock()
-	s.resetSessionTimerLocked(id, ttl)
-	return nil
+	return s.resetSessionTimerLocked(id, ttl), nil
 }
 
 // resetSessionTimerLocked is used to reset a session timer
-// assuming the sessionTimerLock is already held
-func (s *Server) resetSessionTimerLocked(id string, ttl time.Duration) {
+// assuming the sessionTimerLock is already held. It returns
+// when the timer will fire.
+func (s *Server) resetSessionTimerLocked(id string, ttl time.Duration) time.Time {
 	// Ensure a timer map exists
 	if s.sessionTimers == nil {
-		s.sessionTimers = make(map[string]*time.Timer)
+		s.sessionTimers = make(map[string]lib.Timer)
 	}
 
 	// Adjust the given TTL by the TTL multiplier. This is done
 	// to give a client a grace period and to compensate for network
 	// and processing delays. The contract is that a session is not expired
 	// before the TTL, but there is no explicit promise about the upper
-	// bound so this is allowable.
-	ttl = ttl * structs.SessionTTLMultiplier
+	// bound so this is allowable. The jitter goes on top of that so
+	// sessions that were created together don't all expire together.
+	jitter := sessionTTLJitter(id, ttl, s.config.SessionTTLJitterPercent)
+	ttl = ttl*structs.SessionTTLMultiplier + jitter
+	expires := s.clock.Now().Add(ttl)
 
 	// Renew the session timer if it exists
 	if timer, ok := s.sessionTimers[id]; ok {
 		timer.Reset(ttl)
-		return
+		return expires
 	}
 
 	// Create a new timer to track expiration of thi ssession
-	timer := time.AfterFunc(ttl, func() {
+	timer := s.clock.AfterFunc(ttl, func() {
 		s.invalidateSession(id)
 	})
 	s.sessionTimers[id] = timer
+	return expires
+}
+
+// sessionTTLJitter returns how much to add to a session's timer, which is
+// up to the given percentage of its TTL. This is derived from a hash of the
+// session ID rather than picked at random, so a new leader arms the timer
+// with the same jitter after a failover.
+func sessionTTLJitter(id string, ttl time.Duration, percent int) time.Duration {
+	if percent <= 0 {
+		return 0
+	}
+	max := uint64(ttl) * uint64(percent) / 100
+	if max == 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return time.Duration(h.Sum64() % max)
 }
 
 // invalidateSession is invoked when a session TTL is reached and we
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/lib"
 	"github.com/hashicorp/consul/testutil"
 	"github.com/hashicorp/net-rpc-msgpackrpc"
 )
@@ -53,7 +54,7 @@ func TestResetSessionTimer_Fault(t *testing.T) {
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
 	// Should not exist
-	err := s1.resetSessionTimer(generateUUID(), nil)
+	_, err := s1.resetSessionTimer(generateUUID(), nil)
 	if err == nil || !strings.Contains(err.Error(), "not found") {
 		t.Fatalf("err: %v", err)
 	}
@@ -73,7 +74,7 @@ func TestResetSessionTimer_Fault(t *testing.T) {
 	}
 
 	// Reset the session timer
-	err = s1.resetSessionTimer(session.ID, nil)
+	_, err = s1.resetSessionTimer(session.ID, nil)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -107,7 +108,7 @@ func TestResetSessionTimer_NoTTL(t *testing.T) {
 	}
 
 	// Reset the session timer
-	err := s1.resetSessionTimer(session.ID, session)
+	_, err := s1.resetSessionTimer(session.ID, session)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -132,14 +133,17 @@ func TestResetSessionTimer_InvalidTTL(t *testing.T) {
 	}
 
 	// Reset the session timer
-	err := s1.resetSessionTimer(session.ID, session)
+	_, err := s1.resetSessionTimer(session.ID, session)
 	if err == nil || !strings.Contains(err.Error(), "Invalid Session TTL") {
 		t.Fatalf("err: %v", err)
 	}
 }
 
 func TestResetSessionTimerLocked(t *testing.T) {
-	dir1, s1 := testServer(t)
+	clock := lib.NewFakeClock(time.Now())
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Clock = clock
+	})
 	defer os.RemoveAll(dir1)
 	defer s1.Shutdown()
 
@@ -153,51 +157,58 @@ func TestResetSessionTimerLocked(t *testing.T) {
 		t.Fatalf("missing timer")
 	}
 
-	time.Sleep(10 * time.Millisecond * structs.SessionTTLMultiplier)
+	clock.Advance(10 * time.Millisecond * structs.SessionTTLMultiplier)
 
-	if _, ok := s1.sessionTimers["foo"]; ok {
+	s1.sessionTimersLock.Lock()
+	_, ok := s1.sessionTimers["foo"]
+	s1.sessionTimersLock.Unlock()
+	if ok {
 		t.Fatalf("timer should be gone")
 	}
 }
 
 func TestResetSessionTimerLocked_Renew(t *testing.T) {
-	dir1, s1 := testServer(t)
+	clock := lib.NewFakeClock(time.Now())
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Clock = clock
+	})
 	defer os.RemoveAll(dir1)
 	defer s1.Shutdown()
 
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
+	hasTimer := func() bool {
+		s1.sessionTimersLock.Lock()
+		defer s1.sessionTimersLock.Unlock()
+		_, ok := s1.sessionTimers["foo"]
+		return ok
+	}
+
 	s1.sessionTimersLock.Lock()
 	s1.resetSessionTimerLocked("foo", 5*time.Millisecond)
 	s1.sessionTimersLock.Unlock()
 
-	if _, ok := s1.sessionTimers["foo"]; !ok {
+	if !hasTimer() {
 		t.Fatalf("missing timer")
 	}
 
-	time.Sleep(5 * time.Millisecond)
+	clock.Advance(5 * time.Millisecond)
 
 	// Renew the session
 	s1.sessionTimersLock.Lock()
-	renew := time.Now()
 	s1.resetSessionTimerLocked("foo", 5*time.Millisecond)
 	s1.sessionTimersLock.Unlock()
 
-	// Watch for invalidation
-	for time.Now().Sub(renew) < 20*time.Millisecond {
-		s1.sessionTimersLock.Lock()
-		_, ok := s1.sessionTimers["foo"]
-		s1.sessionTimersLock.Unlock()
-		if !ok {
-			end := time.Now()
-			if end.Sub(renew) < 5*time.Millisecond {
-				t.Fatalf("early invalidate")
-			}
-			return
-		}
-		time.Sleep(time.Millisecond)
+	// The renewal should push out the deadline by the full TTL.
+	ttl := 5 * time.Millisecond * structs.SessionTTLMultiplier
+	clock.Advance(ttl - time.Nanosecond)
+	if !hasTimer() {
+		t.Fatalf("early invalidate")
+	}
+	clock.Advance(time.Nanosecond)
+	if hasTimer() {
+		t.Fatalf("should have expired")
 	}
-	t.Fatalf("should have expired")
 }
 
 func TestInvalidateSession(t *testing.T) {
@@ -384,3 +395,138 @@ func TestServer_SessionTTL_Failover(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSessionTTLJitter(t *testing.T) {
+	ttl := 10 * time.Second
+	if j := sessionTTLJitter("foo", ttl, 0); j != 0 {
+		t.Fatalf("bad: %v", j)
+	}
+
+	// The jitter is stable for a given ID, and stays within the window.
+	for i := 0; i < 100; i++ {
+		id := generateUUID()
+		j := sessionTTLJitter(id, ttl, 20)
+		if j < 0 || j >= 2*time.Second {
+			t.Fatalf("bad: %v", j)
+		}
+		if again := sessionTTLJitter(id, ttl, 20); again != j {
+			t.Fatalf("bad: %v != %v", again, j)
+		}
+	}
+}
+
+func TestServer_SessionTTLJitter(t *testing.T) {
+	clock := lib.NewFakeClock(time.Now())
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Clock = clock
+		c.SessionTTLJitterPercent = 50
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	node := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+	}
+	var out struct{}
+	if err := s1.RPC("Catalog.Register", &node, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Create a bunch of sessions with the same TTL all at once. They
+	// should all be set to expire after twice the TTL, spread out over the
+	// next half of the TTL.
+	const numSessions = 100
+	ttl := 10 * time.Second
+	start := clock.Now()
+	earliest := start.Add(ttl * structs.SessionTTLMultiplier)
+	latest := earliest.Add(ttl / 2)
+	arg := structs.SessionRequest{
+		Datacenter: "dc1",
+		Op:         structs.SessionCreate,
+		Session: structs.Session{
+			Node: "foo",
+			TTL:  ttl.String(),
+		},
+	}
+	expires := make(map[string]time.Time)
+	buckets := make([]int, 5)
+	for i := 0; i < numSessions; i++ {
+		var reply structs.SessionCreateReply
+		if err := msgpackrpc.CallWithCodec(codec, "Session.Create", &arg, &reply); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if reply.ExpiresAt.Before(earliest) || !reply.ExpiresAt.Before(latest) {
+			t.Fatalf("bad: %v not in [%v, %v)", reply.ExpiresAt, earliest, latest)
+		}
+		expires[reply.ID] = reply.ExpiresAt
+		buckets[reply.ExpiresAt.Sub(earliest)*5/(ttl/2)]++
+	}
+	for i, n := range buckets {
+		if n == 0 {
+			t.Fatalf("nothing expires in bucket %d: %v", i, buckets)
+		}
+	}
+
+	// Rebuild the timers the way a new leader would. Renewing a session
+	// should give the same expiry, since the clock hasn't moved.
+	if err := s1.clearAllSessionTimers(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.initializeSessionTimers(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for id, expiresAt := range expires {
+		renew := structs.SessionSpecificRequest{
+			Datacenter: "dc1",
+			Session:    id,
+		}
+		var reply structs.IndexedSessions
+		if err := msgpackrpc.CallWithCodec(codec, "Session.Renew", &renew, &reply); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !reply.ExpiresAt.Equal(expiresAt) {
+			t.Fatalf("bad: %v != %v", reply.ExpiresAt, expiresAt)
+		}
+		break
+	}
+
+	// Nothing should expire before twice the TTL, and the sessions should
+	// then trickle out over the jitter window.
+	remaining := func() int {
+		_, sessions, err := s1.fsm.State().SessionList(nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return len(sessions)
+	}
+	clock.Advance(earliest.Sub(start) - time.Millisecond)
+	if n := remaining(); n != numSessions {
+		t.Fatalf("bad: %d", n)
+	}
+	clock.Advance(ttl/4 + time.Millisecond)
+	if err := testutil.WaitForResult(func() (bool, error) {
+		var want int
+		for _, expiresAt := range expires {
+			if clock.Now().Before(expiresAt) {
+				want++
+			}
+		}
+		n := remaining()
+		return n == want && n > 0 && n < numSessions, fmt.Errorf("bad: %d != %d", n, want)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(ttl / 4)
+	if err := testutil.WaitForResult(func() (bool, error) {
+		n := remaining()
+		return n == 0, fmt.Errorf("bad: %d", n)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
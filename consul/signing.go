@@ -0,0 +1,66 @@
+package consul
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/state"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// initializeSigningKey makes the first signing key if there isn't one yet.
+// This is only done by the leader.
+func (s *Server) initializeSigningKey() error {
+	key, err := s.fsm.State().SigningKeyActive()
+	if err != nil {
+		return fmt.Errorf("failed to get signing key: %v", err)
+	}
+	if key != nil {
+		return nil
+	}
+
+	if _, err := s.rotateSigningKey(); err != nil {
+		return fmt.Errorf("failed to initialize signing key: %v", err)
+	}
+	return nil
+}
+
+// rotateSigningKey generates a new signing key and makes it the active one.
+// The old key is kept for verifying results it already signed.
+func (s *Server) rotateSigningKey() (*structs.SigningKey, error) {
+	key, err := structs.GenerateSigningKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// Older servers don't know about signing keys, and don't need to, so
+	// let them skip this.
+	req := structs.SigningKeyRequest{
+		Datacenter: s.config.Datacenter,
+		Key:        *key,
+	}
+	t := structs.SigningKeyRequestType | structs.IgnoreUnknownTypeFlag
+	resp, err := s.raftApply(t, &req)
+	if err != nil {
+		return nil, err
+	}
+	if respErr, ok := resp.(error); ok {
+		return nil, respErr
+	}
+
+	key.Active = true
+	s.logger.Printf("[INFO] consul: Rotated signing key, new key is %q", key.ID)
+	return key, nil
+}
+
+// signResult signs a query result with the active signing key in the given
+// state store, which should be the one the result came from.
+func signResult(state *state.StateStore, index uint64, result interface{}) (*structs.ResultSignature, error) {
+	key, err := state.SigningKeyActive()
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, structs.ErrNoSigningKey
+	}
+	return structs.SignResult(key, index, result)
+}
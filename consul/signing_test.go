@@ -0,0 +1,187 @@
+package consul
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestSigning_ServiceNodes(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// The leader should have made a key.
+	var keys structs.IndexedSigningPublicKeys
+	getKeys := func() {
+		arg := structs.DCSpecificRequest{Datacenter: "dc1"}
+		if err := msgpackrpc.CallWithCodec(codec, "Operator.SigningKeys", &arg, &keys); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	getKeys()
+	if len(keys.Keys) != 1 || !keys.Keys[0].Active || len(keys.Keys[0].PublicKey) == 0 {
+		t.Fatalf("bad: %#v", keys)
+	}
+
+	for _, node := range []string{"foo", "bar"} {
+		arg := structs.RegisterRequest{
+			Datacenter:      "dc1",
+			Node:            node,
+			Address:         "127.0.0.1",
+			TaggedAddresses: map[string]string{"wan": "10.0.0.1", "lan": "127.0.0.1"},
+			NodeMeta:        map[string]string{"rack": "a", "zone": "b"},
+			Service: &structs.NodeService{
+				Service: "db",
+				Tags:    []string{"master", "v1"},
+				Port:    5432,
+				Meta:    map[string]string{"version": "9.6", "engine": "pg"},
+			},
+			Check: &structs.HealthCheck{
+				Name:      "db connect",
+				Status:    structs.HealthPassing,
+				ServiceID: "db",
+			},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	req := structs.ServiceSpecificRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+	}
+
+	// Results aren't signed unless asked for.
+	var health structs.IndexedCheckServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &health); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if health.Signature != nil {
+		t.Fatalf("bad: %#v", health.Signature)
+	}
+
+	// Fetch signed results and verify them with the published key.
+	req.Signed = true
+	health = structs.IndexedCheckServiceNodes{}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &health); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(health.Nodes) != 2 || health.Signature == nil || health.Signature.KeyID != keys.Keys[0].ID {
+		t.Fatalf("bad: %#v", health)
+	}
+	if err := health.Verify(keys.Keys); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var catalog structs.IndexedServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &req, &catalog); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := catalog.Verify(keys.Keys); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Tampering with any part of the result should be caught.
+	health.Nodes[1].Service.Port = 5433
+	if err := health.Verify(keys.Keys); err != structs.ErrBadSignature {
+		t.Fatalf("err: %v", err)
+	}
+	health.Nodes[1].Service.Port = 5432
+	health.Index++
+	if err := health.Verify(keys.Keys); err != structs.ErrBadSignature {
+		t.Fatalf("err: %v", err)
+	}
+	health.Index--
+	catalog.ServiceNodes[0].NodeMeta["rack"] = "z"
+	if err := catalog.Verify(keys.Keys); err != structs.ErrBadSignature {
+		t.Fatalf("err: %v", err)
+	}
+	catalog.ServiceNodes[0].NodeMeta["rack"] = "a"
+
+	// Rotate the key. Results signed with the old key should still verify
+	// against the published keys, and new results should use the new key.
+	rotate := structs.SigningKeyRequest{Datacenter: "dc1"}
+	var rotated structs.SigningPublicKey
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.SigningKeyRotate", &rotate, &rotated); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !rotated.Active || rotated.ID == keys.Keys[0].ID {
+		t.Fatalf("bad: %#v", rotated)
+	}
+	getKeys()
+	if len(keys.Keys) != 2 {
+		t.Fatalf("bad: %#v", keys)
+	}
+	if err := health.Verify(keys.Keys); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	catalog = structs.IndexedServiceNodes{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &req, &catalog); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if catalog.Signature.KeyID != rotated.ID {
+		t.Fatalf("bad: %#v", catalog.Signature)
+	}
+	if err := catalog.Verify(keys.Keys); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Once the old key has been rotated out, its results can't be
+	// verified.
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.SigningKeyRotate", &rotate, &rotated); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	getKeys()
+	err := health.Verify(keys.Keys)
+	if err == nil || !strings.Contains(err.Error(), "Unknown signing key") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSigning_KeyRotate_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Make a request with no token to make sure it gets denied.
+	arg := structs.SigningKeyRequest{Datacenter: "dc1"}
+	var reply structs.SigningPublicKey
+	err := msgpackrpc.CallWithCodec(codec, "Operator.SigningKeyRotate", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// It should go through with the master token.
+	arg.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.SigningKeyRotate", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The public keys can be read without a token.
+	var keys structs.IndexedSigningPublicKeys
+	req := structs.DCSpecificRequest{Datacenter: "dc1"}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.SigningKeys", &req, &keys); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(keys.Keys) != 2 || keys.Keys[0].ID == "" {
+		t.Fatalf("bad: %#v", keys)
+	}
+}
@@ -0,0 +1,160 @@
+package consul
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// As a snapshot is restored, the stream is split into fixed-size chunks, each
+// named by the SHA-256 hash of its contents, and kept in a chunk store until
+// the restore completes. If the restore fails partway through, the chunks
+// already stored are kept, and a retried restore of the same snapshot only
+// has to write the ones it's missing. The snapshot format itself isn't
+// touched, so snapshots are still readable by older servers, and snapshots
+// written by older servers can be restored the same way.
+
+// snapshotChunkSize is the size of each chunk, apart from the last one in a
+// snapshot, which may be shorter.
+var snapshotChunkSize = 1024 * 1024
+
+// snapshotChunkHash returns the name a chunk is stored under.
+func snapshotChunkHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// snapshotChunkStore holds on to the chunks of a snapshot that's being
+// restored, so a retried restore knows which ones it already has.
+type snapshotChunkStore interface {
+	// HasChunk returns true if the chunk with the given hash is already in
+	// the store.
+	HasChunk(hash string) bool
+
+	// WriteChunk adds a chunk to the store.
+	WriteChunk(hash string, data []byte) error
+
+	// Reset removes all the chunks from the store. This is called once a
+	// snapshot has been restored, since the chunks aren't needed any more.
+	Reset() error
+}
+
+// dirChunkStore is a snapshotChunkStore that keeps each chunk in a file in a
+// directory, named by its hash.
+type dirChunkStore struct {
+	dir string
+}
+
+// newDirChunkStore returns a chunk store that keeps its chunks in the given
+// directory, creating it if needed.
+func newDirChunkStore(dir string) (*dirChunkStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot chunk dir: %v", err)
+	}
+	return &dirChunkStore{dir}, nil
+}
+
+// HasChunk checks for the chunk's file, and that its contents still match
+// the hash.
+func (s *dirChunkStore) HasChunk(hash string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, hash))
+	if err != nil {
+		return false
+	}
+	return snapshotChunkHash(data) == hash
+}
+
+// WriteChunk writes the chunk to a temporary file and then moves it into
+// place, so a partially written chunk is never mistaken for a good one.
+func (s *dirChunkStore) WriteChunk(hash string, data []byte) error {
+	path := filepath.Join(s.dir, hash)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Reset removes all the chunk files.
+func (s *dirChunkStore) Reset() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.Remove(filepath.Join(s.dir, file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotChunkReader passes a snapshot stream through unchanged, splitting
+// it into chunks as it goes and handing any the store doesn't already have
+// to it. The last chunk is only stored once the stream hits EOF, and any
+// error storing it is returned in place of the EOF.
+type snapshotChunkReader struct {
+	r       io.Reader
+	store   snapshotChunkStore
+	buf     []byte
+	hashes  []string
+	written int
+}
+
+// newSnapshotChunkReader returns a reader for the snapshot in r that stores
+// its chunks in the given store.
+func newSnapshotChunkReader(r io.Reader, store snapshotChunkStore) *snapshotChunkReader {
+	return &snapshotChunkReader{
+		r:     r,
+		store: store,
+		buf:   make([]byte, 0, snapshotChunkSize),
+	}
+}
+
+// Read reads from the underlying snapshot, storing chunks as they fill up.
+func (c *snapshotChunkReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	for data := p[:n]; len(data) > 0; {
+		m := snapshotChunkSize - len(c.buf)
+		if m > len(data) {
+			m = len(data)
+		}
+		c.buf = append(c.buf, data[:m]...)
+		data = data[m:]
+
+		if len(c.buf) == snapshotChunkSize {
+			if err := c.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err == io.EOF {
+		if err := c.flush(); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// flush stores whatever is buffered as a chunk, unless the store already
+// has it.
+func (c *snapshotChunkReader) flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+
+	hash := snapshotChunkHash(c.buf)
+	if !c.store.HasChunk(hash) {
+		if err := c.store.WriteChunk(hash, c.buf); err != nil {
+			return fmt.Errorf("failed to store snapshot chunk: %v", err)
+		}
+		c.written++
+	}
+	c.hashes = append(c.hashes, hash)
+	c.buf = c.buf[:0]
+	return nil
+}
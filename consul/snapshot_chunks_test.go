@@ -0,0 +1,145 @@
+package consul
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// testChunkStore wraps a chunk store so tests can see what gets written, and
+// make writes fail after a given number of them.
+type testChunkStore struct {
+	snapshotChunkStore
+	failAfter int
+	written   []string
+}
+
+func (s *testChunkStore) WriteChunk(hash string, data []byte) error {
+	if s.failAfter >= 0 && len(s.written) >= s.failAfter {
+		return fmt.Errorf("disk full")
+	}
+	s.written = append(s.written, hash)
+	return s.snapshotChunkStore.WriteChunk(hash, data)
+}
+
+func TestFSM_SnapshotRestore_ChunksResume(t *testing.T) {
+	old := snapshotChunkSize
+	snapshotChunkSize = 256
+	defer func() { snapshotChunkSize = old }()
+
+	// Set up an FSM with enough in it to span a bunch of chunks.
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		entry := &structs.DirEntry{
+			Key:   fmt.Sprintf("key%d", i),
+			Value: []byte(strings.Repeat("x", i)),
+		}
+		if err := fsm.state.KVSSet(uint64(i+1), entry); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+	buf := bytes.NewBuffer(nil)
+	sink := &MockSink{buf, false}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data := buf.Bytes()
+	chunks := (len(data) + snapshotChunkSize - 1) / snapshotChunkSize
+	if chunks < 5 {
+		t.Fatalf("bad: %d", chunks)
+	}
+
+	dir, err := ioutil.TempDir("", "consul")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := newDirChunkStore(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	fsm2, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fsm2.state.KVSSet(1, &structs.DirEntry{Key: "before"})
+
+	// Interrupt the restore partway through.
+	failing := &testChunkStore{store, 3, nil}
+	fsm2.chunks = failing
+	err = fsm2.Restore(&MockSink{bytes.NewBuffer(data), false})
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("err: %v", err)
+	}
+	if len(failing.written) != 3 {
+		t.Fatalf("bad: %v", failing.written)
+	}
+
+	// The old state should still be in place.
+	_, d, err := fsm2.state.KVSGet(nil, "before")
+	if err != nil || d == nil {
+		t.Fatalf("bad: %v %v", d, err)
+	}
+
+	// Retry, and make sure only the chunks we didn't get before are
+	// written.
+	retry := &testChunkStore{store, -1, nil}
+	fsm2.chunks = retry
+	if err := fsm2.Restore(&MockSink{bytes.NewBuffer(data), false}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(retry.written) != chunks-3 {
+		t.Fatalf("bad: %d", len(retry.written))
+	}
+	for _, hash := range retry.written {
+		for _, written := range failing.written {
+			if hash == written {
+				t.Fatalf("chunk %s written twice", hash)
+			}
+		}
+	}
+
+	// Make sure everything came through.
+	_, entries, err := fsm2.state.KVSList(nil, "key")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 50 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	for _, entry := range entries {
+		var i int
+		if _, err := fmt.Sscanf(entry.Key, "key%d", &i); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(entry.Value) != strings.Repeat("x", i) {
+			t.Fatalf("bad: %#v", entry)
+		}
+	}
+	if _, d, err := fsm2.state.KVSGet(nil, "before"); err != nil || d != nil {
+		t.Fatalf("bad: %v %v", d, err)
+	}
+
+	// The chunks should have been cleaned up.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("bad: %v", files)
+	}
+}
@@ -28,7 +28,9 @@ import (
 func (s *Server) dispatchSnapshotRequest(args *structs.SnapshotRequest, in io.Reader,
 	reply *structs.SnapshotResponse) (io.ReadCloser, error) {
 
-	// Perform DC forwarding.
+	// Perform DC forwarding, sending along the canonical name if the
+	// request used an alias.
+	args.Datacenter = s.router.ResolveDatacenter(args.Datacenter)
 	if dc := args.Datacenter; dc != s.config.Datacenter {
 		manager, server, ok := s.router.FindRoute(dc)
 		if !ok {
@@ -48,7 +50,7 @@ func (s *Server) dispatchSnapshotRequest(args *structs.SnapshotRequest, in io.Re
 	if !args.AllowStale {
 		if isLeader, server := s.getLeader(); !isLeader {
 			if server == nil {
-				return nil, structs.ErrNoLeader
+				return nil, s.leaderHint()
 			}
 			return SnapshotRPC(s.connPool, args.Datacenter, server.Addr, args, in, reply)
 		}
@@ -57,7 +59,7 @@ func (s *Server) dispatchSnapshotRequest(args *structs.SnapshotRequest, in io.Re
 	// Verify token is allowed to operate on snapshots. There's only a
 	// single ACL sense here (not read and write) since reading gets you
 	// all the ACLs and you could escalate from there.
-	if acl, err := s.resolveToken(args.Token); err != nil {
+	if acl, err := s.resolveToken("Snapshot", args.Token); err != nil {
 		return nil, err
 	} else if acl != nil && !acl.Snapshot() {
 		return nil, permissionDeniedErr
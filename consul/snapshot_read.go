@@ -0,0 +1,197 @@
+package consul
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/consul/state"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/raft"
+)
+
+// Postmortems often need to know what a key was at some point in the past.
+// Servers already keep a few Raft snapshots around, so old data can be read by
+// restoring one of them into a scratch state store that nothing else can see.
+// The live state is never touched. Restoring a snapshot isn't cheap, and a
+// postmortem tends to read several keys from the same one, so restored
+// snapshots are kept for a little while.
+
+const (
+	// snapshotReadCacheTTL is how long a restored snapshot is kept after it
+	// was last read.
+	snapshotReadCacheTTL = time.Minute
+
+	// snapshotReadCacheSize is how many restored snapshots are kept at once.
+	// Each one holds a full copy of the state store, so this is kept small.
+	snapshotReadCacheSize = 2
+)
+
+// snapshotReader reads data from the snapshots in a Raft snapshot store.
+type snapshotReader struct {
+	store     raft.SnapshotStore
+	logOutput io.Writer
+	logger    *log.Logger
+
+	// restoreLock makes sure only one snapshot is restored at a time, which
+	// bounds the memory used for restores.
+	restoreLock sync.Mutex
+
+	// cache holds the restored snapshots, by ID.
+	cache     map[string]*restoredSnapshot
+	cacheLock sync.Mutex
+}
+
+// restoredSnapshot is a snapshot that's been restored for reading.
+type restoredSnapshot struct {
+	info  structs.RaftSnapshotInfo
+	state *state.StateStore
+	timer *time.Timer
+
+	// lastUsed is when the snapshot was last read.
+	lastUsed time.Time
+}
+
+// newSnapshotReader returns a reader for the snapshots in the given store.
+func newSnapshotReader(store raft.SnapshotStore, logOutput io.Writer) *snapshotReader {
+	return &snapshotReader{
+		store:     store,
+		logOutput: logOutput,
+		logger:    log.New(logOutput, "", log.LstdFlags),
+		cache:     make(map[string]*restoredSnapshot),
+	}
+}
+
+// List returns the retained snapshots, newest first.
+func (r *snapshotReader) List() ([]structs.RaftSnapshotInfo, error) {
+	metas, err := r.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]structs.RaftSnapshotInfo, 0, len(metas))
+	for _, meta := range metas {
+		snapshots = append(snapshots, snapshotInfo(meta))
+	}
+	return snapshots, nil
+}
+
+// State returns a state store with the contents of the given snapshot. The
+// state store must only be read from.
+func (r *snapshotReader) State(id string) (*structs.RaftSnapshotInfo, *state.StateStore, error) {
+	if snap, ok := r.cached(id); ok {
+		return &snap.info, snap.state, nil
+	}
+
+	r.restoreLock.Lock()
+	defer r.restoreLock.Unlock()
+
+	// It might have been restored while we were waiting.
+	if snap, ok := r.cached(id); ok {
+		return &snap.info, snap.state, nil
+	}
+
+	snapshots, err := r.store.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	found := false
+	for _, meta := range snapshots {
+		if meta.ID == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, nil, fmt.Errorf("Unknown snapshot %q", id)
+	}
+
+	start := time.Now()
+	meta, source, err := r.store.Open(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	fsm, err := NewFSM(nil, r.logOutput)
+	if err != nil {
+		source.Close()
+		return nil, nil, err
+	}
+	if err := fsm.Restore(source); err != nil {
+		return nil, nil, fmt.Errorf("failed to restore snapshot %q: %v", id, err)
+	}
+	r.logger.Printf("[DEBUG] consul: Restored snapshot %s for reading in %v", id, time.Since(start))
+
+	snap := &restoredSnapshot{
+		info:  snapshotInfo(meta),
+		state: fsm.State(),
+	}
+	r.add(snap)
+	return &snap.info, snap.state, nil
+}
+
+// cached returns a restored snapshot from the cache, and keeps it around a
+// while longer.
+func (r *snapshotReader) cached(id string) (*restoredSnapshot, bool) {
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+
+	snap, ok := r.cache[id]
+	if ok {
+		snap.timer.Reset(snapshotReadCacheTTL)
+		snap.lastUsed = time.Now()
+	}
+	return snap, ok
+}
+
+// add puts a restored snapshot in the cache, making room for it by dropping
+// the ones that were read longest ago.
+func (r *snapshotReader) add(snap *restoredSnapshot) {
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+
+	for len(r.cache) >= snapshotReadCacheSize {
+		var oldest *restoredSnapshot
+		for _, other := range r.cache {
+			if oldest == nil || other.lastUsed.Before(oldest.lastUsed) {
+				oldest = other
+			}
+		}
+		oldest.timer.Stop()
+		delete(r.cache, oldest.info.ID)
+	}
+
+	snap.lastUsed = time.Now()
+
+	id := snap.info.ID
+	snap.timer = time.AfterFunc(snapshotReadCacheTTL, func() {
+		r.cacheLock.Lock()
+		defer r.cacheLock.Unlock()
+		if r.cache[id] == snap {
+			delete(r.cache, id)
+		}
+	})
+	r.cache[id] = snap
+}
+
+// snapshotInfo returns the details of a snapshot. The snapshot stores don't
+// record when a snapshot was taken, but both of them put the time in the ID,
+// as term-index-milliseconds.
+func snapshotInfo(meta *raft.SnapshotMeta) structs.RaftSnapshotInfo {
+	info := structs.RaftSnapshotInfo{
+		ID:    meta.ID,
+		Index: meta.Index,
+		Term:  meta.Term,
+		Size:  meta.Size,
+	}
+	parts := strings.Split(meta.ID, "-")
+	if len(parts) == 3 {
+		if msec, err := strconv.ParseInt(parts[2], 10, 64); err == nil {
+			info.Time = time.Unix(0, msec*int64(time.Millisecond))
+		}
+	}
+	return info
+}
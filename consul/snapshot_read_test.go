@@ -0,0 +1,98 @@
+package consul
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/raft"
+)
+
+func TestSnapshotReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := raft.NewFileSnapshotStore(dir, 3, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Take a few snapshots, with a different value for the key in each.
+	fsm, err := NewFSM(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		ent := &structs.DirEntry{Key: "foo", Value: []byte{byte(i)}}
+		if err := fsm.state.KVSSet(i, ent); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		sink, err := store.Create(1, i, 1, raft.Configuration{}, 0, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		snap, err := fsm.Snapshot()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := snap.Persist(sink); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		snap.Release()
+	}
+
+	r := newSnapshotReader(store, os.Stderr)
+	snapshots, err := r.List()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(snapshots) != 3 || snapshots[0].Index != 3 || snapshots[0].Time.IsZero() {
+		t.Fatalf("bad: %#v", snapshots)
+	}
+
+	// Each snapshot should have its own value.
+	for _, info := range snapshots {
+		restored, state, err := r.State(info.ID)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if restored.Index != info.Index {
+			t.Fatalf("bad: %#v", restored)
+		}
+		_, ent, err := state.KVSGet(nil, "foo")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if ent == nil || ent.Value[0] != byte(info.Index) {
+			t.Fatalf("bad: %#v", ent)
+		}
+	}
+
+	// Only so many are kept, and the one read longest ago goes first.
+	if len(r.cache) != snapshotReadCacheSize {
+		t.Fatalf("bad: %d", len(r.cache))
+	}
+	if _, ok := r.cache[snapshots[0].ID]; ok {
+		t.Fatalf("should have been dropped")
+	}
+
+	// A cached snapshot should be handed back as is.
+	_, first, err := r.State(snapshots[1].ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, second, err := r.State(snapshots[1].ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if first != second {
+		t.Fatalf("should be cached")
+	}
+}
@@ -2,6 +2,7 @@ package state
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/go-memdb"
@@ -57,13 +58,18 @@ func (s *StateStore) aclSetTxn(tx *memdb.Txn, idx uint64, acl *structs.ACL) erro
 		return fmt.Errorf("failed acl lookup: %s", err)
 	}
 
-	// Set the indexes
+	// Set the indexes, and carry over the usage since that's only
+	// maintained by ACLUsageUpdate.
 	if existing != nil {
 		acl.CreateIndex = existing.(*structs.ACL).CreateIndex
 		acl.ModifyIndex = idx
+		acl.LastUsed = existing.(*structs.ACL).LastUsed
+		acl.Uses = existing.(*structs.ACL).Uses
 	} else {
 		acl.CreateIndex = idx
 		acl.ModifyIndex = idx
+		acl.LastUsed = time.Time{}
+		acl.Uses = 0
 	}
 
 	// Insert the ACL
@@ -77,6 +83,38 @@ func (s *StateStore) aclSetTxn(tx *memdb.Txn, idx uint64, acl *structs.ACL) erro
 	return nil
 }
 
+// ACLUsageUpdate adds the given usage to the totals for each ACL. Usage for
+// ACLs that don't exist is ignored. This doesn't change the modify index of
+// the ACLs, since the usage isn't part of the definition of the ACL and we
+// don't want it to trigger replication.
+func (s *StateStore) ACLUsageUpdate(idx uint64, usage structs.ACLUsages) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	for _, u := range usage {
+		existing, err := tx.First("acls", "id", u.ID)
+		if err != nil {
+			return fmt.Errorf("failed acl lookup: %s", err)
+		}
+		if existing == nil {
+			continue
+		}
+
+		// Make a copy so we don't modify the ACL in place.
+		acl := *existing.(*structs.ACL)
+		if u.LastUsed.After(acl.LastUsed) {
+			acl.LastUsed = u.LastUsed
+		}
+		acl.Uses += u.Uses
+		if err := tx.Insert("acls", &acl); err != nil {
+			return fmt.Errorf("failed inserting acl: %s", err)
+		}
+	}
+
+	tx.Commit()
+	return nil
+}
+
 // ACLGet is used to look up an existing ACL by ID.
 func (s *StateStore) ACLGet(ws memdb.WatchSet, aclID string) (uint64, *structs.ACL, error) {
 	tx := s.db.Txn(false)
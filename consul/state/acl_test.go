@@ -3,6 +3,7 @@ package state
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/go-memdb"
@@ -204,6 +205,62 @@ func TestStateStore_ACLDelete(t *testing.T) {
 	}
 }
 
+func TestStateStore_ACLUsageUpdate(t *testing.T) {
+	s := testStateStore(t)
+
+	// Create an ACL.
+	if err := s.ACLSet(1, &structs.ACL{ID: "acl1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Apply some usage, including for an ACL that doesn't exist.
+	used := time.Date(2017, 3, 1, 12, 30, 0, 0, time.UTC)
+	ws := memdb.NewWatchSet()
+	if _, _, err := s.ACLGet(ws, "acl1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.ACLUsageUpdate(2, structs.ACLUsages{
+		&structs.ACLUsage{ID: "acl1", LastUsed: used, Uses: 2},
+		&structs.ACLUsage{ID: "nope", LastUsed: used, Uses: 1},
+	}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	// Older usage should only bump the count.
+	if err := s.ACLUsageUpdate(3, structs.ACLUsages{
+		&structs.ACLUsage{ID: "acl1", LastUsed: used.Add(-time.Hour), Uses: 1},
+	}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, acl, err := s.ACLGet(nil, "acl1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 1 || acl.ModifyIndex != 1 {
+		t.Fatalf("usage shouldn't change the index: %d, %v", idx, acl)
+	}
+	if acl.Uses != 3 || !acl.LastUsed.Equal(used) {
+		t.Fatalf("bad: %v", acl)
+	}
+	if _, acl, err := s.ACLGet(nil, "nope"); err != nil || acl != nil {
+		t.Fatalf("bad: %v, %v", acl, err)
+	}
+
+	// Setting the ACL should preserve the usage.
+	if err := s.ACLSet(4, &structs.ACL{ID: "acl1", Name: "updated", Uses: 100}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, acl, err = s.ACLGet(nil, "acl1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if acl.Name != "updated" || acl.Uses != 3 || !acl.LastUsed.Equal(used) {
+		t.Fatalf("bad: %v", acl)
+	}
+}
+
 func TestStateStore_ACL_Snapshot_Restore(t *testing.T) {
 	s := testStateStore(t)
 
@@ -2,6 +2,7 @@ package state
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/hashicorp/consul/consul/structs"
@@ -72,6 +73,13 @@ func (s *StateStore) EnsureRegistration(idx uint64, req *structs.RegisterRequest
 	tx := s.db.Txn(true)
 	defer tx.Abort()
 
+	// Service constraints only apply to new registrations, so this isn't
+	// part of ensureRegistrationTxn, which restores use as well.
+	if req.Service != nil {
+		if err := s.serviceConstraintTxn(tx, req.Node, req.Service); err != nil {
+			return err
+		}
+	}
 	if err := s.ensureRegistrationTxn(tx, idx, req); err != nil {
 		return err
 	}
@@ -80,6 +88,74 @@ func (s *StateStore) EnsureRegistration(idx uint64, req *structs.RegisterRequest
 	return nil
 }
 
+// RegistrationUnchanged returns true if applying the given registration
+// would leave the node, service, and checks exactly as they are now. This is
+// conservative, so anything it can't be sure of counts as a change.
+func (s *StateStore) RegistrationUnchanged(req *structs.RegisterRequest) (bool, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	node, err := tx.First("nodes", "id", req.Node)
+	if err != nil {
+		return false, fmt.Errorf("node lookup failed: %s", err)
+	}
+	if node == nil || req.ChangesNode(node.(*structs.Node)) {
+		return false, nil
+	}
+
+	if req.Service != nil {
+		if req.Replace {
+			return false, nil
+		}
+		existing, err := tx.First("services", "id", req.Node, req.Service.ID)
+		if err != nil {
+			return false, fmt.Errorf("failed service lookup: %s", err)
+		}
+		if existing == nil || !(existing.(*structs.ServiceNode).ToNodeService()).IsSame(req.Service) {
+			return false, nil
+		}
+	}
+
+	checks := req.Checks
+	if req.Check != nil {
+		checks = append(structs.HealthChecks{req.Check}, checks...)
+	}
+	for _, check := range checks {
+		if check.Node != req.Node {
+			return false, nil
+		}
+		existing, err := tx.First("checks", "id", check.Node, string(check.CheckID))
+		if err != nil {
+			return false, fmt.Errorf("failed health check lookup: %s", err)
+		}
+		if existing == nil {
+			return false, nil
+		}
+
+		// Fill in the check the same way ensureCheckTxn would before
+		// comparing it.
+		hc := check.Clone()
+		if hc.Status == "" {
+			hc.Status = structs.HealthCritical
+		}
+		if hc.ServiceID != "" {
+			service, err := tx.First("services", "id", hc.Node, hc.ServiceID)
+			if err != nil {
+				return false, fmt.Errorf("failed service lookup: %s", err)
+			}
+			if service == nil {
+				return false, nil
+			}
+			hc.ServiceName = service.(*structs.ServiceNode).ServiceName
+		}
+		if !existing.(*structs.HealthCheck).IsSame(hc) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
 // ensureRegistrationTxn is used to make sure a node, service, and check
 // registration is performed within a single transaction to avoid race
 // conditions on state updates.
@@ -113,11 +189,19 @@ func (s *StateStore) ensureRegistrationTxn(tx *memdb.Txn, idx uint64, req *struc
 	// Add the service, if any. We perform a similar check as we do for the
 	// node info above to make sure we actually need to update the service
 	// definition in order to prevent useless churn if nothing has changed.
+	// A replace always takes out the old instance, even if it looks the
+	// same, so that it starts over with a fresh set of checks.
 	if req.Service != nil {
 		existing, err := tx.First("services", "id", req.Node, req.Service.ID)
 		if err != nil {
 			return fmt.Errorf("failed service lookup: %s", err)
 		}
+		if existing != nil && req.Replace {
+			if err := s.deleteServiceTxn(tx, idx, req.Node, req.Service.ID); err != nil {
+				return fmt.Errorf("failed replacing service: %s", err)
+			}
+			existing = nil
+		}
 		if existing == nil || !(existing.(*structs.ServiceNode).ToNodeService()).IsSame(req.Service) {
 			if err := s.ensureServiceTxn(tx, idx, req.Node, req.Service); err != nil {
 				return fmt.Errorf("failed inserting service: %s", err)
@@ -184,6 +268,7 @@ func (s *StateStore) ensureNodeTxn(tx *memdb.Txn, idx uint64, node *structs.Node
 	if err := tx.Insert("nodes", node); err != nil {
 		return fmt.Errorf("failed inserting node: %s", err)
 	}
+	s.sizes.insertTxn(tx, "nodes", existing, node)
 	if err := tx.Insert("index", &IndexEntry{"nodes", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
@@ -237,10 +322,19 @@ func (s *StateStore) Nodes(ws memdb.WatchSet) (uint64, structs.Nodes, error) {
 	// Get the table index.
 	idx := maxIndexTxn(tx, "nodes")
 
+	nodes, err := s.nodesTxn(tx, ws)
+	if err != nil {
+		return 0, nil, err
+	}
+	return idx, nodes, nil
+}
+
+// nodesTxn returns all the nodes, using the given transaction.
+func (s *StateStore) nodesTxn(tx *memdb.Txn, ws memdb.WatchSet) (structs.Nodes, error) {
 	// Retrieve all of the nodes
 	nodes, err := tx.Get("nodes", "id")
 	if err != nil {
-		return 0, nil, fmt.Errorf("failed nodes lookup: %s", err)
+		return nil, fmt.Errorf("failed nodes lookup: %s", err)
 	}
 	ws.Add(nodes.WatchCh())
 
@@ -249,7 +343,7 @@ func (s *StateStore) Nodes(ws memdb.WatchSet) (uint64, structs.Nodes, error) {
 	for node := nodes.Next(); node != nil; node = nodes.Next() {
 		results = append(results, node.(*structs.Node))
 	}
-	return idx, results, nil
+	return results, nil
 }
 
 // NodesByMeta is used to return all nodes with the given metadata key/value pairs.
@@ -297,6 +391,41 @@ func (s *StateStore) DeleteNode(idx uint64, nodeName string) error {
 	return nil
 }
 
+// DeleteNodesUnlessAlive deletes the given nodes in one transaction, skipping
+// any that have the given check and it's passing, since those nodes are
+// alive again. This returns the nodes that were deleted.
+func (s *StateStore) DeleteNodesUnlessAlive(idx uint64, nodes []string, aliveCheck types.CheckID) ([]string, error) {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	var deleted []string
+	for _, node := range nodes {
+		existing, err := tx.First("nodes", "id", node)
+		if err != nil {
+			return nil, fmt.Errorf("node lookup failed: %s", err)
+		}
+		if existing == nil {
+			continue
+		}
+
+		check, err := tx.First("checks", "id", node, string(aliveCheck))
+		if err != nil {
+			return nil, fmt.Errorf("failed check lookup: %s", err)
+		}
+		if check != nil && check.(*structs.HealthCheck).Status == structs.HealthPassing {
+			continue
+		}
+
+		if err := s.deleteNodeTxn(tx, idx, node); err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, node)
+	}
+
+	tx.Commit()
+	return deleted, nil
+}
+
 // deleteNodeTxn is the inner method used for removing a node from
 // the store within a given transaction.
 func (s *StateStore) deleteNodeTxn(tx *memdb.Txn, idx uint64, nodeName string) error {
@@ -353,6 +482,7 @@ func (s *StateStore) deleteNodeTxn(tx *memdb.Txn, idx uint64, nodeName string) e
 		if err := tx.Delete("coordinates", coord); err != nil {
 			return fmt.Errorf("failed deleting coordinate: %s", err)
 		}
+		s.sizes.deleteTxn(tx, "coordinates", coord)
 		if err := tx.Insert("index", &IndexEntry{"coordinates", idx}); err != nil {
 			return fmt.Errorf("failed updating index: %s", err)
 		}
@@ -362,6 +492,7 @@ func (s *StateStore) deleteNodeTxn(tx *memdb.Txn, idx uint64, nodeName string) e
 	if err := tx.Delete("nodes", node); err != nil {
 		return fmt.Errorf("failed deleting node: %s", err)
 	}
+	s.sizes.deleteTxn(tx, "nodes", node)
 	if err := tx.Insert("index", &IndexEntry{"nodes", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
@@ -434,9 +565,13 @@ func (s *StateStore) ensureServiceTxn(tx *memdb.Txn, idx uint64, node string, sv
 	if err := tx.Insert("services", entry); err != nil {
 		return fmt.Errorf("failed inserting service: %s", err)
 	}
+	s.sizes.insertTxn(tx, "services", existing, entry)
 	if err := tx.Insert("index", &IndexEntry{"services", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
+	if err := s.clearCatalogTombstoneTxn(tx, node, catalogTombstoneService, svc.ID); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -449,10 +584,20 @@ func (s *StateStore) Services(ws memdb.WatchSet) (uint64, structs.Services, erro
 	// Get the table index.
 	idx := maxIndexTxn(tx, "services")
 
+	services, err := s.servicesTxn(tx, ws)
+	if err != nil {
+		return 0, nil, err
+	}
+	return idx, services, nil
+}
+
+// servicesTxn returns all the services and their tags, using the given
+// transaction.
+func (s *StateStore) servicesTxn(tx *memdb.Txn, ws memdb.WatchSet) (structs.Services, error) {
 	// List all the services.
 	services, err := tx.Get("services", "id")
 	if err != nil {
-		return 0, nil, fmt.Errorf("failed querying services: %s", err)
+		return nil, fmt.Errorf("failed querying services: %s", err)
 	}
 	ws.Add(services.WatchCh())
 
@@ -479,7 +624,7 @@ func (s *StateStore) Services(ws memdb.WatchSet) (uint64, structs.Services, erro
 			results[service] = append(results[service], tag)
 		}
 	}
-	return idx, results, nil
+	return results, nil
 }
 
 // ServicesByNodeMeta returns all services, filtered by the given node metadata.
@@ -551,6 +696,112 @@ func (s *StateStore) ServicesByNodeMeta(ws memdb.WatchSet, filters map[string]st
 	return idx, results, nil
 }
 
+// ServiceSummaries returns a summary of every service in the catalog, with
+// the number of instances in each health state and the distinct tags across
+// them. This is much cheaper than looking up the health of each service one
+// at a time. The watch set fires when any service or check changes.
+func (s *StateStore) ServiceSummaries(ws memdb.WatchSet) (uint64, structs.ServiceSummaries, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "services", "checks")
+
+	// Work out the worst status of the node-level checks on each node, and
+	// of the checks for each service instance.
+	checks, err := tx.Get("checks", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed check lookup: %s", err)
+	}
+	ws.Add(checks.WatchCh())
+	type instance struct {
+		node      string
+		serviceID string
+	}
+	nodeStatus := make(map[string]string)
+	serviceStatus := make(map[instance]string)
+	for check := checks.Next(); check != nil; check = checks.Next() {
+		hc := check.(*structs.HealthCheck)
+		if hc.ServiceID == "" {
+			nodeStatus[hc.Node] = worseStatus(nodeStatus[hc.Node], hc.Status)
+		} else {
+			key := instance{hc.Node, hc.ServiceID}
+			serviceStatus[key] = worseStatus(serviceStatus[key], hc.Status)
+		}
+	}
+
+	// Now tally up the instances of each service.
+	services, err := tx.Get("services", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed querying services: %s", err)
+	}
+	ws.Add(services.WatchCh())
+	summaries := make(map[string]*structs.ServiceSummary)
+	tags := make(map[string]map[string]struct{})
+	for service := services.Next(); service != nil; service = services.Next() {
+		svc := service.(*structs.ServiceNode)
+		sum, ok := summaries[svc.ServiceName]
+		if !ok {
+			sum = &structs.ServiceSummary{Name: svc.ServiceName, Tags: make([]string, 0)}
+			summaries[svc.ServiceName] = sum
+			tags[svc.ServiceName] = make(map[string]struct{})
+		}
+		for _, tag := range svc.ServiceTags {
+			if _, ok := tags[svc.ServiceName][tag]; !ok {
+				tags[svc.ServiceName][tag] = struct{}{}
+				sum.Tags = append(sum.Tags, tag)
+			}
+		}
+
+		sum.Instances++
+		if svc.ServiceKind != structs.ServiceKindTypical {
+			if sum.Kinds == nil {
+				sum.Kinds = make(map[string]int)
+			}
+			sum.Kinds[svc.ServiceKind]++
+		}
+		status := worseStatus(nodeStatus[svc.Node], serviceStatus[instance{svc.Node, svc.ServiceID}])
+		switch status {
+		case "", structs.HealthPassing:
+			sum.Passing++
+		case structs.HealthWarning:
+			sum.Warning++
+		default:
+			sum.Critical++
+		}
+	}
+
+	// Generate the output structure.
+	results := make(structs.ServiceSummaries, 0, len(summaries))
+	for _, sum := range summaries {
+		sort.Strings(sum.Tags)
+		results = append(results, sum)
+	}
+	sort.Sort(results)
+	return idx, results, nil
+}
+
+// worseStatus returns the worse of two health check statuses, treating an
+// empty status as better than passing, and any unknown status as critical.
+func worseStatus(a, b string) string {
+	rank := func(status string) int {
+		switch status {
+		case "":
+			return 0
+		case structs.HealthPassing:
+			return 1
+		case structs.HealthWarning:
+			return 2
+		default:
+			return 3
+		}
+	}
+	if rank(b) > rank(a) {
+		return b
+	}
+	return a
+}
+
 // ServiceNodes returns the nodes associated with a given service name.
 func (s *StateStore) ServiceNodes(ws memdb.WatchSet, serviceName string) (uint64, structs.ServiceNodes, error) {
 	tx := s.db.Txn(false)
@@ -579,6 +830,64 @@ func (s *StateStore) ServiceNodes(ws memdb.WatchSet, serviceName string) (uint64
 	return idx, results, nil
 }
 
+// ServiceNodesByKind returns the instances of every service of the given
+// kind. Typical services have no kind, so they can't be looked up this way.
+func (s *StateStore) ServiceNodesByKind(ws memdb.WatchSet, kind string) (uint64, structs.ServiceNodes, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "nodes", "services")
+
+	// List all the services of this kind.
+	services, err := tx.Get("services", "kind", kind)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed service lookup: %s", err)
+	}
+	ws.Add(services.WatchCh())
+
+	var results structs.ServiceNodes
+	for service := services.Next(); service != nil; service = services.Next() {
+		results = append(results, service.(*structs.ServiceNode))
+	}
+
+	// Fill in the node details.
+	results, err = s.parseServiceNodes(tx, ws, results)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed parsing service nodes: %s", err)
+	}
+	return idx, results, nil
+}
+
+// ServiceNodesByMeta returns the instances of every service that has the
+// given meta key set to the given value.
+func (s *StateStore) ServiceNodesByMeta(ws memdb.WatchSet, key, value string) (uint64, structs.ServiceNodes, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "nodes", "services")
+
+	// List all the services with the meta.
+	services, err := tx.Get("services", "meta", key, value)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed service lookup: %s", err)
+	}
+	ws.Add(services.WatchCh())
+
+	var results structs.ServiceNodes
+	for service := services.Next(); service != nil; service = services.Next() {
+		results = append(results, service.(*structs.ServiceNode))
+	}
+
+	// Fill in the node details.
+	results, err = s.parseServiceNodes(tx, ws, results)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed parsing service nodes: %s", err)
+	}
+	return idx, results, nil
+}
+
 // ServiceTagNodes returns the nodes associated with a given service, filtering
 // out services that don't contain the given tag.
 func (s *StateStore) ServiceTagNodes(ws memdb.WatchSet, service string, tag string) (uint64, structs.ServiceNodes, error) {
@@ -786,12 +1095,10 @@ func (s *StateStore) deleteServiceTxn(tx *memdb.Txn, idx uint64, nodeName, servi
 	if err != nil {
 		return fmt.Errorf("failed service lookup: %s", err)
 	}
-	if service == nil {
-		return nil
-	}
 
 	// Delete any checks associated with the service. This will invalidate
-	// sessions as necessary.
+	// sessions as necessary. We do this even if the service is already
+	// gone, so that any checks orphaned by it get cleaned up.
 	checks, err := tx.Get("checks", "node_service", nodeName, serviceID)
 	if err != nil {
 		return fmt.Errorf("failed service check lookup: %s", err)
@@ -800,6 +1107,9 @@ func (s *StateStore) deleteServiceTxn(tx *memdb.Txn, idx uint64, nodeName, servi
 	for check := checks.Next(); check != nil; check = checks.Next() {
 		cids = append(cids, check.(*structs.HealthCheck).CheckID)
 	}
+	if service == nil && len(cids) == 0 {
+		return nil
+	}
 
 	// Do the delete in a separate loop so we don't trash the iterator.
 	for _, cid := range cids {
@@ -812,15 +1122,24 @@ func (s *StateStore) deleteServiceTxn(tx *memdb.Txn, idx uint64, nodeName, servi
 	if err := tx.Insert("index", &IndexEntry{"checks", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
+	if service == nil {
+		return nil
+	}
 
 	// Delete the service and update the index
 	if err := tx.Delete("services", service); err != nil {
 		return fmt.Errorf("failed deleting service: %s", err)
 	}
+	s.sizes.deleteTxn(tx, "services", service)
 	if err := tx.Insert("index", &IndexEntry{"services", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
 
+	// Leave a tombstone so nodes syncing a diff can see the delete.
+	if err := s.catalogTombstoneTxn(tx, idx, nodeName, catalogTombstoneService, serviceID); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -911,9 +1230,13 @@ func (s *StateStore) ensureCheckTxn(tx *memdb.Txn, idx uint64, hc *structs.Healt
 	if err := tx.Insert("checks", hc); err != nil {
 		return fmt.Errorf("failed inserting check: %s", err)
 	}
+	s.sizes.insertTxn(tx, "checks", existing, hc)
 	if err := tx.Insert("index", &IndexEntry{"checks", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
+	if err := s.clearCatalogTombstoneTxn(tx, hc.Node, catalogTombstoneCheck, string(hc.CheckID)); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -1018,22 +1341,54 @@ func (s *StateStore) ChecksInState(ws memdb.WatchSet, state string) (uint64, str
 	// Get the table index.
 	idx := maxIndexTxn(tx, "checks")
 
+	checks, err := s.checksInStateTxn(tx, ws, state)
+	if err != nil {
+		return 0, nil, err
+	}
+	return idx, checks, nil
+}
+
+// checksInStateTxn returns the checks in the given state, using the given
+// transaction.
+func (s *StateStore) checksInStateTxn(tx *memdb.Txn, ws memdb.WatchSet, state string) (structs.HealthChecks, error) {
 	// Query all checks if HealthAny is passed, otherwise use the index.
 	var iter memdb.ResultIterator
 	var err error
 	if state == structs.HealthAny {
 		iter, err = tx.Get("checks", "status")
 		if err != nil {
-			return 0, nil, fmt.Errorf("failed check lookup: %s", err)
+			return nil, fmt.Errorf("failed check lookup: %s", err)
 		}
 	} else {
 		iter, err = tx.Get("checks", "status", state)
 		if err != nil {
-			return 0, nil, fmt.Errorf("failed check lookup: %s", err)
+			return nil, fmt.Errorf("failed check lookup: %s", err)
 		}
 	}
 	ws.Add(iter.WatchCh())
 
+	var results structs.HealthChecks
+	for check := iter.Next(); check != nil; check = iter.Next() {
+		results = append(results, check.(*structs.HealthCheck))
+	}
+	return results, nil
+}
+
+// ChecksByIDPrefix returns the checks on any node whose ID starts with the
+// given prefix.
+func (s *StateStore) ChecksByIDPrefix(ws memdb.WatchSet, prefix string) (uint64, structs.HealthChecks, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "checks")
+
+	iter, err := tx.Get("checks", "check_id_prefix", prefix)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed check lookup: %s", err)
+	}
+	ws.Add(iter.WatchCh())
+
 	var results structs.HealthChecks
 	for check := iter.Next(); check != nil; check = iter.Next() {
 		results = append(results, check.(*structs.HealthCheck))
@@ -1041,6 +1396,36 @@ func (s *StateStore) ChecksInState(ws memdb.WatchSet, state string) (uint64, str
 	return idx, results, nil
 }
 
+// OrphanedChecks returns the checks that are tied to a service that's no
+// longer registered on their node. Deleting a service cleans up its checks,
+// but older versions could leave some behind, and these would otherwise
+// sit in the catalog forever.
+func (s *StateStore) OrphanedChecks() (structs.HealthChecks, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	checks, err := tx.Get("checks", "id")
+	if err != nil {
+		return nil, fmt.Errorf("failed check lookup: %s", err)
+	}
+
+	var results structs.HealthChecks
+	for check := checks.Next(); check != nil; check = checks.Next() {
+		hc := check.(*structs.HealthCheck)
+		if hc.ServiceID == "" {
+			continue
+		}
+		service, err := tx.First("services", "id", hc.Node, hc.ServiceID)
+		if err != nil {
+			return nil, fmt.Errorf("failed service lookup: %s", err)
+		}
+		if service == nil {
+			results = append(results, hc)
+		}
+	}
+	return results, nil
+}
+
 // ChecksInStateByNodeMeta is used to query the state store for all checks
 // which are in the provided state, filtered by the given node metadata values.
 func (s *StateStore) ChecksInStateByNodeMeta(ws memdb.WatchSet, state string, filters map[string]string) (uint64, structs.HealthChecks, error) {
@@ -1134,10 +1519,16 @@ func (s *StateStore) deleteCheckTxn(tx *memdb.Txn, idx uint64, node string, chec
 	if err := tx.Delete("checks", hc); err != nil {
 		return fmt.Errorf("failed removing check: %s", err)
 	}
+	s.sizes.deleteTxn(tx, "checks", hc)
 	if err := tx.Insert("index", &IndexEntry{"checks", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
 
+	// Leave a tombstone so nodes syncing a diff can see the delete.
+	if err := s.catalogTombstoneTxn(tx, idx, node, catalogTombstoneCheck, string(checkID)); err != nil {
+		return err
+	}
+
 	// Delete any sessions for this check.
 	mappings, err := tx.Get("session_checks", "node_check", node, string(checkID))
 	if err != nil {
@@ -1208,6 +1599,63 @@ func (s *StateStore) CheckServiceTagNodes(ws memdb.WatchSet, serviceName, tag st
 	return s.parseCheckServiceNodes(tx, ws, idx, serviceName, results, err)
 }
 
+// serviceAddressHook is called for each service an address lookup looks at.
+// It's only used by tests, to make sure the lookups stick to the indexes.
+var serviceAddressHook func(*structs.ServiceNode)
+
+// CheckServiceNodesByAddress is used to query all nodes and checks for the
+// instances of any service that advertise the given address. That's either
+// the service address, or the node's address for instances that don't set
+// one.
+func (s *StateStore) CheckServiceNodesByAddress(ws memdb.WatchSet, address string) (uint64, structs.CheckServiceNodes, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "nodes", "services", "checks")
+
+	// Grab the instances with their own address first.
+	iter, err := tx.Get("services", "address", address)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed service lookup: %s", err)
+	}
+	ws.Add(iter.WatchCh())
+
+	var results structs.ServiceNodes
+	for service := iter.Next(); service != nil; service = iter.Next() {
+		svc := service.(*structs.ServiceNode)
+		if serviceAddressHook != nil {
+			serviceAddressHook(svc)
+		}
+		results = append(results, svc)
+	}
+
+	// Then add the instances without an address on nodes with this
+	// address.
+	nodes, err := tx.Get("nodes", "address", address)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed node lookup: %s", err)
+	}
+	ws.Add(nodes.WatchCh())
+	for node := nodes.Next(); node != nil; node = nodes.Next() {
+		services, err := tx.Get("services", "node", node.(*structs.Node).Node)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed service lookup: %s", err)
+		}
+		ws.Add(services.WatchCh())
+		for service := services.Next(); service != nil; service = services.Next() {
+			svc := service.(*structs.ServiceNode)
+			if serviceAddressHook != nil {
+				serviceAddressHook(svc)
+			}
+			if svc.ServiceAddress == "" {
+				results = append(results, svc)
+			}
+		}
+	}
+	return s.parseCheckServiceNodes(tx, ws, idx, "", results, err)
+}
+
 // parseCheckServiceNodes is used to parse through a given set of services,
 // and query for an associated node and a set of checks. This is the inner
 // method used to return a rich set of results from a more simple query.
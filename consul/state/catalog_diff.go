@@ -0,0 +1,225 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/types"
+	"github.com/hashicorp/go-memdb"
+)
+
+const (
+	// catalogTombstoneService and catalogTombstoneCheck are the kinds of
+	// catalog tombstones.
+	catalogTombstoneService = "service"
+	catalogTombstoneCheck   = "check"
+
+	// catalogTombstonesReaped is the key in the index table that records
+	// the index catalog tombstones have been reaped up to. Deletes at or
+	// before this index can't be seen any more.
+	catalogTombstonesReaped = "catalog-tombstones-reaped"
+)
+
+// CatalogTombstone records that a service or check was deleted from the
+// catalog, so nodes that were out of touch when it happened can find out.
+// These are reaped along with the KV tombstones.
+type CatalogTombstone struct {
+	Node  string
+	Kind  string
+	ID    string
+	Index uint64
+}
+
+// CatalogTombstones is used to pull all the catalog tombstones from the
+// snapshot.
+func (s *StateSnapshot) CatalogTombstones() (memdb.ResultIterator, error) {
+	iter, err := s.tx.Get("catalog-tombstones", "id")
+	if err != nil {
+		return nil, err
+	}
+	return iter, nil
+}
+
+// CatalogTombstonesReaped returns the index the catalog tombstones in the
+// snapshot have been reaped up to.
+func (s *StateSnapshot) CatalogTombstonesReaped() uint64 {
+	return maxIndexTxn(s.tx, catalogTombstonesReaped)
+}
+
+// CatalogTombstone is used when restoring from a snapshot.
+func (s *StateRestore) CatalogTombstone(stone *CatalogTombstone) error {
+	if err := s.tx.Insert("catalog-tombstones", stone); err != nil {
+		return fmt.Errorf("failed restoring catalog tombstone: %s", err)
+	}
+
+	if err := indexUpdateMaxTxn(s.tx, stone.Index, "catalog-tombstones"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+	return nil
+}
+
+// CatalogTombstonesReaped is used when restoring from a snapshot to record
+// the index catalog tombstones had been reaped up to.
+func (s *StateRestore) CatalogTombstonesReaped(idx uint64) error {
+	if err := indexUpdateMaxTxn(s.tx, idx, catalogTombstonesReaped); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+	return nil
+}
+
+// catalogTombstoneTxn records that the given service or check was deleted.
+func (s *StateStore) catalogTombstoneTxn(tx *memdb.Txn, idx uint64, node, kind, id string) error {
+	stone := &CatalogTombstone{Node: node, Kind: kind, ID: id, Index: idx}
+	if err := tx.Insert("catalog-tombstones", stone); err != nil {
+		return fmt.Errorf("failed inserting catalog tombstone: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"catalog-tombstones", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	// Let the GC know this needs reaping, same as a KV tombstone.
+	if gc := s.kvsGraveyard.gc; gc != nil {
+		tx.Defer(func() { gc.Hint(idx) })
+	}
+	return nil
+}
+
+// clearCatalogTombstoneTxn removes the tombstone for the given service or
+// check, if there is one, since it's been registered again.
+func (s *StateStore) clearCatalogTombstoneTxn(tx *memdb.Txn, node, kind, id string) error {
+	stone, err := tx.First("catalog-tombstones", "id", node, kind, id)
+	if err != nil {
+		return fmt.Errorf("failed catalog tombstone lookup: %s", err)
+	}
+	if stone == nil {
+		return nil
+	}
+	if err := tx.Delete("catalog-tombstones", stone); err != nil {
+		return fmt.Errorf("failed deleting catalog tombstone: %s", err)
+	}
+	return nil
+}
+
+// reapCatalogTombstonesTxn cleans out all the catalog tombstones whose index
+// values are less than or equal to the given idx.
+func (s *StateStore) reapCatalogTombstonesTxn(tx *memdb.Txn, idx uint64) error {
+	stones, err := tx.Get("catalog-tombstones", "id")
+	if err != nil {
+		return fmt.Errorf("failed querying catalog tombstones: %s", err)
+	}
+	var objs []interface{}
+	for stone := stones.Next(); stone != nil; stone = stones.Next() {
+		if stone.(*CatalogTombstone).Index <= idx {
+			objs = append(objs, stone)
+		}
+	}
+
+	// Delete the tombstones in a separate loop so we don't trash the
+	// iterator.
+	for _, obj := range objs {
+		if err := tx.Delete("catalog-tombstones", obj); err != nil {
+			return fmt.Errorf("failed deleting catalog tombstone: %s", err)
+		}
+	}
+
+	if err := indexUpdateMaxTxn(tx, idx, catalogTombstonesReaped); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+	return nil
+}
+
+// NodeCatalogDiff returns the services and checks for the given node that
+// have changed since the given table indexes, along with the ones that have
+// been deleted. If the changes can't all be returned, because the deletes
+// have been reaped, the indexes are from the future, or there are more than
+// maxEntries of them, then the diff has FullResync set instead.
+func (s *StateStore) NodeCatalogDiff(nodeName string, since map[string]uint64,
+	maxEntries int) (*structs.NodeCatalogDiff, error) {
+	for table := range since {
+		if table != "services" && table != "checks" {
+			return nil, fmt.Errorf("Unsupported table %q", table)
+		}
+	}
+
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	diff := &structs.NodeCatalogDiff{
+		Indexes: map[string]uint64{
+			"services": maxIndexTxn(tx, "services"),
+			"checks":   maxIndexTxn(tx, "checks"),
+		},
+	}
+	full := &structs.NodeCatalogDiff{
+		Indexes:    diff.Indexes,
+		FullResync: true,
+	}
+
+	// If the node is gone then everything for it is too.
+	node, err := tx.First("nodes", "id", nodeName)
+	if err != nil {
+		return nil, fmt.Errorf("failed node lookup: %s", err)
+	}
+	if node == nil {
+		return full, nil
+	}
+
+	// Make sure we can still see every delete since the given indexes, and
+	// that they aren't from a newer catalog than ours. The table indexes
+	// can go backwards a bit after a restore, so this checks against the
+	// latest change to any of them.
+	reaped := maxIndexTxn(tx, catalogTombstonesReaped)
+	latest := maxIndexTxn(tx, "nodes", "services", "checks", "catalog-tombstones")
+	for table := range diff.Indexes {
+		if since[table] < reaped || since[table] > latest {
+			return full, nil
+		}
+	}
+
+	services, err := tx.Get("services", "node", nodeName)
+	if err != nil {
+		return nil, fmt.Errorf("failed service lookup: %s", err)
+	}
+	for service := services.Next(); service != nil; service = services.Next() {
+		sn := service.(*structs.ServiceNode)
+		if sn.ModifyIndex > since["services"] {
+			diff.Services = append(diff.Services, sn.ToNodeService())
+		}
+	}
+
+	checks, err := tx.Get("checks", "node", nodeName)
+	if err != nil {
+		return nil, fmt.Errorf("failed check lookup: %s", err)
+	}
+	for check := checks.Next(); check != nil; check = checks.Next() {
+		hc := check.(*structs.HealthCheck)
+		if hc.ModifyIndex > since["checks"] {
+			diff.Checks = append(diff.Checks, hc)
+		}
+	}
+
+	stones, err := tx.Get("catalog-tombstones", "node", nodeName)
+	if err != nil {
+		return nil, fmt.Errorf("failed catalog tombstone lookup: %s", err)
+	}
+	for stone := stones.Next(); stone != nil; stone = stones.Next() {
+		t := stone.(*CatalogTombstone)
+		switch t.Kind {
+		case catalogTombstoneService:
+			if t.Index > since["services"] {
+				diff.DeletedServices = append(diff.DeletedServices, t.ID)
+			}
+		case catalogTombstoneCheck:
+			if t.Index > since["checks"] {
+				diff.DeletedChecks = append(diff.DeletedChecks, types.CheckID(t.ID))
+			}
+		}
+	}
+
+	entries := len(diff.Services) + len(diff.Checks) +
+		len(diff.DeletedServices) + len(diff.DeletedChecks)
+	if maxEntries > 0 && entries > maxEntries {
+		return full, nil
+	}
+	return diff, nil
+}
@@ -0,0 +1,234 @@
+package state
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/types"
+)
+
+func TestStateStore_NodeCatalogDiff(t *testing.T) {
+	s := testStateStore(t)
+
+	// Register what the node last saw.
+	testRegisterNode(t, s, 1, "foo")
+	testRegisterService(t, s, 2, "foo", "web")
+	testRegisterService(t, s, 3, "foo", "db")
+	testRegisterService(t, s, 4, "foo", "cache")
+	testRegisterCheck(t, s, 5, "foo", "web", "web-check", structs.HealthPassing)
+	testRegisterCheck(t, s, 6, "foo", "", "node-check", structs.HealthPassing)
+	testRegisterCheck(t, s, 7, "foo", "db", "db-check", structs.HealthPassing)
+	testRegisterNode(t, s, 8, "bar")
+	testRegisterService(t, s, 9, "bar", "web")
+	since := map[string]uint64{"services": 9, "checks": 7}
+
+	// Nothing's changed yet.
+	diff, err := s.NodeCatalogDiff("foo", since, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := &structs.NodeCatalogDiff{
+		Indexes: map[string]uint64{"services": 9, "checks": 7},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("bad: %#v", diff)
+	}
+
+	// Make a few changes while the node isn't looking. Deleting a service
+	// deletes its checks too. Changes to other nodes shouldn't show up.
+	testRegisterService(t, s, 10, "foo", "web")
+	if err := s.DeleteService(11, "foo", "db"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.DeleteCheck(12, "foo", "node-check"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testRegisterService(t, s, 13, "foo", "api")
+	testRegisterCheck(t, s, 14, "foo", "web", "web-check", structs.HealthCritical)
+	if err := s.DeleteService(15, "bar", "web"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	diff, err = s.NodeCatalogDiff("foo", since, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(diff.Services) != 2 || diff.Services[0].ID != "api" || diff.Services[1].ID != "web" ||
+		diff.Services[1].ModifyIndex != 10 {
+		t.Fatalf("bad: %#v", diff.Services)
+	}
+	if len(diff.Checks) != 1 || diff.Checks[0].CheckID != "web-check" ||
+		diff.Checks[0].Status != structs.HealthCritical {
+		t.Fatalf("bad: %#v", diff.Checks)
+	}
+	if !reflect.DeepEqual(diff.DeletedServices, []string{"db"}) {
+		t.Fatalf("bad: %#v", diff.DeletedServices)
+	}
+	if !reflect.DeepEqual(diff.DeletedChecks, []types.CheckID{"db-check", "node-check"}) {
+		t.Fatalf("bad: %#v", diff.DeletedChecks)
+	}
+	if diff.FullResync || !reflect.DeepEqual(diff.Indexes, map[string]uint64{"services": 15, "checks": 15}) {
+		t.Fatalf("bad: %#v", diff)
+	}
+
+	// Registering a deleted service again clears its tombstone.
+	testRegisterService(t, s, 16, "foo", "db")
+	diff, err = s.NodeCatalogDiff("foo", diff.Indexes, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(diff.Services) != 1 || diff.Services[0].ID != "db" ||
+		len(diff.Checks) != 0 || len(diff.DeletedServices) != 0 || len(diff.DeletedChecks) != 0 {
+		t.Fatalf("bad: %#v", diff)
+	}
+
+	// Too many changes need a full resync.
+	diff, err = s.NodeCatalogDiff("foo", since, 3)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !diff.FullResync || len(diff.Services) != 0 || diff.Indexes["services"] != 16 {
+		t.Fatalf("bad: %#v", diff)
+	}
+
+	// So does an index from the future.
+	diff, err = s.NodeCatalogDiff("foo", map[string]uint64{"services": 100, "checks": 15}, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !diff.FullResync {
+		t.Fatalf("bad: %#v", diff)
+	}
+
+	// And a node that's gone.
+	diff, err = s.NodeCatalogDiff("nope", since, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !diff.FullResync {
+		t.Fatalf("bad: %#v", diff)
+	}
+
+	// Only the tables we track deletes for can be diffed.
+	_, err = s.NodeCatalogDiff("foo", map[string]uint64{"kvs": 1}, 0)
+	if err == nil || !strings.Contains(err.Error(), "Unsupported table") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestStateStore_NodeCatalogDiff_Reaped(t *testing.T) {
+	s := testStateStore(t)
+
+	testRegisterNode(t, s, 1, "foo")
+	testRegisterService(t, s, 2, "foo", "web")
+	testRegisterService(t, s, 3, "foo", "db")
+	if err := s.DeleteService(4, "foo", "web"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.DeleteService(5, "foo", "db"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Once the first delete is reaped it can't be seen, so an index from
+	// before it needs a full resync.
+	if err := s.ReapTombstones(4); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	diff, err := s.NodeCatalogDiff("foo", map[string]uint64{"services": 3, "checks": 3}, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !diff.FullResync || len(diff.DeletedServices) != 0 {
+		t.Fatalf("bad: %#v", diff)
+	}
+
+	// The later delete is still there.
+	diff, err = s.NodeCatalogDiff("foo", map[string]uint64{"services": 4, "checks": 4}, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if diff.FullResync || !reflect.DeepEqual(diff.DeletedServices, []string{"db"}) {
+		t.Fatalf("bad: %#v", diff)
+	}
+}
+
+func TestStateStore_CatalogTombstones_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+
+	testRegisterNode(t, s, 1, "foo")
+	testRegisterService(t, s, 2, "foo", "web")
+	testRegisterService(t, s, 3, "foo", "db")
+	if err := s.DeleteService(4, "foo", "web"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.DeleteService(5, "foo", "db"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.ReapTombstones(4); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	if err := s.ReapTombstones(5); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	iter, err := snap.CatalogTombstones()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var dump []*CatalogTombstone
+	for stone := iter.Next(); stone != nil; stone = iter.Next() {
+		dump = append(dump, stone.(*CatalogTombstone))
+	}
+	expected := []*CatalogTombstone{
+		&CatalogTombstone{Node: "foo", Kind: "service", ID: "db", Index: 5},
+	}
+	if !reflect.DeepEqual(dump, expected) {
+		t.Fatalf("bad: %#v", dump)
+	}
+	if reaped := snap.CatalogTombstonesReaped(); reaped != 4 {
+		t.Fatalf("bad: %d", reaped)
+	}
+
+	// Restore the values into a new state store.
+	s2 := testStateStore(t)
+	restore := s2.Restore()
+	req := &structs.RegisterRequest{
+		Node:    "foo",
+		Service: &structs.NodeService{ID: "cache", Service: "cache"},
+		Check:   &structs.HealthCheck{Node: "foo", CheckID: "cache-check", ServiceID: "cache"},
+	}
+	if err := restore.Registration(5, req); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, stone := range dump {
+		if err := restore.CatalogTombstone(stone); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if err := restore.CatalogTombstonesReaped(4); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	restore.Commit()
+
+	diff, err := s2.NodeCatalogDiff("foo", map[string]uint64{"services": 1, "checks": 1}, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !diff.FullResync {
+		t.Fatalf("bad: %#v", diff)
+	}
+	diff, err = s2.NodeCatalogDiff("foo", map[string]uint64{"services": 4, "checks": 4}, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(diff.DeletedServices, []string{"db"}) {
+		t.Fatalf("bad: %#v", diff)
+	}
+}
@@ -347,6 +347,178 @@ func TestStateStore_EnsureRegistration_Restore(t *testing.T) {
 	}()
 }
 
+func TestStateStore_EnsureRegistration_Replace(t *testing.T) {
+	s := testStateStore(t)
+
+	// Register a service instance with a check.
+	req := &structs.RegisterRequest{
+		Node:    "node1",
+		Address: "1.2.3.4",
+		Service: &structs.NodeService{
+			ID:      "web1",
+			Service: "web",
+			Port:    80,
+		},
+		Checks: structs.HealthChecks{
+			&structs.HealthCheck{
+				Node:      "node1",
+				CheckID:   "old",
+				ServiceID: "web1",
+			},
+		},
+	}
+	if err := s.EnsureRegistration(1, req); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Watch the service, and replace the instance with a new one on a
+	// different port, with a different check.
+	ws := memdb.NewWatchSet()
+	if _, nodes, err := s.CheckServiceNodes(ws, "web"); err != nil || len(nodes) != 1 {
+		t.Fatalf("bad: %v %v", nodes, err)
+	}
+	req = &structs.RegisterRequest{
+		Node:    "node1",
+		Address: "1.2.3.4",
+		Service: &structs.NodeService{
+			ID:      "web1",
+			Service: "web",
+			Port:    81,
+		},
+		Checks: structs.HealthChecks{
+			&structs.HealthCheck{
+				Node:      "node1",
+				CheckID:   "new",
+				ServiceID: "web1",
+			},
+		},
+		Replace: true,
+	}
+	if err := s.EnsureRegistration(2, req); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	// Only the new instance and its check should be there, as a fresh
+	// instance.
+	idx, nodes, err := s.CheckServiceNodes(nil, "web")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2 || len(nodes) != 1 {
+		t.Fatalf("bad: %d %v", idx, nodes)
+	}
+	svc := nodes[0].Service
+	if svc.Port != 81 || svc.CreateIndex != 2 || svc.ModifyIndex != 2 {
+		t.Fatalf("bad: %#v", svc)
+	}
+	if len(nodes[0].Checks) != 1 || nodes[0].Checks[0].CheckID != "new" {
+		t.Fatalf("bad: %#v", nodes[0].Checks)
+	}
+
+	// Replacing an instance that isn't there is just a registration.
+	req.Service = &structs.NodeService{
+		ID:      "web2",
+		Service: "web",
+		Port:    82,
+	}
+	req.Checks = nil
+	if err := s.EnsureRegistration(3, req); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, nodes, err = s.CheckServiceNodes(nil, "web")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 3 || len(nodes) != 2 || nodes[1].Service.Port != 82 {
+		t.Fatalf("bad: %d %v", idx, nodes)
+	}
+}
+
+func TestStateStore_RegistrationUnchanged(t *testing.T) {
+	s := testStateStore(t)
+
+	// Make a fresh request each time, since the state store keeps the
+	// checks it's given.
+	makeReq := func(f func(req *structs.RegisterRequest)) *structs.RegisterRequest {
+		req := &structs.RegisterRequest{
+			Node:            "node1",
+			Address:         "1.2.3.4",
+			TaggedAddresses: map[string]string{"wan": "5.6.7.8"},
+			NodeMeta:        map[string]string{"rack": "a"},
+			Service: &structs.NodeService{
+				ID:      "web1",
+				Service: "web",
+				Port:    80,
+			},
+			Checks: structs.HealthChecks{
+				&structs.HealthCheck{
+					Node:      "node1",
+					CheckID:   "check1",
+					Name:      "check",
+					ServiceID: "web1",
+					Output:    "ok",
+				},
+			},
+		}
+		if f != nil {
+			f(req)
+		}
+		return req
+	}
+	unchanged := func(req *structs.RegisterRequest) bool {
+		ok, err := s.RegistrationUnchanged(req)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return ok
+	}
+
+	// Nothing is there yet.
+	if unchanged(makeReq(nil)) {
+		t.Fatalf("bad")
+	}
+	if err := s.EnsureRegistration(1, makeReq(nil)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The same registration again is unchanged, even though the check
+	// status and service name are filled in by the state store.
+	if !unchanged(makeReq(nil)) {
+		t.Fatalf("bad")
+	}
+
+	// Any difference counts as a change.
+	changes := []func(req *structs.RegisterRequest){
+		func(req *structs.RegisterRequest) { req.Address = "1.2.3.5" },
+		func(req *structs.RegisterRequest) { req.TaggedAddresses["wan"] = "5.6.7.9" },
+		func(req *structs.RegisterRequest) { req.NodeMeta["rack"] = "b" },
+		func(req *structs.RegisterRequest) { req.Service.Port = 81 },
+		func(req *structs.RegisterRequest) { req.Service.ID = "web2" },
+		func(req *structs.RegisterRequest) { req.Replace = true },
+		func(req *structs.RegisterRequest) { req.Checks[0].Output = "still ok" },
+		func(req *structs.RegisterRequest) { req.Checks[0].Status = structs.HealthPassing },
+		func(req *structs.RegisterRequest) { req.Checks[0].CheckID = "check2" },
+		func(req *structs.RegisterRequest) { req.Checks[0].Node = "node2" },
+	}
+	for i, f := range changes {
+		if unchanged(makeReq(f)) {
+			t.Fatalf("change %d: bad", i)
+		}
+	}
+
+	// Node changes don't count when the node update is skipped.
+	req := makeReq(func(req *structs.RegisterRequest) {
+		req.Address = "1.2.3.5"
+		req.SkipNodeUpdate = true
+	})
+	if !unchanged(req) {
+		t.Fatalf("bad")
+	}
+}
+
 func TestStateStore_EnsureNode(t *testing.T) {
 	s := testStateStore(t)
 
@@ -734,6 +906,36 @@ func TestStateStore_DeleteNode(t *testing.T) {
 	}
 }
 
+func TestStateStore_DeleteNodesUnlessAlive(t *testing.T) {
+	s := testStateStore(t)
+
+	// Make a dead node, an alive one, and one without the check.
+	testRegisterNode(t, s, 0, "dead")
+	testRegisterCheck(t, s, 1, "dead", "", "serfHealth", structs.HealthCritical)
+	testRegisterNode(t, s, 2, "alive")
+	testRegisterCheck(t, s, 3, "alive", "", "serfHealth", structs.HealthPassing)
+	testRegisterNode(t, s, 4, "unchecked")
+
+	deleted, err := s.DeleteNodesUnlessAlive(5, []string{"dead", "alive", "unchecked", "nope"}, "serfHealth")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(deleted, []string{"dead", "unchecked"}) {
+		t.Fatalf("bad: %v", deleted)
+	}
+
+	_, nodes, err := s.Nodes(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(nodes) != 1 || nodes[0].Node != "alive" {
+		t.Fatalf("bad: %#v", nodes)
+	}
+	if idx := s.maxIndex("nodes"); idx != 5 {
+		t.Fatalf("bad index: %d", idx)
+	}
+}
+
 func TestStateStore_Node_Snapshot(t *testing.T) {
 	s := testStateStore(t)
 
@@ -988,6 +1190,125 @@ func TestStateStore_Services(t *testing.T) {
 	}
 }
 
+func TestStateStore_ServiceSummaries(t *testing.T) {
+	s := testStateStore(t)
+
+	// Listing with no results returns an empty list.
+	ws := memdb.NewWatchSet()
+	idx, summaries, err := s.ServiceSummaries(ws)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 || len(summaries) != 0 {
+		t.Fatalf("bad: %d %v", idx, summaries)
+	}
+
+	// Register a few instances of redis in varied health. The node-level
+	// check on node3 should drag down its instance.
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterNode(t, s, 2, "node2")
+	testRegisterNode(t, s, 3, "node3")
+	for i, node := range []string{"node1", "node2", "node3"} {
+		ns := &structs.NodeService{
+			ID:      "redis1",
+			Service: "redis",
+			Tags:    []string{"prod", node},
+		}
+		if err := s.EnsureService(uint64(4+i), node, ns); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	testRegisterCheck(t, s, 7, "node1", "redis1", "check1", structs.HealthPassing)
+	testRegisterCheck(t, s, 8, "node2", "redis1", "check1", structs.HealthWarning)
+	testRegisterCheck(t, s, 9, "node3", "redis1", "check1", structs.HealthPassing)
+	testRegisterCheck(t, s, 10, "node3", "", "check2", structs.HealthCritical)
+
+	// A service with no checks at all counts as passing.
+	testRegisterService(t, s, 11, "node1", "dogs")
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	ws = memdb.NewWatchSet()
+	idx, summaries, err = s.ServiceSummaries(ws)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 11 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	expected := structs.ServiceSummaries{
+		&structs.ServiceSummary{
+			Name:      "dogs",
+			Tags:      []string{},
+			Instances: 1,
+			Passing:   1,
+		},
+		&structs.ServiceSummary{
+			Name:      "redis",
+			Tags:      []string{"node1", "node2", "node3", "prod"},
+			Instances: 3,
+			Passing:   1,
+			Warning:   1,
+			Critical:  1,
+		},
+	}
+	if !reflect.DeepEqual(summaries, expected) {
+		t.Fatalf("bad: %#v", summaries)
+	}
+
+	// Check updates should fire the watch and show up in the counts.
+	testRegisterCheck(t, s, 12, "node3", "", "check2", structs.HealthPassing)
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	ws = memdb.NewWatchSet()
+	idx, summaries, err = s.ServiceSummaries(ws)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 12 || summaries[1].Passing != 2 || summaries[1].Critical != 0 {
+		t.Fatalf("bad: %d %#v", idx, summaries[1])
+	}
+
+	// So should deleting a node.
+	if err := s.DeleteNode(13, "node1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	_, summaries, err = s.ServiceSummaries(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(summaries) != 1 || summaries[0].Instances != 2 {
+		t.Fatalf("bad: %#v", summaries)
+	}
+
+	// Instances that aren't typical services should be broken down by
+	// kind.
+	for i, kind := range []string{structs.ServiceKindLoadBalancer, structs.ServiceKindLoadBalancer, ""} {
+		ns := &structs.NodeService{
+			ID:      fmt.Sprintf("lb%d", i),
+			Service: "lb",
+			Kind:    kind,
+		}
+		if err := s.EnsureService(uint64(14+i), "node2", ns); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	_, summaries, err = s.ServiceSummaries(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	kinds := map[string]int{structs.ServiceKindLoadBalancer: 2}
+	if len(summaries) != 2 || summaries[0].Name != "lb" || summaries[0].Instances != 3 ||
+		!reflect.DeepEqual(summaries[0].Kinds, kinds) || summaries[1].Kinds != nil {
+		t.Fatalf("bad: %#v", summaries)
+	}
+}
+
 func TestStateStore_ServicesByNodeMeta(t *testing.T) {
 	s := testStateStore(t)
 
@@ -1260,6 +1581,199 @@ func TestStateStore_ServiceNodes(t *testing.T) {
 	}
 }
 
+func TestStateStore_ServiceNodesByKind(t *testing.T) {
+	s := testStateStore(t)
+
+	// Listing with no results returns nil.
+	ws := memdb.NewWatchSet()
+	idx, res, err := s.ServiceNodesByKind(ws, structs.ServiceKindLoadBalancer)
+	if idx != 0 || res != nil || err != nil {
+		t.Fatalf("expected (0, nil, nil), got: (%d, %#v, %#v)", idx, res, err)
+	}
+
+	// Register services of a couple of kinds, and a typical one.
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterNode(t, s, 2, "node2")
+	services := []struct {
+		node    string
+		id      string
+		service string
+		kind    string
+	}{
+		{"node1", "lb", "web-lb", structs.ServiceKindLoadBalancer},
+		{"node2", "lb", "api-lb", structs.ServiceKindLoadBalancer},
+		{"node1", "web-proxy", "web-proxy", structs.ServiceKindMeshProxy},
+		{"node1", "web", "web", ""},
+	}
+	for i, svc := range services {
+		ns := &structs.NodeService{ID: svc.id, Service: svc.service, Kind: svc.kind}
+		if err := s.EnsureService(uint64(3+i), svc.node, ns); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	// Each kind should only get its own instances.
+	idx, res, err = s.ServiceNodesByKind(nil, structs.ServiceKindLoadBalancer)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 6 || len(res) != 2 {
+		t.Fatalf("bad: %d %#v", idx, res)
+	}
+	for _, sn := range res {
+		if sn.ServiceKind != structs.ServiceKindLoadBalancer {
+			t.Fatalf("bad: %#v", sn)
+		}
+	}
+	if res[0].Node != "node1" || res[0].ServiceName != "web-lb" ||
+		res[1].Node != "node2" || res[1].ServiceName != "api-lb" {
+		t.Fatalf("bad: %#v", res)
+	}
+	_, res, err = s.ServiceNodesByKind(nil, structs.ServiceKindMeshProxy)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(res) != 1 || res[0].ServiceName != "web-proxy" {
+		t.Fatalf("bad: %#v", res)
+	}
+
+	// Typical services can't be looked up by kind.
+	_, res, err = s.ServiceNodesByKind(nil, "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("bad: %#v", res)
+	}
+
+	// Changing a service's kind should fire the watch and move it.
+	ws = memdb.NewWatchSet()
+	if _, _, err := s.ServiceNodesByKind(ws, structs.ServiceKindMeshProxy); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ns := &structs.NodeService{ID: "web-proxy", Service: "web-proxy"}
+	if err := s.EnsureService(7, "node1", ns); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	_, res, err = s.ServiceNodesByKind(nil, structs.ServiceKindMeshProxy)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("bad: %#v", res)
+	}
+}
+
+func TestStateStore_ServiceNodesByMeta(t *testing.T) {
+	s := testStateStore(t)
+
+	// Listing with no results returns nil.
+	ws := memdb.NewWatchSet()
+	idx, res, err := s.ServiceNodesByMeta(ws, "probe", "true")
+	if idx != 0 || res != nil || err != nil {
+		t.Fatalf("expected (0, nil, nil), got: (%d, %#v, %#v)", idx, res, err)
+	}
+
+	// Register services with a few different meta values.
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterNode(t, s, 2, "node2")
+	services := []struct {
+		node string
+		id   string
+		meta map[string]string
+	}{
+		{"node1", "db", map[string]string{"probe": "true"}},
+		{"node2", "db", map[string]string{"probe": "true", "other": "x"}},
+		{"node1", "web", map[string]string{"probe": "false"}},
+		{"node2", "web", nil},
+	}
+	for i, svc := range services {
+		ns := &structs.NodeService{ID: svc.id, Service: svc.id, Meta: svc.meta}
+		if err := s.EnsureService(uint64(3+i), svc.node, ns); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	// Only the instances with a matching value should come back.
+	idx, res, err = s.ServiceNodesByMeta(nil, "probe", "true")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 6 || len(res) != 2 {
+		t.Fatalf("bad: %d %#v", idx, res)
+	}
+	if res[0].Node != "node1" || res[0].ServiceID != "db" ||
+		res[1].Node != "node2" || res[1].ServiceID != "db" {
+		t.Fatalf("bad: %#v", res)
+	}
+
+	// Removing the meta should fire the watch and drop the instance.
+	ws = memdb.NewWatchSet()
+	if _, _, err := s.ServiceNodesByMeta(ws, "probe", "true"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ns := &structs.NodeService{ID: "db", Service: "db"}
+	if err := s.EnsureService(7, "node1", ns); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	_, res, err = s.ServiceNodesByMeta(nil, "probe", "true")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(res) != 1 || res[0].Node != "node2" {
+		t.Fatalf("bad: %#v", res)
+	}
+}
+
+func TestStateStore_ChecksByIDPrefix(t *testing.T) {
+	s := testStateStore(t)
+
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterNode(t, s, 2, "node2")
+	testRegisterCheck(t, s, 3, "node1", "", "probe:a", structs.HealthPassing)
+	testRegisterCheck(t, s, 4, "node2", "", "probe:b", structs.HealthPassing)
+	testRegisterCheck(t, s, 5, "node2", "", "other", structs.HealthPassing)
+
+	ws := memdb.NewWatchSet()
+	idx, checks, err := s.ChecksByIDPrefix(ws, "probe:")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 5 || len(checks) != 2 {
+		t.Fatalf("bad: %d %#v", idx, checks)
+	}
+	if checks[0].Node != "node1" || checks[1].Node != "node2" {
+		t.Fatalf("bad: %#v", checks)
+	}
+
+	// Removing one should fire the watch.
+	if err := s.DeleteCheck(6, "node1", "probe:a"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	_, checks, err = s.ChecksByIDPrefix(nil, "probe:")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(checks) != 1 || checks[0].CheckID != "probe:b" {
+		t.Fatalf("bad: %#v", checks)
+	}
+}
+
 func TestStateStore_ServiceTagNodes(t *testing.T) {
 	s := testStateStore(t)
 
@@ -1472,6 +1986,97 @@ func TestStateStore_DeleteService(t *testing.T) {
 	}
 }
 
+// testInsertOrphanedCheck writes a check for a service that doesn't exist
+// straight into the table, since the normal paths won't allow it.
+func testInsertOrphanedCheck(t *testing.T, s *StateStore, idx uint64,
+	nodeID string, serviceID string, checkID types.CheckID) {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+	chk := &structs.HealthCheck{
+		Node:      nodeID,
+		CheckID:   checkID,
+		ServiceID: serviceID,
+		Status:    structs.HealthCritical,
+		RaftIndex: structs.RaftIndex{
+			CreateIndex: idx,
+			ModifyIndex: idx,
+		},
+	}
+	if err := tx.Insert("checks", chk); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"checks", idx}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	tx.Commit()
+}
+
+func TestStateStore_DeleteService_OrphanedChecks(t *testing.T) {
+	s := testStateStore(t)
+
+	// Set up a check whose service is already gone.
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterService(t, s, 2, "node1", "service1")
+	testRegisterCheck(t, s, 3, "node1", "service1", "check1", structs.HealthPassing)
+	testInsertOrphanedCheck(t, s, 4, "node1", "gone", "orphan")
+
+	// Deleting the missing service should still clean up its checks,
+	// without touching anything else.
+	ws := memdb.NewWatchSet()
+	if _, _, err := s.NodeChecks(ws, "node1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.DeleteService(5, "node1", "gone"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	_, checks, err := s.NodeChecks(nil, "node1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(checks) != 1 || checks[0].CheckID != "check1" {
+		t.Fatalf("bad: %#v", checks)
+	}
+	if idx := s.maxIndex("checks"); idx != 5 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	if idx := s.maxIndex("services"); idx != 2 {
+		t.Fatalf("bad index: %d", idx)
+	}
+}
+
+func TestStateStore_OrphanedChecks(t *testing.T) {
+	s := testStateStore(t)
+
+	// Nothing to report on an empty store.
+	orphans, err := s.OrphanedChecks()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(orphans) != 0 {
+		t.Fatalf("bad: %#v", orphans)
+	}
+
+	// Node-level checks and checks for live services aren't orphans.
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterService(t, s, 2, "node1", "service1")
+	testRegisterCheck(t, s, 3, "node1", "service1", "check1", structs.HealthPassing)
+	testRegisterCheck(t, s, 4, "node1", "", "check2", structs.HealthPassing)
+	testRegisterNode(t, s, 5, "node2")
+	testInsertOrphanedCheck(t, s, 6, "node1", "gone", "orphan1")
+	testInsertOrphanedCheck(t, s, 7, "node2", "service1", "orphan2")
+
+	orphans, err = s.OrphanedChecks()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(orphans) != 2 || orphans[0].CheckID != "orphan1" || orphans[1].CheckID != "orphan2" {
+		t.Fatalf("bad: %#v", orphans)
+	}
+}
+
 func TestStateStore_Service_Snapshot(t *testing.T) {
 	s := testStateStore(t)
 
@@ -2353,6 +2958,100 @@ func TestStateStore_CheckServiceTagNodes(t *testing.T) {
 	}
 }
 
+func TestStateStore_CheckServiceNodesByAddress(t *testing.T) {
+	s := testStateStore(t)
+
+	// Fill the catalog with instances that don't match, which the lookup
+	// shouldn't have to look at.
+	if err := s.EnsureNode(1, &structs.Node{Node: "other", Address: "10.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		svc := &structs.NodeService{
+			ID:      fmt.Sprintf("other%d", i),
+			Service: "other",
+			Address: fmt.Sprintf("10.0.1.%d", i),
+		}
+		if err := s.EnsureService(2, "other", svc); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Register a VIP on a service address, and as the address of a node
+	// with one service that falls back to it and one that doesn't.
+	if err := s.EnsureNode(3, &structs.Node{Node: "foo", Address: "10.0.0.2"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.EnsureService(4, "foo", &structs.NodeService{ID: "web", Service: "web", Address: "10.0.0.100"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.EnsureNode(5, &structs.Node{Node: "bar", Address: "10.0.0.100"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.EnsureService(6, "bar", &structs.NodeService{ID: "db", Service: "db"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.EnsureService(7, "bar", &structs.NodeService{ID: "api", Service: "api", Address: "10.0.0.3"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testRegisterCheck(t, s, 8, "bar", "db", "db-check", structs.HealthPassing)
+
+	// Count the services the lookups look at.
+	var looked int
+	serviceAddressHook = func(*structs.ServiceNode) { looked++ }
+	defer func() { serviceAddressHook = nil }()
+
+	ws := memdb.NewWatchSet()
+	idx, nodes, err := s.CheckServiceNodesByAddress(ws, "10.0.0.100")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 8 || len(nodes) != 2 {
+		t.Fatalf("bad: %d %v", idx, nodes)
+	}
+	if nodes[0].Node.Node != "foo" || nodes[0].Service.ID != "web" {
+		t.Fatalf("bad: %v", nodes[0])
+	}
+	if nodes[1].Node.Node != "bar" || nodes[1].Service.ID != "db" ||
+		len(nodes[1].Checks) != 1 || nodes[1].Checks[0].CheckID != "db-check" {
+		t.Fatalf("bad: %v", nodes[1])
+	}
+
+	// Only the matching service and the services on the matching node
+	// should have been looked at.
+	if looked != 3 {
+		t.Fatalf("bad: %d", looked)
+	}
+
+	// A service address only matches its own instance.
+	looked = 0
+	_, nodes, err = s.CheckServiceNodesByAddress(nil, "10.0.1.5")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(nodes) != 1 || nodes[0].Service.ID != "other5" || looked != 1 {
+		t.Fatalf("bad: %d %v", looked, nodes)
+	}
+
+	// Unknown addresses come back empty.
+	looked = 0
+	_, nodes, err = s.CheckServiceNodesByAddress(nil, "10.0.0.200")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if nodes != nil || looked != 0 {
+		t.Fatalf("bad: %d %v", looked, nodes)
+	}
+
+	// Moving a service off the address should fire the watch.
+	if err := s.EnsureService(9, "foo", &structs.NodeService{ID: "web", Service: "web", Address: "10.0.0.4"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+}
+
 func TestStateStore_Check_Snapshot(t *testing.T) {
 	s := testStateStore(t)
 
@@ -0,0 +1,192 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// CentralChecks is used to pull all the central check definitions from the
+// snapshot.
+func (s *StateSnapshot) CentralChecks() (structs.CentralChecks, error) {
+	checks, err := s.tx.Get("central-checks", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	var ret structs.CentralChecks
+	for check := checks.Next(); check != nil; check = checks.Next() {
+		ret = append(ret, check.(*structs.CentralCheck))
+	}
+	return ret, nil
+}
+
+// CentralCheck is used when restoring from a snapshot. For general inserts,
+// use CentralCheckSet.
+func (s *StateRestore) CentralCheck(check *structs.CentralCheck) error {
+	if err := s.tx.Insert("central-checks", check); err != nil {
+		return fmt.Errorf("failed restoring central check: %s", err)
+	}
+	if err := indexUpdateMaxTxn(s.tx, check.ModifyIndex, "central-checks"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	return nil
+}
+
+// CentralCheckSet is used to create or update a central check definition.
+func (s *StateStore) CentralCheckSet(idx uint64, check *structs.CentralCheck) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	if err := s.centralCheckSetTxn(tx, idx, check); err != nil {
+		return err
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// centralCheckSetTxn is the inner method used to insert a central check
+// definition with the proper indexes into the state store.
+func (s *StateStore) centralCheckSetTxn(tx *memdb.Txn, idx uint64, check *structs.CentralCheck) error {
+	// Check that the ID is set.
+	if check.ID == "" {
+		return ErrMissingCentralCheckID
+	}
+
+	// Check for an existing definition.
+	existing, err := tx.First("central-checks", "id", check.ID)
+	if err != nil {
+		return fmt.Errorf("failed central check lookup: %s", err)
+	}
+
+	// Set the indexes.
+	if existing != nil {
+		check.CreateIndex = existing.(*structs.CentralCheck).CreateIndex
+		check.ModifyIndex = idx
+	} else {
+		check.CreateIndex = idx
+		check.ModifyIndex = idx
+	}
+
+	// Insert the definition and update the index.
+	if err := tx.Insert("central-checks", check); err != nil {
+		return fmt.Errorf("failed inserting central check: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"central-checks", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	return nil
+}
+
+// CentralCheckDelete deletes the given central check definition by ID.
+func (s *StateStore) CentralCheckDelete(idx uint64, checkID string) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Pull the definition.
+	check, err := tx.First("central-checks", "id", checkID)
+	if err != nil {
+		return fmt.Errorf("failed central check lookup: %s", err)
+	}
+	if check == nil {
+		return nil
+	}
+
+	// Delete the definition and update the index.
+	if err := tx.Delete("central-checks", check); err != nil {
+		return fmt.Errorf("failed central check delete: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"central-checks", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// CentralCheckGet returns the given central check definition by ID.
+func (s *StateStore) CentralCheckGet(ws memdb.WatchSet, checkID string) (uint64, *structs.CentralCheck, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "central-checks")
+
+	// Look up the definition by its ID.
+	watchCh, check, err := tx.FirstWatch("central-checks", "id", checkID)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed central check lookup: %s", err)
+	}
+	ws.Add(watchCh)
+	if check == nil {
+		return idx, nil, nil
+	}
+	return idx, check.(*structs.CentralCheck), nil
+}
+
+// CentralCheckList returns all the central check definitions.
+func (s *StateStore) CentralCheckList(ws memdb.WatchSet) (uint64, structs.CentralChecks, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "central-checks")
+
+	// Query all of the definitions.
+	checks, err := tx.Get("central-checks", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed central check lookup: %s", err)
+	}
+	ws.Add(checks.WatchCh())
+
+	// Go over all of the definitions and build the response.
+	var result structs.CentralChecks
+	for check := checks.Next(); check != nil; check = checks.Next() {
+		result = append(result, check.(*structs.CentralCheck))
+	}
+	return idx, result, nil
+}
+
+// NodeCentralChecks returns the central check definitions whose selectors
+// match the given node. The watch set will fire if the definitions change
+// or if the node's registration changes, since that might change which
+// definitions apply. An unknown node doesn't match any definitions.
+func (s *StateStore) NodeCentralChecks(ws memdb.WatchSet, nodeName string) (uint64, structs.CentralChecks, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "central-checks", "nodes")
+
+	// Look up the node.
+	watchCh, n, err := tx.FirstWatch("nodes", "id", nodeName)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed node lookup: %s", err)
+	}
+	ws.Add(watchCh)
+	if n == nil {
+		return idx, nil, nil
+	}
+	node := n.(*structs.Node)
+
+	// Query all of the definitions.
+	checks, err := tx.Get("central-checks", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed central check lookup: %s", err)
+	}
+	ws.Add(checks.WatchCh())
+
+	// Keep the ones that apply to this node.
+	var result structs.CentralChecks
+	for c := checks.Next(); c != nil; c = checks.Next() {
+		check := c.(*structs.CentralCheck)
+		if check.Matches(node.Meta) {
+			result = append(result, check)
+		}
+	}
+	return idx, result, nil
+}
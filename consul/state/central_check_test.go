@@ -0,0 +1,239 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+func TestStateStore_CentralCheck_SetGetDelete(t *testing.T) {
+	s := testStateStore(t)
+
+	// Querying with no results returns nil.
+	ws := memdb.NewWatchSet()
+	idx, res, err := s.CentralCheckGet(ws, testUUID())
+	if idx != 0 || res != nil || err != nil {
+		t.Fatalf("expected (0, nil, nil), got: (%d, %#v, %#v)", idx, res, err)
+	}
+
+	// Inserting a definition with empty ID is disallowed.
+	if err := s.CentralCheckSet(1, &structs.CentralCheck{}); err != ErrMissingCentralCheckID {
+		t.Fatalf("expected %#v, got: %#v", ErrMissingCentralCheckID, err)
+	}
+	if idx := s.maxIndex("central-checks"); idx != 0 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Create a definition.
+	check := &structs.CentralCheck{
+		ID:       testUUID(),
+		Name:     "disk",
+		NodeMeta: map[string]string{"rack": "a"},
+		Script:   "/bin/check-disk",
+		Interval: 10 * time.Second,
+	}
+	if err := s.CentralCheckSet(2, check); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	ws = memdb.NewWatchSet()
+	idx, res, err = s.CentralCheckGet(ws, check.ID)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2 || res.CreateIndex != 2 || res.ModifyIndex != 2 {
+		t.Fatalf("bad: %d %#v", idx, res)
+	}
+	if !reflect.DeepEqual(res, check) {
+		t.Fatalf("bad: %#v", res)
+	}
+
+	// Update it and make sure the create index is kept.
+	update := *check
+	update.Interval = 30 * time.Second
+	if err := s.CentralCheckSet(3, &update); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	idx, res, err = s.CentralCheckGet(nil, check.ID)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 3 || res.CreateIndex != 2 || res.ModifyIndex != 3 || res.Interval != 30*time.Second {
+		t.Fatalf("bad: %d %#v", idx, res)
+	}
+
+	// Deleting an unknown definition is a no-op.
+	if err := s.CentralCheckDelete(4, testUUID()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx := s.maxIndex("central-checks"); idx != 3 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Now delete it for real.
+	ws = memdb.NewWatchSet()
+	if _, _, err := s.CentralCheckList(ws); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.CentralCheckDelete(5, check.ID); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	idx, checks, err := s.CentralCheckList(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 5 || len(checks) != 0 {
+		t.Fatalf("bad: %d %#v", idx, checks)
+	}
+}
+
+func TestStateStore_NodeCentralChecks(t *testing.T) {
+	s := testStateStore(t)
+
+	// An unknown node gets nothing, but should wake up when it registers.
+	ws := memdb.NewWatchSet()
+	_, checks, err := s.NodeCentralChecks(ws, "foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(checks) != 0 {
+		t.Fatalf("bad: %#v", checks)
+	}
+	testRegisterNodeWithMeta(t, s, 1, "foo", map[string]string{"rack": "a"})
+	testRegisterNodeWithMeta(t, s, 2, "bar", map[string]string{"rack": "b"})
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	// Add one definition for rack a and one for everyone.
+	rackA := &structs.CentralCheck{
+		ID:       testUUID(),
+		Name:     "rack-a",
+		NodeMeta: map[string]string{"rack": "a"},
+		TTL:      time.Minute,
+	}
+	if err := s.CentralCheckSet(3, rackA); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	all := &structs.CentralCheck{
+		ID:   testUUID(),
+		Name: "all",
+		TTL:  time.Minute,
+	}
+	if err := s.CentralCheckSet(4, all); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ws = memdb.NewWatchSet()
+	idx, checks, err := s.NodeCentralChecks(ws, "foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 4 || len(checks) != 2 {
+		t.Fatalf("bad: %d %#v", idx, checks)
+	}
+	_, checks, err = s.NodeCentralChecks(nil, "bar")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(checks) != 1 || checks[0].ID != all.ID {
+		t.Fatalf("bad: %#v", checks)
+	}
+
+	// Moving the node to another rack should fire the watch and change
+	// what it gets.
+	testRegisterNodeWithMeta(t, s, 5, "foo", map[string]string{"rack": "b"})
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	idx, checks, err = s.NodeCentralChecks(nil, "foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 5 || len(checks) != 1 || checks[0].ID != all.ID {
+		t.Fatalf("bad: %d %#v", idx, checks)
+	}
+}
+
+func TestStateStore_CentralCheck_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+
+	checks := structs.CentralChecks{
+		&structs.CentralCheck{
+			ID:       testUUID(),
+			Name:     "disk",
+			NodeMeta: map[string]string{"rack": "a"},
+			HTTP:     "http://localhost:8080/health",
+			Interval: 10 * time.Second,
+		},
+		&structs.CentralCheck{
+			ID:   testUUID(),
+			Name: "ttl",
+			TTL:  time.Minute,
+		},
+	}
+	for i, check := range checks {
+		if err := s.CentralCheckSet(uint64(i+1), check); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Snapshot the definitions.
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	if err := s.CentralCheckDelete(3, checks[0].ID); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Verify the snapshot.
+	dump, err := snap.CentralChecks()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(dump) != 2 {
+		t.Fatalf("bad: %#v", dump)
+	}
+
+	// Restore the values into a new state store.
+	func() {
+		s := testStateStore(t)
+		restore := s.Restore()
+		for _, check := range dump {
+			if err := restore.CentralCheck(check); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+		restore.Commit()
+
+		idx, res, err := s.CentralCheckList(nil)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 2 || len(res) != 2 {
+			t.Fatalf("bad: %d %#v", idx, res)
+		}
+		for _, check := range checks {
+			_, got, err := s.CentralCheckGet(nil, check.ID)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if !reflect.DeepEqual(got, check) {
+				t.Fatalf("bad: %#v", got)
+			}
+		}
+	}()
+}
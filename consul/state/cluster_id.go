@@ -0,0 +1,81 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// ClusterID is used to pull the cluster ID from the snapshot.
+func (s *StateSnapshot) ClusterID() (*structs.ClusterID, error) {
+	c, err := s.tx.First("cluster-id", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	id, ok := c.(*structs.ClusterID)
+	if !ok {
+		return nil, nil
+	}
+
+	return id, nil
+}
+
+// ClusterID is used when restoring from a snapshot.
+func (s *StateRestore) ClusterID(id *structs.ClusterID) error {
+	if err := s.tx.Insert("cluster-id", id); err != nil {
+		return fmt.Errorf("failed restoring cluster ID: %s", err)
+	}
+
+	return nil
+}
+
+// ClusterID is used to get the cluster ID. This returns nil if it hasn't been
+// set yet.
+func (s *StateStore) ClusterID(ws memdb.WatchSet) (uint64, *structs.ClusterID, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	watchCh, c, err := tx.FirstWatch("cluster-id", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed cluster ID lookup: %s", err)
+	}
+	ws.Add(watchCh)
+
+	id, ok := c.(*structs.ClusterID)
+	if !ok {
+		return 0, nil, nil
+	}
+
+	return id.ModifyIndex, id, nil
+}
+
+// ClusterIDSet is used to set the cluster ID. The ID never changes once it's
+// set, so this does nothing if there's already one.
+func (s *StateStore) ClusterIDSet(idx uint64, id *structs.ClusterID) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	if id.ID == "" {
+		return ErrMissingClusterID
+	}
+
+	// Check for an existing ID.
+	existing, err := tx.First("cluster-id", "id")
+	if err != nil {
+		return fmt.Errorf("failed cluster ID lookup: %s", err)
+	}
+	if existing != nil {
+		return nil
+	}
+
+	id.CreateIndex = idx
+	id.ModifyIndex = idx
+	if err := tx.Insert("cluster-id", id); err != nil {
+		return fmt.Errorf("failed inserting cluster ID: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
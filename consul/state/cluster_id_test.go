@@ -0,0 +1,89 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+func TestStateStore_ClusterID(t *testing.T) {
+	s := testStateStore(t)
+
+	// Should start out unset.
+	ws := memdb.NewWatchSet()
+	idx, id, err := s.ClusterID(ws)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 || id != nil {
+		t.Fatalf("bad: %d %#v", idx, id)
+	}
+
+	// The ID is required.
+	if err := s.ClusterIDSet(1, &structs.ClusterID{}); err != ErrMissingClusterID {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := &structs.ClusterID{ID: "a5cd2e6b-4d6f-4f0b-9bd0-6d6fb5f6a1d2"}
+	if err := s.ClusterIDSet(2, expected); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	idx, id, err = s.ClusterID(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2 || !reflect.DeepEqual(id, expected) {
+		t.Fatalf("bad: %d %#v", idx, id)
+	}
+
+	// Setting it again shouldn't change it.
+	if err := s.ClusterIDSet(3, &structs.ClusterID{ID: "nope"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, id, err = s.ClusterID(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2 || id.ID != expected.ID {
+		t.Fatalf("bad: %d %#v", idx, id)
+	}
+}
+
+func TestStateStore_ClusterID_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+	before := &structs.ClusterID{ID: "a5cd2e6b-4d6f-4f0b-9bd0-6d6fb5f6a1d2"}
+	if err := s.ClusterIDSet(99, before); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	snapped, err := snap.ClusterID()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(snapped, before) {
+		t.Fatalf("bad: %#v", snapped)
+	}
+
+	s2 := testStateStore(t)
+	restore := s2.Restore()
+	if err := restore.ClusterID(snapped); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	restore.Commit()
+
+	idx, res, err := s2.ClusterID(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 99 || !reflect.DeepEqual(res, before) {
+		t.Fatalf("bad: %d %#v", idx, res)
+	}
+}
@@ -0,0 +1,43 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// ConsistentRead runs the given sub-queries against a single transaction, so
+// they all see the catalog as it was at one point in time. The index is the
+// highest index of the tables that were read.
+func (s *StateStore) ConsistentRead(ws memdb.WatchSet, queries []string) (uint64, *structs.ConsistentReadResults, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	var idx uint64
+	results := &structs.ConsistentReadResults{}
+	for _, query := range queries {
+		var err error
+		switch query {
+		case structs.ConsistentReadNodes:
+			results.Nodes, err = s.nodesTxn(tx, ws)
+		case structs.ConsistentReadServices:
+			results.Services, err = s.servicesTxn(tx, ws)
+		case structs.ConsistentReadChecks:
+			results.Checks, err = s.checksInStateTxn(tx, ws, structs.HealthAny)
+		case structs.ConsistentReadCoordinates:
+			results.Coordinates, err = s.coordinatesTxn(tx, ws)
+		default:
+			return 0, nil, fmt.Errorf("Unknown sub-query %q", query)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+
+		// The sub-query names are the same as their table names.
+		if tableIdx := maxIndexTxn(tx, query); tableIdx > idx {
+			idx = tableIdx
+		}
+	}
+	return idx, results, nil
+}
@@ -0,0 +1,55 @@
+package state
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+func TestStateStore_ConsistentRead(t *testing.T) {
+	s := testStateStore(t)
+
+	testRegisterNode(t, s, 1, "foo")
+	testRegisterService(t, s, 2, "foo", "web")
+	testRegisterCheck(t, s, 3, "foo", "web", "web-check", structs.HealthPassing)
+	updates := structs.Coordinates{
+		&structs.Coordinate{Node: "foo", Coord: generateRandomCoordinate()},
+	}
+	if err := s.CoordinateBatchUpdate(4, updates); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Only the tables that are read count towards the index.
+	ws := memdb.NewWatchSet()
+	idx, results, err := s.ConsistentRead(ws, []string{"nodes", "services"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2 || len(results.Nodes) != 1 || len(results.Services) != 1 ||
+		results.Checks != nil || results.Coordinates != nil {
+		t.Fatalf("bad: %d %#v", idx, results)
+	}
+
+	idx, results, err = s.ConsistentRead(nil, []string{"checks", "coordinates"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 4 || len(results.Checks) != 1 || len(results.Coordinates) != 1 ||
+		results.Nodes != nil || results.Services != nil {
+		t.Fatalf("bad: %d %#v", idx, results)
+	}
+
+	// A change to a table that was read should fire the watch.
+	testRegisterService(t, s, 5, "foo", "db")
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	// Unknown sub-queries are an error.
+	_, _, err = s.ConsistentRead(nil, []string{"nodes", "kvs"})
+	if err == nil || !strings.Contains(err.Error(), "Unknown sub-query") {
+		t.Fatalf("err: %v", err)
+	}
+}
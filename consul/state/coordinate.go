@@ -25,6 +25,7 @@ func (s *StateRestore) Coordinates(idx uint64, updates structs.Coordinates) erro
 		if err := s.tx.Insert("coordinates", update); err != nil {
 			return fmt.Errorf("failed restoring coordinate: %s", err)
 		}
+		s.store.sizes.insertTxn(s.tx, "coordinates", nil, update)
 	}
 
 	if err := indexUpdateMaxTxn(s.tx, idx, "coordinates"); err != nil {
@@ -64,10 +65,19 @@ func (s *StateStore) Coordinates(ws memdb.WatchSet) (uint64, structs.Coordinates
 	// Get the table index.
 	idx := maxIndexTxn(tx, "coordinates")
 
+	coords, err := s.coordinatesTxn(tx, ws)
+	if err != nil {
+		return 0, nil, err
+	}
+	return idx, coords, nil
+}
+
+// coordinatesTxn returns all the coordinates, using the given transaction.
+func (s *StateStore) coordinatesTxn(tx *memdb.Txn, ws memdb.WatchSet) (structs.Coordinates, error) {
 	// Pull all the coordinates.
 	iter, err := tx.Get("coordinates", "id")
 	if err != nil {
-		return 0, nil, fmt.Errorf("failed coordinate lookup: %s", err)
+		return nil, fmt.Errorf("failed coordinate lookup: %s", err)
 	}
 	ws.Add(iter.WatchCh())
 
@@ -75,7 +85,7 @@ func (s *StateStore) Coordinates(ws memdb.WatchSet) (uint64, structs.Coordinates
 	for coord := iter.Next(); coord != nil; coord = iter.Next() {
 		results = append(results, coord.(*structs.Coordinate))
 	}
-	return idx, results, nil
+	return results, nil
 }
 
 // CoordinateBatchUpdate processes a batch of coordinate updates and applies
@@ -102,9 +112,14 @@ func (s *StateStore) CoordinateBatchUpdate(idx uint64, updates structs.Coordinat
 			continue
 		}
 
+		existing, err := tx.First("coordinates", "id", update.Node)
+		if err != nil {
+			return fmt.Errorf("failed coordinate lookup: %s", err)
+		}
 		if err := tx.Insert("coordinates", update); err != nil {
 			return fmt.Errorf("failed inserting coordinate: %s", err)
 		}
+		s.sizes.insertTxn(tx, "coordinates", existing, update)
 	}
 
 	// Update the index.
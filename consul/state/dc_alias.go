@@ -0,0 +1,165 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// DatacenterAliases is used to pull all the datacenter aliases from the
+// snapshot.
+func (s *StateSnapshot) DatacenterAliases() (structs.DatacenterAliases, error) {
+	aliases, err := s.tx.Get("dc-aliases", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	var ret structs.DatacenterAliases
+	for alias := aliases.Next(); alias != nil; alias = aliases.Next() {
+		ret = append(ret, alias.(*structs.DatacenterAlias))
+	}
+	return ret, nil
+}
+
+// DatacenterAlias is used when restoring from a snapshot. For general
+// inserts, use DatacenterAliasSet.
+func (s *StateRestore) DatacenterAlias(alias *structs.DatacenterAlias) error {
+	if err := s.tx.Insert("dc-aliases", alias); err != nil {
+		return fmt.Errorf("failed restoring datacenter alias: %s", err)
+	}
+	if err := indexUpdateMaxTxn(s.tx, alias.ModifyIndex, "dc-aliases"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	return nil
+}
+
+// DatacenterAliasSet is used to create or update a datacenter alias. Aliases
+// have to point straight at a canonical name, so this rejects aliases that
+// would point at another alias, or that another alias already points at.
+// That also rules out any cycles.
+func (s *StateStore) DatacenterAliasSet(idx uint64, alias *structs.DatacenterAlias) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	if alias.Alias == "" || alias.Canonical == "" {
+		return ErrMissingDatacenterAlias
+	}
+	if alias.Alias == alias.Canonical {
+		return fmt.Errorf("Datacenter alias %q can't point to itself", alias.Alias)
+	}
+
+	// Make sure the canonical name isn't an alias itself.
+	target, err := tx.First("dc-aliases", "id", alias.Canonical)
+	if err != nil {
+		return fmt.Errorf("failed datacenter alias lookup: %s", err)
+	}
+	if target != nil {
+		return fmt.Errorf("Datacenter alias %q can't point to %q, which is an alias for %q",
+			alias.Alias, alias.Canonical, target.(*structs.DatacenterAlias).Canonical)
+	}
+
+	// Make sure nothing already points at the alias.
+	source, err := tx.First("dc-aliases", "canonical", alias.Alias)
+	if err != nil {
+		return fmt.Errorf("failed datacenter alias lookup: %s", err)
+	}
+	if source != nil {
+		return fmt.Errorf("Datacenter alias %q can't be added since alias %q points to it",
+			alias.Alias, source.(*structs.DatacenterAlias).Alias)
+	}
+
+	// Set the indexes.
+	existing, err := tx.First("dc-aliases", "id", alias.Alias)
+	if err != nil {
+		return fmt.Errorf("failed datacenter alias lookup: %s", err)
+	}
+	if existing != nil {
+		alias.CreateIndex = existing.(*structs.DatacenterAlias).CreateIndex
+	} else {
+		alias.CreateIndex = idx
+	}
+	alias.ModifyIndex = idx
+
+	// Insert the alias and update the index.
+	if err := tx.Insert("dc-aliases", alias); err != nil {
+		return fmt.Errorf("failed inserting datacenter alias: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"dc-aliases", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// DatacenterAliasDelete deletes the given datacenter alias.
+func (s *StateStore) DatacenterAliasDelete(idx uint64, name string) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Pull the alias.
+	alias, err := tx.First("dc-aliases", "id", name)
+	if err != nil {
+		return fmt.Errorf("failed datacenter alias lookup: %s", err)
+	}
+	if alias == nil {
+		return nil
+	}
+
+	// Delete the alias and update the index.
+	if err := tx.Delete("dc-aliases", alias); err != nil {
+		return fmt.Errorf("failed datacenter alias delete: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"dc-aliases", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// DatacenterAliasGet returns the given datacenter alias, or nil if there's no
+// alias by that name.
+func (s *StateStore) DatacenterAliasGet(ws memdb.WatchSet, name string) (uint64, *structs.DatacenterAlias, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "dc-aliases")
+
+	// Look up the alias by name.
+	watchCh, alias, err := tx.FirstWatch("dc-aliases", "id", name)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed datacenter alias lookup: %s", err)
+	}
+	ws.Add(watchCh)
+	if alias == nil {
+		return idx, nil, nil
+	}
+	return idx, alias.(*structs.DatacenterAlias), nil
+}
+
+// DatacenterAliasList returns all the datacenter aliases.
+func (s *StateStore) DatacenterAliasList(ws memdb.WatchSet) (uint64, structs.DatacenterAliases, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "dc-aliases")
+
+	// Query all of the aliases.
+	aliases, err := tx.Get("dc-aliases", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed datacenter alias lookup: %s", err)
+	}
+	ws.Add(aliases.WatchCh())
+
+	// Go over all of the aliases and build the response.
+	var result structs.DatacenterAliases
+	for alias := aliases.Next(); alias != nil; alias = aliases.Next() {
+		result = append(result, alias.(*structs.DatacenterAlias))
+	}
+	return idx, result, nil
+}
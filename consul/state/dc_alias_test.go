@@ -0,0 +1,182 @@
+package state
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+func TestStateStore_DatacenterAlias_CRUD(t *testing.T) {
+	s := testStateStore(t)
+
+	// Should start out empty.
+	ws := memdb.NewWatchSet()
+	idx, alias, err := s.DatacenterAliasGet(ws, "old")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 || alias != nil {
+		t.Fatalf("bad: %d %#v", idx, alias)
+	}
+
+	// Both names are required.
+	for _, bad := range []*structs.DatacenterAlias{
+		&structs.DatacenterAlias{Alias: "old"},
+		&structs.DatacenterAlias{Canonical: "new"},
+	} {
+		if err := s.DatacenterAliasSet(1, bad); err != ErrMissingDatacenterAlias {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Add an alias.
+	expected := &structs.DatacenterAlias{Alias: "old", Canonical: "new"}
+	if err := s.DatacenterAliasSet(1, expected); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	idx, alias, err = s.DatacenterAliasGet(nil, "old")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 1 || !reflect.DeepEqual(alias, expected) {
+		t.Fatalf("bad: %d %#v", idx, alias)
+	}
+
+	// Repoint it, which should keep the create index.
+	if err := s.DatacenterAliasSet(2, &structs.DatacenterAlias{Alias: "old", Canonical: "newer"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, alias, err = s.DatacenterAliasGet(nil, "old")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2 || alias.Canonical != "newer" || alias.CreateIndex != 1 || alias.ModifyIndex != 2 {
+		t.Fatalf("bad: %d %#v", idx, alias)
+	}
+
+	// Add another and list them.
+	if err := s.DatacenterAliasSet(3, &structs.DatacenterAlias{Alias: "older", Canonical: "newer"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ws = memdb.NewWatchSet()
+	idx, aliases, err := s.DatacenterAliasList(ws)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 3 || len(aliases) != 2 || aliases[0].Alias != "old" || aliases[1].Alias != "older" {
+		t.Fatalf("bad: %d %#v", idx, aliases)
+	}
+
+	// Deleting an unknown alias is a no-op.
+	if err := s.DatacenterAliasDelete(4, "nope"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx := s.maxIndex("dc-aliases"); idx != 3 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Now delete one for real.
+	if err := s.DatacenterAliasDelete(5, "old"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	idx, aliases, err = s.DatacenterAliasList(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 5 || len(aliases) != 1 || aliases[0].Alias != "older" {
+		t.Fatalf("bad: %d %#v", idx, aliases)
+	}
+}
+
+func TestStateStore_DatacenterAlias_Chains(t *testing.T) {
+	s := testStateStore(t)
+
+	if err := s.DatacenterAliasSet(1, &structs.DatacenterAlias{Alias: "b", Canonical: "c"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cases := []struct {
+		alias    *structs.DatacenterAlias
+		expected string
+	}{
+		{&structs.DatacenterAlias{Alias: "a", Canonical: "a"}, "can't point to itself"},
+		{&structs.DatacenterAlias{Alias: "a", Canonical: "b"}, "which is an alias"},
+		{&structs.DatacenterAlias{Alias: "c", Canonical: "a"}, "points to it"},
+		{&structs.DatacenterAlias{Alias: "c", Canonical: "b"}, "which is an alias"},
+	}
+	for _, tc := range cases {
+		err := s.DatacenterAliasSet(2, tc.alias)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("bad: %#v %v", tc.alias, err)
+		}
+	}
+
+	// Nothing should have changed.
+	idx, aliases, err := s.DatacenterAliasList(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 1 || len(aliases) != 1 {
+		t.Fatalf("bad: %d %#v", idx, aliases)
+	}
+}
+
+func TestStateStore_DatacenterAlias_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+	before := structs.DatacenterAliases{
+		&structs.DatacenterAlias{Alias: "a", Canonical: "new"},
+		&structs.DatacenterAlias{Alias: "b", Canonical: "new"},
+	}
+	for i, alias := range before {
+		if err := s.DatacenterAliasSet(uint64(i+1), alias); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Snapshot the aliases.
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	if err := s.DatacenterAliasDelete(3, "a"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Verify the snapshot.
+	dump, err := snap.DatacenterAliases()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(dump, before) {
+		t.Fatalf("bad: %#v", dump)
+	}
+
+	// Restore the values into a new state store.
+	func() {
+		s := testStateStore(t)
+		restore := s.Restore()
+		for _, alias := range dump {
+			if err := restore.DatacenterAlias(alias); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+		restore.Commit()
+
+		idx, res, err := s.DatacenterAliasList(nil)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 2 || !reflect.DeepEqual(res, before) {
+			t.Fatalf("bad: %d %#v", idx, res)
+		}
+	}()
+}
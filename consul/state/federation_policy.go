@@ -0,0 +1,151 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// FederationPolicies is used to pull all the federation policies from the
+// snapshot.
+func (s *StateSnapshot) FederationPolicies() (structs.FederationPolicies, error) {
+	policies, err := s.tx.Get("federation-policies", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	var ret structs.FederationPolicies
+	for policy := policies.Next(); policy != nil; policy = policies.Next() {
+		ret = append(ret, policy.(*structs.FederationPolicy))
+	}
+	return ret, nil
+}
+
+// FederationPolicy is used when restoring from a snapshot. For general
+// inserts, use FederationPolicySet.
+func (s *StateRestore) FederationPolicy(policy *structs.FederationPolicy) error {
+	if err := s.tx.Insert("federation-policies", policy); err != nil {
+		return fmt.Errorf("failed restoring federation policy: %s", err)
+	}
+	if err := indexUpdateMaxTxn(s.tx, policy.ModifyIndex, "federation-policies"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	return nil
+}
+
+// FederationPolicySet is used to create or update the federation policy for a
+// datacenter.
+func (s *StateStore) FederationPolicySet(idx uint64, policy *structs.FederationPolicy) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	if policy.Datacenter == "" {
+		return ErrMissingFederationPolicy
+	}
+	switch policy.Forwarding {
+	case structs.FederationForwardNone, structs.FederationForwardReads, structs.FederationForwardAll:
+	default:
+		return fmt.Errorf("Invalid federation forwarding %q", policy.Forwarding)
+	}
+	switch policy.Decommission {
+	case structs.DecommissionNone, structs.DecommissionMarked, structs.DecommissionPurged:
+	default:
+		return fmt.Errorf("Invalid decommission state %q", policy.Decommission)
+	}
+
+	// Set the indexes.
+	existing, err := tx.First("federation-policies", "id", policy.Datacenter)
+	if err != nil {
+		return fmt.Errorf("failed federation policy lookup: %s", err)
+	}
+	if existing != nil {
+		policy.CreateIndex = existing.(*structs.FederationPolicy).CreateIndex
+	} else {
+		policy.CreateIndex = idx
+	}
+	policy.ModifyIndex = idx
+
+	// Insert the policy and update the index.
+	if err := tx.Insert("federation-policies", policy); err != nil {
+		return fmt.Errorf("failed inserting federation policy: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"federation-policies", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// FederationPolicyDelete deletes the federation policy for the given
+// datacenter, which goes back to having all requests forwarded.
+func (s *StateStore) FederationPolicyDelete(idx uint64, dc string) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Pull the policy.
+	policy, err := tx.First("federation-policies", "id", dc)
+	if err != nil {
+		return fmt.Errorf("failed federation policy lookup: %s", err)
+	}
+	if policy == nil {
+		return nil
+	}
+
+	// Delete the policy and update the index.
+	if err := tx.Delete("federation-policies", policy); err != nil {
+		return fmt.Errorf("failed federation policy delete: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"federation-policies", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// FederationPolicyGet returns the federation policy for the given datacenter,
+// or nil if it doesn't have one.
+func (s *StateStore) FederationPolicyGet(ws memdb.WatchSet, dc string) (uint64, *structs.FederationPolicy, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "federation-policies")
+
+	// Look up the policy by datacenter.
+	watchCh, policy, err := tx.FirstWatch("federation-policies", "id", dc)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed federation policy lookup: %s", err)
+	}
+	ws.Add(watchCh)
+	if policy == nil {
+		return idx, nil, nil
+	}
+	return idx, policy.(*structs.FederationPolicy), nil
+}
+
+// FederationPolicyList returns all the federation policies.
+func (s *StateStore) FederationPolicyList(ws memdb.WatchSet) (uint64, structs.FederationPolicies, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "federation-policies")
+
+	// Query all of the policies.
+	policies, err := tx.Get("federation-policies", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed federation policy lookup: %s", err)
+	}
+	ws.Add(policies.WatchCh())
+
+	// Go over all of the policies and build the response.
+	var result structs.FederationPolicies
+	for policy := policies.Next(); policy != nil; policy = policies.Next() {
+		result = append(result, policy.(*structs.FederationPolicy))
+	}
+	return idx, result, nil
+}
@@ -0,0 +1,165 @@
+package state
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+func TestStateStore_FederationPolicy_CRUD(t *testing.T) {
+	s := testStateStore(t)
+
+	// Should start out empty.
+	ws := memdb.NewWatchSet()
+	idx, policy, err := s.FederationPolicyGet(ws, "dc2")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 || policy != nil {
+		t.Fatalf("bad: %d %#v", idx, policy)
+	}
+
+	// The datacenter is required, and the forwarding must be valid.
+	err = s.FederationPolicySet(1, &structs.FederationPolicy{Forwarding: structs.FederationForwardNone})
+	if err != ErrMissingFederationPolicy {
+		t.Fatalf("err: %v", err)
+	}
+	err = s.FederationPolicySet(1, &structs.FederationPolicy{Datacenter: "dc2", Forwarding: "some"})
+	if err == nil || !strings.Contains(err.Error(), "Invalid federation forwarding") {
+		t.Fatalf("err: %v", err)
+	}
+	err = s.FederationPolicySet(1, &structs.FederationPolicy{Datacenter: "dc2", Forwarding: structs.FederationForwardAll, Decommission: "gone"})
+	if err == nil || !strings.Contains(err.Error(), "Invalid decommission state") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Add a policy.
+	expected := &structs.FederationPolicy{
+		Datacenter: "dc2",
+		Forwarding: structs.FederationForwardNone,
+	}
+	if err := s.FederationPolicySet(1, expected); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	idx, policy, err = s.FederationPolicyGet(nil, "dc2")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 1 || !reflect.DeepEqual(policy, expected) {
+		t.Fatalf("bad: %d %#v", idx, policy)
+	}
+
+	// Update it, which should keep the create index.
+	update := &structs.FederationPolicy{
+		Datacenter: "dc2",
+		Forwarding: structs.FederationForwardReads,
+	}
+	if err := s.FederationPolicySet(2, update); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, policy, err = s.FederationPolicyGet(nil, "dc2")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2 || policy.Forwarding != structs.FederationForwardReads ||
+		policy.CreateIndex != 1 || policy.ModifyIndex != 2 {
+		t.Fatalf("bad: %d %#v", idx, policy)
+	}
+
+	// Add another and list them.
+	other := &structs.FederationPolicy{
+		Datacenter: "dc3",
+		Forwarding: structs.FederationForwardAll,
+	}
+	if err := s.FederationPolicySet(3, other); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ws = memdb.NewWatchSet()
+	idx, policies, err := s.FederationPolicyList(ws)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 3 || len(policies) != 2 || policies[0].Datacenter != "dc2" || policies[1].Datacenter != "dc3" {
+		t.Fatalf("bad: %d %#v", idx, policies)
+	}
+
+	// Deleting an unknown policy is a no-op.
+	if err := s.FederationPolicyDelete(4, "nope"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx := s.maxIndex("federation-policies"); idx != 3 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Now delete one for real.
+	if err := s.FederationPolicyDelete(5, "dc2"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	idx, policies, err = s.FederationPolicyList(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 5 || len(policies) != 1 || policies[0].Datacenter != "dc3" {
+		t.Fatalf("bad: %d %#v", idx, policies)
+	}
+}
+
+func TestStateStore_FederationPolicy_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+	before := structs.FederationPolicies{
+		&structs.FederationPolicy{Datacenter: "dc2", Forwarding: structs.FederationForwardNone},
+		&structs.FederationPolicy{Datacenter: "dc3", Forwarding: structs.FederationForwardReads},
+	}
+	for i, policy := range before {
+		if err := s.FederationPolicySet(uint64(i+1), policy); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Snapshot the policies.
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	if err := s.FederationPolicyDelete(3, "dc2"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Verify the snapshot.
+	dump, err := snap.FederationPolicies()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(dump, before) {
+		t.Fatalf("bad: %#v", dump)
+	}
+
+	// Restore the values into a new state store.
+	func() {
+		s := testStateStore(t)
+		restore := s.Restore()
+		for _, policy := range dump {
+			if err := restore.FederationPolicy(policy); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+		restore.Commit()
+
+		idx, res, err := s.FederationPolicyList(nil)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 2 || !reflect.DeepEqual(res, before) {
+			t.Fatalf("bad: %d %#v", idx, res)
+		}
+	}()
+}
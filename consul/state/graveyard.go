@@ -10,6 +10,12 @@ import (
 type Tombstone struct {
 	Key   string
 	Index uint64
+
+	// Prefix is set if the tombstone stands in for every key under Key,
+	// rather than just Key itself. These are made when a tree is deleted
+	// without tracking the individual keys, so that listings of anything
+	// under the prefix still see the delete.
+	Prefix bool
 }
 
 // Graveyard manages a set of tombstones.
@@ -17,6 +23,10 @@ type Graveyard struct {
 	// GC is when we create tombstones to track their time-to-live.
 	// The GC is consumed upstream to manage clearing of tombstones.
 	gc *TombstoneGC
+
+	// sizes is where the size of the tombstones table is tracked, if
+	// it's set.
+	sizes *tableSizes
 }
 
 // NewGraveyard returns a new graveyard.
@@ -26,11 +36,20 @@ func NewGraveyard(gc *TombstoneGC) *Graveyard {
 
 // InsertTxn adds a new tombstone.
 func (g *Graveyard) InsertTxn(tx *memdb.Txn, key string, idx uint64) error {
-	// Insert the tombstone.
+	// Insert the tombstone, keeping any prefix tombstone that's already
+	// there for the same key so we don't lose track of the keys under it.
 	stone := &Tombstone{Key: key, Index: idx}
+	existing, err := tx.First("tombstones", "id", key)
+	if err != nil {
+		return fmt.Errorf("failed querying tombstones: %s", err)
+	}
+	if existing != nil && existing.(*Tombstone).Prefix {
+		stone.Prefix = true
+	}
 	if err := tx.Insert("tombstones", stone); err != nil {
 		return fmt.Errorf("failed inserting tombstone: %s", err)
 	}
+	g.trackInsert(tx, existing, stone)
 
 	if err := tx.Insert("index", &IndexEntry{"tombstones", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
@@ -43,8 +62,51 @@ func (g *Graveyard) InsertTxn(tx *memdb.Txn, key string, idx uint64) error {
 	return nil
 }
 
+// InsertPrefixTxn adds a single tombstone that covers every key under the
+// given prefix. This is used in place of a tombstone per key when deleting
+// large trees. Any prefix tombstones under the given prefix are moved up to
+// the same index, so the longest prefix tombstone covering a key is always
+// the most recent one, see GetMaxIndexTxn.
+func (g *Graveyard) InsertPrefixTxn(tx *memdb.Txn, prefix string, idx uint64) error {
+	stones, err := tx.Get("tombstones", "prefix_prefix", prefix)
+	if err != nil {
+		return fmt.Errorf("failed querying tombstones: %s", err)
+	}
+	var covered []*Tombstone
+	for stone := stones.Next(); stone != nil; stone = stones.Next() {
+		covered = append(covered, stone.(*Tombstone))
+	}
+	for _, existing := range covered {
+		stone := &Tombstone{Key: existing.Key, Index: idx, Prefix: true}
+		if err := tx.Insert("tombstones", stone); err != nil {
+			return fmt.Errorf("failed inserting tombstone: %s", err)
+		}
+		g.trackInsert(tx, existing, stone)
+	}
+
+	stone := &Tombstone{Key: prefix, Index: idx, Prefix: true}
+	existing, err := tx.First("tombstones", "id", prefix)
+	if err != nil {
+		return fmt.Errorf("failed querying tombstones: %s", err)
+	}
+	if err := tx.Insert("tombstones", stone); err != nil {
+		return fmt.Errorf("failed inserting tombstone: %s", err)
+	}
+	g.trackInsert(tx, existing, stone)
+
+	if err := tx.Insert("index", &IndexEntry{"tombstones", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	if g.gc != nil {
+		tx.Defer(func() { g.gc.Hint(idx) })
+	}
+	return nil
+}
+
 // GetMaxIndexTxn returns the highest index tombstone whose key matches the
-// given context, using a prefix match.
+// given context, using a prefix match. Prefix tombstones for any parent of
+// the given context are also considered, since they cover it as well.
 func (g *Graveyard) GetMaxIndexTxn(tx *memdb.Txn, prefix string) (uint64, error) {
 	stones, err := tx.Get("tombstones", "id_prefix", prefix)
 	if err != nil {
@@ -58,6 +120,44 @@ func (g *Graveyard) GetMaxIndexTxn(tx *memdb.Txn, prefix string) (uint64, error)
 			lindex = s.Index
 		}
 	}
+
+	// Prefix tombstones are never older than the ones above them, so we
+	// only need the closest one.
+	stone, err := tx.LongestPrefix("tombstones", "prefix_prefix", prefix)
+	if err != nil {
+		return 0, fmt.Errorf("failed querying tombstones: %s", err)
+	}
+	if stone != nil {
+		if s := stone.(*Tombstone); s.Index > lindex {
+			lindex = s.Index
+		}
+	}
+	return lindex, nil
+}
+
+// GetKeyIndexTxn returns the index of the tombstone for exactly the given
+// key, or of the closest prefix tombstone covering it, whichever is higher.
+// Unlike GetMaxIndexTxn, tombstones for other keys under the given one don't
+// count.
+func (g *Graveyard) GetKeyIndexTxn(tx *memdb.Txn, key string) (uint64, error) {
+	var lindex uint64
+	stone, err := tx.First("tombstones", "id", key)
+	if err != nil {
+		return 0, fmt.Errorf("failed querying tombstones: %s", err)
+	}
+	if stone != nil {
+		lindex = stone.(*Tombstone).Index
+	}
+
+	stone, err = tx.LongestPrefix("tombstones", "prefix_prefix", key)
+	if err != nil {
+		return 0, fmt.Errorf("failed querying tombstones: %s", err)
+	}
+	if stone != nil {
+		if s := stone.(*Tombstone); s.Index > lindex {
+			lindex = s.Index
+		}
+	}
 	return lindex, nil
 }
 
@@ -77,6 +177,7 @@ func (g *Graveyard) RestoreTxn(tx *memdb.Txn, stone *Tombstone) error {
 	if err := tx.Insert("tombstones", stone); err != nil {
 		return fmt.Errorf("failed inserting tombstone: %s", err)
 	}
+	g.trackInsert(tx, nil, stone)
 
 	if err := indexUpdateMaxTxn(tx, stone.Index, "tombstones"); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
@@ -109,6 +210,17 @@ func (g *Graveyard) ReapTxn(tx *memdb.Txn, idx uint64) error {
 		if err := tx.Delete("tombstones", obj); err != nil {
 			return fmt.Errorf("failed deleting tombstone: %s", err)
 		}
+		if g.sizes != nil {
+			g.sizes.deleteTxn(tx, "tombstones", obj)
+		}
 	}
 	return nil
 }
+
+// trackInsert records a tombstone insert with the size tracker, if there is
+// one.
+func (g *Graveyard) trackInsert(tx *memdb.Txn, existing interface{}, stone *Tombstone) {
+	if g.sizes != nil {
+		g.sizes.insertTxn(tx, "tombstones", existing, stone)
+	}
+}
@@ -0,0 +1,47 @@
+package state
+
+import (
+	"fmt"
+)
+
+// TombstonePrefixIndex is a custom memdb indexer used to index the prefix
+// tombstones by their key. The built-in string indexer adds a null
+// terminator, which means it can't be used to find the longest prefix
+// tombstone covering a given key.
+type TombstonePrefixIndex struct {
+}
+
+// FromObject is used to compute the index key when inserting or updating an
+// object.
+func (*TombstonePrefixIndex) FromObject(obj interface{}) (bool, []byte, error) {
+	stone, ok := obj.(*Tombstone)
+	if !ok {
+		return false, nil, fmt.Errorf("invalid object given to index as tombstone")
+	}
+	if !stone.Prefix {
+		return false, nil, nil
+	}
+
+	// Always prepend a null so that we can represent even an empty key.
+	out := "\x00" + stone.Key
+	return true, []byte(out), nil
+}
+
+// FromArgs is used when querying for an exact match. Since we don't add any
+// suffix we can just call the prefix version.
+func (t *TombstonePrefixIndex) FromArgs(args ...interface{}) ([]byte, error) {
+	return t.PrefixFromArgs(args...)
+}
+
+// PrefixFromArgs is used when doing a prefix scan for an object.
+func (*TombstonePrefixIndex) PrefixFromArgs(args ...interface{}) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("must provide only a single argument")
+	}
+	arg, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("argument must be a string: %#v", args[0])
+	}
+	arg = "\x00" + arg
+	return []byte(arg), nil
+}
@@ -28,6 +28,10 @@ func (s *StateRestore) KVS(entry *structs.DirEntry) error {
 	if err := s.tx.Insert("kvs", entry); err != nil {
 		return fmt.Errorf("failed inserting kvs entry: %s", err)
 	}
+	s.store.sizes.insertTxn(s.tx, "kvs", nil, entry)
+	if err := kvsQuotaChangeTxn(s.tx, entry.Key, nil, entry, false); err != nil {
+		return err
+	}
 
 	if err := indexUpdateMaxTxn(s.tx, entry.ModifyIndex, "kvs"); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
@@ -54,6 +58,9 @@ func (s *StateStore) ReapTombstones(index uint64) error {
 	if err := s.kvsGraveyard.ReapTxn(tx, index); err != nil {
 		return fmt.Errorf("failed to reap kvs tombstones: %s", err)
 	}
+	if err := s.reapCatalogTombstonesTxn(tx, index); err != nil {
+		return fmt.Errorf("failed to reap catalog tombstones: %s", err)
+	}
 
 	tx.Commit()
 	return nil
@@ -85,11 +92,18 @@ func (s *StateStore) kvsSetTxn(tx *memdb.Txn, idx uint64, entry *structs.DirEntr
 		return fmt.Errorf("failed kvs lookup: %s", err)
 	}
 
-	// Set the indexes.
+	// Set the indexes, and carry the creation metadata over from the
+	// existing entry. For a new entry this comes from the modification
+	// metadata, if there is any.
 	if existing != nil {
-		entry.CreateIndex = existing.(*structs.DirEntry).CreateIndex
+		e := existing.(*structs.DirEntry)
+		entry.CreateIndex = e.CreateIndex
+		entry.CreatedBy = e.CreatedBy
+		entry.CreateTime = e.CreateTime
 	} else {
 		entry.CreateIndex = idx
+		entry.CreatedBy = entry.ModifiedBy
+		entry.CreateTime = entry.ModifyTime
 	}
 	entry.ModifyIndex = idx
 
@@ -103,10 +117,16 @@ func (s *StateStore) kvsSetTxn(tx *memdb.Txn, idx uint64, entry *structs.DirEntr
 		}
 	}
 
+	// Charge the write against any quotas, which may refuse it.
+	if err := kvsQuotaChangeTxn(tx, entry.Key, existing, entry, true); err != nil {
+		return err
+	}
+
 	// Store the kv pair in the state store and update the index.
 	if err := tx.Insert("kvs", entry); err != nil {
 		return fmt.Errorf("failed inserting kvs entry: %s", err)
 	}
+	s.sizes.insertTxn(tx, "kvs", existing, entry)
 	if err := tx.Insert("index", &IndexEntry{"kvs", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
@@ -140,6 +160,66 @@ func (s *StateStore) kvsGetTxn(tx *memdb.Txn, ws memdb.WatchSet, key string) (ui
 	return idx, nil, nil
 }
 
+// KVSGetMany is used to retrieve several exact keys at once. Keys that don't
+// exist are left out of the results. The returned index is the max index of
+// the returned entries or any tombstones for the requested keys, or else it's
+// the full table indexes for kvs and tombstones. The watch set fires when
+// one of the requested keys that exists changes, though a key that doesn't
+// exist yet can't be watched as precisely.
+func (s *StateStore) KVSGetMany(ws memdb.WatchSet, keys []string) (uint64, structs.DirEntries, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table indexes.
+	idx := maxIndexTxn(tx, "kvs", "tombstones")
+
+	var ents structs.DirEntries
+	var lindex uint64
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		watchCh, entry, err := tx.FirstWatch("kvs", "id", key)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed kvs lookup: %s", err)
+		}
+		ws.Add(watchCh)
+		if entry != nil {
+			e := entry.(*structs.DirEntry)
+			ents = append(ents, e)
+			if e.ModifyIndex > lindex {
+				lindex = e.ModifyIndex
+			}
+			continue
+		}
+
+		// A missing key may have been deleted, so account for its
+		// tombstone, if any.
+		gindex, err := s.kvsGraveyard.GetKeyIndexTxn(tx, key)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed graveyard lookup: %s", err)
+		}
+		if gindex > lindex {
+			lindex = gindex
+		}
+	}
+
+	// Use the sub index if it was set, otherwise use the full table index
+	// from above.
+	if lindex != 0 {
+		idx = lindex
+	}
+	return idx, ents, nil
+}
+
+// KVSIndex returns the index of the latest change to the KV store.
+func (s *StateStore) KVSIndex() uint64 {
+	return s.maxIndex("kvs")
+}
+
 // KVSList is used to list out all keys under a given prefix. If the
 // prefix is left empty, all keys in the KVS will be returned. The returned
 // is the max index of the returned kvs entries or applicable tombstones, or
@@ -308,6 +388,10 @@ func (s *StateStore) kvsDeleteTxn(tx *memdb.Txn, idx uint64, key string) error {
 	if err := tx.Delete("kvs", entry); err != nil {
 		return fmt.Errorf("failed deleting kvs entry: %s", err)
 	}
+	s.sizes.deleteTxn(tx, "kvs", entry)
+	if err := kvsQuotaChangeTxn(tx, key, entry, nil, false); err != nil {
+		return err
+	}
 	if err := tx.Insert("index", &IndexEntry{"kvs", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
@@ -409,7 +493,7 @@ func (s *StateStore) KVSDeleteTree(idx uint64, prefix string) error {
 	tx := s.db.Txn(true)
 	defer tx.Abort()
 
-	if err := s.kvsDeleteTreeTxn(tx, idx, prefix); err != nil {
+	if _, err := s.kvsDeleteTreeTxn(tx, idx, prefix, noTombstoneLimit); err != nil {
 		return err
 	}
 
@@ -417,41 +501,108 @@ func (s *StateStore) KVSDeleteTree(idx uint64, prefix string) error {
 	return nil
 }
 
+// KVSDeleteTreeMaxTombstones is like KVSDeleteTree, but if more than the
+// given number of keys are deleted then it leaves a single tombstone for the
+// whole prefix instead of one for each key. A limit of zero always does this.
+// This returns true if the prefix tombstone was used.
+func (s *StateStore) KVSDeleteTreeMaxTombstones(idx uint64, prefix string, maxTombstones int) (bool, error) {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	collapsed, err := s.kvsDeleteTreeTxn(tx, idx, prefix, maxTombstones)
+	if err != nil {
+		return false, err
+	}
+
+	tx.Commit()
+	return collapsed, nil
+}
+
+// noTombstoneLimit is given to kvsDeleteTreeTxn to always create a tombstone
+// for each deleted key.
+const noTombstoneLimit = -1
+
 // kvsDeleteTreeTxn is the inner method that does a recursive delete inside an
-// existing transaction.
-func (s *StateStore) kvsDeleteTreeTxn(tx *memdb.Txn, idx uint64, prefix string) error {
+// existing transaction. If more than maxTombstones keys are deleted then a
+// single prefix tombstone is used in place of per-key tombstones, and this
+// returns true.
+func (s *StateStore) kvsDeleteTreeTxn(tx *memdb.Txn, idx uint64, prefix string, maxTombstones int) (bool, error) {
 	// Get an iterator over all of the keys with the given prefix.
 	entries, err := tx.Get("kvs", "id_prefix", prefix)
 	if err != nil {
-		return fmt.Errorf("failed kvs lookup: %s", err)
+		return false, fmt.Errorf("failed kvs lookup: %s", err)
 	}
 
-	// Go over all of the keys and remove them. We call the delete
-	// directly so that we only update the index once. We also add
-	// tombstones as we go.
-	var modified bool
+	// Gather up the keys first so we don't trash the iterator as we go,
+	// and so we know how many tombstones it would take.
 	var objs []interface{}
 	for entry := entries.Next(); entry != nil; entry = entries.Next() {
-		e := entry.(*structs.DirEntry)
-		if err := s.kvsGraveyard.InsertTxn(tx, e.Key, idx); err != nil {
-			return fmt.Errorf("failed adding to graveyard: %s", err)
-		}
 		objs = append(objs, entry)
-		modified = true
+	}
+	if len(objs) == 0 {
+		return false, nil
+	}
+
+	// Add the tombstones, collapsing them into one if there are too many.
+	collapsed := maxTombstones != noTombstoneLimit && len(objs) > maxTombstones
+	if collapsed {
+		if err := s.kvsPrefixTombstoneTxn(tx, idx, prefix); err != nil {
+			return false, err
+		}
+	} else {
+		for _, obj := range objs {
+			e := obj.(*structs.DirEntry)
+			if err := s.kvsGraveyard.InsertTxn(tx, e.Key, idx); err != nil {
+				return false, fmt.Errorf("failed adding to graveyard: %s", err)
+			}
+		}
 	}
 
-	// Do the actual deletes in a separate loop so we don't trash the
-	// iterator as we go.
+	// Do the actual deletes. We call the delete directly so that we only
+	// update the index once.
 	for _, obj := range objs {
 		if err := tx.Delete("kvs", obj); err != nil {
-			return fmt.Errorf("failed deleting kvs entry: %s", err)
+			return false, fmt.Errorf("failed deleting kvs entry: %s", err)
+		}
+		s.sizes.deleteTxn(tx, "kvs", obj)
+		if err := kvsQuotaChangeTxn(tx, obj.(*structs.DirEntry).Key, obj, nil, false); err != nil {
+			return false, err
 		}
 	}
 
 	// Update the index
-	if modified {
-		if err := tx.Insert("index", &IndexEntry{"kvs", idx}); err != nil {
-			return fmt.Errorf("failed updating index: %s", err)
+	if err := tx.Insert("index", &IndexEntry{"kvs", idx}); err != nil {
+		return false, fmt.Errorf("failed updating index: %s", err)
+	}
+	return collapsed, nil
+}
+
+// kvsPrefixTombstoneTxn leaves a tombstone covering every key under the
+// given prefix, so listings under it won't slide backwards once the keys are
+// gone.
+func (s *StateStore) kvsPrefixTombstoneTxn(tx *memdb.Txn, idx uint64, prefix string) error {
+	if prefix != "" {
+		if err := s.kvsGraveyard.InsertPrefixTxn(tx, prefix, idx); err != nil {
+			return fmt.Errorf("failed adding to graveyard: %s", err)
+		}
+		return nil
+	}
+
+	// Tombstones can't have an empty key, but since every key is going
+	// away we can get the same effect by moving the existing tombstones up
+	// to this index. Listings that don't hit any of them fall back to the
+	// table index, which the delete bumps.
+	stones, err := s.kvsGraveyard.DumpTxn(tx)
+	if err != nil {
+		return fmt.Errorf("failed querying tombstones: %s", err)
+	}
+	var keys []string
+	for stone := stones.Next(); stone != nil; stone = stones.Next() {
+		keys = append(keys, stone.(*Tombstone).Key)
+	}
+	for _, key := range keys {
+		if err := s.kvsGraveyard.InsertTxn(tx, key, idx); err != nil {
+			return fmt.Errorf("failed adding to graveyard: %s", err)
 		}
 	}
 	return nil
@@ -582,6 +733,72 @@ func (s *StateStore) kvsUnlockTxn(tx *memdb.Txn, idx uint64, entry *structs.DirE
 	return true, nil
 }
 
+// KVSOrphanedLocks returns the keys that are locked by a session that no
+// longer exists. Destroying a session releases its locks, so these should
+// only turn up after a bug or a partial restore, but they'd otherwise stay
+// locked forever.
+func (s *StateStore) KVSOrphanedLocks() ([]structs.OrphanedLock, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	entries, err := tx.Get("kvs", "session_prefix", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed kvs lookup: %s", err)
+	}
+	var orphans []structs.OrphanedLock
+	for entry := entries.Next(); entry != nil; entry = entries.Next() {
+		e := entry.(*structs.DirEntry)
+		sess, err := tx.First("sessions", "id", e.Session)
+		if err != nil {
+			return nil, fmt.Errorf("failed session lookup: %s", err)
+		}
+		if sess == nil {
+			orphans = append(orphans, structs.OrphanedLock{Key: e.Key, Session: e.Session})
+		}
+	}
+	return orphans, nil
+}
+
+// KVSReleaseOrphanedLocks releases the given orphaned locks by clearing the
+// session and bumping the lock index, leaving the value alone. The lock index
+// is bumped so anything still holding on to the old lock index, like a client
+// that thinks it has the lock, can tell the lock has changed hands. Keys that have since been deleted, or are
+// no longer held by the given session, or whose session now exists, are
+// skipped. This returns the number of locks released.
+func (s *StateStore) KVSReleaseOrphanedLocks(idx uint64, locks []structs.OrphanedLock) (int, error) {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	released := 0
+	for _, lock := range locks {
+		existing, err := tx.First("kvs", "id", lock.Key)
+		if err != nil {
+			return 0, fmt.Errorf("failed kvs lookup: %s", err)
+		}
+		if existing == nil || existing.(*structs.DirEntry).Session != lock.Session {
+			continue
+		}
+		sess, err := tx.First("sessions", "id", lock.Session)
+		if err != nil {
+			return 0, fmt.Errorf("failed session lookup: %s", err)
+		}
+		if sess != nil {
+			continue
+		}
+
+		e := existing.(*structs.DirEntry).Clone()
+		e.Session = ""
+		e.LockIndex++
+		if err := s.kvsSetTxn(tx, idx, e, true); err != nil {
+			return 0, err
+		}
+		released++
+	}
+
+	tx.Commit()
+	return released, nil
+}
+
 // kvsCheckSessionTxn checks to see if the given session matches the current
 // entry for a key.
 func (s *StateStore) kvsCheckSessionTxn(tx *memdb.Txn, key string, session string) (*structs.DirEntry, error) {
@@ -619,3 +836,48 @@ func (s *StateStore) kvsCheckIndexTxn(tx *memdb.Txn, key string, cidx uint64) (*
 
 	return e, nil
 }
+
+// KVSCheckFlags enforces the reserved flags of the entries the given KVS
+// update touches, see structs.KVFlagsReserved. The leader calls this before
+// the update goes into Raft.
+func (s *StateStore) KVSCheckFlags(op structs.KVSOp, entry *structs.DirEntry) error {
+	if !op.IsWrite() {
+		return nil
+	}
+
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	var existing structs.DirEntries
+	if op == structs.KVSDeleteTree {
+		entries, err := tx.Get("kvs", "id_prefix", entry.Key)
+		if err != nil {
+			return fmt.Errorf("failed kvs lookup: %s", err)
+		}
+		for e := entries.Next(); e != nil; e = entries.Next() {
+			existing = append(existing, e.(*structs.DirEntry))
+		}
+	} else {
+		e, err := tx.First("kvs", "id", entry.Key)
+		if err != nil {
+			return fmt.Errorf("failed kvs lookup: %s", err)
+		}
+		if e != nil {
+			existing = append(existing, e.(*structs.DirEntry))
+		}
+	}
+
+	// Deletes don't store the flags they're given.
+	deletes := op == structs.KVSDelete || op == structs.KVSDeleteCAS || op == structs.KVSDeleteTree
+	for _, e := range existing {
+		switch {
+		case e.Flags&structs.KVFlagImmutable != 0:
+			return &structs.KVFlagError{Key: e.Key, Reason: "is immutable"}
+		case e.Flags&structs.KVFlagWriteOnce != 0:
+			return &structs.KVFlagError{Key: e.Key, Reason: "is write-once"}
+		case !deletes && entry.Flags&structs.KVFlagWriteOnce != 0:
+			return &structs.KVFlagError{Key: e.Key, Reason: "can only be made write-once when it's created"}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// KVQuotas is used to pull all the KV quotas from the snapshot.
+func (s *StateSnapshot) KVQuotas() (structs.KVQuotas, error) {
+	quotas, err := s.tx.Get("kv-quotas", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	var ret structs.KVQuotas
+	for quota := quotas.Next(); quota != nil; quota = quotas.Next() {
+		ret = append(ret, quota.(*structs.KVQuota))
+	}
+	return ret, nil
+}
+
+// KVQuota is used when restoring from a snapshot. For general inserts, use
+// KVQuotaSet. The usage is worked out again from the keys that have been
+// restored so far, and the ones restored after this are added as they come
+// in.
+func (s *StateRestore) KVQuota(quota *structs.KVQuota) error {
+	usage, err := kvsQuotaUsageTxn(s.tx, quota.Prefix)
+	if err != nil {
+		return err
+	}
+	quota.Usage = usage
+
+	if err := s.tx.Insert("kv-quotas", quota); err != nil {
+		return fmt.Errorf("failed restoring kv quota: %s", err)
+	}
+	if err := indexUpdateMaxTxn(s.tx, quota.ModifyIndex, "kv-quotas"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	return nil
+}
+
+// KVQuotaSet is used to create or update the quota on a KV prefix. The
+// quota's usage is worked out from what's already stored, which may already
+// be over the new limits. If so, writes under the prefix that add to it will
+// be refused until enough is deleted.
+func (s *StateStore) KVQuotaSet(idx uint64, quota *structs.KVQuota) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	if quota.Prefix == "" {
+		return ErrMissingKVQuotaPrefix
+	}
+
+	// Set the indexes.
+	existing, err := tx.First("kv-quotas", "id", quota.Prefix)
+	if err != nil {
+		return fmt.Errorf("failed kv quota lookup: %s", err)
+	}
+	if existing != nil {
+		quota.CreateIndex = existing.(*structs.KVQuota).CreateIndex
+	} else {
+		quota.CreateIndex = idx
+	}
+	quota.ModifyIndex = idx
+
+	if quota.Usage, err = kvsQuotaUsageTxn(tx, quota.Prefix); err != nil {
+		return err
+	}
+
+	// Insert the quota and update the index.
+	if err := tx.Insert("kv-quotas", quota); err != nil {
+		return fmt.Errorf("failed inserting kv quota: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"kv-quotas", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// KVQuotaDelete removes the quota on the given KV prefix.
+func (s *StateStore) KVQuotaDelete(idx uint64, prefix string) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Pull the quota.
+	quota, err := tx.First("kv-quotas", "id", prefix)
+	if err != nil {
+		return fmt.Errorf("failed kv quota lookup: %s", err)
+	}
+	if quota == nil {
+		return nil
+	}
+
+	// Delete the quota and update the index.
+	if err := tx.Delete("kv-quotas", quota); err != nil {
+		return fmt.Errorf("failed kv quota delete: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"kv-quotas", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// KVQuotaList returns all the KV quotas along with their current usage.
+// Since the usage changes with KV writes, the index covers the KV store as
+// well as the quotas.
+func (s *StateStore) KVQuotaList(ws memdb.WatchSet) (uint64, structs.KVQuotas, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "kv-quotas", "kvs")
+
+	// Query all of the quotas.
+	quotas, err := tx.Get("kv-quotas", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed kv quota lookup: %s", err)
+	}
+	ws.Add(quotas.WatchCh())
+
+	// Go over all of the quotas and build the response.
+	var result structs.KVQuotas
+	for quota := quotas.Next(); quota != nil; quota = quotas.Next() {
+		result = append(result, quota.(*structs.KVQuota))
+	}
+	return idx, result, nil
+}
+
+// kvsQuotaUsageTxn adds up what's stored under the given prefix.
+func kvsQuotaUsageTxn(tx *memdb.Txn, prefix string) (structs.KVQuotaUsage, error) {
+	var usage structs.KVQuotaUsage
+	entries, err := tx.Get("kvs", "id_prefix", prefix)
+	if err != nil {
+		return usage, fmt.Errorf("failed kvs lookup: %s", err)
+	}
+	for entry := entries.Next(); entry != nil; entry = entries.Next() {
+		usage.Keys++
+		usage.Bytes += int64(len(entry.(*structs.DirEntry).Value))
+	}
+	return usage, nil
+}
+
+// kvsQuotaChangeTxn charges a write to the given key against the quotas
+// covering it. Existing is the entry being replaced or deleted, and entry is
+// the one being written, either of which may be nil. If enforce is set, a
+// write that adds to a prefix that's over its quota afterwards is refused
+// with a KVQuotaError. Writes that don't add anything always go through.
+func kvsQuotaChangeTxn(tx *memdb.Txn, key string, existing, entry interface{}, enforce bool) error {
+	var keys int
+	var bytes int64
+	if existing != nil {
+		keys--
+		bytes -= int64(len(existing.(*structs.DirEntry).Value))
+	}
+	if entry != nil {
+		keys++
+		bytes += int64(len(entry.(*structs.DirEntry).Value))
+	}
+	if keys == 0 && bytes == 0 {
+		return nil
+	}
+
+	// Find the quotas covering the key. There won't be many quotas, so
+	// it's fine to go through them all. We gather them up first since
+	// we're going to update them.
+	iter, err := tx.Get("kv-quotas", "id")
+	if err != nil {
+		return fmt.Errorf("failed kv quota lookup: %s", err)
+	}
+	var quotas []*structs.KVQuota
+	for quota := iter.Next(); quota != nil; quota = iter.Next() {
+		if q := quota.(*structs.KVQuota); strings.HasPrefix(key, q.Prefix) {
+			quotas = append(quotas, q)
+		}
+	}
+
+	for _, existing := range quotas {
+		// Make a copy so we don't modify the one in the state store.
+		quota := *existing
+		quota.Usage.Keys += keys
+		quota.Usage.Bytes += bytes
+
+		if enforce {
+			if keys > 0 && quota.MaxKeys > 0 && quota.Usage.Keys > quota.MaxKeys {
+				return &structs.KVQuotaError{
+					Prefix: quota.Prefix,
+					Limit:  "keys",
+					Max:    int64(quota.MaxKeys),
+					Usage:  int64(quota.Usage.Keys),
+				}
+			}
+			if bytes > 0 && quota.MaxBytes > 0 && quota.Usage.Bytes > quota.MaxBytes {
+				return &structs.KVQuotaError{
+					Prefix: quota.Prefix,
+					Limit:  "bytes",
+					Max:    quota.MaxBytes,
+					Usage:  quota.Usage.Bytes,
+				}
+			}
+		}
+
+		if err := tx.Insert("kv-quotas", &quota); err != nil {
+			return fmt.Errorf("failed updating kv quota: %s", err)
+		}
+	}
+	return nil
+}
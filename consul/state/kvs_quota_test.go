@@ -0,0 +1,225 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+func TestStateStore_KVQuota_CRUD(t *testing.T) {
+	s := testStateStore(t)
+
+	// Should start out empty.
+	ws := memdb.NewWatchSet()
+	idx, quotas, err := s.KVQuotaList(ws)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 || len(quotas) != 0 {
+		t.Fatalf("bad: %d %#v", idx, quotas)
+	}
+
+	// The prefix is required.
+	if err := s.KVQuotaSet(1, &structs.KVQuota{MaxKeys: 1}); err != ErrMissingKVQuotaPrefix {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Add a quota over some existing keys, which should be counted.
+	testSetKey(t, s, 1, "team/a", "aaa")
+	testSetKey(t, s, 2, "other", "bbb")
+	if err := s.KVQuotaSet(3, &structs.KVQuota{Prefix: "team/", MaxKeys: 5}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	idx, quotas, err = s.KVQuotaList(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 3 || len(quotas) != 1 || quotas[0].Prefix != "team/" ||
+		quotas[0].Usage != (structs.KVQuotaUsage{Keys: 1, Bytes: 3}) {
+		t.Fatalf("bad: %d %#v", idx, quotas)
+	}
+
+	// Update it, which should keep the create index.
+	if err := s.KVQuotaSet(4, &structs.KVQuota{Prefix: "team/", MaxKeys: 2, MaxBytes: 10}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, quotas, err = s.KVQuotaList(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 4 || len(quotas) != 1 || quotas[0].MaxKeys != 2 || quotas[0].MaxBytes != 10 ||
+		quotas[0].CreateIndex != 3 || quotas[0].ModifyIndex != 4 {
+		t.Fatalf("bad: %d %#v", idx, quotas)
+	}
+
+	// KV writes should fire the watch and move the index, since they
+	// change the usage.
+	ws = memdb.NewWatchSet()
+	if _, _, err := s.KVQuotaList(ws); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testSetKey(t, s, 5, "team/b", "b")
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	idx, quotas, err = s.KVQuotaList(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 5 || quotas[0].Usage != (structs.KVQuotaUsage{Keys: 2, Bytes: 4}) {
+		t.Fatalf("bad: %d %#v", idx, quotas)
+	}
+
+	// Delete the quota.
+	if err := s.KVQuotaDelete(6, "team/"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, quotas, err = s.KVQuotaList(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 6 || len(quotas) != 0 {
+		t.Fatalf("bad: %d %#v", idx, quotas)
+	}
+
+	// Deleting a quota that's not there is fine.
+	if err := s.KVQuotaDelete(7, "nope/"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestStateStore_KVQuota_Enforce(t *testing.T) {
+	s := testStateStore(t)
+
+	// Set up nested quotas.
+	if err := s.KVQuotaSet(1, &structs.KVQuota{Prefix: "team/", MaxKeys: 3}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.KVQuotaSet(2, &structs.KVQuota{Prefix: "team/big/", MaxBytes: 8}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	usage := func(prefix string) structs.KVQuotaUsage {
+		_, quotas, err := s.KVQuotaList(nil)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		for _, quota := range quotas {
+			if quota.Prefix == prefix {
+				return quota.Usage
+			}
+		}
+		t.Fatalf("missing quota %q", prefix)
+		return structs.KVQuotaUsage{}
+	}
+	set := func(idx uint64, key, value string) error {
+		return s.KVSSet(idx, &structs.DirEntry{Key: key, Value: []byte(value)})
+	}
+
+	// Fill up the byte quota, and then go over it.
+	if err := set(3, "team/big/a", "12345"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	err := set(4, "team/big/b", "6789")
+	qerr, ok := err.(*structs.KVQuotaError)
+	if !ok || qerr.Prefix != "team/big/" || qerr.Limit != "bytes" || qerr.Max != 8 || qerr.Usage != 9 {
+		t.Fatalf("err: %v", err)
+	}
+	if !structs.HasErrorCode(err, structs.ErrCodeKVQuotaExceeded) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Shrinking a value is always allowed.
+	if err := set(5, "team/big/a", "1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if u := usage("team/big/"); u != (structs.KVQuotaUsage{Keys: 1, Bytes: 1}) {
+		t.Fatalf("bad: %#v", u)
+	}
+
+	// Fill up the key quota from outside the nested one.
+	if err := set(6, "team/b", ""); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := set(7, "team/c", ""); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	err = set(8, "team/big/d", "")
+	if qerr, ok := err.(*structs.KVQuotaError); !ok || qerr.Prefix != "team/" || qerr.Limit != "keys" {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A refused write shouldn't count towards any quota.
+	if u := usage("team/"); u != (structs.KVQuotaUsage{Keys: 3, Bytes: 1}) {
+		t.Fatalf("bad: %#v", u)
+	}
+	if u := usage("team/big/"); u != (structs.KVQuotaUsage{Keys: 1, Bytes: 1}) {
+		t.Fatalf("bad: %#v", u)
+	}
+
+	// Updating a key that's there doesn't add a key, and keys outside
+	// the prefix aren't affected.
+	if err := set(9, "team/c", "x"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := set(10, "elsewhere", "x"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Lower the quota below what's stored. Deletes should still work, and
+	// writes resume once there's room.
+	if err := s.KVQuotaSet(11, &structs.KVQuota{Prefix: "team/", MaxKeys: 1}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.KVSDelete(12, "team/b"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := set(13, "team/d", ""); !structs.HasErrorCode(err, structs.ErrCodeKVQuotaExceeded) {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.KVSDeleteTree(14, "team/big/"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if u := usage("team/"); u != (structs.KVQuotaUsage{Keys: 1, Bytes: 1}) {
+		t.Fatalf("bad: %#v", u)
+	}
+	if u := usage("team/big/"); u != (structs.KVQuotaUsage{}) {
+		t.Fatalf("bad: %#v", u)
+	}
+	if err := set(15, "team/c", "y"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A transaction that goes over should be rolled back, including the
+	// usage from the ops that went through.
+	ops := structs.TxnOps{
+		&structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb:   structs.KVSDelete,
+				DirEnt: structs.DirEntry{Key: "team/c"},
+			},
+		},
+		&structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb:   structs.KVSSet,
+				DirEnt: structs.DirEntry{Key: "team/e"},
+			},
+		},
+		&structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb:   structs.KVSSet,
+				DirEnt: structs.DirEntry{Key: "team/f"},
+			},
+		},
+	}
+	_, errors := s.TxnRW(16, ops)
+	if len(errors) != 1 || errors[0].OpIndex != 2 || !structs.HasErrorCode(errors[0], structs.ErrCodeKVQuotaExceeded) {
+		t.Fatalf("bad: %v", errors)
+	}
+	if u := usage("team/"); u != (structs.KVQuotaUsage{Keys: 1, Bytes: 1}) {
+		t.Fatalf("bad: %#v", u)
+	}
+}
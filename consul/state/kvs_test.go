@@ -1,6 +1,7 @@
 package state
 
 import (
+	"fmt"
 	"reflect"
 	"strings"
 	"testing"
@@ -14,7 +15,7 @@ func TestStateStore_GC(t *testing.T) {
 	// Build up a fast GC.
 	ttl := 10 * time.Millisecond
 	gran := 5 * time.Millisecond
-	gc, err := NewTombstoneGC(ttl, gran)
+	gc, err := NewTombstoneGC(ttl, gran, nil)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
@@ -359,6 +360,70 @@ func TestStateStore_KVSSet_KVSGet(t *testing.T) {
 	}
 }
 
+func TestStateStore_KVSSet_Metadata(t *testing.T) {
+	s := testStateStore(t)
+
+	// A new entry takes its creation metadata from the write.
+	t1 := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+	entry := &structs.DirEntry{
+		Key:        "foo",
+		Value:      []byte("bar"),
+		ModifiedBy: "alice",
+		ModifyTime: &t1,
+	}
+	if err := s.KVSSet(1, entry); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, result, err := s.KVSGet(nil, "foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result.CreatedBy != "alice" || result.ModifiedBy != "alice" ||
+		!result.CreateTime.Equal(t1) || !result.ModifyTime.Equal(t1) {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	// Updates keep the creation metadata, even if they try to change it.
+	t2 := t1.Add(time.Hour)
+	entry = &structs.DirEntry{
+		Key:        "foo",
+		Value:      []byte("baz"),
+		CreatedBy:  "mallory",
+		CreateTime: &t2,
+		ModifiedBy: "bob",
+		ModifyTime: &t2,
+	}
+	if err := s.KVSSet(2, entry); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, result, err = s.KVSGet(nil, "foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result.CreatedBy != "alice" || result.ModifiedBy != "bob" ||
+		!result.CreateTime.Equal(t1) || !result.ModifyTime.Equal(t2) {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	// Writes without metadata leave the creation metadata alone but
+	// don't make up any modification metadata.
+	entry = &structs.DirEntry{
+		Key:   "foo",
+		Value: []byte("qux"),
+	}
+	if err := s.KVSSet(3, entry); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, result, err = s.KVSGet(nil, "foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result.CreatedBy != "alice" || result.ModifiedBy != "" ||
+		!result.CreateTime.Equal(t1) || result.ModifyTime != nil {
+		t.Fatalf("bad: %#v", result)
+	}
+}
+
 func TestStateStore_KVSList(t *testing.T) {
 	s := testStateStore(t)
 
@@ -470,6 +535,104 @@ func TestStateStore_KVSList(t *testing.T) {
 	}
 }
 
+func TestStateStore_KVSGetMany(t *testing.T) {
+	s := testStateStore(t)
+
+	// Looking up keys in an empty KVS returns nothing
+	ws := memdb.NewWatchSet()
+	idx, entries, err := s.KVSGetMany(ws, []string{"foo", "bar"})
+	if idx != 0 || entries != nil || err != nil {
+		t.Fatalf("expected (0, nil, nil), got: (%d, %#v, %#v)", idx, entries, err)
+	}
+
+	// Create some KVS entries
+	testSetKey(t, s, 1, "foo", "foo")
+	testSetKey(t, s, 2, "bar", "bar")
+	testSetKey(t, s, 3, "baz", "baz")
+	testSetKey(t, s, 4, "unrelated", "nope")
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	// Only the requested keys come back, with the highest index among
+	// them. Duplicate and missing keys are skipped.
+	idx, entries, err = s.KVSGetMany(nil, []string{"foo", "bar", "foo", "nope"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	if len(entries) != 2 || entries[0].Key != "foo" || entries[1].Key != "bar" {
+		t.Fatalf("bad: %#v", entries)
+	}
+
+	// Watch a set of keys that all exist.
+	ws = memdb.NewWatchSet()
+	idx, entries, err = s.KVSGetMany(ws, []string{"foo", "bar"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	if len(entries) != 2 || entries[0].Key != "foo" || entries[1].Key != "bar" {
+		t.Fatalf("bad: %#v", entries)
+	}
+
+	// Changing a key that wasn't requested shouldn't fire the watch.
+	testSetKey(t, s, 5, "unrelated", "still nope")
+	if watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	// Deleting a requested key should, and the index should come from
+	// its tombstone.
+	if err := s.KVSDelete(6, "bar"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	idx, entries, err = s.KVSGetMany(nil, []string{"foo", "bar"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 6 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	if len(entries) != 1 || entries[0].Key != "foo" {
+		t.Fatalf("bad: %#v", entries)
+	}
+
+	// Tombstones for other keys that happen to start with a requested key
+	// shouldn't count.
+	testSetKey(t, s, 7, "barn", "barn")
+	if err := s.KVSDelete(8, "barn"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, _, err = s.KVSGetMany(nil, []string{"foo", "bar"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 6 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Once the tombstones are reaped, a lookup of only missing keys falls
+	// back to the table index.
+	if err := s.ReapTombstones(8); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, entries, err = s.KVSGetMany(nil, []string{"bar"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 8 || entries != nil {
+		t.Fatalf("bad: %d %#v", idx, entries)
+	}
+}
+
 func TestStateStore_KVSListKeys(t *testing.T) {
 	s := testStateStore(t)
 
@@ -1022,6 +1185,187 @@ func TestStateStore_KVSDeleteTree(t *testing.T) {
 	}
 }
 
+func TestStateStore_KVSDeleteTreeMaxTombstones(t *testing.T) {
+	// countTombstones returns the number of tombstones in the state store.
+	countTombstones := func(s *StateStore) int {
+		tx := s.db.Txn(false)
+		defer tx.Abort()
+
+		stones, err := tx.Get("tombstones", "id")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		num := 0
+		for stone := stones.Next(); stone != nil; stone = stones.Next() {
+			num++
+		}
+		return num
+	}
+
+	// setup makes a store with a big tree under foo/, a key outside of it
+	// that shares a prefix with it, and an old tombstone under the tree.
+	setup := func() *StateStore {
+		s := testStateStore(t)
+		testSetKey(t, s, 1, "fox", "fox")
+		testSetKey(t, s, 2, "foo/old", "old")
+		if err := s.KVSDelete(3, "foo/old"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		for i := 0; i < 1000; i++ {
+			testSetKey(t, s, uint64(4+i), fmt.Sprintf("foo/%04d", i), "hello")
+		}
+		return s
+	}
+
+	// Deleting the tree normally makes a tombstone for every key.
+	s := setup()
+	collapsed, err := s.KVSDeleteTreeMaxTombstones(2000, "foo/", 1000)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if collapsed {
+		t.Fatalf("should not collapse")
+	}
+	if num := countTombstones(s); num != 1001 {
+		t.Fatalf("bad: %d", num)
+	}
+
+	// Now go over the limit, making sure queries on the deleted keys wake
+	// up.
+	s = setup()
+	getWS := memdb.NewWatchSet()
+	if _, _, err := s.KVSGet(getWS, "foo/0500"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	listWS := memdb.NewWatchSet()
+	if _, _, err := s.KVSList(listWS, "foo/05"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	collapsed, err = s.KVSDeleteTreeMaxTombstones(2000, "foo/", 999)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !collapsed {
+		t.Fatalf("should collapse")
+	}
+	if !watchFired(getWS) || !watchFired(listWS) {
+		t.Fatalf("bad")
+	}
+	if num := countTombstones(s); num != 2 {
+		t.Fatalf("bad: %d", num)
+	}
+
+	// The indexes shouldn't slide backwards anywhere in or above the tree,
+	// including for the prefix with the older tombstone.
+	for _, prefix := range []string{"fo", "foo/", "foo/05", "foo/old"} {
+		idx, ents, err := s.KVSList(nil, prefix)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 2000 {
+			t.Fatalf("bad index for %q: %d", prefix, idx)
+		}
+		if prefix != "fo" && len(ents) != 0 {
+			t.Fatalf("bad: %v", ents)
+		}
+		idx, _, err = s.KVSListKeys(nil, prefix, "/")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 2000 {
+			t.Fatalf("bad index for %q: %d", prefix, idx)
+		}
+	}
+	idx, _, err := s.KVSGet(nil, "foo/0500")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2000 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// A regular tombstone on the same key shouldn't replace the prefix
+	// tombstone.
+	testSetKey(t, s, 2001, "foo/", "foo")
+	if err := s.KVSDelete(2002, "foo/"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, _, err = s.KVSList(nil, "foo/05")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2002 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Reaping should clear out the prefix tombstone like any other.
+	if err := s.ReapTombstones(2002); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if num := countTombstones(s); num != 0 {
+		t.Fatalf("bad: %d", num)
+	}
+
+	// Tombstones can't have an empty key, so deleting everything moves the
+	// existing tombstones up instead.
+	s = setup()
+	collapsed, err = s.KVSDeleteTreeMaxTombstones(2000, "", 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !collapsed {
+		t.Fatalf("should collapse")
+	}
+	if num := countTombstones(s); num != 1 {
+		t.Fatalf("bad: %d", num)
+	}
+	for _, prefix := range []string{"fox", "foo/old", "bar"} {
+		idx, _, err := s.KVSList(nil, prefix)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 2000 {
+			t.Fatalf("bad index for %q: %d", prefix, idx)
+		}
+	}
+
+	// A prefix tombstone above an older one should win for the keys under
+	// both.
+	s = setup()
+	if _, err := s.KVSDeleteTreeMaxTombstones(2000, "foo/05", 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testSetKey(t, s, 2001, "foo/bar", "bar")
+	if _, err := s.KVSDeleteTreeMaxTombstones(2002, "foo/", 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, _, err = s.KVSList(nil, "foo/0500")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2002 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Transactions should follow the limit they're given.
+	s = setup()
+	ops := structs.TxnOps{
+		&structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb:          structs.KVSDeleteTree,
+				DirEnt:        structs.DirEntry{Key: "foo/"},
+				MaxTombstones: 999,
+			},
+		},
+	}
+	if _, errors := s.TxnRW(2000, ops); len(errors) != 0 {
+		t.Fatalf("err: %v", errors)
+	}
+	if num := countTombstones(s); num != 2 {
+		t.Fatalf("bad: %d", num)
+	}
+}
+
 func TestStateStore_KVSLockDelay(t *testing.T) {
 	s := testStateStore(t)
 
@@ -1464,3 +1808,118 @@ func TestStateStore_Tombstone_Snapshot_Restore(t *testing.T) {
 		}
 	}()
 }
+
+func TestStateStore_KVSOrphanedLocks(t *testing.T) {
+	s := testStateStore(t)
+
+	// Make a key held by a real session and one held by a session that
+	// doesn't exist. Destroying a session releases its locks, so the
+	// orphan has to be restored directly.
+	testRegisterNode(t, s, 1, "node1")
+	session := testUUID()
+	if err := s.SessionCreate(2, &structs.Session{ID: session, Node: "node1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ok, err := s.KVSLock(3, &structs.DirEntry{Key: "held", Value: []byte("a"), Session: session})
+	if !ok || err != nil {
+		t.Fatalf("didn't get the lock: %v %s", ok, err)
+	}
+	missing := testUUID()
+	restore := s.Restore()
+	if err := restore.KVS(&structs.DirEntry{
+		Key:       "orphan",
+		Value:     []byte("b"),
+		Session:   missing,
+		LockIndex: 1,
+		RaftIndex: structs.RaftIndex{CreateIndex: 4, ModifyIndex: 4},
+	}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	restore.Commit()
+
+	orphans, err := s.KVSOrphanedLocks()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := []structs.OrphanedLock{{Key: "orphan", Session: missing}}
+	if !reflect.DeepEqual(orphans, expected) {
+		t.Fatalf("bad: %#v", orphans)
+	}
+
+	// Locks that no longer match are skipped.
+	released, err := s.KVSReleaseOrphanedLocks(5, []structs.OrphanedLock{
+		{Key: "held", Session: session},
+		{Key: "orphan", Session: testUUID()},
+		{Key: "nope", Session: missing},
+	})
+	if released != 0 || err != nil {
+		t.Fatalf("bad: %d %v", released, err)
+	}
+
+	// Release the real orphan.
+	ws := memdb.NewWatchSet()
+	if _, _, err := s.KVSGet(ws, "orphan"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	released, err = s.KVSReleaseOrphanedLocks(6, orphans)
+	if released != 1 || err != nil {
+		t.Fatalf("bad: %d %v", released, err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	idx, e, err := s.KVSGet(nil, "orphan")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 6 || e.Session != "" || e.LockIndex != 2 || e.ModifyIndex != 6 ||
+		string(e.Value) != "b" {
+		t.Fatalf("bad: %d %#v", idx, e)
+	}
+
+	// The held key is untouched and there's nothing left to sweep.
+	if _, e, err = s.KVSGet(nil, "held"); err != nil || e.Session != session {
+		t.Fatalf("bad: %#v %v", e, err)
+	}
+	if orphans, err = s.KVSOrphanedLocks(); err != nil || len(orphans) != 0 {
+		t.Fatalf("bad: %#v %v", orphans, err)
+	}
+}
+
+func TestStateStore_KVSCheckFlags(t *testing.T) {
+	s := testStateStore(t)
+
+	testSetKey(t, s, 1, "foo/plain", "bar")
+	if err := s.KVSSet(2, &structs.DirEntry{Key: "foo/imm", Flags: structs.KVFlagImmutable}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.KVSSet(3, &structs.DirEntry{Key: "once", Flags: structs.KVFlagWriteOnce}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []struct {
+		op    structs.KVSOp
+		key   string
+		flags uint64
+		ok    bool
+	}{
+		{structs.KVSGet, "foo/imm", 0, true},
+		{structs.KVSSet, "foo/plain", structs.KVFlagImmutable, true},
+		{structs.KVSSet, "foo/plain", structs.KVFlagWriteOnce, false},
+		{structs.KVSSet, "new", structs.KVFlagWriteOnce, true},
+		{structs.KVSSet, "foo/imm", 0, false},
+		{structs.KVSLock, "foo/imm", 0, false},
+		{structs.KVSDelete, "once", 0, false},
+		{structs.KVSDeleteTree, "foo/", 0, false},
+		{structs.KVSDeleteTree, "foo/p", 0, true},
+	}
+	for i, c := range cases {
+		err := s.KVSCheckFlags(c.op, &structs.DirEntry{Key: c.key, Flags: c.flags})
+		if c.ok != (err == nil) {
+			t.Fatalf("case %d: err: %v", i, err)
+		}
+		if err != nil && !structs.HasErrorCode(err, structs.ErrCodeKVFlag) {
+			t.Fatalf("case %d: err: %v", i, err)
+		}
+	}
+}
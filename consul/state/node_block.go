@@ -0,0 +1,148 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/types"
+	"github.com/hashicorp/go-memdb"
+)
+
+// NodeBlocks is used to pull all the node blocks from the snapshot.
+func (s *StateSnapshot) NodeBlocks() (structs.NodeBlocks, error) {
+	blocks, err := s.tx.Get("node-blocks", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	var ret structs.NodeBlocks
+	for block := blocks.Next(); block != nil; block = blocks.Next() {
+		ret = append(ret, block.(*structs.NodeBlock))
+	}
+	return ret, nil
+}
+
+// NodeBlock is used when restoring from a snapshot. For general inserts, use
+// NodeBlockSet.
+func (s *StateRestore) NodeBlock(block *structs.NodeBlock) error {
+	if err := s.tx.Insert("node-blocks", block); err != nil {
+		return fmt.Errorf("failed restoring node block: %s", err)
+	}
+	if err := indexUpdateMaxTxn(s.tx, block.ModifyIndex, "node-blocks"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	return nil
+}
+
+// NodeBlockSet is used to create or update the block on a node.
+func (s *StateStore) NodeBlockSet(idx uint64, block *structs.NodeBlock) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	if block.Node == "" {
+		return ErrMissingNodeBlock
+	}
+
+	// Set the indexes.
+	existing, err := tx.First("node-blocks", "id", block.Node)
+	if err != nil {
+		return fmt.Errorf("failed node block lookup: %s", err)
+	}
+	if existing != nil {
+		block.CreateIndex = existing.(*structs.NodeBlock).CreateIndex
+	} else {
+		block.CreateIndex = idx
+	}
+	block.ModifyIndex = idx
+
+	// Insert the block and update the index.
+	if err := tx.Insert("node-blocks", block); err != nil {
+		return fmt.Errorf("failed inserting node block: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"node-blocks", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// NodeBlockDelete clears the block on the given node.
+func (s *StateStore) NodeBlockDelete(idx uint64, node string) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Pull the block.
+	block, err := tx.First("node-blocks", "id", node)
+	if err != nil {
+		return fmt.Errorf("failed node block lookup: %s", err)
+	}
+	if block == nil {
+		return nil
+	}
+
+	// Delete the block and update the index.
+	if err := tx.Delete("node-blocks", block); err != nil {
+		return fmt.Errorf("failed node block delete: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"node-blocks", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// NodeBlockList returns all the node blocks, including any that have expired
+// but haven't been cleaned up yet.
+func (s *StateStore) NodeBlockList(ws memdb.WatchSet) (uint64, structs.NodeBlocks, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "node-blocks")
+
+	// Query all of the blocks.
+	blocks, err := tx.Get("node-blocks", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed node block lookup: %s", err)
+	}
+	ws.Add(blocks.WatchCh())
+
+	// Go over all of the blocks and build the response.
+	var result structs.NodeBlocks
+	for block := blocks.Next(); block != nil; block = blocks.Next() {
+		result = append(result, block.(*structs.NodeBlock))
+	}
+	return idx, result, nil
+}
+
+// NodeBlocksMatching returns the blocks that apply to a node with the given
+// name or ID. The caller must check whether they've expired.
+func (s *StateStore) NodeBlocksMatching(node string, id types.NodeID) (structs.NodeBlocks, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	var result structs.NodeBlocks
+	block, err := tx.First("node-blocks", "id", node)
+	if err != nil {
+		return nil, fmt.Errorf("failed node block lookup: %s", err)
+	}
+	if block != nil {
+		result = append(result, block.(*structs.NodeBlock))
+	}
+
+	if id != "" {
+		blocks, err := tx.Get("node-blocks", "uuid", string(id))
+		if err != nil {
+			return nil, fmt.Errorf("failed node block lookup: %s", err)
+		}
+		for block := blocks.Next(); block != nil; block = blocks.Next() {
+			if b := block.(*structs.NodeBlock); len(result) == 0 || b != result[0] {
+				result = append(result, b)
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,179 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/types"
+	"github.com/hashicorp/go-memdb"
+)
+
+func TestStateStore_NodeBlock_CRUD(t *testing.T) {
+	s := testStateStore(t)
+
+	// Should start out empty.
+	ws := memdb.NewWatchSet()
+	idx, blocks, err := s.NodeBlockList(ws)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 || len(blocks) != 0 {
+		t.Fatalf("bad: %d %#v", idx, blocks)
+	}
+
+	// The node name is required.
+	if err := s.NodeBlockSet(1, &structs.NodeBlock{}); err != ErrMissingNodeBlock {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Add a block.
+	id := types.NodeID("40e4a748-2192-161a-0510-9bf59fe950b5")
+	expected := &structs.NodeBlock{Node: "node1", ID: id}
+	if err := s.NodeBlockSet(1, expected); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	idx, blocks, err = s.NodeBlockList(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 1 || len(blocks) != 1 || !reflect.DeepEqual(blocks[0], expected) {
+		t.Fatalf("bad: %d %#v", idx, blocks)
+	}
+
+	// Update it, which should keep the create index.
+	expires := time.Now().Add(time.Hour)
+	if err := s.NodeBlockSet(2, &structs.NodeBlock{Node: "node1", ID: id, Expires: expires}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, blocks, err = s.NodeBlockList(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2 || len(blocks) != 1 || !blocks[0].Expires.Equal(expires) ||
+		blocks[0].CreateIndex != 1 || blocks[0].ModifyIndex != 2 {
+		t.Fatalf("bad: %d %#v", idx, blocks)
+	}
+
+	// Add another one without an ID.
+	if err := s.NodeBlockSet(3, &structs.NodeBlock{Node: "node2"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Blocks should match by name, case-insensitively, or by ID.
+	cases := []struct {
+		node  string
+		id    types.NodeID
+		match []string
+	}{
+		{"node1", "", []string{"node1"}},
+		{"NODE1", "", []string{"node1"}},
+		{"renamed", id, []string{"node1"}},
+		{"node1", id, []string{"node1"}},
+		{"node2", id, []string{"node2", "node1"}},
+		{"node3", "", nil},
+		{"node3", types.NodeID("a7c3d5c2-1b1e-4a3c-9d27-6c6e7c5b1d0f"), nil},
+	}
+	for _, tc := range cases {
+		matches, err := s.NodeBlocksMatching(tc.node, tc.id)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		var names []string
+		for _, block := range matches {
+			names = append(names, block.Node)
+		}
+		if !reflect.DeepEqual(names, tc.match) {
+			t.Fatalf("bad: %s %s %v", tc.node, tc.id, names)
+		}
+	}
+
+	// Clearing an unknown block is a no-op.
+	ws = memdb.NewWatchSet()
+	if _, _, err := s.NodeBlockList(ws); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.NodeBlockDelete(4, "nope"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx := s.maxIndex("node-blocks"); idx != 3 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Now clear one for real.
+	if err := s.NodeBlockDelete(5, "node1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	idx, blocks, err = s.NodeBlockList(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 5 || len(blocks) != 1 || blocks[0].Node != "node2" {
+		t.Fatalf("bad: %d %#v", idx, blocks)
+	}
+	matches, err := s.NodeBlocksMatching("renamed", id)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(matches) != 0 {
+		t.Fatalf("bad: %#v", matches)
+	}
+}
+
+func TestStateStore_NodeBlock_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+	before := structs.NodeBlocks{
+		&structs.NodeBlock{Node: "node1", ID: types.NodeID("40e4a748-2192-161a-0510-9bf59fe950b5")},
+		&structs.NodeBlock{Node: "node2", Expires: time.Now().Add(time.Hour).UTC()},
+	}
+	for i, block := range before {
+		if err := s.NodeBlockSet(uint64(i+1), block); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Snapshot the blocks.
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	if err := s.NodeBlockDelete(3, "node1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Verify the snapshot.
+	dump, err := snap.NodeBlocks()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(dump, before) {
+		t.Fatalf("bad: %#v", dump)
+	}
+
+	// Restore the values into a new state store.
+	func() {
+		s := testStateStore(t)
+		restore := s.Restore()
+		for _, block := range dump {
+			if err := restore.NodeBlock(block); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+		restore.Commit()
+
+		idx, res, err := s.NodeBlockList(nil)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 2 || !reflect.DeepEqual(res, before) {
+			t.Fatalf("bad: %d %#v", idx, res)
+		}
+	}()
+}
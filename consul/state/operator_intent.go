@@ -0,0 +1,173 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// OperatorIntents is used to pull all the operator intents from the
+// snapshot.
+func (s *StateSnapshot) OperatorIntents() (structs.OperatorIntents, error) {
+	intents, err := s.tx.Get("operator-intents", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	var ret structs.OperatorIntents
+	for intent := intents.Next(); intent != nil; intent = intents.Next() {
+		ret = append(ret, intent.(*structs.OperatorIntent))
+	}
+	return ret, nil
+}
+
+// OperatorIntent is used when restoring from a snapshot. For general
+// inserts, use OperatorIntentCreate.
+func (s *StateRestore) OperatorIntent(intent *structs.OperatorIntent) error {
+	if err := s.tx.Insert("operator-intents", intent); err != nil {
+		return fmt.Errorf("failed restoring operator intent: %s", err)
+	}
+	if err := indexUpdateMaxTxn(s.tx, intent.ModifyIndex, "operator-intents"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	return nil
+}
+
+// OperatorIntentCreate is used to record a new operator intent.
+func (s *StateStore) OperatorIntentCreate(idx uint64, intent *structs.OperatorIntent) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	if intent.ID == "" {
+		return ErrMissingOperatorIntentID
+	}
+
+	existing, err := tx.First("operator-intents", "id", intent.ID)
+	if err != nil {
+		return fmt.Errorf("failed operator intent lookup: %s", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("operator intent %q already exists", intent.ID)
+	}
+	intent.CreateIndex = idx
+	intent.ModifyIndex = idx
+
+	// Insert the intent and update the index.
+	if err := tx.Insert("operator-intents", intent); err != nil {
+		return fmt.Errorf("failed inserting operator intent: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"operator-intents", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// OperatorIntentUpdate moves the given operator intent on to the given step,
+// as long as it hasn't been modified since the given index. It returns false
+// if the intent is gone or has been modified.
+func (s *StateStore) OperatorIntentUpdate(idx uint64, id, step string, cidx uint64) (bool, error) {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	existing, err := tx.First("operator-intents", "id", id)
+	if err != nil {
+		return false, fmt.Errorf("failed operator intent lookup: %s", err)
+	}
+	if existing == nil || existing.(*structs.OperatorIntent).ModifyIndex != cidx {
+		return false, nil
+	}
+
+	// Make a copy so we don't modify the one in the state store.
+	intent := *existing.(*structs.OperatorIntent)
+	intent.Step = step
+	intent.ModifyIndex = idx
+
+	if err := tx.Insert("operator-intents", &intent); err != nil {
+		return false, fmt.Errorf("failed inserting operator intent: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"operator-intents", idx}); err != nil {
+		return false, fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Commit()
+	return true, nil
+}
+
+// OperatorIntentDelete removes the given operator intent, as long as it
+// hasn't been modified since the given index. It returns false if the intent
+// is gone or has been modified.
+func (s *StateStore) OperatorIntentDelete(idx uint64, id string, cidx uint64) (bool, error) {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	existing, err := tx.First("operator-intents", "id", id)
+	if err != nil {
+		return false, fmt.Errorf("failed operator intent lookup: %s", err)
+	}
+	if existing == nil || existing.(*structs.OperatorIntent).ModifyIndex != cidx {
+		return false, nil
+	}
+
+	// Delete the intent and update the index.
+	if err := tx.Delete("operator-intents", existing); err != nil {
+		return false, fmt.Errorf("failed operator intent delete: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"operator-intents", idx}); err != nil {
+		return false, fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Commit()
+	return true, nil
+}
+
+// OperatorIntentGet returns the operator intent with the given ID, or nil if
+// there isn't one.
+func (s *StateStore) OperatorIntentGet(ws memdb.WatchSet, id string) (uint64, *structs.OperatorIntent, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "operator-intents")
+
+	watchCh, intent, err := tx.FirstWatch("operator-intents", "id", id)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed operator intent lookup: %s", err)
+	}
+	ws.Add(watchCh)
+
+	if intent == nil {
+		return idx, nil, nil
+	}
+	return idx, intent.(*structs.OperatorIntent), nil
+}
+
+// OperatorIntentList returns all the pending operator intents, oldest first.
+func (s *StateStore) OperatorIntentList(ws memdb.WatchSet) (uint64, structs.OperatorIntents, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "operator-intents")
+
+	// Query all of the intents.
+	intents, err := tx.Get("operator-intents", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed operator intent lookup: %s", err)
+	}
+	ws.Add(intents.WatchCh())
+
+	// Go over all of the intents and build the response.
+	var result structs.OperatorIntents
+	for intent := intents.Next(); intent != nil; intent = intents.Next() {
+		result = append(result, intent.(*structs.OperatorIntent))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreateIndex < result[j].CreateIndex
+	})
+	return idx, result, nil
+}
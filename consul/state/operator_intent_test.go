@@ -0,0 +1,164 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+func TestStateStore_OperatorIntent_CRUD(t *testing.T) {
+	s := testStateStore(t)
+
+	// Should start out empty.
+	ws := memdb.NewWatchSet()
+	idx, intents, err := s.OperatorIntentList(ws)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 || len(intents) != 0 {
+		t.Fatalf("bad: %d %#v", idx, intents)
+	}
+
+	// The ID is required.
+	if err := s.OperatorIntentCreate(1, &structs.OperatorIntent{}); err != ErrMissingOperatorIntentID {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Add a couple of intents.
+	first := &structs.OperatorIntent{
+		ID:     testUUID(),
+		Kind:   structs.OperatorIntentServerLeave,
+		Target: "server1",
+		Step:   "one",
+	}
+	if err := s.OperatorIntentCreate(2, first); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	second := &structs.OperatorIntent{
+		ID:     testUUID(),
+		Kind:   structs.OperatorIntentDeadServerCleanup,
+		Target: "server2",
+		Step:   "one",
+	}
+	if err := s.OperatorIntentCreate(3, second); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.OperatorIntentCreate(4, &structs.OperatorIntent{ID: first.ID}); err == nil {
+		t.Fatalf("should fail")
+	}
+	idx, intents, err = s.OperatorIntentList(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 3 || !reflect.DeepEqual(intents, structs.OperatorIntents{first, second}) {
+		t.Fatalf("bad: %d %#v", idx, intents)
+	}
+
+	// Updates only go through from the current modify index.
+	ws = memdb.NewWatchSet()
+	if _, _, err := s.OperatorIntentGet(ws, first.ID); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if ok, err := s.OperatorIntentUpdate(5, first.ID, "two", 1); err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	if ok, err := s.OperatorIntentUpdate(5, first.ID, "two", 2); err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	if ok, err := s.OperatorIntentUpdate(6, first.ID, "three", 2); err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	if ok, err := s.OperatorIntentUpdate(6, testUUID(), "two", 2); err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	idx, intent, err := s.OperatorIntentGet(nil, first.ID)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 5 || intent.Step != "two" || intent.Target != "server1" ||
+		intent.CreateIndex != 2 || intent.ModifyIndex != 5 {
+		t.Fatalf("bad: %d %#v", idx, intent)
+	}
+
+	// The original shouldn't have been touched.
+	if first.Step != "one" || first.ModifyIndex != 2 {
+		t.Fatalf("bad: %#v", first)
+	}
+
+	// Deletes work the same way.
+	if ok, err := s.OperatorIntentDelete(7, first.ID, 2); err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	if ok, err := s.OperatorIntentDelete(7, first.ID, 5); err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	if ok, err := s.OperatorIntentDelete(8, first.ID, 5); err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	idx, intents, err = s.OperatorIntentList(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 7 || !reflect.DeepEqual(intents, structs.OperatorIntents{second}) {
+		t.Fatalf("bad: %d %#v", idx, intents)
+	}
+}
+
+func TestStateStore_OperatorIntent_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+	before := structs.OperatorIntents{
+		&structs.OperatorIntent{ID: testUUID(), Kind: structs.OperatorIntentServerLeave, Target: "server1"},
+		&structs.OperatorIntent{ID: testUUID(), Kind: structs.OperatorIntentDeadServerCleanup, Target: "server2"},
+	}
+	for i, intent := range before {
+		if err := s.OperatorIntentCreate(uint64(i+1), intent); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Snapshot the intents.
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	if _, err := s.OperatorIntentDelete(3, before[0].ID, 1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Verify the snapshot.
+	dump, err := snap.OperatorIntents()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(dump) != 2 {
+		t.Fatalf("bad: %#v", dump)
+	}
+
+	// Restore the values into a new state store.
+	func() {
+		s := testStateStore(t)
+		restore := s.Restore()
+		for _, intent := range dump {
+			if err := restore.OperatorIntent(intent); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+		restore.Commit()
+
+		idx, res, err := s.OperatorIntentList(nil)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 2 || !reflect.DeepEqual(res, before) {
+			t.Fatalf("bad: %d %#v", idx, res)
+		}
+	}()
+}
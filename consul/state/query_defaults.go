@@ -0,0 +1,79 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// QueryDefaults is used to pull the query defaults from the snapshot.
+func (s *StateSnapshot) QueryDefaults() (*structs.QueryDefaults, error) {
+	d, err := s.tx.First("query-defaults", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	defaults, ok := d.(*structs.QueryDefaults)
+	if !ok {
+		return nil, nil
+	}
+
+	return defaults, nil
+}
+
+// QueryDefaults is used when restoring from a snapshot.
+func (s *StateRestore) QueryDefaults(defaults *structs.QueryDefaults) error {
+	if err := s.tx.Insert("query-defaults", defaults); err != nil {
+		return fmt.Errorf("failed restoring query defaults: %s", err)
+	}
+
+	return nil
+}
+
+// QueryDefaults is used to get the current default query options. This
+// returns nil if they've never been set.
+func (s *StateStore) QueryDefaults(ws memdb.WatchSet) (uint64, *structs.QueryDefaults, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	watchCh, d, err := tx.FirstWatch("query-defaults", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed query defaults lookup: %s", err)
+	}
+	ws.Add(watchCh)
+
+	defaults, ok := d.(*structs.QueryDefaults)
+	if !ok {
+		return 0, nil, nil
+	}
+
+	return defaults.ModifyIndex, defaults, nil
+}
+
+// QueryDefaultsSet is used to set the default query options.
+func (s *StateStore) QueryDefaultsSet(idx uint64, defaults *structs.QueryDefaults) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Check for existing defaults.
+	existing, err := tx.First("query-defaults", "id")
+	if err != nil {
+		return fmt.Errorf("failed query defaults lookup: %s", err)
+	}
+
+	// Set the indexes.
+	if existing != nil {
+		defaults.CreateIndex = existing.(*structs.QueryDefaults).CreateIndex
+	} else {
+		defaults.CreateIndex = idx
+	}
+	defaults.ModifyIndex = idx
+
+	if err := tx.Insert("query-defaults", defaults); err != nil {
+		return fmt.Errorf("failed updating query defaults: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
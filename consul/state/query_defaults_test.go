@@ -0,0 +1,98 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+func TestStateStore_QueryDefaults(t *testing.T) {
+	s := testStateStore(t)
+
+	// Should start out unset.
+	ws := memdb.NewWatchSet()
+	idx, defaults, err := s.QueryDefaults(ws)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 || defaults != nil {
+		t.Fatalf("bad: %d %#v", idx, defaults)
+	}
+
+	expected := &structs.QueryDefaults{
+		AllowStale:   true,
+		MaxQueryTime: 2 * time.Minute,
+		Near:         "foo",
+	}
+	if err := s.QueryDefaultsSet(1, expected); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	idx, defaults, err = s.QueryDefaults(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 1 || !reflect.DeepEqual(defaults, expected) {
+		t.Fatalf("bad: %d %#v", idx, defaults)
+	}
+
+	// An update should keep the create index.
+	if err := s.QueryDefaultsSet(2, &structs.QueryDefaults{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, defaults, err = s.QueryDefaults(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2 || defaults.CreateIndex != 1 || defaults.AllowStale {
+		t.Fatalf("bad: %d %#v", idx, defaults)
+	}
+}
+
+func TestStateStore_QueryDefaults_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+	before := &structs.QueryDefaults{
+		AllowStale: true,
+		Near:       "foo",
+	}
+	if err := s.QueryDefaultsSet(99, before); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	if err := s.QueryDefaultsSet(100, &structs.QueryDefaults{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	snapped, err := snap.QueryDefaults()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(snapped, before) {
+		t.Fatalf("bad: %#v", snapped)
+	}
+
+	s2 := testStateStore(t)
+	restore := s2.Restore()
+	if err := restore.QueryDefaults(snapped); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	restore.Commit()
+
+	idx, res, err := s2.QueryDefaults(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 99 || !reflect.DeepEqual(res, before) {
+		t.Fatalf("bad: %d %#v", idx, res)
+	}
+}
@@ -0,0 +1,79 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// QueryFreeze is used to pull the prepared query freeze from the snapshot.
+func (s *StateSnapshot) QueryFreeze() (*structs.QueryFreeze, error) {
+	f, err := s.tx.First("query-freeze", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	freeze, ok := f.(*structs.QueryFreeze)
+	if !ok {
+		return nil, nil
+	}
+
+	return freeze, nil
+}
+
+// QueryFreeze is used when restoring from a snapshot.
+func (s *StateRestore) QueryFreeze(freeze *structs.QueryFreeze) error {
+	if err := s.tx.Insert("query-freeze", freeze); err != nil {
+		return fmt.Errorf("failed restoring query freeze: %s", err)
+	}
+
+	return nil
+}
+
+// QueryFreeze is used to get the prepared query freeze. This returns nil if
+// it's never been set.
+func (s *StateStore) QueryFreeze(ws memdb.WatchSet) (uint64, *structs.QueryFreeze, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	watchCh, f, err := tx.FirstWatch("query-freeze", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed query freeze lookup: %s", err)
+	}
+	ws.Add(watchCh)
+
+	freeze, ok := f.(*structs.QueryFreeze)
+	if !ok {
+		return 0, nil, nil
+	}
+
+	return freeze.ModifyIndex, freeze, nil
+}
+
+// QueryFreezeSet is used to set or clear the prepared query freeze.
+func (s *StateStore) QueryFreezeSet(idx uint64, freeze *structs.QueryFreeze) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Check for an existing freeze.
+	existing, err := tx.First("query-freeze", "id")
+	if err != nil {
+		return fmt.Errorf("failed query freeze lookup: %s", err)
+	}
+
+	// Set the indexes.
+	if existing != nil {
+		freeze.CreateIndex = existing.(*structs.QueryFreeze).CreateIndex
+	} else {
+		freeze.CreateIndex = idx
+	}
+	freeze.ModifyIndex = idx
+
+	if err := tx.Insert("query-freeze", freeze); err != nil {
+		return fmt.Errorf("failed updating query freeze: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
@@ -0,0 +1,99 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+func TestStateStore_QueryFreeze(t *testing.T) {
+	s := testStateStore(t)
+
+	// Should start out unset.
+	ws := memdb.NewWatchSet()
+	idx, freeze, err := s.QueryFreeze(ws)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 || freeze != nil {
+		t.Fatalf("bad: %d %#v", idx, freeze)
+	}
+
+	expected := &structs.QueryFreeze{
+		Frozen: true,
+		SetBy:  "alice",
+		SetAt:  time.Now().UTC(),
+		Reason: "incident 42",
+	}
+	if err := s.QueryFreezeSet(1, expected); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	idx, freeze, err = s.QueryFreeze(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 1 || !reflect.DeepEqual(freeze, expected) {
+		t.Fatalf("bad: %d %#v", idx, freeze)
+	}
+
+	// An update should keep the create index.
+	if err := s.QueryFreezeSet(2, &structs.QueryFreeze{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, freeze, err = s.QueryFreeze(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2 || freeze.CreateIndex != 1 || freeze.Frozen {
+		t.Fatalf("bad: %d %#v", idx, freeze)
+	}
+}
+
+func TestStateStore_QueryFreeze_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+	before := &structs.QueryFreeze{
+		Frozen: true,
+		SetBy:  "alice",
+	}
+	if err := s.QueryFreezeSet(99, before); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	if err := s.QueryFreezeSet(100, &structs.QueryFreeze{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	snapped, err := snap.QueryFreeze()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(snapped, before) {
+		t.Fatalf("bad: %#v", snapped)
+	}
+
+	s2 := testStateStore(t)
+	restore := s2.Restore()
+	if err := restore.QueryFreeze(snapped); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	restore.Commit()
+
+	idx, res, err := s2.QueryFreeze(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 99 || !reflect.DeepEqual(res, before) {
+		t.Fatalf("bad: %d %#v", idx, res)
+	}
+}
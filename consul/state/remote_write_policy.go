@@ -0,0 +1,79 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// RemoteWritePolicy is used to pull the remote write policy from the snapshot.
+func (s *StateSnapshot) RemoteWritePolicy() (*structs.RemoteWritePolicy, error) {
+	p, err := s.tx.First("remote-write-policy", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	policy, ok := p.(*structs.RemoteWritePolicy)
+	if !ok {
+		return nil, nil
+	}
+
+	return policy, nil
+}
+
+// RemoteWritePolicy is used when restoring from a snapshot.
+func (s *StateRestore) RemoteWritePolicy(policy *structs.RemoteWritePolicy) error {
+	if err := s.tx.Insert("remote-write-policy", policy); err != nil {
+		return fmt.Errorf("failed restoring remote write policy: %s", err)
+	}
+
+	return nil
+}
+
+// RemoteWritePolicy is used to get the remote write policy. This returns nil
+// if it's never been set.
+func (s *StateStore) RemoteWritePolicy(ws memdb.WatchSet) (uint64, *structs.RemoteWritePolicy, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	watchCh, p, err := tx.FirstWatch("remote-write-policy", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed remote write policy lookup: %s", err)
+	}
+	ws.Add(watchCh)
+
+	policy, ok := p.(*structs.RemoteWritePolicy)
+	if !ok {
+		return 0, nil, nil
+	}
+
+	return policy.ModifyIndex, policy, nil
+}
+
+// RemoteWritePolicySet is used to update the remote write policy.
+func (s *StateStore) RemoteWritePolicySet(idx uint64, policy *structs.RemoteWritePolicy) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Check for an existing policy.
+	existing, err := tx.First("remote-write-policy", "id")
+	if err != nil {
+		return fmt.Errorf("failed remote write policy lookup: %s", err)
+	}
+
+	// Set the indexes.
+	if existing != nil {
+		policy.CreateIndex = existing.(*structs.RemoteWritePolicy).CreateIndex
+	} else {
+		policy.CreateIndex = idx
+	}
+	policy.ModifyIndex = idx
+
+	if err := tx.Insert("remote-write-policy", policy); err != nil {
+		return fmt.Errorf("failed updating remote write policy: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
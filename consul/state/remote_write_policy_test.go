@@ -0,0 +1,94 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+func TestStateStore_RemoteWritePolicy(t *testing.T) {
+	s := testStateStore(t)
+
+	// Should start out unset.
+	ws := memdb.NewWatchSet()
+	idx, policy, err := s.RemoteWritePolicy(ws)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 || policy != nil {
+		t.Fatalf("bad: %d %#v", idx, policy)
+	}
+
+	expected := &structs.RemoteWritePolicy{
+		RefuseRemoteWrites: true,
+	}
+	if err := s.RemoteWritePolicySet(1, expected); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	idx, policy, err = s.RemoteWritePolicy(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 1 || !reflect.DeepEqual(policy, expected) {
+		t.Fatalf("bad: %d %#v", idx, policy)
+	}
+
+	// An update should keep the create index.
+	if err := s.RemoteWritePolicySet(2, &structs.RemoteWritePolicy{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, policy, err = s.RemoteWritePolicy(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2 || policy.CreateIndex != 1 || policy.RefuseRemoteWrites {
+		t.Fatalf("bad: %d %#v", idx, policy)
+	}
+}
+
+func TestStateStore_RemoteWritePolicy_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+	before := &structs.RemoteWritePolicy{
+		RefuseRemoteWrites: true,
+	}
+	if err := s.RemoteWritePolicySet(99, before); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	if err := s.RemoteWritePolicySet(100, &structs.RemoteWritePolicy{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	snapped, err := snap.RemoteWritePolicy()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(snapped, before) {
+		t.Fatalf("bad: %#v", snapped)
+	}
+
+	s2 := testStateStore(t)
+	restore := s2.Restore()
+	if err := restore.RemoteWritePolicy(snapped); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	restore.Commit()
+
+	idx, res, err := s2.RemoteWritePolicy(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 99 || !reflect.DeepEqual(res, before) {
+		t.Fatalf("bad: %d %#v", idx, res)
+	}
+}
@@ -0,0 +1,130 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// ReverseLookup finds the nodes whose name matches the query, or that have
+// the query as their address, as one of their tagged addresses, or as the
+// address of one of their services. Each match carries the node's services,
+// checks, sessions, and the keys locked by those sessions, all read from the
+// same snapshot. This is meant for tracking down what an IP address belongs
+// to, so it scans the whole catalog.
+func (s *StateStore) ReverseLookup(ws memdb.WatchSet, query string) (uint64, []*structs.ReverseLookupMatch, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "nodes", "services", "checks", "sessions", "kvs")
+
+	// Find the services that have the address. Services without an address
+	// of their own use the node's, which is covered below.
+	matchedBy := make(map[string][]string)
+	services, err := tx.Get("services", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed services lookup: %s", err)
+	}
+	ws.Add(services.WatchCh())
+	for service := services.Next(); service != nil; service = services.Next() {
+		svc := service.(*structs.ServiceNode)
+		if svc.ServiceAddress == query {
+			matchedBy[svc.Node] = append(matchedBy[svc.Node],
+				structs.ReverseLookupServiceAddress+":"+svc.ServiceID)
+		}
+	}
+
+	// Run through the nodes in order and pick out the ones that match.
+	nodes, err := tx.Get("nodes", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed node lookup: %s", err)
+	}
+	ws.Add(nodes.WatchCh())
+	var results []*structs.ReverseLookupMatch
+	for n := nodes.Next(); n != nil; n = nodes.Next() {
+		node := n.(*structs.Node)
+
+		var reasons []string
+		if strings.EqualFold(node.Node, query) {
+			reasons = append(reasons, structs.ReverseLookupNodeName)
+		}
+		if node.Address == query {
+			reasons = append(reasons, structs.ReverseLookupAddress)
+		}
+		var tags []string
+		for tag, addr := range node.TaggedAddresses {
+			if addr == query {
+				tags = append(tags, tag)
+			}
+		}
+		sort.Strings(tags)
+		for _, tag := range tags {
+			reasons = append(reasons, structs.ReverseLookupTaggedAddress+":"+tag)
+		}
+		reasons = append(reasons, matchedBy[node.Node]...)
+		if len(reasons) == 0 {
+			continue
+		}
+
+		match, err := s.reverseLookupMatchTxn(tx, ws, node)
+		if err != nil {
+			return 0, nil, err
+		}
+		match.MatchedBy = reasons
+		results = append(results, match)
+	}
+	return idx, results, nil
+}
+
+// reverseLookupMatchTxn gathers up everything in the catalog that's tied to
+// the given node.
+func (s *StateStore) reverseLookupMatchTxn(tx *memdb.Txn, ws memdb.WatchSet,
+	node *structs.Node) (*structs.ReverseLookupMatch, error) {
+
+	match := &structs.ReverseLookupMatch{Node: node}
+
+	// Services were already watched as a whole by the caller.
+	services, err := tx.Get("services", "node", node.Node)
+	if err != nil {
+		return nil, fmt.Errorf("failed services lookup: %s", err)
+	}
+	for service := services.Next(); service != nil; service = services.Next() {
+		match.Services = append(match.Services, service.(*structs.ServiceNode).ToNodeService())
+	}
+
+	checks, err := tx.Get("checks", "node", node.Node)
+	if err != nil {
+		return nil, fmt.Errorf("failed check lookup: %s", err)
+	}
+	ws.Add(checks.WatchCh())
+	for check := checks.Next(); check != nil; check = checks.Next() {
+		match.Checks = append(match.Checks, check.(*structs.HealthCheck))
+	}
+
+	sessions, err := tx.Get("sessions", "node", node.Node)
+	if err != nil {
+		return nil, fmt.Errorf("failed session lookup: %s", err)
+	}
+	ws.Add(sessions.WatchCh())
+	for session := sessions.Next(); session != nil; session = sessions.Next() {
+		sess := session.(*structs.Session)
+		match.Sessions = append(match.Sessions, sess)
+
+		// Pick up the keys this session holds locks on, without the values.
+		entries, err := tx.Get("kvs", "session", sess.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed kvs lookup: %s", err)
+		}
+		ws.Add(entries.WatchCh())
+		for entry := entries.Next(); entry != nil; entry = entries.Next() {
+			e := *entry.(*structs.DirEntry)
+			e.Value = nil
+			match.Locks = append(match.Locks, &e)
+		}
+	}
+	return match, nil
+}
@@ -0,0 +1,127 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+func TestStateStore_ReverseLookup(t *testing.T) {
+	s := testStateStore(t)
+
+	// Nothing should match in an empty catalog.
+	ws := memdb.NewWatchSet()
+	idx, matches, err := s.ReverseLookup(ws, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 || len(matches) != 0 {
+		t.Fatalf("bad: %d %v", idx, matches)
+	}
+
+	// Set up the address on node1 itself, on a service on node2, and as a
+	// tagged address on node3. node4 doesn't have it anywhere.
+	nodes := []*structs.Node{
+		&structs.Node{Node: "node1", Address: "10.0.0.1"},
+		&structs.Node{Node: "node2", Address: "10.0.0.2"},
+		&structs.Node{Node: "node3", Address: "10.0.0.3",
+			TaggedAddresses: map[string]string{"lan": "10.0.0.3", "wan": "10.0.0.1"}},
+		&structs.Node{Node: "node4", Address: "10.0.0.4"},
+	}
+	for i, node := range nodes {
+		if err := s.EnsureNode(uint64(1+i), node); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if err := s.EnsureService(5, "node2", &structs.NodeService{ID: "web1", Service: "web", Address: "10.0.0.1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.EnsureService(6, "node2", &structs.NodeService{ID: "db1", Service: "db"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.EnsureService(7, "node4", &structs.NodeService{ID: "web1", Service: "web", Address: "10.0.0.4"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testRegisterCheck(t, s, 8, "node2", "web1", "check1", structs.HealthPassing)
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	// Give node2 a session that holds a lock.
+	sess := &structs.Session{ID: testUUID(), Node: "node2"}
+	if err := s.SessionCreate(9, sess); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ok, err := s.KVSLock(10, &structs.DirEntry{Key: "locks/web", Value: []byte("hello"), Session: sess.ID})
+	if !ok || err != nil {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+
+	// Look up the address and make sure each match is attributed right.
+	ws = memdb.NewWatchSet()
+	idx, matches, err = s.ReverseLookup(ws, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 10 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	if len(matches) != 3 {
+		t.Fatalf("bad: %#v", matches)
+	}
+	expected := map[string][]string{
+		"node1": []string{structs.ReverseLookupAddress},
+		"node2": []string{structs.ReverseLookupServiceAddress + ":web1"},
+		"node3": []string{structs.ReverseLookupTaggedAddress + ":wan"},
+	}
+	for _, match := range matches {
+		if !reflect.DeepEqual(match.MatchedBy, expected[match.Node.Node]) {
+			t.Fatalf("bad: %s %v", match.Node.Node, match.MatchedBy)
+		}
+	}
+
+	// The service match should bring along everything on node2.
+	match := matches[1]
+	if len(match.Services) != 2 || len(match.Checks) != 1 || match.Checks[0].CheckID != "check1" {
+		t.Fatalf("bad: %#v", match)
+	}
+	if len(match.Sessions) != 1 || match.Sessions[0].ID != sess.ID {
+		t.Fatalf("bad: %#v", match.Sessions)
+	}
+	if len(match.Locks) != 1 || match.Locks[0].Key != "locks/web" || match.Locks[0].Value != nil {
+		t.Fatalf("bad: %#v", match.Locks)
+	}
+
+	// The lookup shouldn't have touched the value in the state store.
+	_, e, err := s.KVSGet(nil, "locks/web")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(e.Value) != "hello" {
+		t.Fatalf("bad: %#v", e)
+	}
+
+	// Releasing the lock should fire the watch.
+	ok, err = s.KVSUnlock(11, &structs.DirEntry{Key: "locks/web", Session: sess.ID})
+	if !ok || err != nil {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	// Node names match regardless of case.
+	_, matches, err = s.ReverseLookup(nil, "NODE4")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(matches) != 1 || matches[0].Node.Node != "node4" ||
+		!reflect.DeepEqual(matches[0].MatchedBy, []string{structs.ReverseLookupNodeName}) {
+		t.Fatalf("bad: %#v", matches)
+	}
+	if len(matches[0].Locks) != 0 {
+		t.Fatalf("bad: %#v", matches[0].Locks)
+	}
+}
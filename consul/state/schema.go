@@ -26,12 +26,27 @@ func stateStoreSchema() *memdb.DBSchema {
 		checksTableSchema,
 		kvsTableSchema,
 		tombstonesTableSchema,
+		catalogTombstonesTableSchema,
 		sessionsTableSchema,
 		sessionChecksTableSchema,
 		aclsTableSchema,
 		coordinatesTableSchema,
 		preparedQueriesTableSchema,
 		autopilotConfigTableSchema,
+		centralChecksTableSchema,
+		queryDefaultsTableSchema,
+		datacenterAliasesTableSchema,
+		serviceConstraintsTableSchema,
+		queryFreezeTableSchema,
+		signingKeysTableSchema,
+		remoteWritePolicyTableSchema,
+		serviceNamePolicyTableSchema,
+		nodeBlocksTableSchema,
+		serverHistoryTableSchema,
+		federationPoliciesTableSchema,
+		operatorIntentsTableSchema,
+		kvQuotasTableSchema,
+		clusterIDTableSchema,
 	}
 
 	// Add the tables to the root schema
@@ -96,6 +111,14 @@ func nodesTableSchema() *memdb.TableSchema {
 					Lowercase: false,
 				},
 			},
+			"address": &memdb.IndexSchema{
+				Name:         "address",
+				AllowMissing: true,
+				Unique:       false,
+				Indexer: &memdb.StringFieldIndex{
+					Field: "Address",
+				},
+			},
 		},
 	}
 }
@@ -141,6 +164,32 @@ func servicesTableSchema() *memdb.TableSchema {
 					Lowercase: true,
 				},
 			},
+			"address": &memdb.IndexSchema{
+				Name:         "address",
+				AllowMissing: true,
+				Unique:       false,
+				Indexer: &memdb.StringFieldIndex{
+					Field: "ServiceAddress",
+				},
+			},
+			"kind": &memdb.IndexSchema{
+				Name:         "kind",
+				AllowMissing: true,
+				Unique:       false,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "ServiceKind",
+					Lowercase: true,
+				},
+			},
+			"meta": &memdb.IndexSchema{
+				Name:         "meta",
+				AllowMissing: true,
+				Unique:       false,
+				Indexer: &memdb.StringMapFieldIndex{
+					Field:     "ServiceMeta",
+					Lowercase: false,
+				},
+			},
 		},
 	}
 }
@@ -179,6 +228,15 @@ func checksTableSchema() *memdb.TableSchema {
 					Lowercase: false,
 				},
 			},
+			"check_id": &memdb.IndexSchema{
+				Name:         "check_id",
+				AllowMissing: false,
+				Unique:       false,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "CheckID",
+					Lowercase: false,
+				},
+			},
 			"service": &memdb.IndexSchema{
 				Name:         "service",
 				AllowMissing: true,
@@ -277,6 +335,52 @@ func tombstonesTableSchema() *memdb.TableSchema {
 					Lowercase: false,
 				},
 			},
+			"prefix": &memdb.IndexSchema{
+				Name:         "prefix",
+				AllowMissing: true,
+				Unique:       true,
+				Indexer:      &TombstonePrefixIndex{},
+			},
+		},
+	}
+}
+
+// catalogTombstonesTableSchema returns a new TableSchema used for
+// tracking the services and checks that have been deleted from the catalog.
+func catalogTombstonesTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "catalog-tombstones",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.CompoundIndex{
+					Indexes: []memdb.Indexer{
+						&memdb.StringFieldIndex{
+							Field:     "Node",
+							Lowercase: true,
+						},
+						&memdb.StringFieldIndex{
+							Field:     "Kind",
+							Lowercase: false,
+						},
+						&memdb.StringFieldIndex{
+							Field:     "ID",
+							Lowercase: true,
+						},
+					},
+				},
+			},
+			"node": &memdb.IndexSchema{
+				Name:         "node",
+				AllowMissing: false,
+				Unique:       false,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "Node",
+					Lowercase: true,
+				},
+			},
 		},
 	}
 }
@@ -304,6 +408,15 @@ func sessionsTableSchema() *memdb.TableSchema {
 					Lowercase: true,
 				},
 			},
+			"token_hash": &memdb.IndexSchema{
+				Name:         "token_hash",
+				AllowMissing: true,
+				Unique:       false,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "TokenHash",
+					Lowercase: false,
+				},
+			},
 		},
 	}
 }
@@ -459,3 +572,270 @@ func autopilotConfigTableSchema() *memdb.TableSchema {
 		},
 	}
 }
+
+// centralChecksTableSchema returns a new table schema used for storing
+// central check definitions.
+func centralChecksTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "central-checks",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.UUIDFieldIndex{
+					Field: "ID",
+				},
+			},
+		},
+	}
+}
+
+// queryDefaultsTableSchema returns a new table schema used for storing the
+// default query options.
+func queryDefaultsTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "query-defaults",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: true,
+				Unique:       true,
+				Indexer: &memdb.ConditionalIndex{
+					Conditional: func(obj interface{}) (bool, error) { return true, nil },
+				},
+			},
+		},
+	}
+}
+
+// datacenterAliasesTableSchema returns a new table schema used for storing
+// the aliases of renamed datacenters.
+func datacenterAliasesTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "dc-aliases",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.StringFieldIndex{
+					Field: "Alias",
+				},
+			},
+			"canonical": &memdb.IndexSchema{
+				Name:         "canonical",
+				AllowMissing: false,
+				Unique:       false,
+				Indexer: &memdb.StringFieldIndex{
+					Field: "Canonical",
+				},
+			},
+		},
+	}
+}
+
+// serviceConstraintsTableSchema returns a new table schema used for storing
+// the constraints that instances of a service must agree on.
+func serviceConstraintsTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "service-constraints",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.StringFieldIndex{
+					Field: "Service",
+				},
+			},
+		},
+	}
+}
+
+// queryFreezeTableSchema returns a new table schema used for storing the
+// prepared query freeze.
+func queryFreezeTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "query-freeze",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: true,
+				Unique:       true,
+				Indexer: &memdb.ConditionalIndex{
+					Conditional: func(obj interface{}) (bool, error) { return true, nil },
+				},
+			},
+		},
+	}
+}
+
+// signingKeysTableSchema returns a new table schema used for storing the keys
+// used to sign query results.
+func signingKeysTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "signing-keys",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.StringFieldIndex{
+					Field: "ID",
+				},
+			},
+		},
+	}
+}
+
+// remoteWritePolicyTableSchema returns a new table schema used for storing
+// the remote write policy.
+func remoteWritePolicyTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "remote-write-policy",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: true,
+				Unique:       true,
+				Indexer: &memdb.ConditionalIndex{
+					Conditional: func(obj interface{}) (bool, error) { return true, nil },
+				},
+			},
+		},
+	}
+}
+
+// serviceNamePolicyTableSchema returns a new table schema used for storing
+// the service name policy.
+func serviceNamePolicyTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "service-name-policy",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: true,
+				Unique:       true,
+				Indexer: &memdb.ConditionalIndex{
+					Conditional: func(obj interface{}) (bool, error) { return true, nil },
+				},
+			},
+		},
+	}
+}
+
+// nodeBlocksTableSchema returns a new table schema used for storing the nodes
+// that can't be registered again after they were deregistered.
+func nodeBlocksTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "node-blocks",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "Node",
+					Lowercase: true,
+				},
+			},
+			"uuid": &memdb.IndexSchema{
+				Name:         "uuid",
+				AllowMissing: true,
+				Unique:       false,
+				Indexer: &memdb.UUIDFieldIndex{
+					Field: "ID",
+				},
+			},
+		},
+	}
+}
+
+// serverHistoryTableSchema returns a new table schema used for storing the
+// history of changes to the Raft membership of servers.
+func serverHistoryTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "server-history",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer:      &ServerEventIndex{},
+			},
+		},
+	}
+}
+
+// federationPoliciesTableSchema returns a new table schema used for storing
+// the per-datacenter federation policies.
+func federationPoliciesTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "federation-policies",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.StringFieldIndex{
+					Field: "Datacenter",
+				},
+			},
+		},
+	}
+}
+
+// operatorIntentsTableSchema returns a new table schema used for storing the
+// progress of multi-step workflows run by the leader.
+func operatorIntentsTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "operator-intents",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.UUIDFieldIndex{
+					Field: "ID",
+				},
+			},
+		},
+	}
+}
+
+// kvQuotasTableSchema returns a new table schema used for storing the limits
+// on KV prefixes, along with how much is stored under each one.
+func kvQuotasTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "kv-quotas",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.StringFieldIndex{
+					Field: "Prefix",
+				},
+			},
+		},
+	}
+}
+
+// clusterIDTableSchema returns a new table schema used for storing the
+// cluster ID.
+func clusterIDTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "cluster-id",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: true,
+				Unique:       true,
+				Indexer: &memdb.ConditionalIndex{
+					Conditional: func(obj interface{}) (bool, error) { return true, nil },
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,141 @@
+package state
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// maxServerEvents is how many server events are kept. The oldest ones are
+// dropped to make room for new ones.
+const maxServerEvents = 1000
+
+// ServerEventIndex is a custom memdb indexer that indexes server events by
+// their numeric ID, so they're kept in order. None of the built-in indexers
+// handle integers.
+type ServerEventIndex struct {
+}
+
+// FromObject is used to compute the index key when inserting or updating an
+// object.
+func (*ServerEventIndex) FromObject(obj interface{}) (bool, []byte, error) {
+	event, ok := obj.(*structs.ServerEvent)
+	if !ok {
+		return false, nil, fmt.Errorf("invalid object given to index as server event")
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, event.ID)
+	return true, buf, nil
+}
+
+// FromArgs is used when querying for an exact match.
+func (*ServerEventIndex) FromArgs(args ...interface{}) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("must provide only a single argument")
+	}
+	arg, ok := args[0].(uint64)
+	if !ok {
+		return nil, fmt.Errorf("argument must be a uint64: %#v", args[0])
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, arg)
+	return buf, nil
+}
+
+// ServerHistory is used to pull the server history from the snapshot.
+func (s *StateSnapshot) ServerHistory() (structs.ServerEvents, error) {
+	events, err := s.tx.Get("server-history", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	var ret structs.ServerEvents
+	for event := events.Next(); event != nil; event = events.Next() {
+		ret = append(ret, event.(*structs.ServerEvent))
+	}
+	return ret, nil
+}
+
+// ServerEvent is used when restoring from a snapshot. For general inserts, use
+// ServerEventAppend.
+func (s *StateRestore) ServerEvent(event *structs.ServerEvent) error {
+	if err := s.tx.Insert("server-history", event); err != nil {
+		return fmt.Errorf("failed restoring server event: %s", err)
+	}
+	if err := indexUpdateMaxTxn(s.tx, event.ID, "server-history"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	return nil
+}
+
+// ServerEventAppend adds an event to the end of the server history, dropping
+// the oldest events if there are too many. The event's ID is set to the given
+// index.
+func (s *StateStore) ServerEventAppend(idx uint64, event *structs.ServerEvent) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	event.ID = idx
+	if err := tx.Insert("server-history", event); err != nil {
+		return fmt.Errorf("failed inserting server event: %s", err)
+	}
+
+	// Drop the oldest events if we're over the limit.
+	events, err := tx.Get("server-history", "id")
+	if err != nil {
+		return fmt.Errorf("failed server history lookup: %s", err)
+	}
+	var all []interface{}
+	for event := events.Next(); event != nil; event = events.Next() {
+		all = append(all, event)
+	}
+	for i := 0; i < len(all)-maxServerEvents; i++ {
+		if err := tx.Delete("server-history", all[i]); err != nil {
+			return fmt.Errorf("failed deleting server event: %s", err)
+		}
+	}
+
+	if err := tx.Insert("index", &IndexEntry{"server-history", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// ServerHistory returns up to limit server events with IDs after the given
+// one, oldest first. This also returns true if there are more events after
+// the ones returned.
+func (s *StateStore) ServerHistory(ws memdb.WatchSet, after uint64, limit int) (uint64, structs.ServerEvents, bool, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "server-history")
+
+	// Query all of the events. This table is capped, so walking it from the
+	// start is fine.
+	events, err := tx.Get("server-history", "id")
+	if err != nil {
+		return 0, nil, false, fmt.Errorf("failed server history lookup: %s", err)
+	}
+	ws.Add(events.WatchCh())
+
+	var result structs.ServerEvents
+	for raw := events.Next(); raw != nil; raw = events.Next() {
+		event := raw.(*structs.ServerEvent)
+		if event.ID <= after {
+			continue
+		}
+		if len(result) == limit {
+			return idx, result, true, nil
+		}
+		result = append(result, event)
+	}
+	return idx, result, false, nil
+}
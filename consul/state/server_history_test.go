@@ -0,0 +1,145 @@
+package state
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+func TestStateStore_ServerHistory(t *testing.T) {
+	s := testStateStore(t)
+
+	// Should start out empty.
+	ws := memdb.NewWatchSet()
+	idx, events, more, err := s.ServerHistory(ws, 0, 10)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 || len(events) != 0 || more {
+		t.Fatalf("bad: %d %#v %v", idx, events, more)
+	}
+
+	// Add some events, which should get their index as their ID.
+	for i := uint64(1); i <= 5; i++ {
+		event := &structs.ServerEvent{
+			ServerID: fmt.Sprintf("server%d", i),
+			Action:   structs.ServerEventAdded,
+		}
+		if err := s.ServerEventAppend(i*10, event); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if event.ID != i*10 {
+			t.Fatalf("bad: %#v", event)
+		}
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	// Page through them, oldest first.
+	var ids []uint64
+	var after uint64
+	for {
+		idx, events, more, err = s.ServerHistory(nil, after, 2)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 50 || len(events) == 0 || len(events) > 2 {
+			t.Fatalf("bad: %d %#v", idx, events)
+		}
+		for _, event := range events {
+			ids = append(ids, event.ID)
+		}
+		if !more {
+			break
+		}
+		after = events[len(events)-1].ID
+	}
+	if !reflect.DeepEqual(ids, []uint64{10, 20, 30, 40, 50}) {
+		t.Fatalf("bad: %v", ids)
+	}
+
+	// Nothing after the last one.
+	_, events, more, err = s.ServerHistory(nil, 50, 2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(events) != 0 || more {
+		t.Fatalf("bad: %#v %v", events, more)
+	}
+}
+
+func TestStateStore_ServerHistory_Cap(t *testing.T) {
+	s := testStateStore(t)
+
+	// Go over the cap, which should drop the oldest events.
+	for i := uint64(1); i <= maxServerEvents+5; i++ {
+		if err := s.ServerEventAppend(i, &structs.ServerEvent{}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	_, events, more, err := s.ServerHistory(nil, 0, maxServerEvents+10)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(events) != maxServerEvents || more {
+		t.Fatalf("bad: %d %v", len(events), more)
+	}
+	if first, last := events[0].ID, events[len(events)-1].ID; first != 6 || last != maxServerEvents+5 {
+		t.Fatalf("bad: %d %d", first, last)
+	}
+}
+
+func TestStateStore_ServerHistory_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+	before := structs.ServerEvents{
+		&structs.ServerEvent{ServerID: "server1", Action: structs.ServerEventAdded},
+		&structs.ServerEvent{ServerID: "server2", Action: structs.ServerEventRemoved, Reason: "left"},
+	}
+	for i, event := range before {
+		if err := s.ServerEventAppend(uint64(i+1), event); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Snapshot the events.
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	if err := s.ServerEventAppend(3, &structs.ServerEvent{ServerID: "server3"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Verify the snapshot.
+	dump, err := snap.ServerHistory()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(dump, before) {
+		t.Fatalf("bad: %#v", dump)
+	}
+
+	// Restore the values into a new state store.
+	func() {
+		s := testStateStore(t)
+		restore := s.Restore()
+		for _, event := range dump {
+			if err := restore.ServerEvent(event); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+		restore.Commit()
+
+		idx, res, _, err := s.ServerHistory(nil, 0, 10)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 2 || !reflect.DeepEqual(res, before) {
+			t.Fatalf("bad: %d %#v", idx, res)
+		}
+	}()
+}
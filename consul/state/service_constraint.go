@@ -0,0 +1,182 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// ServiceConstraints is used to pull all the service constraints from the
+// snapshot.
+func (s *StateSnapshot) ServiceConstraints() (structs.ServiceConstraints, error) {
+	constraints, err := s.tx.Get("service-constraints", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	var ret structs.ServiceConstraints
+	for constraint := constraints.Next(); constraint != nil; constraint = constraints.Next() {
+		ret = append(ret, constraint.(*structs.ServiceConstraint))
+	}
+	return ret, nil
+}
+
+// ServiceConstraint is used when restoring from a snapshot. For general
+// inserts, use ServiceConstraintSet.
+func (s *StateRestore) ServiceConstraint(constraint *structs.ServiceConstraint) error {
+	if err := s.tx.Insert("service-constraints", constraint); err != nil {
+		return fmt.Errorf("failed restoring service constraint: %s", err)
+	}
+	if err := indexUpdateMaxTxn(s.tx, constraint.ModifyIndex, "service-constraints"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	return nil
+}
+
+// ServiceConstraintSet is used to create or update the constraint for a
+// service. Existing instances aren't checked, the constraint only applies to
+// registrations made after it's set.
+func (s *StateStore) ServiceConstraintSet(idx uint64, constraint *structs.ServiceConstraint) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	if constraint.Service == "" {
+		return ErrMissingServiceConstraint
+	}
+
+	// Set the indexes.
+	existing, err := tx.First("service-constraints", "id", constraint.Service)
+	if err != nil {
+		return fmt.Errorf("failed service constraint lookup: %s", err)
+	}
+	if existing != nil {
+		constraint.CreateIndex = existing.(*structs.ServiceConstraint).CreateIndex
+	} else {
+		constraint.CreateIndex = idx
+	}
+	constraint.ModifyIndex = idx
+
+	// Insert the constraint and update the index.
+	if err := tx.Insert("service-constraints", constraint); err != nil {
+		return fmt.Errorf("failed inserting service constraint: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"service-constraints", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// ServiceConstraintDelete deletes the constraint for the given service.
+func (s *StateStore) ServiceConstraintDelete(idx uint64, service string) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Pull the constraint.
+	constraint, err := tx.First("service-constraints", "id", service)
+	if err != nil {
+		return fmt.Errorf("failed service constraint lookup: %s", err)
+	}
+	if constraint == nil {
+		return nil
+	}
+
+	// Delete the constraint and update the index.
+	if err := tx.Delete("service-constraints", constraint); err != nil {
+		return fmt.Errorf("failed service constraint delete: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"service-constraints", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// ServiceConstraintGet returns the constraint for the given service, or nil
+// if it doesn't have one.
+func (s *StateStore) ServiceConstraintGet(ws memdb.WatchSet, service string) (uint64, *structs.ServiceConstraint, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "service-constraints")
+
+	// Look up the constraint by service name.
+	watchCh, constraint, err := tx.FirstWatch("service-constraints", "id", service)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed service constraint lookup: %s", err)
+	}
+	ws.Add(watchCh)
+	if constraint == nil {
+		return idx, nil, nil
+	}
+	return idx, constraint.(*structs.ServiceConstraint), nil
+}
+
+// ServiceConstraintList returns all the service constraints.
+func (s *StateStore) ServiceConstraintList(ws memdb.WatchSet) (uint64, structs.ServiceConstraints, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "service-constraints")
+
+	// Query all of the constraints.
+	constraints, err := tx.Get("service-constraints", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed service constraint lookup: %s", err)
+	}
+	ws.Add(constraints.WatchCh())
+
+	// Go over all of the constraints and build the response.
+	var result structs.ServiceConstraints
+	for constraint := constraints.Next(); constraint != nil; constraint = constraints.Next() {
+		result = append(result, constraint.(*structs.ServiceConstraint))
+	}
+	return idx, result, nil
+}
+
+// serviceConstraintTxn returns a ServiceConstraintError if the given service
+// instance has a different value for one of its constraint's meta keys than
+// an instance that's already registered. The instance being replaced (same
+// node and ID) is left out of the comparison. This runs inside the
+// registration's transaction so that racing registrations can't both get
+// past it.
+func (s *StateStore) serviceConstraintTxn(tx *memdb.Txn, node string, svc *structs.NodeService) error {
+	constraint, err := tx.First("service-constraints", "id", svc.Service)
+	if err != nil {
+		return fmt.Errorf("failed service constraint lookup: %s", err)
+	}
+	if constraint == nil {
+		return nil
+	}
+	keys := constraint.(*structs.ServiceConstraint).MetaKeys
+
+	instances, err := tx.Get("services", "service", svc.Service)
+	if err != nil {
+		return fmt.Errorf("failed service lookup: %s", err)
+	}
+	for raw := instances.Next(); raw != nil; raw = instances.Next() {
+		instance := raw.(*structs.ServiceNode)
+		if instance.Node == node && instance.ServiceID == svc.ID {
+			continue
+		}
+		for _, key := range keys {
+			if svc.Meta[key] != instance.ServiceMeta[key] {
+				return &structs.ServiceConstraintError{
+					Service:           svc.Service,
+					Key:               key,
+					Value:             svc.Meta[key],
+					ConflictNode:      instance.Node,
+					ConflictServiceID: instance.ServiceID,
+					ConflictValue:     instance.ServiceMeta[key],
+				}
+			}
+		}
+	}
+	return nil
+}
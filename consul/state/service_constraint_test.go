@@ -0,0 +1,205 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+func TestStateStore_ServiceConstraint_CRUD(t *testing.T) {
+	s := testStateStore(t)
+
+	// Should start out empty.
+	ws := memdb.NewWatchSet()
+	idx, constraint, err := s.ServiceConstraintGet(ws, "web")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 || constraint != nil {
+		t.Fatalf("bad: %d %#v", idx, constraint)
+	}
+
+	// The service name is required.
+	if err := s.ServiceConstraintSet(1, &structs.ServiceConstraint{}); err != ErrMissingServiceConstraint {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Add a constraint.
+	expected := &structs.ServiceConstraint{Service: "web", MetaKeys: []string{"protocol"}}
+	if err := s.ServiceConstraintSet(1, expected); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	idx, constraint, err = s.ServiceConstraintGet(nil, "web")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 1 || !reflect.DeepEqual(constraint, expected) {
+		t.Fatalf("bad: %d %#v", idx, constraint)
+	}
+
+	// Update it, which should keep the create index.
+	update := &structs.ServiceConstraint{Service: "web", MetaKeys: []string{"protocol", "version"}}
+	if err := s.ServiceConstraintSet(2, update); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, constraint, err = s.ServiceConstraintGet(nil, "web")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 2 || len(constraint.MetaKeys) != 2 || constraint.CreateIndex != 1 || constraint.ModifyIndex != 2 {
+		t.Fatalf("bad: %d %#v", idx, constraint)
+	}
+
+	// Add another and list them.
+	if err := s.ServiceConstraintSet(3, &structs.ServiceConstraint{Service: "db", MetaKeys: []string{"engine"}}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ws = memdb.NewWatchSet()
+	idx, constraints, err := s.ServiceConstraintList(ws)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 3 || len(constraints) != 2 || constraints[0].Service != "db" || constraints[1].Service != "web" {
+		t.Fatalf("bad: %d %#v", idx, constraints)
+	}
+
+	// Deleting an unknown constraint is a no-op.
+	if err := s.ServiceConstraintDelete(4, "nope"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx := s.maxIndex("service-constraints"); idx != 3 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Now delete one for real.
+	if err := s.ServiceConstraintDelete(5, "web"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	idx, constraints, err = s.ServiceConstraintList(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 5 || len(constraints) != 1 || constraints[0].Service != "db" {
+		t.Fatalf("bad: %d %#v", idx, constraints)
+	}
+}
+
+func TestStateStore_ServiceConstraint_EnsureRegistration(t *testing.T) {
+	s := testStateStore(t)
+	if err := s.ServiceConstraintSet(1, &structs.ServiceConstraint{Service: "web", MetaKeys: []string{"protocol"}}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	register := func(idx uint64, node, protocol string) error {
+		return s.EnsureRegistration(idx, &structs.RegisterRequest{
+			Node:    node,
+			Address: "127.0.0.1",
+			Service: &structs.NodeService{
+				ID:      "web",
+				Service: "web",
+				Meta:    map[string]string{"protocol": protocol},
+			},
+		})
+	}
+
+	// The first instance sets the value and a matching one can join.
+	if err := register(2, "foo", "http"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := register(3, "bar", "http"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A conflicting instance should be rejected without being written.
+	err := register(4, "baz", "grpc")
+	cerr, ok := err.(*structs.ServiceConstraintError)
+	if !ok || cerr.ConflictNode != "bar" && cerr.ConflictNode != "foo" || cerr.ConflictValue != "http" {
+		t.Fatalf("err: %v", err)
+	}
+	idx, nodes, err := s.ServiceNodes(nil, "web")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 3 || len(nodes) != 2 {
+		t.Fatalf("bad: %d %#v", idx, nodes)
+	}
+	if _, node, err := s.GetNode("baz"); err != nil || node != nil {
+		t.Fatalf("bad: %#v %v", node, err)
+	}
+
+	// Restores don't check constraints, since instances registered
+	// before the constraint was set are allowed to disagree.
+	restore := s.Restore()
+	err = restore.Registration(5, &structs.RegisterRequest{
+		Node:    "baz",
+		Address: "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "web",
+			Service: "web",
+			Meta:    map[string]string{"protocol": "grpc"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	restore.Commit()
+}
+
+func TestStateStore_ServiceConstraint_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+	before := structs.ServiceConstraints{
+		&structs.ServiceConstraint{Service: "db", MetaKeys: []string{"engine"}},
+		&structs.ServiceConstraint{Service: "web", MetaKeys: []string{"protocol"}},
+	}
+	for i, constraint := range before {
+		if err := s.ServiceConstraintSet(uint64(i+1), constraint); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Snapshot the constraints.
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	if err := s.ServiceConstraintDelete(3, "db"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Verify the snapshot.
+	dump, err := snap.ServiceConstraints()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(dump, before) {
+		t.Fatalf("bad: %#v", dump)
+	}
+
+	// Restore the values into a new state store.
+	func() {
+		s := testStateStore(t)
+		restore := s.Restore()
+		for _, constraint := range dump {
+			if err := restore.ServiceConstraint(constraint); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+		restore.Commit()
+
+		idx, res, err := s.ServiceConstraintList(nil)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 2 || !reflect.DeepEqual(res, before) {
+			t.Fatalf("bad: %d %#v", idx, res)
+		}
+	}()
+}
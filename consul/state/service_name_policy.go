@@ -0,0 +1,141 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// ServiceNamePolicy is used to pull the service name policy from the
+// snapshot.
+func (s *StateSnapshot) ServiceNamePolicy() (*structs.ServiceNamePolicy, error) {
+	p, err := s.tx.First("service-name-policy", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	policy, ok := p.(*structs.ServiceNamePolicy)
+	if !ok {
+		return nil, nil
+	}
+
+	return policy, nil
+}
+
+// ServiceNamePolicy is used when restoring from a snapshot.
+func (s *StateRestore) ServiceNamePolicy(policy *structs.ServiceNamePolicy) error {
+	if err := s.tx.Insert("service-name-policy", policy); err != nil {
+		return fmt.Errorf("failed restoring service name policy: %s", err)
+	}
+
+	return nil
+}
+
+// ServiceNamePolicy is used to get the service name policy. This returns nil
+// if it's never been set.
+func (s *StateStore) ServiceNamePolicy(ws memdb.WatchSet) (uint64, *structs.ServiceNamePolicy, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	watchCh, p, err := tx.FirstWatch("service-name-policy", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed service name policy lookup: %s", err)
+	}
+	ws.Add(watchCh)
+
+	policy, ok := p.(*structs.ServiceNamePolicy)
+	if !ok {
+		return 0, nil, nil
+	}
+
+	return policy.ModifyIndex, policy, nil
+}
+
+// ServiceNamePolicySet is used to update the service name policy. When the
+// policy goes from disabled to enabled, the names of the services registered
+// at that point are saved in the policy so they keep working.
+func (s *StateStore) ServiceNamePolicySet(idx uint64, policy *structs.ServiceNamePolicy) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	// Check for an existing policy.
+	existing, err := tx.First("service-name-policy", "id")
+	if err != nil {
+		return fmt.Errorf("failed service name policy lookup: %s", err)
+	}
+
+	// Set the indexes, and work out the existing names.
+	policy.Existing = nil
+	if existing != nil {
+		prev := existing.(*structs.ServiceNamePolicy)
+		policy.CreateIndex = prev.CreateIndex
+		if prev.Enabled {
+			policy.Existing = prev.Existing
+		}
+	} else {
+		policy.CreateIndex = idx
+	}
+	policy.ModifyIndex = idx
+
+	if policy.Enabled && (existing == nil || !existing.(*structs.ServiceNamePolicy).Enabled) {
+		names, err := serviceNamesTxn(tx)
+		if err != nil {
+			return err
+		}
+		policy.Existing = names
+	}
+	if !policy.Enabled {
+		policy.Existing = nil
+	}
+
+	if err := tx.Insert("service-name-policy", policy); err != nil {
+		return fmt.Errorf("failed updating service name policy: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// ServiceNamePolicyDelete is used to remove the service name policy.
+func (s *StateStore) ServiceNamePolicyDelete(idx uint64) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	existing, err := tx.First("service-name-policy", "id")
+	if err != nil {
+		return fmt.Errorf("failed service name policy lookup: %s", err)
+	}
+	if existing == nil {
+		return nil
+	}
+
+	if err := tx.Delete("service-name-policy", existing); err != nil {
+		return fmt.Errorf("failed deleting service name policy: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// serviceNamesTxn returns the sorted, unique names of all the registered
+// services.
+func serviceNamesTxn(tx *memdb.Txn) ([]string, error) {
+	services, err := tx.Get("services", "id")
+	if err != nil {
+		return nil, fmt.Errorf("failed querying services: %s", err)
+	}
+
+	unique := make(map[string]struct{})
+	for service := services.Next(); service != nil; service = services.Next() {
+		unique[service.(*structs.ServiceNode).ServiceName] = struct{}{}
+	}
+
+	names := make([]string, 0, len(unique))
+	for name := range unique {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
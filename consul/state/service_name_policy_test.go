@@ -0,0 +1,154 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+func TestStateStore_ServiceNamePolicy(t *testing.T) {
+	s := testStateStore(t)
+	testRegisterNode(t, s, 1, "foo")
+	testRegisterService(t, s, 2, "foo", "web")
+	testRegisterService(t, s, 3, "foo", "db")
+
+	// Should start out unset.
+	ws := memdb.NewWatchSet()
+	idx, policy, err := s.ServiceNamePolicy(ws)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 || policy != nil {
+		t.Fatalf("bad: %d %#v", idx, policy)
+	}
+
+	// Setting a disabled policy shouldn't take note of the services.
+	if err := s.ServiceNamePolicySet(4, &structs.ServiceNamePolicy{Names: []string{"api"}}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	_, policy, err = s.ServiceNamePolicy(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if policy.Enabled || len(policy.Existing) != 0 {
+		t.Fatalf("bad: %#v", policy)
+	}
+
+	// Enabling it should take note of the registered services, and
+	// ignore anything given in the request.
+	enabled := &structs.ServiceNamePolicy{
+		Enabled:  true,
+		Names:    []string{"api"},
+		Prefixes: []string{"batch-"},
+		Existing: []string{"nope"},
+	}
+	if err := s.ServiceNamePolicySet(5, enabled); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	idx, policy, err = s.ServiceNamePolicy(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 5 || policy.CreateIndex != 4 || !reflect.DeepEqual(policy.Existing, []string{"db", "web"}) {
+		t.Fatalf("bad: %d %#v", idx, policy)
+	}
+
+	// Updating it while it's enabled should keep the same names, even
+	// with new services around.
+	testRegisterService(t, s, 6, "foo", "cache")
+	if err := s.ServiceNamePolicySet(7, &structs.ServiceNamePolicy{Enabled: true}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, policy, err = s.ServiceNamePolicy(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(policy.Existing, []string{"db", "web"}) {
+		t.Fatalf("bad: %#v", policy)
+	}
+
+	// Disabling it should clear them.
+	if err := s.ServiceNamePolicySet(8, &structs.ServiceNamePolicy{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, policy, err = s.ServiceNamePolicy(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(policy.Existing) != 0 {
+		t.Fatalf("bad: %#v", policy)
+	}
+
+	// Now delete it.
+	ws = memdb.NewWatchSet()
+	if _, _, err := s.ServiceNamePolicy(ws); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.ServiceNamePolicyDelete(9); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	idx, policy, err = s.ServiceNamePolicy(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 || policy != nil {
+		t.Fatalf("bad: %d %#v", idx, policy)
+	}
+
+	// Deleting it again is a no-op.
+	if err := s.ServiceNamePolicyDelete(10); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestStateStore_ServiceNamePolicy_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+	testRegisterNode(t, s, 1, "foo")
+	testRegisterService(t, s, 2, "foo", "web")
+	before := &structs.ServiceNamePolicy{
+		Enabled: true,
+		Names:   []string{"api"},
+	}
+	if err := s.ServiceNamePolicySet(99, before); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	if err := s.ServiceNamePolicyDelete(100); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	snapped, err := snap.ServiceNamePolicy()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(snapped, before) {
+		t.Fatalf("bad: %#v", snapped)
+	}
+
+	s2 := testStateStore(t)
+	restore := s2.Restore()
+	if err := restore.ServiceNamePolicy(snapped); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	restore.Commit()
+
+	idx, res, err := s2.ServiceNamePolicy(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 99 || !reflect.DeepEqual(res, before) || !reflect.DeepEqual(res.Existing, []string{"web"}) {
+		t.Fatalf("bad: %d %#v", idx, res)
+	}
+}
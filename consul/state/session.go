@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/types"
 	"github.com/hashicorp/go-memdb"
 )
 
@@ -24,9 +25,10 @@ func (s *StateRestore) Session(sess *structs.Session) error {
 	if err := s.tx.Insert("sessions", sess); err != nil {
 		return fmt.Errorf("failed inserting session: %s", err)
 	}
+	s.store.sizes.insertTxn(s.tx, "sessions", nil, sess)
 
 	// Insert the check mappings.
-	for _, checkID := range sess.Checks {
+	for _, checkID := range sessionCheckIDs(sess) {
 		mapping := &sessionCheck{
 			Node:    sess.Node,
 			CheckID: checkID,
@@ -45,6 +47,17 @@ func (s *StateRestore) Session(sess *structs.Session) error {
 	return nil
 }
 
+// sessionCheckIDs returns the IDs of all the checks tied to a session, which
+// includes its service checks.
+func sessionCheckIDs(sess *structs.Session) []types.CheckID {
+	ids := make([]types.CheckID, 0, len(sess.Checks)+len(sess.ServiceChecks))
+	ids = append(ids, sess.Checks...)
+	for _, sc := range sess.ServiceChecks {
+		ids = append(ids, sc.ID)
+	}
+	return ids
+}
+
 // SessionCreate is used to register a new session in the state store.
 func (s *StateStore) SessionCreate(idx uint64, sess *structs.Session) error {
 	tx := s.db.Txn(true)
@@ -66,6 +79,56 @@ func (s *StateStore) SessionCreate(idx uint64, sess *structs.Session) error {
 	return nil
 }
 
+// SessionCreateLimited creates a session the same way as SessionCreate, but
+// refuses it with a SessionLimitError if its node or the token it was created
+// with already has the given number of sessions. A limit of zero means there's
+// no limit. The sessions are counted in the same transaction as the create,
+// so creates that race each other can't both take the last spot.
+func (s *StateStore) SessionCreateLimited(idx uint64, sess *structs.Session, nodeLimit, tokenLimit int) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	if nodeLimit > 0 {
+		count, err := countSessionsTxn(tx, "node", sess.Node)
+		if err != nil {
+			return err
+		}
+		if count >= nodeLimit {
+			return &structs.SessionLimitError{Kind: "node", Limit: nodeLimit}
+		}
+	}
+	if tokenLimit > 0 && sess.TokenHash != "" {
+		count, err := countSessionsTxn(tx, "token_hash", sess.TokenHash)
+		if err != nil {
+			return err
+		}
+		if count >= tokenLimit {
+			return &structs.SessionLimitError{Kind: "token", Limit: tokenLimit}
+		}
+	}
+
+	if err := s.sessionCreateTxn(tx, idx, sess); err != nil {
+		return err
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// countSessionsTxn returns the number of sessions with the given value for
+// the given index.
+func countSessionsTxn(tx *memdb.Txn, index, value string) (int, error) {
+	sessions, err := tx.Get("sessions", index, value)
+	if err != nil {
+		return 0, fmt.Errorf("failed session lookup: %s", err)
+	}
+	count := 0
+	for session := sessions.Next(); session != nil; session = sessions.Next() {
+		count++
+	}
+	return count, nil
+}
+
 // sessionCreateTxn is the inner method used for creating session entries in
 // an open transaction. Any health checks registered with the session will be
 // checked for failing status. Returns any error encountered.
@@ -117,13 +180,34 @@ func (s *StateStore) sessionCreateTxn(tx *memdb.Txn, idx uint64, sess *structs.S
 		}
 	}
 
+	// Go over the service checks and ensure they exist and belong to the
+	// given service.
+	for _, sc := range sess.ServiceChecks {
+		check, err := tx.First("checks", "id", sess.Node, string(sc.ID))
+		if err != nil {
+			return fmt.Errorf("failed check lookup: %s", err)
+		}
+		if check == nil {
+			return fmt.Errorf("Missing check '%s' registration", sc.ID)
+		}
+
+		hc := check.(*structs.HealthCheck)
+		if hc.ServiceID != sc.ServiceID {
+			return fmt.Errorf("Check '%s' is not registered for service '%s'", sc.ID, sc.ServiceID)
+		}
+		if hc.Status == structs.HealthCritical {
+			return fmt.Errorf("Check '%s' is in %s state", sc.ID, hc.Status)
+		}
+	}
+
 	// Insert the session
 	if err := tx.Insert("sessions", sess); err != nil {
 		return fmt.Errorf("failed inserting session: %s", err)
 	}
+	s.sizes.insertTxn(tx, "sessions", nil, sess)
 
 	// Insert the check mappings
-	for _, checkID := range sess.Checks {
+	for _, checkID := range sessionCheckIDs(sess) {
 		mapping := &sessionCheck{
 			Node:    sess.Node,
 			CheckID: checkID,
@@ -242,6 +326,7 @@ func (s *StateStore) deleteSessionTxn(tx *memdb.Txn, idx uint64, sessionID strin
 	if err := tx.Delete("sessions", sess); err != nil {
 		return fmt.Errorf("failed deleting session: %s", err)
 	}
+	s.sizes.deleteTxn(tx, "sessions", sess)
 	if err := tx.Insert("index", &IndexEntry{"sessions", idx}); err != nil {
 		return fmt.Errorf("failed updating index: %s", err)
 	}
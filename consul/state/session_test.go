@@ -651,6 +651,208 @@ func TestStateStore_Session_Invalidate_Critical_Check(t *testing.T) {
 	}
 }
 
+func TestStateStore_SessionCreateLimited(t *testing.T) {
+	s := testStateStore(t)
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterNode(t, s, 2, "node2")
+
+	// Fill up node1, with two sessions for token a.
+	sessions := []*structs.Session{
+		&structs.Session{ID: testUUID(), Node: "node1", TokenHash: "a"},
+		&structs.Session{ID: testUUID(), Node: "node1", TokenHash: "a"},
+		&structs.Session{ID: testUUID(), Node: "node1"},
+	}
+	for i, sess := range sessions {
+		if err := s.SessionCreateLimited(uint64(3+i), sess, 3, 2); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// The node is full, and so is token a, even on another node.
+	create := func(idx uint64, node, tokenHash string) error {
+		sess := &structs.Session{ID: testUUID(), Node: node, TokenHash: tokenHash}
+		return s.SessionCreateLimited(idx, sess, 3, 2)
+	}
+	err := create(10, "node1", "b")
+	if e, ok := err.(*structs.SessionLimitError); !ok || e.Kind != "node" || e.Limit != 3 {
+		t.Fatalf("err: %v", err)
+	}
+	err = create(10, "node2", "a")
+	if e, ok := err.(*structs.SessionLimitError); !ok || e.Kind != "token" || e.Limit != 2 {
+		t.Fatalf("err: %v", err)
+	}
+	if err := create(10, "node2", "b"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := create(11, "node2", ""); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Nothing should have been written for the refused creates.
+	if idx, list, err := s.SessionList(nil); err != nil || idx != 11 || len(list) != 5 {
+		t.Fatalf("bad: %d, %d, %v", idx, len(list), err)
+	}
+
+	// Destroying a session frees up its spot.
+	if err := s.SessionDestroy(12, sessions[0].ID); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := create(13, "node2", "a"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := create(14, "node1", "c"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Zero means no limit.
+	for i := uint64(15); i < 20; i++ {
+		sess := &structs.Session{ID: testUUID(), Node: "node1", TokenHash: "a"}
+		if err := s.SessionCreateLimited(i, sess, 0, 0); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func TestStateStore_SessionCreate_ServiceChecks(t *testing.T) {
+	s := testStateStore(t)
+
+	testRegisterNode(t, s, 1, "foo")
+	testRegisterService(t, s, 2, "foo", "web")
+	testRegisterService(t, s, 3, "foo", "db")
+	testRegisterCheck(t, s, 4, "foo", "web", "web-check", structs.HealthPassing)
+	testRegisterCheck(t, s, 5, "foo", "db", "db-check", structs.HealthCritical)
+	testRegisterCheck(t, s, 6, "foo", "", "node-check", structs.HealthPassing)
+
+	cases := []struct {
+		check   structs.SessionServiceCheck
+		errText string
+	}{
+		{structs.SessionServiceCheck{ID: "nope", ServiceID: "web"}, "Missing check"},
+		{structs.SessionServiceCheck{ID: "node-check", ServiceID: "web"}, "not registered for service"},
+		{structs.SessionServiceCheck{ID: "web-check", ServiceID: "db"}, "not registered for service"},
+		{structs.SessionServiceCheck{ID: "db-check", ServiceID: "db"}, "critical"},
+	}
+	for _, tc := range cases {
+		sess := &structs.Session{
+			ID:            testUUID(),
+			Node:          "foo",
+			ServiceChecks: []structs.SessionServiceCheck{tc.check},
+		}
+		err := s.SessionCreate(7, sess)
+		if err == nil || !strings.Contains(err.Error(), tc.errText) {
+			t.Fatalf("bad: %#v %v", tc.check, err)
+		}
+	}
+
+	// A good one should go through and get mapped to the check.
+	sess := &structs.Session{
+		ID:   testUUID(),
+		Node: "foo",
+		ServiceChecks: []structs.SessionServiceCheck{
+			{ID: "web-check", ServiceID: "web"},
+		},
+	}
+	if err := s.SessionCreate(7, sess); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+	mapping, err := tx.First("session_checks", "session", sess.ID)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expect := &sessionCheck{
+		Node:    "foo",
+		CheckID: "web-check",
+		Session: sess.ID,
+	}
+	if actual, ok := mapping.(*sessionCheck); !ok || !reflect.DeepEqual(actual, expect) {
+		t.Fatalf("bad: %#v", mapping)
+	}
+}
+
+func TestStateStore_Session_Invalidate_Critical_ServiceCheck(t *testing.T) {
+	s := testStateStore(t)
+
+	testRegisterNode(t, s, 1, "foo")
+	testRegisterService(t, s, 2, "foo", "web")
+	testRegisterCheck(t, s, 3, "foo", "web", "web-check", structs.HealthPassing)
+	testRegisterCheck(t, s, 4, "foo", "", "node-check", structs.HealthPassing)
+
+	// Make one session tied to the service and another tied to the node.
+	serviceSession := &structs.Session{
+		ID:   testUUID(),
+		Node: "foo",
+		ServiceChecks: []structs.SessionServiceCheck{
+			{ID: "web-check", ServiceID: "web"},
+		},
+	}
+	if err := s.SessionCreate(5, serviceSession); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	nodeSession := &structs.Session{
+		ID:     testUUID(),
+		Node:   "foo",
+		Checks: []types.CheckID{"node-check"},
+	}
+	if err := s.SessionCreate(6, nodeSession); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Run the sessions through a snapshot and restore so we know the
+	// mappings for the service checks come back.
+	snap := s.Snapshot()
+	defer snap.Close()
+	iter, err := snap.Sessions()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var dump structs.Sessions
+	for sess := iter.Next(); sess != nil; sess = iter.Next() {
+		dump = append(dump, sess.(*structs.Session))
+	}
+	s = testStateStore(t)
+	testRegisterNode(t, s, 1, "foo")
+	testRegisterService(t, s, 2, "foo", "web")
+	testRegisterCheck(t, s, 3, "foo", "web", "web-check", structs.HealthPassing)
+	testRegisterCheck(t, s, 4, "foo", "", "node-check", structs.HealthPassing)
+	restore := s.Restore()
+	for _, sess := range dump {
+		if err := restore.Session(sess); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	restore.Commit()
+	_, restored, err := s.SessionGet(nil, serviceSession.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if restored == nil || !reflect.DeepEqual(restored.ServiceChecks, serviceSession.ServiceChecks) {
+		t.Fatalf("bad: %#v", restored)
+	}
+
+	// Fail the service check, which should only take out the session
+	// tied to the service.
+	testRegisterCheck(t, s, 7, "foo", "web", "web-check", structs.HealthCritical)
+	idx, sess, err := s.SessionGet(nil, serviceSession.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if sess != nil {
+		t.Fatalf("session should be invalidated")
+	}
+	if idx != 7 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	_, sess, err = s.SessionGet(nil, nodeSession.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if sess == nil {
+		t.Fatalf("session should not be invalidated")
+	}
+}
+
 func TestStateStore_Session_Invalidate_DeleteCheck(t *testing.T) {
 	s := testStateStore(t)
 
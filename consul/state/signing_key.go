@@ -0,0 +1,126 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// SigningKeys is used to pull all the signing keys from the snapshot.
+func (s *StateSnapshot) SigningKeys() (structs.SigningKeys, error) {
+	keys, err := s.tx.Get("signing-keys", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	var ret structs.SigningKeys
+	for key := keys.Next(); key != nil; key = keys.Next() {
+		ret = append(ret, key.(*structs.SigningKey))
+	}
+	return ret, nil
+}
+
+// SigningKey is used when restoring from a snapshot. For general inserts, use
+// SigningKeyRotate.
+func (s *StateRestore) SigningKey(key *structs.SigningKey) error {
+	if err := s.tx.Insert("signing-keys", key); err != nil {
+		return fmt.Errorf("failed restoring signing key: %s", err)
+	}
+	if err := indexUpdateMaxTxn(s.tx, key.ModifyIndex, "signing-keys"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	return nil
+}
+
+// SigningKeyRotate makes the given key the active signing key. The key it
+// replaces is kept so results it signed can still be verified, and any key
+// older than that is dropped.
+func (s *StateStore) SigningKeyRotate(idx uint64, key *structs.SigningKey) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	if key.ID == "" || len(key.PublicKey) == 0 || len(key.PrivateKey) == 0 {
+		return fmt.Errorf("Missing signing key")
+	}
+
+	// Retire the active key and drop the ones that were already retired.
+	keys, err := tx.Get("signing-keys", "id")
+	if err != nil {
+		return fmt.Errorf("failed signing key lookup: %s", err)
+	}
+	var existing structs.SigningKeys
+	for k := keys.Next(); k != nil; k = keys.Next() {
+		existing = append(existing, k.(*structs.SigningKey))
+	}
+	for _, k := range existing {
+		if k.ID == key.ID {
+			return fmt.Errorf("Signing key %q already exists", key.ID)
+		}
+		if !k.Active {
+			if err := tx.Delete("signing-keys", k); err != nil {
+				return fmt.Errorf("failed signing key delete: %s", err)
+			}
+			continue
+		}
+
+		retired := *k
+		retired.Active = false
+		retired.ModifyIndex = idx
+		if err := tx.Insert("signing-keys", &retired); err != nil {
+			return fmt.Errorf("failed updating signing key: %s", err)
+		}
+	}
+
+	// Insert the new key and update the index.
+	key.Active = true
+	key.CreateIndex = idx
+	key.ModifyIndex = idx
+	if err := tx.Insert("signing-keys", key); err != nil {
+		return fmt.Errorf("failed inserting signing key: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"signing-keys", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// SigningKeys returns all the signing keys, including the retired one.
+func (s *StateStore) SigningKeys(ws memdb.WatchSet) (uint64, structs.SigningKeys, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	// Get the table index.
+	idx := maxIndexTxn(tx, "signing-keys")
+
+	// Query all of the keys.
+	keys, err := tx.Get("signing-keys", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed signing key lookup: %s", err)
+	}
+	ws.Add(keys.WatchCh())
+
+	var result structs.SigningKeys
+	for key := keys.Next(); key != nil; key = keys.Next() {
+		result = append(result, key.(*structs.SigningKey))
+	}
+	return idx, result, nil
+}
+
+// SigningKeyActive returns the key that's used to sign results, or nil if
+// there isn't one yet.
+func (s *StateStore) SigningKeyActive() (*structs.SigningKey, error) {
+	_, keys, err := s.SigningKeys(nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.Active {
+			return key, nil
+		}
+	}
+	return nil, nil
+}
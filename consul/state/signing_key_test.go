@@ -0,0 +1,141 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+func TestStateStore_SigningKeyRotate(t *testing.T) {
+	s := testStateStore(t)
+
+	// Should start out with no keys.
+	ws := memdb.NewWatchSet()
+	idx, keys, err := s.SigningKeys(ws)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 || len(keys) != 0 {
+		t.Fatalf("bad: %d %#v", idx, keys)
+	}
+	if key, err := s.SigningKeyActive(); err != nil || key != nil {
+		t.Fatalf("bad: %#v %v", key, err)
+	}
+
+	// Keys need all their parts.
+	if err := s.SigningKeyRotate(1, &structs.SigningKey{ID: "a"}); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Rotate in three keys. Only the last two should be kept, and only the
+	// last one should be active.
+	var generated structs.SigningKeys
+	for i := 0; i < 3; i++ {
+		key, err := structs.GenerateSigningKey()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := s.SigningKeyRotate(uint64(i+1), key); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		generated = append(generated, key)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	idx, keys, err = s.SigningKeys(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 3 || len(keys) != 2 {
+		t.Fatalf("bad: %d %#v", idx, keys)
+	}
+	for _, key := range keys {
+		switch key.ID {
+		case generated[1].ID:
+			if key.Active || key.CreateIndex != 2 || key.ModifyIndex != 3 {
+				t.Fatalf("bad: %#v", key)
+			}
+		case generated[2].ID:
+			if !key.Active || key.CreateIndex != 3 || key.ModifyIndex != 3 {
+				t.Fatalf("bad: %#v", key)
+			}
+		default:
+			t.Fatalf("bad: %#v", key)
+		}
+	}
+	active, err := s.SigningKeyActive()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if active.ID != generated[2].ID {
+		t.Fatalf("bad: %#v", active)
+	}
+
+	// The same key can't be added twice.
+	if err := s.SigningKeyRotate(4, generated[2]); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestStateStore_SigningKey_Snapshot_Restore(t *testing.T) {
+	s := testStateStore(t)
+	for i := 0; i < 2; i++ {
+		key, err := structs.GenerateSigningKey()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := s.SigningKeyRotate(uint64(i+1), key); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	_, before, err := s.SigningKeys(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Snapshot the keys.
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	// Alter the real state store.
+	key, err := structs.GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.SigningKeyRotate(3, key); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Verify the snapshot.
+	dump, err := snap.SigningKeys()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(dump, before) {
+		t.Fatalf("bad: %#v", dump)
+	}
+
+	// Restore the values into a new state store.
+	func() {
+		s := testStateStore(t)
+		restore := s.Restore()
+		for _, key := range dump {
+			if err := restore.SigningKey(key); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+		restore.Commit()
+
+		idx, res, err := s.SigningKeys(nil)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != 2 || !reflect.DeepEqual(res, before) {
+			t.Fatalf("bad: %d %#v", idx, res)
+		}
+	}()
+}
@@ -28,6 +28,38 @@ var (
 	// ErrMissingQueryID is returned when a Query set is called on
 	// a Query with an empty ID.
 	ErrMissingQueryID = errors.New("Missing Query ID")
+
+	// ErrMissingCentralCheckID is returned when a central check set is
+	// called on a definition with an empty ID.
+	ErrMissingCentralCheckID = errors.New("Missing central check ID")
+
+	// ErrMissingDatacenterAlias is returned when a datacenter alias set is
+	// called without the alias or the name it points to.
+	ErrMissingDatacenterAlias = errors.New("Missing datacenter alias or canonical name")
+
+	// ErrMissingServiceConstraint is returned when a service constraint set
+	// is called without a service name.
+	ErrMissingServiceConstraint = errors.New("Missing service name for constraint")
+
+	// ErrMissingNodeBlock is returned when a node block set is called
+	// without a node name.
+	ErrMissingNodeBlock = errors.New("Missing node name for block")
+
+	// ErrMissingFederationPolicy is returned when a federation policy set
+	// is called without a datacenter name.
+	ErrMissingFederationPolicy = errors.New("Missing datacenter name for federation policy")
+
+	// ErrMissingOperatorIntentID is returned when an operator intent is
+	// created without an ID.
+	ErrMissingOperatorIntentID = errors.New("Missing operator intent ID")
+
+	// ErrMissingKVQuotaPrefix is returned when a KV quota set is called
+	// without a prefix.
+	ErrMissingKVQuotaPrefix = errors.New("Missing prefix for KV quota")
+
+	// ErrMissingClusterID is returned when the cluster ID is set without
+	// an ID.
+	ErrMissingClusterID = errors.New("Missing cluster ID")
 )
 
 const (
@@ -59,6 +91,9 @@ type StateStore struct {
 
 	// lockDelay holds expiration times for locks associated with keys.
 	lockDelay *Delay
+
+	// sizes tracks roughly how much is stored in the larger tables.
+	sizes *tableSizes
 }
 
 // StateSnapshot is used to provide a point-in-time snapshot. It
@@ -108,7 +143,9 @@ func NewStateStore(gc *TombstoneGC) (*StateStore, error) {
 		abandonCh:    make(chan struct{}),
 		kvsGraveyard: NewGraveyard(gc),
 		lockDelay:    NewDelay(),
+		sizes:        newTableSizes(),
 	}
+	s.kvsGraveyard.sizes = s.sizes
 	return s, nil
 }
 
@@ -0,0 +1,212 @@
+package state
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-memdb"
+)
+
+// sizedTables are the tables that have their size tracked. These are the ones
+// that grow with the size of the cluster or with how it's used.
+var sizedTables = []string{
+	"nodes",
+	"services",
+	"checks",
+	"kvs",
+	"sessions",
+	"tombstones",
+	"coordinates",
+}
+
+// TableSize is a rough count of what's stored in a table. Bytes is an
+// estimate of the memory used by the objects themselves, and doesn't count
+// memdb's indexes.
+type TableSize struct {
+	Objects int64
+	Bytes   int64
+}
+
+// tableSizes keeps running totals of the size of each tracked table. Changes
+// are only added to the totals when their write transaction commits.
+type tableSizes struct {
+	sizes map[string]TableSize
+	lock  sync.RWMutex
+}
+
+// newTableSizes returns a tracker with all the tables at zero.
+func newTableSizes() *tableSizes {
+	t := &tableSizes{
+		sizes: make(map[string]TableSize),
+	}
+	for _, table := range sizedTables {
+		t.sizes[table] = TableSize{}
+	}
+	return t
+}
+
+// insertTxn records an insert into the given table in the given transaction.
+// Existing is the object being replaced, if any.
+func (t *tableSizes) insertTxn(tx *memdb.Txn, table string, existing, obj interface{}) {
+	if existing != nil {
+		t.add(tx, table, 0, approxSize(obj)-approxSize(existing))
+	} else {
+		t.add(tx, table, 1, approxSize(obj))
+	}
+}
+
+// deleteTxn records a delete from the given table in the given transaction.
+func (t *tableSizes) deleteTxn(tx *memdb.Txn, table string, obj interface{}) {
+	t.add(tx, table, -1, -approxSize(obj))
+}
+
+// add records a change to be added to the totals if the given transaction
+// commits.
+func (t *tableSizes) add(tx *memdb.Txn, table string, objects, bytes int64) {
+	tx.Defer(func() { t.commit(table, objects, bytes) })
+}
+
+// commit adds a change to the totals.
+func (t *tableSizes) commit(table string, objects, bytes int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	size := t.sizes[table]
+	size.Objects += objects
+	size.Bytes += bytes
+	t.sizes[table] = size
+}
+
+// TableSizes returns a rough count of what's in each of the tables that grow
+// with the cluster, keyed by table name.
+func (s *StateStore) TableSizes() map[string]TableSize {
+	s.sizes.lock.RLock()
+	defer s.sizes.lock.RUnlock()
+
+	sizes := make(map[string]TableSize, len(s.sizes.sizes))
+	for table, size := range s.sizes.sizes {
+		sizes[table] = size
+	}
+	return sizes
+}
+
+// KVSPrefixSizes adds up the size of the keys under each prefix, cutting keys
+// off after the given number of path segments, and returns the largest ones
+// first. The sizes are estimated the same way as for TableSizes, so they add
+// up to the size of the kvs table.
+func (s *StateStore) KVSPrefixSizes(ws memdb.WatchSet, depth, limit int) (uint64, []*structs.KVPrefixSize, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	idx := maxIndexTxn(tx, "kvs")
+
+	entries, err := tx.Get("kvs", "id")
+	if err != nil {
+		return 0, nil, err
+	}
+	ws.Add(entries.WatchCh())
+
+	byPrefix := make(map[string]*structs.KVPrefixSize)
+	for entry := entries.Next(); entry != nil; entry = entries.Next() {
+		prefix := kvsPrefix(entry.(*structs.DirEntry).Key, depth)
+		size, ok := byPrefix[prefix]
+		if !ok {
+			size = &structs.KVPrefixSize{Prefix: prefix}
+			byPrefix[prefix] = size
+		}
+		size.Keys++
+		size.Bytes += approxSize(entry)
+	}
+
+	var results []*structs.KVPrefixSize
+	for _, size := range byPrefix {
+		results = append(results, size)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Bytes != results[j].Bytes {
+			return results[i].Bytes > results[j].Bytes
+		}
+		return results[i].Prefix < results[j].Prefix
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return idx, results, nil
+}
+
+// kvsPrefix returns the given key cut off after depth path segments, keeping
+// the trailing slash. Keys with fewer segments are returned as they are.
+func kvsPrefix(key string, depth int) string {
+	end := 0
+	for i := 0; i < depth; i++ {
+		n := strings.Index(key[end:], "/")
+		if n < 0 {
+			return key
+		}
+		end += n + 1
+	}
+	return key[:end]
+}
+
+// approxSize estimates the memory used by the given object, following
+// pointers, slices, and maps. Unexported fields aren't followed, since they
+// tend to point at things that are shared, like a time's location.
+func approxSize(obj interface{}) int64 {
+	v := reflect.ValueOf(obj)
+	if !v.IsValid() {
+		return 0
+	}
+	return int64(v.Type().Size()) + approxExtraSize(v)
+}
+
+// approxExtraSize estimates the memory the given value refers to, not
+// counting the value itself.
+func approxExtraSize(v reflect.Value) int64 {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		elem := v.Elem()
+		return int64(elem.Type().Size()) + approxExtraSize(elem)
+
+	case reflect.String:
+		return int64(v.Len())
+
+	case reflect.Slice:
+		n := int64(v.Cap()) * int64(v.Type().Elem().Size())
+		for i := 0; i < v.Len(); i++ {
+			n += approxExtraSize(v.Index(i))
+		}
+		return n
+
+	case reflect.Array:
+		var n int64
+		for i := 0; i < v.Len(); i++ {
+			n += approxExtraSize(v.Index(i))
+		}
+		return n
+
+	case reflect.Map:
+		entry := int64(v.Type().Key().Size() + v.Type().Elem().Size())
+		var n int64
+		for _, key := range v.MapKeys() {
+			n += entry + approxExtraSize(key) + approxExtraSize(v.MapIndex(key))
+		}
+		return n
+
+	case reflect.Struct:
+		var n int64
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			n += approxExtraSize(v.Field(i))
+		}
+		return n
+	}
+	return 0
+}
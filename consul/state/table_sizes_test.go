@@ -0,0 +1,219 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestStateStore_TableSizes_KVS(t *testing.T) {
+	s := testStateStore(t)
+
+	// Everything should start out empty.
+	for table, size := range s.TableSizes() {
+		if size.Objects != 0 || size.Bytes != 0 {
+			t.Fatalf("bad: %s %#v", table, size)
+		}
+	}
+
+	// checkKVS makes sure the kvs estimate is within 10% of what's
+	// expected, erring on the high side since there's some overhead for
+	// each entry.
+	checkKVS := func(objects, bytes int64) {
+		size := s.TableSizes()["kvs"]
+		if size.Objects != objects {
+			t.Fatalf("bad: %#v", size)
+		}
+		if size.Bytes < bytes || size.Bytes > bytes+bytes/10 {
+			t.Fatalf("bad: %d not near %d", size.Bytes, bytes)
+		}
+	}
+
+	// Add some 10k values.
+	value := make([]byte, 10*1024)
+	for i := 0; i < 10; i++ {
+		entry := &structs.DirEntry{Key: fmt.Sprintf("foo/%d", i), Value: value}
+		if err := s.KVSSet(uint64(i+1), entry); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	checkKVS(10, 10*10*1024)
+
+	// Replacing a value should only count the difference.
+	if err := s.KVSSet(11, &structs.DirEntry{Key: "foo/0", Value: make([]byte, 20*1024)}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	checkKVS(10, 11*10*1024)
+
+	// Changes that are thrown away shouldn't count.
+	func() {
+		tx := s.db.Txn(true)
+		defer tx.Abort()
+		entry := &structs.DirEntry{Key: "bar", Value: value}
+		if err := s.kvsSetTxn(tx, 12, entry, false); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}()
+	checkKVS(10, 11*10*1024)
+
+	// Deleting should take the entries back out, and add tombstones.
+	if err := s.KVSDelete(12, "foo/0"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	checkKVS(9, 9*10*1024)
+	if err := s.KVSDeleteTree(13, "foo/"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if size := s.TableSizes()["kvs"]; size.Objects != 0 || size.Bytes != 0 {
+		t.Fatalf("bad: %#v", size)
+	}
+	if size := s.TableSizes()["tombstones"]; size.Objects != 10 || size.Bytes == 0 {
+		t.Fatalf("bad: %#v", size)
+	}
+
+	// Reaping the tombstones should take them back out.
+	if err := s.ReapTombstones(13); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if size := s.TableSizes()["tombstones"]; size.Objects != 0 || size.Bytes != 0 {
+		t.Fatalf("bad: %#v", size)
+	}
+}
+
+func TestStateStore_TableSizes_Catalog(t *testing.T) {
+	s := testStateStore(t)
+
+	testRegisterNode(t, s, 1, "node1")
+	testRegisterService(t, s, 2, "node1", "service1")
+	testRegisterCheck(t, s, 3, "node1", "service1", "check1", structs.HealthPassing)
+	updates := structs.Coordinates{
+		&structs.Coordinate{Node: "node1", Coord: generateRandomCoordinate()},
+	}
+	if err := s.CoordinateBatchUpdate(4, updates); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	sizes := s.TableSizes()
+	for _, table := range []string{"nodes", "services", "checks", "coordinates"} {
+		if size := sizes[table]; size.Objects != 1 || size.Bytes == 0 {
+			t.Fatalf("bad: %s %#v", table, size)
+		}
+	}
+
+	// A restore should come out the same.
+	func() {
+		snap := s.Snapshot()
+		defer snap.Close()
+
+		r := testStateStore(t)
+		restore := r.Restore()
+		nodes, err := snap.Nodes()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		for node := nodes.Next(); node != nil; node = nodes.Next() {
+			n := node.(*structs.Node)
+			req := &structs.RegisterRequest{Node: n.Node, Address: n.Address}
+			if err := restore.Registration(1, req); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+		if err := restore.Coordinates(4, updates); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		restore.Commit()
+
+		restored := r.TableSizes()
+		for _, table := range []string{"nodes", "coordinates"} {
+			if restored[table] != sizes[table] {
+				t.Fatalf("bad: %s %#v %#v", table, restored[table], sizes[table])
+			}
+		}
+	}()
+
+	// Deleting the node should take everything with it.
+	if err := s.DeleteNode(5, "node1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for table, size := range s.TableSizes() {
+		if size.Objects != 0 || size.Bytes != 0 {
+			t.Fatalf("bad: %s %#v", table, size)
+		}
+	}
+}
+
+func TestStateStore_KVSPrefixSizes(t *testing.T) {
+	s := testStateStore(t)
+
+	// Put a few big values under one prefix and a lot of small ones under
+	// another.
+	for i := 0; i < 3; i++ {
+		entry := &structs.DirEntry{Key: fmt.Sprintf("heavy/%d", i), Value: make([]byte, 100*1024)}
+		if err := s.KVSSet(uint64(i+1), entry); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		entry := &structs.DirEntry{Key: fmt.Sprintf("light/sub/%d", i), Value: []byte("x")}
+		if err := s.KVSSet(uint64(i+10), entry); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if err := s.KVSSet(100, &structs.DirEntry{Key: "top", Value: []byte("x")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	idx, prefixes, err := s.KVSPrefixSizes(nil, 1, 10)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 100 || len(prefixes) != 3 {
+		t.Fatalf("bad: %d %v", idx, prefixes)
+	}
+	heavy := prefixes[0]
+	if heavy.Prefix != "heavy/" || heavy.Keys != 3 || heavy.Bytes < 3*100*1024 {
+		t.Fatalf("bad: %#v", heavy)
+	}
+	if light := prefixes[1]; light.Prefix != "light/" || light.Keys != 50 {
+		t.Fatalf("bad: %#v", light)
+	}
+
+	// The prefixes should add up to the table.
+	var total int64
+	for _, prefix := range prefixes {
+		total += prefix.Bytes
+	}
+	if size := s.TableSizes()["kvs"]; total != size.Bytes {
+		t.Fatalf("bad: %d %d", total, size.Bytes)
+	}
+
+	// Go deeper, and only take the biggest one.
+	_, prefixes, err = s.KVSPrefixSizes(nil, 2, 1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(prefixes) != 1 || !strings.HasPrefix(prefixes[0].Prefix, "heavy/") || prefixes[0].Keys != 1 {
+		t.Fatalf("bad: %v", prefixes)
+	}
+}
+
+func TestStateStore_kvsPrefix(t *testing.T) {
+	cases := []struct {
+		key      string
+		depth    int
+		expected string
+	}{
+		{"foo/bar/baz", 1, "foo/"},
+		{"foo/bar/baz", 2, "foo/bar/"},
+		{"foo/bar/baz", 3, "foo/bar/baz"},
+		{"foo", 1, "foo"},
+		{"foo/", 1, "foo/"},
+		{"/foo", 1, "/"},
+	}
+	for _, c := range cases {
+		if actual := kvsPrefix(c.key, c.depth); actual != c.expected {
+			t.Fatalf("bad: %#v %q", c, actual)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"sync"
 	"time"
+
+	"github.com/hashicorp/consul/lib"
 )
 
 // TombstoneGC is used to track creation of tombstones
@@ -23,6 +25,9 @@ type TombstoneGC struct {
 	ttl         time.Duration
 	granularity time.Duration
 
+	// clock is used to tell time and set the expiration timers.
+	clock lib.Clock
+
 	// enabled controls if we actually setup any timers.
 	enabled bool
 
@@ -41,23 +46,29 @@ type TombstoneGC struct {
 // to expire in a given interval with a timer
 type expireInterval struct {
 	maxIndex uint64
-	timer    *time.Timer
+	timer    lib.Timer
 }
 
 // NewTombstoneGC is used to construct a new TombstoneGC given
 // a TTL for tombstones and a tracking granularity. Longer TTLs
 // ensure correct behavior for more time, but use more storage.
 // A shorter granularity increases the number of Raft transactions
-// and reduce how far past the TTL we perform GC.
-func NewTombstoneGC(ttl, granularity time.Duration) (*TombstoneGC, error) {
+// and reduce how far past the TTL we perform GC. If no clock is
+// given then the real clock is used.
+func NewTombstoneGC(ttl, granularity time.Duration, clock lib.Clock) (*TombstoneGC, error) {
 	// Sanity check the inputs
 	if ttl <= 0 || granularity <= 0 {
 		return nil, fmt.Errorf("Tombstone TTL and granularity must be positive")
 	}
 
+	if clock == nil {
+		clock = lib.RealClock{}
+	}
+
 	t := &TombstoneGC{
 		ttl:         ttl,
 		granularity: granularity,
+		clock:       clock,
 		enabled:     false,
 		expires:     make(map[time.Time]*expireInterval),
 		expireCh:    make(chan uint64, 1),
@@ -116,7 +127,7 @@ func (t *TombstoneGC) Hint(index uint64) {
 	// Create new expiration time
 	t.expires[expires] = &expireInterval{
 		maxIndex: index,
-		timer: time.AfterFunc(expires.Sub(time.Now()), func() {
+		timer: t.clock.AfterFunc(expires.Sub(t.clock.Now()), func() {
 			t.expireTime(expires)
 		}),
 	}
@@ -131,7 +142,7 @@ func (t *TombstoneGC) PendingExpiration() bool {
 
 // nextExpires is used to calculate the next expiration time
 func (t *TombstoneGC) nextExpires() time.Time {
-	expires := time.Now().Add(t.ttl)
+	expires := t.clock.Now().Add(t.ttl)
 	remain := expires.UnixNano() % int64(t.granularity)
 	adj := expires.Add(t.granularity - time.Duration(remain))
 	return adj
@@ -3,20 +3,22 @@ package state
 import (
 	"testing"
 	"time"
+
+	"github.com/hashicorp/consul/lib"
 )
 
 func TestTombstoneGC_invalid(t *testing.T) {
-	_, err := NewTombstoneGC(0, 0)
+	_, err := NewTombstoneGC(0, 0, nil)
 	if err == nil {
 		t.Fatalf("should fail")
 	}
 
-	_, err = NewTombstoneGC(time.Second, 0)
+	_, err = NewTombstoneGC(time.Second, 0, nil)
 	if err == nil {
 		t.Fatalf("should fail")
 	}
 
-	_, err = NewTombstoneGC(0, time.Second)
+	_, err = NewTombstoneGC(0, time.Second, nil)
 	if err == nil {
 		t.Fatalf("should fail")
 	}
@@ -25,7 +27,9 @@ func TestTombstoneGC_invalid(t *testing.T) {
 func TestTombstoneGC(t *testing.T) {
 	ttl := 20 * time.Millisecond
 	gran := 5 * time.Millisecond
-	gc, err := NewTombstoneGC(ttl, gran)
+	start := time.Unix(1000, 0)
+	clock := lib.NewFakeClock(start)
+	gc, err := NewTombstoneGC(ttl, gran, clock)
 	if err != nil {
 		t.Fatalf("should fail")
 	}
@@ -35,11 +39,10 @@ func TestTombstoneGC(t *testing.T) {
 		t.Fatalf("should not be pending")
 	}
 
-	start := time.Now()
 	gc.Hint(100)
 
-	time.Sleep(2 * gran)
-	start2 := time.Now()
+	clock.Advance(2 * gran)
+	start2 := clock.Now()
 	gc.Hint(120)
 	gc.Hint(125)
 
@@ -47,39 +50,51 @@ func TestTombstoneGC(t *testing.T) {
 		t.Fatalf("should be pending")
 	}
 
+	// Expirations are rounded up to the next granularity boundary past
+	// the TTL, so nothing should show up before then.
+	clock.Advance(ttl - gran - time.Nanosecond)
+	select {
+	case <-gc.ExpireCh():
+		t.Fatalf("expired early")
+	default:
+	}
+
+	clock.Advance(time.Nanosecond)
 	select {
 	case index := <-gc.ExpireCh():
-		end := time.Now()
-		if end.Sub(start) < ttl {
+		if clock.Now().Sub(start) < ttl {
 			t.Fatalf("expired early")
 		}
 		if index != 100 {
 			t.Fatalf("bad index: %d", index)
 		}
-
-	case <-time.After(ttl * 2):
+	default:
 		t.Fatalf("should get expiration")
 	}
 
+	clock.Advance(2 * gran)
 	select {
 	case index := <-gc.ExpireCh():
-		end := time.Now()
-		if end.Sub(start2) < ttl {
+		if clock.Now().Sub(start2) < ttl {
 			t.Fatalf("expired early")
 		}
 		if index != 125 {
 			t.Fatalf("bad index: %d", index)
 		}
-
-	case <-time.After(ttl * 2):
+	default:
 		t.Fatalf("should get expiration")
 	}
+
+	if gc.PendingExpiration() {
+		t.Fatalf("should not be pending")
+	}
 }
 
 func TestTombstoneGC_Expire(t *testing.T) {
 	ttl := 10 * time.Millisecond
 	gran := 5 * time.Millisecond
-	gc, err := NewTombstoneGC(ttl, gran)
+	clock := lib.NewFakeClock(time.Now())
+	gc, err := NewTombstoneGC(ttl, gran, clock)
 	if err != nil {
 		t.Fatalf("should fail")
 	}
@@ -95,10 +110,14 @@ func TestTombstoneGC_Expire(t *testing.T) {
 	if gc.PendingExpiration() {
 		t.Fatalf("should not be pending")
 	}
+	if n := clock.Pending(); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
 
+	clock.Advance(2 * ttl)
 	select {
 	case <-gc.ExpireCh():
 		t.Fatalf("should be reset")
-	case <-time.After(20 * time.Millisecond):
+	default:
 	}
 }
@@ -28,7 +28,11 @@ func (s *StateStore) txnKVS(tx *memdb.Txn, idx uint64, op *structs.TxnKVOp) (str
 		}
 
 	case structs.KVSDeleteTree:
-		err = s.kvsDeleteTreeTxn(tx, idx, op.DirEnt.Key)
+		max := noTombstoneLimit
+		if op.MaxTombstones > 0 {
+			max = op.MaxTombstones
+		}
+		_, err = s.kvsDeleteTreeTxn(tx, idx, op.DirEnt.Key, max)
 
 	case structs.KVSCAS:
 		var ok bool
@@ -0,0 +1,52 @@
+package consul
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	// stateSizeStatsInterval is how often the estimated size of each state
+	// store table is emitted as a metric.
+	stateSizeStatsInterval = 10 * time.Second
+
+	// defaultKVPrefixDepth and defaultKVPrefixLimit are what
+	// Operator.KVPrefixSizes uses if the request doesn't say.
+	defaultKVPrefixDepth = 1
+	defaultKVPrefixLimit = 10
+)
+
+// stateSizeStats is a long running routine that emits the estimated size of
+// each table in the state store until the server shuts down.
+func (s *Server) stateSizeStats() {
+	for {
+		select {
+		case <-time.After(stateSizeStatsInterval):
+			s.emitStateSizeStats()
+
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// emitStateSizeStats sets gauges for the number of objects and estimated
+// bytes in each table.
+func (s *Server) emitStateSizeStats() {
+	for table, size := range s.fsm.State().TableSizes() {
+		metrics.SetGauge([]string{"consul", "state", table, "objects"}, float32(size.Objects))
+		metrics.SetGauge([]string{"consul", "state", table, "bytes"}, float32(size.Bytes))
+	}
+}
+
+// stateSizeStatsMap returns the table sizes for Stats.
+func (s *Server) stateSizeStatsMap() map[string]string {
+	stats := make(map[string]string)
+	for table, size := range s.fsm.State().TableSizes() {
+		stats[table+"_objects"] = strconv.FormatInt(size.Objects, 10)
+		stats[table+"_bytes"] = strconv.FormatInt(size.Bytes, 10)
+	}
+	return stats
+}
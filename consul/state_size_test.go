@@ -0,0 +1,114 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestOperator_KVPrefixSizes(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Write a few big values under one prefix and some small ones under
+	// another.
+	set := func(key string, size int) {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Value: make([]byte, size),
+			},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		set(fmt.Sprintf("heavy/%d", i), 64*1024)
+	}
+	for i := 0; i < 10; i++ {
+		set(fmt.Sprintf("light/%d", i), 16)
+	}
+
+	// The heavy prefix should come first.
+	arg := structs.KVPrefixSizesRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.KVPrefixSizesReply
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.KVPrefixSizes", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Index == 0 || len(reply.Prefixes) != 2 {
+		t.Fatalf("bad: %#v", reply)
+	}
+	heavy := reply.Prefixes[0]
+	if heavy.Prefix != "heavy/" || heavy.Keys != 3 || heavy.Bytes < 3*64*1024 {
+		t.Fatalf("bad: %#v", heavy)
+	}
+
+	// The limit should be honored.
+	arg.Limit = 1
+	var limited structs.KVPrefixSizesReply
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.KVPrefixSizes", &arg, &limited); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(limited.Prefixes) != 1 || limited.Prefixes[0].Prefix != "heavy/" {
+		t.Fatalf("bad: %#v", limited)
+	}
+
+	// The kvs table estimate should be within 10% of what was written, and
+	// should show up in the stats.
+	written := int64(3*64*1024 + 10*16)
+	size := s1.fsm.State().TableSizes()["kvs"]
+	if size.Objects != 13 || size.Bytes < written || size.Bytes > written+written/10 {
+		t.Fatalf("bad: %#v", size)
+	}
+	stats := s1.Stats()["state"]
+	if stats["kvs_objects"] != "13" || stats["kvs_bytes"] != strconv.FormatInt(size.Bytes, 10) {
+		t.Fatalf("bad: %#v", stats)
+	}
+}
+
+func TestOperator_KVPrefixSizes_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Make a request with no token to make sure it gets denied.
+	arg := structs.KVPrefixSizesRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.KVPrefixSizesReply
+	err := msgpackrpc.CallWithCodec(codec, "Operator.KVPrefixSizes", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Now it should go through with an operator read token.
+	arg.Token = makeTestToken(t, codec, `operator = "read"`, 0)
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.KVPrefixSizes", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
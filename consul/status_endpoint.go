@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"strconv"
 
+	"github.com/hashicorp/consul/consul/agent"
 	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/serf/serf"
 )
 
 // Status endpoint is used to check on server status
@@ -41,6 +43,43 @@ func (s *Status) Peers(args struct{}, reply *[]string) error {
 	return nil
 }
 
+// ClusterID is used to get the ID of the cluster this server is part of. This
+// is empty until the server has been bootstrapped or caught up with the
+// leader.
+func (s *Status) ClusterID(args struct{}, reply *string) error {
+	*reply = s.server.getClusterID()
+	return nil
+}
+
+// ConsistencyToken returns a consistency token from the leader that covers
+// every write it has applied. Most writes don't have a structured reply to
+// carry a token, so after one of those, this gets a token to pass along with
+// later reads.
+func (s *Status) ConsistencyToken(args *structs.DCSpecificRequest, reply *string) error {
+	// Only the leader is sure to have applied the caller's writes.
+	args.AllowStale = false
+	if done, err := s.server.forward("Status.ConsistencyToken", args, args, reply); done {
+		return err
+	}
+
+	*reply = encodeConsistencyToken(s.server.fsm.AppliedIndex())
+	return nil
+}
+
+// ApplyBackoff returns the leader's advice on how much agents should slow down
+// the catalog writes they send during anti-entropy syncs, so they can check
+// it before each sync.
+func (s *Status) ApplyBackoff(args *structs.DCSpecificRequest, reply *structs.ApplyBackoff) error {
+	// Only the leader knows how its applies are doing.
+	args.AllowStale = false
+	if done, err := s.server.forward("Status.ApplyBackoff", args, args, reply); done {
+		return err
+	}
+
+	s.server.applyBackoff(reply)
+	return nil
+}
+
 // Used by Autopilot to query the raft stats of the local server.
 func (s *Status) RaftStats(args struct{}, reply *structs.ServerStats) error {
 	stats := s.server.raft.Stats()
@@ -55,6 +94,34 @@ func (s *Status) RaftStats(args struct{}, reply *structs.ServerStats) error {
 	if err != nil {
 		return fmt.Errorf("error parsing server's last_log_term value: %s", err)
 	}
+	reply.LastAppliedIndex, err = strconv.ParseUint(stats["applied_index"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("error parsing server's applied_index value: %s", err)
+	}
+	reply.GossipDegraded = s.server.isGossipDegraded("lan") || s.server.isGossipDegraded("wan")
 
 	return nil
 }
+
+// WANMembers returns the alive servers in this server's view of the WAN pool.
+// Leaders in other datacenters use this to find servers their own WAN pool is
+// missing.
+func (s *Status) WANMembers(args struct{}, reply *structs.WANMembers) error {
+	for _, m := range s.server.WANMembers() {
+		if m.Status != serf.StatusAlive {
+			continue
+		}
+		ok, parts := agent.IsConsulServer(m)
+		if !ok {
+			continue
+		}
+		*reply = append(*reply, structs.WANMember{
+			Name:       m.Name,
+			Datacenter: parts.Datacenter,
+			Addr:       m.Addr.String(),
+			Port:       m.Port,
+			Status:     m.Status.String(),
+		})
+	}
+	return nil
+}
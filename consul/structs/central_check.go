@@ -0,0 +1,103 @@
+package structs
+
+import (
+	"time"
+)
+
+// CentralCheck is a health check definition that's stored on the servers and
+// handed out to the agents whose nodes match its selector. The servers only
+// store and serve these definitions; the agents are responsible for running
+// the checks and reporting their status through the usual anti-entropy sync.
+type CentralCheck struct {
+	// ID is the UUID-based ID for the definition, generated by the
+	// servers when the definition is created.
+	ID string
+
+	// Name is the name of the check that will be registered on the agent.
+	Name string
+
+	// Notes is an optional human-readable note attached to the check.
+	Notes string
+
+	// NodeMeta selects the nodes that should run this check. A node
+	// matches if its metadata has all of the given key/value pairs, so
+	// an empty selector matches every node.
+	NodeMeta map[string]string
+
+	// Status is the initial status of the check on the agent.
+	Status string
+
+	// These mirror the fields of an agent check definition. Exactly one
+	// of Script, HTTP, TCP, or TTL should be given.
+	Script            string
+	HTTP              string
+	TCP               string
+	DockerContainerID string
+	Shell             string
+	TLSSkipVerify     bool
+	Interval          time.Duration
+	Timeout           time.Duration
+	TTL               time.Duration
+
+	// RaftIndex holds the create/modify indexes of this definition.
+	RaftIndex
+}
+
+// Matches returns true if a node with the given metadata should run this
+// check.
+func (c *CentralCheck) Matches(meta map[string]string) bool {
+	return SatisfiesMetaFilters(meta, c.NodeMeta)
+}
+
+type CentralChecks []*CentralCheck
+
+type IndexedCentralChecks struct {
+	Checks CentralChecks
+	QueryMeta
+}
+
+type CentralCheckOp string
+
+const (
+	CentralCheckCreate CentralCheckOp = "create"
+	CentralCheckUpdate CentralCheckOp = "update"
+	CentralCheckDelete CentralCheckOp = "delete"
+)
+
+// CentralCheckRequest is used to create or change central check definitions.
+type CentralCheckRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Op is the operation to apply.
+	Op CentralCheckOp
+
+	// Check is the check definition itself.
+	Check *CentralCheck
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (c *CentralCheckRequest) RequestDatacenter() string {
+	return c.Datacenter
+}
+
+// CentralCheckSpecificRequest is used to get a central check definition by
+// ID.
+type CentralCheckSpecificRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// CheckID is the ID of a check definition.
+	CheckID string
+
+	// QueryOptions controls the consistency settings for the lookup.
+	QueryOptions
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (c *CentralCheckSpecificRequest) RequestDatacenter() string {
+	return c.Datacenter
+}
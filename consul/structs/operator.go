@@ -1,8 +1,10 @@
 package structs
 
 import (
+	"strings"
 	"time"
 
+	"github.com/hashicorp/consul/types"
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
 )
@@ -112,107 +114,1794 @@ func (op *AutopilotSetConfigRequest) RequestDatacenter() string {
 	return op.Datacenter
 }
 
-// ServerHealth is the health (from the leader's point of view) of a server.
-type ServerHealth struct {
-	// ID is the raft ID of the server.
-	ID string
+// QueryDefaults holds the default options for read requests in a datacenter.
+// These are applied by the servers to any request that leaves the matching
+// option unset, so explicit choices made by clients win, except that wait
+// times are never allowed to go over MaxQueryTime.
+type QueryDefaults struct {
+	// AllowStale lets any server answer reads that don't ask for a
+	// consistency mode of their own.
+	AllowStale bool
 
-	// Name is the node name of the server.
-	Name string
+	// MaxQueryTime is the wait time used for blocking queries that don't
+	// give one, and the longest wait time allowed for those that do.
+	MaxQueryTime time.Duration
 
-	// Address is the address of the server.
-	Address string
+	// Near is the node to sort results by distance from, for requests that
+	// don't give a source node.
+	Near string
 
-	// The status of the SerfHealth check for the server.
-	SerfStatus serf.MemberStatus
+	// RaftIndex stores the create/modify indexes of the defaults.
+	RaftIndex
+}
 
-	// Version is the Consul version of the server.
-	Version string
+// QueryDefaultsSetRequest is used by the Operator endpoint to update the
+// default query options of the datacenter.
+type QueryDefaultsSetRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
 
-	// Leader is whether this server is currently the leader.
-	Leader bool
+	// Defaults are the new query defaults to use.
+	Defaults QueryDefaults
 
-	// LastContact is the time since this node's last contact with the leader.
-	LastContact time.Duration
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
 
-	// LastTerm is the highest leader term this server has a record of in its Raft log.
-	LastTerm uint64
+// RequestDatacenter returns the datacenter for a given request.
+func (op *QueryDefaultsSetRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
 
-	// LastIndex is the last log index this server has a record of in its Raft log.
-	LastIndex uint64
+// QueryFreeze records whether an operator has frozen changes to prepared
+// queries, such as during an incident. Queries can still be executed while
+// they're frozen.
+type QueryFreeze struct {
+	// Frozen is whether changes to prepared queries are refused.
+	Frozen bool
 
-	// Healthy is whether or not the server is healthy according to the current
-	// Autopilot config.
-	Healthy bool
+	// SetBy is who last set or cleared the freeze.
+	SetBy string
 
-	// Voter is whether this is a voting server.
-	Voter bool
+	// SetAt is when the freeze was last set or cleared. This is filled in
+	// by the server.
+	SetAt time.Time
 
-	// StableSince is the last time this server's Healthy value changed.
-	StableSince time.Time
+	// Reason is why the freeze was set.
+	Reason string
+
+	// RaftIndex stores the create/modify indexes of the freeze.
+	RaftIndex
 }
 
-// IsHealthy determines whether this ServerHealth is considered healthy
-// based on the given Autopilot config
-func (h *ServerHealth) IsHealthy(lastTerm uint64, leaderLastIndex uint64, autopilotConf *AutopilotConfig) bool {
-	if h.SerfStatus != serf.StatusAlive {
-		return false
-	}
+// QueryFreezeRequest is used by the Operator endpoint to set or clear the
+// prepared query freeze.
+type QueryFreezeRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
 
-	if h.LastContact > autopilotConf.LastContactThreshold || h.LastContact < 0 {
-		return false
-	}
+	// Freeze is the new freeze state.
+	Freeze QueryFreeze
 
-	if h.LastTerm != lastTerm {
-		return false
-	}
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
 
-	if leaderLastIndex > autopilotConf.MaxTrailingLogs && h.LastIndex < leaderLastIndex-autopilotConf.MaxTrailingLogs {
-		return false
-	}
+// RequestDatacenter returns the datacenter for a given request.
+func (op *QueryFreezeRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
 
-	return true
+// RemoteWritePolicy controls whether servers in a datacenter forward
+// mutating requests that are meant for other datacenters.
+type RemoteWritePolicy struct {
+	// RefuseRemoteWrites makes servers reject mutating requests for other
+	// datacenters instead of forwarding them, unless the request's token
+	// has cross-datacenter write access. Reads are still forwarded.
+	RefuseRemoteWrites bool
+
+	// RaftIndex stores the create/modify indexes of the policy.
+	RaftIndex
 }
 
-// IsStable returns true if the ServerHealth is in a stable, passing state
-// according to the given AutopilotConfig
-func (h *ServerHealth) IsStable(now time.Time, conf *AutopilotConfig) bool {
-	if h == nil {
-		return false
-	}
+// RemoteWritePolicyRequest is used by the Operator endpoint to update the
+// remote write policy.
+type RemoteWritePolicyRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
 
-	if !h.Healthy {
-		return false
+	// Policy is the new remote write policy.
+	Policy RemoteWritePolicy
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *RemoteWritePolicyRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// ServiceNamePolicy requires new service names to be approved before they
+// can be registered.
+type ServiceNamePolicy struct {
+	// Enabled turns on the policy. Services can only be registered with
+	// names that are covered by the policy while it's enabled.
+	Enabled bool
+
+	// Names are the exact service names that are allowed.
+	Names []string
+
+	// Prefixes allow any service name that starts with one of them.
+	Prefixes []string
+
+	// Existing are the service names that were already registered when
+	// the policy was enabled, which are allowed so that running services
+	// don't break. This is filled in by the servers, and is ignored in
+	// requests.
+	Existing []string
+
+	// RaftIndex stores the create/modify indexes of the policy.
+	RaftIndex
+}
+
+// Allows returns true if the given service name can be registered under the
+// policy.
+func (p *ServiceNamePolicy) Allows(name string) bool {
+	if !p.Enabled {
+		return true
+	}
+	for _, allowed := range p.Names {
+		if name == allowed {
+			return true
+		}
 	}
+	for _, prefix := range p.Prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	for _, existing := range p.Existing {
+		if name == existing {
+			return true
+		}
+	}
+	return false
+}
 
-	if now.Sub(h.StableSince) < conf.ServerStabilizationTime {
+// ServiceNamePolicyOp is the operation to apply to the service name policy.
+type ServiceNamePolicyOp string
+
+const (
+	ServiceNamePolicySet    ServiceNamePolicyOp = "set"
+	ServiceNamePolicyDelete ServiceNamePolicyOp = "delete"
+)
+
+// ServiceNamePolicyRequest is used by the Operator endpoint to set or delete
+// the service name policy.
+type ServiceNamePolicyRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Op is the operation to apply.
+	Op ServiceNamePolicyOp
+
+	// Policy is the new policy. This isn't needed for deletes.
+	Policy ServiceNamePolicy
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *ServiceNamePolicyRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// DatacenterAlias maps the old name of a datacenter that's been renamed onto
+// its canonical name, so requests that still use the old name get to the
+// right place.
+type DatacenterAlias struct {
+	// Alias is the old name of the datacenter.
+	Alias string
+
+	// Canonical is the datacenter's current name. This can't be an alias
+	// itself.
+	Canonical string
+
+	// RaftIndex stores the create/modify indexes of the alias.
+	RaftIndex
+}
+
+// DatacenterAliases is a list of datacenter aliases.
+type DatacenterAliases []*DatacenterAlias
+
+// IndexedDatacenterAliases has the datacenter aliases, as well as the query
+// meta.
+type IndexedDatacenterAliases struct {
+	Aliases DatacenterAliases
+	QueryMeta
+}
+
+// DatacenterAliasOp is the operation to apply to a datacenter alias.
+type DatacenterAliasOp string
+
+const (
+	DatacenterAliasSet    DatacenterAliasOp = "set"
+	DatacenterAliasDelete DatacenterAliasOp = "delete"
+)
+
+// DatacenterAliasRequest is used by the Operator endpoint to create, update,
+// or delete a datacenter alias.
+type DatacenterAliasRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Op is the operation to apply.
+	Op DatacenterAliasOp
+
+	// Alias is the alias to operate on. Only the Alias field is needed for
+	// deletes.
+	Alias DatacenterAlias
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *DatacenterAliasRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// ServiceConstraint requires all instances of a service to agree on the
+// values of some of their meta keys.
+type ServiceConstraint struct {
+	// Service is the name of the service the constraint applies to.
+	Service string
+
+	// MetaKeys are the meta keys that all instances of the service must
+	// have the same value for. An instance that doesn't set a key is
+	// treated as having an empty value.
+	MetaKeys []string
+
+	// RaftIndex stores the create/modify indexes of the constraint.
+	RaftIndex
+}
+
+// ServiceConstraints is a list of service constraints.
+type ServiceConstraints []*ServiceConstraint
+
+// IndexedServiceConstraints has the service constraints, as well as the query
+// meta.
+type IndexedServiceConstraints struct {
+	Constraints ServiceConstraints
+	QueryMeta
+}
+
+// ServiceConstraintOp is the operation to apply to a service constraint.
+type ServiceConstraintOp string
+
+const (
+	ServiceConstraintSet    ServiceConstraintOp = "set"
+	ServiceConstraintDelete ServiceConstraintOp = "delete"
+)
+
+// ServiceConstraintRequest is used by the Operator endpoint to create, update,
+// or delete a service constraint.
+type ServiceConstraintRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Op is the operation to apply.
+	Op ServiceConstraintOp
+
+	// Constraint is the constraint to operate on. Only the Service field is
+	// needed for deletes.
+	Constraint ServiceConstraint
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *ServiceConstraintRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// NodeBlock keeps a node that was deregistered from being registered again,
+// either by name or by its node ID.
+type NodeBlock struct {
+	// Node is the name of the blocked node.
+	Node string
+
+	// ID is the node's ID when it was blocked, if it had one.
+	ID types.NodeID
+
+	// Expires is when the block runs out. If it's zero, the block lasts
+	// until it's cleared.
+	Expires time.Time
+
+	// RaftIndex stores the create/modify indexes of the block.
+	RaftIndex
+}
+
+// Expired returns true if the block has run out at the given time.
+func (b *NodeBlock) Expired(now time.Time) bool {
+	return !b.Expires.IsZero() && !now.Before(b.Expires)
+}
+
+// NodeBlocks is a list of node blocks.
+type NodeBlocks []*NodeBlock
+
+// IndexedNodeBlocks has the node blocks, as well as the query meta.
+type IndexedNodeBlocks struct {
+	Blocks NodeBlocks
+	QueryMeta
+}
+
+// NodeBlockOp is the operation to apply to a node block.
+type NodeBlockOp string
+
+const (
+	NodeBlockSet   NodeBlockOp = "set"
+	NodeBlockClear NodeBlockOp = "clear"
+)
+
+// NodeBlockRequest is used to set or clear the block on a node.
+type NodeBlockRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Op is the operation to apply.
+	Op NodeBlockOp
+
+	// Block is the block to operate on. Only the Node field is needed for
+	// clears.
+	Block NodeBlock
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *NodeBlockRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// ServerEventAction is a kind of change to a server's Raft membership.
+type ServerEventAction string
+
+const (
+	ServerEventAdded    ServerEventAction = "added"
+	ServerEventPromoted ServerEventAction = "promoted"
+	ServerEventDemoted  ServerEventAction = "demoted"
+	ServerEventRemoved  ServerEventAction = "removed"
+)
+
+// These are the initiators of server membership changes.
+const (
+	ServerEventByLeader    = "leader"
+	ServerEventByAutopilot = "autopilot"
+	ServerEventByOperator  = "operator"
+)
+
+// ServerEvent records a change to the Raft membership of a server, so there's
+// a trace of servers after they're gone.
+type ServerEvent struct {
+	// ID orders the events. It's the Raft index the event was written at.
+	ID uint64
+
+	// ServerID, Name, and Address identify the server. Name is only known
+	// for servers that are in the LAN pool when the change is made.
+	ServerID string
+	Name     string
+	Address  string
+
+	// Action is what happened to the server.
+	Action ServerEventAction
+
+	// Reason says why it happened, and Initiator is what made it happen,
+	// which is the leader, autopilot, or an operator.
+	Reason    string
+	Initiator string
+
+	// Time is when the leader made the change.
+	Time time.Time
+}
+
+// ServerEvents is a list of server events.
+type ServerEvents []*ServerEvent
+
+// ServerEventRequest is used by the leader to record a server event.
+type ServerEventRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Event is the event to record. The ID is filled in when it's applied.
+	Event ServerEvent
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *ServerEventRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// ServerHistoryRequest is used to page through the server history.
+type ServerHistoryRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// After only returns events with IDs after this one, for paging.
+	After uint64
+
+	// Limit is the most events to return. If it's zero, a default limit is
+	// used.
+	Limit int
+
+	QueryOptions
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *ServerHistoryRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// IndexedServerHistory has a page of the server history, oldest first. If
+// there are more events, Next is the After value for the next page.
+type IndexedServerHistory struct {
+	Events ServerEvents
+	Next   uint64
+	QueryMeta
+}
+
+// FederationForwarding is how much of the request traffic for a federated
+// datacenter is forwarded there.
+type FederationForwarding string
+
+const (
+	FederationForwardNone  FederationForwarding = "none"
+	FederationForwardReads FederationForwarding = "reads"
+	FederationForwardAll   FederationForwarding = "all"
+)
+
+// Allows returns true if a request of the given kind can be forwarded.
+func (f FederationForwarding) Allows(read bool) bool {
+	switch f {
+	case FederationForwardNone:
 		return false
+	case FederationForwardReads:
+		return read
+	default:
+		return true
 	}
-
-	return true
 }
 
-// ServerStats holds miscellaneous Raft metrics for a server
-type ServerStats struct {
-	// LastContact is the time since this node's last contact with the leader.
-	LastContact string
+// DecommissionState is how far along a datacenter is in being decommissioned.
+type DecommissionState string
 
-	// LastTerm is the highest leader term this server has a record of in its Raft log.
-	LastTerm uint64
+const (
+	// DecommissionNone is a datacenter that isn't being decommissioned.
+	DecommissionNone DecommissionState = ""
 
-	// LastIndex is the last log index this server has a record of in its Raft log.
-	LastIndex uint64
+	// DecommissionMarked is a datacenter that's been marked as
+	// decommissioned. It gets no requests, but its servers are still in
+	// the WAN pool.
+	DecommissionMarked DecommissionState = "marked"
+
+	// DecommissionPurged is a datacenter whose servers have also been
+	// removed from the WAN pool and the router.
+	DecommissionPurged DecommissionState = "purged"
+)
+
+// FederationPolicy limits which requests are forwarded to another datacenter.
+// The datacenter stays federated, so its servers are still tracked and show
+// up in the WAN members. Datacenters without a policy get all requests.
+type FederationPolicy struct {
+	// Datacenter is the name of the datacenter the policy applies to.
+	Datacenter string
+
+	// Forwarding is which requests can be forwarded to the datacenter.
+	Forwarding FederationForwarding
+
+	// Decommission is set once the datacenter is being torn down. A
+	// decommissioned datacenter gets no requests, whatever Forwarding
+	// says, and its servers can't rejoin the WAN pool until this is
+	// cleared.
+	Decommission DecommissionState
+
+	// Hidden leaves a decommissioned datacenter out of the datacenter
+	// listings.
+	Hidden bool
+
+	// RaftIndex stores the create/modify indexes of the policy.
+	RaftIndex
 }
 
-// OperatorHealthReply is a representation of the overall health of the cluster
-type OperatorHealthReply struct {
-	// Healthy is true if all the servers in the cluster are healthy.
-	Healthy bool
+// IsDecommissioned returns true if the datacenter has been marked as
+// decommissioned.
+func (p *FederationPolicy) IsDecommissioned() bool {
+	return p.Decommission != DecommissionNone
+}
 
-	// FailureTolerance is the number of healthy servers that could be lost without
-	// an outage occurring.
-	FailureTolerance int
+// Allows returns true if a request of the given kind can be forwarded to the
+// datacenter.
+func (p *FederationPolicy) Allows(read bool) bool {
+	return !p.IsDecommissioned() && p.Forwarding.Allows(read)
+}
+
+// FederationPolicies is a list of federation policies.
+type FederationPolicies []*FederationPolicy
+
+// IndexedFederationPolicies has the federation policies, as well as the query
+// meta.
+type IndexedFederationPolicies struct {
+	Policies FederationPolicies
+	QueryMeta
+}
+
+// FederationPolicyOp is the operation to apply to a federation policy.
+type FederationPolicyOp string
+
+const (
+	FederationPolicySet    FederationPolicyOp = "set"
+	FederationPolicyDelete FederationPolicyOp = "delete"
+)
+
+// FederationPolicyRequest is used by the Operator endpoint to set or delete
+// the federation policy for a datacenter.
+type FederationPolicyRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Op is the operation to apply.
+	Op FederationPolicyOp
+
+	// Policy is the policy to operate on. Only the Datacenter field is
+	// needed for deletes, which also clear any decommission mark. The
+	// decommission fields are ignored for sets.
+	Policy FederationPolicy
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *FederationPolicyRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// DecommissionDatacenterRequest is used by the Operator endpoint to
+// decommission another datacenter, in two phases. The first marks it as
+// decommissioned, and the second, once Confirm is set, removes its servers
+// from the WAN pool.
+type DecommissionDatacenterRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Decommission is the datacenter to decommission.
+	Decommission string
+
+	// Confirm runs the second phase, for a datacenter that's already been
+	// marked.
+	Confirm bool
+
+	// Hide leaves the datacenter out of the datacenter listings once it's
+	// marked. This is only used in the first phase.
+	Hide bool
+
+	// Clear takes the mark off, so the datacenter's servers can rejoin.
+	Clear bool
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *DecommissionDatacenterRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// DecommissionDatacenterReply has the outcome of a decommission request.
+type DecommissionDatacenterReply struct {
+	// State is where the datacenter is at after the request.
+	State DecommissionState
+
+	// Servers are the datacenter's servers in the WAN pool. After the
+	// first phase these are the ones the second phase will remove, and
+	// after the second phase these are the ones it removed.
+	Servers []string
+}
+
+// ServerHealth is the health (from the leader's point of view) of a server.
+type ServerHealth struct {
+	// ID is the raft ID of the server.
+	ID string
+
+	// Name is the node name of the server.
+	Name string
+
+	// Address is the address of the server.
+	Address string
+
+	// The status of the SerfHealth check for the server.
+	SerfStatus serf.MemberStatus
+
+	// Version is the Consul version of the server.
+	Version string
+
+	// Leader is whether this server is currently the leader.
+	Leader bool
+
+	// LastContact is the time since this node's last contact with the leader.
+	LastContact time.Duration
+
+	// LastTerm is the highest leader term this server has a record of in its Raft log.
+	LastTerm uint64
+
+	// LastIndex is the last log index this server has a record of in its Raft log.
+	LastIndex uint64
+
+	// LastAppliedIndex is the last log index this server has applied to its
+	// state store.
+	LastAppliedIndex uint64
+
+	// Healthy is whether or not the server is healthy according to the current
+	// Autopilot config.
+	Healthy bool
+
+	// Voter is whether this is a voting server.
+	Voter bool
+
+	// StableSince is the last time this server's Healthy value changed.
+	StableSince time.Time
+
+	// GossipDegraded is whether any of this server's gossip pools has more
+	// queued messages than its GossipDegradedThreshold.
+	GossipDegraded bool
+}
+
+// IsHealthy determines whether this ServerHealth is considered healthy
+// based on the given Autopilot config
+func (h *ServerHealth) IsHealthy(lastTerm uint64, leaderLastIndex uint64, autopilotConf *AutopilotConfig) bool {
+	if h.SerfStatus != serf.StatusAlive {
+		return false
+	}
+
+	if h.LastContact > autopilotConf.LastContactThreshold || h.LastContact < 0 {
+		return false
+	}
+
+	if h.LastTerm != lastTerm {
+		return false
+	}
+
+	if leaderLastIndex > autopilotConf.MaxTrailingLogs && h.LastIndex < leaderLastIndex-autopilotConf.MaxTrailingLogs {
+		return false
+	}
+
+	return true
+}
+
+// IsCaughtUp returns true if the server has applied enough of the Raft log to
+// be within maxLag of the given index applied by the leader. A server that
+// has the log entries but is still working through applying them isn't ready
+// to be promoted to a voter. Servers that don't report their applied index,
+// such as older versions, and a maxLag of 0 skip the check.
+func (h *ServerHealth) IsCaughtUp(leaderAppliedIndex uint64, maxLag uint64) bool {
+	if h == nil {
+		return false
+	}
+
+	if maxLag == 0 || h.LastAppliedIndex == 0 {
+		return true
+	}
+	if leaderAppliedIndex > maxLag && h.LastAppliedIndex < leaderAppliedIndex-maxLag {
+		return false
+	}
+
+	return true
+}
+
+// IsStable returns true if the ServerHealth is in a stable, passing state
+// according to the given AutopilotConfig
+func (h *ServerHealth) IsStable(now time.Time, conf *AutopilotConfig) bool {
+	if h == nil {
+		return false
+	}
+
+	if !h.Healthy {
+		return false
+	}
+
+	if now.Sub(h.StableSince) < conf.ServerStabilizationTime {
+		return false
+	}
+
+	return true
+}
+
+// ServerStats holds miscellaneous Raft metrics for a server
+type ServerStats struct {
+	// LastContact is the time since this node's last contact with the leader.
+	LastContact string
+
+	// LastTerm is the highest leader term this server has a record of in its Raft log.
+	LastTerm uint64
+
+	// LastIndex is the last log index this server has a record of in its Raft log.
+	LastIndex uint64
+
+	// LastAppliedIndex is the last log index this server has applied to its
+	// state store.
+	LastAppliedIndex uint64
+
+	// GossipDegraded is whether any of this server's gossip pools has more
+	// queued messages than its GossipDegradedThreshold.
+	GossipDegraded bool
+}
+
+// WANMember is a summary of a server in the WAN pool, used to compare WAN
+// membership between datacenters.
+type WANMember struct {
+	// Name is the WAN member name, which is the node name with the
+	// datacenter appended.
+	Name string
+
+	// Datacenter is the datacenter the server is in.
+	Datacenter string
+
+	// Addr and Port are the server's WAN Serf address.
+	Addr string
+	Port uint16
+
+	// Status is the server's Serf status, like "alive" or "failed".
+	Status string
+}
+
+// WANMembers is a list of WAN members.
+type WANMembers []WANMember
+
+// IndexedWANMembers is the WAN pool as a server sees it, along with the
+// datacenters it can route to. The index is the server's own count of WAN
+// membership changes, which isn't related to the Raft index.
+type IndexedWANMembers struct {
+	Members     WANMembers
+	Datacenters []string
+	QueryMeta
+}
+
+// OperatorHealthReply is a representation of the overall health of the cluster
+type OperatorHealthReply struct {
+	// Healthy is true if all the servers in the cluster are healthy.
+	Healthy bool
+
+	// FailureTolerance is the number of healthy servers that could be lost without
+	// an outage occurring.
+	FailureTolerance int
 
 	// Servers holds the health of each server.
 	Servers []ServerHealth
+
+	// Warnings holds any problems with the cluster as a whole that don't
+	// make it unhealthy, such as a flapping leader.
+	Warnings []string
+
+	// BootstrapStall is set if the server that answered is stuck waiting to
+	// bootstrap. There's no leader in that case, so the other fields are
+	// left empty.
+	BootstrapStall *BootstrapStall
+}
+
+// BootstrapStall describes a server that has found enough servers to meet
+// its BootstrapExpect value, but still has no Raft configuration. This is
+// almost always because the servers were started with conflicting expect
+// values, or one of them is in bootstrap mode.
+type BootstrapStall struct {
+	// Node is the name of the stalled server.
+	Node string
+
+	// Expect is the stalled server's own BootstrapExpect value.
+	Expect int
+
+	// Since is when the server first found enough servers.
+	Since time.Time
+
+	// Servers lists the servers that were found, along with the expect
+	// values they advertise.
+	Servers []BootstrapStallServer
+}
+
+// BootstrapStallServer is a server seen by a stalled server.
+type BootstrapStallServer struct {
+	// Name is the node name of the server.
+	Name string
+
+	// Expect is the BootstrapExpect value the server advertises, or zero
+	// if it doesn't advertise one.
+	Expect int
+
+	// Bootstrap is true if the server is in bootstrap mode.
+	Bootstrap bool
+}
+
+const (
+	// WANStatusDisabled means the WAN Serf hasn't been started, or the
+	// server has shut down.
+	WANStatusDisabled = "disabled"
+
+	// WANStatusRetrying means the WAN Serf failed to start and is being
+	// retried in the background.
+	WANStatusRetrying = "retrying"
+
+	// WANStatusUp means the WAN Serf is running.
+	WANStatusUp = "up"
+)
+
+// OperatorWANStatusReply reports the state of a server's WAN Serf pool.
+type OperatorWANStatusReply struct {
+	// Node is the name of the server that answered the request.
+	Node string
+
+	// Status is the WAN Serf status, see the WANStatus* constants.
+	Status string
+
+	// LastError is the last error seen while starting the WAN Serf.
+	LastError string
+
+	// NumMembers is the number of known WAN members.
+	NumMembers int
+}
+
+// KeyringStatusRequest is used to find out which nodes have which gossip
+// encryption keys installed, across all pools and datacenters.
+type KeyringStatusRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Key, if given, is checked to see if it could be removed without
+	// cutting any node off from the rest of its pool.
+	Key string
+
+	// Forwarded is set once the request has been fanned out to all the
+	// datacenters.
+	Forwarded bool
+
+	// RelayFactor is the number of duplicate responses to relay back
+	// through other nodes, for redundancy.
+	RelayFactor uint8
+
+	QueryOptions
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (r *KeyringStatusRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// KeyringKeyStatus reports how far a gossip key has been adopted in a pool.
+type KeyringKeyStatus struct {
+	// Key is the base64-encoded key.
+	Key string
+
+	// NumNodes is the number of nodes that have this key installed.
+	NumNodes int
+
+	// MissingNodes has the names of the nodes that answered but don't
+	// have this key installed.
+	MissingNodes []string
+}
+
+// KeyringPoolStatus reports on the keys installed across one LAN or WAN
+// gossip pool.
+type KeyringPoolStatus struct {
+	// WAN is true if this is the WAN pool, otherwise it's the LAN pool of
+	// Datacenter.
+	WAN bool
+
+	// Datacenter is the datacenter of the server that ran the query.
+	Datacenter string
+
+	// NumNodes is the number of alive members in the pool.
+	NumNodes int
+
+	// Keys has the status of each key installed on any member, sorted by
+	// key.
+	Keys []*KeyringKeyStatus
+
+	// NoResponse has the names of the alive members that didn't answer in
+	// time.
+	NoResponse []string
+
+	// Messages maps node names to any errors they reported.
+	Messages map[string]string `json:",omitempty"`
+
+	// Error is set if the pool couldn't be queried at all.
+	Error string `json:",omitempty"`
+
+	// RemoveSafe is set if the requested key could be removed from this
+	// pool without cutting off any node.
+	RemoveSafe bool
+}
+
+// SafeToRemove returns true if every member of the pool answered and they
+// all share some key other than the given one, so removing it wouldn't cut
+// any node off.
+func (p *KeyringPoolStatus) SafeToRemove(key string) bool {
+	if p.Error != "" || len(p.NoResponse) > 0 || len(p.Messages) > 0 {
+		return false
+	}
+	for _, k := range p.Keys {
+		if k.Key != key && len(k.MissingNodes) == 0 && k.NumNodes > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyringStatusResponse holds the keyring status of every pool in every
+// datacenter.
+type KeyringStatusResponse struct {
+	// Pools has the status of each pool that was queried.
+	Pools []*KeyringPoolStatus
+
+	// RemoveSafe is set if the requested key could be removed from every
+	// pool without cutting off any node.
+	RemoveSafe bool
+
+	QueryMeta
+}
+
+func (r *KeyringStatusResponse) Add(v interface{}) {
+	val := v.(*KeyringStatusResponse)
+	r.Pools = append(r.Pools, val.Pools...)
+}
+
+func (r *KeyringStatusResponse) New() interface{} {
+	return new(KeyringStatusResponse)
+}
+
+// KeyringRotateRequest is used to have the leader rotate the gossip
+// encryption key of its LAN pool and the WAN pool.
+type KeyringRotateRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Key is the new base64-encoded key.
+	Key string
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (r *KeyringRotateRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// KeyringRotateResponse reports how far a keyring rotation has got.
+type KeyringRotateResponse struct {
+	// ID is the ID of the operator intent tracking the rotation.
+	ID string
+
+	// Step is the step the rotation is waiting on, or empty once it's
+	// done.
+	Step string
+
+	// Done is set once the new key is the only one left on every member.
+	Done bool
+
+	// Failures maps the names of the members holding the rotation up to
+	// why, as of the last attempt at the current step. The leader keeps
+	// retrying the step until they've all caught up.
+	Failures map[string]string `json:",omitempty"`
+}
+
+// OperatorTimersRequest is used to pause or resume the leader's timers, such
+// as session TTLs, tombstone reaping, reconciliation, and autopilot.
+type OperatorTimersRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Paused says whether the timers should be paused or resumed.
+	Paused bool
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *OperatorTimersRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// OperatorTimersReply reports the state of the leader's timers.
+type OperatorTimersReply struct {
+	// Node is the name of the server that handled the request.
+	Node string
+
+	// Paused is true if the timers are paused.
+	Paused bool
+
+	WriteMeta
+}
+
+// NetworkCheckRequest asks the server handling it to test whether it can
+// reach another server's Serf and RPC ports.
+type NetworkCheckRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Target is the server to check, given as a LAN or WAN member name, or
+	// as an address. An address that isn't a known member is checked on
+	// the default ports.
+	Target string
+
+	// Handshake also does a protocol-level exchange on each port once it's
+	// connected: a Serf ping for the gossip ports and a Status.Ping for RPC.
+	Handshake bool
+
+	// Timeout bounds each individual check. If this is zero a short
+	// default is used.
+	Timeout time.Duration
+
+	QueryOptions
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *NetworkCheckRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+const (
+	// NetworkCheckOK means the port could be reached.
+	NetworkCheckOK = "ok"
+
+	// NetworkCheckRefused means nothing was listening on the port.
+	NetworkCheckRefused = "refused"
+
+	// NetworkCheckTimeout means the check didn't finish in time, which
+	// usually points at a firewall dropping traffic.
+	NetworkCheckTimeout = "timeout"
+
+	// NetworkCheckHandshakeFailed means the port accepted a connection but
+	// the protocol-level handshake failed.
+	NetworkCheckHandshakeFailed = "handshake_failed"
+
+	// NetworkCheckError covers any other failure.
+	NetworkCheckError = "error"
+)
+
+// NetworkCheckResult is the outcome of checking a single port.
+type NetworkCheckResult struct {
+	// Port names the port that was checked: "serf_lan", "serf_wan", or
+	// "rpc".
+	Port string
+
+	// Addr is the address that was checked.
+	Addr string
+
+	// OK is true if the port could be reached.
+	OK bool
+
+	// Class classifies the result, see the NetworkCheck* constants.
+	Class string
+
+	// Error is the error seen, if any.
+	Error string
+
+	// Latency is how long the check took.
+	Latency time.Duration
+}
+
+// NetworkCheckReply holds the results of a network check.
+type NetworkCheckReply struct {
+	// Node is the name of the server that ran the check.
+	Node string
+
+	// Target is the name of the server that was checked, if it's a known
+	// member, otherwise the requested address.
+	Target string
+
+	// Results has one entry per port checked.
+	Results []NetworkCheckResult
+}
+
+// OperatorDrainRequest is used to put a server into drain mode, or take it
+// out again.
+type OperatorDrainRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Node is the name of the server to drain.
+	Node string
+
+	// Draining says whether the server should be draining.
+	Draining bool
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *OperatorDrainRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// OperatorDrainReply reports whether a server is draining.
+type OperatorDrainReply struct {
+	// Node is the name of the server that was changed.
+	Node string
+
+	// Draining is true if the server is draining.
+	Draining bool
+
+	WriteMeta
+}
+
+// RemovalImpactRequest asks the leader what would happen to the cluster if a
+// server were removed from the Raft configuration. Nothing is changed.
+type RemovalImpactRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// ID is the Raft ID of the server to consider removing.
+	ID raft.ServerID
+
+	QueryOptions
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *RemovalImpactRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// RemovalImpactZone describes a redundancy zone as it would be after a
+// server is removed.
+type RemovalImpactZone struct {
+	// Name is the value of the redundancy zone tag.
+	Name string
+
+	// Servers is the number of servers left in the zone.
+	Servers int
+
+	// HealthyServers is the number of healthy servers left in the zone.
+	HealthyServers int
+
+	// Voters is the number of voters left in the zone.
+	Voters int
+
+	// LosesRedundancy is set if the zone had a healthy spare before the
+	// removal but would be down to a single healthy server.
+	LosesRedundancy bool
+
+	// Empty is set if the zone had a healthy server before the removal but
+	// would have none afterwards.
+	Empty bool
+}
+
+// RemovalImpactReply is the estimated state of the cluster after a server is
+// removed, worked out from the current Raft configuration and Autopilot's
+// view of server health.
+type RemovalImpactReply struct {
+	// ID is the Raft ID of the server that would be removed.
+	ID raft.ServerID
+
+	// Node is the node name of the server, if it's known.
+	Node string
+
+	// Voter is true if the server is currently a voter.
+	Voter bool
+
+	// Voters is the number of voters that would be left.
+	Voters int
+
+	// FailureTolerance is the number of healthy voters that could then be
+	// lost without an outage.
+	FailureTolerance int
+
+	// QuorumMaintained is true if the healthy voters left would still make
+	// up a quorum.
+	QuorumMaintained bool
+
+	// Healthy is true if all the servers left are healthy.
+	Healthy bool
+
+	// Servers holds the health of the servers that would be left.
+	Servers []ServerHealth
+
+	// Zone is the redundancy zone of the server, if redundancy zones are
+	// configured.
+	Zone string
+
+	// Zones describes each redundancy zone after the removal. This is
+	// empty if Autopilot's RedundancyZoneTag isn't set.
+	Zones []RemovalImpactZone
+}
+
+// ReloadableConfig holds the server settings that can be changed on a running
+// server with Server.Reload.
+type ReloadableConfig struct {
+	// Autopilot is the Autopilot configuration.
+	Autopilot *AutopilotConfig
+
+	// AutopilotInterval is how often the leader runs the Autopilot loop,
+	// and ServerHealthInterval is how often it checks server health.
+	AutopilotInterval    time.Duration
+	ServerHealthInterval time.Duration
+
+	// CoordinateUpdatePeriod is how often the servers apply batched network
+	// coordinate updates.
+	CoordinateUpdatePeriod time.Duration
+
+	// ACLDownPolicy and ACLTTL control how non-authoritative servers cache
+	// ACLs and what they do when the ACL datacenter can't be reached.
+	ACLDownPolicy string
+	ACLTTL        time.Duration
+}
+
+// ValidateConfigRequest asks the leader to check a proposed set of reloadable
+// settings. Nothing is changed.
+type ValidateConfigRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Config has the proposed settings. Fields left at their zero value
+	// keep the running server's setting.
+	Config ReloadableConfig
+
+	QueryOptions
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *ValidateConfigRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// ValidateConfigReply has the problems found with a proposed configuration.
+// Errors would stop the configuration from being applied, and warnings are
+// settings that are allowed but look risky for the running cluster.
+type ValidateConfigReply struct {
+	Errors   []string
+	Warnings []string
+}
+
+// TopTokensRequest asks a server for the tokens that have made the most
+// requests to it recently.
+type TopTokensRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Limit is the most tokens to return. The server picks a default if
+	// this isn't set.
+	Limit int
+
+	QueryOptions
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *TopTokensRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// TokenRate is how many requests a server has handled for a token recently.
+type TokenRate struct {
+	// Token is the token's ID. This is redacted unless the request was
+	// made with a token that can list ACLs.
+	Token string
+
+	// Name is the token's name, if the server has a copy of the token.
+	Name string
+
+	// Requests is the number of requests made with the token over the
+	// server's tracking window, including any that were rate limited.
+	Requests uint64
+
+	// Rate is the average number of requests per second over the window.
+	Rate float64
+
+	// RateLimit is the token's rate limit, or zero if it has none.
+	RateLimit float64
+}
+
+// TopTokensReply has the tokens that have made the most requests to a
+// server, busiest first.
+type TopTokensReply struct {
+	// Node is the server that counted the requests.
+	Node string
+
+	// Window is how far back the requests were counted.
+	Window time.Duration
+
+	Tokens []TokenRate
+
+	QueryMeta
+}
+
+// KVPrefixSizesRequest asks for the KV prefixes that take up the most memory.
+type KVPrefixSizesRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Depth is how many path segments to group keys by, so a depth of 1
+	// adds up everything under "foo/" together. The server picks a
+	// default if this isn't set.
+	Depth int
+
+	// Limit is the most prefixes to return. The server picks a default if
+	// this isn't set.
+	Limit int
+
+	QueryOptions
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *KVPrefixSizesRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// KVPrefixSize is the estimated size of the keys under a KV prefix.
+type KVPrefixSize struct {
+	Prefix string
+	Keys   int
+	Bytes  int64
+}
+
+// KVPrefixSizesReply has the largest KV prefixes, largest first.
+type KVPrefixSizesReply struct {
+	Prefixes []*KVPrefixSize
+
+	QueryMeta
+}
+
+// BlockingQueriesRequest asks a server for the blocking queries it's
+// currently serving.
+type BlockingQueriesRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Node is the name of the server to list the queries of. If this is
+	// empty then the server that gets the request answers.
+	Node string
+
+	QueryOptions
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *BlockingQueriesRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// BlockingQuery describes a blocking query that a server is waiting to
+// answer.
+type BlockingQuery struct {
+	// ID identifies the query so it can be cancelled. This is only unique
+	// to the server serving the query.
+	ID string
+
+	// Endpoint is the RPC endpoint the query was made to, such as
+	// "KVS.Get".
+	Endpoint string
+
+	// Filter summarizes what the query is for, such as the key or service
+	// name it's watching.
+	Filter string
+
+	// Source is the address the query came from, or "local" for queries
+	// made by the server's own agent.
+	Source string
+
+	// TokenHash is a hash of the query's ACL token, so queries made with
+	// the same token can be grouped without giving the token away. This
+	// is empty for the anonymous token.
+	TokenHash string
+
+	// Start is when the server started waiting on the query.
+	Start time.Time
+
+	// MinQueryIndex is the index the query is waiting to move past.
+	MinQueryIndex uint64
+}
+
+// BlockingQueriesReply has the blocking queries a server is serving, oldest
+// first.
+type BlockingQueriesReply struct {
+	// Node is the server that's serving the queries.
+	Node string
+
+	Queries []BlockingQuery
+
+	QueryMeta
+}
+
+// CancelBlockingQueryRequest is used to make a blocking query on a server
+// return right away.
+type CancelBlockingQueryRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Node is the name of the server serving the query. If this is empty
+	// then the server that gets the request is used.
+	Node string
+
+	// ID is the ID of the query to cancel, from a BlockingQuery.
+	ID string
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *CancelBlockingQueryRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// OrphanedLock is a key that's locked by a session that no longer exists,
+// which can happen after a partial restore, for example.
+type OrphanedLock struct {
+	Key     string
+	Session string
+}
+
+// OrphanedLockRequest is used to release orphaned locks. Each key is only
+// released if it's still held by the given session, and that session still
+// doesn't exist.
+type OrphanedLockRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	Locks []OrphanedLock
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *OrphanedLockRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// OrphanedLockSweepRequest is used to find and release orphaned locks right
+// away, instead of waiting for the leader's periodic sweep.
+type OrphanedLockSweepRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// DryRun reports the orphaned locks without releasing them.
+	DryRun bool
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *OrphanedLockSweepRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// OrphanedLockSweepReply has the orphaned locks a sweep found.
+type OrphanedLockSweepReply struct {
+	// Locks are the orphaned locks that were found.
+	Locks []OrphanedLock
+
+	// Released is the number of them that were released, which is zero
+	// for a dry run.
+	Released int
+}
+
+// OperatorIntentKind is a kind of multi-step workflow the leader tracks in
+// Raft, so a new leader can pick it up if the old one fails part way.
+type OperatorIntentKind string
+
+const (
+	// OperatorIntentServerLeave removes a server that left or was reaped
+	// from the Raft peers, and then deregisters it.
+	OperatorIntentServerLeave OperatorIntentKind = "server-leave"
+
+	// OperatorIntentDeadServerCleanup is Autopilot removing a failed
+	// server. It forces the server to leave the LAN pool, and then removes
+	// it like a server that left.
+	OperatorIntentDeadServerCleanup OperatorIntentKind = "dead-server-cleanup"
+
+	// OperatorIntentLeaderTransfer promotes the old leader back to a voter
+	// after it demoted itself to hand over leadership. These are recorded
+	// before the old leader steps down, and run by the new leader.
+	OperatorIntentLeaderTransfer OperatorIntentKind = "leader-transfer"
+
+	// OperatorIntentKeyringRotate rotates the gossip encryption key of the
+	// LAN and WAN pools, see the Operator.KeyringRotate endpoint.
+	OperatorIntentKeyringRotate OperatorIntentKind = "keyring-rotate"
+)
+
+// OperatorIntent records the progress of a multi-step workflow.
+type OperatorIntent struct {
+	// ID is a UUID for the intent.
+	ID string
+
+	// Kind is the workflow being run.
+	Kind OperatorIntentKind
+
+	// Target is the node name of the server the workflow acts on, and
+	// ServerID and Address identify it in the Raft configuration.
+	Target   string
+	ServerID string
+	Address  string
+
+	// Reason says why the workflow was started.
+	Reason string
+
+	// Key is the new gossip encryption key for a keyring rotation. It's
+	// blanked out for tokens without keyring read access.
+	Key string `json:",omitempty"`
+
+	// Step is the next step to run. It's moved along as each step is
+	// done, and the intent is deleted after the last one.
+	Step string
+
+	// Started is when the leader started the workflow.
+	Started time.Time
+
+	// RaftIndex stores the create/modify indexes of the intent.
+	RaftIndex
+}
+
+// OperatorIntents is a list of operator intents.
+type OperatorIntents []*OperatorIntent
+
+// IndexedOperatorIntents has the pending operator intents, as well as the
+// query meta.
+type IndexedOperatorIntents struct {
+	Intents OperatorIntents
+	QueryMeta
+}
+
+// OperatorIntentOp is the operation to apply to an operator intent.
+type OperatorIntentOp string
+
+const (
+	OperatorIntentCreate OperatorIntentOp = "create"
+	OperatorIntentUpdate OperatorIntentOp = "update"
+	OperatorIntentDelete OperatorIntentOp = "delete"
+)
+
+// OperatorIntentRequest is used by the leader to record an operator intent
+// and its progress.
+type OperatorIntentRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Op is the operation to apply.
+	Op OperatorIntentOp
+
+	// Intent is the intent to operate on. Updates only use the ID, Step,
+	// and ModifyIndex, and deletes only the ID and ModifyIndex. Both only
+	// take effect if the intent hasn't been modified since ModifyIndex, so
+	// each step is only ever moved past once.
+	Intent OperatorIntent
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *OperatorIntentRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// KVQuota limits how much can be stored under a KV prefix. Writes that would
+// put the prefix over either limit are refused, but deletes always go
+// through, even if the prefix is already over.
+type KVQuota struct {
+	// Prefix is the KV prefix the quota covers.
+	Prefix string
+
+	// MaxKeys is the most keys allowed under the prefix, and MaxBytes is
+	// the most bytes of values. Zero means no limit.
+	MaxKeys  int
+	MaxBytes int64
+
+	// Usage is what's currently stored under the prefix. This is kept up
+	// to date by the state store, and is ignored when setting a quota.
+	Usage KVQuotaUsage
+
+	// RaftIndex stores the create/modify indexes of the quota.
+	RaftIndex
+}
+
+// KVQuotaUsage is what's stored under a KV prefix.
+type KVQuotaUsage struct {
+	Keys  int
+	Bytes int64
+}
+
+// KVQuotas is a list of KV quotas.
+type KVQuotas []*KVQuota
+
+// IndexedKVQuotas has the KV quotas, as well as the query meta.
+type IndexedKVQuotas struct {
+	Quotas KVQuotas
+	QueryMeta
+}
+
+// KVQuotaOp is the operation to apply to a KV quota.
+type KVQuotaOp string
+
+const (
+	KVQuotaSet    KVQuotaOp = "set"
+	KVQuotaDelete KVQuotaOp = "delete"
+)
+
+// KVQuotaRequest is used to set or delete the quota on a KV prefix.
+type KVQuotaRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Op is the operation to apply.
+	Op KVQuotaOp
+
+	// Quota is the quota to operate on. Only the Prefix field is needed
+	// for deletes.
+	Quota KVQuota
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *KVQuotaRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// ClusterID identifies the servers in a datacenter as one cluster. It's
+// generated by the first leader and never changes, and servers that
+// advertise a different one are refused when they try to join.
+type ClusterID struct {
+	// ID is the cluster's UUID.
+	ID string
+
+	// RaftIndex stores the create/modify indexes of the cluster ID.
+	RaftIndex
+}
+
+// ClusterIDRequest is used by the leader to set the cluster ID.
+type ClusterIDRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// ClusterID is the cluster ID to set.
+	ClusterID ClusterID
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *ClusterIDRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// TransferLeaderRequest asks the leader to hand leadership to another voter.
+type TransferLeaderRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *TransferLeaderRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// TransferLeaderReply describes the leader after a leadership transfer.
+type TransferLeaderReply struct {
+	// ID is the Raft ID of the new leader.
+	ID raft.ServerID
+
+	// Node is the node name of the new leader, if it's known.
+	Node string
+
+	// Address is the Raft address of the new leader.
+	Address raft.ServerAddress
+}
+
+// These are the transports a fault injection can apply to.
+const (
+	FaultInjectionRPC  = "rpc"
+	FaultInjectionRaft = "raft"
+)
+
+// FaultInjection describes a fault a server injects into its outgoing
+// connections to other servers, for chaos testing.
+type FaultInjection struct {
+	// ID identifies the injection. The server generates one if it's blank.
+	ID string
+
+	// Transport is FaultInjectionRPC or FaultInjectionRaft, or blank for
+	// both.
+	Transport string
+
+	// Peer is the "IP:port" address of the server to inject faults for,
+	// or blank for all of them.
+	Peer string
+
+	// Latency is added to each new connection, and to each write on a
+	// connection.
+	Latency time.Duration
+
+	// DropPercent is the percentage of new connections that fail.
+	DropPercent int
+
+	// Blackhole makes new connections hang until they time out, and
+	// breaks existing ones.
+	Blackhole bool
+
+	// TTL is how long the injection lasts. It lasts until it's deleted if
+	// this is zero.
+	TTL time.Duration
+
+	// Expires is when the injection will be removed, which the server
+	// sets from the TTL.
+	Expires time.Time
+}
+
+// FaultInjectionOp is the operation to apply to a fault injection.
+type FaultInjectionOp string
+
+const (
+	FaultInjectionSet    FaultInjectionOp = "set"
+	FaultInjectionDelete FaultInjectionOp = "delete"
+)
+
+// FaultInjectionRequest is used to add, replace, or remove a fault injection
+// on a server.
+type FaultInjectionRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Node is the name of the server to change.
+	Node string
+
+	// Op is the operation to apply.
+	Op FaultInjectionOp
+
+	// Injection is the injection to set. Only the ID is needed to delete
+	// one.
+	Injection FaultInjection
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *FaultInjectionRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// FaultInjectionListRequest is used to list a server's fault injections.
+type FaultInjectionListRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Node is the name of the server to ask.
+	Node string
+
+	QueryOptions
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (op *FaultInjectionListRequest) RequestDatacenter() string {
+	return op.Datacenter
+}
+
+// FaultInjectionReply has a server's active fault injections.
+type FaultInjectionReply struct {
+	// Node is the name of the server.
+	Node string
+
+	// Injections are the server's active injections.
+	Injections []*FaultInjection
 }
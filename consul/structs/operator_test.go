@@ -51,6 +51,39 @@ func TestServerHealth_IsHealthy(t *testing.T) {
 	}
 }
 
+func TestServerHealth_IsCaughtUp(t *testing.T) {
+	cases := []struct {
+		health   *ServerHealth
+		applied  uint64
+		expected bool
+	}{
+		// Within the limit
+		{&ServerHealth{LastAppliedIndex: 95}, 100, true},
+		// Exactly at the limit
+		{&ServerHealth{LastAppliedIndex: 90}, 100, true},
+		// Too far behind
+		{&ServerHealth{LastAppliedIndex: 89}, 100, false},
+		// Leader hasn't applied more than the limit yet
+		{&ServerHealth{LastAppliedIndex: 1}, 10, true},
+		// Older servers don't report their applied index
+		{&ServerHealth{LastAppliedIndex: 0}, 100, true},
+		// Nil struct
+		{nil, 100, false},
+	}
+
+	for index, tc := range cases {
+		actual := tc.health.IsCaughtUp(tc.applied, 10)
+		if actual != tc.expected {
+			t.Fatalf("bad value for case %d: %v", index, actual)
+		}
+	}
+
+	// The check can be turned off.
+	if !(&ServerHealth{LastAppliedIndex: 1}).IsCaughtUp(100, 0) {
+		t.Fatalf("should be caught up")
+	}
+}
+
 func TestServerHealth_IsStable(t *testing.T) {
 	start := time.Now()
 	cases := []struct {
@@ -144,6 +144,10 @@ type PreparedQueryRequest struct {
 	// Query is the query itself.
 	Query *PreparedQuery
 
+	// Force applies the change even if prepared queries are frozen. This
+	// requires a management token.
+	Force bool
+
 	// WriteRequest holds the ACL token to go along with this request.
 	WriteRequest
 }
@@ -202,6 +206,10 @@ func (q *PreparedQueryExecuteRequest) RequestDatacenter() string {
 	return q.Datacenter
 }
 
+func (q *PreparedQueryExecuteRequest) GetQuerySource() *QuerySource {
+	return &q.Source
+}
+
 // PreparedQueryExecuteRemoteRequest is used when running a local query in a
 // remote datacenter.
 type PreparedQueryExecuteRemoteRequest struct {
@@ -0,0 +1,202 @@
+package structs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+var (
+	// ErrNoSigningKey is returned when a signed result is requested but the
+	// leader hasn't set up a signing key yet.
+	ErrNoSigningKey = fmt.Errorf("No signing key is available")
+
+	// ErrBadSignature is returned when a result doesn't match its
+	// signature.
+	ErrBadSignature = fmt.Errorf("Result doesn't match its signature")
+)
+
+// SigningKey is a keypair the servers use to sign query results, so they
+// can be passed around by caches and still be checked by the consumer. Only
+// the active key signs results; the previous key is kept around so results
+// signed just before a rotation can still be verified.
+type SigningKey struct {
+	// ID identifies the key in signatures. It's derived from the public
+	// key.
+	ID string
+
+	// PublicKey is the DER encoded PKIX public key.
+	PublicKey []byte
+
+	// PrivateKey is the DER encoded EC private key. This never leaves the
+	// servers.
+	PrivateKey []byte
+
+	// Active is set on the key that's currently used for signing.
+	Active bool
+
+	// RaftIndex stores the create/modify indexes of the key.
+	RaftIndex
+}
+
+// SigningKeys is a list of signing keys.
+type SigningKeys []*SigningKey
+
+// GenerateSigningKey makes a new ECDSA P-256 signing key.
+func GenerateSigningKey() (*SigningKey, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	privBytes, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	id := sha256.Sum256(pubBytes)
+	return &SigningKey{
+		ID:         hex.EncodeToString(id[:8]),
+		PublicKey:  pubBytes,
+		PrivateKey: privBytes,
+	}, nil
+}
+
+// Public returns the parts of the key that are safe to hand out.
+func (k *SigningKey) Public() *SigningPublicKey {
+	return &SigningPublicKey{
+		ID:        k.ID,
+		PublicKey: k.PublicKey,
+		Active:    k.Active,
+	}
+}
+
+// SigningPublicKey is the public half of a signing key.
+type SigningPublicKey struct {
+	ID        string
+	PublicKey []byte
+	Active    bool
+}
+
+// IndexedSigningPublicKeys has the public signing keys, as well as the query
+// meta.
+type IndexedSigningPublicKeys struct {
+	Keys []*SigningPublicKey
+	QueryMeta
+}
+
+// SigningKeyRequest is used to install a new signing key, which becomes the
+// active one.
+type SigningKeyRequest struct {
+	// Datacenter is the target this request is intended for.
+	Datacenter string
+
+	// Key is the new key. This is generated by the leader, and is ignored
+	// when the request comes in over RPC.
+	Key SigningKey
+
+	// WriteRequest holds the ACL token to go along with this request.
+	WriteRequest
+}
+
+// RequestDatacenter returns the datacenter for a given request.
+func (r *SigningKeyRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// ResultSignature is a detached signature over a query result and its
+// index.
+type ResultSignature struct {
+	// KeyID is the ID of the key that made the signature.
+	KeyID string
+
+	// Signature is the ASN.1 encoded ECDSA signature over the SHA-256 hash
+	// of SignedPayload.
+	Signature []byte
+}
+
+// SignedPayload returns the canonical serialization of a result and its
+// index that signatures cover. This is JSON, which has a fixed field order
+// and sorts map keys, so it comes out the same after a round trip through
+// the RPC or HTTP encodings.
+func SignedPayload(index uint64, result interface{}) ([]byte, error) {
+	payload := struct {
+		Index  uint64
+		Result interface{}
+	}{index, result}
+	return json.Marshal(payload)
+}
+
+// SignResult signs the given result and index with the key.
+func SignResult(key *SigningKey, index uint64, result interface{}) (*ResultSignature, error) {
+	priv, err := x509.ParseECPrivateKey(key.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %v", err)
+	}
+	payload, err := SignedPayload(index, result)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, priv, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	return &ResultSignature{KeyID: key.ID, Signature: sig}, nil
+}
+
+// VerifyResult checks the signature on a result and index against the
+// given public keys. It returns ErrBadSignature if the result has been
+// changed, and an error if none of the keys made the signature.
+func VerifyResult(keys []*SigningPublicKey, sig *ResultSignature, index uint64, result interface{}) error {
+	if sig == nil {
+		return fmt.Errorf("Result isn't signed")
+	}
+
+	var key *SigningPublicKey
+	for _, k := range keys {
+		if k.ID == sig.KeyID {
+			key = k
+			break
+		}
+	}
+	if key == nil {
+		return fmt.Errorf("Unknown signing key %q", sig.KeyID)
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(key.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to parse public key: %v", err)
+	}
+	pub, ok := parsed.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("Public key %q isn't an ECDSA key", key.ID)
+	}
+
+	payload, err := SignedPayload(index, result)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(payload)
+	if !ecdsa.VerifyASN1(pub, hash[:], sig.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Verify checks the signature on the service nodes.
+func (r *IndexedServiceNodes) Verify(keys []*SigningPublicKey) error {
+	return VerifyResult(keys, r.Signature, r.Index, r.ServiceNodes)
+}
+
+// Verify checks the signature on the service nodes.
+func (r *IndexedCheckServiceNodes) Verify(keys []*SigningPublicKey) error {
+	return VerifyResult(keys, r.Signature, r.Index, r.Nodes)
+}
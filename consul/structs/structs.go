@@ -19,8 +19,406 @@ var (
 	ErrNoLeader  = fmt.Errorf("No cluster leader")
 	ErrNoDCPath  = fmt.Errorf("No path to datacenter")
 	ErrNoServers = fmt.Errorf("No known Consul servers")
+
+	// ErrStaleFenced is returned for stale reads by a server that has been
+	// out of contact with the leader for longer than its stale read fence.
+	ErrStaleFenced = fmt.Errorf("Stale reads fenced, no recent contact with the cluster leader")
+
+	// ErrCatchingUp is returned for stale reads by a server that's still
+	// replaying the log after starting up, and is too far behind the leader
+	// to serve them.
+	ErrCatchingUp = fmt.Errorf("Stale reads refused, server is still catching up with the cluster leader")
+
+	// ErrDraining is returned for requests from clients to a server that an
+	// operator has put into drain mode.
+	ErrDraining = fmt.Errorf("Server is draining and not serving client requests")
+
+	// ErrDeadlineExceeded is returned for a write whose RequestTimeout ran
+	// out before it was handed to Raft. The write was never applied.
+	ErrDeadlineExceeded = fmt.Errorf("Request deadline exceeded")
+
+	// ErrConsistencyTimeout is returned for reads with a consistency token
+	// when the server doesn't catch up to the token in time.
+	ErrConsistencyTimeout = fmt.Errorf("Timed out waiting to catch up to the consistency token")
 )
 
+// ErrorCode identifies a kind of error. RPC errors only carry their message,
+// so the errors below start their message with their code, followed by a
+// colon. That lets HasErrorCode tell what they are on either side of an RPC.
+type ErrorCode string
+
+const (
+	ErrCodeRemoteWriteRefused    ErrorCode = "Remote writes refused"
+	ErrCodeFederationPolicy      ErrorCode = "Forwarding refused by federation policy"
+	ErrCodeUnsupportedFields     ErrorCode = "Unsupported field(s) in request"
+	ErrCodeServiceConstraint     ErrorCode = "Service constraint violated"
+	ErrCodeServiceNameNotAllowed ErrorCode = "Service name not allowed"
+	ErrCodeNodeBlocked           ErrorCode = "Node is blocked"
+	ErrCodeQueryFrozen           ErrorCode = "Prepared queries are frozen"
+	ErrCodeSnapshotVersion       ErrorCode = "Unsupported snapshot schema version"
+	ErrCodeTooLarge              ErrorCode = "Request too large"
+	ErrCodeKVFlag                ErrorCode = "KV flag violation"
+	ErrCodeTokenRateLimited      ErrorCode = "Token rate limit exceeded"
+	ErrCodeSessionLimit          ErrorCode = "Session limit reached"
+	ErrCodeKVQuotaExceeded       ErrorCode = "KV quota exceeded"
+)
+
+// CodedError is an error with an ErrorCode.
+type CodedError interface {
+	error
+	ErrorCode() ErrorCode
+}
+
+// rpcErrorPrefix is put in front of the message of an error that came back
+// from an RPC by the connection pool, once for each server it went through.
+const rpcErrorPrefix = "rpc error: "
+
+// HasErrorCode returns true if the given error has the given code. This also
+// works for errors that came back from an RPC, which only carry the message,
+// and for a failed transaction operation, which has the error's message.
+func HasErrorCode(err error, code ErrorCode) bool {
+	var msg string
+	switch e := err.(type) {
+	case nil:
+		return false
+	case CodedError:
+		return e.ErrorCode() == code
+	case TxnError:
+		msg = e.What
+	case *TxnError:
+		msg = e.What
+	default:
+		msg = err.Error()
+	}
+
+	for strings.HasPrefix(msg, rpcErrorPrefix) {
+		msg = msg[len(rpcErrorPrefix):]
+	}
+	return strings.HasPrefix(msg, string(code)+":")
+}
+
+// RemoteWriteRefusedError is returned when a mutating request is meant for
+// another datacenter and the local datacenter's remote write policy doesn't
+// allow it to be forwarded.
+type RemoteWriteRefusedError struct {
+	// Local is the datacenter that refused the request.
+	Local string
+
+	// Datacenter is the datacenter the request was meant for.
+	Datacenter string
+}
+
+func (e *RemoteWriteRefusedError) Error() string {
+	return fmt.Sprintf("%s: datacenter %q doesn't forward writes to datacenter %q",
+		ErrCodeRemoteWriteRefused, e.Local, e.Datacenter)
+}
+
+func (e *RemoteWriteRefusedError) ErrorCode() ErrorCode {
+	return ErrCodeRemoteWriteRefused
+}
+
+// FederationPolicyError is returned when a request is meant for another
+// datacenter and the local datacenter's federation policy for it doesn't
+// allow the request to be forwarded there.
+type FederationPolicyError struct {
+	// Local is the datacenter that refused the request.
+	Local string
+
+	// Datacenter is the datacenter the request was meant for.
+	Datacenter string
+
+	// Forwarding is the policy's forwarding setting.
+	Forwarding FederationForwarding
+
+	// Decommissioned is set if the datacenter has been decommissioned, in
+	// which case nothing is forwarded there.
+	Decommissioned bool
+}
+
+func (e *FederationPolicyError) Error() string {
+	if e.Decommissioned {
+		return fmt.Sprintf("%s: datacenter %q has decommissioned datacenter %q",
+			ErrCodeFederationPolicy, e.Local, e.Datacenter)
+	}
+	return fmt.Sprintf("%s: datacenter %q only forwards %q to datacenter %q",
+		ErrCodeFederationPolicy, e.Local, e.Forwarding, e.Datacenter)
+}
+
+func (e *FederationPolicyError) ErrorCode() ErrorCode {
+	return ErrCodeFederationPolicy
+}
+
+// UnsupportedFieldsError is returned by servers running with strict RPC
+// decoding when a request has fields the server doesn't know about, usually
+// because it came from a newer version.
+type UnsupportedFieldsError struct {
+	Fields []string
+}
+
+func (e *UnsupportedFieldsError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrCodeUnsupportedFields, strings.Join(e.Fields, ", "))
+}
+
+func (e *UnsupportedFieldsError) ErrorCode() ErrorCode {
+	return ErrCodeUnsupportedFields
+}
+
+// ServiceConstraintError is returned when a service registration doesn't
+// agree with an existing instance of the same service on a meta key that's
+// covered by a service constraint.
+type ServiceConstraintError struct {
+	// Service is the name of the constrained service.
+	Service string
+
+	// Key is the meta key the instances disagree on.
+	Key string
+
+	// Value is the value from the rejected registration.
+	Value string
+
+	// ConflictNode and ConflictServiceID identify the existing instance
+	// the registration conflicts with, and ConflictValue is its value.
+	ConflictNode      string
+	ConflictServiceID string
+	ConflictValue     string
+}
+
+func (e *ServiceConstraintError) Error() string {
+	return fmt.Sprintf("%s: service %q meta %q is %q but instance %q on node %q has %q",
+		ErrCodeServiceConstraint, e.Service, e.Key, e.Value,
+		e.ConflictServiceID, e.ConflictNode, e.ConflictValue)
+}
+
+func (e *ServiceConstraintError) ErrorCode() ErrorCode {
+	return ErrCodeServiceConstraint
+}
+
+// ServiceNameNotAllowedError is returned when a service is registered with a
+// new name that the service name policy doesn't allow.
+type ServiceNameNotAllowedError struct {
+	// Service is the name that was refused.
+	Service string
+}
+
+func (e *ServiceNameNotAllowedError) Error() string {
+	return fmt.Sprintf("%s: service %q isn't covered by the service name policy",
+		ErrCodeServiceNameNotAllowed, e.Service)
+}
+
+func (e *ServiceNameNotAllowedError) ErrorCode() ErrorCode {
+	return ErrCodeServiceNameNotAllowed
+}
+
+// NodeBlockedError is returned when a node is registered after it was
+// deregistered with a block.
+type NodeBlockedError struct {
+	// Node is the name of the node that was refused.
+	Node string
+}
+
+func (e *NodeBlockedError) Error() string {
+	return fmt.Sprintf("%s: node %q was deregistered and can't be registered again until the block is cleared",
+		ErrCodeNodeBlocked, e.Node)
+}
+
+func (e *NodeBlockedError) ErrorCode() ErrorCode {
+	return ErrCodeNodeBlocked
+}
+
+// QueryFrozenError is returned when a prepared query is changed while an
+// operator has frozen prepared queries.
+type QueryFrozenError struct {
+	// SetBy, SetAt, and Reason describe the freeze.
+	SetBy  string
+	SetAt  time.Time
+	Reason string
+}
+
+func (e *QueryFrozenError) Error() string {
+	return fmt.Sprintf("%s: set by %q at %s: %s", ErrCodeQueryFrozen,
+		e.SetBy, e.SetAt.Format(time.RFC3339), e.Reason)
+}
+
+func (e *QueryFrozenError) ErrorCode() ErrorCode {
+	return ErrCodeQueryFrozen
+}
+
+// SnapshotVersionError is returned when restoring a snapshot whose schema
+// version is outside the range this server knows how to read.
+type SnapshotVersionError struct {
+	// Version is the schema version of the snapshot.
+	Version int
+
+	// Min and Max are the schema versions this server supports.
+	Min int
+	Max int
+}
+
+func (e *SnapshotVersionError) Error() string {
+	return fmt.Sprintf("%s: snapshot has version %d but this server supports %d through %d",
+		ErrCodeSnapshotVersion, e.Version, e.Min, e.Max)
+}
+
+func (e *SnapshotVersionError) ErrorCode() ErrorCode {
+	return ErrCodeSnapshotVersion
+}
+
+// TooLargeError is returned for writes that are too big to send into Raft.
+type TooLargeError struct {
+	// Size is the encoded size of the write, in bytes, and Max is the
+	// limit.
+	Size int
+	Max  int
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("%s: size is %d bytes but the limit is %d bytes",
+		ErrCodeTooLarge, e.Size, e.Max)
+}
+
+func (e *TooLargeError) ErrorCode() ErrorCode {
+	return ErrCodeTooLarge
+}
+
+// KVFlagError is returned for KV writes that go against the reserved flags
+// of an entry, see KVFlagsReserved.
+type KVFlagError struct {
+	// Key is the key that was refused.
+	Key string
+
+	// Reason says which flag refused it.
+	Reason string
+}
+
+func (e *KVFlagError) Error() string {
+	return fmt.Sprintf("%s: key %q %s", ErrCodeKVFlag, e.Key, e.Reason)
+}
+
+func (e *KVFlagError) ErrorCode() ErrorCode {
+	return ErrCodeKVFlag
+}
+
+// TokenRateLimitError is returned for requests made with a token that's
+// over its rate limit.
+type TokenRateLimitError struct {
+	// Limit is the token's limit, in requests per second.
+	Limit float64
+}
+
+func (e *TokenRateLimitError) Error() string {
+	return fmt.Sprintf("%s: limit is %g requests per second", ErrCodeTokenRateLimited, e.Limit)
+}
+
+func (e *TokenRateLimitError) ErrorCode() ErrorCode {
+	return ErrCodeTokenRateLimited
+}
+
+// SessionLimitError is returned when creating a session would put a node or
+// token over its session limit.
+type SessionLimitError struct {
+	// Kind is what the limit applies to, either "node" or "token".
+	Kind string
+
+	// Limit is the most sessions allowed.
+	Limit int
+}
+
+func (e *SessionLimitError) Error() string {
+	return fmt.Sprintf("%s: limit is %d sessions per %s", ErrCodeSessionLimit, e.Limit, e.Kind)
+}
+
+func (e *SessionLimitError) ErrorCode() ErrorCode {
+	return ErrCodeSessionLimit
+}
+
+// KVQuotaError is returned for KV writes that would put a prefix over its
+// quota.
+type KVQuotaError struct {
+	// Prefix is the prefix of the quota that was hit.
+	Prefix string
+
+	// Limit is which limit was hit, either "keys" or "bytes".
+	Limit string
+
+	// Max is the quota's limit, and Usage is what it would have been
+	// after the write.
+	Max   int64
+	Usage int64
+}
+
+func (e *KVQuotaError) Error() string {
+	return fmt.Sprintf("%s: quota for prefix %q allows %d %s but the write would make it %d",
+		ErrCodeKVQuotaExceeded, e.Prefix, e.Max, e.Limit, e.Usage)
+}
+
+func (e *KVQuotaError) ErrorCode() ErrorCode {
+	return ErrCodeKVQuotaExceeded
+}
+
+// NoLeaderError is returned when there's no leader to handle a request. It
+// starts with the message of ErrNoLeader, and describes what the server that
+// gave up knew about the cluster at the time, so clients can tell an election
+// in progress from a server that's cut off and back off accordingly.
+type NoLeaderError struct {
+	// LastLeader is the address of the last leader the server knew of, or
+	// empty if it hasn't known of one since it started.
+	LastLeader string
+
+	// LastContact is how long it's been since the server last heard from
+	// a leader, or -1 if it never has.
+	LastContact time.Duration
+
+	// RaftState is the server's Raft state, such as "Candidate" while an
+	// election is going on.
+	RaftState string
+
+	// AliveServers is the number of servers in the datacenter, including
+	// this one, that the server sees as alive.
+	AliveServers int
+}
+
+// noLeaderErrorFormat is the format of a NoLeaderError's message after
+// ErrNoLeader's message, which ParseNoLeaderError reads back.
+const noLeaderErrorFormat = " (last_leader=%q last_contact=%s raft_state=%s alive_servers=%d)"
+
+func (e *NoLeaderError) Error() string {
+	return ErrNoLeader.Error() + fmt.Sprintf(noLeaderErrorFormat,
+		e.LastLeader, e.LastContact, e.RaftState, e.AliveServers)
+}
+
+// IsErrNoLeader returns true if the given error is ErrNoLeader or a
+// NoLeaderError, including one that came back from an RPC.
+func IsErrNoLeader(err error) bool {
+	return err != nil && strings.Contains(err.Error(), ErrNoLeader.Error())
+}
+
+// ParseNoLeaderError returns the details of a NoLeaderError, including one
+// that came back from an RPC. This returns false if the error isn't one, or
+// if it's a bare ErrNoLeader from an older server.
+func ParseNoLeaderError(err error) (*NoLeaderError, bool) {
+	if err == nil {
+		return nil, false
+	}
+	msg := err.Error()
+	i := strings.Index(msg, ErrNoLeader.Error())
+	if i < 0 {
+		return nil, false
+	}
+
+	var e NoLeaderError
+	var lastContact string
+	if _, err := fmt.Sscanf(msg[i+len(ErrNoLeader.Error()):], noLeaderErrorFormat,
+		&e.LastLeader, &lastContact, &e.RaftState, &e.AliveServers); err != nil {
+		return nil, false
+	}
+	d, err := time.ParseDuration(lastContact)
+	if err != nil {
+		return nil, false
+	}
+	e.LastContact = d
+	return &e, true
+}
+
 type MessageType uint8
 
 // RaftIndex is used to track the index used while creating
@@ -42,6 +440,24 @@ const (
 	TxnRequestType
 	AutopilotRequestType
 	AreaRequestType
+	ACLUsageRequestType
+	CentralCheckRequestType
+	QueryDefaultsRequestType
+	DatacenterAliasRequestType
+	ServiceConstraintRequestType
+	QueryFreezeRequestType
+	SigningKeyRequestType
+	RemoteWritePolicyRequestType
+	CatalogTombstoneRequestType // Only used for snapshot records
+	ServiceNamePolicyRequestType
+	NodeBlockRequestType
+	ServerEventRequestType
+	FederationPolicyRequestType
+	OrphanedLockRequestType
+	DeregisterBatchRequestType
+	OperatorIntentRequestType
+	KVQuotaRequestType
+	ClusterIDRequestType
 )
 
 const (
@@ -117,6 +533,18 @@ type RPCInfo interface {
 	IsRead() bool
 	AllowStaleRead() bool
 	ACLToken() string
+	RequestTrace() (string, int)
+	SetRequestTrace(id string, hops int)
+	ResolvedDatacenter() string
+	SetResolvedDatacenter(dc string)
+}
+
+// DeadlineRequest is implemented by requests that can carry a timeout from
+// the caller, which is only writes for now.
+type DeadlineRequest interface {
+	StartDeadline(now time.Time)
+	Deadline() time.Time
+	SetRequestTimeout(timeout time.Duration)
 }
 
 // QueryOptions is used to specify various flags for read queries
@@ -139,6 +567,27 @@ type QueryOptions struct {
 	// If set, the leader must verify leadership prior to
 	// servicing the request. Prevents a stale read.
 	RequireConsistent bool
+
+	// ConsistencyToken is a token from the reply to an earlier write, or
+	// from Status.ConsistencyToken after one. If set, the server waits
+	// until it has caught up with that write before answering, up to
+	// MaxQueryTime, so a stale read from a follower still sees the
+	// caller's own writes.
+	ConsistencyToken string
+
+	// RequestID is used to correlate the request in the logs of each
+	// server that handles it. If not provided, the first server to see
+	// the request generates one.
+	RequestID string
+
+	// ForwardHops is the number of times the request has been forwarded
+	// between servers. This is used to catch forwarding loops.
+	ForwardHops int
+
+	// ResolvedDC is the canonical name of the datacenter the request is
+	// for, if the request gave an alias. Servers use this in place of the
+	// request's datacenter.
+	ResolvedDC string
 }
 
 // QueryOption only applies to reads, so always true
@@ -154,10 +603,69 @@ func (q QueryOptions) ACLToken() string {
 	return q.Token
 }
 
+func (q QueryOptions) RequestTrace() (string, int) {
+	return q.RequestID, q.ForwardHops
+}
+
+func (q *QueryOptions) SetRequestTrace(id string, hops int) {
+	q.RequestID = id
+	q.ForwardHops = hops
+}
+
+func (q QueryOptions) ResolvedDatacenter() string {
+	return q.ResolvedDC
+}
+
+func (q *QueryOptions) SetResolvedDatacenter(dc string) {
+	q.ResolvedDC = dc
+}
+
+// GetQueryOptions returns the query options so that they can be adjusted by
+// the RPC layer, see QueryOptionsHolder.
+func (q *QueryOptions) GetQueryOptions() *QueryOptions {
+	return q
+}
+
+// QueryOptionsHolder is implemented by read requests, which all embed
+// QueryOptions.
+type QueryOptionsHolder interface {
+	GetQueryOptions() *QueryOptions
+}
+
+// QuerySourceHolder is implemented by requests that can sort their results
+// by distance from a source node.
+type QuerySourceHolder interface {
+	GetQuerySource() *QuerySource
+}
+
 type WriteRequest struct {
 	// Token is the ACL token ID. If not provided, the 'anonymous'
 	// token is assumed for backwards compatibility.
 	Token string
+
+	// RequestID is used to correlate the request in the logs of each
+	// server that handles it. If not provided, the first server to see
+	// the request generates one.
+	RequestID string
+
+	// ForwardHops is the number of times the request has been forwarded
+	// between servers. This is used to catch forwarding loops.
+	ForwardHops int
+
+	// ResolvedDC is the canonical name of the datacenter the request is
+	// for, if the request gave an alias. Servers use this in place of the
+	// request's datacenter.
+	ResolvedDC string
+
+	// RequestTimeout is how long the caller is willing to wait for the
+	// write. If it's set, a write that hasn't been handed to Raft by then
+	// is abandoned with ErrDeadlineExceeded. Servers that forward the
+	// request pass on whatever time is left.
+	RequestTimeout time.Duration
+
+	// deadline is when RequestTimeout runs out on the server that's
+	// handling the request. It's not sent along with the request.
+	deadline time.Time
 }
 
 // WriteRequest only applies to writes, always false
@@ -173,6 +681,115 @@ func (w WriteRequest) ACLToken() string {
 	return w.Token
 }
 
+func (w WriteRequest) RequestTrace() (string, int) {
+	return w.RequestID, w.ForwardHops
+}
+
+func (w *WriteRequest) SetRequestTrace(id string, hops int) {
+	w.RequestID = id
+	w.ForwardHops = hops
+}
+
+func (w WriteRequest) ResolvedDatacenter() string {
+	return w.ResolvedDC
+}
+
+func (w *WriteRequest) SetResolvedDatacenter(dc string) {
+	w.ResolvedDC = dc
+}
+
+// StartDeadline works out when the request's timeout runs out, counting from
+// the given time. It does nothing if there's no timeout or it's already been
+// started.
+func (w *WriteRequest) StartDeadline(now time.Time) {
+	if w.RequestTimeout > 0 && w.deadline.IsZero() {
+		w.deadline = now.Add(w.RequestTimeout)
+	}
+}
+
+// Deadline returns when the request's timeout runs out, or zero if it
+// doesn't have one.
+func (w *WriteRequest) Deadline() time.Time {
+	return w.deadline
+}
+
+// SetRequestTimeout is used to pass the time that's left on the request
+// along when it's forwarded.
+func (w *WriteRequest) SetRequestTimeout(timeout time.Duration) {
+	w.RequestTimeout = timeout
+}
+
+// ReplyMeta describes the server that answered a request. This is filled in
+// centrally by the RPC layer for every reply that carries it, so endpoints
+// don't need to do anything to populate it.
+type ReplyMeta struct {
+	// Server is the node name of the server that answered the request.
+	Server string
+
+	// ServerDatacenter is the datacenter of the server that answered the
+	// request.
+	ServerDatacenter string
+
+	// ServerIsLeader is true if the server that answered the request was
+	// the leader at the time.
+	ServerIsLeader bool
+
+	// Forwarded is true if the server that answered the request passed it
+	// on to another server, such as the leader or a server in another
+	// datacenter, to be handled.
+	Forwarded bool
+
+	// ForwardedTo is the node name of the server the request was
+	// forwarded to, if any.
+	ForwardedTo string
+
+	// ResolvedDatacenter is the canonical name of the datacenter that
+	// handled the request, if the request used an alias for it.
+	ResolvedDatacenter string
+
+	// ServiceTime is how long the server took to answer the request,
+	// including any time spent blocking or forwarding.
+	ServiceTime time.Duration
+}
+
+// GetReplyMeta returns the reply metadata, so it can be filled in without
+// knowing the type of the reply.
+func (m *ReplyMeta) GetReplyMeta() *ReplyMeta {
+	return m
+}
+
+// ReplyMetaHolder is implemented by replies that carry a ReplyMeta.
+type ReplyMetaHolder interface {
+	GetReplyMeta() *ReplyMeta
+}
+
+// WriteMeta allows a write response to include potentially useful metadata
+// about the write. Only writes that have a structured reply can carry it.
+type WriteMeta struct {
+	// ConsistencyToken can be passed along with later reads so they're
+	// sure to see this write, even if they're served by a follower. It's
+	// opaque to callers. Writes without a WriteMeta can get a token from
+	// Status.ConsistencyToken instead.
+	ConsistencyToken string
+
+	// RequestID is the ID used to trace the request through the servers
+	// that handled it.
+	RequestID string
+
+	ReplyMeta
+}
+
+// GetWriteMeta returns the write metadata, so it can be filled in without
+// knowing the type of the reply.
+func (m *WriteMeta) GetWriteMeta() *WriteMeta {
+	return m
+}
+
+// WriteMetaHolder is implemented by replies that carry a WriteMeta.
+type WriteMetaHolder interface {
+	GetWriteMeta() *WriteMeta
+}
+
 // QueryMeta allows a query response to include potentially
 // useful metadata about a query
 type QueryMeta struct {
@@ -186,6 +803,34 @@ type QueryMeta struct {
 
 	// Used to indicate if there is a known leader node
 	KnownLeader bool
+
+	// LastLeader, RaftState, and AliveServers describe what the server
+	// that answered knew about the cluster, see NoLeaderError. They help
+	// judge how far to trust a stale read.
+	LastLeader   string
+	RaftState    string
+	AliveServers int
+
+	// RequestID is the ID used to trace the request through the servers
+	// that handled it.
+	RequestID string
+
+	// Truncated is set if the results were cut short because they went
+	// over the server's result size limit. Index is still the index of
+	// the full result set, so blocking on it works as usual.
+	Truncated bool
+
+	// Omitted is the number of results that were left off when Truncated
+	// is set.
+	Omitted int
+
+	// Cancelled is set if an operator cancelled the blocking query, so it
+	// returned early with the results it had at the time. Index may not
+	// have moved past the requested index.
+	Cancelled bool
+
+	// ReplyMeta describes the server that answered the query.
+	ReplyMeta
 }
 
 // RegisterRequest is used for the Catalog.Register endpoint
@@ -209,6 +854,12 @@ type RegisterRequest struct {
 	// node portion of this update will not apply.
 	SkipNodeUpdate bool
 
+	// Replace supersedes any existing instance of the service with the same
+	// ID on this node, instead of updating it in place. The old instance and
+	// its checks are removed and the new one is added in the same
+	// transaction, so watchers see a single change from one to the other.
+	Replace bool
+
 	WriteRequest
 }
 
@@ -251,9 +902,31 @@ type DeregisterRequest struct {
 	Node       string
 	ServiceID  string
 	CheckID    types.CheckID
+
+	// Block keeps the node from being registered again once it's been
+	// deregistered, which stops the agent on a decommissioned node that's
+	// still running from bringing it back. The block lasts for BlockFor,
+	// or until it's cleared if that's zero. This only applies when the
+	// whole node is deregistered.
+	Block    bool
+	BlockFor time.Duration
+
 	WriteRequest
 }
 
+// DeregisterBatchRequest is used by the leader to deregister a batch of nodes
+// that Serf has reaped in a single Raft entry. Nodes whose Serf health check
+// is passing by the time it's applied have come back, and are left alone.
+type DeregisterBatchRequest struct {
+	Datacenter string
+	Nodes      []string
+	WriteRequest
+}
+
+func (r *DeregisterBatchRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
 func (r *DeregisterRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
@@ -271,6 +944,20 @@ type DCSpecificRequest struct {
 	Datacenter      string
 	NodeMetaFilters map[string]string
 	Source          QuerySource
+
+	// ServiceList asks Catalog.ListServices for a list of services sorted
+	// by name that can be paged through with Limit and After, instead of
+	// a map of them all. Other endpoints ignore these fields.
+	ServiceList bool
+
+	// Limit is the most services to return in a page. Zero means there's
+	// no limit.
+	Limit int
+
+	// After is the name of the last service on the previous page, so the
+	// page starts with the service after it.
+	After string
+
 	QueryOptions
 }
 
@@ -278,6 +965,10 @@ func (r *DCSpecificRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+func (r *DCSpecificRequest) GetQuerySource() *QuerySource {
+	return &r.Source
+}
+
 // ServiceSpecificRequest is used to query about a specific service
 type ServiceSpecificRequest struct {
 	Datacenter      string
@@ -285,7 +976,25 @@ type ServiceSpecificRequest struct {
 	ServiceName     string
 	ServiceTag      string
 	TagFilter       bool // Controls tag filtering
-	Source          QuerySource
+
+	// ServiceAddress, if set, looks up the instances of any service that
+	// advertise this address, either as their service address or as the
+	// address of their node if they don't have one. ServiceName is
+	// optional with this, and narrows the results to one service.
+	// Only supported by Health.ServiceNodes.
+	ServiceAddress string
+
+	// ServiceKind, if set, looks up the instances of any service of this
+	// kind. ServiceName and the tag filter are optional with this, and
+	// narrow the results. Typical services have no kind, so they can't be
+	// looked up this way. Only supported by Catalog.ServiceNodes.
+	ServiceKind string
+
+	// Signed asks for the result to be signed with the cluster's signing
+	// key, so it can be checked after being passed through caches.
+	Signed bool
+
+	Source QuerySource
 	QueryOptions
 }
 
@@ -293,6 +1002,10 @@ func (r *ServiceSpecificRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+func (r *ServiceSpecificRequest) GetQuerySource() *QuerySource {
+	return &r.Source
+}
+
 // NodeSpecificRequest is used to request the information about a single node
 type NodeSpecificRequest struct {
 	Datacenter string
@@ -304,6 +1017,60 @@ func (r *NodeSpecificRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// ReverseLookupRequest is used to find everything in the catalog that refers
+// to a node name or an IP address.
+type ReverseLookupRequest struct {
+	Datacenter string
+
+	// Query is the node name or IP address to look up.
+	Query string
+	QueryOptions
+}
+
+func (r *ReverseLookupRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// CatalogDiffRequest is used by an agent to find out what's changed in the
+// catalog for its node since it last synced, such as after it's been cut off
+// from the servers for a while.
+type CatalogDiffRequest struct {
+	Datacenter string
+	Node       string
+
+	// Indexes has the index of each catalog table the agent last saw, by
+	// table name. The "services" and "checks" tables are supported.
+	Indexes map[string]uint64
+	QueryOptions
+}
+
+func (r *CatalogDiffRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// These are the sub-queries that can be made by a ConsistentReadRequest.
+const (
+	ConsistentReadNodes       = "nodes"
+	ConsistentReadServices    = "services"
+	ConsistentReadChecks      = "checks"
+	ConsistentReadCoordinates = "coordinates"
+)
+
+// ConsistentReadRequest is used to read several catalog tables at once, so
+// the results all come from the same point in time.
+type ConsistentReadRequest struct {
+	Datacenter string
+
+	// Queries are the names of the sub-queries to run, such as "nodes" or
+	// "checks". Each one can only be given once.
+	Queries []string
+	QueryOptions
+}
+
+func (r *ConsistentReadRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
 // ChecksInStateRequest is used to query for nodes in a state
 type ChecksInStateRequest struct {
 	Datacenter      string
@@ -317,6 +1084,10 @@ func (r *ChecksInStateRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+func (r *ChecksInStateRequest) GetQuerySource() *QuerySource {
+	return &r.Source
+}
+
 // Used to return information about a node
 type Node struct {
 	ID              types.NodeID
@@ -329,10 +1100,10 @@ type Node struct {
 }
 type Nodes []*Node
 
-// ValidateMeta validates a set of key/value pairs from the agent config
+// ValidateMeta validates a set of node or service metadata key/value pairs
 func ValidateMetadata(meta map[string]string) error {
 	if len(meta) > metaMaxKeyPairs {
-		return fmt.Errorf("Node metadata cannot contain more than %d key/value pairs", metaMaxKeyPairs)
+		return fmt.Errorf("Metadata cannot contain more than %d key/value pairs", metaMaxKeyPairs)
 	}
 
 	for key, value := range meta {
@@ -395,6 +1166,8 @@ type ServiceNode struct {
 	ServiceAddress           string
 	ServicePort              int
 	ServiceEnableTagOverride bool
+	ServiceMeta              map[string]string
+	ServiceKind              string
 
 	RaftIndex
 }
@@ -404,6 +1177,13 @@ type ServiceNode struct {
 func (s *ServiceNode) PartialClone() *ServiceNode {
 	tags := make([]string, len(s.ServiceTags))
 	copy(tags, s.ServiceTags)
+	var meta map[string]string
+	if s.ServiceMeta != nil {
+		meta = make(map[string]string, len(s.ServiceMeta))
+		for k, v := range s.ServiceMeta {
+			meta[k] = v
+		}
+	}
 
 	return &ServiceNode{
 		// Skip ID, see above.
@@ -416,6 +1196,8 @@ func (s *ServiceNode) PartialClone() *ServiceNode {
 		ServiceAddress:           s.ServiceAddress,
 		ServicePort:              s.ServicePort,
 		ServiceEnableTagOverride: s.ServiceEnableTagOverride,
+		ServiceMeta:              meta,
+		ServiceKind:              s.ServiceKind,
 		RaftIndex: RaftIndex{
 			CreateIndex: s.CreateIndex,
 			ModifyIndex: s.ModifyIndex,
@@ -432,6 +1214,8 @@ func (s *ServiceNode) ToNodeService() *NodeService {
 		Address:           s.ServiceAddress,
 		Port:              s.ServicePort,
 		EnableTagOverride: s.ServiceEnableTagOverride,
+		Meta:              s.ServiceMeta,
+		Kind:              s.ServiceKind,
 		RaftIndex: RaftIndex{
 			CreateIndex: s.CreateIndex,
 			ModifyIndex: s.ModifyIndex,
@@ -441,6 +1225,27 @@ func (s *ServiceNode) ToNodeService() *NodeService {
 
 type ServiceNodes []*ServiceNode
 
+const (
+	// ServiceKindTypical is the kind of an ordinary service, which is the
+	// default.
+	ServiceKindTypical = ""
+
+	// ServiceKindLoadBalancer is the kind of a service that's a load
+	// balancer in front of other services.
+	ServiceKindLoadBalancer = "load-balancer"
+
+	// ServiceKindMeshProxy is the kind of a service that's a proxy for
+	// another service in a service mesh.
+	ServiceKindMeshProxy = "mesh-proxy"
+)
+
+// BuiltinServiceKinds are the kinds of service that can always be
+// registered. Servers can be configured to allow others.
+var BuiltinServiceKinds = []string{
+	ServiceKindLoadBalancer,
+	ServiceKindMeshProxy,
+}
+
 // NodeService is a service provided by a node
 type NodeService struct {
 	ID                string
@@ -449,6 +1254,11 @@ type NodeService struct {
 	Address           string
 	Port              int
 	EnableTagOverride bool
+	Meta              map[string]string
+
+	// Kind is the kind of service this is, such as a load balancer. It's
+	// empty for a typical service.
+	Kind string
 
 	RaftIndex
 }
@@ -463,7 +1273,9 @@ func (s *NodeService) IsSame(other *NodeService) bool {
 		!reflect.DeepEqual(s.Tags, other.Tags) ||
 		s.Address != other.Address ||
 		s.Port != other.Port ||
-		s.EnableTagOverride != other.EnableTagOverride {
+		s.EnableTagOverride != other.EnableTagOverride ||
+		!reflect.DeepEqual(s.Meta, other.Meta) ||
+		s.Kind != other.Kind {
 		return false
 	}
 
@@ -483,6 +1295,8 @@ func (s *NodeService) ToServiceNode(node string) *ServiceNode {
 		ServiceAddress:           s.Address,
 		ServicePort:              s.Port,
 		ServiceEnableTagOverride: s.EnableTagOverride,
+		ServiceMeta:              s.Meta,
+		ServiceKind:              s.Kind,
 		RaftIndex: RaftIndex{
 			CreateIndex: s.CreateIndex,
 			ModifyIndex: s.ModifyIndex,
@@ -601,11 +1415,80 @@ type IndexedNodes struct {
 
 type IndexedServices struct {
 	Services Services
+
+	// ServiceList has a page of services sorted by name, if the request
+	// asked for a list. Services is empty in that case.
+	ServiceList []ServiceListEntry
+
+	// NextAfter is set if there are more services after this page. It
+	// should be given as After to get the next page.
+	NextAfter string
+
+	QueryMeta
+}
+
+// ConsistentReadResults has the results of the sub-queries from a
+// ConsistentReadRequest. Only the ones that were asked for are filled in.
+type ConsistentReadResults struct {
+	Nodes       Nodes
+	Services    Services
+	Checks      HealthChecks
+	Coordinates Coordinates
+}
+
+// IndexedConsistentRead has the results of a ConsistentReadRequest. The
+// index is the highest index of all the tables that were read.
+type IndexedConsistentRead struct {
+	Results ConsistentReadResults
+	QueryMeta
+}
+
+// ServiceListEntry is a service and all the tags its instances have.
+type ServiceListEntry struct {
+	Name string
+	Tags []string
+}
+
+// ServiceSummary sums up the instances of a service across the catalog.
+// Each instance's health is the worst of its service checks and the checks
+// on its node, and an instance with no checks counts as passing.
+type ServiceSummary struct {
+	Name string
+
+	// Tags holds the distinct tags across all the instances.
+	Tags []string
+
+	// Instances is the total number of instances, which is the sum of the
+	// counts by health below.
+	Instances int
+	Passing   int
+	Warning   int
+	Critical  int
+
+	// Kinds has the number of instances of each kind, for instances that
+	// aren't typical services. It's empty if they all are.
+	Kinds map[string]int
+}
+
+// ServiceSummaries is a list of service summaries, sorted by name.
+type ServiceSummaries []*ServiceSummary
+
+func (s ServiceSummaries) Len() int           { return len(s) }
+func (s ServiceSummaries) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s ServiceSummaries) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type IndexedServiceSummaries struct {
+	Services ServiceSummaries
 	QueryMeta
 }
 
 type IndexedServiceNodes struct {
 	ServiceNodes ServiceNodes
+
+	// Signature covers the service nodes and the index, if the request
+	// asked for a signed result.
+	Signature *ResultSignature
+
 	QueryMeta
 }
 
@@ -614,6 +1497,34 @@ type IndexedNodeServices struct {
 	QueryMeta
 }
 
+// NodeCatalogDiff has everything that's changed in the catalog for a node
+// since a set of table indexes.
+type NodeCatalogDiff struct {
+	// Services and Checks have the entries that were added or modified.
+	Services []*NodeService
+	Checks   HealthChecks
+
+	// DeletedServices and DeletedChecks have the IDs of the entries that
+	// were deleted.
+	DeletedServices []string
+	DeletedChecks   []types.CheckID
+
+	// Indexes has the current index of each table, to send along with
+	// the next request.
+	Indexes map[string]uint64
+
+	// FullResync is set if the changes couldn't be worked out, or there
+	// were too many of them, and the node has to read everything again.
+	// None of the other fields are set when this is.
+	FullResync bool
+}
+
+type IndexedNodeCatalogDiff struct {
+	Node string
+	Diff NodeCatalogDiff
+	QueryMeta
+}
+
 type IndexedHealthChecks struct {
 	HealthChecks HealthChecks
 	QueryMeta
@@ -621,6 +1532,11 @@ type IndexedHealthChecks struct {
 
 type IndexedCheckServiceNodes struct {
 	Nodes CheckServiceNodes
+
+	// Signature covers the nodes and the index, if the request asked for
+	// a signed result.
+	Signature *ResultSignature
+
 	QueryMeta
 }
 
@@ -629,6 +1545,40 @@ type IndexedNodeDump struct {
 	QueryMeta
 }
 
+const (
+	// These are the ways a node can match a reverse lookup. Tagged and
+	// service addresses are qualified with the tag or the service ID, like
+	// "tagged_address:wan" or "service_address:redis1".
+	ReverseLookupNodeName       = "node"
+	ReverseLookupAddress        = "address"
+	ReverseLookupTaggedAddress  = "tagged_address"
+	ReverseLookupServiceAddress = "service_address"
+)
+
+// ReverseLookupMatch is a node that matched a reverse lookup, along with
+// everything in the catalog that's tied to it.
+type ReverseLookupMatch struct {
+	Node *Node
+
+	// MatchedBy lists every way the node matched, so a node that matched
+	// only through one of its services' addresses can be told apart from
+	// one that has the address itself.
+	MatchedBy []string
+
+	Services []*NodeService
+	Checks   HealthChecks
+	Sessions Sessions
+
+	// Locks holds the keys locked by the node's sessions. The values are
+	// left out.
+	Locks DirEntries
+}
+
+type IndexedReverseLookup struct {
+	Matches []*ReverseLookupMatch
+	QueryMeta
+}
+
 // DirEntry is used to represent a directory entry. This is
 // used for values in our Key-Value store.
 type DirEntry struct {
@@ -638,17 +1588,31 @@ type DirEntry struct {
 	Value     []byte
 	Session   string `json:",omitempty"`
 
+	// CreatedBy and ModifiedBy are hashes of the tokens that created and
+	// last modified the entry, or "anonymous" for the anonymous token, and
+	// CreateTime and ModifyTime say when. These are
+	// only recorded when the servers have KV metadata turned on. The times
+	// come from the leader's clock, so they're only advisory.
+	CreatedBy  string     `json:",omitempty"`
+	ModifiedBy string     `json:",omitempty"`
+	CreateTime *time.Time `json:",omitempty"`
+	ModifyTime *time.Time `json:",omitempty"`
+
 	RaftIndex
 }
 
 // Returns a clone of the given directory entry.
 func (d *DirEntry) Clone() *DirEntry {
 	return &DirEntry{
-		LockIndex: d.LockIndex,
-		Key:       d.Key,
-		Flags:     d.Flags,
-		Value:     d.Value,
-		Session:   d.Session,
+		LockIndex:  d.LockIndex,
+		Key:        d.Key,
+		Flags:      d.Flags,
+		Value:      d.Value,
+		Session:    d.Session,
+		CreatedBy:  d.CreatedBy,
+		ModifiedBy: d.ModifiedBy,
+		CreateTime: d.CreateTime,
+		ModifyTime: d.ModifyTime,
 		RaftIndex: RaftIndex{
 			CreateIndex: d.CreateIndex,
 			ModifyIndex: d.ModifyIndex,
@@ -658,6 +1622,25 @@ func (d *DirEntry) Clone() *DirEntry {
 
 type DirEntries []*DirEntry
 
+// The top byte of a KV entry's Flags is reserved for flags the servers act
+// on. Applications are free to use the rest however they like. The reserved
+// bits the servers don't know about are stored like any other, but may gain
+// a meaning later. These are enforced by the leader before updates go into
+// Raft, and a KVSRequest or TxnRequest with OverrideFlags gets around them,
+// which is how a flag gets cleared again.
+const (
+	// KVFlagsReserved masks the reserved bits.
+	KVFlagsReserved uint64 = 0xff << 56
+
+	// KVFlagImmutable refuses any change to the entry, including deleting
+	// it. It can be set on an existing entry.
+	KVFlagImmutable uint64 = 1 << 63
+
+	// KVFlagWriteOnce is like KVFlagImmutable, but can only be set when the
+	// entry is created.
+	KVFlagWriteOnce uint64 = 1 << 62
+)
+
 type KVSOp string
 
 const (
@@ -675,6 +1658,13 @@ const (
 	KVSGetTree      = "get-tree"      // Read all keys with the given prefix during the transaction.
 	KVSCheckSession = "check-session" // Check the session holds the key.
 	KVSCheckIndex   = "check-index"   // Check the modify index of the key.
+
+	// These are aliases for lock and unlock that make it clearer in a
+	// transaction that a session is being used to guard other operations.
+	// The Txn endpoint turns them into lock and unlock before they go into
+	// Raft, so servers that don't know about them can still apply them.
+	KVSTxnLock   = "kv-lock"   // Acquire a key with a session.
+	KVSTxnUnlock = "kv-unlock" // Release a key held by a session.
 )
 
 // IsWrite returns true if the given operation alters the state store.
@@ -693,6 +1683,23 @@ type KVSRequest struct {
 	Datacenter string
 	Op         KVSOp    // Which operation are we performing
 	DirEnt     DirEntry // Which directory entry
+
+	// SkipTombstones is used with KVSDeleteTree to leave a single tombstone
+	// for the whole prefix instead of one for each deleted key. This needs
+	// operator write privileges.
+	SkipTombstones bool
+
+	// MaxTombstones is used with KVSDeleteTree to leave a single tombstone
+	// for the whole prefix if more than this many keys are deleted. This is
+	// set by the leader from its config, so all the servers do the same
+	// thing. Zero means there's no limit.
+	MaxTombstones int
+
+	// OverrideFlags lets the update go through even if it goes against the
+	// reserved flags of the entries it touches, which is how a flag gets
+	// cleared. This needs a management token when ACLs are enabled.
+	OverrideFlags bool
+
 	WriteRequest
 }
 
@@ -700,6 +1707,19 @@ func (r *KVSRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// ApplyBackoff is returned by Status.ApplyBackoff, and tells agents whether
+// to slow down the catalog writes they send during anti-entropy syncs.
+type ApplyBackoff struct {
+	// Backoff is an advisory hint that the leader is overloaded, and that
+	// the caller should stretch out how often it sends catalog writes by
+	// about this much. It's zero when the leader isn't overloaded.
+	Backoff time.Duration
+
+	// ApplyQueueDepth is the number of Raft applies the leader had in
+	// flight.
+	ApplyQueueDepth int
+}
+
 // KeyRequest is used to request a key, or key prefix
 type KeyRequest struct {
 	Datacenter string
@@ -711,6 +1731,55 @@ func (r *KeyRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// KeysRequest is used to request several exact keys at once.
+type KeysRequest struct {
+	Datacenter string
+	Keys       []string
+	QueryOptions
+}
+
+func (r *KeysRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// KeySnapshotRequest is used to read a key, or key prefix, as it was in one of
+// the Raft snapshots retained by a server. If SnapshotID is blank, the
+// retained snapshots are listed instead.
+type KeySnapshotRequest struct {
+	Datacenter string
+	SnapshotID string
+	Key        string
+
+	// Prefix reads all the keys under Key, instead of just the one.
+	Prefix bool
+	QueryOptions
+}
+
+func (r *KeySnapshotRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// RaftSnapshotInfo describes a Raft snapshot retained by a server.
+type RaftSnapshotInfo struct {
+	ID    string
+	Index uint64
+	Term  uint64
+	Size  int64
+
+	// Time is when the snapshot was taken, if it's known.
+	Time time.Time
+}
+
+// KeySnapshotResponse is the result of a KeySnapshotRequest. Snapshot is only
+// set when a snapshot was read, in which case the index in the QueryMeta is
+// the index of the snapshot.
+type KeySnapshotResponse struct {
+	Snapshots []RaftSnapshotInfo
+	Snapshot  *RaftSnapshotInfo
+	Entries   DirEntries
+	QueryMeta
+}
+
 // KeyListRequest is used to list keys
 type KeyListRequest struct {
 	Datacenter string
@@ -756,10 +1825,27 @@ type Session struct {
 	Behavior  SessionBehavior // What to do when session is invalidated
 	TTL       string
 
+	// ServiceChecks ties the session to checks belonging to specific
+	// service instances on the session's node, so the session can be
+	// invalidated when just that service fails.
+	ServiceChecks []SessionServiceCheck
+
+	// TokenHash is a hash of the ACL token the session was created with,
+	// which is used to enforce per-token session limits. This is set by
+	// the servers, and is empty for the anonymous token.
+	TokenHash string
+
 	RaftIndex
 }
 type Sessions []*Session
 
+// SessionServiceCheck refers to a health check registered for a service
+// instance on a session's node.
+type SessionServiceCheck struct {
+	ID        types.CheckID
+	ServiceID string
+}
+
 type SessionOp string
 
 const (
@@ -772,6 +1858,14 @@ type SessionRequest struct {
 	Datacenter string
 	Op         SessionOp // Which operation are we performing
 	Session    Session   // Which session
+
+	// NodeSessionLimit and TokenSessionLimit are the most sessions the
+	// session's node and token can have for a create, or zero for no
+	// limit. The leader fills them in, so every server applies the create
+	// with the same limits.
+	NodeSessionLimit  int
+	TokenSessionLimit int
+
 	WriteRequest
 }
 
@@ -779,6 +1873,17 @@ func (r *SessionRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// SessionCreateReply is the reply to a session create made with
+// Session.Create.
+type SessionCreateReply struct {
+	// ID is the ID of the session.
+	ID string
+
+	// ExpiresAt is when the leader will expire the session unless it's
+	// renewed, including any jitter. It's zero for sessions without a TTL.
+	ExpiresAt time.Time
+}
+
 // SessionSpecificRequest is used to request a session by ID
 type SessionSpecificRequest struct {
 	Datacenter string
@@ -792,6 +1897,11 @@ func (r *SessionSpecificRequest) RequestDatacenter() string {
 
 type IndexedSessions struct {
 	Sessions Sessions
+
+	// ExpiresAt is set by Session.Renew to when the leader will expire the
+	// session unless it's renewed again, including any jitter.
+	ExpiresAt time.Time
+
 	QueryMeta
 }
 
@@ -802,6 +1912,38 @@ type ACL struct {
 	Type  string
 	Rules string
 
+	// Datacenters limits the datacenters the token's rules apply in. In
+	// any other datacenter the token only gets the default policy. If this
+	// is empty the rules apply everywhere.
+	Datacenters []string
+
+	// NodeIdentity optionally binds the token to a single node, given as
+	// "<node>/<datacenter>". A bound token can only register and deregister
+	// things for that node, regardless of its rules.
+	NodeIdentity string
+
+	// RateLimit is the most requests per second that each server will
+	// handle for the token. Requests over the limit are rejected with a
+	// TokenRateLimitError. Zero means there's no limit.
+	RateLimit float64
+
+	// SessionLimit is the most sessions that can exist at once in each
+	// datacenter that were created with the token. Creates over the limit
+	// are rejected with a SessionLimitError. Zero means there's no limit.
+	SessionLimit int
+
+	// ShadowRules are rules being tried out for the token. They're checked
+	// along with Rules, and anything they would deny that Rules allows is
+	// logged and reported, but Rules still decides. The ACL.EnforceShadow
+	// endpoint replaces Rules with these once they're known to be safe.
+	ShadowRules string
+
+	// LastUsed and Uses track when the token was last used, rounded to
+	// the minute, and how many times it has been used. These are
+	// maintained by the servers and are ignored when an ACL is set.
+	LastUsed time.Time
+	Uses     uint64
+
 	RaftIndex
 }
 type ACLs []*ACL
@@ -822,13 +1964,33 @@ func (a *ACL) IsSame(other *ACL) bool {
 	if a.ID != other.ID ||
 		a.Name != other.Name ||
 		a.Type != other.Type ||
-		a.Rules != other.Rules {
+		a.Rules != other.Rules ||
+		a.NodeIdentity != other.NodeIdentity ||
+		a.RateLimit != other.RateLimit ||
+		a.SessionLimit != other.SessionLimit ||
+		a.ShadowRules != other.ShadowRules ||
+		len(a.Datacenters) != len(other.Datacenters) {
 		return false
 	}
+	for i, dc := range a.Datacenters {
+		if other.Datacenters[i] != dc {
+			return false
+		}
+	}
 
 	return true
 }
 
+// ParseNodeIdentity splits an ACL's NodeIdentity into its node and
+// datacenter.
+func ParseNodeIdentity(identity string) (string, string, error) {
+	i := strings.LastIndex(identity, "/")
+	if i <= 0 || i == len(identity)-1 {
+		return "", "", fmt.Errorf("Invalid node identity %q: must be <node>/<datacenter>", identity)
+	}
+	return identity[:i], identity[i+1:], nil
+}
+
 // ACLRequest is used to create, update or delete an ACL
 type ACLRequest struct {
 	Datacenter string
@@ -844,6 +2006,33 @@ func (r *ACLRequest) RequestDatacenter() string {
 // ACLRequests is a list of ACL change requests.
 type ACLRequests []*ACLRequest
 
+// ACLUsage records the usage of a token over some period of time.
+type ACLUsage struct {
+	// ID is the token, or a hash of it when the usage is being reported
+	// to the ACL datacenter by ACL.ReportUsage.
+	ID string
+
+	// LastUsed is when the token was last used, and Uses is how many
+	// times it was used.
+	LastUsed time.Time
+	Uses     uint64
+}
+
+// ACLUsages is a list of token usage records.
+type ACLUsages []*ACLUsage
+
+// ACLUsageRequest is used to report token usage so it can be added to the
+// totals kept in the ACL datacenter.
+type ACLUsageRequest struct {
+	Datacenter string
+	Usage      ACLUsages
+	WriteRequest
+}
+
+func (r *ACLUsageRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
 // ACLSpecificRequest is used to request an ACL by ID
 type ACLSpecificRequest struct {
 	Datacenter string
@@ -855,6 +2044,18 @@ func (r *ACLSpecificRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// ACLEnforceShadowRequest is used to replace an ACL's rules with its shadow
+// rules.
+type ACLEnforceShadowRequest struct {
+	Datacenter string
+	ACL        string
+	WriteRequest
+}
+
+func (r *ACLEnforceShadowRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
 // ACLPolicyRequest is used to request an ACL by ID, conditionally
 // filtering on an ID
 type ACLPolicyRequest struct {
@@ -878,6 +2079,141 @@ type ACLPolicy struct {
 	Parent string
 	Policy *acl.Policy
 	TTL    time.Duration
+
+	// Datacenters holds the datacenters the policy applies in, or is empty
+	// if it applies everywhere. See ACL.
+	Datacenters []string
+
+	// NodeIdentity is the node the token is bound to, if any. See ACL.
+	NodeIdentity string
+
+	// RateLimit is the token's rate limit, if any. See ACL.
+	RateLimit float64
+
+	// SessionLimit is the token's session limit, if any. See ACL.
+	SessionLimit int
+
+	// ShadowPolicy is the policy for the token's shadow rules, if it has
+	// any. See ACL.
+	ShadowPolicy *acl.Policy
+
+	// ParentDefaults are the ACL datacenter's per-type default policies,
+	// which override the allow and deny parents for those types. See
+	// acl.RootACLWithDefaults.
+	ParentDefaults map[string]string
+
+	QueryMeta
+}
+
+// ACLDefaults has the default ACL policies in effect.
+type ACLDefaults struct {
+	// Default is the global default policy.
+	Default string
+
+	// Types has the default policy for each resource type that can have
+	// its own, with the global default filled in for the ones that don't.
+	Types map[string]string
+
+	QueryMeta
+}
+
+// ACLProbe asks whether a token has some access to a resource.
+type ACLProbe struct {
+	// Resource is the kind of resource, named after the rule that covers
+	// it, like "key" or "service". See the acl.Resource constants.
+	Resource string
+
+	// Segment is the name of the resource, like a key or a service name.
+	// It's ignored for resources that don't have names, like "operator".
+	Segment string
+
+	// Access is "read" or "write".
+	Access string
+}
+
+// ACLProbeResult is the answer to an ACLProbe.
+type ACLProbeResult struct {
+	ACLProbe
+
+	// Allowed is true if the token has the access.
+	Allowed bool
+
+	// Rule describes what decided the answer, which is either the rule
+	// that matched, like `key "foo/" = "read"`, or the root policy the
+	// check fell through to, like `root "deny"`.
+	Rule string
+}
+
+// These are the statuses of the token in an ACL introspection.
+const (
+	ACLTokenResolved = "resolved"
+	ACLTokenNotFound = "not-found"
+)
+
+// ACLIntrospectRequest is used to check what a token can do.
+type ACLIntrospectRequest struct {
+	Datacenter string
+
+	// Subject is the ID of the token to check. If it's empty, the token the
+	// request is made with is checked. Checking any other token needs a
+	// management token.
+	Subject string
+
+	// Probes are the checks to make.
+	Probes []ACLProbe
+
+	QueryOptions
+}
+
+func (r *ACLIntrospectRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// ACLIntrospectResponse has the answers to an ACLIntrospectRequest.
+type ACLIntrospectResponse struct {
+	// TokenStatus is ACLTokenResolved if the token was resolved, or
+	// ACLTokenNotFound if there's no such token, in which case there are no
+	// results.
+	TokenStatus string
+
+	// Results has the answers to the probes, in the same order.
+	Results []ACLProbeResult
+
+	QueryMeta
+}
+
+// ACLShadowDenial counts checks that a token's shadow rules would have
+// denied, but its rules allowed. See ACL.
+type ACLShadowDenial struct {
+	// ACLProbe is the access that was checked.
+	ACLProbe
+
+	// TokenHash identifies the token without giving it away. It's a hash
+	// of the token ID, like Session.TokenHash.
+	TokenHash string
+
+	// Endpoint is the RPC endpoint that made the check, like "KVS.Apply".
+	Endpoint string
+
+	// Count is how many times the check was made, and LastSeen is when it
+	// was last made.
+	Count    uint64
+	LastSeen time.Time
+}
+
+// ACLShadowReport has the checks that shadow rules would have denied on the
+// servers since they started, or since the tokens' shadow rules were
+// enforced.
+type ACLShadowReport struct {
+	// Node is the server that made the report.
+	Node string
+
+	// Servers are the servers whose checks are in the report. Servers that
+	// couldn't be reached are left out.
+	Servers []string
+
+	Denials []ACLShadowDenial
+
 	QueryMeta
 }
 
@@ -937,6 +2273,54 @@ func (c *CoordinateUpdateRequest) RequestDatacenter() string {
 	return c.Datacenter
 }
 
+// CoordinateRTTRequest is used to ask for the estimated round trip time
+// between two nodes in a datacenter, based on their network coordinates.
+type CoordinateRTTRequest struct {
+	Datacenter string
+	Source     string
+	Target     string
+	QueryOptions
+}
+
+// RequestDatacenter returns the datacenter for a given RTT request.
+func (c *CoordinateRTTRequest) RequestDatacenter() string {
+	return c.Datacenter
+}
+
+// CoordinateRTTBatchRequest is used to ask for the estimated round trip
+// times from a source node to a list of target nodes in a datacenter.
+type CoordinateRTTBatchRequest struct {
+	Datacenter string
+	Source     string
+	Targets    []string
+	QueryOptions
+}
+
+// RequestDatacenter returns the datacenter for a given RTT request.
+func (c *CoordinateRTTBatchRequest) RequestDatacenter() string {
+	return c.Datacenter
+}
+
+// CoordinateRTT is the estimated round trip time from a source node to the
+// given node.
+type CoordinateRTT struct {
+	Node string
+	RTT  time.Duration
+}
+
+// IndexedCoordinateRTT is used to return a single RTT estimate.
+type IndexedCoordinateRTT struct {
+	RTT CoordinateRTT
+	QueryMeta
+}
+
+// IndexedCoordinateRTTs is used to return the RTT estimates from a source
+// node, in the same order as the requested targets.
+type IndexedCoordinateRTTs struct {
+	RTTs []CoordinateRTT
+	QueryMeta
+}
+
 // EventFireRequest is used to ask a server to fire
 // a Serf event. It is a bit odd, since it doesn't depend on
 // the catalog or leader. Any node can respond, so it's not quite
@@ -1030,6 +2414,12 @@ func (r *KeyringRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// IsRead returns true if the request only lists keys. This overrides the
+// QueryOptions, since the other operations change the keyring.
+func (r *KeyringRequest) IsRead() bool {
+	return r.Operation == KeyringList
+}
+
 // KeyringResponse is a unified key response and can be used for install,
 // remove, use, as well as listing key queries.
 type KeyringResponse struct {
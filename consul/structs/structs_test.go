@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/consul/types"
 )
@@ -103,6 +104,101 @@ func TestStructs_ACL_IsSame(t *testing.T) {
 	check(func() { other.Name = "nope" }, func() { other.Name = "An ACL for testing" })
 	check(func() { other.Type = "management" }, func() { other.Type = "client" })
 	check(func() { other.Rules = "" }, func() { other.Rules = "service \"\" { policy = \"read\" }" })
+	check(func() { other.Datacenters = []string{"dc2"} }, func() { other.Datacenters = nil })
+	check(func() { other.NodeIdentity = "foo/dc1" }, func() { other.NodeIdentity = "" })
+
+	// An empty list is the same as no list.
+	other.Datacenters = []string{}
+	if !acl.IsSame(other) || !other.IsSame(acl) {
+		t.Fatalf("should be the same")
+	}
+}
+
+func TestStructs_ParseNodeIdentity(t *testing.T) {
+	node, dc, err := ParseNodeIdentity("web/1/dc1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node != "web/1" || dc != "dc1" {
+		t.Fatalf("bad: %s %s", node, dc)
+	}
+
+	for _, identity := range []string{"", "web", "/dc1", "web/"} {
+		if _, _, err := ParseNodeIdentity(identity); err == nil {
+			t.Fatalf("should fail: %q", identity)
+		}
+	}
+}
+
+func TestStructs_HasErrorCode(t *testing.T) {
+	orig := &KVFlagError{Key: "foo", Reason: "is locked"}
+	if !HasErrorCode(orig, ErrCodeKVFlag) || HasErrorCode(orig, ErrCodeTooLarge) {
+		t.Fatalf("bad: %v", orig)
+	}
+
+	// It should survive being flattened into a string by the RPC layer,
+	// including being passed along by other servers.
+	for _, err := range []error{
+		fmt.Errorf("%s", orig.Error()),
+		fmt.Errorf("rpc error: %s", orig.Error()),
+		fmt.Errorf("rpc error: rpc error: %s", orig.Error()),
+		TxnError{OpIndex: 1, What: orig.Error()},
+		&TxnError{OpIndex: 1, What: orig.Error()},
+	} {
+		if !HasErrorCode(err, ErrCodeKVFlag) {
+			t.Fatalf("bad: %v", err)
+		}
+	}
+
+	// Only the start of the message counts, so a key that happens to look
+	// like a code doesn't.
+	for _, err := range []error{
+		nil,
+		fmt.Errorf("Invalid key %q", ErrCodeKVFlag+": foo"),
+		TxnError{OpIndex: 1, What: "Request too large: size is 2 bytes but the limit is 1 bytes"},
+	} {
+		if HasErrorCode(err, ErrCodeKVFlag) {
+			t.Fatalf("bad: %v", err)
+		}
+	}
+}
+
+func TestStructs_ParseNoLeaderError(t *testing.T) {
+	orig := &NoLeaderError{
+		LastLeader:   "127.0.0.1:8300",
+		LastContact:  1500 * time.Millisecond,
+		RaftState:    "Candidate",
+		AliveServers: 2,
+	}
+
+	// It should survive being flattened into a string by the RPC layer,
+	// with a prefix added along the way.
+	err := fmt.Errorf("rpc error: %s", orig.Error())
+	if !IsErrNoLeader(err) {
+		t.Fatalf("bad: %v", err)
+	}
+	parsed, ok := ParseNoLeaderError(err)
+	if !ok || !reflect.DeepEqual(parsed, orig) {
+		t.Fatalf("bad: %#v", parsed)
+	}
+
+	// A server that's never known a leader should round trip too.
+	orig = &NoLeaderError{LastContact: -1, RaftState: "Follower"}
+	parsed, ok = ParseNoLeaderError(orig)
+	if !ok || !reflect.DeepEqual(parsed, orig) {
+		t.Fatalf("bad: %#v", parsed)
+	}
+
+	// A bare error from an older server is still a no leader error, but
+	// has no details.
+	if !IsErrNoLeader(ErrNoLeader) {
+		t.Fatalf("bad")
+	}
+	for _, err := range []error{nil, ErrNoLeader, ErrNoServers} {
+		if _, ok := ParseNoLeaderError(err); ok {
+			t.Fatalf("should not parse: %v", err)
+		}
+	}
 }
 
 func TestStructs_RegisterRequest_ChangesNode(t *testing.T) {
@@ -181,6 +277,10 @@ func testServiceNode() *ServiceNode {
 		ServiceAddress:           "127.0.0.2",
 		ServicePort:              8080,
 		ServiceEnableTagOverride: true,
+		ServiceMeta: map[string]string{
+			"protocol": "http",
+		},
+		ServiceKind: ServiceKindLoadBalancer,
 		RaftIndex: RaftIndex{
 			CreateIndex: 1,
 			ModifyIndex: 2,
@@ -215,6 +315,13 @@ func TestStructs_ServiceNode_PartialClone(t *testing.T) {
 	if reflect.DeepEqual(sn, clone) {
 		t.Fatalf("clone wasn't independent of the original")
 	}
+
+	sn = testServiceNode()
+	clone = sn.PartialClone()
+	sn.ServiceMeta["protocol"] = "grpc"
+	if clone.ServiceMeta["protocol"] != "http" {
+		t.Fatalf("clone wasn't independent of the original")
+	}
 }
 
 func TestStructs_ServiceNode_Conversions(t *testing.T) {
@@ -241,6 +348,7 @@ func TestStructs_NodeService_IsSame(t *testing.T) {
 		Address:           "127.0.0.1",
 		Port:              1234,
 		EnableTagOverride: true,
+		Meta:              map[string]string{"protocol": "http"},
 	}
 	if !ns.IsSame(ns) {
 		t.Fatalf("should be equal to itself")
@@ -253,6 +361,7 @@ func TestStructs_NodeService_IsSame(t *testing.T) {
 		Address:           "127.0.0.1",
 		Port:              1234,
 		EnableTagOverride: true,
+		Meta:              map[string]string{"protocol": "http"},
 		RaftIndex: RaftIndex{
 			CreateIndex: 1,
 			ModifyIndex: 2,
@@ -285,6 +394,9 @@ func TestStructs_NodeService_IsSame(t *testing.T) {
 	check(func() { other.Address = "XXX" }, func() { other.Address = "127.0.0.1" })
 	check(func() { other.Port = 9999 }, func() { other.Port = 1234 })
 	check(func() { other.EnableTagOverride = false }, func() { other.EnableTagOverride = true })
+	check(func() { other.Meta = nil }, func() { other.Meta = map[string]string{"protocol": "http"} })
+	check(func() { other.Meta = map[string]string{"protocol": "grpc"} }, func() { other.Meta = map[string]string{"protocol": "http"} })
+	check(func() { other.Kind = ServiceKindMeshProxy }, func() { other.Kind = "" })
 }
 
 func TestStructs_HealthCheck_IsSame(t *testing.T) {
@@ -0,0 +1,83 @@
+package structs
+
+// Topics that can be subscribed to with a subscribe request.
+const (
+	// SubscribeServices notifies about service registrations, keyed by
+	// service name.
+	SubscribeServices = "services"
+
+	// SubscribeNodes notifies about node registrations, keyed by node name.
+	SubscribeNodes = "nodes"
+
+	// SubscribeKVPrefix notifies about key/value writes under a prefix.
+	SubscribeKVPrefix = "kv-prefix"
+
+	// SubscribeChecks notifies about health checks, keyed by the name of
+	// the service they belong to.
+	SubscribeChecks = "checks"
+)
+
+// SubscribeTopic is a topic to get change notifications for.
+type SubscribeTopic struct {
+	// Topic is one of the Subscribe constants.
+	Topic string
+
+	// Key narrows the topic down to a single service or node name, or to
+	// a key prefix for SubscribeKVPrefix. If this is blank then all
+	// changes for the topic are sent.
+	Key string
+}
+
+// SubscribeRequest is used as the header for a subscribe RPC request, which
+// is a long-lived stream of change notifications. These are only served by
+// servers in the local datacenter, and don't carry any data, so the client
+// should re-query for whatever changed.
+type SubscribeRequest struct {
+	// Datacenter must be the datacenter of the server handling the
+	// request.
+	Datacenter string
+
+	// Token is the ACL token to use, which needs read access to every
+	// topic.
+	Token string
+
+	// Topics is what to get notifications for.
+	Topics []SubscribeTopic
+}
+
+// SubscribeResponse is used as the header for a subscribe RPC response. It's
+// followed by a stream of SubscribeEvents if there's no error.
+type SubscribeResponse struct {
+	// Error is the overall error status of the RPC request.
+	Error string
+
+	// Index is the server's applied index when the subscription started,
+	// which can be used to query for the starting state.
+	Index uint64
+}
+
+// SubscribeEvent is a single change notification, or a heartbeat.
+type SubscribeEvent struct {
+	// Topic and Key are what changed. The key may be blank if the server
+	// can't tell exactly what changed, such as a service deregistration,
+	// which should be treated as a change to everything in the topic.
+	Topic string
+	Key   string
+
+	// Index is the Raft index of the change.
+	Index uint64
+
+	// Heartbeat is set for the periodic keepalive frames the server sends
+	// while there aren't any changes.
+	Heartbeat bool
+
+	// Reset is set when the server lost track of what changed, such as
+	// after a snapshot restore, and Topic and Key are blank. The client
+	// should re-query everything it's subscribed to as of Index.
+	Reset bool
+
+	// Error is set when the server is ending the subscription, such as
+	// when the token no longer has access, or the client fell too far
+	// behind.
+	Error string
+}
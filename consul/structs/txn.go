@@ -9,6 +9,9 @@ import (
 type TxnKVOp struct {
 	Verb   KVSOp
 	DirEnt DirEntry
+
+	// MaxTombstones works like it does in KVSRequest.
+	MaxTombstones int
 }
 
 // TxnKVResult is used to define the result of a single operation on the KVS
@@ -29,6 +32,12 @@ type TxnOps []*TxnOp
 type TxnRequest struct {
 	Datacenter string
 	Ops        TxnOps
+
+	// OverrideFlags lets the operations go through even if they go against
+	// the reserved flags of the entries they touch, like it does for a
+	// KVSRequest. This needs a management token when ACLs are enabled.
+	OverrideFlags bool
+
 	WriteRequest
 }
 
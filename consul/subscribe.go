@@ -0,0 +1,514 @@
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+const (
+	// subscribeHeartbeatInterval is how often a subscription sends a
+	// heartbeat when there aren't any changes. Clients give up on a
+	// subscription if they don't hear anything for a few of these.
+	subscribeHeartbeatInterval = 10 * time.Second
+
+	// subscribeACLInterval is how often a subscription's token is checked
+	// again, so revoked access doesn't keep getting notifications.
+	subscribeACLInterval = time.Minute
+
+	// subscribeWriteTimeout is how long a write to a subscriber can take
+	// before it's considered gone.
+	subscribeWriteTimeout = 10 * time.Second
+
+	// subscribeQueueSize is how many notifications can be waiting for a
+	// subscriber before it's considered too slow and cut off.
+	subscribeQueueSize = 128
+)
+
+// errSubscriberTooSlow is sent to a subscriber that fell too far behind.
+var errSubscriberTooSlow = errors.New("Subscription ended, client fell too far behind")
+
+// subscriber is a single subscription's view of the changes.
+type subscriber struct {
+	topics []structs.SubscribeTopic
+
+	// events has the notifications waiting to be written.
+	events chan structs.SubscribeEvent
+
+	// slowCh is closed when the subscriber's queue overflowed and it's
+	// been removed.
+	slowCh chan struct{}
+}
+
+// change is a change to the state store that subscribers might care about.
+type change struct {
+	topic string
+	key   string
+	index uint64
+
+	// tree is set for key/value deletes of a whole prefix.
+	tree bool
+}
+
+// matches returns true if the subscriber wants to hear about the change.
+func (sub *subscriber) matches(c change) bool {
+	for _, t := range sub.topics {
+		if t.Topic != c.topic {
+			continue
+		}
+		if c.topic == structs.SubscribeKVPrefix {
+			if strings.HasPrefix(c.key, t.Key) || (c.tree && strings.HasPrefix(t.Key, c.key)) {
+				return true
+			}
+			continue
+		}
+		if t.Key == "" || c.key == "" || t.Key == c.key {
+			return true
+		}
+	}
+	return false
+}
+
+// subscriptions fans changes from the FSM out to subscribers. The change
+// hooks that feed it are only registered once someone subscribes.
+type subscriptions struct {
+	subs  map[*subscriber]struct{}
+	hooks sync.Once
+	lock  sync.Mutex
+}
+
+// newSubscriptions returns an empty set of subscriptions.
+func newSubscriptions() *subscriptions {
+	return &subscriptions{
+		subs: make(map[*subscriber]struct{}),
+	}
+}
+
+// add registers a subscriber for the given topics.
+func (s *subscriptions) add(topics []structs.SubscribeTopic) *subscriber {
+	sub := &subscriber{
+		topics: topics,
+		events: make(chan structs.SubscribeEvent, subscribeQueueSize),
+		slowCh: make(chan struct{}),
+	}
+	s.lock.Lock()
+	s.subs[sub] = struct{}{}
+	s.lock.Unlock()
+	return sub
+}
+
+// remove unregisters a subscriber. It's safe to call this more than once.
+func (s *subscriptions) remove(sub *subscriber) {
+	s.lock.Lock()
+	delete(s.subs, sub)
+	s.lock.Unlock()
+}
+
+// count returns the number of subscribers.
+func (s *subscriptions) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.subs)
+}
+
+// publish queues a change for the subscribers that want it. Subscribers whose
+// queues are full are removed rather than holding up everyone else, and have
+// to subscribe again and re-query.
+func (s *subscriptions) publish(changes ...change) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+OUTER:
+	for sub := range s.subs {
+		for _, c := range changes {
+			if !sub.matches(c) {
+				continue
+			}
+			event := structs.SubscribeEvent{
+				Topic: c.topic,
+				Key:   c.key,
+				Index: c.index,
+			}
+			select {
+			case sub.events <- event:
+			default:
+				delete(s.subs, sub)
+				close(sub.slowCh)
+				metrics.IncrCounter([]string{"consul", "subscribe", "too_slow"}, 1)
+				continue OUTER
+			}
+		}
+	}
+}
+
+// reset tells every subscriber to re-query everything as of the given index,
+// for when changes were missed. Subscribers whose queues are full are removed,
+// the same as in publish.
+func (s *subscriptions) reset(idx uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	event := structs.SubscribeEvent{Reset: true, Index: idx}
+	for sub := range s.subs {
+		select {
+		case sub.events <- event:
+		default:
+			delete(s.subs, sub)
+			close(sub.slowCh)
+			metrics.IncrCounter([]string{"consul", "subscribe", "too_slow"}, 1)
+		}
+	}
+	metrics.IncrCounter([]string{"consul", "subscribe", "reset"}, 1)
+}
+
+// publishSessionKVChange notifies every key/value subscriber if the KV store
+// changed at the given index. Sessions that are destroyed or invalidated,
+// including by node deregistrations and critical checks, release or delete
+// the keys they held, and the apply doesn't say which keys those were.
+func (s *Server) publishSessionKVChange(idx uint64) {
+	if s.fsm.State().KVSIndex() < idx {
+		return
+	}
+	s.subscriptions.publish(change{
+		topic: structs.SubscribeKVPrefix,
+		index: idx,
+		tree:  true,
+	})
+}
+
+// registerSubscribeHooks registers the change hooks that turn applies into
+// notifications. If a hook falls behind and drops changes, or the FSM is
+// restored from a snapshot, subscribers are sent a reset.
+func (s *Server) registerSubscribeHooks() {
+	register := func(msgType structs.MessageType, hook func(idx uint64, op interface{})) {
+		s.registerChangeHook(msgType, hook, s.subscriptions.reset)
+	}
+	s.fsm.hooks.addRestore(s.subscriptions.reset)
+
+	register(structs.RegisterRequestType, func(idx uint64, op interface{}) {
+		req := op.(*structs.RegisterRequest)
+		changes := []change{{topic: structs.SubscribeNodes, key: req.Node, index: idx}}
+		if req.Service != nil {
+			changes = append(changes, change{topic: structs.SubscribeServices, key: req.Service.Service, index: idx})
+		}
+		checks := req.Checks
+		if req.Check != nil {
+			checks = append(checks, req.Check)
+		}
+		critical := false
+		for _, check := range checks {
+			changes = append(changes, change{topic: structs.SubscribeChecks, key: check.ServiceName, index: idx})
+			critical = critical || check.Status == structs.HealthCritical
+		}
+		s.subscriptions.publish(changes...)
+		if critical {
+			s.publishSessionKVChange(idx)
+		}
+	})
+
+	// Deregistrations only have IDs, and the names are gone by now, so
+	// these notify everyone subscribed to the topic.
+	register(structs.DeregisterRequestType, func(idx uint64, op interface{}) {
+		req := op.(*structs.DeregisterRequest)
+		changes := []change{{topic: structs.SubscribeChecks, index: idx}}
+		if req.CheckID == "" {
+			changes = append(changes, change{topic: structs.SubscribeServices, index: idx})
+		}
+		if req.ServiceID == "" && req.CheckID == "" {
+			changes = append(changes, change{topic: structs.SubscribeNodes, key: req.Node, index: idx})
+		}
+		s.subscriptions.publish(changes...)
+		s.publishSessionKVChange(idx)
+	})
+
+	register(structs.DeregisterBatchRequestType, func(idx uint64, op interface{}) {
+		req := op.(*structs.DeregisterBatchRequest)
+		changes := []change{
+			{topic: structs.SubscribeChecks, index: idx},
+			{topic: structs.SubscribeServices, index: idx},
+		}
+		for _, node := range req.Nodes {
+			changes = append(changes, change{topic: structs.SubscribeNodes, key: node, index: idx})
+		}
+		s.subscriptions.publish(changes...)
+		s.publishSessionKVChange(idx)
+	})
+
+	register(structs.SessionRequestType, func(idx uint64, op interface{}) {
+		req := op.(*structs.SessionRequest)
+		if req.Op == structs.SessionDestroy {
+			s.publishSessionKVChange(idx)
+		}
+	})
+
+	register(structs.KVSRequestType, func(idx uint64, op interface{}) {
+		req := op.(*structs.KVSRequest)
+		s.subscriptions.publish(change{
+			topic: structs.SubscribeKVPrefix,
+			key:   req.DirEnt.Key,
+			index: idx,
+			tree:  req.Op == structs.KVSDeleteTree,
+		})
+	})
+
+	register(structs.OrphanedLockRequestType, func(idx uint64, op interface{}) {
+		req := op.(*structs.OrphanedLockRequest)
+		var changes []change
+		for _, lock := range req.Locks {
+			changes = append(changes, change{topic: structs.SubscribeKVPrefix, key: lock.Key, index: idx})
+		}
+		s.subscriptions.publish(changes...)
+	})
+
+	register(structs.TxnRequestType, func(idx uint64, op interface{}) {
+		req := op.(*structs.TxnRequest)
+		var changes []change
+		for _, txnOp := range req.Ops {
+			if txnOp.KV == nil {
+				continue
+			}
+			changes = append(changes, change{
+				topic: structs.SubscribeKVPrefix,
+				key:   txnOp.KV.DirEnt.Key,
+				index: idx,
+				tree:  txnOp.KV.Verb == structs.KVSDeleteTree,
+			})
+		}
+		s.subscriptions.publish(changes...)
+	})
+}
+
+// subscribeAllowed returns true if the ACL can read the given topic.
+func subscribeAllowed(rule acl.ACL, topic structs.SubscribeTopic) bool {
+	switch topic.Topic {
+	case structs.SubscribeServices, structs.SubscribeChecks:
+		return rule.ServiceRead(topic.Key)
+	case structs.SubscribeNodes:
+		return rule.NodeRead(topic.Key)
+	case structs.SubscribeKVPrefix:
+		return rule.KeyRead(topic.Key)
+	default:
+		return false
+	}
+}
+
+// checkSubscribeACL makes sure the token can read every topic in the request.
+func (s *Server) checkSubscribeACL(args *structs.SubscribeRequest) error {
+	rule, err := s.resolveToken("Subscribe", args.Token)
+	if err != nil {
+		return err
+	}
+	if rule == nil {
+		return nil
+	}
+	for _, topic := range args.Topics {
+		if !subscribeAllowed(rule, topic) {
+			return permissionDeniedErr
+		}
+	}
+	return nil
+}
+
+// validateSubscribe checks a subscribe request before it's accepted.
+func (s *Server) validateSubscribe(args *structs.SubscribeRequest) error {
+	if args.Datacenter != s.config.Datacenter {
+		return fmt.Errorf("Subscriptions are only served for the local datacenter %q", s.config.Datacenter)
+	}
+	if len(args.Topics) == 0 {
+		return fmt.Errorf("Must subscribe to at least one topic")
+	}
+	for _, topic := range args.Topics {
+		switch topic.Topic {
+		case structs.SubscribeServices, structs.SubscribeNodes,
+			structs.SubscribeKVPrefix, structs.SubscribeChecks:
+		default:
+			return fmt.Errorf("Unknown subscription topic %q", topic.Topic)
+		}
+	}
+	return s.checkSubscribeACL(args)
+}
+
+// handleSubscribeRequest reads the request from the conn and streams change
+// notifications back until the client goes away, the subscription is ended,
+// or the server shuts down. This will be called from a goroutine after an
+// incoming stream is determined to be a subscription.
+func (s *Server) handleSubscribeRequest(conn net.Conn) error {
+	var args structs.SubscribeRequest
+	dec := codec.NewDecoder(conn, &codec.MsgpackHandle{})
+	if err := dec.Decode(&args); err != nil {
+		return fmt.Errorf("failed to decode request: %v", err)
+	}
+
+	enc := codec.NewEncoder(conn, &codec.MsgpackHandle{})
+	write := func(v interface{}) error {
+		conn.SetWriteDeadline(time.Now().Add(subscribeWriteTimeout))
+		return enc.Encode(v)
+	}
+
+	var reply structs.SubscribeResponse
+	if err := s.validateSubscribe(&args); err != nil {
+		reply.Error = err.Error()
+		return write(&reply)
+	}
+
+	s.subscriptions.hooks.Do(s.registerSubscribeHooks)
+	sub := s.subscriptions.add(args.Topics)
+	defer s.subscriptions.remove(sub)
+	reply.Index = s.raft.AppliedIndex()
+	if err := write(&reply); err != nil {
+		return fmt.Errorf("failed to encode response: %v", err)
+	}
+	metrics.IncrCounter([]string{"consul", "subscribe", "started"}, 1)
+
+	// The client doesn't send anything after the request, so a read
+	// returning means it's gone.
+	closedCh := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closedCh)
+	}()
+
+	heartbeat := s.clock.NewTicker(subscribeHeartbeatInterval)
+	defer heartbeat.Stop()
+	recheck := s.clock.NewTicker(subscribeACLInterval)
+	defer recheck.Stop()
+
+	for {
+		select {
+		case event := <-sub.events:
+			if err := write(&event); err != nil {
+				return fmt.Errorf("failed to send notification: %v", err)
+			}
+
+		case <-heartbeat.C():
+			event := structs.SubscribeEvent{
+				Heartbeat: true,
+				Index:     s.raft.AppliedIndex(),
+			}
+			if err := write(&event); err != nil {
+				return fmt.Errorf("failed to send heartbeat: %v", err)
+			}
+
+		case <-recheck.C():
+			if err := s.checkSubscribeACL(&args); err != nil {
+				event := structs.SubscribeEvent{Error: err.Error()}
+				return write(&event)
+			}
+
+		case <-sub.slowCh:
+			event := structs.SubscribeEvent{Error: errSubscriberTooSlow.Error()}
+			return write(&event)
+
+		case <-closedCh:
+			return nil
+
+		case <-s.shutdownCh:
+			return nil
+		}
+	}
+}
+
+// Subscription is the client side of a subscribe RPC. Call Close when done
+// with it.
+type Subscription struct {
+	// Index is the server's applied index when the subscription started.
+	Index uint64
+
+	stream net.Conn
+	dec    *codec.Decoder
+	once   sync.Once
+	closer func()
+}
+
+// Next blocks until the next change notification and returns it. Heartbeats
+// are handled here and aren't returned. This returns an error once the
+// subscription has ended, including when the server hasn't been heard from
+// for a few heartbeat intervals.
+func (sub *Subscription) Next() (*structs.SubscribeEvent, error) {
+	for {
+		sub.stream.SetReadDeadline(time.Now().Add(3 * subscribeHeartbeatInterval))
+		var event structs.SubscribeEvent
+		if err := sub.dec.Decode(&event); err != nil {
+			return nil, err
+		}
+		if event.Error != "" {
+			return nil, errors.New(event.Error)
+		}
+		if !event.Heartbeat {
+			return &event, nil
+		}
+	}
+}
+
+// Close ends the subscription.
+func (sub *Subscription) Close() {
+	sub.once.Do(sub.closer)
+}
+
+// SubscribeRPC starts a subscription with the given server, over a new stream
+// on the pooled connection to it. If the server refuses the subscription, the
+// error from the reply is returned.
+func SubscribeRPC(pool *ConnPool, dc string, addr net.Addr, version int,
+	args *structs.SubscribeRequest) (*Subscription, error) {
+
+	conn, err := pool.acquire(dc, addr, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conn: %v", err)
+	}
+	stream, err := conn.session.Open()
+	if err != nil {
+		pool.clearConn(conn)
+		pool.releaseConn(conn)
+		return nil, fmt.Errorf("failed to start stream: %v", err)
+	}
+
+	// keep will disarm the defer on success if we are returning the caller
+	// the stream to read notifications from.
+	var keep bool
+	defer func() {
+		if !keep {
+			stream.Close()
+			pool.releaseConn(conn)
+		}
+	}()
+
+	// Write the subscribe byte to set the mode of the stream, then perform
+	// the request.
+	if _, err := stream.Write([]byte{byte(rpcSubscribe)}); err != nil {
+		return nil, fmt.Errorf("failed to write stream type: %v", err)
+	}
+	enc := codec.NewEncoder(stream, &codec.MsgpackHandle{})
+	if err := enc.Encode(args); err != nil {
+		return nil, fmt.Errorf("failed to encode request: %v", err)
+	}
+
+	var reply structs.SubscribeResponse
+	dec := codec.NewDecoder(stream, &codec.MsgpackHandle{})
+	if err := dec.Decode(&reply); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+	if reply.Error != "" {
+		return nil, errors.New(reply.Error)
+	}
+
+	keep = true
+	return &Subscription{
+		Index:  reply.Index,
+		stream: stream,
+		dec:    dec,
+		closer: func() {
+			stream.Close()
+			pool.releaseConn(conn)
+		},
+	}, nil
+}
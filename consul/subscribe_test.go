@@ -0,0 +1,351 @@
+package consul
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+// nextEvent waits for the next notification on a subscription.
+func nextEvent(t *testing.T, sub *Subscription) *structs.SubscribeEvent {
+	type result struct {
+		event *structs.SubscribeEvent
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		event, err := sub.Next()
+		ch <- result{event, err}
+	}()
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatalf("err: %v", r.err)
+		}
+		return r.event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a notification")
+	}
+	return nil
+}
+
+func TestSubscriber_Matches(t *testing.T) {
+	sub := &subscriber{
+		topics: []structs.SubscribeTopic{
+			{Topic: structs.SubscribeServices, Key: "web"},
+			{Topic: structs.SubscribeKVPrefix, Key: "app/"},
+		},
+	}
+	cases := []struct {
+		change change
+		match  bool
+	}{
+		{change{topic: structs.SubscribeServices, key: "web"}, true},
+		{change{topic: structs.SubscribeServices, key: "db"}, false},
+		{change{topic: structs.SubscribeServices}, true},
+		{change{topic: structs.SubscribeNodes, key: "web"}, false},
+		{change{topic: structs.SubscribeKVPrefix, key: "app/config"}, true},
+		{change{topic: structs.SubscribeKVPrefix, key: "other/config"}, false},
+		{change{topic: structs.SubscribeKVPrefix, key: "ap"}, false},
+		{change{topic: structs.SubscribeKVPrefix, key: "ap", tree: true}, true},
+	}
+	for i, c := range cases {
+		if match := sub.matches(c.change); match != c.match {
+			t.Fatalf("case %d: bad: %v", i, match)
+		}
+	}
+}
+
+func TestSubscriptions_Reset(t *testing.T) {
+	subs := newSubscriptions()
+	sub := subs.add([]structs.SubscribeTopic{{Topic: structs.SubscribeNodes}})
+	full := subs.add([]structs.SubscribeTopic{{Topic: structs.SubscribeServices}})
+	for i := 0; i < subscribeQueueSize; i++ {
+		full.events <- structs.SubscribeEvent{}
+	}
+
+	// Every subscriber should get the reset, whatever its topics, and the
+	// one that can't take it should be cut off.
+	subs.reset(5)
+	select {
+	case event := <-sub.events:
+		if !event.Reset || event.Index != 5 {
+			t.Fatalf("bad: %#v", event)
+		}
+	default:
+		t.Fatalf("should have a reset")
+	}
+	select {
+	case <-full.slowCh:
+	default:
+		t.Fatalf("should be too slow")
+	}
+	if n := subs.count(); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestClient_Subscribe(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, c1 := testClient(t)
+	defer os.RemoveAll(dir2)
+	defer c1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := c1.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return c1.servers.NumServers() == 1, nil
+	}); err != nil {
+		t.Fatal("expected consul server")
+	}
+
+	// Unknown topics are refused.
+	args := structs.SubscribeRequest{
+		Datacenter: "dc1",
+		Topics:     []structs.SubscribeTopic{{Topic: "nope"}},
+	}
+	if _, err := c1.Subscribe(&args); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	args.Topics = []structs.SubscribeTopic{{Topic: structs.SubscribeServices}}
+	sub, err := c1.Subscribe(&args)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer sub.Close()
+	if sub.Index == 0 {
+		t.Fatalf("bad: %d", sub.Index)
+	}
+
+	register := func(service string) {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       "foo",
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				Service: service,
+			},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	register("web")
+	event := nextEvent(t, sub)
+	if event.Topic != structs.SubscribeServices || event.Key != "web" || event.Index <= sub.Index {
+		t.Fatalf("bad: %#v", event)
+	}
+
+	// A key/value write shouldn't notify, so the next notification
+	// should be for the next service.
+	kv := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "test",
+			Value: []byte("hello"),
+		},
+	}
+	var ok bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &kv, &ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	register("db")
+	next := nextEvent(t, sub)
+	if next.Topic != structs.SubscribeServices || next.Key != "db" || next.Index <= event.Index+1 {
+		t.Fatalf("bad: %#v", next)
+	}
+
+	// Closing the subscription should clean up on the server.
+	sub.Close()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return s1.subscriptions.count() == 0, nil
+	}); err != nil {
+		t.Fatalf("subscription should be gone")
+	}
+}
+
+func TestServer_Subscribe_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	id := makeTestToken(t, codec, `
+key "app/" {
+	policy = "read"
+}
+`, 0)
+
+	// Topics the token can't read are refused.
+	args := structs.SubscribeRequest{
+		Datacenter: "dc1",
+		Token:      id,
+		Topics: []structs.SubscribeTopic{
+			{Topic: structs.SubscribeKVPrefix, Key: "app/"},
+			{Topic: structs.SubscribeServices},
+		},
+	}
+	_, err := SubscribeRPC(s1.connPool, "dc1", s1.config.RPCAddr, 2, &args)
+	if err == nil || err.Error() != permissionDenied {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Ones it can read are fine.
+	args.Topics = args.Topics[:1]
+	sub, err := SubscribeRPC(s1.connPool, "dc1", s1.config.RPCAddr, 2, &args)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer sub.Close()
+
+	kv := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "app/config",
+			Value: []byte("hello"),
+		},
+		WriteRequest: structs.WriteRequest{
+			Token: "root",
+		},
+	}
+	var ok bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &kv, &ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if event := nextEvent(t, sub); event.Topic != structs.SubscribeKVPrefix || event.Key != "app/config" {
+		t.Fatalf("bad: %#v", event)
+	}
+}
+
+func TestServer_Subscribe_SessionDestroy(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	reg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &reg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sess := structs.SessionRequest{
+		Datacenter: "dc1",
+		Op:         structs.SessionCreate,
+		Session: structs.Session{
+			Node: "foo",
+		},
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Session.Apply", &sess, &sess.Session.ID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	args := structs.SubscribeRequest{
+		Datacenter: "dc1",
+		Topics:     []structs.SubscribeTopic{{Topic: structs.SubscribeKVPrefix, Key: "app/"}},
+	}
+	sub, err := SubscribeRPC(s1.connPool, "dc1", s1.config.RPCAddr, 2, &args)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer sub.Close()
+
+	kv := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSLock,
+		DirEnt: structs.DirEntry{
+			Key:     "app/lock",
+			Session: sess.Session.ID,
+		},
+	}
+	var ok bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &kv, &ok); err != nil || !ok {
+		t.Fatalf("err: %v", err)
+	}
+	event := nextEvent(t, sub)
+	if event.Key != "app/lock" {
+		t.Fatalf("bad: %#v", event)
+	}
+
+	// Destroying the session releases the lock, which the server can't
+	// pin down to a key, so it should notify the whole topic.
+	sess.Op = structs.SessionDestroy
+	var id string
+	if err := msgpackrpc.CallWithCodec(codec, "Session.Apply", &sess, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	next := nextEvent(t, sub)
+	if next.Topic != structs.SubscribeKVPrefix || next.Key != "" || next.Index <= event.Index {
+		t.Fatalf("bad: %#v", next)
+	}
+}
+
+func TestServer_Subscribe_Restore(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	args := structs.SubscribeRequest{
+		Datacenter: "dc1",
+		Topics:     []structs.SubscribeTopic{{Topic: structs.SubscribeNodes}},
+	}
+	sub, err := SubscribeRPC(s1.connPool, "dc1", s1.config.RPCAddr, 2, &args)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer sub.Close()
+
+	// Restoring the FSM from a snapshot replaces the state without any
+	// applies, so subscribers should be told to start over.
+	snap, err := s1.fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+	sink := &MockSink{&bytes.Buffer{}, false}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.fsm.Restore(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if event := nextEvent(t, sub); !event.Reset || event.Index == 0 {
+		t.Fatalf("bad: %#v", event)
+	}
+}
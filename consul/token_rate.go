@@ -0,0 +1,281 @@
+package consul
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+const (
+	// tokenRateBuckets is how many buckets each token's window is split
+	// into. The window slides forward a bucket at a time.
+	tokenRateBuckets = 60
+
+	// tokenRateStatsInterval is how often the busiest tokens' rates are
+	// emitted as metrics.
+	tokenRateStatsInterval = 10 * time.Second
+
+	// defaultTopTokens is how many tokens Operator.TopTokens returns if
+	// the request doesn't say.
+	defaultTopTokens = 10
+
+	// tokenRateResolveInterval is how long a token's rate limit is cached
+	// before it's looked up again, so changes to the limit take up to this
+	// long to be enforced.
+	tokenRateResolveInterval = 10 * time.Second
+)
+
+// tokenRateRanks are the ranks that get a metric with the rate of the token
+// at that rank. The metrics are named by rank, not by token, so there's a
+// fixed number of them no matter how many tokens are in use.
+var tokenRateRanks = []int{1, 2, 3, 5, 10}
+
+// tokenRate holds the recent requests for a single token, along with the
+// state of its rate limiter.
+type tokenRate struct {
+	// counts has the number of requests in each bucket, and epochs has
+	// which bucket since the Unix epoch each slot is counting for.
+	counts [tokenRateBuckets]uint64
+	epochs [tokenRateBuckets]int64
+
+	// allowance is how many more requests the token can make right now,
+	// and lastCheck is when it was last updated.
+	allowance float64
+	lastCheck time.Time
+
+	// limit is the token's rate limit as of when it was resolved.
+	limit    float64
+	resolved time.Time
+}
+
+// tokenRateResolver returns the rate limit for the given token, and false if
+// the token isn't known.
+type tokenRateResolver func(id string) (float64, bool)
+
+// tokenRateTracker counts the requests made with each token over a sliding
+// window, and enforces token rate limits. Only the most recently used tokens
+// are tracked, so the memory it uses is bounded.
+type tokenRateTracker struct {
+	window time.Duration
+	bucket time.Duration
+	tokens *simplelru.LRU
+	lock   sync.Mutex
+}
+
+// newTokenRateTracker returns a tracker that counts requests over the given
+// window for up to the given number of tokens.
+func newTokenRateTracker(window time.Duration, maxTokens int) (*tokenRateTracker, error) {
+	bucket := window / tokenRateBuckets
+	if bucket <= 0 {
+		return nil, fmt.Errorf("Token rate window %s is too short", window)
+	}
+	tokens, err := simplelru.NewLRU(maxTokens, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenRateTracker{
+		window: window,
+		bucket: bucket,
+		tokens: tokens,
+	}, nil
+}
+
+// count returns the number of requests in the window ending at now.
+func (r *tokenRate) count(now int64) uint64 {
+	var total uint64
+	for i, epoch := range r.epochs {
+		if epoch > now-tokenRateBuckets && epoch <= now {
+			total += r.counts[i]
+		}
+	}
+	return total
+}
+
+// record counts a request made with the given token. If the token has a rate
+// limit and it's been exceeded then a TokenRateLimitError is returned. The
+// request is counted either way. Tokens are only tracked once the resolver
+// knows about them, so made up tokens can't push out real ones, and the
+// resolved limit is cached for tokenRateResolveInterval.
+func (t *tokenRateTracker) record(id string, resolve tokenRateResolver, now time.Time) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var rate *tokenRate
+	if raw, ok := t.tokens.Get(id); ok {
+		rate = raw.(*tokenRate)
+	}
+	if rate == nil || now.Sub(rate.resolved) >= tokenRateResolveInterval {
+		limit, ok := resolve(id)
+		if !ok {
+			if rate != nil {
+				t.tokens.Remove(id)
+			}
+			return nil
+		}
+		if rate == nil {
+			rate = &tokenRate{}
+			t.tokens.Add(id, rate)
+		}
+		rate.limit = limit
+		rate.resolved = now
+	}
+	limit := rate.limit
+
+	epoch := now.UnixNano() / int64(t.bucket)
+	slot := epoch % tokenRateBuckets
+	if rate.epochs[slot] != epoch {
+		rate.epochs[slot] = epoch
+		rate.counts[slot] = 0
+	}
+	rate.counts[slot]++
+
+	if limit <= 0 {
+		rate.lastCheck = time.Time{}
+		return nil
+	}
+
+	// This is a token bucket that holds up to a second's worth of
+	// requests, so short bursts are allowed.
+	burst := limit
+	if burst < 1 {
+		burst = 1
+	}
+	if rate.lastCheck.IsZero() {
+		rate.allowance = burst
+	} else if elapsed := now.Sub(rate.lastCheck); elapsed > 0 {
+		rate.allowance += elapsed.Seconds() * limit
+		if rate.allowance > burst {
+			rate.allowance = burst
+		}
+	}
+	rate.lastCheck = now
+	if rate.allowance < 1 {
+		return &structs.TokenRateLimitError{Limit: limit}
+	}
+	rate.allowance--
+	return nil
+}
+
+// tokenRateCount is the number of requests counted for a token.
+type tokenRateCount struct {
+	id       string
+	requests uint64
+}
+
+// top returns up to n of the tokens with the most requests in the window
+// ending at now, busiest first.
+func (t *tokenRateTracker) top(n int, now time.Time) []tokenRateCount {
+	t.lock.Lock()
+	epoch := now.UnixNano() / int64(t.bucket)
+	var counts []tokenRateCount
+	for _, key := range t.tokens.Keys() {
+		raw, _ := t.tokens.Peek(key)
+		if requests := raw.(*tokenRate).count(epoch); requests > 0 {
+			counts = append(counts, tokenRateCount{key.(string), requests})
+		}
+	}
+	t.lock.Unlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].requests != counts[j].requests {
+			return counts[i].requests > counts[j].requests
+		}
+		return counts[i].id < counts[j].id
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// isTokenRateEnabled returns true if we should be counting requests by token.
+func (s *Server) isTokenRateEnabled() bool {
+	return len(s.config.ACLDatacenter) > 0 && s.tokenRates != nil
+}
+
+// tokenRateLimit returns the rate limit for the given token, or zero if it
+// has none, and false if the token isn't known. Tokens are read from the
+// state store if we have a copy of them, otherwise we rely on the ACL cache,
+// so a token isn't known here until it has been resolved.
+func (s *Server) tokenRateLimit(id string) (float64, bool) {
+	if s.config.Datacenter == s.config.ACLDatacenter || s.IsACLReplicationEnabled() {
+		_, token, err := s.fsm.State().ACLGet(nil, id)
+		if err == nil && token != nil {
+			return token.RateLimit, true
+		}
+	}
+	return s.aclCache.tokenRateLimit(id)
+}
+
+// trackTokenRate counts a request being handled by this server with the
+// given token, returning an error if the token is over its rate limit.
+func (s *Server) trackTokenRate(id string) error {
+	if !s.isTokenRateEnabled() {
+		return nil
+	}
+	if id == "" {
+		id = anonymousToken
+	}
+
+	err := s.tokenRates.record(id, s.tokenRateLimit, s.clock.Now())
+	if err != nil {
+		metrics.IncrCounter([]string{"consul", "acl", "token_rate", "limited"}, 1)
+	}
+	return err
+}
+
+// topTokens returns up to n of the busiest tokens on this server. The token
+// IDs are redacted unless showIDs is set.
+func (s *Server) topTokens(n int, showIDs bool) []structs.TokenRate {
+	state := s.fsm.State()
+	var rates []structs.TokenRate
+	for _, c := range s.tokenRates.top(n, s.clock.Now()) {
+		limit, _ := s.tokenRateLimit(c.id)
+		rate := structs.TokenRate{
+			Token:     redactedToken,
+			Requests:  c.requests,
+			Rate:      float64(c.requests) / s.tokenRates.window.Seconds(),
+			RateLimit: limit,
+		}
+		if showIDs {
+			rate.Token = c.id
+		}
+		if _, token, err := state.ACLGet(nil, c.id); err == nil && token != nil {
+			rate.Name = token.Name
+		}
+		rates = append(rates, rate)
+	}
+	return rates
+}
+
+// tokenRateStats periodically emits the rates of the busiest tokens.
+func (s *Server) tokenRateStats() {
+	for {
+		select {
+		case <-time.After(tokenRateStatsInterval):
+			s.emitTokenRateStats()
+
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// emitTokenRateStats sets a gauge for each of the tokenRateRanks with the
+// rate of the token at that rank, or zero if there aren't that many tokens.
+func (s *Server) emitTokenRateStats() {
+	max := tokenRateRanks[len(tokenRateRanks)-1]
+	rates := s.topTokens(max, false)
+	for _, rank := range tokenRateRanks {
+		var rate float64
+		if rank <= len(rates) {
+			rate = rates[rank-1].Rate
+		}
+		metrics.SetGauge([]string{"consul", "acl", "token_rate", fmt.Sprintf("rank_%d", rank)}, float32(rate))
+	}
+}
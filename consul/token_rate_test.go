@@ -0,0 +1,310 @@
+package consul
+
+import (
+	"fmt"
+	"net/rpc"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/lib"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+// fixedTokenRate returns a resolver that knows every token, with the given
+// rate limit.
+func fixedTokenRate(limit float64) tokenRateResolver {
+	return func(string) (float64, bool) {
+		return limit, true
+	}
+}
+
+func TestTokenRateTracker(t *testing.T) {
+	tracker, err := newTokenRateTracker(time.Minute, 2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Count some requests a few seconds apart.
+	start := time.Now()
+	if err := tracker.record("bar", fixedTokenRate(0), start); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := tracker.record("foo", fixedTokenRate(0), start.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	top := tracker.top(10, start.Add(3*time.Second))
+	expected := []tokenRateCount{{"foo", 3}, {"bar", 1}}
+	if len(top) != 2 || top[0] != expected[0] || top[1] != expected[1] {
+		t.Fatalf("bad: %v", top)
+	}
+	if top := tracker.top(1, start.Add(3*time.Second)); len(top) != 1 || top[0] != expected[0] {
+		t.Fatalf("bad: %v", top)
+	}
+
+	// Once the window slides past the first requests they drop out.
+	top = tracker.top(10, start.Add(time.Minute+time.Second))
+	if len(top) != 1 || top[0] != (tokenRateCount{"foo", 1}) {
+		t.Fatalf("bad: %v", top)
+	}
+
+	// Only two tokens are tracked, so a new one pushes out the least
+	// recently used.
+	if err := tracker.record("baz", fixedTokenRate(0), start.Add(3*time.Second)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	top = tracker.top(10, start.Add(3*time.Second))
+	expected = []tokenRateCount{{"foo", 3}, {"baz", 1}}
+	if len(top) != 2 || top[0] != expected[0] || top[1] != expected[1] {
+		t.Fatalf("bad: %v", top)
+	}
+
+	// Tokens that aren't known aren't tracked, so they can't push out the
+	// real ones.
+	unknown := func(string) (float64, bool) { return 0, false }
+	for i := 0; i < 10; i++ {
+		if err := tracker.record(fmt.Sprintf("bogus%d", i), unknown, start.Add(3*time.Second)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	top = tracker.top(10, start.Add(3*time.Second))
+	if len(top) != 2 || top[0] != expected[0] || top[1] != expected[1] {
+		t.Fatalf("bad: %v", top)
+	}
+}
+
+func TestTokenRateTracker_Limit(t *testing.T) {
+	tracker, err := newTokenRateTracker(time.Minute, 10)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A burst of up to the limit is allowed, and then it's enforced.
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := tracker.record("foo", fixedTokenRate(5), now); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	err = tracker.record("foo", fixedTokenRate(5), now)
+	if !structs.HasErrorCode(err, structs.ErrCodeTokenRateLimited) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Rejected requests still count.
+	if top := tracker.top(10, now); len(top) != 1 || top[0].requests != 6 {
+		t.Fatalf("bad: %v", top)
+	}
+
+	// The allowance refills at the limit.
+	now = now.Add(200 * time.Millisecond)
+	if err := tracker.record("foo", fixedTokenRate(5), now); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := tracker.record("foo", fixedTokenRate(5), now); !structs.HasErrorCode(err, structs.ErrCodeTokenRateLimited) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Other tokens aren't affected.
+	if err := tracker.record("bar", fixedTokenRate(0), now); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The limit is cached, so it's only looked up again after a while.
+	lookups := 0
+	counting := func(string) (float64, bool) {
+		lookups++
+		return 5, true
+	}
+	for i := 0; i < 3; i++ {
+		tracker.record("foo", counting, now)
+	}
+	if lookups != 0 {
+		t.Fatalf("bad: %d", lookups)
+	}
+	tracker.record("foo", counting, now.Add(tokenRateResolveInterval))
+	if lookups != 1 {
+		t.Fatalf("bad: %d", lookups)
+	}
+}
+
+// makeTestToken creates a client token with the given rules and rate limit.
+func makeTestToken(t *testing.T, codec rpc.ClientCodec, rules string, limit float64) string {
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:      "User token",
+			Type:      structs.ACLTypeClient,
+			Rules:     rules,
+			RateLimit: limit,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return id
+}
+
+func TestOperator_TopTokens(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	busy := makeTestToken(t, codec, `node "" { policy = "read" }`, 0)
+	quiet := makeTestToken(t, codec, `node "" { policy = "read" }`, 0)
+	operator := makeTestToken(t, codec, `operator = "read"`, 0)
+
+	// Hammer the server with the two tokens at different rates.
+	for i := 0; i < 30; i++ {
+		token := busy
+		if i%3 == 0 {
+			token = quiet
+		}
+		arg := structs.DCSpecificRequest{
+			Datacenter:   "dc1",
+			QueryOptions: structs.QueryOptions{Token: token},
+		}
+		var out structs.IndexedNodes
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The busiest tokens should come first. The management token has only
+	// made a few requests.
+	arg := structs.TopTokensRequest{
+		Datacenter:   "dc1",
+		QueryOptions: structs.QueryOptions{Token: "root"},
+	}
+	var reply structs.TopTokensReply
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.TopTokens", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Node != s1.config.NodeName || reply.Window != s1.config.TokenRateWindow {
+		t.Fatalf("bad: %#v", reply)
+	}
+	if len(reply.Tokens) < 3 {
+		t.Fatalf("bad: %#v", reply.Tokens)
+	}
+	if reply.Tokens[0].Token != busy || reply.Tokens[0].Requests != 20 || reply.Tokens[0].Name != "User token" {
+		t.Fatalf("bad: %#v", reply.Tokens[0])
+	}
+	if reply.Tokens[1].Token != quiet || reply.Tokens[1].Requests != 10 {
+		t.Fatalf("bad: %#v", reply.Tokens[1])
+	}
+	if reply.Tokens[2].Token != "root" {
+		t.Fatalf("bad: %#v", reply.Tokens[2])
+	}
+
+	// A limit cuts the list short.
+	arg.Limit = 1
+	reply = structs.TopTokensReply{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.TopTokens", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Tokens) != 1 || reply.Tokens[0].Token != busy {
+		t.Fatalf("bad: %#v", reply.Tokens)
+	}
+
+	// Token IDs are redacted for tokens that can't list ACLs.
+	arg.Token = operator
+	reply = structs.TopTokensReply{}
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.TopTokens", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Tokens) != 1 || reply.Tokens[0].Token != redactedToken || reply.Tokens[0].Requests != 20 {
+		t.Fatalf("bad: %#v", reply.Tokens)
+	}
+
+	// Tokens without operator read can't see any of this.
+	arg.Token = quiet
+	err := msgpackrpc.CallWithCodec(codec, "Operator.TopTokens", &arg, &reply)
+	if err == nil || err.Error() != permissionDenied {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestOperator_TopTokens_RateLimit(t *testing.T) {
+	clock := lib.NewFakeClock(time.Now())
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.Clock = clock
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	limited := makeTestToken(t, codec, `node "" { policy = "read" }`, 5)
+	unlimited := makeTestToken(t, codec, `node "" { policy = "read" }`, 0)
+	listNodes := func(token string) error {
+		arg := structs.DCSpecificRequest{
+			Datacenter:   "dc1",
+			QueryOptions: structs.QueryOptions{Token: token},
+		}
+		var out structs.IndexedNodes
+		return msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &arg, &out)
+	}
+
+	// The limited token gets a burst of five requests, and the rest are
+	// rejected. The other token is unaffected.
+	for i := 0; i < 5; i++ {
+		if err := listNodes(limited); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := listNodes(limited); !structs.HasErrorCode(err, structs.ErrCodeTokenRateLimited) {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := listNodes(unlimited); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// After a second it can make requests again.
+	clock.Advance(time.Second)
+	if err := listNodes(limited); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The rejected requests are still counted.
+	arg := structs.TopTokensRequest{
+		Datacenter:   "dc1",
+		QueryOptions: structs.QueryOptions{Token: "root"},
+	}
+	var reply structs.TopTokensReply
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.TopTokens", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Tokens) < 2 {
+		t.Fatalf("bad: %#v", reply.Tokens)
+	}
+	if reply.Tokens[0].Token != unlimited || reply.Tokens[0].Requests != 10 || reply.Tokens[0].RateLimit != 0 {
+		t.Fatalf("bad: %#v", reply.Tokens[0])
+	}
+	if reply.Tokens[1].Token != limited || reply.Tokens[1].Requests != 9 || reply.Tokens[1].RateLimit != 5 {
+		t.Fatalf("bad: %#v", reply.Tokens[1])
+	}
+}
@@ -15,14 +15,24 @@ type Txn struct {
 }
 
 // preCheck is used to verify the incoming operations before any further
-// processing takes place. This checks things like ACLs.
-func (t *Txn) preCheck(acl acl.ACL, ops structs.TxnOps) structs.TxnErrors {
+// processing takes place. This checks things like ACLs and the reserved KV
+// flags, which are checked against the state before the transaction, so
+// flags set by earlier operations don't count.
+func (t *Txn) preCheck(acl acl.ACL, ops structs.TxnOps, overrideFlags bool) structs.TxnErrors {
 	var errors structs.TxnErrors
 
 	// Perform the pre-apply checks for any KV operations.
 	for i, op := range ops {
 		if op.KV != nil {
-			ok, err := kvsPreApply(t.srv, acl, op.KV.Verb, &op.KV.DirEnt)
+			op.KV.MaxTombstones = 0
+			if op.KV.Verb == structs.KVSDeleteTree {
+				op.KV.MaxTombstones = t.srv.config.MaxTombstonesPerApply
+			}
+
+			ok, err := kvsPreApply(t.srv, acl, op.KV.Verb, &op.KV.DirEnt, overrideFlags)
+			if err == nil {
+				err = t.checkSession(op.KV)
+			}
 			if err != nil {
 				errors = append(errors, &structs.TxnError{
 					OpIndex: i,
@@ -41,6 +51,88 @@ func (t *Txn) preCheck(acl acl.ACL, ops structs.TxnOps) structs.TxnErrors {
 	return errors
 }
 
+// resolveVerbAliases turns the kv-lock and kv-unlock aliases into the lock and
+// unlock verbs they stand for, so only verbs every server knows go into Raft.
+func resolveVerbAliases(ops structs.TxnOps) {
+	for _, op := range ops {
+		if op.KV == nil {
+			continue
+		}
+		switch op.KV.Verb {
+		case structs.KVSTxnLock:
+			op.KV.Verb = structs.KVSLock
+		case structs.KVSTxnUnlock:
+			op.KV.Verb = structs.KVSUnlock
+		}
+	}
+}
+
+// checkSession makes sure that lock and unlock operations refer to a valid
+// session, so a transaction with a bad session is rejected before it's sent
+// into Raft. The session is checked again when the transaction is applied.
+func (t *Txn) checkSession(op *structs.TxnKVOp) error {
+	if op.Verb != structs.KVSLock && op.Verb != structs.KVSUnlock {
+		return nil
+	}
+
+	if op.DirEnt.Session == "" {
+		return fmt.Errorf("Must provide session to %s key %q", op.Verb, op.DirEnt.Key)
+	}
+	state := t.srv.fsm.State()
+	_, session, err := state.SessionGet(nil, op.DirEnt.Session)
+	if err != nil {
+		return err
+	}
+	if session == nil {
+		return fmt.Errorf("invalid session %q", op.DirEnt.Session)
+	}
+	return nil
+}
+
+// checkSize makes sure the transaction isn't too big to send into Raft. If it
+// is, the error points at the operation that took it over the limit.
+func (t *Txn) checkSize(args *structs.TxnRequest) (*structs.TxnError, error) {
+	max := t.srv.config.RaftMaxEntrySize
+	if max <= 0 {
+		return nil, nil
+	}
+	buf, err := structs.Encode(structs.TxnRequestType, args)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode request: %v", err)
+	}
+	if len(buf) <= max {
+		return nil, nil
+	}
+	metrics.IncrCounter([]string{"consul", "raft", "apply", "too_large"}, 1)
+	tooLarge := &structs.TxnError{
+		OpIndex: len(args.Ops) - 1,
+		What:    (&structs.TooLargeError{Size: len(buf), Max: max}).Error(),
+	}
+
+	// Add up the encoded operations to find the one that took it over,
+	// starting with everything but the operations.
+	base := *args
+	base.Ops = nil
+	enc, err := structs.Encode(structs.TxnRequestType, &base)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode request: %v", err)
+	}
+	size := len(enc)
+	for i, op := range args.Ops {
+		enc, err := structs.Encode(structs.TxnRequestType, op)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to encode request: %v", err)
+		}
+		// Leave out the message type, which is only sent once.
+		size += len(enc) - 1
+		if size > max {
+			tooLarge.OpIndex = i
+			break
+		}
+	}
+	return tooLarge, nil
+}
+
 // Apply is used to apply multiple operations in a single, atomic transaction.
 func (t *Txn) Apply(args *structs.TxnRequest, reply *structs.TxnResponse) error {
 	if done, err := t.srv.forward("Txn.Apply", args, args, reply); done {
@@ -49,14 +141,28 @@ func (t *Txn) Apply(args *structs.TxnRequest, reply *structs.TxnResponse) error
 	defer metrics.MeasureSince([]string{"consul", "txn", "apply"}, time.Now())
 
 	// Run the pre-checks before we send the transaction into Raft.
-	acl, err := t.srv.resolveToken(args.Token)
+	resolveVerbAliases(args.Ops)
+	acl, err := t.srv.resolveToken("Txn.Apply", args.Token)
 	if err != nil {
 		return err
 	}
-	reply.Errors = t.preCheck(acl, args.Ops)
+	reply.Errors = t.preCheck(acl, args.Ops, args.OverrideFlags)
 	if len(reply.Errors) > 0 {
 		return nil
 	}
+	for _, op := range args.Ops {
+		if op.KV != nil {
+			kvsStampMetadata(t.srv, args.Token, &op.KV.DirEnt)
+		}
+	}
+	tooLarge, err := t.checkSize(args)
+	if err != nil {
+		return err
+	}
+	if tooLarge != nil {
+		reply.Errors = structs.TxnErrors{tooLarge}
+		return nil
+	}
 
 	// Apply the update.
 	resp, err := t.srv.raftApply(structs.TxnRequestType, args)
@@ -73,6 +179,7 @@ func (t *Txn) Apply(args *structs.TxnRequest, reply *structs.TxnResponse) error
 	if txnResp, ok := resp.(structs.TxnResponse); ok {
 		if acl != nil {
 			txnResp.Results = FilterTxnResults(acl, txnResp.Results)
+			redactTxnResults(acl, txnResp.Results)
 		}
 		*reply = txnResp
 	} else {
@@ -100,11 +207,11 @@ func (t *Txn) Read(args *structs.TxnReadRequest, reply *structs.TxnReadResponse)
 	}
 
 	// Run the pre-checks before we perform the read.
-	acl, err := t.srv.resolveToken(args.Token)
+	acl, err := t.srv.resolveToken("Txn.Read", args.Token)
 	if err != nil {
 		return err
 	}
-	reply.Errors = t.preCheck(acl, args.Ops)
+	reply.Errors = t.preCheck(acl, args.Ops, false)
 	if len(reply.Errors) > 0 {
 		return nil
 	}
@@ -114,6 +221,17 @@ func (t *Txn) Read(args *structs.TxnReadRequest, reply *structs.TxnReadResponse)
 	reply.Results, reply.Errors = state.TxnRO(args.Ops)
 	if acl != nil {
 		reply.Results = FilterTxnResults(acl, reply.Results)
+		redactTxnResults(acl, reply.Results)
 	}
 	return nil
 }
+
+// redactTxnResults blanks out the tokens in the metadata of any KV entries in
+// the results, unless the ACL is allowed to see tokens.
+func redactTxnResults(acl acl.ACL, results structs.TxnResults) {
+	for _, r := range results {
+		if r.KV != nil {
+			r.KV = redactDirEntMetadata(acl, structs.DirEntries{r.KV})[0]
+		}
+	}
+}
@@ -2,12 +2,15 @@ package consul
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/consul/consul/state"
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/testutil"
 	"github.com/hashicorp/net-rpc-msgpackrpc"
@@ -262,6 +265,203 @@ func TestTxn_Apply_ACLDeny(t *testing.T) {
 	}
 }
 
+func TestTxn_Apply_TooLarge(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.RaftMaxEntrySize = 4096
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Each of these fits on its own, but the third one takes the
+	// transaction over the limit.
+	var ops structs.TxnOps
+	for _, key := range []string{"a", "b", "c", "d"} {
+		ops = append(ops, &structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb: structs.KVSSet,
+				DirEnt: structs.DirEntry{
+					Key:   key,
+					Value: bytes.Repeat([]byte("x"), 1500),
+				},
+			},
+		})
+	}
+	arg := structs.TxnRequest{
+		Datacenter: "dc1",
+		Ops:        ops,
+	}
+	var out structs.TxnResponse
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 1 || out.Errors[0].OpIndex != 2 ||
+		!structs.HasErrorCode(out.Errors[0], structs.ErrCodeTooLarge) ||
+		!strings.Contains(out.Errors[0].What, "limit is 4096 bytes") {
+		t.Fatalf("bad: %v", out.Errors)
+	}
+
+	// Nothing should have been written.
+	_, d, err := s1.fsm.State().KVSGet(nil, "a")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d != nil {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// The first two go through on their own.
+	arg.Ops = ops[:2]
+	out = structs.TxnResponse{}
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 0 || len(out.Results) != 2 {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestTxn_Apply_ReservedFlags(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Create a token that can write all the keys.
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: `key "" { policy = "write" }`,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var user string
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &user); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Create a write-once key and an immutable one.
+	op := func(verb structs.KVSOp, key string, flags uint64) *structs.TxnOp {
+		return &structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb: verb,
+				DirEnt: structs.DirEntry{
+					Key:   key,
+					Flags: flags,
+					Value: []byte("test"),
+				},
+			},
+		}
+	}
+	txn := structs.TxnRequest{
+		Datacenter: "dc1",
+		Ops: structs.TxnOps{
+			op(structs.KVSSet, "once", structs.KVFlagWriteOnce),
+			op(structs.KVSSet, "imm", structs.KVFlagImmutable|7),
+		},
+		WriteRequest: structs.WriteRequest{Token: user},
+	}
+	var out structs.TxnResponse
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &txn, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 0 || len(out.Results) != 2 {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// The user shouldn't be able to change either, and nothing else in
+	// the transaction should go through.
+	txn.Ops = structs.TxnOps{
+		op(structs.KVSSet, "other", 0),
+		op(structs.KVSSet, "once", 0),
+		op(structs.KVSDelete, "imm", 0),
+		op(structs.KVSCAS, "imm", 7),
+	}
+	out = structs.TxnResponse{}
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &txn, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 3 {
+		t.Fatalf("bad: %v", out.Errors)
+	}
+	for i, e := range out.Errors {
+		if e.OpIndex != i+1 || !structs.HasErrorCode(e, structs.ErrCodeKVFlag) {
+			t.Fatalf("bad: %v", e)
+		}
+	}
+	_, d, err := s1.fsm.State().KVSGet(nil, "other")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d != nil {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Even a management token needs to override the flags, and they're
+	// checked against the state before the transaction, so a flag set
+	// earlier in it doesn't count.
+	txn.Ops = structs.TxnOps{
+		op(structs.KVSSet, "imm", 7),
+		op(structs.KVSSet, "new", structs.KVFlagWriteOnce),
+		op(structs.KVSSet, "new", 0),
+	}
+	txn.Token = "root"
+	out = structs.TxnResponse{}
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &txn, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 1 || out.Errors[0].OpIndex != 0 {
+		t.Fatalf("bad: %v", out.Errors)
+	}
+
+	// Overriding the flags needs a management token.
+	txn.OverrideFlags = true
+	txn.Token = user
+	out = structs.TxnResponse{}
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &txn, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 3 || !strings.Contains(out.Errors[0].What, permissionDenied) {
+		t.Fatalf("bad: %v", out.Errors)
+	}
+	_, d, err = s1.fsm.State().KVSGet(nil, "imm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || d.Flags != structs.KVFlagImmutable|7 {
+		t.Fatalf("bad: %v", d)
+	}
+
+	txn.Token = "root"
+	out = structs.TxnResponse{}
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &txn, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 0 {
+		t.Fatalf("bad: %v", out.Errors)
+	}
+	_, d, err = s1.fsm.State().KVSGet(nil, "imm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || d.Flags != 7 {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
 func TestTxn_Apply_LockDelay(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -347,6 +547,213 @@ func TestTxn_Apply_LockDelay(t *testing.T) {
 	}
 }
 
+func TestTxn_Apply_LockSession(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	// Keep track of the verbs that go into Raft.
+	var lock sync.Mutex
+	verbs := make(map[structs.KVSOp]bool)
+	s1.RegisterChangeHook(structs.TxnRequestType, func(idx uint64, op interface{}) {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, txnOp := range op.(*structs.TxnRequest).Ops {
+			if txnOp.KV != nil {
+				verbs[txnOp.KV.Verb] = true
+			}
+		}
+	})
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Make two sessions to compete for the lock.
+	state := s1.fsm.State()
+	if err := state.EnsureNode(1, &structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session1 := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := state.SessionCreate(2, session1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session2 := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := state.SessionCreate(3, session2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// lockTxn acquires the lock with the given session and sets the two
+	// dependent keys in the same transaction.
+	lockTxn := func(session string, value string) structs.TxnRequest {
+		return structs.TxnRequest{
+			Datacenter: "dc1",
+			Ops: structs.TxnOps{
+				&structs.TxnOp{
+					KV: &structs.TxnKVOp{
+						Verb: structs.KVSTxnLock,
+						DirEnt: structs.DirEntry{
+							Key:     "test/lock",
+							Session: session,
+						},
+					},
+				},
+				&structs.TxnOp{
+					KV: &structs.TxnKVOp{
+						Verb: structs.KVSSet,
+						DirEnt: structs.DirEntry{
+							Key:   "test/a",
+							Value: []byte(value),
+						},
+					},
+				},
+				&structs.TxnOp{
+					KV: &structs.TxnKVOp{
+						Verb: structs.KVSSet,
+						DirEnt: structs.DirEntry{
+							Key:   "test/b",
+							Value: []byte(value),
+						},
+					},
+				},
+			},
+		}
+	}
+
+	// verifyKeys checks the values of the dependent keys.
+	verifyKeys := func(value string) {
+		for _, key := range []string{"test/a", "test/b"} {
+			_, d, err := state.KVSGet(nil, key)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if d == nil || string(d.Value) != value {
+				t.Fatalf("bad: %v", d)
+			}
+		}
+	}
+
+	// Acquire the lock with the first session.
+	{
+		arg := lockTxn(session1.ID, "one")
+		var out structs.TxnResponse
+		if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(out.Errors) != 0 || len(out.Results) != 3 {
+			t.Fatalf("bad: %v", out)
+		}
+		if out.Results[0].KV.Session != session1.ID || out.Results[0].KV.LockIndex != 1 {
+			t.Fatalf("bad: %v", out.Results[0].KV)
+		}
+	}
+	verifyKeys("one")
+
+	// The second session should fail to get the lock, and none of the
+	// other writes should be applied.
+	{
+		arg := lockTxn(session2.ID, "two")
+		var out structs.TxnResponse
+		if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(out.Results) != 0 ||
+			len(out.Errors) != 1 ||
+			out.Errors[0].OpIndex != 0 ||
+			!strings.Contains(out.Errors[0].What, "lock is already held") {
+			t.Fatalf("bad: %v", out)
+		}
+	}
+	verifyKeys("one")
+
+	// A bad session should get rejected before it's applied.
+	{
+		arg := lockTxn(generateUUID(), "bad")
+		var out structs.TxnResponse
+		if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(out.Results) != 0 ||
+			len(out.Errors) != 1 ||
+			out.Errors[0].OpIndex != 0 ||
+			!strings.Contains(out.Errors[0].What, "invalid session") {
+			t.Fatalf("bad: %v", out)
+		}
+	}
+	verifyKeys("one")
+
+	// Release the lock and write a final value.
+	{
+		arg := structs.TxnRequest{
+			Datacenter: "dc1",
+			Ops: structs.TxnOps{
+				&structs.TxnOp{
+					KV: &structs.TxnKVOp{
+						Verb: structs.KVSTxnUnlock,
+						DirEnt: structs.DirEntry{
+							Key:     "test/lock",
+							Session: session1.ID,
+						},
+					},
+				},
+				&structs.TxnOp{
+					KV: &structs.TxnKVOp{
+						Verb: structs.KVSSet,
+						DirEnt: structs.DirEntry{
+							Key:   "test/a",
+							Value: []byte("done"),
+						},
+					},
+				},
+			},
+		}
+		var out structs.TxnResponse
+		if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(out.Errors) != 0 || len(out.Results) != 2 {
+			t.Fatalf("bad: %v", out)
+		}
+		if out.Results[0].KV.Session != "" {
+			t.Fatalf("bad: %v", out.Results[0].KV)
+		}
+	}
+	_, d, err := state.KVSGet(nil, "test/a")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "done" {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Now the second session can get the lock.
+	{
+		arg := lockTxn(session2.ID, "two")
+		var out structs.TxnResponse
+		if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(out.Errors) != 0 || len(out.Results) != 3 {
+			t.Fatalf("bad: %v", out)
+		}
+	}
+	verifyKeys("two")
+
+	// The aliases should have gone into Raft as plain locks and unlocks.
+	if err := testutil.WaitForResult(func() (bool, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return verbs[structs.KVSLock] && verbs[structs.KVSUnlock], fmt.Errorf("bad: %v", verbs)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if verbs[structs.KVSTxnLock] || verbs[structs.KVSTxnUnlock] {
+		t.Fatalf("bad: %v", verbs)
+	}
+}
+
 func TestTxn_Read(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -404,9 +811,16 @@ func TestTxn_Read(t *testing.T) {
 			},
 		},
 		QueryMeta: structs.QueryMeta{
-			KnownLeader: true,
+			KnownLeader:  true,
+			LastLeader:   s1.config.RPCAddr.String(),
+			RaftState:    "Leader",
+			AliveServers: 1,
 		},
 	}
+	if out.Server != s1.config.NodeName {
+		t.Fatalf("bad: %#v", out.ReplyMeta)
+	}
+	out.ReplyMeta = structs.ReplyMeta{}
 	if !reflect.DeepEqual(out, expected) {
 		t.Fatalf("bad %v", out)
 	}
@@ -503,7 +917,10 @@ func TestTxn_Read_ACLDeny(t *testing.T) {
 	// Verify the transaction's return value.
 	expected := structs.TxnReadResponse{
 		QueryMeta: structs.QueryMeta{
-			KnownLeader: true,
+			KnownLeader:  true,
+			LastLeader:   s1.config.RPCAddr.String(),
+			RaftState:    "Leader",
+			AliveServers: 1,
 		},
 	}
 	for i, op := range arg.Ops {
@@ -518,7 +935,69 @@ func TestTxn_Read_ACLDeny(t *testing.T) {
 			})
 		}
 	}
+	if out.Server != s1.config.NodeName {
+		t.Fatalf("bad: %#v", out.ReplyMeta)
+	}
+	out.ReplyMeta = structs.ReplyMeta{}
 	if !reflect.DeepEqual(out, expected) {
 		t.Fatalf("bad %v", out)
 	}
 }
+
+func TestTxn_Apply_MaxTombstones(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.MaxTombstonesPerApply = 1
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Write a couple of keys and then delete them with a transaction,
+	// trying to get around the leader's limit.
+	op := func(verb structs.KVSOp, key string) *structs.TxnOp {
+		return &structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb:          verb,
+				DirEnt:        structs.DirEntry{Key: key},
+				MaxTombstones: 100,
+			},
+		}
+	}
+	arg := structs.TxnRequest{
+		Datacenter: "dc1",
+		Ops: structs.TxnOps{
+			op(structs.KVSSet, "test/a"),
+			op(structs.KVSSet, "test/b"),
+		},
+	}
+	var out structs.TxnResponse
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Ops = structs.TxnOps{op(structs.KVSDeleteTree, "test/")}
+	out = structs.TxnResponse{}
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 0 {
+		t.Fatalf("bad: %v", out.Errors)
+	}
+
+	// There should be a single prefix tombstone.
+	snap := s1.fsm.State().Snapshot()
+	defer snap.Close()
+	stones, err := snap.Tombstones()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var keys []string
+	for stone := stones.Next(); stone != nil; stone = stones.Next() {
+		keys = append(keys, stone.(*state.Tombstone).Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"test/"}) {
+		t.Fatalf("bad: %v", keys)
+	}
+}
@@ -0,0 +1,88 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/agent"
+	"github.com/hashicorp/consul/consul/servers"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// wanLivenessMaxTries is the most servers that are checked in a remote
+	// datacenter before giving up and forwarding to the last one anyway.
+	wanLivenessMaxTries = 3
+)
+
+// A server in another datacenter can still be alive as far as Serf is
+// concerned even though its RPC port isn't answering, and forwarding to it
+// then costs a full dial timeout. Before forwarding a request that's
+// expensive to retry, a server we haven't heard from in a while gets a quick
+// ping, and if that doesn't come back in time the request goes to the next
+// server instead.
+
+// isCostlyForward returns true for requests that are worth checking the
+// remote server for before forwarding, which are writes and consistent reads.
+func isCostlyForward(args interface{}) bool {
+	info, ok := args.(structs.RPCInfo)
+	if !ok {
+		return false
+	}
+	if !info.IsRead() {
+		return true
+	}
+	if holder, ok := args.(structs.QueryOptionsHolder); ok {
+		return holder.GetQueryOptions().RequireConsistent
+	}
+	return false
+}
+
+// checkWANServer picks the server in the given datacenter to forward a
+// costly request to, skipping over servers that don't answer a quick ping.
+// Skipped servers are moved to the back of the list.
+func (s *Server) checkWANServer(dc string, manager *servers.Manager, server *agent.Server) (*servers.Manager, *agent.Server) {
+	for tries := 1; ; tries++ {
+		if s.wanServerAlive(server) {
+			return manager, server
+		}
+
+		metrics.IncrCounter([]string{"consul", "rpc", "wan_liveness", "avoided"}, 1)
+		s.logger.Printf("[WARN] consul.rpc: Server %s in DC %q didn't answer a ping, trying another server",
+			server.Addr, dc)
+		manager.NotifyFailedServer(server)
+		if tries >= wanLivenessMaxTries {
+			break
+		}
+
+		nextManager, next, ok := s.router.FindRoute(dc)
+		if !ok || next == server {
+			break
+		}
+		manager, server = nextManager, next
+	}
+	return manager, server
+}
+
+// wanServerAlive returns true if an RPC to the given server has succeeded
+// recently, or if it answers a ping within the liveness timeout. The ping
+// carries on in the background if it times out, so a slow connection can
+// still be set up for later requests.
+func (s *Server) wanServerAlive(server *agent.Server) bool {
+	if time.Since(s.connPool.LastSuccess(server.Addr)) < s.config.WANLivenessThreshold {
+		return true
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := s.connPool.PingConsulServer(server)
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		return err == nil
+	case <-time.After(s.config.WANLivenessTimeout):
+		return false
+	}
+}
@@ -0,0 +1,128 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestIsCostlyForward(t *testing.T) {
+	cases := []struct {
+		args     interface{}
+		expected bool
+	}{
+		{&structs.KVSRequest{}, true},
+		{&structs.KeyRequest{}, false},
+		{&structs.KeyRequest{QueryOptions: structs.QueryOptions{RequireConsistent: true}}, true},
+		{&structs.KeyRequest{QueryOptions: structs.QueryOptions{AllowStale: true}}, false},
+		{struct{}{}, false},
+	}
+	for _, tc := range cases {
+		if actual := isCostlyForward(tc.args); actual != tc.expected {
+			t.Fatalf("bad: %#v %v", tc.args, actual)
+		}
+	}
+}
+
+func TestServer_WANLivenessCheck(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.WANLivenessCheck = true
+		c.WANLivenessTimeout = 100 * time.Millisecond
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	// Dials to the blackholed address hang until they time out, like they
+	// would for a server whose RPC port has stopped answering.
+	var lock sync.Mutex
+	var blackholed string
+	s1.connPool.dialer = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		lock.Lock()
+		hang := address == blackholed
+		lock.Unlock()
+		if hang {
+			time.Sleep(timeout)
+			return nil, fmt.Errorf("i/o timeout")
+		}
+		return net.DialTimeout(network, address, timeout)
+	}
+
+	// Make a second datacenter with two servers.
+	dir2, s2 := testServerDC(t, "dc2")
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	dir3, s3 := testServerDCBootstrap(t, "dc2", false)
+	defer os.RemoveAll(dir3)
+	defer s3.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s2.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s3.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr = fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	for _, s := range []*Server{s2, s3} {
+		if _, err := s.JoinWAN([]string{addr}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	testutil.WaitForLeader(t, s2.RPC, "dc2")
+	if err := testutil.WaitForResult(func() (bool, error) {
+		manager, _, ok := s1.router.FindRoute("dc2")
+		return ok && manager.NumServers() == 2, nil
+	}); err != nil {
+		t.Fatalf("dc2 servers never showed up")
+	}
+
+	// Blackhole whichever server would be picked first.
+	_, first, _ := s1.router.FindRoute("dc2")
+	lock.Lock()
+	blackholed = first.Addr.String()
+	lock.Unlock()
+
+	// A forwarded write should go to the other server without waiting for
+	// the dial to time out.
+	start := time.Now()
+	arg := structs.KVSRequest{
+		Datacenter: "dc2",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "foo",
+			Value: []byte("bar"),
+		},
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > defaultDialTimeout/2 {
+		t.Fatalf("took too long: %v", elapsed)
+	}
+
+	// The dead server should have been moved out of the way, and the one
+	// that answered shouldn't need to be pinged for a while.
+	_, next, _ := s1.router.FindRoute("dc2")
+	if next == first {
+		t.Fatalf("server should have been demoted")
+	}
+	if last := s1.connPool.LastSuccess(next.Addr); time.Since(last) > time.Second {
+		t.Fatalf("bad: %v", last)
+	}
+	if !s1.wanServerAlive(next) {
+		t.Fatalf("should be alive")
+	}
+	if s1.wanServerAlive(first) {
+		t.Fatalf("should not be alive")
+	}
+}
@@ -0,0 +1,223 @@
+package consul
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// wanProxyError is returned when a connection through the WAN proxy fails,
+// so it can be told apart from the destination server being unreachable.
+type wanProxyError struct {
+	proxy string
+	err   error
+}
+
+func (e *wanProxyError) Error() string {
+	return fmt.Sprintf("WAN proxy %s: %v", e.proxy, e.err)
+}
+
+// newWANProxyDialer returns a dialer that connects through the proxy at the
+// given URL, which can be socks5:// or http:// for HTTP CONNECT. Credentials
+// in the URL are used to authenticate with the proxy. The proxy itself is
+// dialed with base. The proxy only sees a tunnel, so TLS is still end to end
+// with the destination server.
+func newWANProxyDialer(rawURL string, base DialerFunc) (DialerFunc, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid WAN proxy URL: %v", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Invalid WAN proxy URL %q: missing host", rawURL)
+	}
+
+	var handshake func(conn net.Conn, u *url.URL, address string) (net.Conn, error)
+	var defaultPort string
+	switch u.Scheme {
+	case "socks5":
+		handshake, defaultPort = socks5Connect, "1080"
+	case "http":
+		handshake, defaultPort = httpConnect, "80"
+	default:
+		return nil, fmt.Errorf("Unsupported WAN proxy scheme %q, must be socks5 or http", u.Scheme)
+	}
+
+	// Use the hostname rather than the host, which keeps the brackets
+	// around an IPv6 address.
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		proxyAddr = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+
+	return func(network, address string, timeout time.Duration) (net.Conn, error) {
+		fail := func(err error) (net.Conn, error) {
+			metrics.IncrCounter([]string{"consul", "rpc", "wan_proxy", "error"}, 1)
+			return nil, &wanProxyError{proxy: proxyAddr, err: err}
+		}
+
+		conn, err := base(network, proxyAddr, timeout)
+		if err != nil {
+			return fail(err)
+		}
+
+		// The handshake shares the dial timeout.
+		if timeout > 0 {
+			conn.SetDeadline(time.Now().Add(timeout))
+		}
+		tunnel, err := handshake(conn, u, address)
+		if err != nil {
+			conn.Close()
+			return fail(err)
+		}
+		conn.SetDeadline(time.Time{})
+
+		metrics.IncrCounter([]string{"consul", "rpc", "wan_proxy", "connect"}, 1)
+		return tunnel, nil
+	}, nil
+}
+
+// socks5Connect asks a SOCKS5 proxy to connect to the given address, as
+// described in RFC 1928. Username and password authentication from RFC 1929
+// is used if the URL has credentials.
+func socks5Connect(conn net.Conn, u *url.URL, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	// Offer no authentication, plus username and password if we have
+	// them.
+	methods := []byte{0x00}
+	if u.User != nil {
+		methods = append(methods, 0x02)
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	if buf[0] != 0x05 {
+		return nil, fmt.Errorf("unexpected SOCKS version %d", buf[0])
+	}
+	switch buf[1] {
+	case 0x00:
+	case 0x02:
+		if u.User == nil {
+			return nil, fmt.Errorf("SOCKS proxy wants credentials")
+		}
+		user := u.User.Username()
+		pass, _ := u.User.Password()
+		req := []byte{0x01, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+		if buf[1] != 0x00 {
+			return nil, fmt.Errorf("SOCKS proxy authentication failed")
+		}
+	default:
+		return nil, fmt.Errorf("SOCKS proxy didn't accept any authentication methods")
+	}
+
+	// Ask for the connection.
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 0x01)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	// Read the reply and skip over the bound address.
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	if reply[1] != 0x00 {
+		return nil, fmt.Errorf("SOCKS proxy couldn't connect to %s, reply code %d", address, reply[1])
+	}
+	var skip int
+	switch reply[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return nil, err
+		}
+		skip = int(buf[0])
+	default:
+		return nil, fmt.Errorf("unexpected SOCKS address type %d", reply[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// httpConnect asks an HTTP proxy to open a tunnel to the given address with
+// the CONNECT method. Basic authentication is used if the URL has
+// credentials.
+func httpConnect(conn net.Conn, u *url.URL, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP proxy couldn't connect to %s: %s", address, resp.Status)
+	}
+
+	// The server doesn't talk first, but hang onto anything that was read
+	// past the response just in case.
+	if br.Buffered() > 0 {
+		return &peekedConn{Conn: conn, reader: br}, nil
+	}
+	return conn, nil
+}
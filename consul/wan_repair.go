@@ -0,0 +1,100 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// runWANRepair periodically looks for servers that other datacenters can see
+// in the WAN pool but we can't, and joins them. Gossip normally takes care of
+// this, but it can't when the network only lets some servers reach others.
+func (s *Server) runWANRepair(stopCh chan struct{}) {
+	ticker := s.clock.NewTicker(s.config.WANRepairInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-s.shutdownCh:
+			return
+		case <-ticker.C():
+		}
+
+		s.repairWAN()
+	}
+}
+
+// repairWAN pulls the WAN members from a server in each known remote
+// datacenter and joins the ones missing from our own pool, up to the
+// configured limit. It returns the number of servers it joined.
+func (s *Server) repairWAN() int {
+	defer metrics.MeasureSince([]string{"consul", "leader", "wan_repair"}, time.Now())
+
+	if s.getSerfWAN() == nil {
+		return 0
+	}
+	known := make(map[string]struct{})
+	for _, m := range s.WANMembers() {
+		known[m.Name] = struct{}{}
+	}
+
+	// Gather the servers that are missing. A server can show up in the
+	// view from more than one datacenter, so these are de-duplicated by
+	// name.
+	missing := make(map[string]structs.WANMember)
+	for _, dc := range s.router.GetDatacenters() {
+		if dc == s.config.Datacenter {
+			continue
+		}
+
+		var remote structs.WANMembers
+		if err := s.forwardDC("Status.WANMembers", dc, struct{}{}, &remote); err != nil {
+			s.logger.Printf("[WARN] consul: Failed to get WAN members from DC %q for repair: %v", dc, err)
+			continue
+		}
+		for _, m := range remote {
+			if _, ok := known[m.Name]; !ok {
+				missing[m.Name] = m
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return 0
+	}
+
+	// Join them in a stable order, so a run that hits the limit doesn't
+	// skip the same servers every time.
+	names := make([]string, 0, len(missing))
+	for name := range missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	joined := 0
+	for i, name := range names {
+		if max := s.config.WANRepairMaxJoins; max > 0 && i >= max {
+			s.logger.Printf("[INFO] consul: Reached WAN repair limit, %d missing server(s) left for the next run",
+				len(names)-i)
+			break
+		}
+
+		m := missing[name]
+		addr := net.JoinHostPort(m.Addr, fmt.Sprintf("%d", m.Port))
+		if _, err := s.JoinWAN([]string{addr}); err != nil {
+			metrics.IncrCounter([]string{"consul", "leader", "wan_repair", "failed"}, 1)
+			s.logger.Printf("[WARN] consul: Failed to join missing WAN server %q at %s: %v", name, addr, err)
+			continue
+		}
+		metrics.IncrCounter([]string{"consul", "leader", "wan_repair", "joined"}, 1)
+		s.logger.Printf("[INFO] consul: Joined WAN server %q in DC %q, which was missing from our WAN pool",
+			name, m.Datacenter)
+		joined++
+	}
+	return joined
+}
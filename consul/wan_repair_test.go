@@ -0,0 +1,132 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+// testWANNoGossip turns off gossip in the WAN pool, so servers only learn
+// about each other when they join.
+func testWANNoGossip(c *Config) {
+	c.SerfWANConfig.MemberlistConfig.ProbeInterval = 0
+	c.SerfWANConfig.MemberlistConfig.PushPullInterval = 0
+	c.SerfWANConfig.MemberlistConfig.GossipNodes = 0
+	c.WANRepairInterval = 0
+}
+
+func testJoinWANTo(t *testing.T, s *Server, other *Server) {
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		other.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func testHasWANMember(s *Server, dc string) bool {
+	for _, m := range s.WANMembers() {
+		if m.Tags["dc"] == dc {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServer_RepairWAN(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		testWANNoGossip(c)
+		c.WANRepairMaxJoins = 1
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	var servers []*Server
+	for _, dc := range []string{"dc2", "dc3", "dc4"} {
+		dir, s := testServerWithConfig(t, func(c *Config) {
+			testWANNoGossip(c)
+			c.Datacenter = dc
+		})
+		defer os.RemoveAll(dir)
+		defer s.Shutdown()
+		servers = append(servers, s)
+	}
+	s2, s3, s4 := servers[0], servers[1], servers[2]
+
+	// Join dc1 to dc2, and then dc3 and dc4 to dc2 only. Without gossip
+	// dc2 never passes dc3 and dc4 along to dc1.
+	testJoinWANTo(t, s1, s2)
+	testJoinWANTo(t, s3, s2)
+	testJoinWANTo(t, s4, s2)
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return len(s1.router.GetDatacenters()) == 2 && len(s2.WANMembers()) == 4, nil
+	}); err != nil {
+		t.Fatalf("bad: %v", s2.WANMembers())
+	}
+	time.Sleep(200 * time.Millisecond)
+	if testHasWANMember(s1, "dc3") || testHasWANMember(s1, "dc4") {
+		t.Fatalf("bad: %v", s1.WANMembers())
+	}
+
+	// Each repair should only join one missing server, because of the
+	// limit.
+	if n := s1.repairWAN(); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	if !testHasWANMember(s1, "dc3") || testHasWANMember(s1, "dc4") {
+		t.Fatalf("bad: %v", s1.WANMembers())
+	}
+	if n := s1.repairWAN(); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	if !testHasWANMember(s1, "dc4") {
+		t.Fatalf("bad: %v", s1.WANMembers())
+	}
+
+	// There's nothing left to repair.
+	if n := s1.repairWAN(); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestLeader_WANRepair(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		testWANNoGossip(c)
+		c.WANRepairInterval = 100 * time.Millisecond
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		testWANNoGossip(c)
+		c.Datacenter = "dc2"
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	dir3, s3 := testServerWithConfig(t, func(c *Config) {
+		testWANNoGossip(c)
+		c.Datacenter = "dc3"
+	})
+	defer os.RemoveAll(dir3)
+	defer s3.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Join dc1 to dc2, and dc3 to dc2 only. The leader in dc1 should
+	// find dc3 through dc2 and join it without any help.
+	testJoinWANTo(t, s1, s2)
+	testJoinWANTo(t, s3, s2)
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return testHasWANMember(s1, "dc3"), nil
+	}); err != nil {
+		t.Fatalf("bad: %v", s1.WANMembers())
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return len(s1.router.GetDatacenters()) == 3, nil
+	}); err != nil {
+		t.Fatalf("bad: %v", s1.router.GetDatacenters())
+	}
+}
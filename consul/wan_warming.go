@@ -0,0 +1,90 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	// wanWarmingInterval is how often servers check their warm connections
+	// to other datacenters when nothing has changed. This needs to be well
+	// under serverRPCCache so the connections don't get reaped.
+	wanWarmingInterval = 30 * time.Second
+)
+
+// wanWarmingLoop keeps RPC connections open to a server in each remote
+// datacenter, checking them periodically, whenever the WAN membership
+// changes, and after failed requests.
+func (s *Server) wanWarmingLoop() {
+	ticker := s.clock.NewTicker(wanWarmingInterval)
+	defer ticker.Stop()
+
+	for {
+		s.warmWANConnections()
+
+		select {
+		case <-s.shutdownCh:
+			return
+		case <-s.router.ChangeCh():
+		case <-s.wanWarmCh:
+		case <-ticker.C():
+		}
+	}
+}
+
+// triggerWANWarming asks the warming loop to check its connections now. This
+// is a no-op if connection warming isn't enabled.
+func (s *Server) triggerWANWarming() {
+	if s.wanWarmCh == nil {
+		return
+	}
+	select {
+	case s.wanWarmCh <- struct{}{}:
+	default:
+	}
+}
+
+// warmWANConnections makes sure there's a working connection to the best
+// server in each of the closest remote datacenters, up to the configured
+// limit.
+func (s *Server) warmWANConnections() {
+	dcs, err := s.router.GetDatacentersByDistance()
+	if err != nil {
+		s.logger.Printf("[WARN] consul: Failed to get datacenters for connection warming: %v", err)
+		return
+	}
+
+	var tried, warm int
+	for _, dc := range dcs {
+		if dc == s.config.Datacenter {
+			continue
+		}
+		if max := s.config.WANConnectionWarmingMaxDCs; max > 0 && tried >= max {
+			break
+		}
+		tried++
+
+		manager, server, ok := s.router.FindRoute(dc)
+		if !ok {
+			continue
+		}
+
+		// If this fails we move on to another server, which we'll try to
+		// warm up next time around.
+		start := time.Now()
+		dialed, err := s.connPool.Warm(server)
+		if err != nil {
+			manager.NotifyFailedServer(server)
+			metrics.IncrCounter([]string{"consul", "rpc", "wan_warming", "failed"}, 1)
+			s.logger.Printf("[DEBUG] consul: Failed to warm connection to server %s in DC %q: %v",
+				server.Addr, dc, err)
+			continue
+		}
+		if dialed {
+			metrics.MeasureSince([]string{"consul", "rpc", "wan_warming", "setup_time"}, start)
+		}
+		warm++
+	}
+	metrics.SetGauge([]string{"consul", "rpc", "wan_warming", "connections"}, float32(warm))
+}
@@ -0,0 +1,134 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestServer_WANConnectionWarming(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.WANConnectionWarming = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerDC(t, "dc2")
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	// Join the servers, which should kick off warming.
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s2.RPC, "dc2")
+
+	// Wait for the connection to dc2 to show up in the pool.
+	target := s2.config.RPCAddr.String()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		s1.connPool.Lock()
+		_, ok := s1.connPool.pool[target]
+		s1.connPool.Unlock()
+		return ok, nil
+	}); err != nil {
+		t.Fatalf("connection to dc2 was never warmed")
+	}
+
+	// A forwarded request shouldn't need to dial.
+	dials := s1.connPool.Dials()
+	args := structs.DCSpecificRequest{
+		Datacenter: "dc2",
+	}
+	var out structs.IndexedNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Nodes) == 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+	if n := s1.connPool.Dials(); n != dials {
+		t.Fatalf("bad: %d != %d", n, dials)
+	}
+
+	// Dropping the connection should get it warmed up again on the next
+	// round.
+	dials = s1.connPool.Dials()
+	s1.connPool.Lock()
+	conn := s1.connPool.pool[target]
+	s1.connPool.Unlock()
+	s1.connPool.clearConn(conn)
+	s1.triggerWANWarming()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		s1.connPool.Lock()
+		_, ok := s1.connPool.pool[target]
+		s1.connPool.Unlock()
+		return ok, nil
+	}); err != nil {
+		t.Fatalf("connection to dc2 was never rewarmed")
+	}
+	if n := s1.connPool.Dials(); n != dials+1 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestServer_WANConnectionWarming_MaxDCs(t *testing.T) {
+	// Leave the warming loop off so we can run a single round ourselves;
+	// the closest datacenter can change from round to round.
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.WANConnectionWarmingMaxDCs = 1
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerDC(t, "dc2")
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	dir3, s3 := testServerDC(t, "dc3")
+	defer os.RemoveAll(dir3)
+	defer s3.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := s3.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s2.RPC, "dc2")
+	testutil.WaitForLeader(t, s3.RPC, "dc3")
+
+	// Only one of the remote datacenters should get a connection.
+	targets := []string{s2.config.RPCAddr.String(), s3.config.RPCAddr.String()}
+	count := func() int {
+		s1.connPool.Lock()
+		defer s1.connPool.Unlock()
+
+		num := 0
+		for _, target := range targets {
+			if _, ok := s1.connPool.pool[target]; ok {
+				num++
+			}
+		}
+		return num
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		dcs, err := s1.router.GetDatacentersByDistance()
+		return len(dcs) == 3, err
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s1.warmWANConnections()
+	if num := count(); num != 1 {
+		t.Fatalf("bad: %d", num)
+	}
+}
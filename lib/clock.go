@@ -0,0 +1,343 @@
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is used to tell the time and to set timers. Timer-driven subsystems
+// take one of these instead of using the time package directly so they can be
+// driven synthetically in tests, or paused while debugging.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for the duration to elapse and then sends the current
+	// time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+
+	// AfterFunc waits for the duration to elapse and then calls f.
+	AfterFunc(d time.Duration, f func()) Timer
+
+	// NewTicker returns a ticker that sends the time on its channel after
+	// each tick of the given period.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a single event made by a Clock, see time.Timer.
+type Timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker delivers ticks at intervals, see time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// RealClock is a Clock that uses the time package.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (RealClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func (RealClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{time.NewTicker(d)}
+}
+
+// realTicker adapts a time.Ticker to the Ticker interface.
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t *realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// FakeClock is a Clock that only moves when told to with Advance, which makes
+// it possible to test timer-driven code without real sleeps. Unlike the time
+// package, timer functions are run synchronously on the goroutine calling
+// Advance, so their effects are visible once Advance returns.
+type FakeClock struct {
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+	lock   sync.Mutex
+}
+
+// NewFakeClock returns a FakeClock that starts at the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now:    now,
+		timers: make(map[*fakeTimer]struct{}),
+	}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.AfterFunc(d, func() {
+		ch <- c.Now()
+	})
+	return ch
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	t := &fakeTimer{clock: c, fn: f}
+	t.Reset(d)
+	return t
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	ch := make(chan time.Time, 1)
+	t := &fakeTimer{clock: c, period: d}
+	t.fn = func() {
+		// Drop ticks for slow receivers, like time.Ticker does.
+		select {
+		case ch <- c.Now():
+		default:
+		}
+	}
+	t.Reset(d)
+	return &fakeTicker{t, ch}
+}
+
+// Pending returns the number of timers and tickers that are waiting to fire.
+func (c *FakeClock) Pending() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.timers)
+}
+
+// Advance moves the clock forward by the given duration, firing any timers
+// that come due along the way in order.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	end := c.now.Add(d)
+	for {
+		// Find the next timer that's due.
+		var next *fakeTimer
+		for t := range c.timers {
+			if !t.when.After(end) && (next == nil || t.when.Before(next.when)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		// Move time up to the timer and reschedule or retire it before
+		// running it, since it may want to reset itself.
+		c.now = next.when
+		if next.period > 0 {
+			next.when = next.when.Add(next.period)
+		} else {
+			delete(c.timers, next)
+		}
+
+		c.lock.Unlock()
+		next.fn()
+		c.lock.Lock()
+	}
+	c.now = end
+	c.lock.Unlock()
+}
+
+// fakeTimer is a timer or ticker made by a FakeClock.
+type fakeTimer struct {
+	clock  *FakeClock
+	when   time.Time
+	period time.Duration
+	fn     func()
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	_, ok := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return ok
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	_, ok := t.clock.timers[t]
+	t.when = t.clock.now.Add(d)
+	t.clock.timers[t] = struct{}{}
+	return ok
+}
+
+// fakeTicker is a ticker made by a FakeClock.
+type fakeTicker struct {
+	timer *fakeTimer
+	ch    chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTicker) Stop() {
+	t.timer.Stop()
+}
+
+// PausableClock wraps a Clock so that its timers can be paused. While it's
+// paused, timer functions that come due are held until it's resumed, and
+// ticks are dropped. This is useful for freezing a server's background
+// activity while debugging an incident.
+type PausableClock struct {
+	Clock
+
+	paused bool
+	held   map[*pausableTimer]struct{}
+	lock   sync.Mutex
+}
+
+// NewPausableClock returns a PausableClock wrapping the given Clock.
+func NewPausableClock(clock Clock) *PausableClock {
+	return &PausableClock{
+		Clock: clock,
+		held:  make(map[*pausableTimer]struct{}),
+	}
+}
+
+// Pause holds back any timers from firing until Resume is called.
+func (p *PausableClock) Pause() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.paused = true
+}
+
+// Resume lets timers fire again, and runs any that came due while the clock
+// was paused.
+func (p *PausableClock) Resume() {
+	p.lock.Lock()
+	held := p.held
+	p.held = make(map[*pausableTimer]struct{})
+	p.paused = false
+	p.lock.Unlock()
+
+	for t := range held {
+		go t.fn()
+	}
+}
+
+// Paused returns true if the clock is paused.
+func (p *PausableClock) Paused() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.paused
+}
+
+func (p *PausableClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	p.AfterFunc(d, func() {
+		ch <- p.Now()
+	})
+	return ch
+}
+
+func (p *PausableClock) AfterFunc(d time.Duration, f func()) Timer {
+	t := &pausableTimer{clock: p, fn: f}
+	t.Timer = p.Clock.AfterFunc(d, t.fire)
+	return t
+}
+
+func (p *PausableClock) NewTicker(d time.Duration) Ticker {
+	t := &pausableTicker{
+		Ticker: p.Clock.NewTicker(d),
+		ch:     make(chan time.Time, 1),
+		stopCh: make(chan struct{}),
+	}
+	go func() {
+		for {
+			select {
+			case now := <-t.Ticker.C():
+				if p.Paused() {
+					continue
+				}
+				select {
+				case t.ch <- now:
+				default:
+				}
+			case <-t.stopCh:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+// pausableTimer is a timer made by a PausableClock.
+type pausableTimer struct {
+	Timer
+	clock *PausableClock
+	fn    func()
+}
+
+// fire runs the timer function, or holds it if the clock is paused.
+func (t *pausableTimer) fire() {
+	t.clock.lock.Lock()
+	if t.clock.paused {
+		t.clock.held[t] = struct{}{}
+		t.clock.lock.Unlock()
+		return
+	}
+	t.clock.lock.Unlock()
+	t.fn()
+}
+
+func (t *pausableTimer) Stop() bool {
+	// A held timer hasn't really fired yet, so it can still be stopped.
+	t.clock.lock.Lock()
+	_, held := t.clock.held[t]
+	delete(t.clock.held, t)
+	t.clock.lock.Unlock()
+	return t.Timer.Stop() || held
+}
+
+func (t *pausableTimer) Reset(d time.Duration) bool {
+	t.clock.lock.Lock()
+	_, held := t.clock.held[t]
+	delete(t.clock.held, t)
+	t.clock.lock.Unlock()
+	return t.Timer.Reset(d) || held
+}
+
+// pausableTicker is a ticker made by a PausableClock.
+type pausableTicker struct {
+	Ticker
+	ch       chan time.Time
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func (t *pausableTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *pausableTicker) Stop() {
+	t.Ticker.Stop()
+	t.stopOnce.Do(func() {
+		close(t.stopCh)
+	})
+}
@@ -0,0 +1,114 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock_AfterFunc(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewFakeClock(start)
+
+	var fired []int
+	clock.AfterFunc(2*time.Second, func() { fired = append(fired, 2) })
+	clock.AfterFunc(1*time.Second, func() { fired = append(fired, 1) })
+	stopped := clock.AfterFunc(1500*time.Millisecond, func() { fired = append(fired, 99) })
+	if n := clock.Pending(); n != 3 {
+		t.Fatalf("bad: %d", n)
+	}
+	if !stopped.Stop() {
+		t.Fatalf("should have been pending")
+	}
+
+	clock.Advance(time.Second - time.Nanosecond)
+	if len(fired) != 0 {
+		t.Fatalf("bad: %v", fired)
+	}
+
+	// Timers should fire in order, and see the time they were due.
+	var now time.Time
+	clock.AfterFunc(2*time.Second, func() { now = clock.Now() })
+	clock.Advance(3 * time.Second)
+	if len(fired) != 2 || fired[0] != 1 || fired[1] != 2 {
+		t.Fatalf("bad: %v", fired)
+	}
+	if want := start.Add(3*time.Second - time.Nanosecond); !now.Equal(want) {
+		t.Fatalf("bad: %v", now)
+	}
+	if clock.Pending() != 0 {
+		t.Fatalf("should not be pending")
+	}
+	if stopped.Stop() {
+		t.Fatalf("should not have been pending")
+	}
+}
+
+func TestFakeClock_Ticker(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	ticker := clock.NewTicker(time.Second)
+
+	clock.Advance(time.Second)
+	select {
+	case <-ticker.C():
+	default:
+		t.Fatalf("should have ticked")
+	}
+
+	// Slow receivers only see a single tick.
+	clock.Advance(5 * time.Second)
+	<-ticker.C()
+	select {
+	case <-ticker.C():
+		t.Fatalf("should have dropped ticks")
+	default:
+	}
+
+	ticker.Stop()
+	clock.Advance(5 * time.Second)
+	select {
+	case <-ticker.C():
+		t.Fatalf("should be stopped")
+	default:
+	}
+}
+
+func TestPausableClock(t *testing.T) {
+	fake := NewFakeClock(time.Unix(1000, 0))
+	clock := NewPausableClock(fake)
+
+	doneCh := make(chan struct{}, 1)
+	clock.AfterFunc(time.Second, func() { doneCh <- struct{}{} })
+	stopped := clock.AfterFunc(time.Second, func() { t.Errorf("should not fire") })
+
+	clock.Pause()
+	if !clock.Paused() {
+		t.Fatalf("should be paused")
+	}
+	fake.Advance(2 * time.Second)
+	select {
+	case <-doneCh:
+		t.Fatalf("should be held")
+	default:
+	}
+
+	// A held timer can still be stopped.
+	if !stopped.Stop() {
+		t.Fatalf("should have been held")
+	}
+
+	clock.Resume()
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatalf("should have fired")
+	}
+
+	// Timers run straight away once resumed.
+	clock.AfterFunc(time.Second, func() { doneCh <- struct{}{} })
+	fake.Advance(time.Second)
+	select {
+	case <-doneCh:
+	default:
+		t.Fatalf("should have fired")
+	}
+}